@@ -0,0 +1,39 @@
+package main
+
+// =================================================================================================
+// --- aggregate.go --- (Counts and Aggregates over Key Ranges)
+// =================================================================================================
+
+// Aggregates over the index key only need the leaf pages: values are never decoded, so COUNT,
+// MIN, MAX and SUM over the id column don't have to fetch a single row from the data file.
+// CountRange doesn't even need the leaves, thanks to the subtree counts (see orderstat.go).
+
+// RangeAggregate holds the aggregates of the keys in a range. Min and Max are only meaningful
+// when Count > 0.
+type RangeAggregate struct {
+	Count    int
+	Min, Max int
+	Sum      int
+}
+
+// AggregateRange returns the count, minimum, maximum and sum of the keys in [startKey, endKey].
+func (t *BPlusTree) AggregateRange(startKey, endKey int) (RangeAggregate, error) {
+	var agg RangeAggregate
+	if startKey > endKey {
+		return agg, nil
+	}
+	c, err := t.Seek(startKey)
+	if err != nil {
+		return agg, err
+	}
+	for c.Next() && c.Key() <= endKey {
+		key := c.Key()
+		if agg.Count == 0 {
+			agg.Min = key
+		}
+		agg.Count++
+		agg.Max = key
+		agg.Sum += key
+	}
+	return agg, c.Err()
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"cmp"
+	"encoding/binary"
+	"maps"
+	"slices"
+	"time"
+)
+
+// =================================================================================================
+// --- aries.go --- (ARIES Recovery: Stealing, Undo and Redo)
+// =================================================================================================
+
+// A transaction buffers the pages it writes until it commits (see txn.go), so the log used to hold
+// only the changes of committed transactions, and recovery only had to redo them. That caps a
+// transaction at what fits in memory. Past maxTxPages buffered pages, a transaction steals them
+// instead: it logs an update record for each, holding the page after the change and before it,
+// and hands the page to the buffer pool, which may write it to the index file before the
+// transaction commits, or even if it never does. Recovery then runs the three passes of ARIES:
+//
+//	analysis  read the log to find the transactions that committed, those that rolled back, and
+//	          the losers, which did neither. The last checkpoint gives the LSN redo starts at.
+//	redo      repeat history from there: write the page of every update and compensation record,
+//	          whichever transaction logged it, and the page images and rows of the committed
+//	          transactions.
+//	undo      roll the losers back, latest update first, by writing the page each update found.
+//	          Every undo is logged as a compensation record (CLR) naming the loser's next update
+//	          to undo, so a crash during recovery never undoes an update twice. An abort record
+//	          ends each loser.
+//
+// Rollback undoes the pages a transaction stole the same way, and RollbackTo those it stole since
+// the savepoint (see savepoint.go). Every record logs whole pages, so writing one again is
+// harmless and redo needn't compare LSNs with the pages. The buffer pool keeps the LSN of the last
+// logged change to each cached page, its pageLSN, for the WAL rule instead: the log is forced to
+// disk up to there before the page is written out.
+//
+// `go run . check` crashes a DB at random page writes, in the middle of transactions, rollbacks
+// and savepoints, and checks that recovery leaves a valid tree holding exactly the committed rows.
+
+// defaultMaxTxPages is the number of pages a transaction buffers before it steals them.
+const defaultMaxTxPages = 256
+
+// stolenPage is a page a transaction stole: the LSN of its update record, and the page before.
+type stolenPage struct {
+	lsn    uint64
+	pageID PageID
+	before *Page
+}
+
+// maybeSteal steals the transaction's buffered pages once there are more than maxTxPages.
+func (tx *Tx) maybeSteal() error {
+	if tx.noSteal || len(tx.db.tree.txPages) <= tx.db.maxTxPages {
+		return nil
+	}
+	return tx.steal()
+}
+
+// steal logs an update record for every page the transaction buffers, in page order, and hands the
+// pages to the buffer pool. The transaction's begin record is logged first, unless it already is.
+func (tx *Tx) steal() error {
+	db, tree := tx.db, tx.db.tree
+	if tx.beginLSN == 0 {
+		lsn, err := db.wal.Append(&walRecord{txID: tx.id, kind: walBegin})
+		if err != nil {
+			return err
+		}
+		tx.beginLSN = lsn
+	}
+	for _, pageID := range slices.Sorted(maps.Keys(tree.txPages)) {
+		page := tree.txPages[pageID]
+		before, err := tx.pageBefore(pageID)
+		if err != nil {
+			return err
+		}
+		lsn, err := db.wal.Append(&walRecord{txID: tx.id, kind: walPageUpdate, target: int64(pageID), data: slices.Concat(page[:], before[:])})
+		if err != nil {
+			return err
+		}
+		// Once logged, the update is undone on rollback, whether the pool got the page or not.
+		tx.stolen = append(tx.stolen, stolenPage{lsn, pageID, before})
+		if int64(pageID) >= tx.numPages {
+			if tx.newStolen == nil {
+				tx.newStolen = make(map[PageID]bool)
+			}
+			tx.newStolen[pageID] = true
+		}
+		if tree.txUndo != nil {
+			tree.txUndo = append(tree.txUndo, pageUndo{pageID, page})
+		}
+		delete(tree.txPages, pageID)
+		if err := tree.pool.writeLoggedPage(pageID, page, lsn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pageBefore returns page pageID as it is outside the transaction: the buffer pool's, or a
+// released page if the transaction allocated it and hasn't stolen it before.
+func (tx *Tx) pageBefore(pageID PageID) (*Page, error) {
+	if int64(pageID) >= tx.numPages && !tx.newStolen[pageID] {
+		return newReleasedPage(), nil
+	}
+	return tx.db.tree.pool.ReadPage(pageID, new(Page))
+}
+
+// undoStolen undoes the pages the transaction stole from the nth on, latest first: it logs a
+// compensation record for each and hands the page before to the buffer pool.
+func (tx *Tx) undoStolen(n int) error {
+	for i := len(tx.stolen) - 1; i >= n; i-- {
+		s := tx.stolen[i]
+		var undoNext uint64
+		if i > 0 {
+			undoNext = tx.stolen[i-1].lsn
+		}
+		lsn, err := tx.db.wal.Append(compensation(tx.id, s.pageID, undoNext, s.before))
+		if err != nil {
+			return err
+		}
+		tx.stolen = tx.stolen[:i]
+		if err := tx.db.tree.pool.writeLoggedPage(s.pageID, s.before, lsn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// keptPages returns how many pages the Pager keeps when a rollback goes back to numPages: the
+// pages the transaction allocated and stole stay allocated, released once undone.
+func (tx *Tx) keptPages(numPages int64) int64 {
+	for pageID := range tx.newStolen {
+		numPages = max(numPages, int64(pageID)+1)
+	}
+	return numPages
+}
+
+// compensation returns the compensation record of transaction txID that restores page pageID to
+// page, where undoNext is the LSN of the transaction's next update to undo, or 0.
+//
+//	| undoNext uint64 | page |
+func compensation(txID uint64, pageID PageID, undoNext uint64, page *Page) *walRecord {
+	data := binary.LittleEndian.AppendUint64(make([]byte, 0, 8+PageSize), undoNext)
+	return &walRecord{txID: txID, kind: walCompensation, target: int64(pageID), data: append(data, page[:]...)}
+}
+
+// loggedPage returns the page an update or compensation record writes: the page after the update,
+// or as undoing one restored it.
+func loggedPage(record walRecord) (*Page, error) {
+	data := record.data
+	if record.kind == walCompensation {
+		if len(data) < 8 {
+			return nil, errCorruptWALRecord
+		}
+		data = data[8:]
+	}
+	if len(data) < PageSize {
+		return nil, errCorruptWALRecord
+	}
+	return (*Page)(data[:PageSize]), nil
+}
+
+// recover runs the analysis, redo and undo passes over the log, writing to pager directly.
+//
+// A transaction that was prepared as part of a distributed transaction, but neither committed nor
+// aborted, is in doubt: it commits if decided says the distributed transaction did, and is undone
+// as a loser otherwise. Either way the outcome is logged, so it is only decided once.
+func (db *DB) recover(pager *Pager, records []walRecord, decided func(globalID uint64) bool) error {
+	// Analysis.
+	committed := make(map[uint64]bool)
+	ended := make(map[uint64]bool)          // committed or aborted
+	prepared := make(map[uint64]uint64)     // local transaction ID -> distributed transaction ID
+	updates := make(map[uint64][]walRecord) // the updates of each transaction left to undo, in log order
+	var redoLSN uint64
+	for _, record := range records {
+		db.nextTxID = max(db.nextTxID, record.txID+1)
+		switch record.kind {
+		case walCommit:
+			committed[record.txID], ended[record.txID] = true, true
+		case walAbort:
+			ended[record.txID] = true
+		case walCheckpoint:
+			redoLSN = uint64(record.target)
+		case walPrepare:
+			prepared[record.txID] = uint64(record.target)
+		case walPageUpdate:
+			if len(record.data) != 2*PageSize {
+				return errCorruptWALRecord
+			}
+			updates[record.txID] = append(updates[record.txID], record)
+		case walCompensation:
+			if len(record.data) != 8+PageSize {
+				return errCorruptWALRecord
+			}
+			// The updates after undoNext have been undone.
+			undoNext := binary.LittleEndian.Uint64(record.data)
+			u := updates[record.txID]
+			for len(u) > 0 && u[len(u)-1].lsn > undoNext {
+				u = u[:len(u)-1]
+			}
+			updates[record.txID] = u
+		}
+	}
+	for _, txID := range slices.Sorted(maps.Keys(prepared)) {
+		if ended[txID] || decided == nil || !decided(prepared[txID]) {
+			continue
+		}
+		commitTime := binary.LittleEndian.AppendUint64(nil, uint64(time.Now().UnixNano()))
+		if _, err := db.wal.Append(&walRecord{txID: txID, kind: walCommit, data: commitTime}); err != nil {
+			return err
+		}
+		if err := db.wal.Sync(); err != nil {
+			return err
+		}
+		committed[txID], ended[txID] = true, true
+	}
+	var losers []uint64
+	for txID := range updates {
+		if !ended[txID] {
+			losers = append(losers, txID)
+		}
+	}
+	for txID := range prepared {
+		if _, ok := updates[txID]; !ok && !ended[txID] {
+			losers = append(losers, txID)
+		}
+	}
+	slices.Sort(losers)
+	for _, record := range records {
+		if record.kind == walReplicated && committed[record.txID] {
+			db.replicatedLSN.Store(uint64(record.target))
+		}
+	}
+
+	// Redo.
+	for _, record := range records {
+		if record.lsn < redoLSN {
+			continue
+		}
+		switch {
+		case record.kind == walPageUpdate || record.kind == walCompensation:
+			page, err := loggedPage(record)
+			if err != nil {
+				return err
+			}
+			if err := pager.WritePage(PageID(record.target), page); err != nil {
+				return err
+			}
+		case record.kind == walPageImage && committed[record.txID]:
+			if err := pager.WritePage(PageID(record.target), (*Page)(record.data)); err != nil {
+				return err
+			}
+		case record.kind == walHeapAppend && committed[record.txID]:
+			if err := db.heap.WriteRow(record.target, record.data); err != nil {
+				return err
+			}
+		}
+	}
+	if err := db.heap.Sync(); err != nil {
+		return err
+	}
+
+	// Undo. The compensation and abort records are forced to disk before the pages are written.
+	var undo []walRecord
+	for _, txID := range losers {
+		undo = append(undo, updates[txID]...)
+	}
+	slices.SortFunc(undo, func(a, b walRecord) int { return cmp.Compare(b.lsn, a.lsn) })
+	for _, u := range undo {
+		remaining := updates[u.txID][:len(updates[u.txID])-1]
+		updates[u.txID] = remaining
+		var undoNext uint64
+		if len(remaining) > 0 {
+			undoNext = remaining[len(remaining)-1].lsn
+		}
+		if _, err := db.wal.Append(compensation(u.txID, PageID(u.target), undoNext, (*Page)(u.data[PageSize:]))); err != nil {
+			return err
+		}
+	}
+	for _, txID := range losers {
+		if _, err := db.wal.Append(&walRecord{txID: txID, kind: walAbort}); err != nil {
+			return err
+		}
+	}
+	if len(losers) == 0 {
+		return nil
+	}
+	if err := db.wal.Sync(); err != nil {
+		return err
+	}
+	for _, u := range undo {
+		if err := pager.WritePage(PageID(u.target), (*Page)(u.data[PageSize:])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
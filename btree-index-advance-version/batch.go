@@ -0,0 +1,136 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"slices"
+)
+
+// =================================================================================================
+// --- batch.go --- (Batch Insert)
+// =================================================================================================
+
+// Inserting keys one at a time reads and writes the target leaf, and every page above it whose
+// entry count changes, once per key. InsertBatch sorts the batch first, so keys that belong in the
+// same leaf arrive next to each other. Each such run is merged into its leaf with one read and one
+// write of the leaf, and the ancestors' counts are adjusted once per run instead of once per key.
+// Only a full leaf falls back to the regular split path, one key at a time, after which the rest
+// of the run continues in whichever half it now belongs to.
+
+// KV is a key/value pair for InsertBatch.
+type KV struct {
+	Key   int
+	Value int64
+}
+
+// InsertBatch inserts all pairs, in any order. The keys must be unique, within the batch and in
+// the tree. Duplicates within the batch are reported before anything is written. A key already in
+// the tree stops the batch there, leaving the pairs with smaller keys inserted. Either is reported
+// as a *ConstraintViolation.
+func (t *BPlusTree) InsertBatch(pairs []KV) error {
+	return t.InsertBatchContext(context.Background(), pairs)
+}
+
+// InsertBatchContext is InsertBatch that stops once ctx is done, checking it before each run, and
+// then returns ctx.Err(). The runs merged until then stay inserted.
+func (t *BPlusTree) InsertBatchContext(ctx context.Context, pairs []KV) error {
+	sorted := sortPairs(pairs)
+	if violations := t.batchDuplicates(sorted); len(violations) > 0 {
+		return violations[0]
+	}
+
+	for len(sorted) > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		leafPageID, leafPage, bounds, err := t.findLeafPageBounded(sorted[0].Key)
+		if err != nil {
+			return err
+		}
+		// The run is the prefix of the batch that belongs in this leaf, cut short by the room
+		// left in it.
+		n := 0
+		for n < len(sorted) && n < t.degree-1-int(getNumKeys(leafPage)) && bounds.contains(sorted[n].Key) {
+			n++
+		}
+		if n == 0 {
+			// The leaf is full: insert the first pair alone, splitting the leaf, and look
+			// up the leaf again for the rest.
+			n = 1
+		}
+		if err := t.mergeIntoLeaf(leafPageID, leafPage, sorted[:n]); err != nil {
+			return err
+		}
+		sorted = sorted[n:]
+	}
+	return nil
+}
+
+// sortPairs returns a copy of pairs sorted by key. Pairs with the same key keep their order.
+func sortPairs(pairs []KV) []KV {
+	sorted := slices.Clone(pairs)
+	slices.SortStableFunc(sorted, func(a, b KV) int { return cmp.Compare(a.Key, b.Key) })
+	return sorted
+}
+
+// batchDuplicates returns a violation for every pair of a sorted batch whose key an earlier pair
+// already has.
+func (t *BPlusTree) batchDuplicates(sorted []KV) ConstraintViolations {
+	var violations ConstraintViolations
+	for i := 1; i < len(sorted); i++ {
+		if sorted[i].Key != sorted[i-1].Key {
+			continue
+		}
+		first := i - 1
+		for first > 0 && sorted[first-1].Key == sorted[i].Key {
+			first--
+		}
+		violations = append(violations, &ConstraintViolation{Index: t.Name(), Key: sorted[i].Key, Existing: sorted[first].Value, Rejected: sorted[i].Value})
+	}
+	return violations
+}
+
+// mergeIntoLeaf adds a sorted run of pairs to a leaf page, then writes the page once and updates
+// the ancestors' counts once. The leaf must have room for the whole run, unless the run is a single
+// pair, which splits a full leaf the way Insert does.
+func (t *BPlusTree) mergeIntoLeaf(pageID PageID, page *Page, run []KV) error {
+	keys, cells := readLeafEntries(page)
+	for _, kv := range run {
+		if i, found := slices.BinarySearch(keys, kv.Key); found {
+			return t.duplicateKey(page, i, encodeInt64Value(kv.Value))
+		}
+	}
+	if t.bloom != nil {
+		for _, kv := range run {
+			t.bloom.Add(kv.Key)
+		}
+	}
+	if len(keys) == t.degree-1 {
+		cell, err := t.newLeafCell(run[0].Key, encodeInt64Value(run[0].Value))
+		if err != nil {
+			return err
+		}
+		return t.splitAndInsertLeaf(pageID, page, run[0].Key, cell)
+	}
+
+	merged := make([][]byte, 0, len(cells)+len(run))
+	i := 0
+	for _, kv := range run {
+		for i < len(keys) && keys[i] < kv.Key {
+			merged = append(merged, cells[i])
+			i++
+		}
+		cell, err := t.newLeafCell(kv.Key, encodeInt64Value(kv.Value))
+		if err != nil {
+			return err
+		}
+		merged = append(merged, cell)
+	}
+	merged = append(merged, cells[i:]...)
+
+	writeLeafEntries(page, merged)
+	if err := t.writePage(pageID, page); err != nil {
+		return err
+	}
+	return t.adjustAncestorCounts(pageID, page, len(run))
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"os/exec"
+)
+
+// =================================================================================================
+// --- bench.go --- (Benchmark Suite)
+// =================================================================================================
+
+// The benchmarks are Benchmark functions in bench_test.go. `go run . bench` is a shortcut that runs
+// them with `go test`, from this module's directory.
+
+// benchCommand implements `go run . bench [-bench regexp] [-sizes 10000,100000] [-workers 1,4]
+// [-disk ssd,hdd]`. It runs the benchmarks that match -bench with `go test -bench -benchmem` and
+// passes the other flags on to them (see bench_test.go).
+func benchCommand(args []string) error {
+	flags := flag.NewFlagSet("bench", flag.ExitOnError)
+	pattern := flags.String("bench", ".", "regular expression selecting the benchmarks to run")
+	sizes := flags.String("sizes", "", "comma-separated dataset sizes (default 10000,100000,1000000)")
+	workers := flags.String("workers", "", "comma-separated worker counts for the parallel build (default 1,4)")
+	disk := flags.String("disk", "", "comma-separated simulated disk profiles to run on instead of the real stores: memory, ssd, hdd")
+	flags.Parse(args)
+
+	cmd := exec.Command("go", "test", "-run", "^$", "-bench", *pattern, "-benchmem", "-timeout", "0", ".",
+		"-args", "-sizes="+*sizes, "-workers="+*workers, "-disk="+*disk)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	return cmd.Run()
+}
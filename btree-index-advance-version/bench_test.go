@@ -0,0 +1,800 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// The benchmark suite runs with `go test -bench . -benchmem`, or `go run . bench` (see bench.go).
+// Each benchmark has a sub-benchmark for every store, dataset size and insert order, named
+// <store>/<order>/<size>: "OnDisk" is the ReadAt-based Pager, "Mmap" the memory-mapped one, and
+// "Simulated/<profile>" a simulated device (see pager_latency.go). The flags below pick the sizes,
+// the worker counts of the parallel build, and simulated devices instead of the real stores:
+//
+//	go test -run '^$' -bench Lookup -benchmem -args -sizes 10000 -disk ssd
+//
+// The datasets and metrics mirror the benchmark suite of the in-memory version
+// (btree-index-simple-version/bench_test.go) so the two sets of numbers can be compared side by
+// side.
+
+var (
+	sizesFlag   = flag.String("sizes", "", "comma-separated dataset sizes (default 10000,100000,1000000)")
+	workersFlag = flag.String("workers", "", "comma-separated worker counts for the parallel build (default 1,4)")
+	diskFlag    = flag.String("disk", "", "comma-separated simulated disk profiles to run on instead of the real stores: memory, ssd, hdd")
+)
+
+// benchDegree gives nodes a realistic fan-out instead of the tiny degree used by the demo.
+const benchDegree = 128
+
+// benchRangeWidth is the number of consecutive keys read by each range scan.
+const benchRangeWidth = 1000
+
+var defaultBenchSizes = []int{10_000, 100_000, 1_000_000}
+
+// defaultBenchWorkers are the worker counts the parallel build is measured with.
+var defaultBenchWorkers = []int{1, 4}
+
+// benchSortRunPairs is the run length of the external sort build, short enough that every dataset
+// is sorted in several runs.
+const benchSortRunPairs = 1 << 12
+
+// benchMultiGetSize is the number of keys per MultiGet in the batch lookup benchmark.
+const benchMultiGetSize = 100
+
+// benchWriterKeys is the number of keys the writer of the concurrent lookup benchmarks inserts
+// before it deletes them again.
+const benchWriterKeys = 1000
+
+// benchTxSize is the number of inserts per transaction in the durability benchmarks.
+const benchTxSize = 100
+
+// benchFlushInterval is how often the background flusher runs in the write-back insert benchmark.
+const benchFlushInterval = 50 * time.Millisecond
+
+// generateKeys returns the keys 0..n-1, either in ascending order or shuffled with a fixed seed
+// so that every run inserts them in the same order.
+func generateKeys(n int, random bool) []int {
+	if !random {
+		keys := make([]int, n)
+		for i := range keys {
+			keys[i] = i
+		}
+		return keys
+	}
+	return rand.New(rand.NewSource(42)).Perm(n)
+}
+
+// benchStore is a PageStore implementation the suite runs against.
+type benchStore struct {
+	name string
+	open func(path string) (PageStore, error)
+}
+
+var benchStores = []benchStore{
+	{"OnDisk", func(path string) (PageStore, error) { return NewPager(path) }},
+	{"Mmap", func(path string) (PageStore, error) { return NewMmapPager(path) }},
+}
+
+// simulatedBenchStore is a MemPageStore behind a LatencyPageStore with the given profile, which
+// makes the device the only difference between two runs. It ignores the path.
+func simulatedBenchStore(profile DiskProfile) benchStore {
+	return benchStore{"Simulated/" + profile.Name, func(string) (PageStore, error) {
+		return NewLatencyPageStore(NewMemPageStore(), profile), nil
+	}}
+}
+
+// newBenchTree creates an empty tree backed by a fresh temporary index file in the given store.
+// The returned cleanup function drains the buffer pool, then closes and removes the file.
+func newBenchTree(store benchStore) (*BPlusTree, func(), error) {
+	file, err := os.CreateTemp("", "bench-*.idx")
+	if err != nil {
+		return nil, nil, err
+	}
+	path := file.Name()
+	file.Close()
+
+	pager, err := store.open(path)
+	if err != nil {
+		os.Remove(path)
+		return nil, nil, err
+	}
+	tree := NewBPlusTree(pager, benchDegree)
+	cleanup := func() {
+		tree.BufferPool().Close()
+		pager.Close()
+		os.Remove(path)
+	}
+	return tree, cleanup, nil
+}
+
+// buildBenchTree creates a tree holding the given keys. Each key's value is derived from the key.
+func buildBenchTree(store benchStore, keys []int) (*BPlusTree, func(), error) {
+	tree, cleanup, err := newBenchTree(store)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, k := range keys {
+		if err := tree.Insert(k, int64(k)*10); err != nil {
+			cleanup()
+			return nil, nil, err
+		}
+	}
+	return tree, cleanup, nil
+}
+
+// benchmarkInsert measures inserting keys into an empty tree whose leaves split by policy, and
+// reports how full the leaves end up. With writeBack, the tree's buffer pool runs its background
+// flusher, so the inserts don't wait for their pages to reach the disk; draining the pool
+// afterwards is not timed.
+func benchmarkInsert(store benchStore, keys []int, writeBack bool, policy SplitPolicy) func(b *testing.B) {
+	return func(b *testing.B) {
+		counter := &pageCounter{}
+		var fill float64
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			tree, cleanup, err := newBenchTree(store)
+			if err != nil {
+				b.Fatal(err)
+			}
+			tree.SetTracer(counter)
+			if err := tree.SetSplitPolicy(policy); err != nil {
+				b.Fatal(err)
+			}
+			if writeBack {
+				if err := tree.BufferPool().StartFlusher(benchFlushInterval, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StartTimer()
+
+			for _, k := range keys {
+				if err := tree.Insert(k, int64(k)*10); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			b.StopTimer()
+			stats, err := tree.FragmentationStats()
+			if err != nil {
+				b.Fatal(err)
+			}
+			fill = stats.Fill
+			cleanup()
+			b.StartTimer()
+		}
+		inserts := float64(b.N * len(keys))
+		b.ReportMetric(inserts/b.Elapsed().Seconds(), "inserts/s")
+		b.ReportMetric(float64(counter.touched())/inserts, "pages/insert")
+		b.ReportMetric(fill*100, "%full")
+	}
+}
+
+// benchmarkInsertBatch measures inserting the same keys into an empty tree with one InsertBatch
+// call, for comparison with benchmarkInsert.
+func benchmarkInsertBatch(store benchStore, keys []int) func(b *testing.B) {
+	pairs := make([]KV, len(keys))
+	for i, k := range keys {
+		pairs[i] = KV{Key: k, Value: int64(k) * 10}
+	}
+	return func(b *testing.B) {
+		counter := &pageCounter{}
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			tree, cleanup, err := newBenchTree(store)
+			if err != nil {
+				b.Fatal(err)
+			}
+			tree.SetTracer(counter)
+			b.StartTimer()
+
+			if err := tree.InsertBatch(pairs); err != nil {
+				b.Fatal(err)
+			}
+
+			b.StopTimer()
+			cleanup()
+			b.StartTimer()
+		}
+		inserts := float64(b.N * len(keys))
+		b.ReportMetric(inserts/b.Elapsed().Seconds(), "inserts/s")
+		b.ReportMetric(float64(counter.touched())/inserts, "pages/insert")
+	}
+}
+
+// pairSource is a DataSource over records already in memory, so that the build benchmarks don't
+// measure parsing a data file.
+type pairSource struct {
+	pairs []KV
+}
+
+func (s *pairSource) NextRecord() (int, int64, error) {
+	if len(s.pairs) == 0 {
+		return 0, 0, io.EOF
+	}
+	kv := s.pairs[0]
+	s.pairs = s.pairs[1:]
+	return kv.Key, kv.Value, nil
+}
+
+func (s *pairSource) Close() error { return nil }
+
+// benchmarkBuild measures building an empty tree from the same keys with BuildIndexWith and opts:
+// bottom-up with workers, bottom-up through an external sort, or otherwise through InsertBatch.
+func benchmarkBuild(store benchStore, keys []int, opts BuildOptions) func(b *testing.B) {
+	pairs := make([]KV, len(keys))
+	for i, k := range keys {
+		pairs[i] = KV{Key: k, Value: int64(k) * 10}
+	}
+	return func(b *testing.B) {
+		counter := &pageCounter{}
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			tree, cleanup, err := newBenchTree(store)
+			if err != nil {
+				b.Fatal(err)
+			}
+			tree.SetTracer(counter)
+			b.StartTimer()
+
+			if _, err := BuildIndexWith(tree, &pairSource{pairs}, opts); err != nil {
+				b.Fatal(err)
+			}
+
+			b.StopTimer()
+			cleanup()
+			b.StartTimer()
+		}
+		inserts := float64(b.N * len(keys))
+		b.ReportMetric(inserts/b.Elapsed().Seconds(), "inserts/s")
+		b.ReportMetric(float64(counter.touched())/inserts, "pages/insert")
+	}
+}
+
+func benchmarkLookup(tree *BPlusTree, keys []int) func(b *testing.B) {
+	return func(b *testing.B) {
+		counter := &pageCounter{}
+		tree.SetTracer(counter)
+		defer tree.SetTracer(nil)
+		r := rand.New(rand.NewSource(7))
+
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			key := keys[r.Intn(len(keys))]
+			if _, found, err := tree.Search(key); err != nil || !found {
+				b.Fatalf("lookup of key %d failed: found=%v err=%v", key, found, err)
+			}
+		}
+		b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "lookups/s")
+		b.ReportMetric(float64(counter.touched())/float64(b.N), "pages/lookup")
+	}
+}
+
+// benchmarkMultiGet looks up random keys in batches of benchMultiGetSize with MultiGet. Compare
+// its pages/lookup with benchmarkLookup's.
+func benchmarkMultiGet(tree *BPlusTree, keys []int) func(b *testing.B) {
+	return func(b *testing.B) {
+		counter := &pageCounter{}
+		tree.SetTracer(counter)
+		defer tree.SetTracer(nil)
+		r := rand.New(rand.NewSource(7))
+		batch := make([]int, benchMultiGetSize)
+
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			for j := range batch {
+				batch[j] = keys[r.Intn(len(keys))]
+			}
+			_, found, err := tree.MultiGet(batch)
+			if err != nil {
+				b.Fatalf("lookup of a batch failed: %v", err)
+			}
+			if j := slices.Index(found, false); j != -1 {
+				b.Fatalf("lookup of key %d failed: not found", batch[j])
+			}
+		}
+		lookups := float64(b.N) * benchMultiGetSize
+		b.ReportMetric(lookups/b.Elapsed().Seconds(), "lookups/s")
+		b.ReportMetric(float64(counter.touched())/lookups, "pages/lookup")
+	}
+}
+
+// benchmarkFingerLookup looks up the keys in ascending order through a Finger, the access pattern
+// finger search is made for. Compare its pages/lookup with benchmarkLookup's.
+func benchmarkFingerLookup(tree *BPlusTree, n int) func(b *testing.B) {
+	return func(b *testing.B) {
+		counter := &pageCounter{}
+		tree.SetTracer(counter)
+		defer tree.SetTracer(nil)
+		finger := tree.NewFinger()
+
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			key := i % n
+			if _, found, err := finger.Search(key); err != nil || !found {
+				b.Fatalf("lookup of key %d failed: found=%v err=%v", key, found, err)
+			}
+		}
+		b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "lookups/s")
+		b.ReportMetric(float64(counter.touched())/float64(b.N), "pages/lookup")
+	}
+}
+
+// benchmarkConcurrentLookup looks up random keys from parallel goroutines while a writer goroutine
+// keeps inserting benchWriterKeys keys past the tree's and deleting them again. With optimistic,
+// the readers use OptimisticSearch and the writer goes ahead of them; otherwise they share a
+// tree-wide sync.RWMutex with Search, and the writer takes it for every insert and delete. That is
+// the coarsest latching, not latch coupling: the tree has no latches of its own per page to couple.
+// The writer leaves the tree as it found it.
+func benchmarkConcurrentLookup(tree *BPlusTree, keys []int, optimistic bool) func(b *testing.B) {
+	return func(b *testing.B) {
+		var latch sync.RWMutex
+		if optimistic {
+			tree.EnableOptimisticReads()
+		}
+		lock := func(f func() error) error {
+			if !optimistic {
+				latch.Lock()
+				defer latch.Unlock()
+			}
+			return f()
+		}
+		// deleteWritten deletes the first n keys the writer inserted.
+		deleteWritten := func(n int) error {
+			for k := len(keys); k < len(keys)+n; k++ {
+				if err := lock(func() error { _, err := tree.Delete(k); return err }); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		stop, writerErr := make(chan struct{}), make(chan error, 1)
+		go func() {
+			for inserted := 0; ; inserted++ {
+				select {
+				case <-stop:
+					writerErr <- deleteWritten(inserted)
+					return
+				default:
+				}
+				if inserted == benchWriterKeys {
+					if err := deleteWritten(inserted); err != nil {
+						writerErr <- err
+						return
+					}
+					inserted = 0
+				}
+				k := len(keys) + inserted
+				if err := lock(func() error { return tree.Insert(k, int64(k)*10) }); err != nil {
+					writerErr <- errors.Join(err, deleteWritten(inserted))
+					return
+				}
+			}
+		}()
+
+		var seed atomic.Int64
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			r := rand.New(rand.NewSource(seed.Add(1)))
+			for pb.Next() {
+				key := keys[r.Intn(len(keys))]
+				var found bool
+				var err error
+				if optimistic {
+					_, found, err = tree.OptimisticSearch(key)
+				} else {
+					latch.RLock()
+					_, found, err = tree.Search(key)
+					latch.RUnlock()
+				}
+				if err != nil || !found {
+					b.Errorf("lookup of key %d failed: found=%v err=%v", key, found, err)
+					return
+				}
+			}
+		})
+		b.StopTimer()
+		close(stop)
+		if err := <-writerErr; err != nil {
+			b.Fatal(err)
+		}
+		b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "lookups/s")
+	}
+}
+
+// buildBenchHash creates a hash index holding the given keys in a fresh temporary file of the
+// given store, for comparison with the tree's point lookups. Only the lookups are measured, so it
+// is built with the buffer pool in write-back mode. The returned cleanup function closes and
+// removes the file.
+func buildBenchHash(store benchStore, keys []int) (*HashIndex, func(), error) {
+	file, err := os.CreateTemp("", "bench-*.hash")
+	if err != nil {
+		return nil, nil, err
+	}
+	path := file.Name()
+	file.Close()
+	os.Remove(path) // the store creates the file anew, so that it starts empty
+
+	pager, err := store.open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	cleanup := func() {
+		pager.Close()
+		os.Remove(path)
+	}
+	index, err := OpenHashIndex(pager)
+	if err == nil {
+		err = index.BufferPool().StartFlusher(benchFlushInterval, nil)
+	}
+	for _, k := range keys {
+		if err != nil {
+			break
+		}
+		_, err = index.Put(k, int64(k)*10)
+	}
+	if err := errors.Join(err, index.Close()); err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	return index, cleanup, nil
+}
+
+// benchmarkHashLookup is benchmarkLookup for a hash index.
+func benchmarkHashLookup(index *HashIndex, keys []int) func(b *testing.B) {
+	return func(b *testing.B) {
+		counter := &pageCounter{}
+		index.SetTracer(counter)
+		defer index.SetTracer(nil)
+		r := rand.New(rand.NewSource(7))
+
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			key := keys[r.Intn(len(keys))]
+			if _, found, err := index.Get(key); err != nil || !found {
+				b.Fatalf("lookup of key %d failed: found=%v err=%v", key, found, err)
+			}
+		}
+		b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "lookups/s")
+		b.ReportMetric(float64(counter.touched())/float64(b.N), "pages/lookup")
+	}
+}
+
+func benchmarkRangeScan(tree *BPlusTree, n int) func(b *testing.B) {
+	return func(b *testing.B) {
+		counter := &pageCounter{}
+		tree.SetTracer(counter)
+		defer tree.SetTracer(nil)
+		r := rand.New(rand.NewSource(7))
+		width := min(benchRangeWidth, n)
+
+		b.ResetTimer()
+		scanned := 0
+		for i := 0; i < b.N; i++ {
+			start := r.Intn(n - width + 1)
+			results, err := tree.SearchRange(start, start+width-1)
+			if err != nil {
+				b.Fatal(err)
+			}
+			scanned += len(results)
+		}
+		b.ReportMetric(float64(scanned)/b.Elapsed().Seconds(), "keys/s")
+		b.ReportMetric(float64(counter.touched())/float64(b.N), "pages/scan")
+	}
+}
+
+// benchmarkWALCommit measures inserting keys into an empty DB in transactions of benchTxSize keys,
+// which the write-ahead log makes durable (see txn.go). Each key's row is the key itself.
+func benchmarkWALCommit(keys []int) func(b *testing.B) {
+	return func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			dir, err := os.MkdirTemp("", "bench-wal-*")
+			if err != nil {
+				b.Fatal(err)
+			}
+			db, err := OpenDB(filepath.Join(dir, "index.idx"), filepath.Join(dir, "heap.csv"), filepath.Join(dir, "wal.log"), benchDegree)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.StartTimer()
+
+			for from := 0; from < len(keys); from += benchTxSize {
+				tx := db.Begin()
+				for _, k := range keys[from:min(from+benchTxSize, len(keys))] {
+					if err := tx.Insert(k, []byte(strconv.Itoa(k))); err != nil {
+						b.Fatal(err)
+					}
+				}
+				if err := tx.Commit(); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			b.StopTimer()
+			db.Close()
+			os.RemoveAll(dir)
+			b.StartTimer()
+		}
+		reportCommits(b, len(keys))
+	}
+}
+
+// benchmarkShadowCommit is benchmarkWALCommit for a shadow-paged tree (see shadow.go), which has no
+// rows to store.
+func benchmarkShadowCommit(keys []int) func(b *testing.B) {
+	return func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			dir, err := os.MkdirTemp("", "bench-shadow-*")
+			if err != nil {
+				b.Fatal(err)
+			}
+			st, err := OpenShadowTree(filepath.Join(dir, "index.idx"), benchDegree)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.StartTimer()
+
+			for from := 0; from < len(keys); from += benchTxSize {
+				if err := st.Update(func(tree *BPlusTree) error {
+					for _, k := range keys[from:min(from+benchTxSize, len(keys))] {
+						if err := tree.Insert(k, int64(k)*10); err != nil {
+							return err
+						}
+					}
+					return nil
+				}); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			b.StopTimer()
+			st.Close()
+			os.RemoveAll(dir)
+			b.StartTimer()
+		}
+		reportCommits(b, len(keys))
+	}
+}
+
+// reportCommits reports the insert and commit throughput of a durability benchmark.
+func reportCommits(b *testing.B, n int) {
+	commits := (n + benchTxSize - 1) / benchTxSize
+	b.ReportMetric(float64(b.N*n)/b.Elapsed().Seconds(), "inserts/s")
+	b.ReportMetric(float64(b.N*commits)/b.Elapsed().Seconds(), "commits/s")
+}
+
+// benchConfig returns the stores, dataset sizes and worker counts the flags ask for.
+func benchConfig(b *testing.B) (stores []benchStore, sizes, workers []int) {
+	stores, sizes, workers = benchStores, defaultBenchSizes, defaultBenchWorkers
+	var err error
+	if *diskFlag != "" {
+		stores = nil
+		for _, name := range strings.Split(*diskFlag, ",") {
+			profile, err := DiskProfileByName(strings.TrimSpace(name))
+			if err != nil {
+				b.Fatal(err)
+			}
+			stores = append(stores, simulatedBenchStore(profile))
+		}
+	}
+	if *sizesFlag != "" {
+		if sizes, err = parsePositiveInts(*sizesFlag, "dataset size"); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if *workersFlag != "" {
+		if workers, err = parsePositiveInts(*workersFlag, "worker count"); err != nil {
+			b.Fatal(err)
+		}
+	}
+	return stores, sizes, workers
+}
+
+// benchSetup prepares a sub-benchmark for the keys of a dataset in a store. It returns the
+// benchmark and a function that cleans up after it.
+type benchSetup func(store benchStore, keys []int) (func(b *testing.B), func(), error)
+
+// runDatasets runs a sub-benchmark for every store and dataset size the flags ask for, in both
+// sequential and random insert order. A store without a name is left out of the sub-benchmark's
+// name. setup runs, untimed, the first time the sub-benchmark runs, so datasets that -bench
+// filters out are never built, and the cleanup runs once the sub-benchmark is done.
+func runDatasets(b *testing.B, stores []benchStore, setup benchSetup) {
+	_, sizes, _ := benchConfig(b)
+	for _, store := range stores {
+		for _, n := range sizes {
+			for _, random := range []bool{false, true} {
+				order := "sequential"
+				if random {
+					order = "random"
+				}
+				name := fmt.Sprintf("%s/%d", order, n)
+				if store.name != "" {
+					name = store.name + "/" + name
+				}
+				var run func(b *testing.B)
+				cleanup := func() {}
+				b.Run(name, func(b *testing.B) {
+					if run == nil {
+						b.StopTimer()
+						bench, done, err := setup(store, generateKeys(n, random))
+						if err != nil {
+							b.Fatal(err)
+						}
+						run, cleanup = bench, done
+						b.StartTimer()
+					}
+					run(b)
+				})
+				cleanup()
+			}
+		}
+	}
+}
+
+// onEmptyTrees is the benchSetup of benchmarks that build their own trees.
+func onEmptyTrees(bench func(store benchStore, keys []int) func(b *testing.B)) benchSetup {
+	return func(store benchStore, keys []int) (func(b *testing.B), func(), error) {
+		return bench(store, keys), func() {}, nil
+	}
+}
+
+// onTrees is the benchSetup of benchmarks that read a tree holding the dataset.
+func onTrees(bench func(tree *BPlusTree, keys []int) func(b *testing.B)) benchSetup {
+	return func(store benchStore, keys []int) (func(b *testing.B), func(), error) {
+		tree, cleanup, err := buildBenchTree(store, keys)
+		if err != nil {
+			return nil, nil, err
+		}
+		return bench(tree, keys), cleanup, nil
+	}
+}
+
+func BenchmarkInsert(b *testing.B) {
+	stores, _, _ := benchConfig(b)
+	runDatasets(b, stores, onEmptyTrees(func(store benchStore, keys []int) func(b *testing.B) {
+		return benchmarkInsert(store, keys, false, SplitEven)
+	}))
+}
+
+func BenchmarkInsertWriteBack(b *testing.B) {
+	stores, _, _ := benchConfig(b)
+	runDatasets(b, stores, onEmptyTrees(func(store benchStore, keys []int) func(b *testing.B) {
+		return benchmarkInsert(store, keys, true, SplitEven)
+	}))
+}
+
+// BenchmarkInsertRightHeavy splits the rightmost leaf 90/10 (see splitpolicy.go).
+func BenchmarkInsertRightHeavy(b *testing.B) {
+	stores, _, _ := benchConfig(b)
+	runDatasets(b, stores, onEmptyTrees(func(store benchStore, keys []int) func(b *testing.B) {
+		return benchmarkInsert(store, keys, false, SplitRightHeavy)
+	}))
+}
+
+func BenchmarkInsertBatch(b *testing.B) {
+	stores, _, _ := benchConfig(b)
+	runDatasets(b, stores, onEmptyTrees(benchmarkInsertBatch))
+}
+
+// BenchmarkBuildParallel builds the tree bottom-up with each worker count (see parallel.go).
+func BenchmarkBuildParallel(b *testing.B) {
+	stores, _, workerCounts := benchConfig(b)
+	for _, workers := range workerCounts {
+		b.Run(fmt.Sprintf("Workers%d", workers), func(b *testing.B) {
+			runDatasets(b, stores, onEmptyTrees(func(store benchStore, keys []int) func(b *testing.B) {
+				return benchmarkBuild(store, keys, BuildOptions{Workers: workers})
+			}))
+		})
+	}
+}
+
+// BenchmarkBuildExternal builds the tree through an external sort in runs of benchSortRunPairs
+// (see extsort.go).
+func BenchmarkBuildExternal(b *testing.B) {
+	stores, _, _ := benchConfig(b)
+	externalSort := &ExternalSortOptions{RunPairs: benchSortRunPairs}
+	runDatasets(b, stores, onEmptyTrees(func(store benchStore, keys []int) func(b *testing.B) {
+		return benchmarkBuild(store, keys, BuildOptions{ExternalSort: externalSort})
+	}))
+}
+
+func BenchmarkLookup(b *testing.B) {
+	stores, _, _ := benchConfig(b)
+	runDatasets(b, stores, onTrees(benchmarkLookup))
+}
+
+// BenchmarkMultiGet looks up random keys in batches (see multiget.go).
+func BenchmarkMultiGet(b *testing.B) {
+	stores, _, _ := benchConfig(b)
+	runDatasets(b, stores, onTrees(benchmarkMultiGet))
+}
+
+func BenchmarkFingerLookup(b *testing.B) {
+	stores, _, _ := benchConfig(b)
+	runDatasets(b, stores, onTrees(func(tree *BPlusTree, keys []int) func(b *testing.B) {
+		return benchmarkFingerLookup(tree, len(keys))
+	}))
+}
+
+func BenchmarkRangeScan(b *testing.B) {
+	stores, _, _ := benchConfig(b)
+	runDatasets(b, stores, onTrees(func(tree *BPlusTree, keys []int) func(b *testing.B) {
+		return benchmarkRangeScan(tree, len(keys))
+	}))
+}
+
+// BenchmarkRWMutexLookup and BenchmarkOptimisticLookup look up keys from parallel goroutines while
+// another one writes (see benchmarkConcurrentLookup).
+func BenchmarkRWMutexLookup(b *testing.B) {
+	stores, _, _ := benchConfig(b)
+	runDatasets(b, stores, onTrees(func(tree *BPlusTree, keys []int) func(b *testing.B) {
+		return benchmarkConcurrentLookup(tree, keys, false)
+	}))
+}
+
+func BenchmarkOptimisticLookup(b *testing.B) {
+	stores, _, _ := benchConfig(b)
+	runDatasets(b, stores, onTrees(func(tree *BPlusTree, keys []int) func(b *testing.B) {
+		return benchmarkConcurrentLookup(tree, keys, true)
+	}))
+}
+
+// BenchmarkHashLookup looks up the same keys in an extendible hash index (see hash.go) built in
+// the same store.
+func BenchmarkHashLookup(b *testing.B) {
+	stores, _, _ := benchConfig(b)
+	runDatasets(b, stores, func(store benchStore, keys []int) (func(b *testing.B), func(), error) {
+		index, cleanup, err := buildBenchHash(store, keys)
+		if err != nil {
+			return nil, nil, err
+		}
+		return benchmarkHashLookup(index, keys), cleanup, nil
+	})
+}
+
+// BenchmarkWALCommit and BenchmarkShadowCommit compare the two ways of making transactions
+// durable, the write-ahead log of a DB and shadow paging. They need real files, so -disk skips
+// them.
+func BenchmarkWALCommit(b *testing.B) {
+	if *diskFlag != "" {
+		b.Skip("the durability benchmarks need real files")
+	}
+	runDatasets(b, []benchStore{{}}, onEmptyTrees(func(_ benchStore, keys []int) func(b *testing.B) {
+		return benchmarkWALCommit(keys)
+	}))
+}
+
+func BenchmarkShadowCommit(b *testing.B) {
+	if *diskFlag != "" {
+		b.Skip("the durability benchmarks need real files")
+	}
+	runDatasets(b, []benchStore{{}}, onEmptyTrees(func(_ benchStore, keys []int) func(b *testing.B) {
+		return benchmarkShadowCommit(keys)
+	}))
+}
+
+// parsePositiveInts parses a comma-separated list of positive ints, such as the -sizes flag.
+func parsePositiveInts(s, what string) ([]int, error) {
+	var sizes []int
+	for _, part := range strings.Split(s, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid %s %q", what, part)
+		}
+		sizes = append(sizes, n)
+	}
+	return sizes, nil
+}
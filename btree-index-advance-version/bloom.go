@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"math/bits"
+	"os"
+)
+
+// =================================================================================================
+// --- bloom.go --- (Bloom Filter Sidecar)
+// =================================================================================================
+
+// A lookup of a key that isn't in the index still reads one page per level before it finds out.
+// A Bloom filter answers "is this key absent?" from memory instead: it is an array of m bits, and
+// adding a key sets the k bits chosen by k hash functions of the key. A key whose k bits aren't
+// all set was never added, so the lookup returns not-found without touching the tree. A key whose
+// bits are all set is probably present, but may only share its bits with other keys: a false
+// positive, which costs the usual descent and nothing more. There are never false negatives.
+//
+// With n keys, m = -n·ln(p)/ln(2)² bits and k = (m/n)·ln(2) hash functions give a false-positive
+// rate of p, about 9.6 bits per key for 1% and 14.4 for 0.1%. The k positions are derived from two
+// hashes of the key, h1 + i·h2, which is as good as k independent hash functions.
+//
+// The filter is kept in a sidecar file next to the index, <index>.bloom:
+//
+//	| magic | k | false-positive rate | key count | number of 64-bit words | words ... | CRC-32 |
+//
+// Inserts add their key to the filter. Deletes leave their key's bits set, since other keys may
+// share them; the filter only loses precision until Compact, which rebuilds it for the keys that
+// remain, sized for their number. There is no separate bulk-load path: Compact is the tree's bulk
+// load, and InsertBatch adds its keys like Insert.
+
+// bloomFileSuffix is appended to the index file's path to name its Bloom filter.
+const bloomFileSuffix = ".bloom"
+
+const (
+	bloomMagic      = 0x424C4D46 // "BLMF"
+	bloomHeaderSize = 32
+	// minBloomKeys sizes the filter of a small or empty tree, so that it has room to grow before
+	// its false-positive rate climbs.
+	minBloomKeys = 1024
+)
+
+var (
+	errInvalidFalsePositiveRate = errors.New("false-positive rate must be in (0, 1)")
+	errBloomWithBuckets         = errors.New("a Bloom filter only covers an index file without buckets")
+	errCorruptBloomFilter       = errors.New("corrupt Bloom filter file")
+)
+
+// BloomFilter is a set of int keys that can answer "definitely absent" or "maybe present".
+type BloomFilter struct {
+	words  []uint64
+	k      int     // number of bits set per key
+	n      int     // number of keys added
+	fpRate float64 // the false-positive rate the filter was sized for
+}
+
+// NewBloomFilter creates a filter sized to hold expectedKeys keys with the given false-positive
+// rate, e.g. 0.01.
+func NewBloomFilter(expectedKeys int, fpRate float64) *BloomFilter {
+	n := float64(max(expectedKeys, 1))
+	m := math.Ceil(-n * math.Log(fpRate) / (math.Ln2 * math.Ln2))
+	k := int(math.Round(m / n * math.Ln2))
+	return &BloomFilter{words: make([]uint64, int(m+63)/64), k: max(k, 1), fpRate: fpRate}
+}
+
+// positions calls fn with each of the k bits of key.
+func (f *BloomFilter) positions(key int, fn func(bit uint64)) {
+	m := uint64(len(f.words)) * 64
+	h1 := hashKey(key)
+	h2 := hashKey(int(h1^0x9e3779b97f4a7c15)) | 1 // odd, so the k positions differ
+	for i := uint64(0); i < uint64(f.k); i++ {
+		fn((h1 + i*h2) % m)
+	}
+}
+
+// Add records key in the filter.
+func (f *BloomFilter) Add(key int) {
+	f.positions(key, func(bit uint64) { f.words[bit/64] |= 1 << (bit % 64) })
+	f.n++
+}
+
+// MayContain reports whether key may have been added. False means it definitely wasn't.
+func (f *BloomFilter) MayContain(key int) bool {
+	contains := true
+	f.positions(key, func(bit uint64) {
+		if f.words[bit/64]&(1<<(bit%64)) == 0 {
+			contains = false
+		}
+	})
+	return contains
+}
+
+// FalsePositiveRate estimates the filter's current false-positive rate from the fraction of its
+// bits that are set. It exceeds the configured rate once more keys were added than it was sized for.
+func (f *BloomFilter) FalsePositiveRate() float64 {
+	set := 0
+	for _, w := range f.words {
+		set += bits.OnesCount64(w)
+	}
+	return math.Pow(float64(set)/float64(len(f.words)*64), float64(f.k))
+}
+
+func (f *BloomFilter) String() string {
+	return fmt.Sprintf("%d keys in %d bytes, %d hashes, estimated false-positive rate %.4f (configured %.4f)",
+		f.n, len(f.words)*8, f.k, f.FalsePositiveRate(), f.fpRate)
+}
+
+// EnableBloomFilter makes negative lookups of the tree skip the pages when the filter rules the key
+// out. It loads the filter saved next to the index if there is one for the same false-positive
+// rate and the same number of keys, and otherwise builds one from a scan of the tree and saves it.
+// Trees that aren't stored in a Pager keep the filter in memory only.
+//
+// Only inserts made while the filter is enabled are added to it, so an index modified without
+// it should be rebuilt by calling EnableBloomFilter again before that file is reopened with it;
+// a changed key count is detected, an insert balanced by a delete is not.
+func (t *BPlusTree) EnableBloomFilter(fpRate float64) error {
+	if !(fpRate > 0 && fpRate < 1) {
+		return errInvalidFalsePositiveRate
+	}
+	// Bucket operations swap the tree's root, and their keys would miss the filter.
+	if t.catalogPageID != -1 {
+		return errBloomWithBuckets
+	}
+	numKeys, err := t.Len()
+	if err != nil {
+		return err
+	}
+	if path := t.bloomPath(); path != "" {
+		filter, err := loadBloomFilter(path)
+		if err == nil && filter.fpRate == fpRate && filter.n == numKeys {
+			t.bloom = filter
+			return nil
+		}
+		if err != nil && !errors.Is(err, os.ErrNotExist) && !errors.Is(err, errCorruptBloomFilter) {
+			return err
+		}
+	}
+	filter, err := t.buildBloomFilter(numKeys, fpRate)
+	if err != nil {
+		return err
+	}
+	t.bloom = filter
+	return t.SaveBloomFilter()
+}
+
+// DisableBloomFilter stops consulting the filter. Its sidecar file is left as it was.
+func (t *BPlusTree) DisableBloomFilter() {
+	t.bloom = nil
+}
+
+// BloomFilter returns the tree's filter, or nil if it has none.
+func (t *BPlusTree) BloomFilter() *BloomFilter {
+	return t.bloom
+}
+
+// SaveBloomFilter writes the filter to its sidecar file, so that the keys inserted since it was
+// loaded are kept. It does nothing if the tree has no filter or isn't stored in a Pager.
+func (t *BPlusTree) SaveBloomFilter() error {
+	path := t.bloomPath()
+	if t.bloom == nil || path == "" {
+		return nil
+	}
+	return t.bloom.save(path)
+}
+
+// bloomPath returns the path of the index's filter file, or "" if the index isn't a file, or is a
+// temporary one.
+func (t *BPlusTree) bloomPath() string {
+	if pager, ok := t.pager.(*Pager); ok && !pager.temp {
+		return pager.path + bloomFileSuffix
+	}
+	return ""
+}
+
+// buildBloomFilter adds every key of the tree to a new filter.
+func (t *BPlusTree) buildBloomFilter(numKeys int, fpRate float64) (*BloomFilter, error) {
+	filter := NewBloomFilter(max(numKeys, minBloomKeys), fpRate)
+	c, err := t.SeekContext(context.Background(), math.MinInt)
+	if err != nil {
+		return nil, err
+	}
+	for c.Next() {
+		filter.Add(c.Key())
+	}
+	return filter, c.Err()
+}
+
+// save writes the filter to path, through a temporary file so a crash leaves the old one intact.
+func (f *BloomFilter) save(path string) error {
+	buf := make([]byte, bloomHeaderSize+len(f.words)*8, bloomHeaderSize+len(f.words)*8+4)
+	binary.LittleEndian.PutUint32(buf[0:], bloomMagic)
+	binary.LittleEndian.PutUint32(buf[4:], uint32(f.k))
+	binary.LittleEndian.PutUint64(buf[8:], math.Float64bits(f.fpRate))
+	binary.LittleEndian.PutUint64(buf[16:], uint64(f.n))
+	binary.LittleEndian.PutUint64(buf[24:], uint64(len(f.words)))
+	for i, w := range f.words {
+		binary.LittleEndian.PutUint64(buf[bloomHeaderSize+i*8:], w)
+	}
+	buf = binary.LittleEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf))
+
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, buf, 0666); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// loadBloomFilter reads a filter written by save.
+func loadBloomFilter(path string) (*BloomFilter, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) < bloomHeaderSize+4 || binary.LittleEndian.Uint32(buf) != bloomMagic {
+		return nil, errCorruptBloomFilter
+	}
+	body := buf[:len(buf)-4]
+	numWords := binary.LittleEndian.Uint64(buf[24:])
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(buf[len(body):]) ||
+		numWords == 0 || uint64(len(body)-bloomHeaderSize) != numWords*8 {
+		return nil, errCorruptBloomFilter
+	}
+	f := &BloomFilter{
+		words:  make([]uint64, numWords),
+		k:      int(binary.LittleEndian.Uint32(buf[4:])),
+		fpRate: math.Float64frombits(binary.LittleEndian.Uint64(buf[8:])),
+		n:      int(binary.LittleEndian.Uint64(buf[16:])),
+	}
+	for i := range f.words {
+		f.words[i] = binary.LittleEndian.Uint64(body[bloomHeaderSize+i*8:])
+	}
+	if f.k < 1 {
+		return nil, errCorruptBloomFilter
+	}
+	return f, nil
+}
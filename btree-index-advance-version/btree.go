@@ -1,8 +1,15 @@
 package main
 
 import (
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"math"
+	"os"
+	"slices"
+	"sync/atomic"
+	"time"
 )
 
 // =================================================================================================
@@ -24,31 +31,335 @@ const (
 	NodeTypeInternal = 1
 )
 
+// Errors returned by tree operations. They are wrapped with the key or page they are about, so
+// compare with errors.Is.
+var (
+	// ErrKeyNotFound is for operations that need the key to be present. Lookups report a missing
+	// key with their found result instead.
+	ErrKeyNotFound  = errors.New("key not found")
+	ErrDuplicateKey = errors.New("duplicate key insertion not allowed")
+)
+
 // BPlusTree struct and NewBPlusTree constructor
 type BPlusTree struct {
-	pager      *Pager
+	pager      PageStore
+	pool       *BufferPool
 	rootPageID PageID
-	degree     int
+	metaPageID PageID // -1 if the index has no meta page yet (see meta.go)
+	// catalogPageID is -1 if the index has no buckets yet (see catalog.go).
+	catalogPageID PageID
+	degree        int
+	tracer        Tracer
+	name          string // reported by constraint violations; "" means the file's path (see constraint.go)
+	// metrics counts splits and merges and times operations; nil if disabled (see metrics.go).
+	metrics Metrics
+	// spans starts a span for every operation, and span is that of the running one; both are
+	// nil if disabled (see spans.go).
+	spans SpanTracer
+	span  *opSpan
+	// bloom rules out lookups of absent keys before they read a page; nil if disabled (see bloom.go).
+	bloom *BloomFilter
+
+	// txPages buffers the pages written while a transaction is open (see txn.go).
+	// It is nil when no transaction is running and writes go straight to the pager.
+	txPages map[PageID]*Page
+	// txUndo, while the open transaction has a savepoint, records for every page write the
+	// buffered page it replaced, nil if there was none (see savepoint.go). It is nil otherwise.
+	txUndo []pageUndo
+	// closed is set by Close, after which every page access fails with ErrTreeClosed.
+	closed bool
+
+	// optimistic is set by EnableOptimisticReads, and sharedRoot is the root as optimistic
+	// readers see it (see optimistic.go).
+	optimistic atomic.Bool
+	sharedRoot atomic.Int64
+	// rebalanceDepth is the number of nested rebalances in progress, as a merge cascades up the
+	// tree. Each locks the versions of the pages it changes (see optimistic.go).
+	rebalanceDepth int
+
+	// rightmost is the rightmost leaf, remembered for appends (see rightmost.go).
+	rightmost rightmostLeaf
+	// splitPolicy is set by SetSplitPolicy, and 0 for SplitEven (see splitpolicy.go).
+	splitPolicy SplitPolicy
+	// internalDegree is the degree of internal pages, 0 if it is degree (see fanout.go).
+	internalDegree int
+}
+
+// NewBPlusTree opens the tree stored in pager, or creates an empty one. The degree must be between
+// 3 and MaxDegree; 0 means MaxDegree, the widest node that fits a page. DegreeForValueSize
+// derives the degree for larger values.
+func NewBPlusTree(pager PageStore, degree int) *BPlusTree {
+	return NewBPlusTreeWithDegrees(pager, degree, 0)
 }
 
-func NewBPlusTree(pager *Pager, degree int) *BPlusTree {
+// NewBPlusTreeWithDegrees is NewBPlusTree with a degree of its own for internal pages, between 3 and
+// MaxInternalDegree; 0 means the same as the degree, which then only applies to leaves (see
+// fanout.go). Both degrees are fixed when the tree is created: an existing tree keeps the ones
+// recorded in its header, whatever is passed, and only a file written before the header takes
+// degree.
+func NewBPlusTreeWithDegrees(pager PageStore, degree, internalDegree int) *BPlusTree {
+	if degree == 0 {
+		degree = MaxDegree
+	}
 	if degree < 3 {
 		panic("B+ Tree degree must be at least 3")
 	}
-	if pager.numPages == 0 {
+	if degree > MaxDegree {
+		panic(fmt.Sprintf("B+ Tree degree must be at most %d to fit a full node in a page", MaxDegree))
+	}
+	if internalDegree == degree {
+		internalDegree = 0
+	}
+	if internalDegree != 0 && (internalDegree < 3 || internalDegree > MaxInternalDegree) {
+		panic(fmt.Sprintf("B+ Tree internal degree must be between 3 and %d", MaxInternalDegree))
+	}
+	if pager.NumPages() == 0 {
+		// Page 0 is the meta page, where Open finds the header, and the root starts out as page 1.
+		tree := &BPlusTree{pager: pager, pool: NewBufferPool(pager, defaultBufferPoolFrames), rootPageID: 1, metaPageID: 0, catalogPageID: -1,
+			degree: degree, internalDegree: internalDegree}
+		metaPage := newMetaPage()
+		putIndexHeader(metaPage, tree.indexHeader())
+		pager.WritePage(0, metaPage)
+
 		rootPageData := new(Page)
 		rootPageData[nodeTypeOffset] = NodeTypeLeaf
 		setIsRoot(rootPageData, true)
 		setParentPageID(rootPageData, -1) // Root's parent is invalid
-		setNumKeys(rootPageData, 0)
+		resetCells(rootPageData)
 		setNextLeafPageID(rootPageData, -1)
-		pager.WritePage(0, rootPageData)
-		return &BPlusTree{pager: pager, rootPageID: 0, degree: degree}
+		pager.WritePage(1, rootPageData)
+		return tree
+	}
+	header, metaPageID, err := findIndexHeader(pager)
+	if err == nil {
+		if tree, ok := openWithHeader(pager, header, metaPageID); ok {
+			return tree
+		}
+		degree = header.degree
+	}
+	// Files written before the index header, or whose header points to a root that has moved:
+	// the root moves whenever it splits, so we scan for the page that carries the root flag,
+	// falling back to page 0 if none does. The roots of buckets carry it too.
+	catalogPageID := findPageOfType(pager, NodeTypeCatalog)
+	rootPageID := findRootPageID(pager, bucketRoots(pager, catalogPageID))
+	return &BPlusTree{pager: pager, pool: NewBufferPool(pager, defaultBufferPoolFrames), rootPageID: rootPageID,
+		metaPageID: findPageOfType(pager, NodeTypeMeta), catalogPageID: catalogPageID, degree: degree, internalDegree: header.internalDegree}
+}
+
+// Open opens the index file at path with the degree, root and catalog recorded in its header (see
+// meta.go), so unlike NewBPlusTree it needs no degree and doesn't scan the file. The file must
+// exist and have a header: ErrNoIndexHeader means it doesn't, ErrUnsupportedFormat that a newer
+// build wrote it. The tree owns the Pager it opens.
+func Open(path string) (*BPlusTree, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	pager, err := NewPager(path)
+	if err != nil {
+		return nil, err
+	}
+	tree, err := OpenStore(pager)
+	if err != nil {
+		pager.Close()
+		return nil, err
+	}
+	return tree, nil
+}
+
+// OpenReadOnly is Open for reading only, through NewReadOnlyPager: any number of processes can
+// read the index at once, but none while a writer has it open. Writes fail with ErrReadOnly.
+func OpenReadOnly(path string) (*BPlusTree, error) {
+	pager, err := NewReadOnlyPager(path)
+	if err != nil {
+		return nil, err
+	}
+	tree, err := OpenStore(pager)
+	if err != nil {
+		pager.Close()
+		return nil, err
+	}
+	return tree, nil
+}
+
+// OpenStore is Open for an index in any PageStore, such as an encrypted Pager.
+func OpenStore(pager PageStore) (*BPlusTree, error) {
+	header, metaPageID, err := findIndexHeader(pager)
+	if err != nil {
+		return nil, err
+	}
+	if tree, ok := openWithHeader(pager, header, metaPageID); ok {
+		return tree, nil
+	}
+	// The root has moved since the header was written: find it as NewBPlusTree does for a file
+	// without a header, and bring the header up to date unless the store is read-only.
+	tree := NewBPlusTree(pager, header.degree)
+	if err := tree.writeIndexHeader(); err != nil && !errors.Is(err, ErrReadOnly) {
+		return nil, err
+	}
+	return tree, nil
+}
+
+// openWithHeader returns the tree described by header, and false if the root the header records is
+// no longer the root.
+func openWithHeader(pager PageStore, header indexHeader, metaPageID PageID) (*BPlusTree, bool) {
+	root, err := pager.ReadPage(header.rootPageID, new(Page))
+	if err != nil || !isRoot(root) || root[nodeTypeOffset] > NodeTypeInternal {
+		return nil, false
+	}
+	return &BPlusTree{pager: pager, pool: NewBufferPool(pager, defaultBufferPoolFrames), rootPageID: header.rootPageID,
+		metaPageID: metaPageID, catalogPageID: header.catalogPageID, degree: header.degree, internalDegree: header.internalDegree}, true
+}
+
+var errCloseInTransaction = errors.New("cannot close the tree while a transaction is open")
+
+// Close writes out every dirty page in the buffer pool, brings the index header up to date with
+// the current root (see meta.go), saves the Bloom filter, if any, and closes the page store, so the
+// tree owns its store from then on. Pager writes are synced as they are made, so everything is
+// on disk when Close returns. Every later operation fails with ErrTreeClosed, and so does a second
+// Close. Close fails if a transaction is open. A tree on a read-only Pager just closes it.
+func (t *BPlusTree) Close() error {
+	if t.closed {
+		return ErrTreeClosed
 	}
-	// In a real DB, we'd read a master page to find the rootPageID.
-	// We'll assume it's always 0 for this simulation if the file exists.
-	// You would need to query the Pager to find the root page ID.
-	return &BPlusTree{pager: pager, rootPageID: 0, degree: degree}
+	if t.txPages != nil {
+		return errCloseInTransaction
+	}
+	var err error
+	if pager, ok := t.pager.(*Pager); !ok || !pager.readOnly {
+		err = t.pool.Close()
+		if err == nil {
+			err = t.writeIndexHeader()
+		}
+		if err == nil {
+			err = t.SaveBloomFilter()
+		}
+	}
+	t.closed = true
+	t.bloom = nil
+	t.pool.reset()
+	return errors.Join(err, t.pager.Close())
+}
+
+// Degree returns the maximum number of children of a node. With NewBPlusTreeWithDegrees it only
+// applies to leaves, the maximum number of entries plus one.
+func (t *BPlusTree) Degree() int {
+	return t.degree
+}
+
+// InternalDegree returns the maximum number of children of an internal page, which is Degree
+// unless the tree was created with an internal degree of its own.
+func (t *BPlusTree) InternalDegree() int {
+	if t.internalDegree == 0 {
+		return t.degree
+	}
+	return t.internalDegree
+}
+
+// BufferPool returns the pool caching the tree's pages.
+func (t *BPlusTree) BufferPool() *BufferPool {
+	return t.pool
+}
+
+// findRootPageID returns the ID of the page flagged as the root of the tree, skipping the roots of
+// buckets.
+func findRootPageID(pager PageStore, bucketRoots []PageID) PageID {
+	buf := new(Page)
+	for i := int64(0); i < pager.NumPages(); i++ {
+		page, err := pager.ReadPage(PageID(i), buf)
+		if err != nil {
+			break
+		}
+		if isRoot(page) && !slices.Contains(bucketRoots, PageID(i)) {
+			return PageID(i)
+		}
+	}
+	return 0
+}
+
+// readPage reads a page, reporting the access to the tracer. Pages written by the open
+// transaction, if any, are read from its buffer instead of the buffer pool. Others are checked
+// before they are returned (see checkPage). The page is a new copy the caller may change.
+func (t *BPlusTree) readPage(pageID PageID) (*Page, error) {
+	return t.readPageInto(pageID, new(Page))
+}
+
+// readPageInto is readPage into buf, which it returns, for callers that reuse a buffer (see
+// pagepool.go).
+func (t *BPlusTree) readPageInto(pageID PageID, buf *Page) (*Page, error) {
+	if t.closed {
+		return nil, ErrTreeClosed
+	}
+	if t.tracer != nil {
+		t.tracer.OnPageRead(pageID)
+	}
+	if t.span != nil {
+		t.span.pagesRead++
+	}
+	if page, ok := t.txPages[pageID]; ok {
+		*buf = *page
+		return buf, nil
+	}
+	page, err := t.pool.ReadPage(pageID, buf)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.checkPage(pageID, page); err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+// checkPage returns an ErrCorruptPage error if a page read from the store can't be what the tree
+// wrote: its node type is unknown, its numKeys or a cell pointer doesn't fit in it (see
+// checkCells), or it points to a child, next leaf or right sibling past the end of the file. Whatever reads the
+// page afterwards can follow its cells and pointers without checking them again.
+func (t *BPlusTree) checkPage(pageID PageID, page *Page) error {
+	switch nodeType := page[nodeTypeOffset]; {
+	case nodeType > NodeTypeCatalog:
+		return fmt.Errorf("%w: page %d has unknown node type %d", ErrCorruptPage, pageID, nodeType)
+	case nodeType > NodeTypeInternal:
+		return nil
+	}
+	if err := checkCells(pageID, page); err != nil {
+		return err
+	}
+	numPages := t.pager.NumPages()
+	pointsPast := func(target PageID) bool { return target < 0 || int64(target) >= numPages }
+	if isLeaf(page) {
+		if next := getNextLeafPageID(page); next != -1 && pointsPast(next) {
+			return fmt.Errorf("%w: leaf %d points to next leaf %d, past the end of the file (%d pages)", ErrCorruptPage, pageID, next, numPages)
+		}
+		return nil
+	}
+	for i := 0; i <= int(getNumKeys(page)); i++ {
+		if child := childAt(page, i); pointsPast(child) {
+			return fmt.Errorf("%w: page %d points to child %d, past the end of the file (%d pages)", ErrCorruptPage, pageID, child, numPages)
+		}
+	}
+	if right := rightLink(page); right != -1 && pointsPast(right) {
+		return fmt.Errorf("%w: page %d links to right sibling %d, past the end of the file (%d pages)", ErrCorruptPage, pageID, right, numPages)
+	}
+	return nil
+}
+
+// writePage writes a page, reporting the access to the tracer. While a transaction is open
+// the page is buffered until the transaction commits instead of being written to the pager.
+func (t *BPlusTree) writePage(pageID PageID, page *Page) error {
+	if t.closed {
+		return ErrTreeClosed
+	}
+	if t.tracer != nil {
+		t.tracer.OnPageWrite(pageID)
+	}
+	if t.txPages != nil {
+		if t.txUndo != nil {
+			t.txUndo = append(t.txUndo, pageUndo{pageID, t.txPages[pageID]})
+		}
+		pageCopy := *page
+		t.txPages[pageID] = &pageCopy
+		return nil
+	}
+	return t.pool.WritePage(pageID, page)
 }
 
 // Helper functions for page metadata
@@ -80,65 +391,162 @@ func setParentPageID(page *Page, pageID PageID) {
 
 // Search and SearchRange (no changes needed)
 func (t *BPlusTree) Search(key int) (int64, bool, error) {
+	return t.SearchContext(context.Background(), key)
+}
+
+// SearchContext is Search that returns ctx.Err() instead if ctx is already done. A single lookup
+// reads one page per level, so it isn't interrupted once started.
+func (t *BPlusTree) SearchContext(ctx context.Context, key int) (int64, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, false, err
+	}
+	if t.metrics != nil {
+		defer t.observe("search", time.Now())
+	}
+	span := t.startSpan(ctx, "btree.Search", SpanAttribute{"btree.key", key})
+	value, found, err := t.search(key)
+	span.end(err, SpanAttribute{"btree.found", found})
+	return value, found, err
+}
+
+// search implements SearchContext.
+func (t *BPlusTree) search(key int) (int64, bool, error) {
+	if t.bloom != nil && !t.bloom.MayContain(key) {
+		return 0, false, nil
+	}
+	buf := getPageBuffer()
+	defer putPageBuffer(buf)
+	page, i, err := t.findEntry(key, buf)
+	if err != nil || i == -1 {
+		return 0, false, err
+	}
+	if inline, _, _ := leafValueAt(page, i); len(inline) != 8 {
+		return 0, false, errNotInt64Value
+	}
+	return valueAt(page, i), true, nil
+}
+
+// SearchBytes returns the value stored under key by InsertBytes (or Insert), reading it back
+// from its overflow pages if it didn't fit in the leaf.
+func (t *BPlusTree) SearchBytes(key int) ([]byte, bool, error) {
+	if t.bloom != nil && !t.bloom.MayContain(key) {
+		return nil, false, nil
+	}
+	buf := getPageBuffer()
+	defer putPageBuffer(buf)
+	page, i, err := t.findEntry(key, buf)
+	if err != nil || i == -1 {
+		return nil, false, err
+	}
+	value, err := t.leafValue(page, i)
+	return value, err == nil, err
+}
+
+// findEntry returns the leaf page that would hold key, read into buf, and the index of key in it,
+// or -1.
+func (t *BPlusTree) findEntry(key int, buf *Page) (*Page, int, error) {
 	leafPageID, err := t.findLeafPage(key)
 	if err != nil {
-		return 0, false, err
+		return nil, -1, err
 	}
-	page, err := t.pager.ReadPage(leafPageID, new(Page))
+	page, err := t.readPageInto(leafPageID, buf)
 	if err != nil {
-		return 0, false, err
+		return nil, -1, err
 	}
 
 	numKeys := int(getNumKeys(page))
 	for i := 0; i < numKeys; i++ {
-		offset := headerSize + i*(8+8)
-		if int(binary.LittleEndian.Uint64(page[offset:])) == key {
-			return int64(binary.LittleEndian.Uint64(page[offset+8:])), true, nil
+		if keyAt(page, i) == key {
+			t.compared(i + 1)
+			return page, i, nil
 		}
 	}
-	return 0, false, nil
+	t.compared(numKeys)
+	return page, -1, nil
 }
 
 func (t *BPlusTree) SearchRange(startKey, endKey int) ([]int64, error) {
+	return t.SearchRangeContext(context.Background(), startKey, endKey)
+}
+
+// SearchRangeContext is SearchRange that stops scanning once ctx is done, checking it before each
+// leaf, and then returns ctx.Err() with no results.
+func (t *BPlusTree) SearchRangeContext(ctx context.Context, startKey, endKey int) ([]int64, error) {
 	if startKey > endKey {
 		return nil, nil
 	}
-	leafPageID, err := t.findLeafPage(startKey)
+	if t.metrics != nil {
+		defer t.observe("range", time.Now())
+	}
+	span := t.startSpan(ctx, "btree.SearchRange", SpanAttribute{"btree.start", startKey}, SpanAttribute{"btree.end", endKey})
+	results, err := t.searchRange(ctx, startKey, endKey)
+	span.end(err, SpanAttribute{"btree.results", len(results)})
+	return results, err
+}
+
+// searchRange implements SearchRangeContext.
+func (t *BPlusTree) searchRange(ctx context.Context, startKey, endKey int) ([]int64, error) {
+	c, err := t.SeekContext(ctx, startKey)
 	if err != nil {
 		return nil, err
 	}
 	var results []int64
-	for leafPageID != -1 {
-		page, err := t.pager.ReadPage(leafPageID, new(Page))
-		if err != nil {
-			return nil, err
-		}
-		numKeys := int(getNumKeys(page))
-		foundEnd := false
-		for i := 0; i < numKeys; i++ {
-			offset := headerSize + i*(8+8)
-			currentKey := int(binary.LittleEndian.Uint64(page[offset:]))
-			if currentKey > endKey {
-				foundEnd = true
-				break
-			}
-			if currentKey >= startKey {
-				results = append(results, int64(binary.LittleEndian.Uint64(page[offset+8:])))
-			}
-		}
-		if foundEnd {
+	for c.Next() {
+		t.compared(1)
+		if c.Key() > endKey {
 			break
 		}
-		leafPageID = getNextLeafPageID(page)
+		results = append(results, c.Value())
+	}
+	if err := c.Err(); err != nil {
+		return nil, err
 	}
 	return results, nil
 }
 
-// findLeafPage (no changes needed)
+// SearchRangeLimit returns at most limit values of the keys in [startKey, endKey], after skipping
+// the first offset of them, like LIMIT/OFFSET in SQL. A negative limit means no limit. The scan
+// stops reading leaves as soon as the page of results is complete.
+func (t *BPlusTree) SearchRangeLimit(startKey, endKey, limit, offset int) ([]int64, error) {
+	if startKey > endKey || limit == 0 {
+		return nil, nil
+	}
+	c, err := t.Seek(startKey)
+	if err != nil {
+		return nil, err
+	}
+	c.Skip(offset)
+	var results []int64
+	for (limit < 0 || len(results) < limit) && c.Next() && c.Key() <= endKey {
+		results = append(results, c.Value())
+	}
+	return results, c.Err()
+}
+
+// ScanFrom returns the values of key and every key after it, in key order.
+func (t *BPlusTree) ScanFrom(key int) ([]int64, error) {
+	return t.SearchRange(key, math.MaxInt)
+}
+
+// ScanTo returns the values of every key up to key, and of key itself, in key order.
+func (t *BPlusTree) ScanTo(key int) ([]int64, error) {
+	return t.SearchRange(math.MinInt, key)
+}
+
+// ScanAll returns the values of every key, in key order.
+func (t *BPlusTree) ScanAll() ([]int64, error) {
+	return t.SearchRange(math.MinInt, math.MaxInt)
+}
+
+// findLeafPage returns the leaf that would hold key. The pages on the way down are checked when
+// they are read, so a corrupt page fails with ErrCorruptPage rather than a panic, and so does a
+// cycle of child pointers rather than an endless loop.
 func (t *BPlusTree) findLeafPage(key int) (PageID, error) {
+	buf := getPageBuffer()
+	defer putPageBuffer(buf)
 	currentPageID := t.rootPageID
-	for {
-		page, err := t.pager.ReadPage(currentPageID, new(Page))
+	for depth := 0; ; depth++ {
+		page, err := t.readNodeInto(currentPageID, buf)
 		if err != nil {
 			return -1, err
 		}
@@ -148,14 +556,98 @@ func (t *BPlusTree) findLeafPage(key int) (PageID, error) {
 		numKeys := int(getNumKeys(page))
 		i := 0
 		for i < numKeys {
-			offset := headerSize + i*(8+8) + 8
-			if key < int(binary.LittleEndian.Uint64(page[offset:])) {
+			if key < keyAt(page, i) {
 				break
 			}
 			i++
 		}
-		offset := headerSize + i*(8+8)
-		currentPageID = PageID(binary.LittleEndian.Uint64(page[offset:]))
+		t.compared(min(i+1, numKeys))
+		if currentPageID, err = t.childOf(currentPageID, page, i, depth); err != nil {
+			return -1, err
+		}
+	}
+}
+
+// maxTreeDepth is the deepest a descent goes before it takes the tree for corrupt. Every internal
+// page has at least two children, so a tree this deep would hold more keys than an int counts.
+const maxTreeDepth = 64
+
+// readNode reads a page that must be a leaf or internal page.
+func (t *BPlusTree) readNode(pageID PageID) (*Page, error) {
+	return t.readNodeInto(pageID, new(Page))
+}
+
+// readNodeInto is readNode into buf.
+func (t *BPlusTree) readNodeInto(pageID PageID, buf *Page) (*Page, error) {
+	page, err := t.readPageInto(pageID, buf)
+	if err != nil {
+		return nil, err
+	}
+	if page[nodeTypeOffset] > NodeTypeInternal {
+		return nil, errNotTreeNode(pageID, page)
+	}
+	return page, nil
+}
+
+// errNotTreeNode is the error for a descent that reached a page other than a leaf or internal
+// page.
+func errNotTreeNode(pageID PageID, page *Page) error {
+	return fmt.Errorf("%w: page %d is a %s page, not a tree node", ErrCorruptPage, pageID, pageTypeName(page))
+}
+
+// childOf returns the i-th child of internal page pageID, which is depth levels below the root,
+// checking that the descent isn't deeper than any tree.
+func (t *BPlusTree) childOf(pageID PageID, page *Page, i, depth int) (PageID, error) {
+	if depth+1 >= maxTreeDepth {
+		return -1, errTooDeep(t.rootPageID)
+	}
+	return childAt(page, i), nil
+}
+
+// errTooDeep is the error for a descent from rootPageID that found no leaf within maxTreeDepth
+// levels.
+func errTooDeep(rootPageID PageID) error {
+	return fmt.Errorf("%w: no leaf within %d levels of root page %d", ErrCorruptPage, maxTreeDepth, rootPageID)
+}
+
+// keyRange is the range of keys that belong in a page, as set by the separators above it.
+// Without a lower (upper) bound the page is the leftmost (rightmost) one on its level.
+type keyRange struct {
+	low, high       int // low is inclusive, high exclusive
+	hasLow, hasHigh bool
+}
+
+func (r keyRange) contains(key int) bool {
+	return (!r.hasLow || key >= r.low) && (!r.hasHigh || key < r.high)
+}
+
+// findLeafPageBounded is findLeafPage that also returns the leaf page itself and the range of
+// keys that belong in it, taken from the separators on the way down.
+func (t *BPlusTree) findLeafPageBounded(key int) (PageID, *Page, keyRange, error) {
+	var bounds keyRange
+	currentPageID := t.rootPageID
+	for depth := 0; ; depth++ {
+		page, err := t.readNode(currentPageID)
+		if err != nil {
+			return -1, nil, bounds, err
+		}
+		if isLeaf(page) {
+			return currentPageID, page, bounds, nil
+		}
+		numKeys := int(getNumKeys(page))
+		i := 0
+		for i < numKeys && key >= keyAt(page, i) {
+			i++
+		}
+		if i > 0 {
+			bounds.low, bounds.hasLow = keyAt(page, i-1), true
+		}
+		if i < numKeys {
+			bounds.high, bounds.hasHigh = keyAt(page, i), true
+		}
+		if currentPageID, err = t.childOf(currentPageID, page, i, depth); err != nil {
+			return -1, nil, bounds, err
+		}
 	}
 }
 
@@ -165,191 +657,208 @@ func (t *BPlusTree) findLeafPage(key int) (PageID, error) {
 
 // Insert orchestrates the insertion process.
 func (t *BPlusTree) Insert(key int, value int64) error {
-	leafPageID, err := t.findLeafPage(key)
-	if err != nil {
+	return t.InsertBytes(key, encodeInt64Value(value))
+}
+
+// InsertContext is Insert that returns ctx.Err() instead if ctx is already done. An insert that
+// has started runs to completion, since stopping it halfway would leave a split half done.
+func (t *BPlusTree) InsertContext(ctx context.Context, key int, value int64) error {
+	if err := ctx.Err(); err != nil {
 		return err
 	}
-	leafPage, err := t.pager.ReadPage(leafPageID, new(Page))
-	if err != nil {
-		return err
+	return t.insertBytes(ctx, key, encodeInt64Value(value))
+}
+
+// InsertBytes inserts a key with an arbitrary byte value. Values too large to be stored in the
+// leaf are kept in overflow pages.
+func (t *BPlusTree) InsertBytes(key int, value []byte) error {
+	return t.insertBytes(context.Background(), key, value)
+}
+
+// insertBytes is InsertBytes with the context to start its span in.
+func (t *BPlusTree) insertBytes(ctx context.Context, key int, value []byte) error {
+	if t.metrics != nil {
+		defer t.observe("insert", time.Now())
+	}
+	span := t.startSpan(ctx, "btree.Insert", SpanAttribute{"btree.key", key})
+	err := t.insert(key, value)
+	span.end(err)
+	return err
+}
+
+// insert implements InsertBytes.
+func (t *BPlusTree) insert(key int, value []byte) error {
+	leafPageID, leafPage, appending := t.appendLeaf(key)
+	if !appending {
+		var err error
+		if leafPageID, err = t.findLeafPage(key); err != nil {
+			return err
+		}
+		if leafPage, err = t.readPage(leafPageID); err != nil {
+			return err
+		}
+		t.noteRightmostLeaf(leafPageID, leafPage)
 	}
 
 	numKeys := int(getNumKeys(leafPage))
-	// Check for duplicates
-	for i := 0; i < numKeys; i++ {
-		offset := headerSize + i*16
-		if int(binary.LittleEndian.Uint64(leafPage[offset:])) == key {
-			return fmt.Errorf("duplicate key insertion not allowed for key %d", key)
+	if !appending {
+		// Check for duplicates. An appended key is past the last one.
+		for i := 0; i < numKeys; i++ {
+			if keyAt(leafPage, i) == key {
+				t.compared(i + 1)
+				return t.duplicateKey(leafPage, i, value)
+			}
 		}
+		t.compared(numKeys)
+	}
+
+	cell, err := t.newLeafCell(key, value)
+	if err != nil {
+		return err
+	}
+	if t.bloom != nil {
+		t.bloom.Add(key)
 	}
 
 	// A leaf node is full if it has degree-1 keys.
 	if numKeys < t.degree-1 {
-		insertIntoLeaf(leafPage, key, value)
-		return t.pager.WritePage(leafPageID, leafPage)
+		insertIntoLeaf(leafPage, key, cell)
+		if err := t.writePage(leafPageID, leafPage); err != nil {
+			return err
+		}
+		return t.adjustAncestorCounts(leafPageID, leafPage, 1)
 	}
 
 	// Otherwise, split the leaf.
-	return t.splitAndInsertLeaf(leafPageID, leafPage, key, value)
+	return t.splitAndInsertLeaf(leafPageID, leafPage, key, cell)
 }
 
-// insertIntoLeaf writes a key/value pair into a leaf page's byte buffer.
-func insertIntoLeaf(page *Page, key int, value int64) {
+// insertIntoLeaf adds the cell holding a key/value pair to a leaf page, keeping its entries sorted.
+func insertIntoLeaf(page *Page, key int, cell []byte) {
 	numKeys := int(getNumKeys(page))
 	insertIndex := 0
-	for insertIndex < numKeys && key > int(binary.LittleEndian.Uint64(page[headerSize+insertIndex*16:])) {
+	for insertIndex < numKeys && key > keyAt(page, insertIndex) {
 		insertIndex++
 	}
-
-	// Shift existing keys/values to the right to make space for the new one
-	copy(page[headerSize+(insertIndex+1)*16:], page[headerSize+insertIndex*16:(headerSize+(numKeys)*16)])
-
-	offset := headerSize + insertIndex*16
-	binary.LittleEndian.PutUint64(page[offset:], uint64(key))
-	binary.LittleEndian.PutUint64(page[offset+8:], uint64(value))
-	setNumKeys(page, uint16(numKeys+1))
+	insertCell(page, insertIndex, cell)
 }
 
 // splitAndInsertLeaf handles splitting a full leaf node.
-func (t *BPlusTree) splitAndInsertLeaf(oldPageID PageID, oldPage *Page, key int, value int64) error {
+func (t *BPlusTree) splitAndInsertLeaf(oldPageID PageID, oldPage *Page, key int, cell []byte) error {
 	newPageID := t.pager.AllocatePage()
+	defer t.pin(oldPageID, newPageID)()
 	newPage := new(Page)
 	newPage[nodeTypeOffset] = NodeTypeLeaf
 	setParentPageID(newPage, getParentPageID(oldPage))
 
-	tempKeys := make([]int, 0, t.degree)
-	tempValues := make([]int64, 0, t.degree)
-
-	numKeys := int(getNumKeys(oldPage))
-	inserted := false
-	for i := 0; i < numKeys; i++ {
-		offset := headerSize + i*16
-		currentKey := int(binary.LittleEndian.Uint64(oldPage[offset:]))
-		if !inserted && key < currentKey {
-			tempKeys = append(tempKeys, key)
-			tempValues = append(tempValues, value)
-			inserted = true
-		}
-		tempKeys = append(tempKeys, currentKey)
-		tempValues = append(tempValues, int64(binary.LittleEndian.Uint64(oldPage[offset+8:])))
-	}
-	if !inserted {
-		tempKeys = append(tempKeys, key)
-		tempValues = append(tempValues, value)
-	}
+	tempKeys, tempCells := readLeafEntries(oldPage)
+	insertIndex, _ := slices.BinarySearch(tempKeys, key)
+	tempKeys = slices.Insert(tempKeys, insertIndex, key)
+	tempCells = slices.Insert(tempCells, insertIndex, cell)
 
-	splitPoint := (t.degree) / 2
-	leftKeys := tempKeys[:splitPoint]
-	leftValues := tempValues[:splitPoint]
+	splitPoint := t.leafSplitPoint(oldPage, insertIndex)
+	leftCells := tempCells[:splitPoint]
 	rightKeys := tempKeys[splitPoint:]
-	rightValues := tempValues[splitPoint:]
+	rightCells := tempCells[splitPoint:]
 
 	keyToPromote := rightKeys[0]
 
-	clear(oldPage[headerSize:])
-	setNumKeys(oldPage, uint16(len(leftKeys)))
-	for i, k := range leftKeys {
-		offset := headerSize + i*16
-		binary.LittleEndian.PutUint64(oldPage[offset:], uint64(k))
-		binary.LittleEndian.PutUint64(oldPage[offset+8:], uint64(leftValues[i]))
-	}
-
-	setNumKeys(newPage, uint16(len(rightKeys)))
-	for i, k := range rightKeys {
-		offset := headerSize + i*16
-		binary.LittleEndian.PutUint64(newPage[offset:], uint64(k))
-		binary.LittleEndian.PutUint64(newPage[offset+8:], uint64(rightValues[i]))
-	}
+	writeLeafEntries(oldPage, leftCells)
+	writeLeafEntries(newPage, rightCells)
 
+	// The new page takes over the old one's fence, and the old one ends where the new one begins.
+	copyFence(newPage, oldPage)
+	setFence(oldPage, keyToPromote, newPageID)
 	setNextLeafPageID(newPage, getNextLeafPageID(oldPage))
 	setNextLeafPageID(oldPage, newPageID)
 
-	if err := t.pager.WritePage(oldPageID, oldPage); err != nil {
+	if t.tracer != nil {
+		t.tracer.OnSplit(oldPageID, newPageID, true)
+	}
+	if t.metrics != nil {
+		t.metrics.Split(true)
+	}
+
+	// The new page goes first: a reader that finds the old page split follows its right link.
+	if err := t.writePage(newPageID, newPage); err != nil {
 		return err
 	}
-	if err := t.pager.WritePage(newPageID, newPage); err != nil {
+	if err := t.writePage(oldPageID, oldPage); err != nil {
 		return err
 	}
 
-	return t.insertIntoParent(getParentPageID(oldPage), oldPageID, keyToPromote, newPageID)
+	return t.insertIntoParent(getParentPageID(oldPage), oldPageID, len(leftCells), keyToPromote, newPageID, len(rightCells))
 }
 
 // insertIntoParent handles inserting a promoted key into an internal node, splitting if necessary.
-func (t *BPlusTree) insertIntoParent(parentPageID, leftChildID PageID, key int, rightChildID PageID) error {
+// leftCount and rightCount are the entry counts of the two halves of the split child. Together
+// they hold one entry more than the child did, so the counts above the parent grow by one.
+func (t *BPlusTree) insertIntoParent(parentPageID, leftChildID PageID, leftCount, key int, rightChildID PageID, rightCount int) error {
 	if parentPageID == -1 {
 		newRootPageID := t.pager.AllocatePage()
+		defer t.pin(newRootPageID)()
+		if t.tracer != nil {
+			t.tracer.OnPromote(key, newRootPageID)
+		}
 		newRootPage := new(Page)
 		newRootPage[nodeTypeOffset] = NodeTypeInternal
 		setIsRoot(newRootPage, true)
 		setParentPageID(newRootPage, -1)
-		setNumKeys(newRootPage, 1)
-
-		binary.LittleEndian.PutUint64(newRootPage[headerSize:], uint64(leftChildID))
-		binary.LittleEndian.PutUint64(newRootPage[headerSize+8:], uint64(key))
-		binary.LittleEndian.PutUint64(newRootPage[headerSize+16:], uint64(rightChildID))
+		writeInternalEntries(newRootPage, []int{key}, []PageID{leftChildID, rightChildID}, []int{leftCount, rightCount})
 
-		leftChildPage, _ := t.pager.ReadPage(leftChildID, new(Page))
+		leftChildPage, _ := t.readPage(leftChildID)
 		setIsRoot(leftChildPage, false)
 		setParentPageID(leftChildPage, newRootPageID)
-		t.pager.WritePage(leftChildID, leftChildPage)
+		t.writePage(leftChildID, leftChildPage)
 
-		rightChildPage, _ := t.pager.ReadPage(rightChildID, new(Page))
+		rightChildPage, _ := t.readPage(rightChildID)
 		setIsRoot(rightChildPage, false)
 		setParentPageID(rightChildPage, newRootPageID)
-		t.pager.WritePage(rightChildID, rightChildPage)
+		t.writePage(rightChildID, rightChildPage)
 
-		if err := t.pager.WritePage(newRootPageID, newRootPage); err != nil {
+		if err := t.writePage(newRootPageID, newRootPage); err != nil {
 			return err
 		}
 		t.rootPageID = newRootPageID
+		t.sharedRoot.Store(int64(newRootPageID))
 		return nil
 	}
 
-	parentPage, err := t.pager.ReadPage(parentPageID, new(Page))
+	if t.tracer != nil {
+		t.tracer.OnPromote(key, parentPageID)
+	}
+	parentPage, err := t.readPage(parentPageID)
 	if err != nil {
 		return err
 	}
 	numKeys := int(getNumKeys(parentPage))
 
-	if numKeys < t.degree-1 {
+	if numKeys < t.InternalDegree()-1 {
 		insertIndex := 0
 		for insertIndex < numKeys {
-			offset := headerSize + insertIndex*16 + 8
-			if key < int(binary.LittleEndian.Uint64(parentPage[offset:])) {
+			if key < keyAt(parentPage, insertIndex) {
 				break
 			}
 			insertIndex++
 		}
-
-		keyStart := headerSize + insertIndex*16 + 8
-		ptrStart := keyStart - 8
-		copy(parentPage[ptrStart+32:], parentPage[ptrStart+16:])
-
-		binary.LittleEndian.PutUint64(parentPage[keyStart:], uint64(key))
-		binary.LittleEndian.PutUint64(parentPage[keyStart+8:], uint64(rightChildID))
-
-		setNumKeys(parentPage, uint16(numKeys+1))
-		return t.pager.WritePage(parentPageID, parentPage)
+		setChildCountAt(parentPage, insertIndex, leftCount)
+		insertCell(parentPage, insertIndex, internalCell(key, rightChildID, rightCount))
+		if err := t.writePage(parentPageID, parentPage); err != nil {
+			return err
+		}
+		return t.adjustAncestorCounts(parentPageID, parentPage, 1)
 	}
 
 	// *** FULL INTERNAL NODE SPLIT IMPLEMENTATION ***
 	// If parent is full, we must split it too.
 	newPageID := t.pager.AllocatePage()
+	defer t.pin(parentPageID, newPageID)()
 	newPage := new(Page)
 	newPage[nodeTypeOffset] = NodeTypeInternal
 	setParentPageID(newPage, getParentPageID(parentPage))
 
-	tempKeys := make([]int, 0, t.degree)
-	tempPointers := make([]PageID, 0, t.degree+1)
-
 	// Copy existing keys and pointers to temporary slices
-	tempPointers = append(tempPointers, PageID(binary.LittleEndian.Uint64(parentPage[headerSize:])))
-	for i := 0; i < numKeys; i++ {
-		keyOffset := headerSize + i*16 + 8
-		ptrOffset := keyOffset + 8
-		tempKeys = append(tempKeys, int(binary.LittleEndian.Uint64(parentPage[keyOffset:])))
-		tempPointers = append(tempPointers, PageID(binary.LittleEndian.Uint64(parentPage[ptrOffset:])))
-	}
+	tempKeys, tempPointers, tempCounts := readInternalEntries(parentPage)
 
 	// Insert the new key and child pointer
 	insertIndex := 0
@@ -358,49 +867,427 @@ func (t *BPlusTree) insertIntoParent(parentPageID, leftChildID PageID, key int,
 	}
 	tempKeys = append(tempKeys[:insertIndex], append([]int{key}, tempKeys[insertIndex:]...)...)
 	tempPointers = append(tempPointers[:insertIndex+1], append([]PageID{rightChildID}, tempPointers[insertIndex+1:]...)...)
+	tempCounts[insertIndex] = leftCount
+	tempCounts = slices.Insert(tempCounts, insertIndex+1, rightCount)
 
 	// Split the temporary slices
-	splitPoint := (t.degree) / 2
+	splitPoint := t.InternalDegree() / 2
 	keyToPromoteAgain := tempKeys[splitPoint]
 
 	leftKeys := tempKeys[:splitPoint]
 	rightKeys := tempKeys[splitPoint+1:]
 	leftPointers := tempPointers[:splitPoint+1]
 	rightPointers := tempPointers[splitPoint+1:]
+	leftCounts := tempCounts[:splitPoint+1]
+	rightCounts := tempCounts[splitPoint+1:]
 
-	// Update the old (left) parent page
-	clear(parentPage[headerSize:])
-	setNumKeys(parentPage, uint16(len(leftKeys)))
-	binary.LittleEndian.PutUint64(parentPage[headerSize:], uint64(leftPointers[0]))
-	for i, k := range leftKeys {
-		offset := headerSize + i*16 + 8
-		binary.LittleEndian.PutUint64(parentPage[offset:], uint64(k))
-		binary.LittleEndian.PutUint64(parentPage[offset+8:], uint64(leftPointers[i+1]))
-	}
+	// Update the old (left) parent page and write the new (right) one
+	writeInternalEntries(parentPage, leftKeys, leftPointers, leftCounts)
+	writeInternalEntries(newPage, rightKeys, rightPointers, rightCounts)
+	copyFence(newPage, parentPage)
+	setFence(parentPage, keyToPromoteAgain, newPageID)
 
-	// Write the new (right) parent page
-	setNumKeys(newPage, uint16(len(rightKeys)))
-	binary.LittleEndian.PutUint64(newPage[headerSize:], uint64(rightPointers[0]))
-	for i, k := range rightKeys {
-		offset := headerSize + i*16 + 8
-		binary.LittleEndian.PutUint64(newPage[offset:], uint64(k))
-		binary.LittleEndian.PutUint64(newPage[offset+8:], uint64(rightPointers[i+1]))
+	if t.tracer != nil {
+		t.tracer.OnSplit(parentPageID, newPageID, false)
+	}
+	if t.metrics != nil {
+		t.metrics.Split(false)
 	}
 
 	// Update parent pointers of the children that were moved
 	for _, childPageID := range rightPointers {
-		childPage, _ := t.pager.ReadPage(childPageID, new(Page))
+		childPage, _ := t.readPage(childPageID)
 		setParentPageID(childPage, newPageID)
-		t.pager.WritePage(childPageID, childPage)
+		t.writePage(childPageID, childPage)
 	}
 
-	if err := t.pager.WritePage(parentPageID, parentPage); err != nil {
+	if err := t.writePage(newPageID, newPage); err != nil {
 		return err
 	}
-	if err := t.pager.WritePage(newPageID, newPage); err != nil {
+	if err := t.writePage(parentPageID, parentPage); err != nil {
 		return err
 	}
 
 	// Recursively call insertIntoParent for the grandparent
-	return t.insertIntoParent(getParentPageID(parentPage), parentPageID, keyToPromoteAgain, newPageID)
+	return t.insertIntoParent(getParentPageID(parentPage), parentPageID, subtreeCount(parentPage), keyToPromoteAgain, newPageID, subtreeCount(newPage))
+}
+
+// ====================================
+// --- FULL DELETE IMPLEMENTATION ---
+// ====================================
+
+// Delete removes a key from the tree, rebalancing any page that drops below half-full.
+// It reports whether the key was present.
+func (t *BPlusTree) Delete(key int) (bool, error) {
+	if t.metrics != nil {
+		defer t.observe("delete", time.Now())
+	}
+	leafPageID, err := t.findLeafPage(key)
+	if err != nil {
+		return false, err
+	}
+	leafPage, err := t.readPage(leafPageID)
+	if err != nil {
+		return false, err
+	}
+
+	keys, _ := readLeafEntries(leafPage)
+	index := slices.Index(keys, key)
+	if index == -1 {
+		return false, nil
+	}
+	if _, _, overflow := leafValueAt(leafPage, index); overflow != -1 {
+		if err := t.freeOverflowChain(overflow); err != nil {
+			return false, err
+		}
+	}
+	deleteCell(leafPage, index)
+	if err := t.writePage(leafPageID, leafPage); err != nil {
+		return false, err
+	}
+	if err := t.adjustAncestorCounts(leafPageID, leafPage, -1); err != nil {
+		return false, err
+	}
+
+	return true, t.rebalance(leafPageID, leafPage)
+}
+
+// minKeys is the minimum number of keys a non-root leaf must hold to stay at least half-full.
+func (t *BPlusTree) minKeys() int {
+	return (t.degree - 1) / 2
+}
+
+// minInternalKeys is minKeys for internal pages.
+func (t *BPlusTree) minInternalKeys() int {
+	return (t.InternalDegree() - 1) / 2
+}
+
+// minKeysOf returns minKeys or minInternalKeys, depending on the type of page.
+func (t *BPlusTree) minKeysOf(page *Page) int {
+	if isLeaf(page) {
+		return t.minKeys()
+	}
+	return t.minInternalKeys()
+}
+
+// rebalance restores the minimum occupancy of a page after a deletion, first by borrowing
+// an entry from a sibling and otherwise by merging with one, which may cascade up to the root.
+func (t *BPlusTree) rebalance(pageID PageID, page *Page) error {
+	if pageID == t.rootPageID {
+		// The root is allowed to underflow. An internal root with no keys left has a
+		// single child, which becomes the new root and shrinks the tree by one level.
+		if isLeaf(page) || getNumKeys(page) > 0 {
+			return nil
+		}
+		_, children, _ := readInternalEntries(page)
+		defer t.pin(pageID, children[0])()
+		defer t.rebalancing(pageID, children[0])()
+		newRootPage, err := t.readPage(children[0])
+		if err != nil {
+			return err
+		}
+		setIsRoot(newRootPage, true)
+		setParentPageID(newRootPage, -1)
+		if err := t.writePage(children[0], newRootPage); err != nil {
+			return err
+		}
+		t.rootPageID = children[0]
+		t.sharedRoot.Store(int64(children[0]))
+		return t.releasePage(pageID, page)
+	}
+	minKeys := t.minKeysOf(page)
+	if int(getNumKeys(page)) >= minKeys {
+		return nil
+	}
+
+	parentPageID := getParentPageID(page)
+	parentPage, err := t.readPage(parentPageID)
+	if err != nil {
+		return err
+	}
+	_, children, _ := readInternalEntries(parentPage)
+	childIndex := slices.Index(children, pageID)
+	// The borrow or merge below changes the page, its parent and a sibling.
+	changed := append(slices.Clone(children[max(childIndex-1, 0):min(childIndex+2, len(children))]), parentPageID)
+	defer t.pin(changed...)()
+	defer t.rebalancing(changed...)()
+
+	var leftPageID, rightPageID PageID
+	var leftPage, rightPage *Page
+	if childIndex > 0 {
+		leftPageID = children[childIndex-1]
+		if leftPage, err = t.readPage(leftPageID); err != nil {
+			return err
+		}
+		if int(getNumKeys(leftPage)) > minKeys {
+			return t.borrowFromLeft(pageID, page, leftPageID, leftPage, parentPageID, parentPage, childIndex-1)
+		}
+	}
+	if childIndex < len(children)-1 {
+		rightPageID = children[childIndex+1]
+		if rightPage, err = t.readPage(rightPageID); err != nil {
+			return err
+		}
+		if int(getNumKeys(rightPage)) > minKeys {
+			return t.borrowFromRight(pageID, page, rightPageID, rightPage, parentPageID, parentPage, childIndex)
+		}
+	}
+
+	// Neither sibling can spare an entry, so merge with one of them.
+	if leftPage != nil {
+		err = t.mergePages(leftPageID, leftPage, pageID, page, parentPageID, parentPage, childIndex-1)
+	} else {
+		err = t.mergePages(pageID, page, rightPageID, rightPage, parentPageID, parentPage, childIndex)
+	}
+	if err != nil {
+		return err
+	}
+	return t.rebalance(parentPageID, parentPage)
+}
+
+// borrowFromLeft moves the last entry of the left sibling into the page and fixes the separator in the parent.
+func (t *BPlusTree) borrowFromLeft(pageID PageID, page *Page, leftPageID PageID, leftPage *Page, parentPageID PageID, parentPage *Page, separatorIndex int) error {
+	parentKeys, parentChildren, parentCounts := readInternalEntries(parentPage)
+
+	if isLeaf(page) {
+		leftKeys, leftCells := readLeafEntries(leftPage)
+		_, cells := readLeafEntries(page)
+		last := len(leftKeys) - 1
+		cells = slices.Insert(cells, 0, leftCells[last])
+		writeLeafEntries(leftPage, leftCells[:last])
+		writeLeafEntries(page, cells)
+		parentKeys[separatorIndex] = leftKeys[last]
+		setHighKey(leftPage, leftKeys[last])
+	} else {
+		// The separator comes down into the page and the left sibling's last key goes up to replace it.
+		leftKeys, leftChildren, leftCounts := readInternalEntries(leftPage)
+		keys, children, counts := readInternalEntries(page)
+		last := len(leftKeys) - 1
+		movedChildID := leftChildren[last+1]
+		keys = slices.Insert(keys, 0, parentKeys[separatorIndex])
+		children = slices.Insert(children, 0, movedChildID)
+		counts = slices.Insert(counts, 0, leftCounts[last+1])
+		parentKeys[separatorIndex] = leftKeys[last]
+		writeInternalEntries(leftPage, leftKeys[:last], leftChildren[:last+1], leftCounts[:last+1])
+		setHighKey(leftPage, leftKeys[last])
+		writeInternalEntries(page, keys, children, counts)
+		if err := t.setParent(movedChildID, pageID); err != nil {
+			return err
+		}
+	}
+	parentCounts[separatorIndex] = subtreeCount(leftPage)
+	parentCounts[separatorIndex+1] = subtreeCount(page)
+	writeInternalEntries(parentPage, parentKeys, parentChildren, parentCounts)
+
+	if err := t.writePage(leftPageID, leftPage); err != nil {
+		return err
+	}
+	if err := t.writePage(pageID, page); err != nil {
+		return err
+	}
+	return t.writePage(parentPageID, parentPage)
+}
+
+// borrowFromRight moves the first entry of the right sibling into the page and fixes the separator in the parent.
+func (t *BPlusTree) borrowFromRight(pageID PageID, page *Page, rightPageID PageID, rightPage *Page, parentPageID PageID, parentPage *Page, separatorIndex int) error {
+	parentKeys, parentChildren, parentCounts := readInternalEntries(parentPage)
+
+	if isLeaf(page) {
+		rightKeys, rightCells := readLeafEntries(rightPage)
+		_, cells := readLeafEntries(page)
+		cells = append(cells, rightCells[0])
+		writeLeafEntries(rightPage, rightCells[1:])
+		writeLeafEntries(page, cells)
+		parentKeys[separatorIndex] = rightKeys[1]
+		setHighKey(page, rightKeys[1])
+	} else {
+		// The separator comes down into the page and the right sibling's first key goes up to replace it.
+		rightKeys, rightChildren, rightCounts := readInternalEntries(rightPage)
+		keys, children, counts := readInternalEntries(page)
+		movedChildID := rightChildren[0]
+		keys = append(keys, parentKeys[separatorIndex])
+		children = append(children, movedChildID)
+		counts = append(counts, rightCounts[0])
+		parentKeys[separatorIndex] = rightKeys[0]
+		writeInternalEntries(rightPage, rightKeys[1:], rightChildren[1:], rightCounts[1:])
+		writeInternalEntries(page, keys, children, counts)
+		setHighKey(page, rightKeys[0])
+		if err := t.setParent(movedChildID, pageID); err != nil {
+			return err
+		}
+	}
+	parentCounts[separatorIndex] = subtreeCount(page)
+	parentCounts[separatorIndex+1] = subtreeCount(rightPage)
+	writeInternalEntries(parentPage, parentKeys, parentChildren, parentCounts)
+
+	if err := t.writePage(rightPageID, rightPage); err != nil {
+		return err
+	}
+	if err := t.writePage(pageID, page); err != nil {
+		return err
+	}
+	return t.writePage(parentPageID, parentPage)
+}
+
+// mergePages folds the right page into the left one and removes the separator between them from the parent.
+func (t *BPlusTree) mergePages(leftPageID PageID, leftPage *Page, rightPageID PageID, rightPage *Page, parentPageID PageID, parentPage *Page, separatorIndex int) error {
+	parentKeys, parentChildren, parentCounts := readInternalEntries(parentPage)
+
+	if isLeaf(leftPage) {
+		_, leftCells := readLeafEntries(leftPage)
+		_, rightCells := readLeafEntries(rightPage)
+		writeLeafEntries(leftPage, append(leftCells, rightCells...))
+		setNextLeafPageID(leftPage, getNextLeafPageID(rightPage))
+	} else {
+		// The separator is pulled down between the two halves.
+		leftKeys, leftChildren, leftCounts := readInternalEntries(leftPage)
+		rightKeys, rightChildren, rightCounts := readInternalEntries(rightPage)
+		leftKeys = append(leftKeys, parentKeys[separatorIndex])
+		writeInternalEntries(leftPage, append(leftKeys, rightKeys...), append(leftChildren, rightChildren...), append(leftCounts, rightCounts...))
+		for _, childPageID := range rightChildren {
+			if err := t.setParent(childPageID, leftPageID); err != nil {
+				return err
+			}
+		}
+	}
+	copyFence(leftPage, rightPage)
+	parentCounts[separatorIndex] = subtreeCount(leftPage)
+	writeInternalEntries(parentPage,
+		slices.Delete(parentKeys, separatorIndex, separatorIndex+1),
+		slices.Delete(parentChildren, separatorIndex+1, separatorIndex+2),
+		slices.Delete(parentCounts, separatorIndex+1, separatorIndex+2))
+
+	if t.tracer != nil {
+		t.tracer.OnMerge(leftPageID, rightPageID, isLeaf(leftPage))
+	}
+	if t.metrics != nil {
+		t.metrics.Merge(isLeaf(leftPage))
+	}
+	if err := t.writePage(leftPageID, leftPage); err != nil {
+		return err
+	}
+	if err := t.writePage(parentPageID, parentPage); err != nil {
+		return err
+	}
+
+	return t.releasePage(rightPageID, rightPage)
+}
+
+// releasePage clears a page that is no longer referenced by the tree, so it doesn't look like
+// a live node (or a second root) when the index file is scanned or inspected.
+func (t *BPlusTree) releasePage(pageID PageID, page *Page) error {
+	clear(page[:])
+	setParentPageID(page, -1)
+	setNextLeafPageID(page, -1)
+	return t.writePage(pageID, page)
+}
+
+// newReleasedPage returns a page as releasePage leaves it.
+func newReleasedPage() *Page {
+	page := new(Page)
+	setParentPageID(page, -1)
+	setNextLeafPageID(page, -1)
+	return page
+}
+
+// pin pins pages in the buffer pool while a split or merge changes them together, and returns a
+// function that unpins them.
+func (t *BPlusTree) pin(pageIDs ...PageID) func() {
+	for _, pageID := range pageIDs {
+		t.pool.Pin(pageID)
+	}
+	return func() {
+		for _, pageID := range pageIDs {
+			t.pool.Unpin(pageID)
+		}
+	}
+}
+
+// rebalancing marks a rebalance of the given pages in progress for optimistic readers, by locking
+// their versions, and returns a function that ends it.
+func (t *BPlusTree) rebalancing(pageIDs ...PageID) func() {
+	t.rebalanceDepth++
+	t.pool.lockVersions(pageIDs...)
+	return func() {
+		t.pool.unlockVersions(pageIDs...)
+		t.rebalanceDepth--
+	}
+}
+
+// setParent rewrites the parent pointer stored in a child page's header.
+func (t *BPlusTree) setParent(childPageID, parentPageID PageID) error {
+	childPage, err := t.readPage(childPageID)
+	if err != nil {
+		return err
+	}
+	setParentPageID(childPage, parentPageID)
+	return t.writePage(childPageID, childPage)
+}
+
+// readLeafEntries returns the keys stored in a leaf page and a copy of the cell holding each
+// key/value pair. Moving whole cells between pages keeps large values in their overflow pages.
+func readLeafEntries(page *Page) ([]int, [][]byte) {
+	numKeys := int(getNumKeys(page))
+	keys := make([]int, numKeys)
+	cells := make([][]byte, numKeys)
+	for i := 0; i < numKeys; i++ {
+		keys[i] = keyAt(page, i)
+		cells[i] = slices.Clone(cellAt(page, i))
+	}
+	return keys, cells
+}
+
+// writeLeafEntries replaces the contents of a leaf page with the given cells.
+func writeLeafEntries(page *Page, cells [][]byte) {
+	resetCells(page)
+	for i, cell := range cells {
+		insertCell(page, i, cell)
+	}
+}
+
+// readInternalEntries decodes the separator keys, child page IDs and child entry counts stored in
+// an internal page. There is always one more child than there are keys.
+func readInternalEntries(page *Page) ([]int, []PageID, []int) {
+	numKeys := int(getNumKeys(page))
+	keys := make([]int, numKeys)
+	children := make([]PageID, numKeys+1)
+	counts := make([]int, numKeys+1)
+	children[0] = getLeftmostChild(page)
+	counts[0] = childCountAt(page, 0)
+	for i := 0; i < numKeys; i++ {
+		keys[i] = keyAt(page, i)
+		children[i+1] = childAt(page, i+1)
+		counts[i+1] = childCountAt(page, i+1)
+	}
+	return keys, children, counts
+}
+
+// writeInternalEntries replaces the contents of an internal page with the given keys, children
+// and child entry counts.
+func writeInternalEntries(page *Page, keys []int, children []PageID, counts []int) {
+	resetCells(page)
+	setLeftmostChild(page, children[0])
+	setChildCountAt(page, 0, counts[0])
+	for i, k := range keys {
+		insertCell(page, i, internalCell(k, children[i+1], counts[i+1]))
+	}
+}
+
+// adjustAncestorCounts adds delta to the entry count every ancestor of a page keeps for the
+// subtree leading to it, after delta entries were added to (or removed from) that page's subtree.
+func (t *BPlusTree) adjustAncestorCounts(pageID PageID, page *Page, delta int) error {
+	for parentPageID := getParentPageID(page); parentPageID != -1; parentPageID = getParentPageID(page) {
+		parentPage, err := t.readPage(parentPageID)
+		if err != nil {
+			return err
+		}
+		_, children, _ := readInternalEntries(parentPage)
+		i := slices.Index(children, pageID)
+		setChildCountAt(parentPage, i, childCountAt(parentPage, i)+delta)
+		if err := t.writePage(parentPageID, parentPage); err != nil {
+			return err
+		}
+		pageID, page = parentPageID, parentPage
+	}
+	return nil
 }
@@ -0,0 +1,459 @@
+package main
+
+import (
+	"cmp"
+	"container/list"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+// =================================================================================================
+// --- bufferpool.go --- (Buffer Pool Manager)
+// =================================================================================================
+
+// defaultBufferPoolFrames is the number of pages a tree keeps cached in memory (4MB of pages).
+const defaultBufferPoolFrames = 1024
+
+// BufferPool caches pages in memory between the tree and its PageStore, evicting the least recently
+// used page when it is full.
+//
+// By default it is write-through: every WritePage also goes to the Pager before returning. Once
+// StartFlusher has been called it becomes write-back: WritePage only updates the cached page and
+// marks it dirty, and a background goroutine periodically writes the dirty pages out, so the
+// caller no longer waits for the disk. Flush and Close drain every dirty page synchronously,
+// except for pinned ones.
+//
+// A split or merge changes a page and its parent and siblings one after another. Pin keeps such a
+// page in the pool until the matching Unpin: a pinned page is never evicted, and a write-back
+// flush leaves it dirty rather than write some pages of the change without the others. Pins nest,
+// so a page pinned twice stays pinned until it is unpinned twice. A page can be pinned before it
+// is cached; the pin holds once it is. In write-through mode every write still goes to the Pager.
+type BufferPool struct {
+	mu       sync.Mutex
+	pager    PageStore
+	capacity int
+	frames   map[PageID]*frame
+	lru      *list.List // front = most recently used
+	// pins counts the Pins of each pinned page that haven't been unpinned yet.
+	pins map[PageID]int
+	// versions holds the version of every page a rebalance has locked since optimistic reads were
+	// enabled, and is nil before; locks counts the nested locks of each locked page (see
+	// optimistic.go).
+	versions map[PageID]uint64
+	locks    map[PageID]int
+
+	writeBack bool
+	// metrics counts the reads, hits and writes, if set (see metrics.go).
+	metrics Metrics
+	// appliedLSN is the highest WAL LSN whose page changes have been handed to the pool.
+	appliedLSN uint64
+	// forceLog, if set, forces the WAL to disk up to an LSN. A page is only written to the Pager
+	// once the log holds the change with its pageLSN (see aries.go).
+	forceLog func(lsn uint64) error
+
+	// flushMu serializes flushes, so the same page is never being written by two of them at once.
+	flushMu      sync.Mutex
+	onCheckpoint func(lsn uint64) error
+	stop         chan struct{}
+	stopped      chan struct{}
+	flusherErr   error
+}
+
+// frame is a cached page.
+type frame struct {
+	pageID PageID
+	page   Page
+	elem   *list.Element
+
+	dirty bool
+	// version increases with every write, so a flush can tell whether the page changed while
+	// it was being written out.
+	version uint64
+	// recLSN is the LSN of the first logged change that made the page dirty, or 0 for changes
+	// that were not logged.
+	recLSN uint64
+	// pageLSN is the LSN of the last logged change to the page, or 0.
+	pageLSN uint64
+	// flushing frames are being written out by a flush and must not be evicted meanwhile.
+	flushing bool
+}
+
+var errFlusherRunning = errors.New("background flusher is already running")
+
+func NewBufferPool(pager PageStore, capacity int) *BufferPool {
+	return &BufferPool{
+		pager:    pager,
+		capacity: capacity,
+		frames:   make(map[PageID]*frame),
+		lru:      list.New(),
+		pins:     make(map[PageID]int),
+	}
+}
+
+// Pin keeps a page in the pool, and out of flushes, until it is unpinned.
+func (bp *BufferPool) Pin(pageID PageID) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	bp.pins[pageID]++
+}
+
+// Unpin undoes a Pin of a page. It panics if the page isn't pinned.
+func (bp *BufferPool) Unpin(pageID PageID) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	switch bp.pins[pageID] {
+	case 0:
+		panic(fmt.Sprintf("buffer pool: unpin of page %d, which isn't pinned", pageID))
+	case 1:
+		delete(bp.pins, pageID)
+	default:
+		bp.pins[pageID]--
+	}
+}
+
+// trackVersions starts counting page versions, if it hasn't yet.
+func (bp *BufferPool) trackVersions() {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	if bp.versions == nil {
+		bp.versions = make(map[PageID]uint64)
+		bp.locks = make(map[PageID]int)
+	}
+}
+
+// lockVersions makes the version of each page odd, unless it is locked already, until the matching
+// unlockVersions. Locks nest as pins do. It does nothing before trackVersions.
+func (bp *BufferPool) lockVersions(pageIDs ...PageID) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	if bp.versions == nil {
+		return
+	}
+	for _, pageID := range pageIDs {
+		if bp.locks[pageID]++; bp.locks[pageID] == 1 {
+			bp.versions[pageID]++
+		}
+	}
+}
+
+// unlockVersions undoes a lockVersions of the pages: the last unlock of a page makes its version
+// even again, and higher than before the lock.
+func (bp *BufferPool) unlockVersions(pageIDs ...PageID) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	if bp.versions == nil {
+		return
+	}
+	for _, pageID := range pageIDs {
+		if bp.locks[pageID]--; bp.locks[pageID] == 0 {
+			delete(bp.locks, pageID)
+			bp.versions[pageID]++
+		}
+	}
+}
+
+// pageVersion returns the current version of a page.
+func (bp *BufferPool) pageVersion(pageID PageID) uint64 {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	return bp.versions[pageID]
+}
+
+// readVersioned is ReadPage that also returns the version the page had when it was copied.
+func (bp *BufferPool) readVersioned(pageID PageID, pageData *Page) (*Page, uint64, error) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	page, err := bp.readPage(pageID, pageData)
+	return page, bp.versions[pageID], err
+}
+
+// ReadPage copies a page into pageData, loading it from the Pager if it isn't cached.
+func (bp *BufferPool) ReadPage(pageID PageID, pageData *Page) (*Page, error) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	return bp.readPage(pageID, pageData)
+}
+
+// readPage implements ReadPage. The caller must hold bp.mu.
+func (bp *BufferPool) readPage(pageID PageID, pageData *Page) (*Page, error) {
+
+	if f, ok := bp.frames[pageID]; ok {
+		bp.lru.MoveToFront(f.elem)
+		*pageData = f.page
+		if bp.metrics != nil {
+			bp.metrics.PageRead(true)
+		}
+		return pageData, nil
+	}
+	if bp.metrics != nil {
+		bp.metrics.PageRead(false)
+	}
+	page, err := bp.pager.ReadPage(pageID, pageData)
+	if err != nil {
+		return pageData, err
+	}
+	// The store may hand back its own read-only page instead of filling pageData.
+	if page != pageData {
+		*pageData = *page
+	}
+	if err := bp.addFrame(pageID, pageData); err != nil {
+		return pageData, err
+	}
+	return pageData, nil
+}
+
+// WritePage stores a page in the pool. In write-through mode it is also written to the Pager.
+func (bp *BufferPool) WritePage(pageID PageID, pageData *Page) error {
+	return bp.writePage(pageID, pageData, 0)
+}
+
+// writeLoggedPage stores a page whose change was logged in the WAL at recLSN. The page isn't
+// written to the Pager before the log is on disk up to there.
+func (bp *BufferPool) writeLoggedPage(pageID PageID, pageData *Page, recLSN uint64) error {
+	return bp.writePage(pageID, pageData, recLSN)
+}
+
+func (bp *BufferPool) writePage(pageID PageID, pageData *Page, recLSN uint64) error {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+
+	f, ok := bp.frames[pageID]
+	if ok {
+		f.page = *pageData
+		bp.lru.MoveToFront(f.elem)
+	} else {
+		if err := bp.addFrame(pageID, pageData); err != nil {
+			return err
+		}
+		f = bp.frames[pageID]
+	}
+	f.version++
+	f.pageLSN = max(f.pageLSN, recLSN)
+
+	if !bp.writeBack {
+		if err := bp.forceLogTo(f.pageLSN); err != nil {
+			return err
+		}
+		return bp.writeToPager(bp.metrics, pageID, &f.page)
+	}
+	if !f.dirty {
+		f.dirty = true
+		f.recLSN = recLSN
+	}
+	return nil
+}
+
+// addFrame caches a page, evicting the least recently used page that is neither pinned nor being
+// flushed if the pool is full. If every page is, the pool grows past its capacity for now. A
+// dirty victim is written to the Pager first, and the frame of a victim holds the new page, so a
+// full pool doesn't allocate. The caller must hold bp.mu.
+func (bp *BufferPool) addFrame(pageID PageID, pageData *Page) error {
+	var f *frame
+	for elem := bp.lru.Back(); elem != nil && len(bp.frames) >= bp.capacity; {
+		victim := elem.Value.(*frame)
+		elem = elem.Prev()
+		if victim.flushing || bp.pins[victim.pageID] > 0 {
+			continue
+		}
+		if victim.dirty {
+			if err := bp.forceLogTo(victim.pageLSN); err != nil {
+				return err
+			}
+			if err := bp.writeToPager(bp.metrics, victim.pageID, &victim.page); err != nil {
+				return err
+			}
+		}
+		bp.lru.Remove(victim.elem)
+		delete(bp.frames, victim.pageID)
+		f = victim
+	}
+
+	if f == nil {
+		f = new(frame)
+	}
+	*f = frame{pageID: pageID, page: *pageData}
+	f.elem = bp.lru.PushFront(f)
+	bp.frames[pageID] = f
+	return nil
+}
+
+// forceLogTo forces the WAL to disk up to lsn, if the pool has a forceLog and lsn is not 0.
+func (bp *BufferPool) forceLogTo(lsn uint64) error {
+	if bp.forceLog == nil || lsn == 0 {
+		return nil
+	}
+	return bp.forceLog(lsn)
+}
+
+// writeToPager writes a page to the Pager, counting it in metrics unless that is nil. The metrics
+// are passed in, since Flush writes without holding bp.mu.
+func (bp *BufferPool) writeToPager(metrics Metrics, pageID PageID, pageData *Page) error {
+	if metrics != nil {
+		metrics.PageWrite()
+	}
+	return bp.pager.WritePage(pageID, pageData)
+}
+
+// setMetrics installs the metrics the pool reports to, or removes them if metrics is nil.
+func (bp *BufferPool) setMetrics(metrics Metrics) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	bp.metrics = metrics
+}
+
+// HintScan passes a scan cursor's hint on to the page store, unless the page is already cached.
+func (bp *BufferPool) HintScan(nextPageID PageID) {
+	bp.mu.Lock()
+	_, cached := bp.frames[nextPageID]
+	bp.mu.Unlock()
+	if hinter, ok := bp.pager.(ScanHinter); ok && !cached {
+		hinter.HintScan(nextPageID)
+	}
+}
+
+// reset drops every cached page, e.g. after the underlying file has been replaced. The pool must
+// have been flushed first.
+func (bp *BufferPool) reset() {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	bp.frames = make(map[PageID]*frame)
+	bp.lru.Init()
+}
+
+// advanceAppliedLSN records that every page change logged up to lsn has been handed to the pool.
+func (bp *BufferPool) advanceAppliedLSN(lsn uint64) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	bp.appliedLSN = max(bp.appliedLSN, lsn)
+}
+
+// checkpointLSN returns the LSN from which WAL replay has to start: every logged change before it
+// is already in the index file. The caller must hold bp.mu.
+func (bp *BufferPool) checkpointLSN() uint64 {
+	lsn := bp.appliedLSN + 1
+	for _, f := range bp.frames {
+		if f.dirty && f.recLSN != 0 {
+			lsn = min(lsn, f.recLSN)
+		}
+	}
+	return lsn
+}
+
+// Flush writes every dirty page that isn't pinned to the Pager and then reports the new checkpoint
+// LSN to the callback registered with StartFlusher, if any. Pinned pages stay dirty, and keep the
+// checkpoint LSN from passing their changes.
+func (bp *BufferPool) Flush() error {
+	bp.flushMu.Lock()
+	defer bp.flushMu.Unlock()
+
+	// Take a copy of every dirty page. The frames stay dirty until they have been written, so a
+	// page that changes again meanwhile is still flushed next time.
+	type flushItem struct {
+		frame   *frame
+		page    Page
+		version uint64
+	}
+	bp.mu.Lock()
+	var items []flushItem
+	var pageLSN uint64
+	for _, f := range bp.frames {
+		if f.dirty && bp.pins[f.pageID] == 0 {
+			f.flushing = true
+			items = append(items, flushItem{frame: f, page: f.page, version: f.version})
+			pageLSN = max(pageLSN, f.pageLSN)
+		}
+	}
+	metrics := bp.metrics
+	bp.mu.Unlock()
+	// Writing in page order keeps the disk access pattern sequential.
+	slices.SortFunc(items, func(a, b flushItem) int { return cmp.Compare(a.frame.pageID, b.frame.pageID) })
+
+	err := bp.forceLogTo(pageLSN)
+	written := 0
+	for ; err == nil && written < len(items); written++ {
+		if err = bp.writeToPager(metrics, items[written].frame.pageID, &items[written].page); err != nil {
+			break
+		}
+	}
+
+	bp.mu.Lock()
+	for i, item := range items {
+		item.frame.flushing = false
+		// A page that changed again while it was being written stays dirty.
+		if i < written && item.frame.version == item.version {
+			item.frame.dirty = false
+			item.frame.recLSN = 0
+		}
+	}
+	lsn := bp.checkpointLSN()
+	onCheckpoint := bp.onCheckpoint
+	bp.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+	if onCheckpoint != nil {
+		return onCheckpoint(lsn)
+	}
+	return nil
+}
+
+// StartFlusher switches the pool to write-back mode and starts a goroutine that flushes the dirty
+// pages every interval. After each flush, onCheckpoint (which may be nil) is called with the new
+// checkpoint LSN, e.g. to record it in the WAL.
+func (bp *BufferPool) StartFlusher(interval time.Duration, onCheckpoint func(lsn uint64) error) error {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	if bp.stop != nil {
+		return errFlusherRunning
+	}
+	bp.writeBack = true
+	bp.onCheckpoint = onCheckpoint
+	bp.stop = make(chan struct{})
+	bp.stopped = make(chan struct{})
+
+	go func(stop, stopped chan struct{}) {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := bp.Flush(); err != nil {
+					bp.mu.Lock()
+					bp.flusherErr = err
+					bp.mu.Unlock()
+				}
+			case <-stop:
+				return
+			}
+		}
+	}(bp.stop, bp.stopped)
+	return nil
+}
+
+// Close stops the background flusher, if it is running, and writes out every dirty page.
+// The pool goes back to write-through mode and can still be used afterwards.
+func (bp *BufferPool) Close() error {
+	bp.mu.Lock()
+	stop, stopped := bp.stop, bp.stopped
+	bp.stop, bp.stopped = nil, nil
+	bp.mu.Unlock()
+	if stop != nil {
+		close(stop)
+		<-stopped
+	}
+
+	err := bp.Flush()
+
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	bp.writeBack = false
+	bp.onCheckpoint = nil
+	err = errors.Join(bp.flusherErr, err)
+	bp.flusherErr = nil
+	return err
+}
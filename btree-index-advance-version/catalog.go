@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// =================================================================================================
+// --- catalog.go --- (Catalog of Buckets)
+// =================================================================================================
+
+// One index file can hold several B+ trees: the main tree, and any number of named buckets (see
+// KVStore.CreateBucket). Each bucket's root page is recorded in the catalog page, which is created
+// along with the first bucket and found by scanning the file, like the meta page.
+//
+// Every tree's root page carries the root flag, so when a file with a catalog is opened, the main
+// tree's root is the flagged page that isn't a bucket's root.
+//
+// Catalog page layout:
+//
+//	| header (32 bytes) | root PageID int64 | name length uint8 | name | root PageID int64 | ...
+//
+// The header's numKeys holds the number of buckets. The catalog is a single page, which limits how
+// many buckets a file can have.
+
+const NodeTypeCatalog = 4
+
+const maxBucketNameLength = 255
+
+var (
+	ErrBucketNotFound = errors.New("bucket not found")
+	ErrBucketExists   = errors.New("bucket already exists")
+	errCatalogFull    = errors.New("catalog page is full")
+	errBadBucketName  = fmt.Errorf("bucket name must be 1 to %d bytes long", maxBucketNameLength)
+)
+
+// catalogEntry is a bucket in the catalog.
+type catalogEntry struct {
+	name string
+	root PageID
+}
+
+func readCatalogEntries(page *Page) []catalogEntry {
+	entries := make([]catalogEntry, getNumKeys(page))
+	offset := headerSize
+	for i := range entries {
+		entries[i].root = PageID(binary.LittleEndian.Uint64(page[offset:]))
+		nameLength := int(page[offset+8])
+		entries[i].name = string(page[offset+9 : offset+9+nameLength])
+		offset += 9 + nameLength
+	}
+	return entries
+}
+
+func writeCatalogEntries(page *Page, entries []catalogEntry) error {
+	offset := headerSize
+	for _, e := range entries {
+		if offset+9+len(e.name) > PageSize {
+			return errCatalogFull
+		}
+		binary.LittleEndian.PutUint64(page[offset:], uint64(e.root))
+		page[offset+8] = byte(len(e.name))
+		copy(page[offset+9:], e.name)
+		offset += 9 + len(e.name)
+	}
+	clear(page[offset:])
+	setNumKeys(page, uint16(len(entries)))
+	return nil
+}
+
+// findPageOfType returns the ID of the first page of the given node type, or -1 if there is none.
+func findPageOfType(pager PageStore, nodeType byte) PageID {
+	buf := new(Page)
+	for i := int64(0); i < pager.NumPages(); i++ {
+		page, err := pager.ReadPage(PageID(i), buf)
+		if err != nil {
+			break
+		}
+		if page[nodeTypeOffset] == nodeType {
+			return PageID(i)
+		}
+	}
+	return -1
+}
+
+// bucketRoots returns the root pages of the buckets in the catalog page of pager, if any.
+func bucketRoots(pager PageStore, catalogPageID PageID) []PageID {
+	if catalogPageID == -1 {
+		return nil
+	}
+	page, err := pager.ReadPage(catalogPageID, new(Page))
+	if err != nil {
+		return nil
+	}
+	var roots []PageID
+	for _, e := range readCatalogEntries(page) {
+		roots = append(roots, e.root)
+	}
+	return roots
+}
+
+// buckets returns the buckets in the catalog.
+func (t *BPlusTree) buckets() ([]catalogEntry, error) {
+	if t.catalogPageID == -1 {
+		return nil, nil
+	}
+	page, err := t.readPage(t.catalogPageID)
+	if err != nil {
+		return nil, err
+	}
+	return readCatalogEntries(page), nil
+}
+
+// bucketRoot returns the root page of the named bucket.
+func (t *BPlusTree) bucketRoot(name string) (PageID, error) {
+	entries, err := t.buckets()
+	if err != nil {
+		return -1, err
+	}
+	i := slices.IndexFunc(entries, func(e catalogEntry) bool { return e.name == name })
+	if i == -1 {
+		return -1, fmt.Errorf("%w: %q", ErrBucketNotFound, name)
+	}
+	return entries[i].root, nil
+}
+
+// setBuckets rewrites the catalog, allocating the catalog page the first time.
+func (t *BPlusTree) setBuckets(entries []catalogEntry) error {
+	page := new(Page)
+	page[nodeTypeOffset] = NodeTypeCatalog
+	setParentPageID(page, -1)
+	if err := writeCatalogEntries(page, entries); err != nil {
+		return err
+	}
+	if t.catalogPageID == -1 {
+		t.catalogPageID = t.pager.AllocatePage()
+		// The header tells Open where the catalog is.
+		if err := t.writeIndexHeader(); err != nil {
+			return err
+		}
+	}
+	return t.writePage(t.catalogPageID, page)
+}
+
+// createBucket adds a bucket with an empty tree to the catalog.
+func (t *BPlusTree) createBucket(name string) error {
+	if len(name) == 0 || len(name) > maxBucketNameLength {
+		return errBadBucketName
+	}
+	if t.bloom != nil {
+		return errBloomWithBuckets
+	}
+	entries, err := t.buckets()
+	if err != nil {
+		return err
+	}
+	if slices.ContainsFunc(entries, func(e catalogEntry) bool { return e.name == name }) {
+		return fmt.Errorf("%w: %q", ErrBucketExists, name)
+	}
+	rootPageID := t.pager.AllocatePage()
+	root := new(Page)
+	root[nodeTypeOffset] = NodeTypeLeaf
+	setIsRoot(root, true)
+	setParentPageID(root, -1)
+	resetCells(root)
+	setNextLeafPageID(root, -1)
+	if err := t.writePage(rootPageID, root); err != nil {
+		return err
+	}
+	return t.setBuckets(append(entries, catalogEntry{name, rootPageID}))
+}
+
+// setBucketRoot records a new root page for the named bucket.
+func (t *BPlusTree) setBucketRoot(name string, rootPageID PageID) error {
+	entries, err := t.buckets()
+	if err != nil {
+		return err
+	}
+	for i := range entries {
+		if entries[i].name == name {
+			entries[i].root = rootPageID
+			return t.setBuckets(entries)
+		}
+	}
+	return fmt.Errorf("%w: %q", ErrBucketNotFound, name)
+}
+
+// deleteBucket removes the named bucket from the catalog. Its pages stay in the file, unused.
+func (t *BPlusTree) deleteBucket(name string) error {
+	entries, err := t.buckets()
+	if err != nil {
+		return err
+	}
+	i := slices.IndexFunc(entries, func(e catalogEntry) bool { return e.name == name })
+	if i == -1 {
+		return fmt.Errorf("%w: %q", ErrBucketNotFound, name)
+	}
+	// Clear the root flag, or the old root could be taken for the main tree's root.
+	root, err := t.readPage(entries[i].root)
+	if err != nil {
+		return err
+	}
+	if err := t.releasePage(entries[i].root, root); err != nil {
+		return err
+	}
+	return t.setBuckets(slices.Delete(entries, i, i+1))
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// =================================================================================================
+// --- cdc.go --- (Change Data Capture)
+// =================================================================================================
+
+// The WAL knows every committed change, but as page images and rows: which key moved to which
+// row is lost in them. So a transaction also logs a change record for every key it inserted or
+// deleted, with the offsets of the key's row before and after, and Subscribe turns the change
+// records of each committed transaction into events, in commit order:
+//
+//	err := db.Subscribe(ctx, 0, func(e ChangeEvent) error {
+//		cache.Invalidate(e.Key) // e.Kind, e.OldOffset, e.NewOffset, e.LSN
+//		return nil
+//	})
+//
+// Several changes to a key in one transaction add up to one event: deleting a key and inserting
+// it again, as a PUT does, is an update, and inserting a key and deleting it again is left out.
+// Transactions that roll back never commit, so they never show up.
+//
+// Subscribe reads the WAL file from the start and then waits at its end for more, as the leader
+// does for its replicas (see replication.go). Every event carries the LSN of its transaction's
+// commit record, so a consumer that stops can resume from the last LSN it handled. `go run .
+// serve` streams the events as JSON Lines from GET /changes?from=LSN.
+
+// ChangeKind is what a transaction did to a key.
+type ChangeKind int
+
+const (
+	ChangeInsert ChangeKind = iota + 1
+	ChangeUpdate
+	ChangeDelete
+)
+
+func (k ChangeKind) String() string {
+	switch k {
+	case ChangeInsert:
+		return "insert"
+	case ChangeUpdate:
+		return "update"
+	case ChangeDelete:
+		return "delete"
+	}
+	return fmt.Sprintf("ChangeKind(%d)", int(k))
+}
+
+// MarshalText makes the kind show up as a word in JSON.
+func (k ChangeKind) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+// ChangeEvent is a committed change to a key.
+type ChangeEvent struct {
+	LSN        uint64     `json:"lsn"` // the LSN of the commit record of the transaction
+	CommitTime time.Time  `json:"commit_time"`
+	Kind       ChangeKind `json:"kind"`
+	Bucket     string     `json:"bucket,omitempty"` // the key-value bucket, if any (see kv.go)
+	Key        int        `json:"key"`
+	OldOffset  int64      `json:"old_offset"` // the offset of the key's row before, or -1
+	NewOffset  int64      `json:"new_offset"` // the offset of the key's row after, or -1
+}
+
+// keyChange is a change a transaction made to a key: the offsets of the key's row before and
+// after it, -1 for no row.
+type keyChange struct {
+	key      int
+	old, new int64
+}
+
+// record returns the change record for the change, logged by transaction txID on bucket.
+//
+//	| old int64 | new int64 | bucket ... |
+func (c keyChange) record(txID uint64, bucket string) walRecord {
+	data := binary.LittleEndian.AppendUint64(nil, uint64(c.old))
+	data = binary.LittleEndian.AppendUint64(data, uint64(c.new))
+	return walRecord{txID: txID, kind: walChange, target: int64(c.key), data: append(data, bucket...)}
+}
+
+// changeEvent decodes a change record of a transaction that committed at the given commit record.
+func changeEvent(record, commit walRecord) (ChangeEvent, error) {
+	if len(record.data) < 16 {
+		return ChangeEvent{}, errCorruptWALRecord
+	}
+	e := ChangeEvent{
+		LSN:       commit.lsn,
+		Bucket:    string(record.data[16:]),
+		Key:       int(record.target),
+		OldOffset: int64(binary.LittleEndian.Uint64(record.data[0:])),
+		NewOffset: int64(binary.LittleEndian.Uint64(record.data[8:])),
+	}
+	if len(commit.data) == 8 {
+		e.CommitTime = time.Unix(0, int64(binary.LittleEndian.Uint64(commit.data)))
+	}
+	switch {
+	case e.OldOffset == -1:
+		e.Kind = ChangeInsert
+	case e.NewOffset == -1:
+		e.Kind = ChangeDelete
+	default:
+		e.Kind = ChangeUpdate
+	}
+	return e, nil
+}
+
+// Subscribe calls fn with the change events of every transaction whose commit record comes after
+// LSN from, in commit order, waiting for new commits at the end of the log. It returns when ctx is
+// done, with ctx.Err(), or when fn returns an error, with that error. A from of 0 starts at the
+// beginning of the log.
+func (db *DB) Subscribe(ctx context.Context, from uint64, fn func(ChangeEvent) error) error {
+	var assembler txAssembler
+	return db.followLog(ctx, func(record walRecord) error {
+		records := assembler.add(record)
+		if records == nil || record.lsn <= from {
+			return nil
+		}
+		for _, r := range records {
+			if r.kind != walChange {
+				continue
+			}
+			e, err := changeEvent(r, record)
+			if err != nil {
+				return err
+			}
+			if err := fn(e); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, nil)
+}
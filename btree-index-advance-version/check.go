@@ -0,0 +1,1094 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// =================================================================================================
+// --- check.go --- (Property-Based / Fuzz Checking)
+// =================================================================================================
+
+// checkDegrees are the degrees exercised by the checker. Small degrees split and merge constantly.
+var checkDegrees = []int{3, 4, 5, 8}
+
+// The partitioners of the sharded index checks. checkRangeShards splits the keys of the checks,
+// which are below 512, into three ranges.
+var (
+	checkHashShards     = NewHashRing(3, 0)
+	checkRangeShards, _ = NewRangePartitioner(128, 320)
+)
+
+// referenceModel is the trivially correct model the tree is compared against.
+type referenceModel struct {
+	entries map[int]int64
+}
+
+// sortedKeys returns the model's keys in ascending order.
+func (m *referenceModel) sortedKeys() []int {
+	keys := make([]int, 0, len(m.entries))
+	for k := range m.entries {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// OrderedIndex is the interface shared by the B+ tree, the copy-on-write tree (cow.go) and the
+// sharded index (shard.go). All are held to it by the same conformance checks. The LSM tree of
+// lsm-index-version satisfies a copy of it, and the in-memory version has an OrderedIndex of its
+// own, whose operations can't fail; future index implementations join the checks by satisfying it.
+type OrderedIndex interface {
+	Insert(key int, value int64) error
+	Search(key int) (int64, bool, error)
+	SearchRange(startKey, endKey int) ([]int64, error)
+	Delete(key int) (bool, error)
+	Len() (int, error)
+}
+
+var (
+	_ OrderedIndex = (*BPlusTree)(nil)
+	_ OrderedIndex = (*COWTree)(nil)
+	_ OrderedIndex = (*ShardedIndex)(nil)
+)
+
+// fuzzOps is the fuzz target for the B+ tree: it runs checkConformance on a fresh tree of the given
+// degrees and split policy, and also verifies the tree invariants after every operation.
+func fuzzOps(degree, internalDegree int, policy SplitPolicy, data []byte) error {
+	tree := NewBPlusTreeWithDegrees(NewMemPageStore(), degree, internalDegree)
+	if err := tree.SetSplitPolicy(policy); err != nil {
+		return err
+	}
+	return checkConformance(tree, data, func() error {
+		if n, _ := tree.Len(); n == 0 {
+			rootPage, err := tree.readPage(tree.rootPageID)
+			if err != nil {
+				return err
+			}
+			if !isLeaf(rootPage) || getNumKeys(rootPage) != 0 {
+				return fmt.Errorf("tree is empty but the root page is not an empty leaf")
+			}
+		}
+		if n := len(tree.pool.pins); n > 0 {
+			return fmt.Errorf("%d pages are still pinned between operations", n)
+		}
+		if err := checkScans(tree); err != nil {
+			return err
+		}
+		return checkInvariants(tree)
+	})
+}
+
+// checkScans verifies that ScanFrom, ScanTo and ScanAll agree with a walk of the leaf chain, with
+// the bound at the middle key of the tree.
+func checkScans(tree *BPlusTree) error {
+	var keys []int
+	var values []int64
+	c, err := tree.Seek(math.MinInt)
+	if err != nil {
+		return err
+	}
+	for c.Next() {
+		keys = append(keys, c.Key())
+		values = append(values, c.Value())
+	}
+	if err := c.Err(); err != nil {
+		return err
+	}
+	mid, bound := len(keys)/2, 0
+	if mid < len(keys) {
+		bound = keys[mid]
+	}
+	for _, scan := range []struct {
+		name string
+		scan func() ([]int64, error)
+		want []int64
+	}{
+		{fmt.Sprintf("ScanFrom(%d)", bound), func() ([]int64, error) { return tree.ScanFrom(bound) }, values[mid:]},
+		{fmt.Sprintf("ScanTo(%d)", bound), func() ([]int64, error) { return tree.ScanTo(bound) }, values[:min(mid+1, len(values))]},
+		{"ScanAll()", tree.ScanAll, values},
+	} {
+		got, err := scan.scan()
+		if err != nil {
+			return err
+		}
+		if !slices.Equal(got, scan.want) {
+			return fmt.Errorf("%s returned %d values, want the %d of the leaf chain", scan.name, len(got), len(scan.want))
+		}
+	}
+	return nil
+}
+
+// fuzzCOWOps is the fuzz target for the copy-on-write tree, like fuzzOps.
+func fuzzCOWOps(degree int, data []byte) error {
+	tree, err := OpenCOWTree(NewMemPageStore(), degree)
+	if err != nil {
+		return err
+	}
+	return checkConformance(tree, data, func() error { return checkCOWInvariants(tree) })
+}
+
+// fuzzShardedOps is the fuzz target for the sharded index: it runs checkConformance on three
+// fresh shards of the given degree, routed by partitioner, and verifies that every shard holds
+// only its own keys and keeps the tree invariants.
+func fuzzShardedOps(degree int, partitioner Partitioner, data []byte) error {
+	shards := make([]*BPlusTree, partitioner.NumShards())
+	for i := range shards {
+		shards[i] = newCheckTree(degree)
+	}
+	index, err := NewShardedIndex(shards, partitioner)
+	if err != nil {
+		return err
+	}
+	return checkConformance(index, data, func() error {
+		for i, shard := range shards {
+			c, err := shard.Seek(math.MinInt)
+			if err != nil {
+				return err
+			}
+			for c.Next() {
+				if owner := partitioner.Shard(c.Key()); owner != i {
+					return fmt.Errorf("key %d is in shard %d, but belongs in shard %d", c.Key(), i, owner)
+				}
+			}
+			if err := c.Err(); err != nil {
+				return err
+			}
+			if err := checkInvariants(shard); err != nil {
+				return fmt.Errorf("shard %d: %w", i, err)
+			}
+		}
+		return nil
+	})
+}
+
+// fuzzOptimisticReads is the fuzz target for optimistic reads (see optimistic.go). A tree of the
+// given degree holds the even keys below 2*optimisticCheckKeys, which stay put, and data decodes
+// as inserts and deletes of odd keys, two bytes each. Before every page the writer writes, a probe
+// makes one attempt at an optimistic lookup of a random even key, as if a reader ran just then. An
+// attempt may have to restart during a rebalance, but not during a split, and one that doesn't
+// restart must find the key with its value.
+func fuzzOptimisticReads(degree int, data []byte) error {
+	tree := newCheckTree(degree)
+	for key := 0; key < 2*optimisticCheckKeys; key += 2 {
+		if err := tree.Insert(key, int64(key)); err != nil {
+			return err
+		}
+	}
+	tree.EnableOptimisticReads()
+	probe := &optimisticProbe{tree: tree, r: rand.New(rand.NewSource(int64(len(data))))}
+	tree.SetTracer(probe)
+	for i := 0; i+1 < len(data) && probe.err == nil; i += 2 {
+		key := 2*(int(data[i+1])%optimisticCheckKeys) + 1
+		var err error
+		if data[i]%2 == 0 {
+			if err = tree.Insert(key, int64(key)); errors.Is(err, ErrDuplicateKey) {
+				err = nil
+			}
+		} else {
+			_, err = tree.Delete(key)
+		}
+		if err != nil {
+			return fmt.Errorf("op %d: %w", i/2, err)
+		}
+	}
+	if probe.err != nil {
+		return probe.err
+	}
+	if n := len(tree.pool.pins); n > 0 {
+		return fmt.Errorf("%d pages are still pinned", n)
+	}
+	return checkInvariants(tree)
+}
+
+// optimisticCheckKeys is the number of keys fuzzOptimisticReads looks up, and of keys it inserts
+// and deletes in between.
+const optimisticCheckKeys = 64
+
+// optimisticProbe is the Tracer of fuzzOptimisticReads. It only acts on page writes.
+type optimisticProbe struct {
+	pageCounter
+	tree *BPlusTree
+	r    *rand.Rand
+	err  error // the first wrong lookup
+}
+
+func (p *optimisticProbe) OnPageWrite(pageID PageID) {
+	key := 2 * p.r.Intn(optimisticCheckKeys)
+	value, found, restart, err := p.tree.optimisticSearch(key)
+	if p.err != nil {
+		return
+	}
+	if restart {
+		if p.tree.rebalanceDepth == 0 {
+			p.err = fmt.Errorf("optimistic lookup of key %d restarted before a write to page %d outside a rebalance", key, pageID)
+		}
+		return
+	}
+	if err != nil || !found || value != int64(key) {
+		p.err = fmt.Errorf("optimistic lookup of key %d before a write to page %d: value %d, found %v, err %v", key, pageID, value, found, err)
+	}
+}
+
+// checkConformance decodes data as a sequence of operations, applies each one to index and to the
+// reference model, and verifies after every operation that they agree and that invariants, the
+// checks specific to the implementation, hold. Each operation takes three bytes: an opcode and
+// two key bytes.
+func checkConformance(index OrderedIndex, data []byte, invariants func() error) error {
+	model := &referenceModel{entries: make(map[int]int64)}
+
+	for i := 0; i+2 < len(data); i += 3 {
+		key := int(data[i+1])<<8 | int(data[i+2])
+		// Keep keys in a small range so operations collide with existing keys often.
+		key %= 512
+		value := int64(key) * 10
+
+		var desc string
+		switch data[i] % 4 {
+		case 0, 1:
+			desc = fmt.Sprintf("Insert(%d)", key)
+			_, exists := model.entries[key]
+			err := index.Insert(key, value)
+			if exists != errors.Is(err, ErrDuplicateKey) || (!exists && err != nil) {
+				return fmt.Errorf("op %d %s: returned error %v with key present=%v", i/3, desc, err, exists)
+			}
+			model.entries[key] = value
+		case 2:
+			desc = fmt.Sprintf("Delete(%d)", key)
+			_, exists := model.entries[key]
+			deleted, err := index.Delete(key)
+			if err != nil {
+				return fmt.Errorf("op %d %s: %w", i/3, desc, err)
+			}
+			if deleted != exists {
+				return fmt.Errorf("op %d %s: returned %v, want %v", i/3, desc, deleted, exists)
+			}
+			delete(model.entries, key)
+		case 3:
+			desc = fmt.Sprintf("Search(%d)", key)
+			want, exists := model.entries[key]
+			got, found, err := index.Search(key)
+			if err != nil {
+				return fmt.Errorf("op %d %s: %w", i/3, desc, err)
+			}
+			if found != exists || got != want {
+				return fmt.Errorf("op %d %s: got (%d, %v), want (%d, %v)", i/3, desc, got, found, want, exists)
+			}
+		}
+
+		if err := checkAgainstModel(index, model); err != nil {
+			return fmt.Errorf("op %d %s: %w", i/3, desc, err)
+		}
+		if err := invariants(); err != nil {
+			return fmt.Errorf("op %d %s: %w", i/3, desc, err)
+		}
+	}
+	return nil
+}
+
+// newCheckTree creates an empty tree backed by an in-memory page store.
+func newCheckTree(degree int) *BPlusTree {
+	return NewBPlusTree(NewMemPageStore(), degree)
+}
+
+// checkAgainstModel verifies that the size, a full range scan and a point lookup of every key agree
+// with the model.
+func checkAgainstModel(index OrderedIndex, model *referenceModel) error {
+	keys := model.sortedKeys()
+	n, err := index.Len()
+	if err != nil {
+		return err
+	}
+	if n != len(keys) {
+		return fmt.Errorf("Len() = %d, want %d", n, len(keys))
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+
+	values, err := index.SearchRange(keys[0], keys[len(keys)-1])
+	if err != nil {
+		return err
+	}
+	if len(values) != len(keys) {
+		return fmt.Errorf("range scan returned %d records, want %d", len(values), len(keys))
+	}
+	for i, k := range keys {
+		if values[i] != model.entries[k] {
+			return fmt.Errorf("range scan returned value %d at position %d, want %d", values[i], i, model.entries[k])
+		}
+		got, found, err := index.Search(k)
+		if err != nil {
+			return err
+		}
+		if !found || got != model.entries[k] {
+			return fmt.Errorf("Search(%d) = (%d, %v), want (%d, true)", k, got, found, model.entries[k])
+		}
+	}
+	return nil
+}
+
+// checkInvariants verifies the structural B+ tree invariants on disk: a well-formed slotted layout,
+// page occupancy, sorted keys that respect the separators above them, consistent parent pointers and root flags, all leaves at the same
+// depth, subtree entry counts that match the subtrees, a leaf chain that visits the leaves in key order,
+// and fences whose high keys match the separators and whose right links follow the pages of their level.
+func checkInvariants(tree *BPlusTree) error {
+	var leaves []PageID
+	leafDepth := -1
+	var levels [][]PageID // the internal pages of each level, from left to right
+	var walk func(pageID, parentPageID PageID, depth int, low, high *int) error
+	walk = func(pageID, parentPageID PageID, depth int, low, high *int) error {
+		page, err := tree.readPage(pageID)
+		if err != nil {
+			return err
+		}
+		if getParentPageID(page) != parentPageID {
+			return fmt.Errorf("page %d has parent %d, want %d", pageID, getParentPageID(page), parentPageID)
+		}
+		if isRoot(page) != (pageID == tree.rootPageID) {
+			return fmt.Errorf("page %d has a wrong root flag", pageID)
+		}
+		if err := checkPageLayout(page); err != nil {
+			return fmt.Errorf("page %d: %w", pageID, err)
+		}
+		if hasFence(page) {
+			k, ok := highKey(page)
+			switch {
+			case ok && high == nil:
+				return fmt.Errorf("page %d has high key %d, but is the rightmost page of its level", pageID, k)
+			case !ok && high != nil:
+				return fmt.Errorf("page %d has no high key, want %d", pageID, *high)
+			case ok && k != *high:
+				return fmt.Errorf("page %d has high key %d, want %d", pageID, k, *high)
+			}
+		}
+		numKeys := int(getNumKeys(page))
+		if maxKeys := tree.maxKeysOf(page); numKeys > maxKeys {
+			return fmt.Errorf("page %d holds %d keys, max is %d", pageID, numKeys, maxKeys)
+		}
+		// A right-heavy split leaves the rightmost leaf short until the next appends fill it.
+		rightHeavy := tree.splitPolicy > SplitEven && isLeaf(page) && getNextLeafPageID(page) == -1
+		if minKeys := tree.minKeysOf(page); pageID != tree.rootPageID && numKeys < minKeys && !rightHeavy {
+			return fmt.Errorf("page %d holds %d keys, min is %d", pageID, numKeys, minKeys)
+		}
+
+		var keys []int
+		var children []PageID
+		var counts []int
+		if isLeaf(page) {
+			keys, _ = readLeafEntries(page)
+		} else {
+			keys, children, counts = readInternalEntries(page)
+		}
+		if !slices.IsSorted(keys) || len(slices.Compact(slices.Clone(keys))) != len(keys) {
+			return fmt.Errorf("page %d keys %v are not strictly increasing", pageID, keys)
+		}
+		for _, k := range keys {
+			if (low != nil && k < *low) || (high != nil && k >= *high) {
+				return fmt.Errorf("key %d on page %d is outside the range set by its ancestors", k, pageID)
+			}
+		}
+
+		if isLeaf(page) {
+			if leafDepth == -1 {
+				leafDepth = depth
+			} else if depth != leafDepth {
+				return fmt.Errorf("leaf page %d is at depth %d, other leaves are at depth %d", pageID, depth, leafDepth)
+			}
+			leaves = append(leaves, pageID)
+			for i, k := range keys {
+				if _, size, overflow := leafValueAt(page, i); overflow != -1 {
+					if _, err := tree.readOverflowChain(overflow, size); err != nil {
+						return fmt.Errorf("value of key %d on page %d: %w", k, pageID, err)
+					}
+				}
+			}
+			return nil
+		}
+
+		if depth == len(levels) {
+			levels = append(levels, nil)
+		}
+		levels[depth] = append(levels[depth], pageID)
+		for i, childPageID := range children {
+			childLow, childHigh := low, high
+			if i > 0 {
+				childLow = &keys[i-1]
+			}
+			if i < len(keys) {
+				childHigh = &keys[i]
+			}
+			if err := walk(childPageID, pageID, depth+1, childLow, childHigh); err != nil {
+				return err
+			}
+			childPage, err := tree.readPage(childPageID)
+			if err != nil {
+				return err
+			}
+			if got := subtreeCount(childPage); got != counts[i] {
+				return fmt.Errorf("page %d records %d entries under child %d, which holds %d", pageID, counts[i], childPageID, got)
+			}
+		}
+		return nil
+	}
+	if err := walk(tree.rootPageID, -1, 0, nil, nil); err != nil {
+		return err
+	}
+
+	for i, leafPageID := range leaves {
+		want := PageID(-1)
+		if i+1 < len(leaves) {
+			want = leaves[i+1]
+		}
+		page, err := tree.readPage(leafPageID)
+		if err != nil {
+			return err
+		}
+		if got := getNextLeafPageID(page); got != want {
+			return fmt.Errorf("leaf page %d links to page %d, want %d", leafPageID, got, want)
+		}
+	}
+	for _, level := range levels {
+		for i, pageID := range level {
+			page, err := tree.readPage(pageID)
+			if err != nil {
+				return err
+			}
+			want := PageID(-1)
+			if i+1 < len(level) {
+				want = level[i+1]
+			}
+			if got := rightLink(page); hasFence(page) && got != want {
+				return fmt.Errorf("page %d links to right sibling %d, want %d", pageID, got, want)
+			}
+		}
+	}
+	return nil
+}
+
+// checkCOWInvariants verifies the structural invariants of a copy-on-write tree: sorted keys
+// within the bounds of the separators above them, no page over maxKeys, every leaf on the same
+// level, and a key count in the meta page that matches the leaves. Pages may be underfull, since
+// deletes don't merge, but only the root may be empty.
+func checkCOWInvariants(tree *COWTree) error {
+	snapshot := tree.Snapshot()
+	leafDepth, numKeys := -1, 0
+	var visit func(pageID PageID, bounds keyRange, depth int) error
+	visit = func(pageID PageID, bounds keyRange, depth int) error {
+		n, err := snapshot.node(pageID)
+		if err != nil {
+			return err
+		}
+		if len(n.keys) > tree.maxKeys {
+			return fmt.Errorf("page %d has %d keys, more than %d", pageID, len(n.keys), tree.maxKeys)
+		}
+		for i, k := range n.keys {
+			if i > 0 && k <= n.keys[i-1] {
+				return fmt.Errorf("page %d: keys out of order: %d after %d", pageID, k, n.keys[i-1])
+			}
+			if !bounds.contains(k) {
+				return fmt.Errorf("page %d: key %d outside the separator bounds", pageID, k)
+			}
+		}
+		if n.leaf {
+			if len(n.keys) == 0 && pageID != snapshot.state.root {
+				return fmt.Errorf("page %d is an empty leaf below the root", pageID)
+			}
+			if leafDepth == -1 {
+				leafDepth = depth
+			} else if depth != leafDepth {
+				return fmt.Errorf("leaf %d is at depth %d, want %d", pageID, depth, leafDepth)
+			}
+			numKeys += len(n.keys)
+			return nil
+		}
+		if pageID == snapshot.state.root && len(n.children) < 2 {
+			return fmt.Errorf("root page %d is internal with a single child", pageID)
+		}
+		for i, child := range n.children {
+			childBounds := bounds
+			if i > 0 {
+				childBounds.low, childBounds.hasLow = n.keys[i-1], true
+			}
+			if i < len(n.keys) {
+				childBounds.high, childBounds.hasHigh = n.keys[i], true
+			}
+			if err := visit(child, childBounds, depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := visit(snapshot.state.root, keyRange{}, 0); err != nil {
+		return err
+	}
+	if numKeys != snapshot.Len() {
+		return fmt.Errorf("meta page counts %d keys, the leaves hold %d", snapshot.Len(), numKeys)
+	}
+	return nil
+}
+
+// checkPageLayout verifies a page's slotted layout: the cell pointer array and the cell content
+// area don't overlap, every cell lies inside the content area without overlapping another one or
+// the fence, and the content area holds exactly the live cells plus the fragmented bytes.
+func checkPageLayout(page *Page) error {
+	numKeys := int(getNumKeys(page))
+	contentOffset, contentEnd := getCellContentOffset(page), cellContentEnd(page)
+	if freeSpace(page) < 0 {
+		return fmt.Errorf("cell pointers overlap the cell content area at %d", contentOffset)
+	}
+	type span struct{ offset, size int }
+	cells := make([]span, numKeys)
+	used := 0
+	for i := range cells {
+		offset := cellOffset(page, i)
+		if offset < contentOffset || offset+leafCellHeaderSize > contentEnd {
+			return fmt.Errorf("cell %d at offset %d lies outside the content area", i, offset)
+		}
+		cells[i] = span{offset, cellSizeAt(page, offset)}
+		if offset+cells[i].size > contentEnd {
+			return fmt.Errorf("cell %d at offset %d runs past the end of the content area", i, offset)
+		}
+		used += cells[i].size
+	}
+	if contentEnd-contentOffset != used+getFragmentedBytes(page) {
+		return fmt.Errorf("content area of %d bytes holds %d bytes of cells and %d fragmented bytes",
+			contentEnd-contentOffset, used, getFragmentedBytes(page))
+	}
+	slices.SortFunc(cells, func(a, b span) int { return a.offset - b.offset })
+	for i := 1; i < len(cells); i++ {
+		if cells[i].offset < cells[i-1].offset+cells[i-1].size {
+			return fmt.Errorf("cells at offsets %d and %d overlap", cells[i-1].offset, cells[i].offset)
+		}
+	}
+	return nil
+}
+
+// fuzzPageDecoder is the fuzz target for the page decoder: it puts data, cut or zero-padded to a
+// page, in place of the root of a small tree, and describes the page, checks its layout, searches
+// the tree and scans it. Whatever the bytes, this may fail with an error such as ErrCorruptPage,
+// which the target ignores, but must neither panic nor hang; the scan is cut short in case the
+// leaf chain has a cycle.
+func fuzzPageDecoder(data []byte) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("decoding the page panicked: %v", r)
+		}
+	}()
+	tree := newPageDecoderTree()
+	page := new(Page)
+	copy(page[:], data)
+	if err := tree.pool.WritePage(tree.rootPageID, page); err != nil {
+		return err
+	}
+	describePage(io.Discard, tree.rootPageID, page)
+	checkPageLayout(page)
+	for _, key := range []int{math.MinInt, -1, 0, pageDecoderKeys / 2, pageDecoderKeys, math.MaxInt} {
+		tree.Search(key)
+	}
+	if c, err := tree.Seek(math.MinInt); err == nil {
+		for n := 0; n <= 2*pageDecoderKeys && c.Next(); n++ {
+			c.Value()
+		}
+	}
+	return nil
+}
+
+// pageDecoderRuns is the number of pages fuzzPageDecoder decodes per run of the other checks.
+// Each takes a fraction of a millisecond.
+const pageDecoderRuns = 50
+
+// pageDecoderKeys is the number of keys in the tree of fuzzPageDecoder, enough for a root with
+// two levels below it at degree 4.
+const pageDecoderKeys = 64
+
+// newPageDecoderTree returns the tree that fuzzPageDecoder corrupts.
+func newPageDecoderTree() *BPlusTree {
+	tree := newCheckTree(4)
+	for key := range pageDecoderKeys {
+		tree.Insert(key, int64(key))
+	}
+	return tree
+}
+
+// pageDecoderInput returns a page of the tree of fuzzPageDecoder, the root or a leaf, with a few
+// random bytes changed, mostly in the header and the cell pointers. Random pages are almost never
+// leaf or internal pages.
+func pageDecoderInput(r *rand.Rand) []byte {
+	tree := newPageDecoderTree()
+	pageID := tree.rootPageID
+	if r.Intn(2) == 0 {
+		pageID, _ = tree.findLeafPage(r.Intn(pageDecoderKeys))
+	}
+	page, err := tree.readPage(pageID)
+	if err != nil {
+		return nil
+	}
+	for range 1 + r.Intn(4) {
+		i := r.Intn(PageSize)
+		if r.Intn(4) > 0 {
+			i = r.Intn(headerSize + 16*cellPointerSize)
+		}
+		page[i] = byte(r.Intn(256))
+	}
+	return page[:]
+}
+
+// crashingFile is the pageFile of a Pager that crashes at a page write: once writesLeft writes have
+// gone through, every write and sync fails, and nothing more reaches the file.
+type crashingFile struct {
+	pageFile
+	writesLeft int
+	crashed    bool
+}
+
+var errSimulatedCrash = errors.New("simulated crash")
+
+func (f *crashingFile) WriteAt(p []byte, off int64) (int, error) {
+	if f.writesLeft == 0 {
+		f.crashed = true
+		return 0, errSimulatedCrash
+	}
+	f.writesLeft--
+	return f.pageFile.WriteAt(p, off)
+}
+
+func (f *crashingFile) Sync() error {
+	if f.crashed {
+		return errSimulatedCrash
+	}
+	return f.pageFile.Sync()
+}
+
+// fuzzCrashRecovery runs random transactions on a DB in dir until its index file crashes at a
+// random page write, then drops what the log still buffers, reopens the DB and checks that
+// recovery left a valid tree holding exactly the committed rows. A transaction that crashed in
+// Commit may or may not have committed.
+func fuzzCrashRecovery(r *rand.Rand, dir string) error {
+	indexPath, heapPath, walPath := filepath.Join(dir, "crash.idx"), filepath.Join(dir, "crash.dat"), filepath.Join(dir, "crash.wal")
+	db, err := OpenDB(indexPath, heapPath, walPath, 4)
+	if err != nil {
+		return err
+	}
+	// Back to write-through, so that pages are written at once and in the same order every run,
+	// and stolen after a few pages, so that most transactions steal some.
+	if err := db.tree.pool.Close(); err != nil {
+		db.Close()
+		return err
+	}
+	db.maxTxPages = 4
+	file := &crashingFile{pageFile: db.pager.file, writesLeft: 1 + r.Intn(300)}
+	db.pager.file = file
+
+	committed := make(map[int]string)
+	var pending map[int]string // the rows of the transaction that crashed in Commit, if any
+	for !file.crashed {
+		rows, commit, err := crashTx(db, r, committed)
+		switch {
+		case file.crashed && commit:
+			pending = rows
+		case err != nil && !file.crashed:
+			db.Close()
+			return err
+		case commit:
+			committed = rows
+		}
+	}
+	// The crash: the log's buffer is lost, and the running transaction never finishes.
+	err = errors.Join(db.wal.file.Close(), db.heap.Close(), file.pageFile.Close())
+	if err != nil {
+		return err
+	}
+
+	db, err = OpenDB(indexPath, heapPath, walPath, 4)
+	if err != nil {
+		return fmt.Errorf("recovery: %w", err)
+	}
+	defer db.Close()
+	if err := checkInvariants(db.tree); err != nil {
+		return fmt.Errorf("after recovery: %w", err)
+	}
+	rows := make(map[int]string)
+	tx := db.Begin()
+	err = tx.Scan(math.MinInt, math.MaxInt, func(key int, row string) error {
+		rows[key] = row
+		return nil
+	})
+	tx.Rollback()
+	if err != nil {
+		return err
+	}
+	if !maps.Equal(rows, committed) && (pending == nil || !maps.Equal(rows, pending)) {
+		return fmt.Errorf("after recovery: %d rows, want the %d committed ones", len(rows), len(committed))
+	}
+	return nil
+}
+
+// crashTx runs a random transaction of inserts, deletes and savepoints on db, whose committed rows
+// are committed, and reports whether it ended in a commit, with the rows that leaves, rather than
+// a rollback.
+func crashTx(db *DB, r *rand.Rand, committed map[int]string) (map[int]string, bool, error) {
+	tx := db.Begin()
+	rows := maps.Clone(committed)
+	var savepoints []map[int]string
+	for range 1 + r.Intn(40) {
+		var err error
+		switch key, op := r.Intn(512), r.Intn(10); {
+		case op < 7:
+			if _, ok := rows[key]; ok {
+				_, err = tx.Delete(key)
+				delete(rows, key)
+			} else {
+				rows[key] = fmt.Sprintf("%d,%d", key, r.Intn(1000))
+				err = tx.Insert(key, []byte(rows[key]))
+			}
+		case op == 7:
+			err = tx.Savepoint("sp")
+			savepoints = append(savepoints, maps.Clone(rows))
+		case op == 8 && len(savepoints) > 0:
+			err = tx.RollbackTo("sp")
+			rows = maps.Clone(savepoints[len(savepoints)-1])
+		case op == 9 && len(savepoints) > 0:
+			err = tx.Release("sp")
+			savepoints = savepoints[:len(savepoints)-1]
+		}
+		if err != nil {
+			tx.Rollback()
+			return nil, false, err
+		}
+	}
+	if r.Intn(4) == 0 {
+		return nil, false, tx.Rollback()
+	}
+	return rows, true, tx.Commit()
+}
+
+// kvCheckKeys is the number of keys checkKVSharedPrefix stores. They all share a prefix longer than
+// the 4 bytes of a group key, so they all fall in one run of groups (see kv.go).
+const kvCheckKeys = 3000
+
+// kvCheckKey returns the i-th key of the key-value checks.
+func kvCheckKey(i int) []byte {
+	return fmt.Appendf(nil, "session:user:%08d", i)
+}
+
+// kvCheckValue returns the 100-byte value of the i-th key of the key-value checks.
+func kvCheckValue(i int) []byte {
+	return fmt.Appendf(nil, "%-100d", i)
+}
+
+// checkKVSharedPrefix stores kvCheckKeys keys that share a long prefix in a key-value store in
+// dir, deletes every third one, and verifies Get and Scan against the keys it kept, before and
+// after reopening the store.
+func checkKVSharedPrefix(dir string) error {
+	path := filepath.Join(dir, "kv")
+	store, err := OpenKVStore(path)
+	if err != nil {
+		return err
+	}
+	defer func() { store.Close() }()
+	for i := range kvCheckKeys {
+		if err := store.Put(kvCheckKey(i), kvCheckValue(i)); err != nil {
+			return fmt.Errorf("Put(%s): %w", kvCheckKey(i), err)
+		}
+	}
+	for i := 0; i < kvCheckKeys; i += 3 {
+		if deleted, err := store.Delete(kvCheckKey(i)); err != nil || !deleted {
+			return fmt.Errorf("Delete(%s) = (%v, %v), want (true, nil)", kvCheckKey(i), deleted, err)
+		}
+	}
+	kept := func(i int) bool { return i%3 != 0 }
+	if err := checkKVStore(store, kept); err != nil {
+		return err
+	}
+	if err := store.Close(); err != nil {
+		return err
+	}
+	if store, err = OpenKVStore(path); err != nil {
+		return err
+	}
+	if err := checkKVStore(store, kept); err != nil {
+		return fmt.Errorf("after reopening: %w", err)
+	}
+	return nil
+}
+
+// checkTTLSharedPrefix stores kvCheckKeys keys that share a long prefix in a key-value store in
+// dir, every other one with a TTL that has already run out and the others with one that won't, and
+// verifies that Get and Scan skip the expired keys, that SweepExpired deletes them, and that only
+// the live keys are left, before and after reopening the store.
+func checkTTLSharedPrefix(dir string) error {
+	path := filepath.Join(dir, "ttl")
+	store, err := OpenKVStore(path)
+	if err != nil {
+		return err
+	}
+	defer func() { store.Close() }()
+	live := func(i int) bool { return i%2 == 0 }
+	for i := range kvCheckKeys {
+		ttl := -time.Second
+		if live(i) {
+			ttl = time.Hour
+		}
+		if err := store.PutWithTTL(kvCheckKey(i), kvCheckValue(i), ttl); err != nil {
+			return fmt.Errorf("PutWithTTL(%s): %w", kvCheckKey(i), err)
+		}
+	}
+	if err := checkKVStore(store, live); err != nil {
+		return fmt.Errorf("before the sweep: %w", err)
+	}
+	if swept, err := store.SweepExpired(); err != nil || swept != kvCheckKeys/2 {
+		return fmt.Errorf("SweepExpired() = (%d, %v), want (%d, nil)", swept, err, kvCheckKeys/2)
+	}
+	if groups, err := store.db.tree.Len(); err != nil || groups > kvCheckKeys/2 {
+		return fmt.Errorf("%d groups are left after the sweep (%v), want at most the %d live keys", groups, err, kvCheckKeys/2)
+	}
+	if err := checkKVStore(store, live); err != nil {
+		return fmt.Errorf("after the sweep: %w", err)
+	}
+	if err := store.Close(); err != nil {
+		return err
+	}
+	if store, err = OpenKVStore(path); err != nil {
+		return err
+	}
+	if err := checkKVStore(store, live); err != nil {
+		return fmt.Errorf("after reopening: %w", err)
+	}
+	return nil
+}
+
+// checkKVStore verifies that the store holds kvCheckValue(i) under kvCheckKey(i) for exactly the
+// i below kvCheckKeys that are kept, by a Get of each key and by Scans of the shared prefix, of a
+// shorter prefix and of a longer one.
+func checkKVStore(store *KVStore, kept func(i int) bool) error {
+	var want [][]byte
+	for i := range kvCheckKeys {
+		value, found, err := store.Get(kvCheckKey(i))
+		if err != nil {
+			return err
+		}
+		if found != kept(i) || found && !slices.Equal(value, kvCheckValue(i)) {
+			return fmt.Errorf("Get(%s) = (%q, %v), want it kept: %v", kvCheckKey(i), value, found, kept(i))
+		}
+		if kept(i) {
+			want = append(want, kvCheckKey(i))
+		}
+	}
+	for _, prefix := range []string{"session:user:", "s", "session:user:0000001"} {
+		var got [][]byte
+		err := store.Scan([]byte(prefix), func(key, value []byte) error {
+			got = append(got, slices.Clone(key))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		matching := slices.DeleteFunc(slices.Clone(want), func(key []byte) bool { return !bytes.HasPrefix(key, []byte(prefix)) })
+		if !slices.EqualFunc(got, matching, bytes.Equal) {
+			return fmt.Errorf("Scan(%q) returned %d keys, want the %d kept ones in order", prefix, len(got), len(matching))
+		}
+	}
+	return checkKVGroups(store)
+}
+
+// kvCheckGroupEntries is the most entries checkKVGroups lets a group hold. A group holds more than
+// one only when hashes collide, which is rare with the few thousand keys of the checks.
+const kvCheckGroupEntries = 4
+
+// checkKVGroups verifies that every group row of the store's main tree is stored under the group
+// key of each of its entries, and that no group holds more than kvCheckGroupEntries of them.
+func checkKVGroups(store *KVStore) error {
+	tx := store.db.Begin()
+	defer tx.Rollback()
+	return tx.Scan(math.MinInt, math.MaxInt, func(g int, row string) error {
+		entries, err := decodeGroup(row)
+		if err != nil {
+			return err
+		}
+		if len(entries) > kvCheckGroupEntries {
+			return fmt.Errorf("group %#x holds %d entries", g, len(entries))
+		}
+		for _, e := range entries {
+			if groupKey(e.key) != g {
+				return fmt.Errorf("key %s is in group %#x, want %#x", e.key, g, groupKey(e.key))
+			}
+		}
+		return nil
+	})
+}
+
+// encryptionCheckKeys is the number of keys checkEncryptedIndex inserts.
+const encryptionCheckKeys = 500
+
+// checkEncryptedIndex builds an encrypted index in dir and verifies that it opens only with its
+// key, that the failed attempts leave it intact, and that an unencrypted index can't be opened
+// with a key.
+func checkEncryptedIndex(dir string) error {
+	path := filepath.Join(dir, "encrypted.idx")
+	key, wrongKey := make([]byte, 32), make([]byte, 32)
+	wrongKey[0] = 1
+	pager, err := NewEncryptedPager(path, key)
+	if err != nil {
+		return err
+	}
+	tree := NewBPlusTree(pager, 5)
+	for i := range encryptionCheckKeys {
+		if err := tree.Insert(i, int64(i)); err != nil {
+			return err
+		}
+	}
+	if err := tree.Close(); err != nil {
+		return err
+	}
+
+	if _, err := NewPager(path); !errors.Is(err, ErrIndexEncrypted) {
+		return fmt.Errorf("opening the encrypted index without a key: got %v, want %v", err, ErrIndexEncrypted)
+	}
+	if _, err := NewEncryptedPager(path, wrongKey); !errors.Is(err, ErrWrongKey) {
+		return fmt.Errorf("opening the encrypted index with the wrong key: got %v, want %v", err, ErrWrongKey)
+	}
+	if pager, err = NewEncryptedPager(path, key); err != nil {
+		return err
+	}
+	if tree, err = OpenStore(pager); err != nil {
+		pager.Close()
+		return err
+	}
+	for i := range encryptionCheckKeys {
+		if value, found, err := tree.Search(i); err != nil || !found || value != int64(i) {
+			tree.Close()
+			return fmt.Errorf("after reopening, Search(%d) = %d, %t, %v", i, value, found, err)
+		}
+	}
+	if err := tree.Close(); err != nil {
+		return err
+	}
+
+	plainPath := filepath.Join(dir, "plain.idx")
+	if pager, err = NewPager(plainPath); err != nil {
+		return err
+	}
+	tree = NewBPlusTree(pager, 5)
+	if err := tree.Close(); err != nil {
+		return err
+	}
+	if _, err := NewEncryptedPager(plainPath, key); !errors.Is(err, ErrIndexNotEncrypted) {
+		return fmt.Errorf("opening an unencrypted index with a key: got %v, want %v", err, ErrIndexNotEncrypted)
+	}
+	return nil
+}
+
+// checkSplitPolicy returns the split policy of the run-th operation sequence: runs alternate
+// between even splits and splits that keep every entry in the left leaf.
+func checkSplitPolicy(run int) SplitPolicy {
+	if run%2 == 1 {
+		return SplitRightmost
+	}
+	return SplitEven
+}
+
+// checkInternalDegree returns the internal degree of the run-th operation sequence at
+// checkDegrees[i]. Every third run gives internal pages the next degree, so they split and merge
+// at other sizes than the leaves.
+func checkInternalDegree(i, run int) int {
+	if run%3 == 1 {
+		return checkDegrees[(i+1)%len(checkDegrees)]
+	}
+	return checkDegrees[i]
+}
+
+// checkPartitioner returns the partitioner of the run-th sharded operation sequence, and its name.
+// Runs alternate between the two partitioners, which keeps the checks quick.
+func checkPartitioner(run int) (Partitioner, string) {
+	if run%2 == 1 {
+		return checkRangeShards, "range"
+	}
+	return checkHashShards, "hash"
+}
+
+// checkCommand implements `go run . check [-runs N] [-ops N] [-seed N]`. It feeds randomly
+// generated operation sequences to fuzzOps, fuzzCOWOps, fuzzShardedOps and fuzzOptimisticReads
+// for every degree in checkDegrees, decodes corrupted pages with fuzzPageDecoder, and crashes as
+// many DBs as it runs operation sequences per degree with fuzzCrashRecovery. Last, it fills a
+// key-value store with keys that share a prefix with checkKVSharedPrefix, and with keys that expire
+// with checkTTLSharedPrefix, and opens an encrypted index with checkEncryptedIndex.
+func checkCommand(args []string) error {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	runs := flags.Int("runs", 20, "number of random operation sequences per degree")
+	ops := flags.Int("ops", 300, "number of operations per sequence")
+	seed := flags.Int64("seed", 1, "random seed")
+	flags.Parse(args)
+
+	r := rand.New(rand.NewSource(*seed))
+	for i, degree := range checkDegrees {
+		for run := 0; run < *runs; run++ {
+			data := make([]byte, *ops*3)
+			r.Read(data)
+			policy, internalDegree := checkSplitPolicy(run), checkInternalDegree(i, run)
+			if err := fuzzOps(degree, internalDegree, policy, data); err != nil {
+				return fmt.Errorf("degree %d, internal degree %d, split policy %g, run %d (seed %d): %w",
+					degree, internalDegree, policy, run, *seed, err)
+			}
+			if err := fuzzCOWOps(degree, data); err != nil {
+				return fmt.Errorf("copy-on-write tree, degree %d, run %d (seed %d): %w", degree, run, *seed, err)
+			}
+			partitioner, sharding := checkPartitioner(run)
+			if err := fuzzShardedOps(degree, partitioner, data); err != nil {
+				return fmt.Errorf("%s-sharded index, degree %d, run %d (seed %d): %w", sharding, degree, run, *seed, err)
+			}
+			if err := fuzzOptimisticReads(degree, data); err != nil {
+				return fmt.Errorf("optimistic reads, degree %d, run %d (seed %d): %w", degree, run, *seed, err)
+			}
+		}
+		fmt.Printf("degree %d: %d runs of %d operations passed\n", degree, *runs, *ops)
+	}
+
+	for run := 0; run < *runs*pageDecoderRuns; run++ {
+		if err := fuzzPageDecoder(pageDecoderInput(r)); err != nil {
+			return fmt.Errorf("page decoder, run %d (seed %d): %w", run, *seed, err)
+		}
+	}
+	fmt.Printf("page decoder: %d corrupted pages decoded\n", *runs*pageDecoderRuns)
+
+	for run := 0; run < *runs; run++ {
+		dir, err := os.MkdirTemp("", "crash-*")
+		if err != nil {
+			return err
+		}
+		err = fuzzCrashRecovery(r, dir)
+		os.RemoveAll(dir)
+		if err != nil {
+			return fmt.Errorf("crash recovery, run %d (seed %d): %w", run, *seed, err)
+		}
+	}
+	fmt.Printf("crash recovery: %d runs passed\n", *runs)
+
+	dir, err := os.MkdirTemp("", "kv-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	if err := checkKVSharedPrefix(dir); err != nil {
+		return fmt.Errorf("key-value store: %w", err)
+	}
+	if err := checkTTLSharedPrefix(dir); err != nil {
+		return fmt.Errorf("expiring keys: %w", err)
+	}
+	fmt.Printf("key-value store: %d keys with a shared prefix passed, with and without a TTL\n", kvCheckKeys)
+	if err := checkEncryptedIndex(dir); err != nil {
+		return fmt.Errorf("encryption: %w", err)
+	}
+	fmt.Printf("encryption: an index of %d keys opened only with its key\n", encryptionCheckKeys)
+	return nil
+}
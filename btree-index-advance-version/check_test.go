@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// testRuns and testOps are the number of random operation sequences each test runs, per degree,
+// and their length; `go run . check` runs more of them.
+const (
+	testRuns = 5
+	testOps  = 300
+)
+
+// testSequences returns n random operation sequences of testOps operations each.
+func testSequences(r *rand.Rand, n int) [][]byte {
+	sequences := make([][]byte, n)
+	for i := range sequences {
+		sequences[i] = make([]byte, testOps*3)
+		r.Read(sequences[i])
+	}
+	return sequences
+}
+
+// forEachDegree runs check on testRuns random operation sequences, in a subtest for each of
+// checkDegrees.
+func forEachDegree(t *testing.T, check func(i, run int, data []byte) error) {
+	r := rand.New(rand.NewSource(1))
+	for i, degree := range checkDegrees {
+		t.Run(fmt.Sprintf("degree=%d", degree), func(t *testing.T) {
+			for run, data := range testSequences(r, testRuns) {
+				if err := check(i, run, data); err != nil {
+					t.Fatalf("run %d: %v", run, err)
+				}
+			}
+		})
+	}
+}
+
+// TestOps runs fuzzOps with the split policies and internal degrees of `go run . check`.
+func TestOps(t *testing.T) {
+	forEachDegree(t, func(i, run int, data []byte) error {
+		return fuzzOps(checkDegrees[i], checkInternalDegree(i, run), checkSplitPolicy(run), data)
+	})
+}
+
+// TestCOWOps runs fuzzCOWOps, the operation sequences of TestOps on the copy-on-write tree.
+func TestCOWOps(t *testing.T) {
+	forEachDegree(t, func(i, run int, data []byte) error {
+		return fuzzCOWOps(checkDegrees[i], data)
+	})
+}
+
+// TestShardedOps runs fuzzShardedOps with both partitioners.
+func TestShardedOps(t *testing.T) {
+	forEachDegree(t, func(i, run int, data []byte) error {
+		partitioner, sharding := checkPartitioner(run)
+		if err := fuzzShardedOps(checkDegrees[i], partitioner, data); err != nil {
+			return fmt.Errorf("%s-sharded: %w", sharding, err)
+		}
+		return nil
+	})
+}
+
+// TestOptimisticReads runs fuzzOptimisticReads, which probes an optimistic lookup before every
+// page write.
+func TestOptimisticReads(t *testing.T) {
+	forEachDegree(t, func(i, run int, data []byte) error {
+		return fuzzOptimisticReads(checkDegrees[i], data)
+	})
+}
+
+// TestPageDecoder decodes as many corrupted pages as `go run . check -runs 5`.
+func TestPageDecoder(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for run := 0; run < testRuns*pageDecoderRuns; run++ {
+		if err := fuzzPageDecoder(pageDecoderInput(r)); err != nil {
+			t.Fatalf("run %d: %v", run, err)
+		}
+	}
+}
+
+// TestCrashRecovery crashes a DB at a random page write and recovers it, testRuns times.
+func TestCrashRecovery(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for run := 0; run < testRuns; run++ {
+		if err := fuzzCrashRecovery(r, t.TempDir()); err != nil {
+			t.Fatalf("run %d: %v", run, err)
+		}
+	}
+}
+
+// TestKVSharedPrefix runs checkKVSharedPrefix, which reads back keys with a long shared prefix.
+func TestKVSharedPrefix(t *testing.T) {
+	if err := checkKVSharedPrefix(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestTTLSharedPrefix is TestKVSharedPrefix with a TTL on every key, half of which have run out.
+func TestTTLSharedPrefix(t *testing.T) {
+	if err := checkTTLSharedPrefix(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestEncryptedIndex opens an encrypted index with no key, the wrong key and the right key.
+func TestEncryptedIndex(t *testing.T) {
+	if err := checkEncryptedIndex(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// FuzzOps runs fuzzOps under `go test -fuzz FuzzOps`: data is the operation sequence, checked
+// against the reference map after every operation, and the other arguments pick the degrees, from
+// checkDegrees, and the split policy. The corpus starts with a random sequence for each degree.
+func FuzzOps(f *testing.F) {
+	r := rand.New(rand.NewSource(1))
+	for i := range checkDegrees {
+		data := make([]byte, 300*3)
+		r.Read(data)
+		f.Add(uint8(i), uint8(i+i%2), i%2 == 1, data)
+	}
+	f.Fuzz(func(t *testing.T, degree, internalDegree uint8, rightmost bool, data []byte) {
+		policy := SplitEven
+		if rightmost {
+			policy = SplitRightmost
+		}
+		d, id := checkDegrees[int(degree)%len(checkDegrees)], checkDegrees[int(internalDegree)%len(checkDegrees)]
+		if err := fuzzOps(d, id, policy, data); err != nil {
+			t.Fatalf("degree %d, internal degree %d, split policy %g: %v", d, id, policy, err)
+		}
+	})
+}
+
+// FuzzPageDecoder runs fuzzPageDecoder under `go test -fuzz FuzzPageDecoder`. The corpus starts
+// with the pages of the tree the target corrupts, unchanged: its root and each of its leaves.
+func FuzzPageDecoder(f *testing.F) {
+	tree := newPageDecoderTree()
+	seen := make(map[PageID]bool)
+	pageIDs := []PageID{tree.rootPageID}
+	for key := range pageDecoderKeys {
+		pageID, err := tree.findLeafPage(key)
+		if err != nil {
+			f.Fatal(err)
+		}
+		pageIDs = append(pageIDs, pageID)
+	}
+	for _, pageID := range pageIDs {
+		if seen[pageID] {
+			continue
+		}
+		seen[pageID] = true
+		page, err := tree.readPage(pageID)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(page[:])
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if err := fuzzPageDecoder(data); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"slices"
+)
+
+// =================================================================================================
+// --- checkpoint.go --- (Snapshots and Incremental Checkpoints)
+// =================================================================================================
+
+// A checkpoint copies the index file to another file, page by page, in a background goroutine.
+// The copy is consistent because the Pager takes a copy-on-write snapshot when the checkpoint
+// begins: until every page has been copied, the first write to a page that hasn't been copied yet
+// preserves the page's old contents, and the checkpoint copies that preserved image instead.
+//
+// The Pager also remembers which pages were written since the last checkpoint, so an incremental
+// checkpoint only has to rewrite those pages in the file produced by the previous one.
+
+var (
+	errCheckpointRunning  = errors.New("a checkpoint is already in progress")
+	errNoFullCheckpoint   = errors.New("incremental checkpoint requires a previous full checkpoint")
+	errCheckpointNotFound = errors.New("incremental checkpoint target does not exist")
+	errCheckpointNoPager  = errors.New("checkpoints require the tree to be stored in a Pager")
+)
+
+// pageSnapshot is a copy-on-write view of the index file frozen when a checkpoint began.
+type pageSnapshot struct {
+	numPages  int64
+	preserved map[PageID]*Page    // old contents of pages overwritten after the snapshot was taken
+	copied    map[PageID]struct{} // pages the checkpoint has already copied
+}
+
+// CheckpointJob is a checkpoint running in the background.
+type CheckpointJob struct {
+	done chan struct{}
+	err  error
+}
+
+// Wait blocks until the checkpoint has finished and returns its error, if any.
+func (j *CheckpointJob) Wait() error {
+	<-j.done
+	return j.err
+}
+
+// failedCheckpoint returns a job that has already finished with err.
+func failedCheckpoint(err error) *CheckpointJob {
+	job := &CheckpointJob{done: make(chan struct{}), err: err}
+	close(job.done)
+	return job
+}
+
+// Checkpoint starts writing a consistent snapshot of the whole index, as it is right now, to path.
+// The copy runs in the background and writes to the tree can continue while it does.
+// Pages still dirty in the buffer pool are flushed first, so the snapshot includes them.
+func (t *BPlusTree) Checkpoint(path string) *CheckpointJob {
+	pager, ok := t.pager.(*Pager)
+	if !ok {
+		return failedCheckpoint(errCheckpointNoPager)
+	}
+	if err := t.pool.Flush(); err != nil {
+		return failedCheckpoint(err)
+	}
+	return pager.checkpoint(path, false)
+}
+
+// IncrementalCheckpoint brings the snapshot written by the previous checkpoint at path up to date
+// by rewriting only the pages that were dirtied since that checkpoint began.
+func (t *BPlusTree) IncrementalCheckpoint(path string) *CheckpointJob {
+	pager, ok := t.pager.(*Pager)
+	if !ok {
+		return failedCheckpoint(errCheckpointNoPager)
+	}
+	if err := t.pool.Flush(); err != nil {
+		return failedCheckpoint(err)
+	}
+	return pager.checkpoint(path, true)
+}
+
+func (p *Pager) checkpoint(path string, incremental bool) *CheckpointJob {
+	p.mu.Lock()
+	if p.snapshot != nil {
+		p.mu.Unlock()
+		return failedCheckpoint(errCheckpointRunning)
+	}
+	if incremental && !p.checkpointed {
+		p.mu.Unlock()
+		return failedCheckpoint(errNoFullCheckpoint)
+	}
+
+	var pages []PageID
+	if incremental {
+		for pageID := range p.dirty {
+			pages = append(pages, pageID)
+		}
+		slices.Sort(pages)
+	} else {
+		for i := int64(0); i < p.numPages; i++ {
+			pages = append(pages, PageID(i))
+		}
+	}
+	snapshot := p.installSnapshot()
+	dirtyBefore := p.dirty
+	p.dirty = make(map[PageID]struct{})
+	p.mu.Unlock()
+
+	job := &CheckpointJob{done: make(chan struct{})}
+	go func() {
+		err := p.copySnapshot(snapshot, path, pages, incremental)
+
+		p.mu.Lock()
+		p.snapshot = nil
+		if err == nil {
+			p.checkpointed = true
+		} else {
+			// The pages were never written out, so the next checkpoint has to include them again.
+			for pageID := range dirtyBefore {
+				p.dirty[pageID] = struct{}{}
+			}
+		}
+		p.mu.Unlock()
+
+		job.err = err
+		close(job.done)
+	}()
+	return job
+}
+
+// installSnapshot starts a copy-on-write snapshot of the whole file. The caller must hold p.mu and
+// check that no snapshot is running.
+func (p *Pager) installSnapshot() *pageSnapshot {
+	p.snapshot = &pageSnapshot{
+		numPages:  p.numPages,
+		preserved: make(map[PageID]*Page),
+		copied:    make(map[PageID]struct{}),
+	}
+	return p.snapshot
+}
+
+// startSnapshot starts a snapshot for a backup (see DB.Backup). Unlike a checkpoint, a backup
+// leaves the record of the pages written since the last checkpoint alone.
+func (p *Pager) startSnapshot() (*pageSnapshot, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.snapshot != nil {
+		return nil, errCheckpointRunning
+	}
+	return p.installSnapshot(), nil
+}
+
+// endSnapshot ends the snapshot started by startSnapshot.
+func (p *Pager) endSnapshot() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.snapshot = nil
+}
+
+// copySnapshot writes the snapshot's view of the given pages to path. A full checkpoint is written
+// to a temporary file that replaces path only once it is complete. An incremental checkpoint
+// updates the existing file at path in place.
+func (p *Pager) copySnapshot(snapshot *pageSnapshot, path string, pages []PageID, incremental bool) error {
+	target := path
+	var dst *os.File
+	var err error
+	if incremental {
+		dst, err = os.OpenFile(path, os.O_RDWR, 0666)
+		if errors.Is(err, os.ErrNotExist) {
+			return errCheckpointNotFound
+		}
+	} else {
+		target = path + ".tmp"
+		dst, err = os.Create(target)
+	}
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	for _, pageID := range pages {
+		if int64(pageID) >= snapshot.numPages {
+			continue
+		}
+		page, err := p.snapshotPage(snapshot, pageID)
+		if err != nil {
+			return err
+		}
+		if err := p.cipher.writeFrame(dst, pageID, page); err != nil {
+			return err
+		}
+	}
+
+	// Pages allocated after the snapshot was taken are not part of it.
+	if err := dst.Truncate(snapshot.numPages * p.cipher.frameSize()); err != nil {
+		return err
+	}
+	if err := dst.Sync(); err != nil {
+		return err
+	}
+	if incremental {
+		return nil
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	return os.Rename(target, path)
+}
+
+// snapshotPage returns the contents a page had when the snapshot was taken and marks it as copied,
+// after which writers no longer need to preserve it.
+func (p *Pager) snapshotPage(snapshot *pageSnapshot, pageID PageID) (*Page, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	snapshot.copied[pageID] = struct{}{}
+	if page, ok := snapshot.preserved[pageID]; ok {
+		delete(snapshot.preserved, pageID)
+		return page, nil
+	}
+	return p.readPage(pageID, new(Page))
+}
+
+// preserveForSnapshot saves the current contents of a page before it is overwritten, if a running
+// checkpoint still needs them. The caller must hold p.mu.
+func (p *Pager) preserveForSnapshot(pageID PageID) error {
+	snapshot := p.snapshot
+	if snapshot == nil || int64(pageID) >= snapshot.numPages {
+		return nil
+	}
+	if _, done := snapshot.copied[pageID]; done {
+		return nil
+	}
+	if _, saved := snapshot.preserved[pageID]; saved {
+		return nil
+	}
+	page, err := p.readPage(pageID, new(Page))
+	if err != nil {
+		return err
+	}
+	snapshot.preserved[pageID] = page
+	return nil
+}
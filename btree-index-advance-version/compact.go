@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"os"
+)
+
+// =================================================================================================
+// --- compact.go --- (Vacuum / Compaction)
+// =================================================================================================
+
+// Deletes leave the index file full of half-empty pages and of pages that are no longer part of
+// the tree at all. Compact rewrites the whole tree into a fresh file, bottom-up, and then swaps it
+// in place of the old one:
+//
+//	| meta page | leaves, in key order | internal pages, level by level | root | overflow pages |
+//
+// Every page is filled up to the requested fill factor, and logically consecutive leaves are also
+// physically consecutive, which is what read-ahead needs. The file is written under a temporary
+// name and renamed over the index, so a crash leaves either the old or the new file in place. A
+// segmented index is written to new segments instead, and its manifest is renamed (see
+// segment.go). The meta page goes to page 0, where Open looks for it, with an index header for the
+// new root, so compacting also gives a file from before the header one. The new root carries the
+// root flag too.
+
+// defaultCompactFillFactor leaves some room in every page, so the first inserts after compacting
+// don't immediately split pages again.
+const defaultCompactFillFactor = 0.9
+
+var (
+	errCompactNeedsPager    = errors.New("compaction requires the tree to be stored in a Pager")
+	errCompactInTransaction = errors.New("cannot compact while a transaction is open")
+	errInvalidFillFactor    = errors.New("fill factor must be in (0, 1]")
+	errCompactWithBuckets   = errors.New("cannot compact an index file that holds buckets")
+)
+
+// Compact rewrites the index file so that every page is filled to fillFactor (e.g. 0.9), within the
+// limits the tree's degree allows. Pages that are no longer used are dropped.
+func (t *BPlusTree) Compact(fillFactor float64) error {
+	return t.CompactContext(context.Background(), fillFactor)
+}
+
+// CompactContext is Compact that gives up once ctx is done and returns ctx.Err(). The new file is
+// only swapped in at the very end, so a cancelled compaction leaves the index as it was.
+func (t *BPlusTree) CompactContext(ctx context.Context, fillFactor float64) error {
+	numKeys, err := t.Len()
+	if err != nil {
+		return err
+	}
+	return t.rewrite(fillFactor, numKeys, func() (compactSource, error) {
+		return t.SeekContext(ctx, math.MinInt)
+	})
+}
+
+// compactSource is the sequence of entries a rewrite copies, in key order. After Next returns
+// true, at returns a cursor whose last entry is the current one.
+type compactSource interface {
+	Next() bool
+	Err() error
+	at() *Cursor
+}
+
+func (c *Cursor) at() *Cursor { return c }
+
+// rewrite implements CompactContext and MergeContext: it bulk-loads the entries of the source
+// open returns into a fresh file and swaps it in. open is called twice, once to count the entries
+// and once to copy them. numKeys sizes the rebuilt bloom filter.
+func (t *BPlusTree) rewrite(fillFactor float64, numKeys int, open func() (compactSource, error)) error {
+	pager, ok := t.pager.(*Pager)
+	if !ok {
+		return errCompactNeedsPager
+	}
+	if t.txPages != nil {
+		return errCompactInTransaction
+	}
+	if !(fillFactor > 0 && fillFactor <= 1) {
+		return errInvalidFillFactor
+	}
+	// Compaction only rewrites the main tree, so it would lose the buckets.
+	if t.catalogPageID != -1 {
+		return errCompactWithBuckets
+	}
+	if err := t.pool.Flush(); err != nil {
+		return err
+	}
+
+	// The filter is rebuilt from the keys that are copied, sized for their number (see bloom.go).
+	var bloom *BloomFilter
+	if t.bloom != nil {
+		bloom = NewBloomFilter(max(numKeys, minBloomKeys), t.bloom.fpRate)
+	}
+
+	file, err := pager.compactTarget()
+	if err != nil {
+		return err
+	}
+	rootPageID, metaPageID, err := t.writeCompacted(file, fillFactor, bloom, open)
+	if err == nil {
+		err = pager.installCompacted(file)
+	}
+	if err != nil {
+		discardCompacted(file)
+		return err
+	}
+	t.pool.reset()
+	t.rootPageID, t.metaPageID = rootPageID, metaPageID
+	if bloom == nil {
+		return nil
+	}
+	t.bloom = bloom
+	return t.SaveBloomFilter()
+}
+
+// writeCompacted bulk-loads the entries of the source open returns into file, which is empty, and
+// returns the IDs of its root page and of its meta page. It adds every key to bloom, unless bloom
+// is nil.
+func (t *BPlusTree) writeCompacted(file pageFile, fillFactor float64, bloom *BloomFilter, open func() (compactSource, error)) (rootPageID, metaPageID PageID, err error) {
+	c, err := open()
+	if err != nil {
+		return -1, -1, err
+	}
+	numEntries := 0
+	for c.Next() {
+		numEntries++
+	}
+	if err := c.Err(); err != nil {
+		return -1, -1, err
+	}
+
+	// Plan every level up front, so each page knows its own ID and its parent's when it's written.
+	maxKeys, maxInternalKeys := t.degree-1, t.InternalDegree()-1
+	leafTarget := int(math.Round(fillFactor * float64(maxKeys)))
+	internalTarget := int(math.Round(fillFactor * float64(maxInternalKeys)))
+	levels := [][]int{distribute(numEntries, t.minKeys(), maxKeys, leafTarget)}
+	for len(levels[len(levels)-1]) > 1 {
+		numChildren := len(levels[len(levels)-1])
+		levels = append(levels, distribute(numChildren, t.minInternalKeys()+1, maxInternalKeys+1, internalTarget+1))
+	}
+	firstPageID := make([]PageID, len(levels)) // ID of the first page of each level
+	nextPageID := PageID(1)                    // page 0 is the meta page
+	for i, level := range levels {
+		firstPageID[i] = nextPageID
+		nextPageID += PageID(len(level))
+	}
+	rootPageID = nextPageID - 1
+	parentOf := func(level, index int) PageID {
+		if level == len(levels)-1 {
+			return -1
+		}
+		return firstPageID[level+1] + PageID(groupOf(levels[level+1], index))
+	}
+
+	w := &compactWriter{file: file, nextOverflow: nextPageID}
+	if pager, ok := t.pager.(*Pager); ok {
+		w.cipher = pager.cipher
+	}
+
+	// Leaves. Values in overflow pages are copied to new chains at the end of the file.
+	lowKeys := make([]int, 0, len(levels[0])) // smallest key under each page of the current level
+	counts := levels[0]                       // number of entries under each page of the current level
+	if c, err = open(); err != nil {
+		return -1, -1, err
+	}
+	for i, size := range levels[0] {
+		page := new(Page)
+		page[nodeTypeOffset] = NodeTypeLeaf
+		resetCells(page)
+		for j := 0; j < size; j++ {
+			if !c.Next() {
+				if err := c.Err(); err != nil {
+					return -1, -1, err
+				}
+				return -1, -1, errors.New("tree changed during compaction")
+			}
+			entry := c.at()
+			if j == 0 {
+				lowKeys = append(lowKeys, entry.Key())
+			}
+			if bloom != nil {
+				bloom.Add(entry.Key())
+			}
+			cell := cellAt(entry.page, entry.index-1)
+			if _, valueSize, overflow := leafValueAt(entry.page, entry.index-1); overflow != -1 {
+				value, err := entry.tree.readOverflowChain(overflow, valueSize)
+				if err != nil {
+					return -1, -1, err
+				}
+				first, err := w.writeOverflowChain(value)
+				if err != nil {
+					return -1, -1, err
+				}
+				cell = overflowLeafCell(entry.Key(), valueSize, first)
+			}
+			insertCell(page, j, cell)
+		}
+		next := PageID(-1)
+		if i+1 < len(levels[0]) {
+			next = firstPageID[0] + PageID(i+1)
+		}
+		setNextLeafPageID(page, next)
+		if err := w.writeNode(firstPageID[0]+PageID(i), page, parentOf(0, i), len(levels) == 1); err != nil {
+			return -1, -1, err
+		}
+	}
+
+	// Internal levels. A separator is the smallest key under the child to its right.
+	for level := 1; level < len(levels); level++ {
+		childLowKeys, childCounts := lowKeys, counts
+		lowKeys, counts = make([]int, 0, len(levels[level])), make([]int, 0, len(levels[level]))
+		child := 0
+		for i, size := range levels[level] {
+			page := new(Page)
+			page[nodeTypeOffset] = NodeTypeInternal
+			children := make([]PageID, size)
+			for j := range children {
+				children[j] = firstPageID[level-1] + PageID(child+j)
+			}
+			writeInternalEntries(page, childLowKeys[child+1:child+size], children, childCounts[child:child+size])
+			lowKeys = append(lowKeys, childLowKeys[child])
+			counts = append(counts, subtreeCount(page))
+			child += size
+			if err := w.writeNode(firstPageID[level]+PageID(i), page, parentOf(level, i), level == len(levels)-1); err != nil {
+				return -1, -1, err
+			}
+		}
+	}
+
+	meta, err := t.readMeta()
+	if err != nil {
+		return -1, -1, err
+	}
+	header := t.indexHeader()
+	header.rootPageID, header.catalogPageID = rootPageID, -1
+	putIndexHeader(meta, header)
+	if err := w.cipher.writeFrame(file, 0, meta); err != nil {
+		return -1, -1, err
+	}
+	if err := file.Sync(); err != nil {
+		return -1, -1, err
+	}
+	return rootPageID, 0, nil
+}
+
+// distribute splits n items into groups of between minPer and maxPer items, as close to target
+// items per group as those bounds allow, and returns the group sizes. A single group may hold
+// fewer than minPer items (it becomes the root).
+func distribute(n, minPer, maxPer, target int) []int {
+	target = min(max(target, minPer, 1), maxPer)
+	groups := (n + target - 1) / target
+	groups = max(groups, (n+maxPer-1)/maxPer)
+	if minPer > 0 {
+		groups = min(groups, n/minPer)
+	}
+	groups = max(groups, 1)
+
+	sizes := make([]int, groups)
+	for i := range sizes {
+		sizes[i] = n / groups
+		if i < n%groups {
+			sizes[i]++
+		}
+	}
+	return sizes
+}
+
+// groupOf returns the index of the group holding the given item.
+func groupOf(sizes []int, item int) int {
+	for i, size := range sizes {
+		if item < size {
+			return i
+		}
+		item -= size
+	}
+	return len(sizes) - 1
+}
+
+// compactTarget creates the empty file Compact writes the compacted index to: a file next to the
+// index, or the next generation of a segmented index (see segment.go).
+func (p *Pager) compactTarget() (pageFile, error) {
+	if segments, ok := p.file.(*segmentedFile); ok {
+		return segments.nextGeneration(), nil
+	}
+	return os.Create(p.path + ".compact")
+}
+
+// installCompacted swaps the file written by Compact in place of the index.
+func (p *Pager) installCompacted(file pageFile) error {
+	if segments, ok := file.(*segmentedFile); ok {
+		return p.replaceSegments(segments)
+	}
+	file.Close()
+	return p.replaceFile(file.Name())
+}
+
+// discardCompacted deletes the file of a compaction that failed.
+func discardCompacted(file pageFile) {
+	if segments, ok := file.(*segmentedFile); ok {
+		segments.remove()
+		return
+	}
+	file.Close()
+	os.Remove(file.Name())
+}
+
+// compactWriter writes the pages of a compacted index file.
+type compactWriter struct {
+	file         pageFile
+	cipher       *pageCipher // the index file's, if it is encrypted
+	nextOverflow PageID
+}
+
+func (w *compactWriter) writeNode(pageID PageID, page *Page, parentPageID PageID, root bool) error {
+	setParentPageID(page, parentPageID)
+	setIsRoot(page, root)
+	return w.cipher.writeFrame(w.file, pageID, page)
+}
+
+// writeOverflowChain stores value in overflow pages at the end of the file, like
+// BPlusTree.writeOverflowChain does in the live index.
+func (w *compactWriter) writeOverflowChain(value []byte) (PageID, error) {
+	first := w.nextOverflow
+	for offset := 0; offset < len(value); offset += overflowPayloadSize {
+		chunk := value[offset:min(offset+overflowPayloadSize, len(value))]
+		page := new(Page)
+		page[nodeTypeOffset] = NodeTypeOverflow
+		setParentPageID(page, -1)
+		setNumKeys(page, uint16(len(chunk)))
+		next := PageID(-1)
+		if offset+overflowPayloadSize < len(value) {
+			next = w.nextOverflow + 1
+		}
+		setNextLeafPageID(page, next)
+		copy(page[headerSize:], chunk)
+		if err := w.cipher.writeFrame(w.file, w.nextOverflow, page); err != nil {
+			return -1, err
+		}
+		w.nextOverflow++
+	}
+	return first, nil
+}
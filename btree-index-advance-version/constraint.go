@@ -0,0 +1,149 @@
+package main
+
+import (
+	"cmp"
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// =================================================================================================
+// --- constraint.go --- (Unique Constraint Violations)
+// =================================================================================================
+
+// The tree is a unique index: a key maps to one value, and inserting a key that is already
+// present fails. The error says which key, which index and which row already holds it, so that a
+// caller loading data can point at the offending record rather than just at the key:
+//
+//	duplicate key insertion not allowed: key 12 in index "users_pk.idx" already maps to offset 296 (rejected offset 410)
+//
+// It is a *ConstraintViolation, which matches ErrDuplicateKey with errors.Is, like the plain
+// wrapped error it replaces. BuildIndexWith can also check a whole data file before loading it and
+// report every violation at once, as a ConstraintViolations error.
+
+// ConstraintViolation is the error for a key that the unique index already holds, or that a batch
+// holds twice. Use errors.As to get at its fields.
+type ConstraintViolation struct {
+	// Index names the index, by default the path of its file (see SetName).
+	Index string
+	Key   int
+	// Existing is the value already stored under Key, the offset of the row that holds it, and
+	// Rejected is the value that couldn't be inserted. Within a batch, Existing is the value of
+	// the first pair with the key. Either is -1 if it isn't an int64 stored by Insert.
+	Existing, Rejected int64
+}
+
+func (e *ConstraintViolation) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%v: key %d", ErrDuplicateKey, e.Key)
+	if e.Index != "" {
+		fmt.Fprintf(&b, " in index %q", e.Index)
+	}
+	if e.Existing != -1 {
+		fmt.Fprintf(&b, " already maps to offset %d", e.Existing)
+	} else {
+		b.WriteString(" is already present")
+	}
+	if e.Rejected != -1 {
+		fmt.Fprintf(&b, " (rejected offset %d)", e.Rejected)
+	}
+	return b.String()
+}
+
+func (e *ConstraintViolation) Unwrap() error { return ErrDuplicateKey }
+
+// ConstraintViolations is the error for a bulk load that found several violations.
+type ConstraintViolations []*ConstraintViolation
+
+// maxViolationsInMessage bounds the violations spelled out by ConstraintViolations.Error.
+const maxViolationsInMessage = 3
+
+func (v ConstraintViolations) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d unique constraint violations", len(v))
+	for i, e := range v {
+		if i == maxViolationsInMessage {
+			fmt.Fprintf(&b, "; and %d more", len(v)-i)
+			break
+		}
+		fmt.Fprintf(&b, "; %v", e)
+	}
+	return b.String()
+}
+
+// Unwrap returns the violations, so that errors.Is matches ErrDuplicateKey and errors.As finds a
+// *ConstraintViolation.
+func (v ConstraintViolations) Unwrap() []error {
+	errs := make([]error, len(v))
+	for i, e := range v {
+		errs[i] = e
+	}
+	return errs
+}
+
+// SetName sets the name the tree's constraint violations report. It defaults to the path of the
+// index file.
+func (t *BPlusTree) SetName(name string) {
+	t.name = name
+}
+
+// Name returns the name of the tree (see SetName).
+func (t *BPlusTree) Name() string {
+	if t.name != "" {
+		return t.name
+	}
+	switch pager := t.pager.(type) {
+	case *Pager:
+		return pager.path
+	case *MmapPager:
+		return pager.file.Name()
+	}
+	return ""
+}
+
+// duplicateKey returns the violation for inserting value under the key of the i-th entry of a
+// leaf page.
+func (t *BPlusTree) duplicateKey(page *Page, i int, value []byte) *ConstraintViolation {
+	existing := int64(-1)
+	if inline, _, _ := leafValueAt(page, i); len(inline) == 8 {
+		existing = valueAt(page, i)
+	}
+	return &ConstraintViolation{Index: t.Name(), Key: keyAt(page, i), Existing: existing, Rejected: decodeOffset(value)}
+}
+
+// decodeOffset returns the int64 a value stored by Insert holds, or -1 for other values.
+func decodeOffset(value []byte) int64 {
+	if len(value) != 8 {
+		return -1
+	}
+	return int64(binary.LittleEndian.Uint64(value))
+}
+
+// uniqueViolations returns every violation that inserting pairs would cause, sorted by key:
+// duplicates within pairs, found by sorting them, and keys the tree already holds, found by
+// scanning the tree alongside the sorted pairs.
+func (t *BPlusTree) uniqueViolations(pairs []KV) (ConstraintViolations, error) {
+	sorted := sortPairs(pairs)
+	violations := t.batchDuplicates(sorted)
+	if len(sorted) == 0 {
+		return violations, nil
+	}
+	c, err := t.Seek(sorted[0].Key)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < len(sorted) && c.Next(); {
+		for i < len(sorted) && sorted[i].Key < c.Key() {
+			i++
+		}
+		for ; i < len(sorted) && sorted[i].Key == c.Key(); i++ {
+			violations = append(violations, t.duplicateKey(c.page, c.index-1, encodeInt64Value(sorted[i].Value)))
+		}
+	}
+	if err := c.Err(); err != nil {
+		return nil, err
+	}
+	slices.SortStableFunc(violations, func(a, b *ConstraintViolation) int { return cmp.Compare(a.Key, b.Key) })
+	return violations, nil
+}
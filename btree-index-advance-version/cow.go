@@ -0,0 +1,563 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// =================================================================================================
+// --- cow.go --- (Copy-on-Write B+ Tree)
+// =================================================================================================
+
+// The B+ tree in btree.go updates its pages in place, so it needs the write-ahead log of txn.go to
+// survive a crash halfway through a split, and the checkpoints of checkpoint.go to give readers a
+// stable view. A COWTree gets both from never overwriting a page, like LMDB and bbolt do: a write
+// copies the leaf it changes to a new page at the end of the file, which changes the child pointer
+// in the parent, which is copied too, and so on up to a new root.
+//
+//	before:        root A            after inserting into leaf C:      root A'
+//	              /      \                                            /      \
+//	            B          C                                        B          C'
+//
+// The old root still reaches the old version of every page, so it is a complete snapshot of the
+// tree before the write. What makes a new version current is a meta page naming its root:
+//
+//	| header (32 bytes) | magic uint32 | CRC-32 uint32 | txid | root | page count | key count int64 |
+//
+// Pages 0 and 1 are both meta pages. A commit writes (and syncs) every new page first, then the
+// meta page of the older of the two, with the next transaction ID. Opening the file picks the
+// valid meta page with the highest ID, so a crash before the meta page is written leaves the
+// previous version, and a torn meta page fails its checksum and leaves the other one. There is
+// nothing to replay, so there is no log.
+//
+// Readers take a COWSnapshot, which is just a root, without any lock: the pages it reaches are
+// never written again, while the single writer builds the next version in pages beyond the end of
+// the current one and publishes it with one atomic pointer swap.
+//
+// The price is that every write copies a whole root-to-leaf path, and that the file only grows:
+// the pages of old versions are never reused, since a snapshot may still be reading them. Pages
+// have no parent or next-leaf pointers, which couldn't be kept up to date without copying the
+// neighbours too, so range scans descend from the root. Deletes don't merge underfull pages; a
+// page that becomes empty is dropped from its parent.
+//
+// Leaf page layout:       | header (32 bytes) | key int64 | value int64 | ... |
+// Internal page layout:   | header (32 bytes) | child int64 | key int64 | child int64 | ... |
+//
+// numKeys is the number of keys; an internal page has one more child than keys.
+
+const (
+	NodeTypeCOWMeta     = 10
+	NodeTypeCOWLeaf     = 11
+	NodeTypeCOWInternal = 12
+)
+
+const (
+	cowMagic = 0x434F5754 // "COWT"
+	// cowMaxDegree is the widest node that fits a page: an internal page holds 253 keys and 254
+	// children, and a leaf is limited to the same number of keys.
+	cowMaxDegree = (PageSize-headerSize-8)/16 + 1
+	// cowFirstPage is the first page after the two meta pages.
+	cowFirstPage = 2
+)
+
+// cowState is the version of the tree a meta page describes.
+type cowState struct {
+	txid     uint64
+	root     PageID
+	numPages int64 // pages 0 to numPages-1 hold this version; new ones are written after them
+	numKeys  int
+}
+
+// cowNode is a decoded COWTree page.
+type cowNode struct {
+	leaf     bool
+	keys     []int
+	values   []int64  // of a leaf, one per key
+	children []PageID // of an internal page, one more than keys
+}
+
+// COWTree is a copy-on-write B+ tree mapping int keys to int64 values. Any number of goroutines
+// may read it through snapshots while one writes; writes are serialized.
+type COWTree struct {
+	pager   PageStore
+	maxKeys int
+	mu      sync.Mutex // held by the running Update
+	current atomic.Pointer[cowState]
+}
+
+// OpenCOWTree opens the copy-on-write tree stored in pager, or creates an empty one in an empty
+// pager. The degree must be between 3 and cowMaxDegree; 0 means cowMaxDegree.
+func OpenCOWTree(pager PageStore, degree int) (*COWTree, error) {
+	if degree == 0 {
+		degree = cowMaxDegree
+	}
+	if degree < 3 || degree > cowMaxDegree {
+		return nil, fmt.Errorf("copy-on-write tree degree must be between 3 and %d", cowMaxDegree)
+	}
+	t := &COWTree{pager: pager, maxKeys: degree - 1}
+	if pager.NumPages() == 0 {
+		state := cowState{root: cowFirstPage, numPages: cowFirstPage + 1}
+		if err := pager.WritePage(cowFirstPage, encodeCOWNode(&cowNode{leaf: true})); err != nil {
+			return nil, err
+		}
+		for metaPageID := PageID(0); metaPageID < cowFirstPage; metaPageID++ {
+			if err := pager.WritePage(metaPageID, encodeCOWMeta(state)); err != nil {
+				return nil, err
+			}
+		}
+		t.current.Store(&state)
+		return t, nil
+	}
+
+	var best *cowState
+	for metaPageID := PageID(0); metaPageID < cowFirstPage; metaPageID++ {
+		page, err := pager.ReadPage(metaPageID, new(Page))
+		if err != nil {
+			return nil, err
+		}
+		if state, ok := decodeCOWMeta(page); ok && (best == nil || state.txid > best.txid) {
+			best = &state
+		}
+	}
+	if best == nil {
+		return nil, fmt.Errorf("%w: neither meta page of the copy-on-write tree is valid", ErrCorruptPage)
+	}
+	t.current.Store(best)
+	return t, nil
+}
+
+// --- Pages ---
+
+func encodeCOWMeta(state cowState) *Page {
+	page := new(Page)
+	page[nodeTypeOffset] = NodeTypeCOWMeta
+	setParentPageID(page, -1)
+	setNextLeafPageID(page, -1)
+	body := page[headerSize:]
+	binary.LittleEndian.PutUint32(body[0:], cowMagic)
+	binary.LittleEndian.PutUint64(body[8:], state.txid)
+	binary.LittleEndian.PutUint64(body[16:], uint64(state.root))
+	binary.LittleEndian.PutUint64(body[24:], uint64(state.numPages))
+	binary.LittleEndian.PutUint64(body[32:], uint64(state.numKeys))
+	binary.LittleEndian.PutUint32(body[4:], crc32.ChecksumIEEE(body[8:40]))
+	return page
+}
+
+// decodeCOWMeta returns the state a meta page holds, and false if it isn't a valid meta page.
+func decodeCOWMeta(page *Page) (cowState, bool) {
+	body := page[headerSize:]
+	if page[nodeTypeOffset] != NodeTypeCOWMeta || binary.LittleEndian.Uint32(body[0:]) != cowMagic ||
+		binary.LittleEndian.Uint32(body[4:]) != crc32.ChecksumIEEE(body[8:40]) {
+		return cowState{}, false
+	}
+	return cowState{
+		txid:     binary.LittleEndian.Uint64(body[8:]),
+		root:     PageID(binary.LittleEndian.Uint64(body[16:])),
+		numPages: int64(binary.LittleEndian.Uint64(body[24:])),
+		numKeys:  int(binary.LittleEndian.Uint64(body[32:])),
+	}, true
+}
+
+func encodeCOWNode(n *cowNode) *Page {
+	page := new(Page)
+	page[nodeTypeOffset] = NodeTypeCOWInternal
+	if n.leaf {
+		page[nodeTypeOffset] = NodeTypeCOWLeaf
+	}
+	setParentPageID(page, -1)
+	setNextLeafPageID(page, -1)
+	setNumKeys(page, uint16(len(n.keys)))
+	offset := headerSize
+	put := func(v int64) {
+		binary.LittleEndian.PutUint64(page[offset:], uint64(v))
+		offset += 8
+	}
+	for i, key := range n.keys {
+		if !n.leaf {
+			put(int64(n.children[i]))
+		}
+		put(int64(key))
+		if n.leaf {
+			put(n.values[i])
+		}
+	}
+	if !n.leaf {
+		put(int64(n.children[len(n.keys)]))
+	}
+	return page
+}
+
+// readCOWNode reads and decodes a page of the tree.
+func readCOWNode(pager PageStore, pageID PageID) (*cowNode, error) {
+	page, err := pager.ReadPage(pageID, new(Page))
+	if err != nil {
+		return nil, err
+	}
+	nodeType, numKeys := page[nodeTypeOffset], int(getNumKeys(page))
+	if nodeType != NodeTypeCOWLeaf && nodeType != NodeTypeCOWInternal || numKeys >= cowMaxDegree {
+		return nil, fmt.Errorf("%w: page %d is not a copy-on-write tree page", ErrCorruptPage, pageID)
+	}
+	n := &cowNode{leaf: nodeType == NodeTypeCOWLeaf, keys: make([]int, numKeys)}
+	offset := headerSize
+	next := func() int64 {
+		v := int64(binary.LittleEndian.Uint64(page[offset:]))
+		offset += 8
+		return v
+	}
+	if n.leaf {
+		n.values = make([]int64, numKeys)
+		for i := range n.keys {
+			n.keys[i], n.values[i] = int(next()), next()
+		}
+		return n, nil
+	}
+	n.children = make([]PageID, numKeys+1)
+	for i := range n.keys {
+		n.children[i] = PageID(next())
+		n.keys[i] = int(next())
+	}
+	n.children[numKeys] = PageID(next())
+	return n, nil
+}
+
+// childIndex returns the index of the child of an internal node whose subtree may hold key.
+func (n *cowNode) childIndex(key int) int {
+	return sort.Search(len(n.keys), func(i int) bool { return key < n.keys[i] })
+}
+
+// --- Snapshots ---
+
+// COWSnapshot is a read-only view of one committed version of a COWTree. It stays valid and
+// unchanged however many transactions commit after it was taken.
+type COWSnapshot struct {
+	pager PageStore
+	state *cowState
+	// dirty holds the pages written by a transaction that haven't been committed yet, when the
+	// snapshot is the transaction's own view.
+	dirty map[PageID]*cowNode
+}
+
+// Snapshot returns a view of the latest committed version. It takes no lock.
+func (t *COWTree) Snapshot() *COWSnapshot {
+	return &COWSnapshot{pager: t.pager, state: t.current.Load()}
+}
+
+// TxID returns the ID of the transaction that committed the snapshot's version, 0 for the empty
+// tree the file was created with.
+func (s *COWSnapshot) TxID() uint64 {
+	return s.state.txid
+}
+
+// Len returns the number of keys in the snapshot.
+func (s *COWSnapshot) Len() int {
+	return s.state.numKeys
+}
+
+// NumPages returns the number of pages of the file in use when the snapshot was committed, those
+// of older versions included.
+func (s *COWSnapshot) NumPages() int64 {
+	return s.state.numPages
+}
+
+func (s *COWSnapshot) node(pageID PageID) (*cowNode, error) {
+	if n, ok := s.dirty[pageID]; ok {
+		return n, nil
+	}
+	return readCOWNode(s.pager, pageID)
+}
+
+// Search finds the value associated with a given key.
+func (s *COWSnapshot) Search(key int) (int64, bool, error) {
+	n, err := s.node(s.state.root)
+	for err == nil && !n.leaf {
+		n, err = s.node(n.children[n.childIndex(key)])
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	if i, found := slices.BinarySearch(n.keys, key); found {
+		return n.values[i], true, nil
+	}
+	return 0, false, nil
+}
+
+// SearchRange returns the values of the keys within [startKey, endKey], in key order.
+func (s *COWSnapshot) SearchRange(startKey, endKey int) ([]int64, error) {
+	var results []int64
+	var visit func(pageID PageID) error
+	visit = func(pageID PageID) error {
+		n, err := s.node(pageID)
+		if err != nil {
+			return err
+		}
+		if n.leaf {
+			for i, key := range n.keys {
+				if key >= startKey && key <= endKey {
+					results = append(results, n.values[i])
+				}
+			}
+			return nil
+		}
+		// Only the children from the one holding startKey to the one holding endKey overlap.
+		for i := n.childIndex(startKey); i <= n.childIndex(endKey); i++ {
+			if err := visit(n.children[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if startKey > endKey {
+		return nil, nil
+	}
+	return results, visit(s.state.root)
+}
+
+// Search finds the value associated with a given key in the latest committed version.
+func (t *COWTree) Search(key int) (int64, bool, error) {
+	return t.Snapshot().Search(key)
+}
+
+// SearchRange returns the values of the keys within [startKey, endKey] in the latest committed
+// version.
+func (t *COWTree) SearchRange(startKey, endKey int) ([]int64, error) {
+	return t.Snapshot().SearchRange(startKey, endKey)
+}
+
+// Len returns the number of keys in the latest committed version. It can't fail; the error is
+// there to match BPlusTree.Len.
+func (t *COWTree) Len() (int, error) {
+	return t.Snapshot().Len(), nil
+}
+
+// --- Transactions ---
+
+// COWTx is a read-write transaction. Its writes copy pages into memory, where later writes of the
+// same transaction modify them again without another copy, and reach the file when it commits.
+type COWTx struct {
+	COWSnapshot // the transaction's own view, including its uncommitted writes
+	tree        *COWTree
+	next        cowState
+}
+
+// Update runs fn in a transaction, which commits if fn returns nil and is discarded otherwise.
+// Only one Update runs at a time; snapshots keep reading the previous version meanwhile.
+func (t *COWTree) Update(fn func(tx *COWTx) error) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	current := t.current.Load()
+	tx := &COWTx{tree: t, next: *current}
+	tx.next.txid++
+	tx.COWSnapshot = COWSnapshot{pager: t.pager, state: &tx.next, dirty: make(map[PageID]*cowNode)}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if len(tx.dirty) == 0 {
+		return nil
+	}
+	return tx.commit()
+}
+
+// Insert inserts a key with its value in a transaction of its own.
+func (t *COWTree) Insert(key int, value int64) error {
+	return t.Update(func(tx *COWTx) error { return tx.Insert(key, value) })
+}
+
+// Delete removes a key in a transaction of its own and reports whether it was present.
+func (t *COWTree) Delete(key int) (bool, error) {
+	var found bool
+	err := t.Update(func(tx *COWTx) (err error) {
+		found, err = tx.Delete(key)
+		return err
+	})
+	return found, err
+}
+
+// commit writes the transaction's pages, then the meta page that makes them the current version,
+// and publishes that version to new snapshots.
+func (tx *COWTx) commit() error {
+	pageIDs := make([]PageID, 0, len(tx.dirty))
+	for pageID := range tx.dirty {
+		pageIDs = append(pageIDs, pageID)
+	}
+	slices.Sort(pageIDs)
+	for _, pageID := range pageIDs {
+		if err := tx.pager.WritePage(pageID, encodeCOWNode(tx.dirty[pageID])); err != nil {
+			return err
+		}
+	}
+	// A PageStore without the Pager's fsync on every write must not reorder these writes.
+	if err := tx.pager.WritePage(PageID(tx.next.txid%cowFirstPage), encodeCOWMeta(tx.next)); err != nil {
+		return err
+	}
+	next := tx.next
+	tx.tree.current.Store(&next)
+	return nil
+}
+
+// writable returns a node the transaction may modify in place of the given page: the page itself
+// if the transaction already copied it, or else a copy at a new page ID.
+func (tx *COWTx) writable(pageID PageID) (PageID, *cowNode, error) {
+	if n, ok := tx.dirty[pageID]; ok {
+		return pageID, n, nil
+	}
+	n, err := readCOWNode(tx.pager, pageID)
+	if err != nil {
+		return 0, nil, err
+	}
+	newPageID := tx.allocate()
+	tx.dirty[newPageID] = n
+	return newPageID, n, nil
+}
+
+// allocate returns a page ID past the end of the current version.
+func (tx *COWTx) allocate() PageID {
+	tx.next.numPages++
+	return PageID(tx.next.numPages - 1)
+}
+
+// newNode adds a node to the transaction at a new page ID.
+func (tx *COWTx) newNode(n *cowNode) PageID {
+	pageID := tx.allocate()
+	tx.dirty[pageID] = n
+	return pageID
+}
+
+// Insert inserts a key with its value. It returns ErrDuplicateKey if the key is already present.
+func (tx *COWTx) Insert(key int, value int64) error {
+	root, splitKey, right, err := tx.insert(tx.next.root, key, value)
+	if err != nil {
+		return err
+	}
+	if right != -1 {
+		root = tx.newNode(&cowNode{keys: []int{splitKey}, children: []PageID{root, right}})
+	}
+	tx.next.root = root
+	tx.next.numKeys++
+	return nil
+}
+
+// insert adds key to the subtree at pageID and returns the page that replaces it. If that page
+// split, it also returns the smallest key of the new right sibling and the sibling's page, or -1.
+// Pages are only copied on the way back up, so a duplicate key copies nothing.
+func (tx *COWTx) insert(pageID PageID, key int, value int64) (PageID, int, PageID, error) {
+	n, err := tx.node(pageID)
+	if err != nil {
+		return 0, 0, -1, err
+	}
+	if n.leaf {
+		i, found := slices.BinarySearch(n.keys, key)
+		if found {
+			return 0, 0, -1, &ConstraintViolation{Key: key, Existing: n.values[i], Rejected: value}
+		}
+		if pageID, n, err = tx.writable(pageID); err != nil {
+			return 0, 0, -1, err
+		}
+		n.keys, n.values = slices.Insert(n.keys, i, key), slices.Insert(n.values, i, value)
+		if len(n.keys) <= tx.tree.maxKeys {
+			return pageID, 0, -1, nil
+		}
+		mid := len(n.keys) / 2
+		right := &cowNode{leaf: true, keys: slices.Clone(n.keys[mid:]), values: slices.Clone(n.values[mid:])}
+		n.keys, n.values = n.keys[:mid], n.values[:mid]
+		return pageID, right.keys[0], tx.newNode(right), nil
+	}
+
+	i := n.childIndex(key)
+	child, childSplitKey, childRight, err := tx.insert(n.children[i], key, value)
+	if err != nil {
+		return 0, 0, -1, err
+	}
+	if pageID, n, err = tx.writable(pageID); err != nil {
+		return 0, 0, -1, err
+	}
+	n.children[i] = child
+	if childRight == -1 {
+		return pageID, 0, -1, nil
+	}
+	n.keys = slices.Insert(n.keys, i, childSplitKey)
+	n.children = slices.Insert(n.children, i+1, childRight)
+	if len(n.keys) <= tx.tree.maxKeys {
+		return pageID, 0, -1, nil
+	}
+	// The middle key moves up to the parent instead of staying in either half.
+	mid := len(n.keys) / 2
+	splitKey := n.keys[mid]
+	right := &cowNode{keys: slices.Clone(n.keys[mid+1:]), children: slices.Clone(n.children[mid+1:])}
+	n.keys, n.children = n.keys[:mid], n.children[:mid+1]
+	return pageID, splitKey, tx.newNode(right), nil
+}
+
+// Delete removes a key and reports whether it was present.
+func (tx *COWTx) Delete(key int) (bool, error) {
+	root, empty, found, err := tx.delete(tx.next.root, key)
+	if err != nil || !found {
+		return false, err
+	}
+	if empty {
+		delete(tx.dirty, root)
+		root = tx.newNode(&cowNode{leaf: true})
+	}
+	// A root left with a single child is replaced by the child. The pages dropped here and below
+	// were all copied by this transaction, so they are dropped before they're ever written.
+	for {
+		n, err := tx.node(root)
+		if err != nil {
+			return false, err
+		}
+		if n.leaf || len(n.children) > 1 {
+			break
+		}
+		delete(tx.dirty, root)
+		root = n.children[0]
+	}
+	tx.next.root = root
+	tx.next.numKeys--
+	return true, nil
+}
+
+// delete removes key from the subtree at pageID and returns the page that replaces it, and whether
+// that page is empty, in which case the parent drops it.
+func (tx *COWTx) delete(pageID PageID, key int) (PageID, bool, bool, error) {
+	n, err := tx.node(pageID)
+	if err != nil {
+		return 0, false, false, err
+	}
+	if n.leaf {
+		i, found := slices.BinarySearch(n.keys, key)
+		if !found {
+			return pageID, false, false, nil
+		}
+		if pageID, n, err = tx.writable(pageID); err != nil {
+			return 0, false, false, err
+		}
+		n.keys, n.values = slices.Delete(n.keys, i, i+1), slices.Delete(n.values, i, i+1)
+		return pageID, len(n.keys) == 0, true, nil
+	}
+
+	i := n.childIndex(key)
+	child, childEmpty, found, err := tx.delete(n.children[i], key)
+	if err != nil || !found {
+		return pageID, false, found, err
+	}
+	if pageID, n, err = tx.writable(pageID); err != nil {
+		return 0, false, false, err
+	}
+	if !childEmpty {
+		n.children[i] = child
+		return pageID, false, true, nil
+	}
+	// Dropping child i also drops the separator next to it; the keys that routed to the child
+	// now route to a neighbour, which is just as good for a page with no keys.
+	delete(tx.dirty, child)
+	n.children = slices.Delete(n.children, i, i+1)
+	if len(n.keys) > 0 {
+		sep := max(i-1, 0)
+		n.keys = slices.Delete(n.keys, sep, sep+1)
+	}
+	return pageID, len(n.children) == 0, true, nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// =================================================================================================
+// --- cursor.go --- (Leaf Cursor for Range Scans)
+// =================================================================================================
+
+// Cursor walks the leaf chain in key order, one entry at a time:
+//
+//	c, err := tree.Seek(5)
+//	for c.Next() {
+//		fmt.Println(c.Key(), c.Value())
+//	}
+//	err = c.Err()
+//
+// Every time the cursor moves to a leaf it hints the next leaf in the chain to the buffer pool,
+// which passes the hint on to the page store so it can start reading ahead. The tree must not be
+// modified while a cursor is in use.
+type Cursor struct {
+	tree  *BPlusTree
+	ctx   context.Context // checked before each leaf is read
+	page  *Page           // current leaf, nil once the cursor is exhausted
+	buf   *Page           // buffer the leaves are read into (see pagepool.go), nil once exhausted
+	index int             // entry of page returned by the next call to Next
+	key   int
+	err   error
+}
+
+// Seek returns a cursor positioned before the first entry whose key is >= key.
+func (t *BPlusTree) Seek(key int) (*Cursor, error) {
+	return t.SeekContext(context.Background(), key)
+}
+
+// SeekContext is Seek for a cursor that stops once ctx is done. The cursor checks ctx every time it
+// moves to the next leaf; Next then returns false and Err returns ctx.Err().
+func (t *BPlusTree) SeekContext(ctx context.Context, key int) (*Cursor, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	leafPageID, err := t.findLeafPage(key)
+	if err != nil {
+		return nil, err
+	}
+	c := &Cursor{tree: t, ctx: ctx, buf: getPageBuffer()}
+	if err := c.load(leafPageID); err != nil {
+		c.release()
+		return nil, err
+	}
+	numKeys := int(getNumKeys(c.page))
+	for c.index < numKeys && keyAt(c.page, c.index) < key {
+		c.index++
+	}
+	t.compared(min(c.index+1, numKeys))
+	return c, nil
+}
+
+// load moves the cursor to the start of a leaf and hints the leaf after it.
+func (c *Cursor) load(pageID PageID) error {
+	page, err := c.tree.readNodeInto(pageID, c.buf)
+	if err != nil {
+		return err
+	}
+	if !isLeaf(page) {
+		return fmt.Errorf("%w: page %d in the leaf chain is not a leaf", ErrCorruptPage, pageID)
+	}
+	c.page, c.index = page, 0
+	if next := getNextLeafPageID(page); next != -1 {
+		c.tree.pool.HintScan(next)
+	}
+	return nil
+}
+
+// Next advances the cursor to the next entry. It returns false when there are no more entries
+// or an error occurred (see Err).
+func (c *Cursor) Next() bool {
+	for c.page != nil {
+		if c.index < int(getNumKeys(c.page)) {
+			c.key = keyAt(c.page, c.index)
+			c.index++
+			return true
+		}
+		c.nextLeaf()
+	}
+	return false
+}
+
+// nextLeaf moves the cursor to the start of the next leaf in the chain.
+func (c *Cursor) nextLeaf() {
+	next := getNextLeafPageID(c.page)
+	c.page = nil
+	if next == -1 {
+		c.release()
+		return
+	}
+	if err := c.ctx.Err(); err != nil {
+		c.err = err
+		c.release()
+		return
+	}
+	if err := c.load(next); err != nil {
+		c.err = err
+		c.release()
+	}
+}
+
+// release puts the cursor's buffer back once there are no more leaves to read into it.
+func (c *Cursor) release() {
+	putPageBuffer(c.buf)
+	c.buf = nil
+}
+
+// Skip moves the cursor past the next n entries without returning them, so a following Next
+// returns the entry after those. Leaves that are skipped entirely are never decoded.
+func (c *Cursor) Skip(n int) {
+	for n > 0 && c.page != nil {
+		remaining := int(getNumKeys(c.page)) - c.index
+		if n <= remaining {
+			c.index += n
+			return
+		}
+		n -= remaining
+		c.nextLeaf()
+	}
+}
+
+// Key returns the key of the entry the cursor is on.
+func (c *Cursor) Key() int { return c.key }
+
+// Value returns the value of the entry the cursor is on, for values stored by Insert.
+// It returns 0 for values that are not an int64.
+func (c *Cursor) Value() int64 {
+	return int64ValueAt(c.page, c.index-1)
+}
+
+// int64ValueAt returns the value of the i-th entry of a leaf if it is an int64 stored by Insert,
+// and 0 otherwise.
+func int64ValueAt(page *Page, i int) int64 {
+	if inline, _, _ := leafValueAt(page, i); len(inline) != 8 {
+		return 0
+	}
+	return valueAt(page, i)
+}
+
+// Bytes returns the value of the entry the cursor is on as stored by InsertBytes, reading it
+// from its overflow pages if necessary.
+func (c *Cursor) Bytes() ([]byte, error) {
+	return c.tree.leafValue(c.page, c.index-1)
+}
+
+// Err returns the error that stopped the cursor, if any.
+func (c *Cursor) Err() error { return c.err }
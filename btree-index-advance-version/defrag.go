@@ -0,0 +1,243 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+)
+
+// =================================================================================================
+// --- defrag.go --- (Online Leaf Chain Defragmentation)
+// =================================================================================================
+
+// Compact rebuilds the whole file, which needs a Pager and a second copy of the index on disk.
+// DefragmentLeaves is the lighter, in-place alternative. It runs through the normal page API, so
+// it works on any PageStore and the tree stays usable between calls:
+//
+//  1. Adjacent leaves under the same parent whose entries fit in one page are merged, releasing
+//     the right one. A merge that leaves the parent under-filled rebalances it as Delete would.
+//  2. The leaves are then moved between the pages they occupy, so that walking the leaf chain
+//     visits them in ascending page order. Only the parents' child pointers and the next-leaf
+//     pointers change; internal and overflow pages stay where they are.
+//
+// The leaves don't become a single contiguous run when internal or overflow pages sit between
+// them. Compact gives that layout.
+
+var errDefragInTransaction = errors.New("cannot defragment while a transaction is open")
+
+// FragmentationStats describes how well the leaf chain is packed and laid out on disk.
+type FragmentationStats struct {
+	Leaves  int
+	Entries int
+	// Fill is the average fraction of a leaf's capacity (degree-1 entries) in use.
+	Fill float64
+	// SequentialLinks counts next-leaf pointers to the page right after the current one, and
+	// BackwardLinks those that make a scan seek back in the file.
+	SequentialLinks int
+	BackwardLinks   int
+}
+
+func (s FragmentationStats) String() string {
+	return fmt.Sprintf("%d leaves, %d entries, %.0f%% full, %d/%d links sequential, %d backward",
+		s.Leaves, s.Entries, s.Fill*100, s.SequentialLinks, max(s.Leaves-1, 0), s.BackwardLinks)
+}
+
+// FragmentationStats walks the leaf chain and reports how fragmented it is.
+func (t *BPlusTree) FragmentationStats() (FragmentationStats, error) {
+	var stats FragmentationStats
+	chain, err := t.leafChain()
+	if err != nil {
+		return stats, err
+	}
+	for i, pageID := range chain {
+		page, err := t.readPage(pageID)
+		if err != nil {
+			return stats, err
+		}
+		stats.Entries += int(getNumKeys(page))
+		if i+1 < len(chain) {
+			if next := chain[i+1]; next == pageID+1 {
+				stats.SequentialLinks++
+			} else if next < pageID {
+				stats.BackwardLinks++
+			}
+		}
+	}
+	stats.Leaves = len(chain)
+	stats.Fill = float64(stats.Entries) / float64(stats.Leaves*(t.degree-1))
+	return stats, nil
+}
+
+// DefragmentLeaves merges under-filled neighbouring leaves and reorders the leaf pages so range
+// scans read the file front to back. It returns the fragmentation before and after.
+func (t *BPlusTree) DefragmentLeaves() (before, after FragmentationStats, err error) {
+	if t.txPages != nil {
+		return before, after, errDefragInTransaction
+	}
+	if before, err = t.FragmentationStats(); err != nil {
+		return before, after, err
+	}
+	if err := t.mergeLeaves(); err != nil {
+		return before, after, err
+	}
+	if err := t.reorderLeaves(); err != nil {
+		return before, after, err
+	}
+	after, err = t.FragmentationStats()
+	return before, after, err
+}
+
+// leafChain returns the IDs of the leaf pages in key order.
+func (t *BPlusTree) leafChain() ([]PageID, error) {
+	pageID, err := t.findLeafPage(math.MinInt)
+	if err != nil {
+		return nil, err
+	}
+	var chain []PageID
+	for pageID != -1 {
+		page, err := t.readPage(pageID)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, pageID)
+		pageID = getNextLeafPageID(page)
+	}
+	return chain, nil
+}
+
+// mergeLeaves merges each leaf with its right neighbour for as long as both share a parent and
+// their entries fit in one page.
+func (t *BPlusTree) mergeLeaves() error {
+	pageID, err := t.findLeafPage(math.MinInt)
+	if err != nil {
+		return err
+	}
+	for pageID != -1 {
+		// Re-read the page every time: rebalancing the parent may have rewritten its header.
+		page, err := t.readPage(pageID)
+		if err != nil {
+			return err
+		}
+		nextPageID := getNextLeafPageID(page)
+		if nextPageID == -1 {
+			return nil
+		}
+		nextPage, err := t.readPage(nextPageID)
+		if err != nil {
+			return err
+		}
+		parentPageID := getParentPageID(page)
+		if parentPageID != getParentPageID(nextPage) || int(getNumKeys(page)+getNumKeys(nextPage)) > t.degree-1 {
+			pageID = nextPageID
+			continue
+		}
+
+		parentPage, err := t.readPage(parentPageID)
+		if err != nil {
+			return err
+		}
+		_, children, _ := readInternalEntries(parentPage)
+		separatorIndex := slices.Index(children, pageID)
+		if err := t.mergePages(pageID, page, nextPageID, nextPage, parentPageID, parentPage, separatorIndex); err != nil {
+			return err
+		}
+		if err := t.rebalance(parentPageID, parentPage); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reorderLeaves moves the leaves between the pages they occupy so that the leaf chain runs in
+// ascending page order.
+func (t *BPlusTree) reorderLeaves() error {
+	chain, err := t.leafChain()
+	if err != nil {
+		return err
+	}
+	slots := slices.Clone(chain)
+	slices.Sort(slots)
+	newPageID := make(map[PageID]PageID, len(chain))
+	for i, pageID := range chain {
+		if pageID != slots[i] {
+			newPageID[pageID] = slots[i]
+		}
+	}
+	if len(newPageID) == 0 {
+		return nil
+	}
+	moved := func(pageID PageID) PageID {
+		if to, ok := newPageID[pageID]; ok {
+			return to
+		}
+		return pageID
+	}
+
+	// Point the parents at the new locations first. A leaf's parent doesn't change.
+	parents := make(map[PageID]bool)
+	for _, pageID := range chain {
+		page, err := t.readPage(pageID)
+		if err != nil {
+			return err
+		}
+		if parentPageID := getParentPageID(page); parentPageID != -1 && !parents[parentPageID] {
+			parents[parentPageID] = true
+			parentPage, err := t.readPage(parentPageID)
+			if err != nil {
+				return err
+			}
+			keys, children, counts := readInternalEntries(parentPage)
+			for i, child := range children {
+				children[i] = moved(child)
+			}
+			writeInternalEntries(parentPage, keys, children, counts)
+			if err := t.writePage(parentPageID, parentPage); err != nil {
+				return err
+			}
+		}
+	}
+
+	// The moves form cycles over the leaf pages. Each cycle is applied holding one page in hand.
+	// A leaf that stays put may still need its next-leaf pointer updated.
+	done := make(map[PageID]bool, len(newPageID))
+	for _, start := range chain {
+		if done[start] {
+			continue
+		}
+		page, err := t.readPage(start)
+		if err != nil {
+			return err
+		}
+		if _, ok := newPageID[start]; !ok {
+			if next := getNextLeafPageID(page); next != moved(next) {
+				setNextLeafPageID(page, moved(next))
+				if err := t.writePage(start, page); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		for from := start; ; {
+			to := newPageID[from]
+			done[from] = true
+			var displaced *Page
+			if to != start {
+				if displaced, err = t.readPage(to); err != nil {
+					return err
+				}
+			}
+			if next := getNextLeafPageID(page); next != -1 {
+				setNextLeafPageID(page, moved(next))
+			}
+			if err := t.writePage(to, page); err != nil {
+				return err
+			}
+			if to == start {
+				break
+			}
+			from, page = to, displaced
+		}
+	}
+	return nil
+}
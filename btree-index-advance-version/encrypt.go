@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// =================================================================================================
+// --- encrypt.go --- (Encryption at Rest)
+// =================================================================================================
+
+// A Pager opened with a key encrypts every page with AES-GCM as it is written to the file, and
+// decrypts and authenticates it as it is read back, so the tree above never sees the difference.
+// Each page is stored in a frame that starts with a page header in the clear:
+//
+//	| node type uint8 | (padding) | flags uint8 | (padding) | nonce 12 bytes | (padding 16) |
+//	| encrypted page 4096 bytes | tag 16 bytes |
+//
+// The nonce is random and new for every write. The page ID and the first bytes of the header are
+// authenticated along with the page, so a page copied to another position fails to decrypt, and so
+// does a header that was changed.
+//
+// Page 0 is the meta page, and its frame header repeats the node type and the flags of the meta
+// page, where the pager sets metaFlagEncrypted (see meta.go). The header of every other frame only
+// holds the nonce. An unencrypted file has its meta page as is at the start of the file, with the
+// flag cleared, so the first bytes of a file tell whether it is encrypted before any key is tried.
+// Opening an encrypted file without a key fails with ErrIndexEncrypted, and opening it with the
+// wrong key fails with ErrWrongKey, because the meta page doesn't authenticate. Files written
+// before the meta page existed, whose page 0 is a tree page, are never encrypted.
+//
+// Only the index file is encrypted. The heap file, and the page images in the WAL, are not.
+// Read-ahead works on raw file bytes, so it is off for encrypted files.
+
+const (
+	frameNonceOffset   = 4
+	frameDataOffset    = headerSize
+	encryptedFrameSize = frameDataOffset + PageSize + 16
+)
+
+var (
+	ErrIndexEncrypted    = errors.New("index file is encrypted, open it with its key")
+	ErrIndexNotEncrypted = errors.New("index file is not encrypted")
+	ErrWrongKey          = errors.New("wrong encryption key")
+)
+
+// pageCipher encrypts and decrypts the frames of an encrypted index file.
+type pageCipher struct {
+	aead cipher.AEAD
+}
+
+// newPageCipher returns a cipher for key, which must be 16, 24 or 32 bytes long (AES-128, AES-192
+// or AES-256).
+func newPageCipher(key []byte) (*pageCipher, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &pageCipher{aead: aead}, nil
+}
+
+// frameSize returns the size a page takes up in the file. A nil *pageCipher stores pages as they
+// are.
+func (c *pageCipher) frameSize() int64 {
+	if c == nil {
+		return PageSize
+	}
+	return encryptedFrameSize
+}
+
+// seal returns the frame storing page as page pageID.
+func (c *pageCipher) seal(pageID PageID, page *Page) []byte {
+	if c == nil {
+		return page[:]
+	}
+	frame := make([]byte, frameDataOffset, encryptedFrameSize)
+	if pageID == 0 {
+		meta := *page
+		meta[metaFlagsOffset] |= metaFlagEncrypted
+		page = &meta
+		frame[nodeTypeOffset] = page[nodeTypeOffset]
+		frame[metaFlagsOffset] = page[metaFlagsOffset]
+	}
+	nonce := frame[frameNonceOffset : frameNonceOffset+12]
+	rand.Read(nonce)
+	return c.aead.Seal(frame, nonce, page[:], frameAdditionalData(pageID, frame))
+}
+
+// frameAdditionalData returns what is authenticated along with page pageID, stored in frame: the
+// page ID and the part of the frame header in front of the nonce.
+func frameAdditionalData(pageID PageID, frame []byte) []byte {
+	return binary.LittleEndian.AppendUint64(frame[:frameNonceOffset:frameNonceOffset], uint64(pageID))
+}
+
+// open decrypts the frame of page pageID into page.
+func (c *pageCipher) open(pageID PageID, frame []byte, page *Page) error {
+	nonce := frame[frameNonceOffset : frameNonceOffset+12]
+	_, err := c.aead.Open(page[:0], nonce, frame[frameDataOffset:], frameAdditionalData(pageID, frame))
+	if err != nil {
+		return fmt.Errorf("%w: page %d fails authentication", ErrCorruptPage, pageID)
+	}
+	return nil
+}
+
+// NewEncryptedPager opens (or creates) an index file whose pages are encrypted with key (see
+// newPageCipher for its size).
+func NewEncryptedPager(path string, key []byte) (*Pager, error) {
+	c, err := newPageCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return openPager(path, c, false, nil)
+}
+
+// checkEncryption makes sure the file matches the way it is opened: an unencrypted file must not
+// be opened with a key, an encrypted one must be opened with its key. An empty file can be opened
+// either way. Whether the file is encrypted is read from the flags of the meta page, which are in
+// the clear either way. file holds fileSize bytes, and c is the cipher the file is opened with.
+func checkEncryption(file io.ReaderAt, fileSize int64, c *pageCipher) error {
+	if fileSize == 0 {
+		return nil
+	}
+	var header [frameNonceOffset]byte
+	if _, err := file.ReadAt(header[:], 0); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	encrypted := header[nodeTypeOffset] == NodeTypeMeta && header[metaFlagsOffset]&metaFlagEncrypted != 0
+	switch {
+	case c == nil && encrypted:
+		return ErrIndexEncrypted
+	case c != nil && !encrypted:
+		return ErrIndexNotEncrypted
+	case c != nil:
+		if err := c.readFrame(file, 0, new(Page)); errors.Is(err, ErrCorruptPage) {
+			return ErrWrongKey
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readFrame reads page pageID from file into pageData, decrypting it if c isn't nil.
+func (c *pageCipher) readFrame(file io.ReaderAt, pageID PageID, pageData *Page) error {
+	if c == nil {
+		return readFullFrame(file, pageID, pageData[:])
+	}
+	frame := make([]byte, encryptedFrameSize)
+	if err := readFullFrame(file, pageID, frame); err != nil {
+		return err
+	}
+	return c.open(pageID, frame, pageData)
+}
+
+// readFullFrame reads the frame of page pageID, len(frame) bytes, from file. A frame that starts
+// at the end of the file is a page allocated but not written yet, and fails with
+// ErrPageOutOfRange. One the file ends in the middle of fails with ErrCorruptPage, however the
+// reader reports the short read.
+func readFullFrame(file io.ReaderAt, pageID PageID, frame []byte) error {
+	n, err := file.ReadAt(frame, int64(pageID)*int64(len(frame)))
+	switch {
+	case n == len(frame):
+		// ReadAt may return io.EOF with the last frame of the file.
+		return nil
+	case n == 0 && errors.Is(err, io.EOF):
+		return fmt.Errorf("%w: page %d was allocated but never written", ErrPageOutOfRange, pageID)
+	case err == nil || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF):
+		return fmt.Errorf("%w: page %d is cut short: read %d of %d bytes", ErrCorruptPage, pageID, n, len(frame))
+	}
+	return err
+}
+
+// writeFrame writes page pageID to file, encrypting it if c isn't nil.
+func (c *pageCipher) writeFrame(file io.WriterAt, pageID PageID, pageData *Page) error {
+	_, err := file.WriteAt(c.seal(pageID, pageData), int64(pageID)*c.frameSize())
+	return err
+}
@@ -0,0 +1,498 @@
+package main
+
+import (
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+)
+
+// =================================================================================================
+// --- extsort.go --- (External Merge Sort)
+// =================================================================================================
+
+// Building a tree bottom-up needs its entries in key order, and the parallel build sorts them in
+// memory, which limits it to data whose keys fit in RAM. An external merge sort, the way databases
+// sort anything larger than their work memory, only ever holds a bounded part of it:
+//
+//	run generation:  pairs ──▶ sort RunPairs at a time ──▶ run 0 | run 1 | run 2 | ... (pages of a temp file)
+//	merge passes:    FanIn runs at a time ──▶ one longer run, until at most FanIn are left
+//	final merge:     the last runs ──▶ SortedPairs ──▶ BulkLoad
+//
+// The runs live in pages of an anonymous index file (see NewTempPager), 254 pairs to a page. A
+// merge reads every run it merges one page at a time and picks the smallest key among their heads
+// with a heap, so it needs a page of memory per run, and each pass reads and writes every pair
+// once. With the defaults, 1M pairs a run and 64 runs a merge, 64M pairs, or 1GB, sort with one
+// read and one write to disk, and the last merge feeds BulkLoad directly instead of writing the
+// sorted output. The temp file only grows: the runs of an earlier pass aren't reused.
+//
+//	sorter, err := NewExternalSorter(ExternalSortOptions{})
+//	for ... { err = sorter.Add(KV{key, offset}) }
+//	pairs, err := sorter.Sort()
+//	err = tree.BulkLoad(pairs)
+//
+// BuildIndexWith does that with BuildOptions.ExternalSort. The sort is stable: pairs with the same
+// key come out in the order they were added.
+
+const (
+	// sortPairSize is the size of a pair in a run page: the key and the value, 8 bytes each.
+	sortPairSize = 16
+	// sortPairsPerPage is the number of pairs in a full run page, after the page header.
+	sortPairsPerPage = (PageSize - headerSize) / sortPairSize
+	// defaultSortRunPairs makes runs of 16MB.
+	defaultSortRunPairs = 1 << 20
+	defaultSortFanIn    = 64
+)
+
+var (
+	errSortDone          = errors.New("external sorter has already sorted")
+	errBulkLoadNotEmpty  = errors.New("a bulk load needs an empty tree")
+	errSortedPairsShort  = errors.New("sorted pairs ended before their length")
+	errSortedPairsUnsort = errors.New("bulk loaded pairs are not in key order")
+)
+
+// ExternalSortOptions configures an ExternalSorter.
+type ExternalSortOptions struct {
+	// RunPairs is the number of pairs sorted in memory at a time, the length of a run; 0 means
+	// 1M, or 16MB.
+	RunPairs int
+	// FanIn is the most runs merged at once, each through a page of memory; 0 means 64. It must
+	// be at least 2.
+	FanIn int
+	// Dir is the directory of the temporary file holding the runs; "" means os.TempDir().
+	Dir string
+}
+
+// ExternalSortStats describes the work of an ExternalSorter.
+type ExternalSortStats struct {
+	Pairs        int
+	Runs         int   // runs generated from the pairs
+	MergePasses  int   // passes that wrote longer runs, not counting the final merge
+	PagesWritten int64 // run pages written, over every pass
+}
+
+func (s ExternalSortStats) String() string {
+	return fmt.Sprintf("%d pairs, %d runs, %d merge passes, %d pages written", s.Pairs, s.Runs, s.MergePasses, s.PagesWritten)
+}
+
+// ExternalSorter sorts KV pairs by key using a bounded amount of memory. Add the pairs, then call
+// Sort once and read them back in order, and Close the sorter when done.
+type ExternalSorter struct {
+	opts   ExternalSortOptions
+	pager  *Pager
+	buffer []KV      // the pairs added since the last run was written
+	runs   []sortRun // the runs of the current pass, in the order their pairs were added
+	sorted bool
+	stats  ExternalSortStats
+}
+
+// sortRun is a sorted run of n pairs on consecutive pages, from page first on.
+type sortRun struct {
+	first PageID
+	n     int
+}
+
+// NewExternalSorter returns an empty sorter, with its runs in a new temporary file.
+func NewExternalSorter(opts ExternalSortOptions) (*ExternalSorter, error) {
+	if opts.RunPairs == 0 {
+		opts.RunPairs = defaultSortRunPairs
+	}
+	if opts.FanIn == 0 {
+		opts.FanIn = defaultSortFanIn
+	}
+	if opts.RunPairs < 1 || opts.FanIn < 2 {
+		return nil, fmt.Errorf("external sort needs at least 1 pair per run and a fan-in of 2, got %d and %d", opts.RunPairs, opts.FanIn)
+	}
+	pager, err := NewTempPager(opts.Dir)
+	if err != nil {
+		return nil, err
+	}
+	return &ExternalSorter{opts: opts, pager: pager}, nil
+}
+
+// Add adds a pair to sort. Once RunPairs pairs have piled up, they are sorted and written out as a
+// run.
+func (s *ExternalSorter) Add(kv KV) error {
+	if s.sorted {
+		return errSortDone
+	}
+	if s.buffer == nil {
+		s.buffer = make([]KV, 0, s.opts.RunPairs)
+	}
+	s.buffer = append(s.buffer, kv)
+	s.stats.Pairs++
+	if len(s.buffer) == s.opts.RunPairs {
+		return s.flushRun()
+	}
+	return nil
+}
+
+// flushRun sorts the buffered pairs and writes them as a run.
+func (s *ExternalSorter) flushRun() error {
+	if len(s.buffer) == 0 {
+		return nil
+	}
+	slices.SortStableFunc(s.buffer, compareKV)
+	w := s.newRunWriter()
+	for _, kv := range s.buffer {
+		if err := w.add(kv); err != nil {
+			return err
+		}
+	}
+	run, err := w.finish()
+	if err != nil {
+		return err
+	}
+	s.runs = append(s.runs, run)
+	s.stats.Runs++
+	s.buffer = s.buffer[:0]
+	return nil
+}
+
+// Sort writes out the last run and merges the runs until at most FanIn are left, then returns
+// the pairs in key order, merged from those as they are read.
+func (s *ExternalSorter) Sort() (*SortedPairs, error) {
+	if s.sorted {
+		return nil, errSortDone
+	}
+	s.sorted = true
+	if err := s.flushRun(); err != nil {
+		return nil, err
+	}
+	s.buffer = nil
+	for len(s.runs) > s.opts.FanIn {
+		// Merging consecutive runs keeps the sort stable.
+		var next []sortRun
+		for i := 0; i < len(s.runs); i += s.opts.FanIn {
+			group := s.runs[i:min(i+s.opts.FanIn, len(s.runs))]
+			if len(group) == 1 {
+				next = append(next, group[0])
+				continue
+			}
+			merged, err := s.mergeRuns(group)
+			if err != nil {
+				return nil, err
+			}
+			next = append(next, merged)
+		}
+		s.runs = next
+		s.stats.MergePasses++
+	}
+	return s.newSortedPairs(s.runs)
+}
+
+// mergeRuns merges runs into a new one.
+func (s *ExternalSorter) mergeRuns(runs []sortRun) (sortRun, error) {
+	pairs, err := s.newSortedPairs(runs)
+	if err != nil {
+		return sortRun{}, err
+	}
+	w := s.newRunWriter()
+	for pairs.Next() {
+		if err := w.add(pairs.Pair()); err != nil {
+			return sortRun{}, err
+		}
+	}
+	if err := pairs.Err(); err != nil {
+		return sortRun{}, err
+	}
+	return w.finish()
+}
+
+// Stats returns the work done so far.
+func (s *ExternalSorter) Stats() ExternalSortStats {
+	return s.stats
+}
+
+// Close deletes the sorter's temporary file. The SortedPairs returned by Sort can't be read after.
+func (s *ExternalSorter) Close() error {
+	return s.pager.Close()
+}
+
+// runWriter writes a run, a page at a time.
+type runWriter struct {
+	sorter *ExternalSorter
+	run    sortRun
+	page   *Page
+	count  int // pairs on page
+}
+
+func (s *ExternalSorter) newRunWriter() *runWriter {
+	return &runWriter{sorter: s, run: sortRun{first: -1}, page: new(Page)}
+}
+
+func (w *runWriter) add(kv KV) error {
+	offset := headerSize + w.count*sortPairSize
+	binary.LittleEndian.PutUint64(w.page[offset:], uint64(kv.Key))
+	binary.LittleEndian.PutUint64(w.page[offset+8:], uint64(kv.Value))
+	w.count++
+	w.run.n++
+	if w.count == sortPairsPerPage {
+		return w.flush()
+	}
+	return nil
+}
+
+func (w *runWriter) flush() error {
+	if w.count == 0 {
+		return nil
+	}
+	setNumKeys(w.page, uint16(w.count))
+	// The pages of a run are allocated one after another, and nothing else allocates meanwhile.
+	pageID := w.sorter.pager.AllocatePage()
+	if w.run.first == -1 {
+		w.run.first = pageID
+	}
+	if err := w.sorter.pager.WritePage(pageID, w.page); err != nil {
+		return err
+	}
+	w.sorter.stats.PagesWritten++
+	w.page, w.count = new(Page), 0
+	return nil
+}
+
+func (w *runWriter) finish() (sortRun, error) {
+	return w.run, w.flush()
+}
+
+// runReader reads a run back, a page at a time.
+type runReader struct {
+	pager  *Pager
+	run    sortRun
+	pageID PageID
+	page   *Page
+	index  int // of the next pair on page
+	read   int // pairs read so far
+}
+
+// next returns the next pair of the run, and io.EOF after the last one.
+func (r *runReader) next() (KV, error) {
+	if r.read == r.run.n {
+		return KV{}, io.EOF
+	}
+	if r.page == nil || r.index == int(getNumKeys(r.page)) {
+		// Each page of the run is read into the buffer of the one before.
+		buf := r.page
+		if buf == nil {
+			buf = new(Page)
+		}
+		page, err := r.pager.ReadPage(r.pageID, buf)
+		if err != nil {
+			return KV{}, err
+		}
+		r.pageID++
+		r.page, r.index = page, 0
+	}
+	offset := headerSize + r.index*sortPairSize
+	kv := KV{
+		Key:   int(int64(binary.LittleEndian.Uint64(r.page[offset:]))),
+		Value: int64(binary.LittleEndian.Uint64(r.page[offset+8:])),
+	}
+	r.index++
+	r.read++
+	return kv, nil
+}
+
+// mergeHead is the next pair of a run being merged.
+type mergeHead struct {
+	kv  KV
+	run int // index of the run, which breaks ties so the merge is stable
+}
+
+// mergeHeap orders the heads of the runs being merged by key.
+type mergeHeap []mergeHead
+
+func (h mergeHeap) Len() int { return len(h) }
+func (h mergeHeap) Less(i, j int) bool {
+	if h[i].kv.Key != h[j].kv.Key {
+		return h[i].kv.Key < h[j].kv.Key
+	}
+	return h[i].run < h[j].run
+}
+func (h mergeHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *mergeHeap) Push(x any)   { *h = append(*h, x.(mergeHead)) }
+func (h *mergeHeap) Pop() any {
+	old := *h
+	head := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return head
+}
+
+// SortedPairs iterates over pairs in key order, merging sorted runs as it goes. Like a Cursor, call
+// Next before each Pair, and check Err once Next returns false.
+type SortedPairs struct {
+	readers []*runReader
+	heads   mergeHeap
+	n       int
+	current KV
+	err     error
+}
+
+func (s *ExternalSorter) newSortedPairs(runs []sortRun) (*SortedPairs, error) {
+	p := &SortedPairs{}
+	for _, run := range runs {
+		r := &runReader{pager: s.pager, run: run, pageID: run.first}
+		kv, err := r.next()
+		if err == io.EOF {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		p.heads = append(p.heads, mergeHead{kv, len(p.readers)})
+		p.readers = append(p.readers, r)
+		p.n += run.n
+	}
+	heap.Init(&p.heads)
+	return p, nil
+}
+
+// Len returns the number of pairs, read or not.
+func (p *SortedPairs) Len() int {
+	return p.n
+}
+
+// Next advances to the next pair and reports whether there is one.
+func (p *SortedPairs) Next() bool {
+	if p.err != nil || len(p.heads) == 0 {
+		return false
+	}
+	head := p.heads[0]
+	p.current = head.kv
+	kv, err := p.readers[head.run].next()
+	switch {
+	case err == io.EOF:
+		heap.Pop(&p.heads)
+	case err != nil:
+		p.err = err
+		return false
+	default:
+		p.heads[0].kv = kv
+		heap.Fix(&p.heads, 0)
+	}
+	return true
+}
+
+// Pair returns the current pair.
+func (p *SortedPairs) Pair() KV {
+	return p.current
+}
+
+// Err returns the error that stopped Next, if any.
+func (p *SortedPairs) Err() error {
+	return p.err
+}
+
+// BulkLoad builds the tree bottom-up from pairs, which must be in key order, like the parallel
+// build does from pairs in memory: pages are filled to defaultCompactFillFactor, and each is
+// written once. The tree must be empty. Only the smallest key of every leaf is kept in memory. A
+// duplicate key is reported as a *ConstraintViolation and leaves the tree empty.
+func (t *BPlusTree) BulkLoad(pairs *SortedPairs) error {
+	violations, err := t.bulkLoadSorted(pairs)
+	if err != nil {
+		return err
+	}
+	if len(violations) > 0 {
+		return violations[0]
+	}
+	return nil
+}
+
+// bulkLoadSorted implements BulkLoad, returning every duplicate key.
+func (t *BPlusTree) bulkLoadSorted(pairs *SortedPairs) (ConstraintViolations, error) {
+	n, err := t.Len()
+	if err != nil {
+		return nil, err
+	}
+	if n > 0 {
+		return nil, errBulkLoadNotEmpty
+	}
+	if pairs.Len() == 0 {
+		return nil, nil
+	}
+
+	plan := t.planBulkLoad(pairs.Len())
+	parentIDs := plan.leafParents()
+	lowKeys := make([]int, len(plan.levels[0]))
+	var violations ConstraintViolations
+	var prev, firstOfKey KV
+	for i, size := range plan.levels[0] {
+		entries := make([]KV, 0, size)
+		for range size {
+			if !pairs.Next() {
+				if err := pairs.Err(); err != nil {
+					return nil, err
+				}
+				return nil, errSortedPairsShort
+			}
+			kv := pairs.Pair()
+			switch {
+			case i == 0 && len(entries) == 0, kv.Key > prev.Key:
+				firstOfKey = kv
+			case kv.Key == prev.Key:
+				violations = append(violations, &ConstraintViolation{Index: t.Name(), Key: kv.Key, Existing: firstOfKey.Value, Rejected: kv.Value})
+			default:
+				return nil, errSortedPairsUnsort
+			}
+			prev = kv
+			entries = append(entries, kv)
+		}
+		lowKeys[i] = entries[0].Key
+		// After a duplicate, the rest is only read to find the others.
+		if len(violations) > 0 {
+			continue
+		}
+		if err := t.writePage(plan.pageIDs[0][i], plan.leaf(i, entries, parentIDs[i])); err != nil {
+			return nil, err
+		}
+		if t.bloom != nil {
+			for _, kv := range entries {
+				t.bloom.Add(kv.Key)
+			}
+		}
+	}
+	if len(violations) > 0 {
+		// The first leaf is the root leaf of the empty tree: empty it again.
+		empty := bulkPlan{levels: [][]int{{0}}, pageIDs: [][]PageID{{t.rootPageID}}}
+		return violations, t.writePage(t.rootPageID, empty.leaf(0, nil, -1))
+	}
+	return nil, t.writeInternalLevels(plan, lowKeys)
+}
+
+// buildExternal implements BuildIndexWith for opts.ExternalSort != nil.
+func (t *BPlusTree) buildExternal(source DataSource, opts BuildOptions) (int, error) {
+	sorter, err := NewExternalSorter(*opts.ExternalSort)
+	if err != nil {
+		return 0, err
+	}
+	defer sorter.Close()
+	for {
+		key, offset, err := source.NextRecord()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		if err := sorter.Add(KV{Key: key, Value: offset}); err != nil {
+			return 0, err
+		}
+	}
+	pairs, err := sorter.Sort()
+	if err != nil {
+		return 0, err
+	}
+	violations, err := t.bulkLoadSorted(pairs)
+	if err != nil {
+		return 0, err
+	}
+	if len(violations) > 0 {
+		if opts.CollectViolations {
+			return 0, violations
+		}
+		return 0, violations[0]
+	}
+	return pairs.Len(), nil
+}
@@ -0,0 +1,32 @@
+package main
+
+// =================================================================================================
+// --- fanout.go --- (Separate Degree for Internal Pages)
+// =================================================================================================
+
+// A tree has one degree by default, for leaves and internal pages alike. The leaves hold the
+// values, so a tree of large inline values needs a small degree (see DegreeForValueSize), while an
+// internal cell is only a key, a child pointer and an entry count, whatever the values. With a
+// single degree the internal pages are then as narrow as the leaves, and the tree is taller than it
+// has to be. NewBPlusTreeWithDegrees gives internal pages a degree of their own:
+//
+//	tree := NewBPlusTreeWithDegrees(pager, DegreeForValueSize(200), MaxInternalDegree)
+//
+// At degree 19, a million 200-byte values take about 77,000 leaves. Internal pages of degree 19
+// need five levels above them, and of degree 185 only three, so every lookup reads two pages less.
+// The internal degree is recorded in the index header, which makes the file format version 2
+// (see meta.go); a tree with a single degree still writes version 1. Internal cells take as much
+// room as leaf cells with 8-byte values, so MaxInternalDegree is MaxDegree, and trees with small
+// values gain nothing.
+
+// MaxInternalDegree is the largest internal degree a tree can have: a full internal page of
+// internalCellSize cells fills a page, with room left for a fence.
+const MaxInternalDegree = (PageSize-headerSize-fenceSize)/(cellPointerSize+internalCellSize) + 1
+
+// maxKeysOf returns the number of keys a page can hold, depending on its type.
+func (t *BPlusTree) maxKeysOf(page *Page) int {
+	if isLeaf(page) {
+		return t.degree - 1
+	}
+	return t.InternalDegree() - 1
+}
@@ -0,0 +1,88 @@
+package main
+
+import "math"
+
+// =================================================================================================
+// --- finger.go --- (Finger Search)
+// =================================================================================================
+
+// A lookup normally descends from the root, reading one page per level. Lookups that come in
+// sorted or clustered order keep landing in the same leaf, or in the one right after it, so a
+// Finger remembers the leaf of its last lookup together with the range of keys that belong in it:
+//
+//	key inside the leaf's range:         read only that leaf
+//	key just past it, in the next leaf:  follow the next-leaf pointer, two reads
+//	anywhere else:                       descend from the root, as Search does
+//
+// A sorted sequence of lookups then costs about one page read each instead of one per level.
+// Like a Cursor, a Finger must not be used across modifications of the tree: a split or merge can
+// move keys out of the leaf it remembers.
+
+// Finger performs lookups that start from the leaf of the previous lookup.
+type Finger struct {
+	tree   *BPlusTree
+	leaf   PageID // -1 until the first lookup
+	bounds keyRange
+	buf    *Page // buffer the remembered leaf and the one after it are read into
+}
+
+// NewFinger returns a finger for lookups in the tree.
+func (t *BPlusTree) NewFinger() *Finger {
+	return &Finger{tree: t, leaf: -1, buf: new(Page)}
+}
+
+// Search is BPlusTree.Search, starting from the leaf of the previous lookup when key is in or
+// right after that leaf.
+func (f *Finger) Search(key int) (int64, bool, error) {
+	page, err := f.findLeaf(key)
+	if err != nil {
+		return 0, false, err
+	}
+	numKeys := int(getNumKeys(page))
+	for i := 0; i < numKeys; i++ {
+		if keyAt(page, i) != key {
+			continue
+		}
+		if inline, _, _ := leafValueAt(page, i); len(inline) != 8 {
+			return 0, false, errNotInt64Value
+		}
+		return valueAt(page, i), true, nil
+	}
+	return 0, false, nil
+}
+
+// findLeaf returns the leaf key belongs in and moves the finger there.
+func (f *Finger) findLeaf(key int) (*Page, error) {
+	t := f.tree
+	if f.leaf != -1 && f.bounds.contains(key) {
+		return t.readPageInto(f.leaf, f.buf)
+	}
+	if f.leaf != -1 && f.bounds.hasHigh && key >= f.bounds.high {
+		// The next leaf starts at this leaf's upper bound. If key is no larger than its last key,
+		// key belongs there. The separator that ends the next leaf's range is in a parent page,
+		// so the range is taken to end right after its last key: no key in between is in the
+		// tree, so looking one up in this leaf gives the same answer.
+		page, err := t.readPageInto(f.leaf, f.buf)
+		if err != nil {
+			return nil, err
+		}
+		if next := getNextLeafPageID(page); next != -1 {
+			nextPage, err := t.readPageInto(next, f.buf)
+			if err != nil {
+				return nil, err
+			}
+			if numKeys := int(getNumKeys(nextPage)); numKeys > 0 && key <= keyAt(nextPage, numKeys-1) {
+				last := keyAt(nextPage, numKeys-1)
+				f.leaf = next
+				f.bounds = keyRange{low: f.bounds.high, hasLow: true, high: last + 1, hasHigh: last < math.MaxInt}
+				return nextPage, nil
+			}
+		}
+	}
+	leaf, page, bounds, err := t.findLeafPageBounded(key)
+	if err != nil {
+		return nil, err
+	}
+	f.leaf, f.bounds = leaf, bounds
+	return page, nil
+}
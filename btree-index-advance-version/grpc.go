@@ -0,0 +1,361 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// =================================================================================================
+// --- grpc.go --- (gRPC Service)
+// =================================================================================================
+
+// The Index service of index.proto, served next to the HTTP API by `go run . serve -grpc :9090`,
+// so that clients generated for any language can use the DB. Instead of generated code and the
+// grpc package, this file speaks the gRPC protocol itself:
+//
+//   - gRPC runs over HTTP/2 without TLS ("h2c"), which net/http serves since Go 1.24.
+//   - A call is a POST to /btree.Index/<method>. Every message in either direction is framed as
+//     | compressed flag uint8 | length uint32 big-endian | protobuf message |.
+//   - The outcome is sent in the grpc-status and grpc-message trailers.
+//   - The messages are small, so they are encoded and decoded by hand, field by field.
+//
+// RangeScan streams its rows from a cursor in batches of rangeScanBatchSize, each read in a
+// transaction of its own, so a slow client doesn't hold the DB's lock between batches. A scan
+// therefore sees the writes committed between two batches, as a paginated scan would.
+//
+// TestGRPCOverHTTP2 calls the service with net/http's HTTP/2 client. No client generated from
+// index.proto is tested against it.
+
+const rangeScanBatchSize = 256
+
+// gRPC status codes.
+const (
+	grpcOK                = 0
+	grpcInvalidArgument   = 3
+	grpcNotFound          = 5
+	grpcResourceExhausted = 8
+	grpcUnimplemented     = 12
+	grpcInternal          = 13
+)
+
+// grpcError is an error with a gRPC status code.
+type grpcError struct {
+	code int
+	err  error
+}
+
+func (e *grpcError) Error() string { return e.err.Error() }
+func (e *grpcError) Unwrap() error { return e.err }
+
+// grpcStatus returns the status code and message to report for err.
+func grpcStatus(err error) (int, string) {
+	var ge *grpcError
+	switch {
+	case err == nil:
+		return grpcOK, ""
+	case errors.As(err, &ge):
+		return ge.code, err.Error()
+	case errors.Is(err, ErrKeyNotFound):
+		return grpcNotFound, err.Error()
+	case errors.Is(err, errRowHasNewline), errors.Is(err, errRowTooLarge):
+		return grpcInvalidArgument, err.Error()
+	default:
+		return grpcInternal, err.Error()
+	}
+}
+
+// --- Protobuf encoding ---
+
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var errBadProto = errors.New("malformed protobuf message")
+
+func appendVarintField(buf []byte, field int, v uint64) []byte {
+	if v == 0 {
+		return buf // proto3 leaves out fields with the default value
+	}
+	buf = binary.AppendUvarint(buf, uint64(field<<3|wireVarint))
+	return binary.AppendUvarint(buf, v)
+}
+
+func appendBytesField(buf []byte, field int, v []byte) []byte {
+	if len(v) == 0 {
+		return buf
+	}
+	buf = binary.AppendUvarint(buf, uint64(field<<3|wireBytes))
+	buf = binary.AppendUvarint(buf, uint64(len(v)))
+	return append(buf, v...)
+}
+
+// protoField is a field of a decoded message. varint holds the value of varint fields, and bytes
+// that of length-delimited ones.
+type protoField struct {
+	number int
+	varint uint64
+	bytes  []byte
+}
+
+// decodeProto calls fn for each varint and length-delimited field of a message, skipping fields
+// of other wire types.
+func decodeProto(buf []byte, fn func(f protoField)) error {
+	for len(buf) > 0 {
+		tag, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return errBadProto
+		}
+		buf = buf[n:]
+		f := protoField{number: int(tag >> 3)}
+		switch tag & 7 {
+		case wireVarint:
+			f.varint, n = binary.Uvarint(buf)
+			if n <= 0 {
+				return errBadProto
+			}
+			buf = buf[n:]
+		case wireBytes:
+			length, n := binary.Uvarint(buf)
+			if n <= 0 || uint64(len(buf)-n) < length {
+				return errBadProto
+			}
+			f.bytes = buf[n : n+int(length)]
+			buf = buf[n+int(length):]
+		case wireFixed64:
+			if len(buf) < 8 {
+				return errBadProto
+			}
+			buf = buf[8:]
+			continue
+		case wireFixed32:
+			if len(buf) < 4 {
+				return errBadProto
+			}
+			buf = buf[4:]
+			continue
+		default:
+			return errBadProto
+		}
+		fn(f)
+	}
+	return nil
+}
+
+// keyRequest is a GetRequest or DeleteRequest.
+type keyRequest struct {
+	key int
+}
+
+func (m *keyRequest) unmarshal(buf []byte) error {
+	return decodeProto(buf, func(f protoField) {
+		if f.number == 1 {
+			m.key = int(int64(f.varint))
+		}
+	})
+}
+
+type putRequest struct {
+	key int
+	row []byte
+}
+
+func (m *putRequest) unmarshal(buf []byte) error {
+	return decodeProto(buf, func(f protoField) {
+		switch f.number {
+		case 1:
+			m.key = int(int64(f.varint))
+		case 2:
+			m.row = f.bytes
+		}
+	})
+}
+
+type rangeScanRequest struct {
+	start, end int
+}
+
+func (m *rangeScanRequest) unmarshal(buf []byte) error {
+	return decodeProto(buf, func(f protoField) {
+		switch f.number {
+		case 1:
+			m.start = int(int64(f.varint))
+		case 2:
+			m.end = int(int64(f.varint))
+		}
+	})
+}
+
+func marshalRow(key int, row string) []byte {
+	buf := appendVarintField(nil, 1, uint64(key))
+	return appendBytesField(buf, 2, []byte(row))
+}
+
+func marshalPutResponse(created bool) []byte {
+	if created {
+		return appendVarintField(nil, 1, 1)
+	}
+	return nil
+}
+
+// --- Framing and calls ---
+
+// readGRPCMessage reads the single request message of a unary or server-streaming call.
+func readGRPCMessage(r io.Reader) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, &grpcError{grpcInvalidArgument, fmt.Errorf("reading message: %w", err)}
+	}
+	if prefix[0] != 0 {
+		return nil, &grpcError{grpcUnimplemented, errors.New("compressed messages are not supported")}
+	}
+	length := binary.BigEndian.Uint32(prefix[1:])
+	if length > maxRowSize+64 {
+		return nil, &grpcError{grpcResourceExhausted, fmt.Errorf("message of %d bytes is too large", length)}
+	}
+	message := make([]byte, length)
+	if _, err := io.ReadFull(r, message); err != nil {
+		return nil, &grpcError{grpcInvalidArgument, fmt.Errorf("reading message: %w", err)}
+	}
+	return message, nil
+}
+
+// writeGRPCMessage writes a framed response message and flushes it to the client.
+func writeGRPCMessage(w http.ResponseWriter, message []byte) error {
+	frame := make([]byte, 5, 5+len(message))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(message)))
+	if _, err := w.Write(append(frame, message...)); err != nil {
+		return err
+	}
+	http.NewResponseController(w).Flush()
+	return nil
+}
+
+// grpcServer handles the gRPC calls for a DB.
+type grpcServer struct {
+	db *DB
+}
+
+func newGRPCHandler(db *DB) http.Handler {
+	return &grpcServer{db: db}
+}
+
+func (s *grpcServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "gRPC requests only", http.StatusUnsupportedMediaType)
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	w.WriteHeader(http.StatusOK)
+
+	message, err := readGRPCMessage(r.Body)
+	if err == nil {
+		switch r.URL.Path {
+		case "/btree.Index/Get":
+			err = s.get(w, message)
+		case "/btree.Index/Put":
+			err = s.put(w, message)
+		case "/btree.Index/Delete":
+			err = s.delete(w, message)
+		case "/btree.Index/RangeScan":
+			err = s.rangeScan(w, r, message)
+		default:
+			err = &grpcError{grpcUnimplemented, fmt.Errorf("unknown method %s", r.URL.Path)}
+		}
+	}
+	code, text := grpcStatus(err)
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(code))
+	if text != "" {
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", text)
+	}
+}
+
+func (s *grpcServer) get(w http.ResponseWriter, message []byte) error {
+	var req keyRequest
+	if err := req.unmarshal(message); err != nil {
+		return &grpcError{grpcInvalidArgument, err}
+	}
+	row, found, err := s.db.Get(req.key)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("%w: %d", ErrKeyNotFound, req.key)
+	}
+	return writeGRPCMessage(w, marshalRow(req.key, row))
+}
+
+func (s *grpcServer) put(w http.ResponseWriter, message []byte) error {
+	var req putRequest
+	if err := req.unmarshal(message); err != nil {
+		return &grpcError{grpcInvalidArgument, err}
+	}
+	created, err := putRow(s.db, req.key, req.row)
+	if err != nil {
+		return err
+	}
+	return writeGRPCMessage(w, marshalPutResponse(created))
+}
+
+func (s *grpcServer) delete(w http.ResponseWriter, message []byte) error {
+	var req keyRequest
+	if err := req.unmarshal(message); err != nil {
+		return &grpcError{grpcInvalidArgument, err}
+	}
+	deleted, err := deleteRow(s.db, req.key)
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return fmt.Errorf("%w: %d", ErrKeyNotFound, req.key)
+	}
+	return writeGRPCMessage(w, nil)
+}
+
+var errBatchFull = errors.New("batch full")
+
+func (s *grpcServer) rangeScan(w http.ResponseWriter, r *http.Request, message []byte) error {
+	var req rangeScanRequest
+	if err := req.unmarshal(message); err != nil {
+		return &grpcError{grpcInvalidArgument, err}
+	}
+	start := req.start
+	for start <= req.end {
+		if err := r.Context().Err(); err != nil {
+			return err
+		}
+		var batch [][]byte
+		lastKey := 0
+		tx := s.db.Begin()
+		err := tx.Scan(start, req.end, func(key int, row string) error {
+			batch = append(batch, marshalRow(key, row))
+			lastKey = key
+			if len(batch) == rangeScanBatchSize {
+				return errBatchFull
+			}
+			return nil
+		})
+		tx.Rollback()
+		if err != nil && err != errBatchFull {
+			return err
+		}
+		for _, message := range batch {
+			if err := writeGRPCMessage(w, message); err != nil {
+				return err
+			}
+		}
+		if err == nil || lastKey == math.MaxInt {
+			break
+		}
+		start = lastKey + 1
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// grpcCall makes a call to the gRPC service at url over HTTP/2 without TLS, as a gRPC client
+// does, and returns the response messages and the grpc-status trailer.
+func grpcCall(t *testing.T, client *http.Client, url, method string, request []byte) ([][]byte, int) {
+	t.Helper()
+	frame := make([]byte, 5, 5+len(request))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(request)))
+	req, err := http.NewRequest(http.MethodPost, url+"/btree.Index/"+method, bytes.NewReader(append(frame, request...)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Fatalf("%s: response over %s, want HTTP/2", method, resp.Proto)
+	}
+	var messages [][]byte
+	for {
+		var prefix [5]byte
+		if _, err := io.ReadFull(resp.Body, prefix[:]); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("%s: reading a message: %v", method, err)
+		}
+		message := make([]byte, binary.BigEndian.Uint32(prefix[1:]))
+		if _, err := io.ReadFull(resp.Body, message); err != nil {
+			t.Fatalf("%s: reading a message: %v", method, err)
+		}
+		messages = append(messages, message)
+	}
+	code, err := strconv.Atoi(resp.Trailer.Get("Grpc-Status"))
+	if err != nil {
+		t.Fatalf("%s: grpc-status trailer %q: %v", method, resp.Trailer.Get("Grpc-Status"), err)
+	}
+	return messages, code
+}
+
+// TestGRPCOverHTTP2 calls every method of the Index service through net/http's HTTP/2 client,
+// which checks the framing and the trailers on a real HTTP/2 connection. The messages are encoded
+// with the same code the server uses, so this doesn't show that clients generated from index.proto
+// interoperate.
+func TestGRPCOverHTTP2(t *testing.T) {
+	dir := t.TempDir()
+	db, err := OpenDB(filepath.Join(dir, "grpc.idx"), filepath.Join(dir, "grpc.dat"), filepath.Join(dir, "grpc.wal"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	server := httptest.NewUnstartedServer(newGRPCHandler(db))
+	server.Config.Protocols = new(http.Protocols)
+	server.Config.Protocols.SetUnencryptedHTTP2(true)
+	server.Start()
+	defer server.Close()
+	transport := &http.Transport{Protocols: new(http.Protocols)}
+	transport.Protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: transport}
+
+	for key := 1; key <= 3; key++ {
+		messages, code := grpcCall(t, client, server.URL, "Put", marshalRow(key, "row "+strconv.Itoa(key)))
+		if code != grpcOK || len(messages) != 1 || !bytes.Equal(messages[0], marshalPutResponse(true)) {
+			t.Fatalf("Put(%d) = %q, status %d", key, messages, code)
+		}
+	}
+	if messages, code := grpcCall(t, client, server.URL, "Get", appendVarintField(nil, 1, 2)); code != grpcOK ||
+		len(messages) != 1 || !bytes.Equal(messages[0], marshalRow(2, "row 2")) {
+		t.Fatalf("Get(2) = %q, status %d", messages, code)
+	}
+	if messages, code := grpcCall(t, client, server.URL, "RangeScan", appendVarintField(appendVarintField(nil, 1, 2), 2, 9)); code != grpcOK ||
+		len(messages) != 2 || !bytes.Equal(messages[0], marshalRow(2, "row 2")) || !bytes.Equal(messages[1], marshalRow(3, "row 3")) {
+		t.Fatalf("RangeScan(2, 9) = %q, status %d", messages, code)
+	}
+	if messages, code := grpcCall(t, client, server.URL, "Delete", appendVarintField(nil, 1, 2)); code != grpcOK || len(messages) != 1 {
+		t.Fatalf("Delete(2) = %q, status %d", messages, code)
+	}
+	if messages, code := grpcCall(t, client, server.URL, "Get", appendVarintField(nil, 1, 2)); code != grpcNotFound || len(messages) != 0 {
+		t.Fatalf("Get(2) after Delete = %q, status %d, want NOT_FOUND", messages, code)
+	}
+	if _, code := grpcCall(t, client, server.URL, "Put", marshalRow(4, "two\nlines")); code != grpcInvalidArgument {
+		t.Fatalf("Put of a row with a newline: status %d, want INVALID_ARGUMENT", code)
+	}
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// =================================================================================================
+// --- hash.go --- (Extendible Hash Index)
+// =================================================================================================
+
+// A HashIndex maps int keys to int64 values, like the B+ tree, in pages of a PageStore of its own,
+// but only answers equality lookups: it hashes the key to pick the one bucket page that can hold
+// it, so a lookup reads a single page however many keys there are. There is no key order, so
+// there are no range scans.
+//
+// It is extendible hashing. The directory is an array of 2^globalDepth bucket page IDs, indexed
+// by the low globalDepth bits of a key's hash. Several directory slots can point to the same
+// bucket: a bucket with local depth d holds every key whose hash ends in the same d bits, and is
+// pointed to by the 2^(globalDepth-d) slots that end in them. When a bucket overflows:
+//
+//   - if its local depth is below the global depth, it is split in two by the next bit of the hash,
+//     and half the slots that pointed to it are pointed to the new bucket;
+//   - otherwise the directory doubles first, each slot i+2^globalDepth copying slot i, which gives
+//     the bucket two slots to split between.
+//
+// Only the overflowing bucket is rewritten, never the whole table, unlike a hash table that
+// rehashes everything when it grows. Deleting a key doesn't merge buckets or shrink the directory.
+//
+// Page 0 is the first directory page; further directory pages are chained from it through the
+// next-leaf slot of the header. The directory is small (8 bytes per slot), so it is kept in memory
+// while the index is open and each lookup reads just the bucket page.
+//
+// Directory page layout:
+//
+//	| header (32 bytes) | bucket page ID int64 ... |
+//
+// The node type is NodeTypeHashDirectory, and the parent slot of page 0 holds the global depth.
+//
+// Bucket page layout:
+//
+//	| header (32 bytes) | key int64 | value int64 | ... |
+//
+// The node type is NodeTypeHashBucket, the parent slot holds the local depth and numKeys the
+// number of entries, which are in no particular order.
+
+const (
+	NodeTypeHashDirectory = 5
+	NodeTypeHashBucket    = 6
+)
+
+const (
+	hashSlotsPerPage   = (PageSize - headerSize) / 8
+	hashBucketCapacity = (PageSize - headerSize) / 16
+	// maxHashGlobalDepth bounds the directory at 2^24 slots, 128 MB, far more than the buckets it
+	// points to could fill unless the hash function is broken.
+	maxHashGlobalDepth = 24
+)
+
+var errHashBucketFull = errors.New("hash bucket cannot be split any further")
+
+// HashIndex is an extendible hash index. Like the B+ tree, it is not safe for concurrent use.
+type HashIndex struct {
+	pager       PageStore
+	pool        *BufferPool
+	globalDepth int
+	directory   []PageID // the bucket of each slot
+	dirPages    []PageID // the directory pages, starting with page 0
+	// dirtyDirPages holds the indexes in dirPages of the pages with changed slots.
+	dirtyDirPages map[int]bool
+	tracer        Tracer
+}
+
+// OpenHashIndex opens the hash index stored in pager, or creates an empty one in an empty pager.
+func OpenHashIndex(pager PageStore) (*HashIndex, error) {
+	h := &HashIndex{pager: pager, pool: NewBufferPool(pager, defaultBufferPoolFrames), dirtyDirPages: make(map[int]bool)}
+	if pager.NumPages() == 0 {
+		// One slot, pointing to one empty bucket of local depth 0.
+		h.dirPages = []PageID{pager.AllocatePage()}
+		bucketID := pager.AllocatePage()
+		if err := h.writeBucket(bucketID, newHashBucket(0)); err != nil {
+			return nil, err
+		}
+		h.directory = []PageID{0}
+		h.setSlot(0, bucketID)
+		return h, h.writeDirectory()
+	}
+	return h, h.loadDirectory()
+}
+
+// BufferPool returns the pool caching the index's pages.
+func (h *HashIndex) BufferPool() *BufferPool {
+	return h.pool
+}
+
+// SetTracer installs a tracer on the index. It reports page reads and writes, and OnSplit for
+// bucket splits. Passing nil disables tracing.
+func (h *HashIndex) SetTracer(tracer Tracer) {
+	h.tracer = tracer
+}
+
+// hashKey mixes the bits of key, so that keys that differ only in their high bits, or that share a
+// stride, still spread over the buckets. It is the finalizer of MurmurHash3.
+func hashKey(key int) uint64 {
+	x := uint64(key)
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+func (h *HashIndex) slot(key int) int {
+	return int(hashKey(key) & (1<<h.globalDepth - 1))
+}
+
+// --- Pages ---
+
+func newHashBucket(localDepth int) *Page {
+	page := new(Page)
+	page[nodeTypeOffset] = NodeTypeHashBucket
+	setParentPageID(page, PageID(localDepth))
+	return page
+}
+
+func bucketLocalDepth(page *Page) int { return int(getParentPageID(page)) }
+
+func bucketEntry(page *Page, i int) (int, int64) {
+	offset := headerSize + i*16
+	return int(int64(binary.LittleEndian.Uint64(page[offset:]))), int64(binary.LittleEndian.Uint64(page[offset+8:]))
+}
+
+func setBucketEntry(page *Page, i int, key int, value int64) {
+	offset := headerSize + i*16
+	binary.LittleEndian.PutUint64(page[offset:], uint64(key))
+	binary.LittleEndian.PutUint64(page[offset+8:], uint64(value))
+}
+
+// findInBucket returns the index of key in the bucket, or -1.
+func findInBucket(page *Page, key int) int {
+	for i := 0; i < int(getNumKeys(page)); i++ {
+		if k, _ := bucketEntry(page, i); k == key {
+			return i
+		}
+	}
+	return -1
+}
+
+func (h *HashIndex) readBucket(pageID PageID) (*Page, error) {
+	if h.tracer != nil {
+		h.tracer.OnPageRead(pageID)
+	}
+	page, err := h.pool.ReadPage(pageID, new(Page))
+	if err != nil {
+		return nil, err
+	}
+	if page[nodeTypeOffset] != NodeTypeHashBucket {
+		return nil, fmt.Errorf("%w: page %d is not a hash bucket", ErrCorruptPage, pageID)
+	}
+	return page, nil
+}
+
+func (h *HashIndex) writeBucket(pageID PageID, page *Page) error {
+	if h.tracer != nil {
+		h.tracer.OnPageWrite(pageID)
+	}
+	return h.pool.WritePage(pageID, page)
+}
+
+// loadDirectory reads the global depth and the directory from the directory pages.
+func (h *HashIndex) loadDirectory() error {
+	for pageID := PageID(0); pageID != -1; {
+		page, err := h.pool.ReadPage(pageID, new(Page))
+		if err != nil {
+			return err
+		}
+		if page[nodeTypeOffset] != NodeTypeHashDirectory {
+			return fmt.Errorf("%w: page %d is not a hash directory page", ErrCorruptPage, pageID)
+		}
+		if pageID == 0 {
+			h.globalDepth = int(getParentPageID(page))
+			if h.globalDepth < 0 || h.globalDepth > maxHashGlobalDepth {
+				return fmt.Errorf("%w: hash directory has global depth %d", ErrCorruptPage, h.globalDepth)
+			}
+		}
+		h.dirPages = append(h.dirPages, pageID)
+		for i := 0; i < int(getNumKeys(page)); i++ {
+			h.directory = append(h.directory, PageID(binary.LittleEndian.Uint64(page[headerSize+i*8:])))
+		}
+		pageID = getNextLeafPageID(page)
+	}
+	if len(h.directory) != 1<<h.globalDepth {
+		return fmt.Errorf("%w: hash directory has %d slots, want %d", ErrCorruptPage, len(h.directory), 1<<h.globalDepth)
+	}
+	return nil
+}
+
+// setSlot points directory slot i to bucket pageID.
+func (h *HashIndex) setSlot(i int, pageID PageID) {
+	h.directory[i] = pageID
+	h.dirtyDirPages[i/hashSlotsPerPage] = true
+}
+
+// writeDirectory writes the directory pages whose slots have changed since the last call,
+// allocating pages for a directory that has grown.
+func (h *HashIndex) writeDirectory() error {
+	numPages := (len(h.directory) + hashSlotsPerPage - 1) / hashSlotsPerPage
+	for len(h.dirPages) < numPages {
+		h.dirPages = append(h.dirPages, h.pager.AllocatePage())
+		// The previous last page has to link to the new one.
+		h.dirtyDirPages[len(h.dirPages)-2] = true
+		h.dirtyDirPages[len(h.dirPages)-1] = true
+	}
+	for p := range h.dirtyDirPages {
+		page := new(Page)
+		page[nodeTypeOffset] = NodeTypeHashDirectory
+		if p == 0 {
+			setParentPageID(page, PageID(h.globalDepth))
+		}
+		setNextLeafPageID(page, -1)
+		if p+1 < numPages {
+			setNextLeafPageID(page, h.dirPages[p+1])
+		}
+		slots := h.directory[p*hashSlotsPerPage : min((p+1)*hashSlotsPerPage, len(h.directory))]
+		for i, bucketID := range slots {
+			binary.LittleEndian.PutUint64(page[headerSize+i*8:], uint64(bucketID))
+		}
+		setNumKeys(page, uint16(len(slots)))
+		if h.tracer != nil {
+			h.tracer.OnPageWrite(h.dirPages[p])
+		}
+		if err := h.pool.WritePage(h.dirPages[p], page); err != nil {
+			return err
+		}
+		delete(h.dirtyDirPages, p)
+	}
+	return nil
+}
+
+// --- Operations ---
+
+// Get returns the value stored under key.
+func (h *HashIndex) Get(key int) (int64, bool, error) {
+	page, err := h.readBucket(h.directory[h.slot(key)])
+	if err != nil {
+		return 0, false, err
+	}
+	if i := findInBucket(page, key); i != -1 {
+		_, value := bucketEntry(page, i)
+		return value, true, nil
+	}
+	return 0, false, nil
+}
+
+// Put stores value under key, replacing the value already stored there, if any. It reports
+// whether it replaced one.
+func (h *HashIndex) Put(key int, value int64) (bool, error) {
+	for {
+		slot := h.slot(key)
+		bucketID := h.directory[slot]
+		page, err := h.readBucket(bucketID)
+		if err != nil {
+			return false, err
+		}
+		if i := findInBucket(page, key); i != -1 {
+			setBucketEntry(page, i, key, value)
+			return true, h.writeBucket(bucketID, page)
+		}
+		if n := int(getNumKeys(page)); n < hashBucketCapacity {
+			setBucketEntry(page, n, key, value)
+			setNumKeys(page, uint16(n+1))
+			return false, h.writeBucket(bucketID, page)
+		}
+		// The bucket is full: split it, and try again in whichever half the key now maps to.
+		if err := h.split(slot, bucketID, page); err != nil {
+			return false, err
+		}
+	}
+}
+
+// split splits the full bucket of the given slot in two, doubling the directory first if the
+// bucket's local depth has reached the global depth.
+func (h *HashIndex) split(slot int, bucketID PageID, page *Page) error {
+	localDepth := bucketLocalDepth(page)
+	if localDepth == h.globalDepth {
+		if h.globalDepth == maxHashGlobalDepth {
+			return fmt.Errorf("%w: bucket %d at depth %d", errHashBucketFull, bucketID, localDepth)
+		}
+		// Each new slot i+2^globalDepth points where slot i does.
+		h.directory = append(h.directory, h.directory...)
+		h.globalDepth++
+		for p := 0; p*hashSlotsPerPage < len(h.directory); p++ {
+			h.dirtyDirPages[p] = true
+		}
+	}
+
+	// Keys whose hash has bit localDepth set move to the new bucket.
+	bit := uint64(1) << localDepth
+	newBucketID := h.pager.AllocatePage()
+	low, high := newHashBucket(localDepth+1), newHashBucket(localDepth+1)
+	for i := 0; i < int(getNumKeys(page)); i++ {
+		key, value := bucketEntry(page, i)
+		half := low
+		if hashKey(key)&bit != 0 {
+			half = high
+		}
+		n := int(getNumKeys(half))
+		setBucketEntry(half, n, key, value)
+		setNumKeys(half, uint16(n+1))
+	}
+	// The slots of the old bucket are those that end in the same localDepth bits as slot.
+	for i := slot & int(bit-1); i < len(h.directory); i += int(bit) {
+		if uint64(i)&bit != 0 {
+			h.setSlot(i, newBucketID)
+		}
+	}
+	if h.tracer != nil {
+		h.tracer.OnSplit(bucketID, newBucketID, true)
+	}
+	// The new bucket is written before the directory points to it, and the directory before the
+	// old bucket drops the keys that moved.
+	if err := h.writeBucket(newBucketID, high); err != nil {
+		return err
+	}
+	if err := h.writeDirectory(); err != nil {
+		return err
+	}
+	return h.writeBucket(bucketID, low)
+}
+
+// Delete removes key and reports whether it was present.
+func (h *HashIndex) Delete(key int) (bool, error) {
+	bucketID := h.directory[h.slot(key)]
+	page, err := h.readBucket(bucketID)
+	if err != nil {
+		return false, err
+	}
+	i := findInBucket(page, key)
+	if i == -1 {
+		return false, nil
+	}
+	// The entries are unordered, so the last one fills the gap.
+	n := int(getNumKeys(page)) - 1
+	lastKey, lastValue := bucketEntry(page, n)
+	setBucketEntry(page, i, lastKey, lastValue)
+	setBucketEntry(page, n, 0, 0)
+	setNumKeys(page, uint16(n))
+	return true, h.writeBucket(bucketID, page)
+}
+
+// Close writes out the pages cached by the index's buffer pool. It doesn't close the PageStore.
+func (h *HashIndex) Close() error {
+	return h.pool.Close()
+}
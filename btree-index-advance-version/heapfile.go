@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+)
+
+// =================================================================================================
+// --- heapfile.go --- (Row Storage)
+// =================================================================================================
+
+// HeapFile is an append-only data file holding one row per line, in the same format as users.csv.
+// Rows are addressed by the byte offset at which they start, which is what the index stores.
+type HeapFile struct {
+	file *os.File
+	size int64
+}
+
+var errRowHasNewline = errors.New("heap rows cannot contain a newline")
+
+func OpenHeapFile(path string) (*HeapFile, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &HeapFile{file: file, size: stat.Size()}, nil
+}
+
+// Size returns the offset at which the next appended row will start.
+func (h *HeapFile) Size() int64 {
+	return h.size
+}
+
+// WriteRow writes a row, followed by its newline, at the given offset.
+func (h *HeapFile) WriteRow(offset int64, row []byte) error {
+	if bytes.IndexByte(row, '\n') != -1 {
+		return errRowHasNewline
+	}
+	line := append(append(make([]byte, 0, len(row)+1), row...), '\n')
+	if _, err := h.file.WriteAt(line, offset); err != nil {
+		return err
+	}
+	h.size = max(h.size, offset+int64(len(line)))
+	return nil
+}
+
+// ReadRow returns the row starting at the given offset.
+func (h *HeapFile) ReadRow(offset int64) (string, error) {
+	// ReadBytes rather than ReadLine, which would cut rows longer than the reader's buffer short.
+	line, err := bufio.NewReader(io.NewSectionReader(h.file, offset, h.size-offset)).ReadBytes('\n')
+	if err != nil && (err != io.EOF || len(line) == 0) {
+		return "", err
+	}
+	return string(bytes.TrimSuffix(line, []byte{'\n'})), nil
+}
+
+func (h *HeapFile) Sync() error {
+	return h.file.Sync()
+}
+
+func (h *HeapFile) Close() error {
+	return h.file.Close()
+}
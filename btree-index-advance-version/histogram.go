@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// =================================================================================================
+// --- histogram.go --- (Equi-Depth Histogram and Cardinality Estimation)
+// =================================================================================================
+
+// An equi-depth histogram splits the keys into buckets holding (nearly) the same number of
+// entries, so dense key ranges get narrow buckets and sparse ones get wide buckets. Estimating
+// how many entries a range holds then only needs the buckets, not the tree: buckets fully inside
+// the range count in full, and a partially covered bucket contributes the covered fraction of its
+// key range, assuming its keys are spread evenly.
+//
+// A histogram is a snapshot. It doesn't follow later inserts and deletes, so rebuild it once the
+// index has changed noticeably.
+
+var errInvalidBucketCount = errors.New("histogram needs at least one bucket")
+
+// HistogramBucket covers the keys Low..High (inclusive) and holds Count entries.
+type HistogramBucket struct {
+	Low, High int
+	Count     int
+}
+
+// Histogram is an equi-depth histogram over the keys of a tree.
+type Histogram struct {
+	Buckets []HistogramBucket
+	Total   int
+}
+
+func (h *Histogram) String() string {
+	return fmt.Sprintf("%d entries in %d buckets %v", h.Total, len(h.Buckets), h.Buckets)
+}
+
+// BuildHistogram scans the tree and builds an equi-depth histogram with at most numBuckets buckets.
+func (t *BPlusTree) BuildHistogram(numBuckets int) (*Histogram, error) {
+	if numBuckets < 1 {
+		return nil, errInvalidBucketCount
+	}
+	c, err := t.Seek(math.MinInt)
+	if err != nil {
+		return nil, err
+	}
+	total := 0
+	for c.Next() {
+		total++
+	}
+	if err := c.Err(); err != nil {
+		return nil, err
+	}
+
+	h := &Histogram{Total: total}
+	if total == 0 {
+		return h, nil
+	}
+	sizes := distribute(total, 1, total, (total+numBuckets-1)/numBuckets)
+	if c, err = t.Seek(math.MinInt); err != nil {
+		return nil, err
+	}
+	for _, size := range sizes {
+		bucket := HistogramBucket{Count: size}
+		for i := 0; i < size; i++ {
+			if !c.Next() {
+				return nil, fmt.Errorf("tree changed while building the histogram: %w", c.Err())
+			}
+			if i == 0 {
+				bucket.Low = c.Key()
+			}
+			bucket.High = c.Key()
+		}
+		h.Buckets = append(h.Buckets, bucket)
+	}
+	return h, nil
+}
+
+// EstimateRange returns the approximate number of entries with startKey <= key <= endKey.
+func (h *Histogram) EstimateRange(startKey, endKey int) float64 {
+	estimate := 0.0
+	for _, b := range h.Buckets {
+		if endKey < b.Low || startKey > b.High {
+			continue
+		}
+		if startKey <= b.Low && endKey >= b.High {
+			estimate += float64(b.Count)
+			continue
+		}
+		// Keys are integers, so the bucket spans High-Low+1 possible keys. Float arithmetic
+		// avoids overflowing on buckets that span most of the int range.
+		low, high := max(startKey, b.Low), min(endKey, b.High)
+		covered := (float64(high) - float64(low) + 1) / (float64(b.High) - float64(b.Low) + 1)
+		estimate += covered * float64(b.Count)
+	}
+	return estimate
+}
+
+// Selectivity returns the estimated fraction of all entries with startKey <= key <= endKey.
+func (h *Histogram) Selectivity(startKey, endKey int) float64 {
+	if h.Total == 0 {
+		return 0
+	}
+	return h.EstimateRange(startKey, endKey) / float64(h.Total)
+}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// =================================================================================================
+// --- import.go --- (Importing Data Files)
+// =================================================================================================
+
+// The index can be built over any DataSource: something that yields the key of each record in a
+// data file and the byte offset at which the record starts. BuildIndex collects the records and
+// inserts them as one batch, which writes each leaf once per run of keys instead of once per
+// record. A record the source can't parse stops the build before anything is inserted.
+//
+// There are two sources: CSVSource for CSV files and JSONLSource for JSON-lines files (one JSON
+// object per line).
+//
+// CSVSource reads a CSV data file described by a CSVSchema. The file is parsed with encoding/csv,
+// so quoted fields (including ones holding the delimiter, quotes or line breaks), CRLF line endings
+// and other delimiters than the comma work. A UTF-8 byte order mark at the start of the file is
+// skipped.
+//
+// Every row is checked against the schema: it must have one field per column, and fields of
+// ColumnInt columns must be integers. The key column must be a ColumnInt column, since the tree's
+// keys are ints.
+
+// DataSource yields the records of a data file to index.
+type DataSource interface {
+	// NextRecord returns the key of the next record and the byte offset at which the record
+	// starts in the data file, or io.EOF after the last record.
+	NextRecord() (key int, offset int64, err error)
+	Close() error
+}
+
+// BuildIndex inserts the key and offset of every record of source into the tree and returns the
+// number of records indexed.
+func BuildIndex(tree *BPlusTree, source DataSource) (int, error) {
+	return BuildIndexWith(tree, source, BuildOptions{})
+}
+
+// BuildOptions changes how BuildIndexWith loads the records.
+type BuildOptions struct {
+	// CollectViolations checks every record against the unique constraint before inserting any,
+	// and reports all the duplicate keys, within the data file and with the tree, in one
+	// ConstraintViolations error, sorted by key. Nothing is inserted if there are any. Otherwise
+	// the load stops at the first duplicate, like InsertBatch.
+	CollectViolations bool
+	// Workers, if above 0, builds the tree bottom-up instead of inserting the records, sorting
+	// them with that many goroutines (see parallel.go). The tree must be empty. A duplicate key
+	// leaves the tree empty, with or without CollectViolations.
+	Workers int
+	// ExternalSort, if not nil, also builds the tree bottom-up, but sorts the records on disk with
+	// an ExternalSorter so that they don't have to fit in memory (see extsort.go), and ignores
+	// Workers. The tree must be empty, and a duplicate key leaves it empty.
+	ExternalSort *ExternalSortOptions
+}
+
+// BuildIndexWith is BuildIndex with options.
+func BuildIndexWith(tree *BPlusTree, source DataSource, opts BuildOptions) (int, error) {
+	if opts.ExternalSort != nil {
+		return tree.buildExternal(source, opts)
+	}
+	if opts.Workers > 0 {
+		return tree.buildParallel(source, opts)
+	}
+	var pairs []KV
+	for {
+		key, offset, err := source.NextRecord()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		pairs = append(pairs, KV{Key: key, Value: offset})
+	}
+	if opts.CollectViolations {
+		violations, err := tree.uniqueViolations(pairs)
+		if err != nil {
+			return 0, err
+		}
+		if len(violations) > 0 {
+			return 0, violations
+		}
+	}
+	if err := tree.InsertBatch(pairs); err != nil {
+		return 0, err
+	}
+	return len(pairs), nil
+}
+
+// ColumnType is the type of the values in a column.
+type ColumnType int
+
+const (
+	ColumnString ColumnType = iota
+	ColumnInt
+)
+
+func (c ColumnType) String() string {
+	if c == ColumnInt {
+		return "int"
+	}
+	return "string"
+}
+
+// Column is a column of a data file.
+type Column struct {
+	Name string
+	Type ColumnType
+}
+
+// CSVSchema describes the layout of a CSV data file.
+type CSVSchema struct {
+	Columns []Column
+	// Key is the name of the column the index is built on.
+	Key string
+	// Delimiter separates the fields of a row. 0 means a comma.
+	Delimiter rune
+	// Header is true if the first row holds the column names. They must match Columns.
+	Header bool
+}
+
+// usersSchema is the layout of users.csv.
+var usersSchema = CSVSchema{
+	Columns: []Column{{"id", ColumnInt}, {"username", ColumnString}, {"email", ColumnString}},
+	Key:     "id",
+	Header:  true,
+}
+
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// keyColumn returns the index of the key column.
+func (s CSVSchema) keyColumn() (int, error) {
+	for i, c := range s.Columns {
+		if c.Name != s.Key {
+			continue
+		}
+		if c.Type != ColumnInt {
+			return -1, fmt.Errorf("key column %q has type %v, want int", s.Key, c.Type)
+		}
+		return i, nil
+	}
+	return -1, fmt.Errorf("key column %q is not in the schema", s.Key)
+}
+
+// checkRow checks the fields of a row against the column types.
+func (s CSVSchema) checkRow(fields []string) error {
+	for i, c := range s.Columns {
+		if c.Type != ColumnInt {
+			continue
+		}
+		if _, err := strconv.Atoi(fields[i]); err != nil {
+			return fmt.Errorf("column %q: %q is not an int", c.Name, fields[i])
+		}
+	}
+	return nil
+}
+
+// checkHeader checks that a header row names the schema's columns, in order.
+func (s CSVSchema) checkHeader(fields []string) error {
+	for i, c := range s.Columns {
+		if !strings.EqualFold(strings.TrimSpace(fields[i]), c.Name) {
+			return fmt.Errorf("header has column %q where the schema has %q", fields[i], c.Name)
+		}
+	}
+	return nil
+}
+
+// CSVSource is a DataSource over a CSV data file described by a CSVSchema.
+type CSVSource struct {
+	path      string
+	file      *os.File
+	reader    *csv.Reader
+	schema    CSVSchema
+	keyColumn int
+	base      int64 // offset in the file at which the reader started, after a byte order mark
+	started   bool  // whether the header row, if any, is behind the reader
+}
+
+// NewCSVSource opens a CSV data file for indexing.
+func NewCSVSource(path string, schema CSVSchema) (*CSVSource, error) {
+	return newCSVSourceAt(path, schema, 0)
+}
+
+// newCSVSourceAt opens a CSV data file for indexing the rows from offset on, which must be the
+// start of a row. A header row and a byte order mark are only expected at offset 0.
+func newCSVSourceAt(path string, schema CSVSchema, offset int64) (*CSVSource, error) {
+	keyColumn, err := schema.keyColumn()
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	// Offsets handed to the index are offsets in the file, so account for a skipped BOM.
+	input := bufio.NewReader(file)
+	base := offset
+	if prefix, _ := input.Peek(len(utf8BOM)); offset == 0 && bytes.Equal(prefix, utf8BOM) {
+		input.Discard(len(utf8BOM))
+		base = int64(len(utf8BOM))
+	}
+	reader := csv.NewReader(input)
+	if schema.Delimiter != 0 {
+		reader.Comma = schema.Delimiter
+	}
+	reader.FieldsPerRecord = len(schema.Columns)
+	reader.ReuseRecord = true
+	return &CSVSource{path: path, file: file, reader: reader, schema: schema, keyColumn: keyColumn, base: base, started: offset > 0}, nil
+}
+
+// Offset returns the offset right after the last row read, where the next one starts.
+func (s *CSVSource) Offset() int64 {
+	return s.base + s.reader.InputOffset()
+}
+
+// NextRecord returns the key of the next row and the offset at which the row starts. A header
+// row is checked and skipped.
+func (s *CSVSource) NextRecord() (int, int64, error) {
+	fields, offset, err := s.nextRow()
+	if err != nil {
+		return 0, 0, err
+	}
+	key, _ := strconv.Atoi(fields[s.keyColumn])
+	return key, offset, nil
+}
+
+// nextRow returns the fields of the next row, checked against the schema, and the offset at which
+// the row starts. A header row is checked and skipped. The fields are only valid until the next
+// call.
+func (s *CSVSource) nextRow() ([]string, int64, error) {
+	for {
+		offset := s.Offset()
+		fields, err := s.reader.Read()
+		if err == io.EOF {
+			return nil, 0, io.EOF
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("%s: %w", s.path, err)
+		}
+		line, _ := s.reader.FieldPos(0)
+		if !s.started {
+			s.started = true
+			if s.schema.Header {
+				if err := s.schema.checkHeader(fields); err != nil {
+					return nil, 0, fmt.Errorf("%s:%d: %w", s.path, line, err)
+				}
+				continue
+			}
+		}
+		if err := s.schema.checkRow(fields); err != nil {
+			return nil, 0, fmt.Errorf("%s:%d: %w", s.path, line, err)
+		}
+		return fields, offset, nil
+	}
+}
+
+func (s *CSVSource) Close() error {
+	return s.file.Close()
+}
+
+// ImportCSV indexes every row of a CSV data file by its key column and returns the number of rows
+// indexed (see BuildIndex). It then records the version of the data file and the offset up to
+// which it was indexed in the meta page, for ValidateAgainstData and AppendIndex.
+func ImportCSV(tree *BPlusTree, dataPath string, schema CSVSchema) (int, error) {
+	return tree.importCSVAt(dataPath, schema, 0)
+}
+
+// ErrDataFileChanged means the part of the data file that is already indexed has changed since,
+// so appending to the index would leave stale offsets in it. Rebuild the index instead.
+var ErrDataFileChanged = errors.New("indexed part of the data file has changed")
+
+// AppendIndex indexes the rows appended to a CSV data file since it was last indexed, starting at
+// fromOffset, and returns the number of rows added. A negative fromOffset means the offset
+// recorded in the meta page by the last ImportCSV or AppendIndex.
+//
+// Before indexing anything, AppendIndex checks that the recorded version of the file is still its
+// prefix, i.e. that the file was only appended to. If it wasn't, it returns ErrDataFileChanged.
+// A row whose key is already in the index stops the append with ErrDuplicateKey, leaving the
+// rows with smaller keys indexed.
+func (t *BPlusTree) AppendIndex(dataPath string, schema CSVSchema, fromOffset int64) (int, error) {
+	if fromOffset < 0 {
+		offset, err := t.IndexedOffset()
+		if err != nil {
+			return 0, err
+		}
+		fromOffset = offset
+	}
+	recorded, ok, err := t.DataFileInfo()
+	if err != nil {
+		return 0, err
+	}
+	if ok {
+		unchanged, err := hasPrefixChecksum(dataPath, recorded.Size, recorded.Checksum)
+		if err != nil {
+			return 0, err
+		}
+		if !unchanged {
+			return 0, fmt.Errorf("%w: %s no longer starts with the %d bytes indexed", ErrDataFileChanged, dataPath, recorded.Size)
+		}
+	}
+	if fromOffset > 0 {
+		// Without a line break after the last indexed row, the appended bytes extend that row.
+		last, err := byteAt(dataPath, fromOffset-1)
+		if err != nil {
+			return 0, err
+		}
+		if last != '\n' {
+			return 0, fmt.Errorf("%w: the row before offset %d has no line break, so the appended data extends it", ErrDataFileChanged, fromOffset)
+		}
+	}
+	return t.importCSVAt(dataPath, schema, fromOffset)
+}
+
+// hasPrefixChecksum reports whether the file at path is at least size bytes long and its first
+// size bytes have the given CRC-32 checksum.
+func hasPrefixChecksum(path string, size int64, checksum uint32) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	hash := crc32.NewIEEE()
+	n, err := io.CopyN(hash, file, size)
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	return n == size && hash.Sum32() == checksum, nil
+}
+
+// byteAt returns the byte at offset in the file at path.
+func byteAt(path string, offset int64) (byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	var b [1]byte
+	_, err = file.ReadAt(b[:], offset)
+	return b[0], err
+}
+
+// importCSVAt indexes the rows of a CSV data file from offset on and records the file in the
+// meta page.
+func (t *BPlusTree) importCSVAt(dataPath string, schema CSVSchema, offset int64) (int, error) {
+	source, err := newCSVSourceAt(dataPath, schema, offset)
+	if err != nil {
+		return 0, err
+	}
+	defer source.Close()
+	n, err := BuildIndex(t, source)
+	if err != nil {
+		return 0, err
+	}
+	if err := t.RecordDataFile(dataPath); err != nil {
+		return 0, err
+	}
+	return n, t.setIndexedOffset(source.Offset())
+}
+
+// JSONLSource is a DataSource over a JSON-lines data file: one JSON object per line, with the key
+// in an integer field. Blank lines are skipped.
+type JSONLSource struct {
+	path     string
+	file     *os.File
+	reader   *bufio.Reader
+	keyField string
+	offset   int64
+	line     int
+}
+
+// NewJSONLSource opens a JSON-lines data file for indexing on the given field.
+func NewJSONLSource(path, keyField string) (*JSONLSource, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &JSONLSource{path: path, file: file, reader: bufio.NewReader(file), keyField: keyField}, nil
+}
+
+// NextRecord returns the key of the next object and the offset of the line holding it.
+func (s *JSONLSource) NextRecord() (int, int64, error) {
+	for {
+		line, err := s.reader.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			return 0, 0, io.EOF
+		}
+		if err != nil && err != io.EOF {
+			return 0, 0, fmt.Errorf("%s: %w", s.path, err)
+		}
+		offset := s.offset
+		s.offset += int64(len(line))
+		s.line++
+		if s.line == 1 && bytes.HasPrefix(line, utf8BOM) {
+			line = line[len(utf8BOM):]
+			offset += int64(len(utf8BOM))
+		}
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		key, err := s.key(line)
+		if err != nil {
+			return 0, 0, fmt.Errorf("%s:%d: %w", s.path, s.line, err)
+		}
+		return key, offset, nil
+	}
+}
+
+// key decodes an object and returns its key field.
+func (s *JSONLSource) key(line []byte) (int, error) {
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(line, &object); err != nil {
+		return 0, err
+	}
+	raw, ok := object[s.keyField]
+	if !ok {
+		return 0, fmt.Errorf("object has no field %q", s.keyField)
+	}
+	var key int
+	if err := json.Unmarshal(raw, &key); err != nil {
+		return 0, fmt.Errorf("field %q: %s is not an int", s.keyField, raw)
+	}
+	return key, nil
+}
+
+func (s *JSONLSource) Close() error {
+	return s.file.Close()
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+)
+
+// =================================================================================================
+// --- inspect.go --- (Index File Inspection)
+// =================================================================================================
+
+// `go run . inspect` looks at an index file without going through main's demo:
+//
+//	inspect pages <file>               one line per page: type, keys, parent, next, free space
+//	inspect page <file> <id>           the decoded header and cells of a page, then a hexdump
+//	inspect verify [-degree N] <file>  run the structural checks of `go run . check`
+//	inspect stats [-degree N] <file>   print the tree statistics
+//	inspect dot <file>                 print the tree as a Graphviz digraph
+//
+// verify and stats take the degree from the file's header (see meta.go), or from -degree for a file
+// written before the header existed. It only matters for the occupancy checks and the fill factor.
+
+// pageTypeName returns the name of a page's node type.
+func pageTypeName(page *Page) string {
+	switch page[nodeTypeOffset] {
+	case NodeTypeLeaf:
+		return "LEAF"
+	case NodeTypeInternal:
+		return "INTERNAL"
+	case NodeTypeOverflow:
+		return "OVERFLOW"
+	case NodeTypeMeta:
+		return "META"
+	case NodeTypeCatalog:
+		return "CATALOG"
+	case NodeTypeHashDirectory:
+		return "HASH_DIR"
+	case NodeTypeHashBucket:
+		return "HASH_BKT"
+	case NodeTypeTermDictionary:
+		return "TERMS"
+	case NodeTypePostings:
+		return "POSTINGS"
+	case NodeTypeRTree:
+		return "RTREE"
+	case NodeTypeCOWMeta:
+		return "COW_META"
+	case NodeTypeCOWLeaf:
+		return "COW_LEAF"
+	case NodeTypeCOWInternal:
+		return "COW_INT"
+	case NodeTypeShadowMeta:
+		return "SHDW_META"
+	case NodeTypePageTable:
+		return "PAGE_TBL"
+	default:
+		return fmt.Sprintf("UNKNOWN(%d)", page[nodeTypeOffset])
+	}
+}
+
+// describePage prints the decoded header and cells of a page.
+func describePage(w io.Writer, pageID PageID, page *Page) {
+	if page[nodeTypeOffset] == NodeTypeOverflow {
+		fmt.Fprintf(w, "\n[ Page %d | Type: OVERFLOW | Bytes: %d | NextOverflowID: %d ]\n", pageID, getNumKeys(page), getNextLeafPageID(page))
+		return
+	}
+	if page[nodeTypeOffset] == NodeTypeMeta {
+		fmt.Fprintf(w, "\n[ Page %d | Type: META ]\n", pageID)
+		fmt.Fprintf(w, "  - Data file: %v\n", metaDataFileInfo(page))
+		if header, ok := decodeIndexHeader(page); ok {
+			fmt.Fprintf(w, "  - Header: format version %d, degree %d, root %d, catalog %d\n",
+				header.formatVersion, header.degree, header.rootPageID, header.catalogPageID)
+			if header.internalDegree != 0 {
+				fmt.Fprintf(w, "  - Internal degree: %d\n", header.internalDegree)
+			}
+		}
+		return
+	}
+	if page[nodeTypeOffset] == NodeTypeCatalog {
+		fmt.Fprintf(w, "\n[ Page %d | Type: CATALOG | Buckets: %d ]\n", pageID, getNumKeys(page))
+		for _, e := range readCatalogEntries(page) {
+			fmt.Fprintf(w, "    - %q -> root %d\n", e.name, e.root)
+		}
+		return
+	}
+	if page[nodeTypeOffset] == NodeTypeHashDirectory {
+		fmt.Fprintf(w, "\n[ Page %d | Type: HASH_DIR | Slots: %d | NextDirectoryID: %d ]\n", pageID, getNumKeys(page), getNextLeafPageID(page))
+		if pageID == 0 {
+			fmt.Fprintf(w, "  - Global depth: %d\n", getParentPageID(page))
+		}
+		return
+	}
+	if page[nodeTypeOffset] == NodeTypeHashBucket {
+		fmt.Fprintf(w, "\n[ Page %d | Type: HASH_BKT | Entries: %d | LocalDepth: %d ]\n", pageID, getNumKeys(page), bucketLocalDepth(page))
+		for j := 0; j < int(min(getNumKeys(page), hashBucketCapacity)); j++ {
+			key, value := bucketEntry(page, j)
+			fmt.Fprintf(w, "    - %d -> %d\n", key, value)
+		}
+		return
+	}
+	if page[nodeTypeOffset] == NodeTypeTermDictionary {
+		fmt.Fprintf(w, "\n[ Page %d | Type: TERMS | Terms: %d | NextDictionaryID: %d ]\n", pageID, getNumKeys(page), getNextLeafPageID(page))
+		return
+	}
+	if page[nodeTypeOffset] == NodeTypePostings {
+		fmt.Fprintf(w, "\n[ Page %d | Type: POSTINGS | TIDs: %d | NextPostingsID: %d ]\n", pageID, getNumKeys(page), getNextLeafPageID(page))
+		for j := 0; j < int(min(getNumKeys(page), postingsPerPage)); j++ {
+			fmt.Fprintf(w, "    - %d\n", postingAt(page, j))
+		}
+		return
+	}
+	if page[nodeTypeOffset] == NodeTypeRTree {
+		fmt.Fprintf(w, "\n[ Page %d | Type: RTREE | Entries: %d | Level: %d ]\n", pageID, getNumKeys(page), getParentPageID(page))
+		return
+	}
+	if page[nodeTypeOffset] == NodeTypeCOWMeta {
+		state, ok := decodeCOWMeta(page)
+		fmt.Fprintf(w, "\n[ Page %d | Type: COW_META | Valid: %v | TxID: %d | Root: %d ]\n", pageID, ok, state.txid, state.root)
+		return
+	}
+	if page[nodeTypeOffset] == NodeTypeCOWLeaf || page[nodeTypeOffset] == NodeTypeCOWInternal {
+		fmt.Fprintf(w, "\n[ Page %d | Type: %s | NumKeys: %d ]\n", pageID, pageTypeName(page), getNumKeys(page))
+		return
+	}
+	if page[nodeTypeOffset] == NodeTypeShadowMeta {
+		txid, ok := decodeShadowMeta(page)
+		fmt.Fprintf(w, "\n[ Page %d | Type: SHDW_META | Valid: %v | TxID: %d ]\n", pageID, ok, txid)
+		return
+	}
+	if page[nodeTypeOffset] == NodeTypePageTable {
+		fmt.Fprintf(w, "\n[ Page %d | Type: PAGE_TBL | Entries: %d ]\n", pageID, getNumKeys(page))
+		return
+	}
+	numKeys := getNumKeys(page)
+	parentID := getParentPageID(page)
+	fmt.Fprintf(w, "\n[ Page %d | Type: %s | NumKeys: %d | ParentID: %d ]\n", pageID, pageTypeName(page), numKeys, parentID)
+	if err := checkPageLayout(page); err != nil {
+		// The cell pointers can't be trusted, so don't follow them.
+		fmt.Fprintf(w, "  - Bad layout: %v\n", err)
+		return
+	}
+	if high, ok := highKey(page); ok {
+		fmt.Fprintf(w, "  - Fence: HighKey %d | RightLinkID -> %d\n", high, rightLink(page))
+	}
+
+	if isLeaf(page) {
+		nextID := getNextLeafPageID(page)
+		fmt.Fprintf(w, "  - Header: NextLeafID -> %d\n", nextID)
+		fmt.Fprintln(w, "  - Content: [Key -> RecordOffset]")
+		for j := 0; j < int(numKeys); j++ {
+			if inline, size, overflow := leafValueAt(page, j); overflow != -1 {
+				fmt.Fprintf(w, "    - %d -> [%d bytes in overflow page %d]\n", keyAt(page, j), size, overflow)
+				continue
+			} else if len(inline) != 8 {
+				fmt.Fprintf(w, "    - %d -> %q\n", keyAt(page, j), inline)
+				continue
+			}
+			fmt.Fprintf(w, "    - %d -> %d\n", keyAt(page, j), valueAt(page, j))
+		}
+	} else {
+		fmt.Fprintln(w, "  - Content: [PtrToPageID | Key | PtrToPageID | ...]")
+		fmt.Fprintf(w, "    - Ptr -> %d (%d entries)\n", childAt(page, 0), childCountAt(page, 0))
+		for j := 0; j < int(numKeys); j++ {
+			fmt.Fprintf(w, "    - Key: %d\n", keyAt(page, j))
+			fmt.Fprintf(w, "    - Ptr -> %d (%d entries)\n", childAt(page, j+1), childCountAt(page, j+1))
+		}
+	}
+}
+
+// visualizeIndexFile prints the structure of the binary index file, read through pager: the file is
+// locked while a Pager has it open, so it can't be opened a second time.
+func visualizeIndexFile(pager *Pager) error {
+	fmt.Println("\n--- Visualizing On-Disk Index File Structure ---")
+	if pager.NumPages() == 0 {
+		fmt.Println("Index file is empty.")
+		return nil
+	}
+
+	for i := int64(0); i < pager.NumPages(); i++ {
+		pageID := PageID(i)
+		page, err := pager.ReadPage(pageID, new(Page))
+		if err != nil {
+			fmt.Printf("Error reading page %d: %v\n", pageID, err)
+			continue
+		}
+		describePage(os.Stdout, pageID, page)
+	}
+	return nil
+}
+
+// hexDump writes a hexdump of data, collapsing runs of identical lines into a "*" line like
+// hexdump -C does. Most of a page is usually the zeroed free space between the cell pointers and
+// the cells.
+func hexDump(w io.Writer, data []byte) {
+	const lineSize = 16
+	skipping := false
+	for offset := 0; offset < len(data); offset += lineSize {
+		line := data[offset:min(offset+lineSize, len(data))]
+		if offset > 0 && offset+lineSize < len(data) && bytes.Equal(line, data[offset-lineSize:offset]) {
+			if !skipping {
+				fmt.Fprintln(w, "*")
+				skipping = true
+			}
+			continue
+		}
+		skipping = false
+		dump := hex.Dump(line)
+		// hex.Dump numbers lines from 0, so replace its offset with the one in the page.
+		fmt.Fprintf(w, "%08x%s", offset, dump[8:])
+	}
+}
+
+// openIndexFile opens an existing index file for reading, so that inspecting an index doesn't
+// conflict with other readers, and fails with ErrLocked while a writer has it open.
+func openIndexFile(path string) (*Pager, error) {
+	return NewReadOnlyPager(path)
+}
+
+// openIndexTree opens the tree in an existing, non-empty index file. A degree of 0 means the one in
+// the file's header, or MaxDegree if it has none.
+func openIndexTree(path string, degree int) (*BPlusTree, *Pager, error) {
+	pager, err := openIndexFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if pager.NumPages() == 0 {
+		pager.Close()
+		return nil, nil, fmt.Errorf("%s is empty", path)
+	}
+	if degree == 0 {
+		tree, err := OpenStore(pager)
+		if err == nil {
+			return tree, pager, nil
+		}
+		if !errors.Is(err, ErrNoIndexHeader) {
+			pager.Close()
+			return nil, nil, err
+		}
+	}
+	return NewBPlusTree(pager, degree), pager, nil
+}
+
+func inspectPages(w io.Writer, pager *Pager) error {
+	fmt.Fprintf(w, "%6s  %-9s %5s %7s %7s %6s %6s\n", "page", "type", "keys", "parent", "next", "free", "frag")
+	buf := new(Page)
+	for i := int64(0); i < pager.NumPages(); i++ {
+		page, err := pager.ReadPage(PageID(i), buf)
+		if err != nil {
+			return err
+		}
+		typeName := pageTypeName(page)
+		if isRoot(page) {
+			typeName += "*"
+		}
+		if page[nodeTypeOffset] == NodeTypeCatalog {
+			fmt.Fprintf(w, "%6d  %-9s %5d %7s %7s %6s %6s\n", i, typeName, getNumKeys(page), "-", "-", "-", "-")
+			continue
+		}
+		if page[nodeTypeOffset] == NodeTypeMeta {
+			fmt.Fprintf(w, "%6d  %-9s %5s %7s %7s %6s %6s\n", i, typeName, "-", "-", "-", "-", "-")
+			continue
+		}
+		if page[nodeTypeOffset] == NodeTypeOverflow {
+			fmt.Fprintf(w, "%6d  %-9s %5s %7s %7d %6d %6s\n", i, typeName, "-", "-", getNextLeafPageID(page), overflowPayloadSize-int(getNumKeys(page)), "-")
+			continue
+		}
+		if page[nodeTypeOffset] == NodeTypeHashDirectory {
+			fmt.Fprintf(w, "%6d  %-9s %5d %7s %7d %6d %6s\n", i, typeName, getNumKeys(page), "-", getNextLeafPageID(page), (hashSlotsPerPage-int(getNumKeys(page)))*8, "-")
+			continue
+		}
+		if page[nodeTypeOffset] == NodeTypeHashBucket {
+			fmt.Fprintf(w, "%6d  %-9s %5d %7s %7s %6d %6s\n", i, typeName, getNumKeys(page), "-", "-", (hashBucketCapacity-int(getNumKeys(page)))*16, "-")
+			continue
+		}
+		if page[nodeTypeOffset] == NodeTypeTermDictionary {
+			fmt.Fprintf(w, "%6d  %-9s %5d %7s %7d %6s %6s\n", i, typeName, getNumKeys(page), "-", getNextLeafPageID(page), "-", "-")
+			continue
+		}
+		if page[nodeTypeOffset] == NodeTypePostings {
+			fmt.Fprintf(w, "%6d  %-9s %5d %7s %7d %6d %6s\n", i, typeName, getNumKeys(page), "-", getNextLeafPageID(page), (postingsPerPage-int(getNumKeys(page)))*8, "-")
+			continue
+		}
+		if page[nodeTypeOffset] == NodeTypeRTree {
+			fmt.Fprintf(w, "%6d  %-9s %5d %7s %7s %6d %6s\n", i, typeName, getNumKeys(page), "-", "-", (rtreeMaxEntries-int(getNumKeys(page)))*rtreeEntrySize, "-")
+			continue
+		}
+		if page[nodeTypeOffset] == NodeTypeCOWMeta {
+			fmt.Fprintf(w, "%6d  %-9s %5s %7s %7s %6s %6s\n", i, typeName, "-", "-", "-", "-", "-")
+			continue
+		}
+		if page[nodeTypeOffset] == NodeTypeCOWLeaf || page[nodeTypeOffset] == NodeTypeCOWInternal {
+			fmt.Fprintf(w, "%6d  %-9s %5d %7s %7s %6s %6s\n", i, typeName, getNumKeys(page), "-", "-", "-", "-")
+			continue
+		}
+		if page[nodeTypeOffset] == NodeTypeShadowMeta {
+			fmt.Fprintf(w, "%6d  %-9s %5s %7s %7s %6s %6s\n", i, typeName, "-", "-", "-", "-", "-")
+			continue
+		}
+		if page[nodeTypeOffset] == NodeTypePageTable {
+			fmt.Fprintf(w, "%6d  %-9s %5d %7s %7s %6d %6s\n", i, typeName, getNumKeys(page), "-", "-", (pageTableEntries-int(getNumKeys(page)))*8, "-")
+			continue
+		}
+		next := "-"
+		if isLeaf(page) {
+			next = strconv.FormatInt(int64(getNextLeafPageID(page)), 10)
+		}
+		fmt.Fprintf(w, "%6d  %-9s %5d %7d %7s %6d %6d\n", i, typeName, getNumKeys(page), getParentPageID(page), next, freeSpace(page), getFragmentedBytes(page))
+	}
+	fmt.Fprintln(w, "(* marks the root; overflow pages show the unused payload bytes as free)")
+	return nil
+}
+
+// writeDot writes the tree reachable from the root as a Graphviz digraph: one record node per page
+// holding its keys, solid edges to children and dashed edges along the leaf chain.
+func writeDot(w io.Writer, tree *BPlusTree) error {
+	fmt.Fprintln(w, "digraph btree {")
+	fmt.Fprintln(w, "  node [shape=record];")
+	var leaves []PageID
+	for level := []PageID{tree.rootPageID}; len(level) > 0; {
+		var next []PageID
+		for _, pageID := range level {
+			page, err := tree.readPage(pageID)
+			if err != nil {
+				return err
+			}
+			var keys []int
+			var children []PageID
+			if isLeaf(page) {
+				keys, _ = readLeafEntries(page)
+				leaves = append(leaves, pageID)
+			} else {
+				keys, children, _ = readInternalEntries(page)
+			}
+			label := fmt.Sprintf("page %d", pageID)
+			for _, k := range keys {
+				label += fmt.Sprintf("|%d", k)
+			}
+			fmt.Fprintf(w, "  p%d [label=\"%s\"];\n", pageID, label)
+			for _, child := range children {
+				fmt.Fprintf(w, "  p%d -> p%d;\n", pageID, child)
+			}
+			next = append(next, children...)
+		}
+		level = next
+	}
+	for i := 1; i < len(leaves); i++ {
+		fmt.Fprintf(w, "  p%d -> p%d [style=dashed, constraint=false];\n", leaves[i-1], leaves[i])
+	}
+	fmt.Fprintln(w, "}")
+	return nil
+}
+
+// inspectCommand implements `go run . inspect <command> ...`.
+func inspectCommand(args []string) error {
+	const usage = "usage: inspect pages|page|verify|stats|dot [-degree N] <file> [page id]"
+	if len(args) == 0 {
+		return errors.New(usage)
+	}
+	command := args[0]
+	flags := flag.NewFlagSet("inspect "+command, flag.ExitOnError)
+	degree := flags.Int("degree", 0, "degree the index was built with (0 means the one in its header, or MaxDegree)")
+	flags.Parse(args[1:])
+	if flags.NArg() < 1 {
+		return errors.New(usage)
+	}
+	path := flags.Arg(0)
+
+	switch command {
+	case "pages":
+		pager, err := openIndexFile(path)
+		if err != nil {
+			return err
+		}
+		defer pager.Close()
+		return inspectPages(os.Stdout, pager)
+	case "page":
+		if flags.NArg() < 2 {
+			return errors.New("usage: inspect page <file> <page id>")
+		}
+		pageID, err := strconv.ParseInt(flags.Arg(1), 10, 64)
+		if err != nil {
+			return fmt.Errorf("bad page id %q: %w", flags.Arg(1), err)
+		}
+		pager, err := openIndexFile(path)
+		if err != nil {
+			return err
+		}
+		defer pager.Close()
+		page, err := pager.ReadPage(PageID(pageID), new(Page))
+		if err != nil {
+			return err
+		}
+		describePage(os.Stdout, PageID(pageID), page)
+		fmt.Println()
+		hexDump(os.Stdout, page[:])
+		return nil
+	case "verify":
+		tree, pager, err := openIndexTree(path, *degree)
+		if err != nil {
+			return err
+		}
+		defer pager.Close()
+		if err := checkInvariants(tree); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		fmt.Printf("%s: ok, root is page %d\n", path, tree.rootPageID)
+		return nil
+	case "stats":
+		tree, pager, err := openIndexTree(path, *degree)
+		if err != nil {
+			return err
+		}
+		defer pager.Close()
+		stats, err := tree.Stats()
+		if err != nil {
+			return err
+		}
+		fmt.Println(stats)
+		return nil
+	case "dot":
+		tree, pager, err := openIndexTree(path, *degree)
+		if err != nil {
+			return err
+		}
+		defer pager.Close()
+		return writeDot(os.Stdout, tree)
+	default:
+		return fmt.Errorf("unknown inspect command %q (available: pages, page, verify, stats, dot)", command)
+	}
+}
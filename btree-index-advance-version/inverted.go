@@ -0,0 +1,517 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// =================================================================================================
+// --- inverted.go --- (Inverted Index)
+// =================================================================================================
+
+// The B+ tree and the hash index find the row of a key. An inverted index finds the rows of a word,
+// the way a search engine does: a tokenizer splits the text of a column into terms, and every term
+// maps to its postings list, the sorted TIDs of the rows whose text contains it. A query with
+// several terms combines their lists: AND intersects them, OR merges them. Both walk the sorted
+// lists side by side, and an intersection starts from the shortest list, since its result can't
+// be any longer.
+//
+// A TID (tuple ID) is the address of a row, which in this repository is the byte offset at which
+// the row starts in the data file, the same value the B+ tree stores.
+//
+// The index lives in pages of a PageStore of its own. Page 0 is the first page of the term
+// dictionary; further dictionary pages are chained from it through the next-leaf slot of the
+// header. The dictionary is kept in memory while the index is open and is written back by Flush
+// and Close, while postings pages are written as they change, so an index that wasn't closed
+// should be rebuilt.
+//
+// Dictionary page layout:
+//
+//	| header (32 bytes) | term length uint8 | term | first page int64 | last page int64 | count uint32 | ... |
+//
+// The node type is NodeTypeTermDictionary and numKeys is the number of terms on the page.
+//
+// Postings page layout:
+//
+//	| header (32 bytes) | TID int64 ... |
+//
+// The node type is NodeTypePostings, numKeys is the number of TIDs and the next-leaf slot links to
+// the next page of the list. Rows are usually added in file order, which appends to the last page
+// of each list; a smaller TID is inserted in place, rewriting the list from the page it goes in.
+
+const (
+	NodeTypeTermDictionary = 7
+	NodeTypePostings       = 8
+)
+
+// TID identifies a row by the offset at which it starts in the data file.
+type TID = int64
+
+const (
+	postingsPerPage = (PageSize - headerSize) / 8
+	// maxTermLength bounds the length of a term in bytes. Longer words are cut at a rune boundary.
+	maxTermLength = 64
+	// dictionaryEntrySize is the size of a dictionary entry without its term.
+	dictionaryEntrySize = 1 + 8 + 8 + 4
+)
+
+// postingsList locates the postings pages of a term.
+type postingsList struct {
+	first, last PageID
+	count       int
+}
+
+// InvertedIndex maps the terms of a text column to the rows containing them. Like the B+ tree, it
+// is not safe for concurrent use.
+type InvertedIndex struct {
+	pager     PageStore
+	pool      *BufferPool
+	terms     map[string]*postingsList // the term dictionary
+	dictPages []PageID                 // the dictionary pages, starting with page 0
+	dirty     bool                     // whether terms has changed since the dictionary was written
+	tracer    Tracer
+}
+
+// OpenInvertedIndex opens the inverted index stored in pager, or creates an empty one in an empty
+// pager.
+func OpenInvertedIndex(pager PageStore) (*InvertedIndex, error) {
+	x := &InvertedIndex{pager: pager, pool: NewBufferPool(pager, defaultBufferPoolFrames), terms: make(map[string]*postingsList)}
+	if pager.NumPages() == 0 {
+		x.dictPages = []PageID{pager.AllocatePage()}
+		x.dirty = true
+		return x, x.Flush()
+	}
+	return x, x.loadDictionary()
+}
+
+// BufferPool returns the pool caching the index's pages.
+func (x *InvertedIndex) BufferPool() *BufferPool {
+	return x.pool
+}
+
+// SetTracer installs a tracer on the index. It reports postings page reads and writes. Passing nil
+// disables tracing.
+func (x *InvertedIndex) SetTracer(tracer Tracer) {
+	x.tracer = tracer
+}
+
+// NumTerms returns the number of distinct terms in the index.
+func (x *InvertedIndex) NumTerms() int {
+	return len(x.terms)
+}
+
+// Tokenize splits text into lower-case terms: maximal runs of letters and digits. Everything else,
+// such as spaces, punctuation and the @ and dots of an email address, separates terms.
+func Tokenize(text string) []string {
+	terms := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for i, term := range terms {
+		for len(term) > maxTermLength {
+			_, size := utf8.DecodeLastRuneInString(term)
+			term = term[:len(term)-size]
+		}
+		terms[i] = term
+	}
+	return terms
+}
+
+// uniqueTerms returns the distinct terms of text, sorted.
+func uniqueTerms(text string) []string {
+	terms := Tokenize(text)
+	slices.Sort(terms)
+	return slices.Compact(terms)
+}
+
+// --- Pages ---
+
+func newPostingsPage() *Page {
+	page := new(Page)
+	page[nodeTypeOffset] = NodeTypePostings
+	setNextLeafPageID(page, -1)
+	return page
+}
+
+func postingAt(page *Page, i int) TID {
+	return TID(binary.LittleEndian.Uint64(page[headerSize+i*8:]))
+}
+
+func setPostingAt(page *Page, i int, tid TID) {
+	binary.LittleEndian.PutUint64(page[headerSize+i*8:], uint64(tid))
+}
+
+func (x *InvertedIndex) readPostingsPage(pageID PageID) (*Page, error) {
+	if x.tracer != nil {
+		x.tracer.OnPageRead(pageID)
+	}
+	page, err := x.pool.ReadPage(pageID, new(Page))
+	if err != nil {
+		return nil, err
+	}
+	if page[nodeTypeOffset] != NodeTypePostings || int(getNumKeys(page)) > postingsPerPage {
+		return nil, fmt.Errorf("%w: page %d is not a postings page", ErrCorruptPage, pageID)
+	}
+	return page, nil
+}
+
+func (x *InvertedIndex) writePostingsPage(pageID PageID, page *Page) error {
+	if x.tracer != nil {
+		x.tracer.OnPageWrite(pageID)
+	}
+	return x.pool.WritePage(pageID, page)
+}
+
+// loadDictionary reads the term dictionary from the dictionary pages.
+func (x *InvertedIndex) loadDictionary() error {
+	for pageID := PageID(0); pageID != -1; {
+		page, err := x.pool.ReadPage(pageID, new(Page))
+		if err != nil {
+			return err
+		}
+		if page[nodeTypeOffset] != NodeTypeTermDictionary {
+			return fmt.Errorf("%w: page %d is not a term dictionary page", ErrCorruptPage, pageID)
+		}
+		x.dictPages = append(x.dictPages, pageID)
+		offset := headerSize
+		for i := 0; i < int(getNumKeys(page)); i++ {
+			if offset+dictionaryEntrySize > PageSize || int(page[offset]) > maxTermLength ||
+				offset+dictionaryEntrySize+int(page[offset]) > PageSize {
+				return fmt.Errorf("%w: term dictionary page %d overruns the page", ErrCorruptPage, pageID)
+			}
+			termLength := int(page[offset])
+			term := string(page[offset+1 : offset+1+termLength])
+			offset += 1 + termLength
+			x.terms[term] = &postingsList{
+				first: PageID(binary.LittleEndian.Uint64(page[offset:])),
+				last:  PageID(binary.LittleEndian.Uint64(page[offset+8:])),
+				count: int(binary.LittleEndian.Uint32(page[offset+16:])),
+			}
+			offset += 20
+		}
+		pageID = getNextLeafPageID(page)
+	}
+	return nil
+}
+
+// writeDictionary writes the whole term dictionary, in term order, allocating pages for a
+// dictionary that has grown. Terms are never removed, so it never shrinks.
+func (x *InvertedIndex) writeDictionary() error {
+	terms := make([]string, 0, len(x.terms))
+	for term := range x.terms {
+		terms = append(terms, term)
+	}
+	slices.Sort(terms)
+
+	var pages []*Page
+	page := new(Page)
+	offset := headerSize
+	for _, term := range terms {
+		if offset+dictionaryEntrySize+len(term) > PageSize {
+			pages = append(pages, page)
+			page, offset = new(Page), headerSize
+		}
+		list := x.terms[term]
+		page[offset] = byte(len(term))
+		offset += 1 + copy(page[offset+1:], term)
+		binary.LittleEndian.PutUint64(page[offset:], uint64(list.first))
+		binary.LittleEndian.PutUint64(page[offset+8:], uint64(list.last))
+		binary.LittleEndian.PutUint32(page[offset+16:], uint32(list.count))
+		offset += 20
+		setNumKeys(page, getNumKeys(page)+1)
+	}
+	pages = append(pages, page)
+
+	for len(x.dictPages) < len(pages) {
+		x.dictPages = append(x.dictPages, x.pager.AllocatePage())
+	}
+	// Write the pages back to front, so a page is never linked before it's written.
+	for i := len(pages) - 1; i >= 0; i-- {
+		pages[i][nodeTypeOffset] = NodeTypeTermDictionary
+		setNextLeafPageID(pages[i], -1)
+		if i+1 < len(pages) {
+			setNextLeafPageID(pages[i], x.dictPages[i+1])
+		}
+		if err := x.pool.WritePage(x.dictPages[i], pages[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// --- Operations ---
+
+// Add indexes the text of the row tid under each of its terms. Adding a row to a term again
+// does nothing.
+func (x *InvertedIndex) Add(tid TID, text string) error {
+	for _, term := range uniqueTerms(text) {
+		if err := x.addPosting(term, tid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addPosting adds tid to the postings list of term.
+func (x *InvertedIndex) addPosting(term string, tid TID) error {
+	list := x.terms[term]
+	if list == nil {
+		pageID := x.pager.AllocatePage()
+		page := newPostingsPage()
+		setPostingAt(page, 0, tid)
+		setNumKeys(page, 1)
+		if err := x.writePostingsPage(pageID, page); err != nil {
+			return err
+		}
+		x.terms[term] = &postingsList{first: pageID, last: pageID, count: 1}
+		x.dirty = true
+		return nil
+	}
+
+	last, err := x.readPostingsPage(list.last)
+	if err != nil {
+		return err
+	}
+	n := int(getNumKeys(last))
+	if n > 0 && tid <= postingAt(last, n-1) {
+		return x.insertPosting(list, tid)
+	}
+	if n < postingsPerPage {
+		setPostingAt(last, n, tid)
+		setNumKeys(last, uint16(n+1))
+		if err := x.writePostingsPage(list.last, last); err != nil {
+			return err
+		}
+	} else {
+		// The last page is full: start a new one, and link it once it's written.
+		pageID := x.pager.AllocatePage()
+		page := newPostingsPage()
+		setPostingAt(page, 0, tid)
+		setNumKeys(page, 1)
+		if err := x.writePostingsPage(pageID, page); err != nil {
+			return err
+		}
+		setNextLeafPageID(last, pageID)
+		if err := x.writePostingsPage(list.last, last); err != nil {
+			return err
+		}
+		list.last = pageID
+	}
+	list.count++
+	x.dirty = true
+	return nil
+}
+
+// insertPosting inserts a TID smaller than the last one of the list in its place. The pages from
+// the one it goes in are rewritten with their TIDs shifted by one, and a page is added at the end
+// if the last one overflows.
+func (x *InvertedIndex) insertPosting(list *postingsList, tid TID) error {
+	var pageIDs []PageID
+	var tids []TID
+	start := -1 // index in pageIDs of the page tid goes in
+	for pageID := list.first; pageID != -1; {
+		page, err := x.readPostingsPage(pageID)
+		if err != nil {
+			return err
+		}
+		n := int(getNumKeys(page))
+		if start == -1 && n > 0 && tid <= postingAt(page, n-1) {
+			start = len(pageIDs)
+		}
+		if start != -1 {
+			for i := 0; i < n; i++ {
+				tids = append(tids, postingAt(page, i))
+			}
+		}
+		pageIDs = append(pageIDs, pageID)
+		pageID = getNextLeafPageID(page)
+	}
+	i, found := slices.BinarySearch(tids, tid)
+	if found {
+		return nil
+	}
+	tids = slices.Insert(tids, i, tid)
+
+	// Every page but the last is full, so the TIDs fill the same pages again, plus a new one if the
+	// last page overflows.
+	pageIDs = pageIDs[start:]
+	if len(tids) > len(pageIDs)*postingsPerPage {
+		pageIDs = append(pageIDs, x.pager.AllocatePage())
+	}
+	for p := len(pageIDs) - 1; p >= 0; p-- {
+		page := newPostingsPage()
+		chunk := tids[p*postingsPerPage : min((p+1)*postingsPerPage, len(tids))]
+		for j, t := range chunk {
+			setPostingAt(page, j, t)
+		}
+		setNumKeys(page, uint16(len(chunk)))
+		if p+1 < len(pageIDs) {
+			setNextLeafPageID(page, pageIDs[p+1])
+		}
+		if err := x.writePostingsPage(pageIDs[p], page); err != nil {
+			return err
+		}
+	}
+	list.last = pageIDs[len(pageIDs)-1]
+	list.count++
+	x.dirty = true
+	return nil
+}
+
+// readPostings returns the whole postings list of a term.
+func (x *InvertedIndex) readPostings(list *postingsList) ([]TID, error) {
+	tids := make([]TID, 0, list.count)
+	for pageID := list.first; pageID != -1; {
+		page, err := x.readPostingsPage(pageID)
+		if err != nil {
+			return nil, err
+		}
+		for i := 0; i < int(getNumKeys(page)); i++ {
+			tids = append(tids, postingAt(page, i))
+		}
+		pageID = getNextLeafPageID(page)
+	}
+	return tids, nil
+}
+
+// MatchAll returns the TIDs of the rows containing every term of query (an AND query), in
+// ascending order.
+func (x *InvertedIndex) MatchAll(query string) ([]TID, error) {
+	terms := uniqueTerms(query)
+	if len(terms) == 0 {
+		return nil, nil
+	}
+	lists := make([]*postingsList, len(terms))
+	for i, term := range terms {
+		if lists[i] = x.terms[term]; lists[i] == nil {
+			return nil, nil // no row has this term, so none has them all
+		}
+	}
+	slices.SortFunc(lists, func(a, b *postingsList) int { return a.count - b.count })
+
+	result, err := x.readPostings(lists[0])
+	if err != nil {
+		return nil, err
+	}
+	for _, list := range lists[1:] {
+		if len(result) == 0 {
+			break
+		}
+		tids, err := x.readPostings(list)
+		if err != nil {
+			return nil, err
+		}
+		result = intersectPostings(result, tids)
+	}
+	return result, nil
+}
+
+// MatchAny returns the TIDs of the rows containing at least one term of query (an OR query), in
+// ascending order.
+func (x *InvertedIndex) MatchAny(query string) ([]TID, error) {
+	var result []TID
+	for _, term := range uniqueTerms(query) {
+		list := x.terms[term]
+		if list == nil {
+			continue
+		}
+		tids, err := x.readPostings(list)
+		if err != nil {
+			return nil, err
+		}
+		result = unionPostings(result, tids)
+	}
+	return result, nil
+}
+
+// intersectPostings returns the TIDs in both sorted lists.
+func intersectPostings(a, b []TID) []TID {
+	var result []TID
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			result = append(result, a[i])
+			i++
+			j++
+		}
+	}
+	return result
+}
+
+// unionPostings returns the TIDs in either sorted list, once each.
+func unionPostings(a, b []TID) []TID {
+	result := make([]TID, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] < b[j]:
+			result = append(result, a[i])
+			i++
+		case a[i] > b[j]:
+			result = append(result, b[j])
+			j++
+		default:
+			result = append(result, a[i])
+			i++
+			j++
+		}
+	}
+	result = append(result, a[i:]...)
+	return append(result, b[j:]...)
+}
+
+// Flush writes the term dictionary, if it has changed, and the pages cached by the buffer pool.
+func (x *InvertedIndex) Flush() error {
+	if x.dirty {
+		if err := x.writeDictionary(); err != nil {
+			return err
+		}
+		x.dirty = false
+	}
+	return x.pool.Flush()
+}
+
+// Close flushes the index. It doesn't close the PageStore.
+func (x *InvertedIndex) Close() error {
+	if err := x.Flush(); err != nil {
+		return err
+	}
+	return x.pool.Close()
+}
+
+// IndexTextColumn adds every row of a CSV data file to the index, under the terms of the named
+// column, and returns the number of rows indexed.
+func IndexTextColumn(x *InvertedIndex, dataPath string, schema CSVSchema, column string) (int, error) {
+	col := slices.IndexFunc(schema.Columns, func(c Column) bool { return c.Name == column })
+	if col == -1 {
+		return 0, fmt.Errorf("column %q is not in the schema", column)
+	}
+	source, err := NewCSVSource(dataPath, schema)
+	if err != nil {
+		return 0, err
+	}
+	defer source.Close()
+	rows := 0
+	for {
+		fields, offset, err := source.nextRow()
+		if errors.Is(err, io.EOF) {
+			return rows, x.Flush()
+		}
+		if err != nil {
+			return rows, err
+		}
+		if err := x.Add(offset, fields[col]); err != nil {
+			return rows, err
+		}
+		rows++
+	}
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"math"
+	"slices"
+	"sync"
+	"time"
+)
+
+// =================================================================================================
+// --- kv.go --- (Key-Value Store)
+// =================================================================================================
+
+// KVStore packages a DB (index, heap file and write-ahead log) as an embedded key-value store with
+// byte-slice keys and values, in the spirit of bbolt:
+//
+//	store, err := OpenKVStore("data/users")  // data/users.idx, .dat and .wal
+//	store.Put([]byte("user:42"), []byte("zoe"))
+//	value, found, err := store.Get([]byte("user:42"))
+//	store.Scan([]byte("user:"), func(key, value []byte) error { ... })
+//
+// The tree's keys are ints, so a byte key is mapped to an int made of two halves (see groupKey):
+// the high 32 bits are its first 4 bytes, padded with zero bytes, and the low 32 bits a hash of
+// the whole key. The keys that map to the same int form a group, one heap row holding the group's
+// entries, sorted by key. Two keys only share a group if their hashes collide as well as their
+// first bytes, so a group holds a single key but for the odd collision, however many keys share
+// a prefix. The high half keeps the order of the keys between runs of groups that share their
+// first 4 bytes, but not within a run, so Scan sorts the entries of each run before it returns
+// them.
+//
+// Every Put and Delete is a transaction of its own: it rewrites the row of the key's group and
+// commits. The heap file is append-only, so the old row stays behind in it. A row must fit in a
+// WAL record (walMaxDataSize) once base64-encoded, which bounds the size of a single value.
+//
+// Buckets are separate keyspaces in the same files, each with its own tree. Their roots are kept
+// in the catalog page (see catalog.go). An entry can also expire (see ttl.go).
+
+var (
+	errEmptyKey     = errors.New("key must not be empty")
+	errCorruptGroup = errors.New("corrupt key-value group row")
+)
+
+// KVStore is an embedded key-value store. Its methods are safe for concurrent use; they run one at
+// a time.
+type KVStore struct {
+	db *DB
+
+	// The expiry sweeper, if it runs (see ttl.go).
+	sweeperMu                   sync.Mutex
+	stopSweeper, sweeperStopped chan struct{}
+}
+
+// kvEntry is a key-value pair in a group.
+type kvEntry struct {
+	key, value []byte
+	expires    int64 // when the entry expires, in Unix nanoseconds, or 0 if it doesn't
+}
+
+// OpenKVStore opens the store kept in path.idx, path.dat and path.wal, creating the files if they
+// don't exist.
+func OpenKVStore(path string) (*KVStore, error) {
+	db, err := OpenDB(path+".idx", path+".dat", path+".wal", 0)
+	if err != nil {
+		return nil, err
+	}
+	return &KVStore{db: db}, nil
+}
+
+// groupKey returns the tree key of the group holding key: its first 4 bytes in the high 32 bits
+// and the FNV-1a hash of the whole key in the low 32 bits, read as a big-endian uint64 with the
+// sign bit flipped so that ints sort as the unsigned numbers do.
+func groupKey(key []byte) int {
+	h := fnv.New32a()
+	h.Write(key)
+	return groupRunKey(key) | int(h.Sum32())
+}
+
+// groupRunKey returns the lowest tree key of the run of groups whose keys start with the first 4
+// bytes of key, padded with zero bytes.
+func groupRunKey(key []byte) int {
+	var prefix [4]byte
+	copy(prefix[:], key)
+	return int(uint64(binary.BigEndian.Uint32(prefix[:]))<<32 ^ 1<<63)
+}
+
+// sameGroupRun reports whether the tree keys a and b are in the same run of groups.
+func sameGroupRun(a, b int) bool {
+	return a>>32 == b>>32
+}
+
+// encodeGroup encodes a group's entries as a heap row. Rows can't contain newlines, so the
+// length-prefixed entries are base64-encoded. If any entry expires, the row starts with a zero
+// byte, which can't start a key's length, and every entry ends with its expiration time.
+func encodeGroup(entries []kvEntry) []byte {
+	withExpiry := slices.ContainsFunc(entries, func(e kvEntry) bool { return e.expires != 0 })
+	var buf []byte
+	if withExpiry {
+		buf = append(buf, 0)
+	}
+	for _, e := range entries {
+		buf = binary.AppendUvarint(buf, uint64(len(e.key)))
+		buf = append(buf, e.key...)
+		buf = binary.AppendUvarint(buf, uint64(len(e.value)))
+		buf = append(buf, e.value...)
+		if withExpiry {
+			buf = binary.AppendUvarint(buf, uint64(e.expires))
+		}
+	}
+	return []byte(base64.StdEncoding.EncodeToString(buf))
+}
+
+// decodeGroup decodes a heap row written by encodeGroup.
+func decodeGroup(row string) ([]kvEntry, error) {
+	buf, err := base64.StdEncoding.DecodeString(row)
+	if err != nil {
+		return nil, errCorruptGroup
+	}
+	withExpiry := len(buf) > 0 && buf[0] == 0
+	if withExpiry {
+		buf = buf[1:]
+	}
+	var entries []kvEntry
+	for len(buf) > 0 {
+		var e kvEntry
+		for _, field := range []*[]byte{&e.key, &e.value} {
+			n, size := binary.Uvarint(buf)
+			if size <= 0 || uint64(len(buf)-size) < n {
+				return nil, errCorruptGroup
+			}
+			*field = buf[size : size+int(n)]
+			buf = buf[size+int(n):]
+		}
+		if withExpiry {
+			expires, size := binary.Uvarint(buf)
+			if size <= 0 {
+				return nil, errCorruptGroup
+			}
+			e.expires = int64(expires)
+			buf = buf[size:]
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// searchGroup returns the position of key in a group's entries, or where it would be inserted.
+func searchGroup(entries []kvEntry, key []byte) (int, bool) {
+	return slices.BinarySearchFunc(entries, key, func(e kvEntry, key []byte) int { return bytes.Compare(e.key, key) })
+}
+
+// readGroup returns the entries of the group stored under the tree key g.
+func readGroup(tx *Tx, g int) ([]kvEntry, error) {
+	row, found, err := tx.Get(g)
+	if err != nil || !found {
+		return nil, err
+	}
+	return decodeGroup(row)
+}
+
+// writeGroup replaces the group stored under the tree key g. An empty group is removed.
+func writeGroup(tx *Tx, g int, entries []kvEntry) error {
+	if _, err := tx.Delete(g); err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	return tx.Insert(g, encodeGroup(entries))
+}
+
+// Bucket is a named keyspace of a KVStore, stored in a B+ tree of its own in the same files.
+// The store's own Put, Get, Delete and Scan work on the main tree, outside any bucket.
+type Bucket struct {
+	store *KVStore
+	name  string // "" for the main tree
+}
+
+// CreateBucket adds an empty bucket to the store.
+func (s *KVStore) CreateBucket(name string) (*Bucket, error) {
+	tx := s.db.Begin()
+	if err := s.db.tree.createBucket(name); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &Bucket{store: s, name: name}, nil
+}
+
+// Bucket returns the named bucket, or ErrBucketNotFound.
+func (s *KVStore) Bucket(name string) (*Bucket, error) {
+	tx := s.db.Begin()
+	defer tx.Rollback()
+	if _, err := s.db.tree.bucketRoot(name); err != nil {
+		return nil, err
+	}
+	return &Bucket{store: s, name: name}, nil
+}
+
+// DeleteBucket removes the named bucket and its keys. Its pages stay in the files, unused.
+func (s *KVStore) DeleteBucket(name string) error {
+	tx := s.db.Begin()
+	if err := s.db.tree.deleteBucket(name); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Buckets returns the names of the store's buckets, in the order they were created.
+func (s *KVStore) Buckets() ([]string, error) {
+	tx := s.db.Begin()
+	defer tx.Rollback()
+	entries, err := s.db.tree.buckets()
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(entries))
+	for i, e := range entries {
+		names[i] = e.name
+	}
+	return names, nil
+}
+
+// begin starts a transaction on the bucket's tree. The DB has a single BPlusTree, so a bucket is
+// opened by pointing the tree at the bucket's root for the length of the transaction. Rollback
+// points it back at the main tree's root.
+func (b *Bucket) begin() (*Tx, error) {
+	tx := b.store.db.Begin()
+	if b.name == "" {
+		return tx, nil
+	}
+	root, err := b.store.db.tree.bucketRoot(b.name)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	b.store.db.tree.rootPageID = root
+	tx.bucket = b.name
+	return tx, nil
+}
+
+// commit records the bucket's root in the catalog if a split or merge moved it, points the tree
+// back at the main tree's root and commits the transaction.
+func (b *Bucket) commit(tx *Tx) error {
+	tree := b.store.db.tree
+	if b.name != "" {
+		root, err := tree.bucketRoot(b.name)
+		if err == nil && root != tree.rootPageID {
+			err = tree.setBucketRoot(b.name, tree.rootPageID)
+		}
+		tree.rootPageID = tx.rootPageID
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Put stores value under key in the main tree, replacing the value stored before, if any.
+func (s *KVStore) Put(key, value []byte) error {
+	return (&Bucket{store: s}).Put(key, value)
+}
+
+// Get returns the value stored under key in the main tree.
+func (s *KVStore) Get(key []byte) ([]byte, bool, error) {
+	return (&Bucket{store: s}).Get(key)
+}
+
+// Delete removes key from the main tree and reports whether it was there.
+func (s *KVStore) Delete(key []byte) (bool, error) {
+	return (&Bucket{store: s}).Delete(key)
+}
+
+// Scan calls fn for every key in the main tree that starts with prefix (see Bucket.Scan).
+func (s *KVStore) Scan(prefix []byte, fn func(key, value []byte) error) error {
+	return (&Bucket{store: s}).Scan(prefix, fn)
+}
+
+// Put stores value under key, replacing the value stored before, if any.
+func (b *Bucket) Put(key, value []byte) error {
+	if len(key) == 0 {
+		return errEmptyKey
+	}
+	tx, err := b.begin()
+	if err != nil {
+		return err
+	}
+	if err := putEntry(tx, key, value, 0); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return b.commit(tx)
+}
+
+// putEntry stores value under key in the tree tx works on, as part of tx, to expire at expires,
+// in Unix nanoseconds, or never if it is 0.
+func putEntry(tx *Tx, key, value []byte, expires int64) error {
+	g := groupKey(key)
+	entries, err := readGroup(tx, g)
+	if err != nil {
+		return err
+	}
+	i, found := searchGroup(entries, key)
+	if found {
+		entries[i].value, entries[i].expires = value, expires
+	} else {
+		entries = slices.Insert(entries, i, kvEntry{key, value, expires})
+	}
+	return writeGroup(tx, g, entries)
+}
+
+// Get returns the value stored under key.
+func (b *Bucket) Get(key []byte) ([]byte, bool, error) {
+	tx, err := b.begin()
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback()
+	entries, err := readGroup(tx, groupKey(key))
+	if err != nil {
+		return nil, false, err
+	}
+	i, found := searchGroup(entries, key)
+	if !found || entries[i].expired(time.Now()) {
+		return nil, false, nil
+	}
+	return entries[i].value, true, nil
+}
+
+// Delete removes key and reports whether it was there.
+func (b *Bucket) Delete(key []byte) (bool, error) {
+	tx, err := b.begin()
+	if err != nil {
+		return false, err
+	}
+	found, err := deleteEntry(tx, key)
+	if err != nil || !found {
+		tx.Rollback()
+		return false, err
+	}
+	return true, b.commit(tx)
+}
+
+// deleteEntry removes key from the tree tx works on, as part of tx, and reports whether it was
+// there. An expired key isn't.
+func deleteEntry(tx *Tx, key []byte) (bool, error) {
+	g := groupKey(key)
+	entries, err := readGroup(tx, g)
+	if err != nil {
+		return false, err
+	}
+	i, found := searchGroup(entries, key)
+	if !found || entries[i].expired(time.Now()) {
+		return false, nil
+	}
+	return true, writeGroup(tx, g, slices.Delete(entries, i, i+1))
+}
+
+// Scan calls fn for every key that starts with prefix, in byte-wise key order, and stops at the
+// first error fn returns. An empty prefix scans every key. The store is locked while Scan runs,
+// so fn must not call the store's other methods. The entries of one run of groups, the keys that
+// share their first 4 bytes, are held in memory to be sorted.
+func (b *Bucket) Scan(prefix []byte, fn func(key, value []byte) error) error {
+	// The groups that can hold keys with the prefix are those from the run of the prefix padded
+	// with zero bytes to the end of the run of the prefix padded with 0xff bytes.
+	low, high := math.MinInt, math.MaxInt
+	if len(prefix) > 0 {
+		padded := []byte{0xff, 0xff, 0xff, 0xff}
+		copy(padded, prefix)
+		low, high = groupRunKey(prefix), groupRunKey(padded)|math.MaxUint32
+	}
+
+	tx, err := b.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	db := b.store.db
+	now := time.Now()
+	c, err := db.tree.Seek(low)
+	if err != nil {
+		return err
+	}
+	// The entries of the current run of groups, returned sorted once the run ends.
+	var run []kvEntry
+	flush := func() error {
+		slices.SortFunc(run, func(a, b kvEntry) int { return bytes.Compare(a.key, b.key) })
+		for _, e := range run {
+			if err := fn(e.key, e.value); err != nil {
+				return err
+			}
+		}
+		run = run[:0]
+		return nil
+	}
+	runKey := low
+	for c.Next() && c.Key() <= high {
+		if !sameGroupRun(c.Key(), runKey) {
+			if err := flush(); err != nil {
+				return err
+			}
+			runKey = c.Key()
+		}
+		row, err := db.heap.ReadRow(c.Value())
+		if err != nil {
+			return err
+		}
+		entries, err := decodeGroup(row)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if bytes.HasPrefix(e.key, prefix) && !e.expired(now) {
+				run = append(run, e)
+			}
+		}
+	}
+	if err := c.Err(); err != nil {
+		return err
+	}
+	return flush()
+}
+
+// Close stops the expiry sweeper, if it runs, and closes the store's files.
+func (s *KVStore) Close() error {
+	s.StopSweeper()
+	return s.db.Close()
+}
@@ -2,75 +2,22 @@ package main
 
 import (
 	"bufio"
-	"encoding/binary"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"math/rand"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 // =================================================================================================
 // --- main.go --- (Demonstration)
 // =================================================================================================
 
-// visualizeIndexFile reads the binary index file and prints its structure.
-func visualizeIndexFile(indexFilePath string) error {
-	fmt.Println("\n--- Visualizing On-Disk Index File Structure ---")
-	pager, err := NewPager(indexFilePath)
-	if err != nil {
-		return err
-	}
-	defer pager.Close()
-	if pager.numPages == 0 {
-		fmt.Println("Index file is empty.")
-		return nil
-	}
-
-	for i := int64(0); i < pager.numPages; i++ {
-		pageID := PageID(i)
-		page, err := pager.ReadPage(pageID, new(Page))
-		if err != nil {
-			fmt.Printf("Error reading page %d: %v\n", pageID, err)
-			continue
-		}
-
-		nodeType := "INTERNAL"
-		if isLeaf(page) {
-			nodeType = "LEAF"
-		}
-		numKeys := getNumKeys(page)
-		parentID := getParentPageID(page)
-		fmt.Printf("\n[ Page %d | Type: %s | NumKeys: %d | ParentID: %d ]\n", pageID, nodeType, numKeys, parentID)
-
-		if isLeaf(page) {
-			nextID := getNextLeafPageID(page)
-			fmt.Printf("  - Header: NextLeafID -> %d\n", nextID)
-			fmt.Println("  - Content: [Key -> RecordOffset]")
-			for j := 0; j < int(numKeys); j++ {
-				offset := headerSize + j*(8+8)
-				key := binary.LittleEndian.Uint64(page[offset:])
-				value := binary.LittleEndian.Uint64(page[offset+8:])
-				fmt.Printf("    - %d -> %d\n", key, value)
-			}
-		} else {
-			fmt.Println("  - Content: [PtrToPageID | Key | PtrToPageID | ...]")
-			ptrOffset := headerSize
-			ptr := binary.LittleEndian.Uint64(page[ptrOffset:])
-			fmt.Printf("    - Ptr -> %d\n", ptr)
-			for j := 0; j < int(numKeys); j++ {
-				keyOffset := headerSize + j*(8+8) + 8
-				ptrOffset := keyOffset + 8
-				key := binary.LittleEndian.Uint64(page[keyOffset:])
-				ptr := binary.LittleEndian.Uint64(page[ptrOffset:])
-				fmt.Printf("    - Key: %d\n", key)
-				fmt.Printf("    - Ptr -> %d\n", ptr)
-			}
-		}
-	}
-	return nil
-}
-
 func readDataAtOffset(dataFilePath string, offset int64) (string, error) {
 	file, err := os.Open(dataFilePath)
 	if err != nil {
@@ -88,44 +35,46 @@ func readDataAtOffset(dataFilePath string, offset int64) (string, error) {
 	return string(line), nil
 }
 
-// buildTreeFromFile now uses the dynamic Insert function.
+// buildTreeFromFile indexes every row of users.csv by its id (see import.go).
 func buildTreeFromFile(tree *BPlusTree, dataFilePath string) error {
-	dataFile, err := os.Open(dataFilePath)
-	if err != nil {
-		return err
-	}
-	defer dataFile.Close()
-	reader := bufio.NewReader(dataFile)
-	var offset int64 = 0
-	line, _, err := reader.ReadLine()
-	if err != nil {
-		return err
-	}
-	offset += int64(len(line)) + 1
+	_, err := ImportCSV(tree, dataFilePath, usersSchema)
+	return err
+}
 
-	for {
-		line, _, err := reader.ReadLine()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return err
-		}
-		parts := strings.Split(string(line), ",")
-		if len(parts) > 0 {
-			id, convErr := strconv.Atoi(parts[0])
-			if convErr == nil {
-				if insertErr := tree.Insert(id, offset); insertErr != nil {
-					return insertErr
-				}
-			}
-		}
-		offset += int64(len(line)) + 1
+// runSubcommand dispatches the tool modes that run instead of the demo.
+func runSubcommand(name string, args []string) error {
+	switch name {
+	case "bench":
+		return benchCommand(args)
+	case "check":
+		return checkCommand(args)
+	case "inspect":
+		return inspectCommand(args)
+	case "raft":
+		return raftCommand(args)
+	case "replica":
+		return replicaCommand(args)
+	case "restore":
+		return restoreCommand(args)
+	case "serve":
+		return serveCommand(args)
+	case "simulate":
+		return simulateCommand(args)
+	default:
+		return fmt.Errorf("unknown command %q (available: bench, check, inspect, raft, replica, restore, serve, simulate)", name)
 	}
-	return nil
 }
 
 func main() {
+	// `go run . <command>` runs one of the tools instead of the demo below.
+	if len(os.Args) > 1 {
+		if err := runSubcommand(os.Args[1], os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	const dataFile = "users.csv"
 	const indexFile = "users_pk.idx"
 	// Let's use a small degree to force splits quickly for demonstration
@@ -140,9 +89,9 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
-	// We defer the close on the main function's pager to ensure the file is closed at the end.
-	defer pager.Close()
 	tree := NewBPlusTree(pager, degree)
+	// Closing the tree flushes it, records its root in the header and closes the pager.
+	defer tree.Close()
 
 	// --- Step 2: Build the B+ Tree index dynamically by inserting from users.csv ---
 	fmt.Println("--- Building B+ Tree index dynamically from users.csv ---")
@@ -152,7 +101,20 @@ func main() {
 	fmt.Println("Index build process finished.")
 
 	// --- Step 3: Visualize the final binary index file structure ---
-	visualizeIndexFile(indexFile)
+	visualizeIndexFile(pager)
+	stats, err := tree.Stats()
+	if err != nil {
+		panic(err)
+	}
+	fmt.Printf("\nIndex statistics: %v\n", stats)
+	validation, err := tree.ValidateAgainstData(dataFile, usersSchema)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Printf("Validated %d offsets against %s (%v): %d mismatches, changed since indexing: %v\n",
+		validation.Entries, dataFile, validation.Current, len(validation.Mismatches), validation.Changed())
+	fmt.Printf("Degree %d keeps the demo tree small enough to print. A %d-byte page fits degree %d for int64 values, or %d for 100-byte values.\n",
+		tree.Degree(), PageSize, MaxDegree, DegreeForValueSize(100))
 
 	// --- Step 4: Use the dynamically built index for queries ---
 	fmt.Println("\n--- Use Case 1: Point Search (Find user with id=12) ---")
@@ -168,6 +130,46 @@ func main() {
 	} else {
 		fmt.Printf("Key %d not found.\n", keyToFind)
 	}
+	if err := tree.Insert(keyToFind, offset); errors.Is(err, ErrDuplicateKey) {
+		fmt.Printf("Inserting id %d again is rejected: %v\n", keyToFind, err)
+	}
+	// Loading users.csv a second time would violate the unique constraint on every row.
+	if source, err := NewCSVSource(dataFile, usersSchema); err == nil {
+		_, err = BuildIndexWith(tree, source, BuildOptions{CollectViolations: true})
+		source.Close()
+		var violations ConstraintViolations
+		if errors.As(err, &violations) {
+			fmt.Printf("Reloading %s would insert nothing: %d violations, starting with %v\n", dataFile, len(violations), violations[0])
+		}
+	}
+
+	// Looking up every id in order: a finger starts each lookup from the previous leaf.
+	counter := &pageCounter{}
+	tree.SetTracer(counter)
+	for id := 1; id <= stats.Keys; id++ {
+		tree.Search(id)
+	}
+	fromRoot := counter.reads
+	counter.reads = 0
+	finger := tree.NewFinger()
+	for id := 1; id <= stats.Keys; id++ {
+		finger.Search(id)
+	}
+	tree.SetTracer(nil)
+	fmt.Printf("Looking up ids 1-%d in order reads %d pages from the root, %d with a finger.\n", stats.Keys, fromRoot, counter.reads)
+
+	// The same lookups as spans, the way a service tracing its requests would see them.
+	recorder := &SpanRecorder{}
+	tree.SetSpanTracer(recorder)
+	requestCtx, request := recorder.Start(context.Background(), "GET /users")
+	tree.SearchContext(requestCtx, keyToFind)
+	tree.SearchRangeContext(requestCtx, 5, 8)
+	request.End()
+	tree.SetSpanTracer(nil)
+	fmt.Println("Spans of a request that looks up id 12 and ids 5-8:")
+	for _, span := range recorder.Spans() {
+		fmt.Printf("  %v\n", span)
+	}
 
 	// --- Step 5: Use the Range Search implementation ---
 	fmt.Println("\n--- Use Case 2: Range Search (Find users with id between 5 and 8) ---")
@@ -180,4 +182,485 @@ func main() {
 		rowData, _ := readDataAtOffset(dataFile, off)
 		fmt.Printf("  - Data at offset %d: %s\n", off, rowData)
 	}
+	page, err := tree.SearchRangeLimit(5, 8, 2, 2)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Printf("Second page of the same range, two records per page (LIMIT 2 OFFSET 2): %v\n", page)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := tree.SearchRangeContext(ctx, 5, 8); err != nil {
+		fmt.Printf("The same range scan with a cancelled context stops with: %v\n", err)
+	}
+	agg, err := tree.AggregateRange(5, 8)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Printf("Aggregates over the same range, from the leaves alone: count=%d min=%d max=%d sum=%d\n",
+		agg.Count, agg.Min, agg.Max, agg.Sum)
+	rank, err := tree.Rank(12)
+	if err != nil {
+		panic(err)
+	}
+	median, _, err := tree.SelectNth(stats.Keys / 2)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Printf("Order statistics: %d ids are below 12, the median id is %d\n", rank, median)
+	minID, _, err := tree.Min()
+	if err != nil {
+		panic(err)
+	}
+	maxID, _, err := tree.Max()
+	if err != nil {
+		panic(err)
+	}
+	floor, _, err := tree.Floor(100)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Printf("Smallest id %d, largest id %d, largest id <= 100 is %d\n", minID, maxID, floor)
+	histogram, err := tree.BuildHistogram(4)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Printf("A 4-bucket histogram estimates %.1f records in range [5, 8].\n", histogram.EstimateRange(5, 8))
+
+	// The query layer picks the access path itself. The whole table fits in one page of
+	// users.csv, so reading it is cheaper than descending the index and then fetching each row.
+	users, err := NewTable("users", dataFile, tree)
+	if err != nil {
+		panic(err)
+	}
+	rows, plan, err := users.Select(5, 8)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Printf("EXPLAIN SELECT * FROM users WHERE id BETWEEN 5 AND 8:\n%s\n", plan.Explain())
+	fmt.Printf("The query returned %d rows.\n", len(rows))
+
+	// On a table of 10000 rows, a query for the ids alone is answered from the leaves of the index,
+	// while fetching the whole rows of the same range would cost more than reading the file.
+	bigDataFile, err := os.CreateTemp("", "users-*.csv")
+	if err != nil {
+		panic(err)
+	}
+	defer os.Remove(bigDataFile.Name())
+	bigWriter := bufio.NewWriter(bigDataFile)
+	fmt.Fprintln(bigWriter, "id,username,email")
+	for id := 1; id <= 10000; id++ {
+		fmt.Fprintf(bigWriter, "%d,user%d,user%d@example.com\n", id, id, id)
+	}
+	bigWriter.Flush()
+	bigDataFile.Close()
+	bigIndex := NewBPlusTree(NewMemPageStore(), 0)
+	if _, err := ImportCSV(bigIndex, bigDataFile.Name(), usersSchema); err != nil {
+		panic(err)
+	}
+	bigUsers, err := NewTable("users", bigDataFile.Name(), bigIndex)
+	if err != nil {
+		panic(err)
+	}
+	ids, plan, err := bigUsers.SelectIDs(100, 199)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Printf("EXPLAIN SELECT id FROM users WHERE id BETWEEN 100 AND 199, over 10000 rows:\n%s\n", plan.Explain())
+	fmt.Printf("The query returned %d ids without reading the data file.\n", len(ids))
+	fmt.Printf("EXPLAIN SELECT * with the same range:\n%s\n", bigUsers.Plan(100, 199).Explain())
+
+	// A large read can be split at the index's separators and scanned by several goroutines.
+	parts, err := bigIndex.SplitRange(1, 10000, 4)
+	if err != nil {
+		panic(err)
+	}
+	partSizes := make([]int, len(parts))
+	var scans sync.WaitGroup
+	for i, part := range parts {
+		scans.Add(1)
+		go func() {
+			defer scans.Done()
+			offsets, err := bigIndex.SearchRange(part.Start, part.End)
+			if err != nil {
+				panic(err)
+			}
+			partSizes[i] = len(offsets)
+		}()
+	}
+	scans.Wait()
+	fmt.Printf("SplitRange(1, 10000, 4) gave %v, scanned in parallel: %v ids\n", parts, partSizes)
+
+	// The same ids spread over four trees by consistent hashing. Growing the ring to five shards
+	// moves only the ids the new shard takes over, where id % 5 would move most of them.
+	shards := make([]*BPlusTree, 4)
+	for i := range shards {
+		shards[i] = NewBPlusTree(NewMemPageStore(), 0)
+	}
+	ring := NewHashRing(len(shards), 0)
+	sharded, err := NewShardedIndex(shards, ring)
+	if err != nil {
+		panic(err)
+	}
+	for id := 1; id <= 10000; id++ {
+		if err := sharded.Insert(id, int64(id)); err != nil {
+			panic(err)
+		}
+	}
+	shardSizes := make([]int, len(shards))
+	for i, shard := range shards {
+		if shardSizes[i], err = shard.Len(); err != nil {
+			panic(err)
+		}
+	}
+	fiveShards, moved := NewHashRing(len(shards)+1, 0), 0
+	for id := 1; id <= 10000; id++ {
+		if fiveShards.Shard(id) != ring.Shard(id) {
+			moved++
+		}
+	}
+	shardedOffsets, err := sharded.SearchRange(100, 199)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Printf("Sharded over a hash ring: %v ids per shard, %d ids in [100, 199] from a fan-out scan; a fifth shard would take %d ids\n",
+		shardSizes, len(shardedOffsets), moved)
+
+	// --- Step 6: Take a checkpoint, then trace the page-level changes made by Delete while it runs ---
+	fmt.Println("\n--- Use Case 3: Tracing what a Delete does to the on-disk pages ---")
+	const checkpointFile = "users_pk.ckpt"
+	job := tree.Checkpoint(checkpointFile)
+	tree.SetTracer(NewLogTracer(os.Stdout))
+	for _, key := range []int{5, 6, 7} {
+		fmt.Printf("Delete(%d):\n", key)
+		if _, err := tree.Delete(key); err != nil {
+			panic(err)
+		}
+	}
+	tree.SetTracer(nil)
+
+	// --- Step 7: The checkpoint still holds the index as it was before the deletes ---
+	fmt.Println("\n--- Use Case 4: Reading from a checkpoint taken before the deletes ---")
+	if err := job.Wait(); err != nil {
+		panic(err)
+	}
+	defer os.Remove(checkpointFile)
+	// A checkpoint is an index file with a header, so Open finds its degree and root.
+	snapshot, err := Open(checkpointFile)
+	if err != nil {
+		panic(err)
+	}
+	defer snapshot.Close()
+	for _, key := range []int{5, 6, 7} {
+		_, inTree, _ := tree.Search(key)
+		_, inSnapshot, _ := snapshot.Search(key)
+		fmt.Printf("Key %d: in live index=%v, in checkpoint=%v\n", key, inTree, inSnapshot)
+	}
+
+	// --- Step 8: Transactions over the index, a heap file and the write-ahead log ---
+	fmt.Println("\n--- Use Case 5: A rolled-back transaction leaves the index untouched ---")
+	const txIndexFile, txHeapFile, txLogFile = "tx_demo.idx", "tx_demo.dat", "tx_demo.wal"
+	for _, f := range []string{txIndexFile, txHeapFile, txLogFile} {
+		os.Remove(f)
+		defer os.Remove(f)
+	}
+	db, err := OpenDB(txIndexFile, txHeapFile, txLogFile, degree)
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
+	dbMetrics := NewPrometheusMetrics()
+	db.SetMetrics(dbMetrics)
+
+	tx := db.Begin()
+	tx.Insert(100, []byte("100,zoe,zoe@example.com"))
+	tx.Insert(101, []byte("101,yann,yann@example.com"))
+	if err := tx.Commit(); err != nil {
+		panic(err)
+	}
+	tx = db.Begin()
+	tx.Insert(102, []byte("102,xena,xena@example.com"))
+	tx.Delete(100)
+	tx.Rollback()
+
+	for _, key := range []int{100, 101, 102} {
+		row, found, _ := db.Get(key)
+		fmt.Printf("Key %d: found=%v row=%q\n", key, found, row)
+	}
+
+	// A unique secondary index on an optional badge number, the fourth column, is maintained by
+	// every Insert and Delete from now on. Rows without a badge are left out of it.
+	err = db.CreateIndex("users_badge", func(row []byte) (int, bool) {
+		fields := strings.Split(string(row), ",")
+		if len(fields) < 4 {
+			return 0, false
+		}
+		badge, err := strconv.Atoi(fields[3])
+		return badge, err == nil
+	})
+	if err != nil {
+		panic(err)
+	}
+	tx = db.Begin()
+	tx.Insert(103, []byte("103,walt,walt@example.com,7001"))
+	tx.Insert(104, []byte("104,vera,vera@example.com,7002"))
+	if err := tx.Commit(); err != nil {
+		panic(err)
+	}
+	row, _, _ := db.GetBy("users_badge", 7002)
+	fmt.Printf("Badge 7002 through the users_badge index: %q\n", row)
+	tx = db.Begin()
+	err = tx.Insert(105, []byte("105,uma,uma@example.com,7001"))
+	tx.Rollback()
+	_, found, _ = db.Get(105)
+	fmt.Printf("Key 105 with badge 7001 again is rejected: %v (key 105 found=%v)\n", err, found)
+
+	// Moving rows to new keys in one transaction, with a savepoint per move: the second move fails
+	// on its badge after its Delete, and RollbackTo brings key 103 back without losing the first.
+	tx = db.Begin()
+	for _, move := range []struct {
+		from, to int
+		row      string
+	}{{104, 109, "109,vera,vera@example.com,7002"}, {103, 110, "110,walt,walt@example.com,7002"}} {
+		tx.Savepoint("move")
+		tx.Delete(move.from)
+		if err := tx.Insert(move.to, []byte(move.row)); err != nil {
+			tx.RollbackTo("move")
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		panic(err)
+	}
+	for _, key := range []int{103, 104, 109, 110} {
+		_, found, _ := db.Get(key)
+		fmt.Printf("After the moves, key %d found=%v\n", key, found)
+	}
+
+	// The metrics, as `serve` exposes them at /metrics, of everything the DB did above.
+	var exposition strings.Builder
+	dbMetrics.WriteTo(&exposition)
+	fmt.Println("Some of the DB's metrics in the Prometheus format:")
+	for _, line := range strings.Split(exposition.String(), "\n") {
+		if strings.HasPrefix(line, "btree_wal_bytes_total") || strings.HasPrefix(line, "btree_fsyncs_total") ||
+			strings.HasPrefix(line, "btree_operation_duration_seconds_count") {
+			fmt.Println("  " + line)
+		}
+	}
+
+	// The same kind of rows spread over two shards. A transaction that writes to both commits on
+	// both, through two-phase commit, or on neither.
+	const shardedDBPath = "tx_demo_sharded"
+	for _, suffix := range []string{".coord.wal", ".shard0.idx", ".shard0.dat", ".shard0.wal", ".shard1.idx", ".shard1.dat", ".shard1.wal"} {
+		os.Remove(shardedDBPath + suffix)
+		defer os.Remove(shardedDBPath + suffix)
+	}
+	shardedDB, err := OpenShardedDB(shardedDBPath, NewHashRing(2, 0), degree)
+	if err != nil {
+		panic(err)
+	}
+	defer shardedDB.Close()
+	shardedTx := shardedDB.Begin()
+	for key := 200; key < 204; key++ {
+		shardedTx.Insert(key, fmt.Appendf(nil, "%d,user%d,user%d@example.com", key, key, key))
+	}
+	if err := shardedTx.Commit(); err != nil {
+		panic(err)
+	}
+	shardedTx = shardedDB.Begin()
+	shardedTx.Insert(206, []byte("206,tess,tess@example.com"))
+	shardedTx.Insert(201, []byte("201,sam,sam@example.com"))
+	err = shardedTx.Commit()
+	_, found, _ = shardedDB.Get(206)
+	fmt.Printf("Keys 200-203 committed over two shards; 206 with a duplicate 201 is rejected: %v (key 206 found=%v)\n", err, found)
+
+	// --- Step 9: Repack the leaves in place, then rewrite the index without the space left behind by the deletes ---
+	fmt.Println("\n--- Use Case 6: Defragmenting and compacting the index after the deletes ---")
+	before, after, err := tree.DefragmentLeaves()
+	if err != nil {
+		panic(err)
+	}
+	fmt.Printf("Leaf chain before defragmenting: %v\n", before)
+	fmt.Printf("Leaf chain after defragmenting:  %v\n", after)
+	pagesBefore := pager.NumPages()
+	if err := tree.Compact(defaultCompactFillFactor); err != nil {
+		panic(err)
+	}
+	fmt.Printf("Index file shrank from %d to %d pages.\n", pagesBefore, pager.NumPages())
+	offset, found, err = tree.Search(keyToFind)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Printf("Search(%d) after compaction: found=%v offset=%d\n", keyToFind, found, offset)
+
+	// --- Step 10: Let a Bloom filter answer lookups of keys that aren't there ---
+	fmt.Println("\n--- Use Case 7: A Bloom filter skips the tree for missing keys ---")
+	defer os.Remove(indexFile + bloomFileSuffix)
+	if err := tree.EnableBloomFilter(0.01); err != nil {
+		panic(err)
+	}
+	fmt.Printf("Bloom filter: %v\n", tree.BloomFilter())
+	tree.SetTracer(counter)
+	for _, key := range []int{keyToFind, 1000} {
+		counter.reads = 0
+		_, found, err := tree.Search(key)
+		if err != nil {
+			panic(err)
+		}
+		fmt.Printf("Search(%d): found=%v after reading %d pages\n", key, found, counter.reads)
+	}
+	tree.SetTracer(nil)
+
+	// --- Step 11: Full-text search over the email column ---
+	fmt.Println("\n--- Use Case 8: An inverted index over the email column ---")
+	const textIndexFile = "users_email.idx"
+	os.Remove(textIndexFile)
+	defer os.Remove(textIndexFile)
+	textPager, err := NewPager(textIndexFile)
+	if err != nil {
+		panic(err)
+	}
+	defer textPager.Close()
+	textIndex, err := OpenInvertedIndex(textPager)
+	if err != nil {
+		panic(err)
+	}
+	indexedRows, err := IndexTextColumn(textIndex, dataFile, usersSchema, "email")
+	if err != nil {
+		panic(err)
+	}
+	fmt.Printf("Indexed %d rows under %d terms; %q is tokenized as %q.\n", indexedRows, textIndex.NumTerms(), "alice@example.com", Tokenize("alice@example.com"))
+	for _, query := range []string{"alice example", "alice bob"} {
+		all, err := textIndex.MatchAll(query)
+		if err != nil {
+			panic(err)
+		}
+		any, err := textIndex.MatchAny(query)
+		if err != nil {
+			panic(err)
+		}
+		fmt.Printf("%q: AND matches TIDs %v, OR matches TIDs %v\n", query, all, any)
+	}
+	if err := textIndex.Close(); err != nil {
+		panic(err)
+	}
+
+	// --- Step 12: Window queries over points on a map ---
+	fmt.Println("\n--- Use Case 9: An R-tree answering a window query ---")
+	const spatialIndexFile = "points.idx"
+	os.Remove(spatialIndexFile)
+	defer os.Remove(spatialIndexFile)
+	spatialPager, err := NewPager(spatialIndexFile)
+	if err != nil {
+		panic(err)
+	}
+	defer spatialPager.Close()
+	rtree, err := OpenRTree(spatialPager)
+	if err != nil {
+		panic(err)
+	}
+	// 10,000 points scattered over a 1000x1000 map, each standing for a row.
+	rng := rand.New(rand.NewSource(1))
+	for tid := TID(0); tid < 10000; tid++ {
+		x, y := rng.Float64()*1000, rng.Float64()*1000
+		if err := rtree.Insert(Rect{x, y, x, y}, tid); err != nil {
+			panic(err)
+		}
+	}
+	height, err := rtree.Height()
+	if err != nil {
+		panic(err)
+	}
+	counter.reads = 0
+	rtree.SetTracer(counter)
+	window := Rect{MinX: 100, MinY: 100, MaxX: 150, MaxY: 150}
+	tids, err := rtree.Search(window)
+	if err != nil {
+		panic(err)
+	}
+	rtree.SetTracer(nil)
+	fmt.Printf("%d points in the window %v; the query read %d of the tree's %d pages (height %d).\n",
+		len(tids), window, counter.reads, spatialPager.NumPages(), height)
+	if err := rtree.Close(); err != nil {
+		panic(err)
+	}
+
+	// --- Step 13: A copy-on-write tree, whose snapshots don't see later commits ---
+	fmt.Println("\n--- Use Case 10: A copy-on-write B+ tree with a snapshot reader ---")
+	const cowIndexFile = "users_pk.cow"
+	os.Remove(cowIndexFile)
+	defer os.Remove(cowIndexFile)
+	cowPager, err := NewPager(cowIndexFile)
+	if err != nil {
+		panic(err)
+	}
+	defer cowPager.Close()
+	cowTree, err := OpenCOWTree(cowPager, degree)
+	if err != nil {
+		panic(err)
+	}
+	source, err := NewCSVSource(dataFile, usersSchema)
+	if err != nil {
+		panic(err)
+	}
+	err = cowTree.Update(func(tx *COWTx) error {
+		for {
+			key, offset, err := source.NextRecord()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err := tx.Insert(key, offset); err != nil {
+				return err
+			}
+		}
+	})
+	source.Close()
+	if err != nil {
+		panic(err)
+	}
+	cowSnapshot := cowTree.Snapshot()
+	if _, err := cowTree.Delete(keyToFind); err != nil {
+		panic(err)
+	}
+	_, inCOWSnapshot, _ := cowSnapshot.Search(keyToFind)
+	_, inLatest, _ := cowTree.Search(keyToFind)
+	fmt.Printf("After deleting %d in transaction %d: the snapshot of transaction %d still finds it: %v, the latest version: %v\n",
+		keyToFind, cowTree.Snapshot().TxID(), cowSnapshot.TxID(), inCOWSnapshot, inLatest)
+	fmt.Printf("The delete copied its path to new pages: the file grew from %d to %d pages.\n", cowSnapshot.NumPages(), cowTree.Snapshot().NumPages())
+
+	// --- Step 14: The same machinery as an embedded key-value store ---
+	fmt.Println("\n--- Use Case 11: A key-value store with byte-slice keys ---")
+	const kvPath = "kv_demo"
+	for _, ext := range []string{".idx", ".dat", ".wal"} {
+		os.Remove(kvPath + ext)
+		defer os.Remove(kvPath + ext)
+	}
+	store, err := OpenKVStore(kvPath)
+	if err != nil {
+		panic(err)
+	}
+	defer store.Close()
+	for _, user := range []string{"alice", "bob", "carol"} {
+		store.Put([]byte("user:"+user), []byte(user+"@example.com"))
+	}
+	store.Put([]byte("config:theme"), []byte("dark"))
+	store.Delete([]byte("user:bob"))
+	store.Scan([]byte("user:"), func(key, value []byte) error {
+		fmt.Printf("%s = %s\n", key, value)
+		return nil
+	})
+	sessions, err := store.CreateBucket("sessions")
+	if err != nil {
+		panic(err)
+	}
+	sessions.Put([]byte("user:alice"), []byte("token-1"))
+	value, _, _ := store.Get([]byte("user:alice"))
+	session, _, _ := sessions.Get([]byte("user:alice"))
+	fmt.Printf("The same key in the main tree: %s, in the %q bucket: %s\n", value, "sessions", session)
+	sessions.PutWithTTL([]byte("user:carol"), []byte("token-2"), 10*time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	_, found, _ = sessions.Get([]byte("user:carol"))
+	swept, _ := store.SweepExpired()
+	fmt.Printf("A session with a 10ms TTL is found 20ms later: %v; keys swept: %d\n", found, swept)
 }
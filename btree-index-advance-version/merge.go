@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+)
+
+// =================================================================================================
+// --- merge.go --- (Merging Two Indexes)
+// =================================================================================================
+
+// A data file split into shards can be indexed one shard at a time, in parallel or on different
+// machines, leaving one index per shard. Merge combines two of them into one. Inserting the
+// entries of one into the other would descend the tree and split pages once per key. Both leaf
+// chains already hold their keys in order, though, so Merge walks them side by side with two
+// cursors, the way the merge step of a merge sort does, and bulk-loads the combined sequence into
+// a fresh file exactly as Compact does (see compact.go):
+//
+//	this tree:   1  4  7  9
+//	other tree:  2  4  8            ──▶  1  2  4  7  8  9, then internal pages bottom-up
+//
+// A key both trees hold is settled by a MergePolicy. With MergeReject, the default, it is an
+// error, reported as a *ConstraintViolation before anything is written, as for a unique index.
+//
+//	err := shard0.Merge(shard1, MergeReject)
+//
+// The receiving tree must be stored in a Pager, whose file the merged tree replaces. The other
+// tree can be stored anywhere and is left unchanged; only its main tree is merged, not its buckets.
+
+// MergePolicy decides which value Merge keeps for a key both trees hold.
+type MergePolicy int
+
+const (
+	// MergeReject fails the merge with a *ConstraintViolation and leaves both trees unchanged.
+	MergeReject MergePolicy = iota
+	// MergeKeepExisting keeps the value of the tree being merged into.
+	MergeKeepExisting
+	// MergeKeepOther keeps the value of the tree merged in.
+	MergeKeepOther
+)
+
+var errMergeSelf = errors.New("cannot merge a tree with itself")
+
+// Merge adds every entry of other to the tree, resolving keys both hold by policy, and rewrites
+// the index file bottom-up with pages filled to defaultCompactFillFactor.
+func (t *BPlusTree) Merge(other *BPlusTree, policy MergePolicy) error {
+	return t.MergeContext(context.Background(), other, policy)
+}
+
+// MergeContext is Merge that gives up once ctx is done and returns ctx.Err(). As with
+// CompactContext, the new file is only swapped in at the very end.
+func (t *BPlusTree) MergeContext(ctx context.Context, other *BPlusTree, policy MergePolicy) error {
+	if other == t {
+		return errMergeSelf
+	}
+	numKeys, err := t.Len()
+	if err != nil {
+		return err
+	}
+	numOther, err := other.Len()
+	if err != nil {
+		return err
+	}
+	return t.rewrite(defaultCompactFillFactor, numKeys+numOther, func() (compactSource, error) {
+		a, err := t.SeekContext(ctx, math.MinInt)
+		if err != nil {
+			return nil, err
+		}
+		b, err := other.SeekContext(ctx, math.MinInt)
+		if err != nil {
+			return nil, err
+		}
+		return &mergeSource{tree: t, a: a, b: b, policy: policy, nextA: true, nextB: true}, nil
+	})
+}
+
+// mergeSource yields the entries of two cursors in key order, one entry per key.
+type mergeSource struct {
+	tree         *BPlusTree // the tree merged into, which names the index in violations
+	a, b         *Cursor
+	policy       MergePolicy
+	okA, okB     bool // whether a and b stand at an entry
+	nextA, nextB bool // whether the entry of a and of b has been consumed
+	cur          *Cursor
+	err          error
+}
+
+func (m *mergeSource) Next() bool {
+	if m.err != nil {
+		return false
+	}
+	if m.nextA {
+		m.okA = m.a.Next()
+	}
+	if m.nextB {
+		m.okB = m.b.Next()
+	}
+	m.nextA, m.nextB = false, false
+	if m.err = errors.Join(m.a.Err(), m.b.Err()); m.err != nil {
+		return false
+	}
+	switch {
+	case !m.okA && !m.okB:
+		return false
+	case !m.okB || m.okA && m.a.Key() < m.b.Key():
+		m.cur, m.nextA = m.a, true
+	case !m.okA || m.b.Key() < m.a.Key():
+		m.cur, m.nextB = m.b, true
+	default:
+		m.nextA, m.nextB = true, true
+		switch m.policy {
+		case MergeKeepExisting:
+			m.cur = m.a
+		case MergeKeepOther:
+			m.cur = m.b
+		default:
+			rejected, _, _ := leafValueAt(m.b.page, m.b.index-1)
+			m.err = m.tree.duplicateKey(m.a.page, m.a.index-1, rejected)
+			return false
+		}
+	}
+	return true
+}
+
+func (m *mergeSource) Err() error { return m.err }
+
+func (m *mergeSource) at() *Cursor { return m.cur }
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"time"
+)
+
+// =================================================================================================
+// --- meta.go --- (Index Meta Page)
+// =================================================================================================
+
+// The meta page holds facts about the index that don't belong in any tree page, such as which
+// version of the data file the offsets were taken from, and the index header: the format version,
+// the degrees, and where the root and the catalog are. NewBPlusTree writes it as page 0 of a new
+// file, so Open can read the header from there and needs neither the degree from the caller nor a
+// scan of the file for the root. Files written before the header existed get their meta page the
+// first time something is recorded in it, wherever the file ends then, and an index file without
+// one is still valid; for those the meta page and the root are found by scanning the file. Compact
+// carries the meta page over to page 0 of the new file.
+//
+// Meta page layout:
+//
+//	| header (32 bytes) | data file size int64 | data file mtime int64 | data file crc32 uint32 |
+//	| (padding) | indexed offset int64 | magic uint32 | format version uint16 | degree uint16 |
+//	| root page ID int64 | catalog page ID int64 | internal degree uint16 |
+//
+// Of the page header, only the node type, NodeTypeMeta, and the flags byte are used. The only flag
+// is metaFlagEncrypted, which the pager of an encrypted file sets (see encrypt.go). The mtime is
+// in Unix nanoseconds. The indexed offset is where the rows that aren't indexed yet begin (see
+// AppendIndex). The index header is only valid if the magic number is there. The internal degree
+// is 0 unless the tree was created with its own degree for internal pages (see fanout.go); it
+// came with format version 2.
+//
+// The root moves when it splits or shrinks, and the header is only rewritten when the tree is
+// opened, closed or compacted, so after a crash its root may be stale. A stale root page no longer
+// carries the root flag, because splits clear it and released pages are zeroed, so Open checks the
+// flag and falls back to the scan, then rewrites the header.
+
+const NodeTypeMeta = 3
+
+const (
+	metaFlagsOffset          = cellContentOffsetOffset // byte, in the page header
+	metaDataSizeOffset       = headerSize
+	metaDataModTimeOffset    = headerSize + 8
+	metaDataChecksumOffset   = headerSize + 16
+	metaIndexedOffset        = headerSize + 24
+	metaMagicOffset          = headerSize + 32
+	metaFormatVersionOffset  = headerSize + 36
+	metaDegreeOffset         = headerSize + 38
+	metaRootOffset           = headerSize + 40
+	metaCatalogOffset        = headerSize + 48
+	metaInternalDegreeOffset = headerSize + 56
+)
+
+// metaFlagEncrypted is set in the flags of the meta page when the index file is encrypted.
+const metaFlagEncrypted = 1
+
+// metaMagic marks a meta page that holds an index header ("BPTI").
+const metaMagic = 0x49545042
+
+// IndexFormatVersion is the latest version of the index file format, which this build writes.
+// Open refuses files of a later version. Version 2 adds the internal degree, and only files that
+// have one are written as version 2, so builds that only read version 1 can still open the others.
+const IndexFormatVersion = 2
+
+// Errors returned by Open. Compare with errors.Is.
+var (
+	// ErrNoIndexHeader means the file has no index header: it is empty, it isn't an index file,
+	// or it was written before the header existed. NewBPlusTree opens the latter with the degree
+	// they were built with.
+	ErrNoIndexHeader = errors.New("index file has no header")
+	// ErrUnsupportedFormat means the file was written in a format version this build can't read.
+	ErrUnsupportedFormat = errors.New("unsupported index file format")
+)
+
+// indexHeader is the part of the meta page that describes the tree.
+type indexHeader struct {
+	formatVersion int
+	degree        int
+	rootPageID    PageID
+	catalogPageID PageID // -1 if the index has no buckets
+	// internalDegree is the degree of internal pages, 0 if it is the degree.
+	internalDegree int
+}
+
+// putIndexHeader stores h in a meta page.
+func putIndexHeader(page *Page, h indexHeader) {
+	binary.LittleEndian.PutUint32(page[metaMagicOffset:], metaMagic)
+	binary.LittleEndian.PutUint16(page[metaFormatVersionOffset:], uint16(h.formatVersion))
+	binary.LittleEndian.PutUint16(page[metaDegreeOffset:], uint16(h.degree))
+	binary.LittleEndian.PutUint64(page[metaRootOffset:], uint64(h.rootPageID))
+	binary.LittleEndian.PutUint64(page[metaCatalogOffset:], uint64(h.catalogPageID))
+	binary.LittleEndian.PutUint16(page[metaInternalDegreeOffset:], uint16(h.internalDegree))
+}
+
+// decodeIndexHeader returns the index header of a page, and false if it isn't a meta page that
+// holds one.
+func decodeIndexHeader(page *Page) (indexHeader, bool) {
+	if page[nodeTypeOffset] != NodeTypeMeta || binary.LittleEndian.Uint32(page[metaMagicOffset:]) != metaMagic {
+		return indexHeader{}, false
+	}
+	return indexHeader{
+		formatVersion:  int(binary.LittleEndian.Uint16(page[metaFormatVersionOffset:])),
+		degree:         int(binary.LittleEndian.Uint16(page[metaDegreeOffset:])),
+		rootPageID:     PageID(binary.LittleEndian.Uint64(page[metaRootOffset:])),
+		catalogPageID:  PageID(binary.LittleEndian.Uint64(page[metaCatalogOffset:])),
+		internalDegree: int(binary.LittleEndian.Uint16(page[metaInternalDegreeOffset:])),
+	}, true
+}
+
+// findIndexHeader reads the index header of the file in pager and returns it with the ID of the
+// meta page that holds it. It looks at page 0 first, and scans the file for the meta page of an
+// older file only if page 0 isn't one.
+func findIndexHeader(pager PageStore) (indexHeader, PageID, error) {
+	if pager.NumPages() == 0 {
+		return indexHeader{}, -1, fmt.Errorf("%w: the file is empty", ErrNoIndexHeader)
+	}
+	metaPageID := PageID(0)
+	page, err := pager.ReadPage(metaPageID, new(Page))
+	if err != nil {
+		return indexHeader{}, -1, err
+	}
+	if page[nodeTypeOffset] != NodeTypeMeta {
+		if metaPageID = findPageOfType(pager, NodeTypeMeta); metaPageID == -1 {
+			return indexHeader{}, -1, ErrNoIndexHeader
+		}
+		if page, err = pager.ReadPage(metaPageID, new(Page)); err != nil {
+			return indexHeader{}, -1, err
+		}
+	}
+	header, ok := decodeIndexHeader(page)
+	switch {
+	case !ok:
+		return indexHeader{}, -1, ErrNoIndexHeader
+	case header.formatVersion < 1 || header.formatVersion > IndexFormatVersion:
+		return indexHeader{}, -1, fmt.Errorf("%w: version %d, this build reads versions 1 to %d",
+			ErrUnsupportedFormat, header.formatVersion, IndexFormatVersion)
+	case header.degree < 3 || header.degree > MaxDegree:
+		return indexHeader{}, -1, fmt.Errorf("%w: the header of page %d has degree %d", ErrCorruptPage, metaPageID, header.degree)
+	case header.internalDegree != 0 && (header.internalDegree < 3 || header.internalDegree > MaxInternalDegree):
+		return indexHeader{}, -1, fmt.Errorf("%w: the header of page %d has internal degree %d", ErrCorruptPage, metaPageID, header.internalDegree)
+	case header.rootPageID < 0 || int64(header.rootPageID) >= pager.NumPages():
+		return indexHeader{}, -1, fmt.Errorf("%w: the header of page %d has root %d, past the end of the file", ErrCorruptPage, metaPageID, header.rootPageID)
+	}
+	return header, metaPageID, nil
+}
+
+// writeIndexHeader records the tree's degrees, root and catalog in the meta page, allocating the
+// meta page if an older file doesn't have one.
+func (t *BPlusTree) writeIndexHeader() error {
+	page, err := t.readMeta()
+	if err != nil {
+		return err
+	}
+	putIndexHeader(page, t.indexHeader())
+	return t.writeMeta(page)
+}
+
+// indexHeader returns the header that describes the tree as it is now, in the oldest format version
+// that can describe it.
+func (t *BPlusTree) indexHeader() indexHeader {
+	formatVersion := 1
+	if t.internalDegree != 0 {
+		formatVersion = 2
+	}
+	return indexHeader{formatVersion: formatVersion, degree: t.degree, rootPageID: t.rootPageID, catalogPageID: t.catalogPageID,
+		internalDegree: t.internalDegree}
+}
+
+// DataFileInfo identifies a version of a data file: its size, modification time and CRC-32
+// checksum.
+type DataFileInfo struct {
+	Size     int64
+	ModTime  time.Time
+	Checksum uint32
+}
+
+func (i DataFileInfo) String() string {
+	return fmt.Sprintf("%d bytes, modified %s, crc32 %08x", i.Size, i.ModTime.Format(time.RFC3339), i.Checksum)
+}
+
+// statDataFile returns the DataFileInfo of the file at path. It reads the whole file.
+func statDataFile(path string) (DataFileInfo, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return DataFileInfo{}, err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return DataFileInfo{}, err
+	}
+	hash := crc32.NewIEEE()
+	if _, err := io.Copy(hash, file); err != nil {
+		return DataFileInfo{}, err
+	}
+	return DataFileInfo{Size: stat.Size(), ModTime: stat.ModTime(), Checksum: hash.Sum32()}, nil
+}
+
+// readMeta returns the meta page, or a new, empty one if the index doesn't have one yet.
+func (t *BPlusTree) readMeta() (*Page, error) {
+	if t.metaPageID == -1 {
+		return newMetaPage(), nil
+	}
+	return t.readPage(t.metaPageID)
+}
+
+// newMetaPage returns a meta page with nothing recorded in it.
+func newMetaPage() *Page {
+	page := new(Page)
+	page[nodeTypeOffset] = NodeTypeMeta
+	setParentPageID(page, -1)
+	return page
+}
+
+// writeMeta writes the meta page, allocating it the first time.
+func (t *BPlusTree) writeMeta(page *Page) error {
+	if t.metaPageID == -1 {
+		t.metaPageID = t.pager.AllocatePage()
+	}
+	return t.writePage(t.metaPageID, page)
+}
+
+// DataFileInfo returns the data file version recorded by RecordDataFile, and false if none has
+// been recorded.
+func (t *BPlusTree) DataFileInfo() (DataFileInfo, bool, error) {
+	if t.metaPageID == -1 {
+		return DataFileInfo{}, false, nil
+	}
+	page, err := t.readPage(t.metaPageID)
+	if err != nil {
+		return DataFileInfo{}, false, err
+	}
+	return metaDataFileInfo(page), true, nil
+}
+
+// metaDataFileInfo decodes the data file version stored in a meta page.
+func metaDataFileInfo(page *Page) DataFileInfo {
+	return DataFileInfo{
+		Size:     int64(binary.LittleEndian.Uint64(page[metaDataSizeOffset:])),
+		ModTime:  time.Unix(0, int64(binary.LittleEndian.Uint64(page[metaDataModTimeOffset:]))),
+		Checksum: binary.LittleEndian.Uint32(page[metaDataChecksumOffset:]),
+	}
+}
+
+// RecordDataFile records the current version of the data file at path in the meta page, to tell
+// later whether the file has changed since the index was built (see ValidateAgainstData).
+// ImportCSV calls it after building the index.
+func (t *BPlusTree) RecordDataFile(path string) error {
+	info, err := statDataFile(path)
+	if err != nil {
+		return err
+	}
+	page, err := t.readMeta()
+	if err != nil {
+		return err
+	}
+	binary.LittleEndian.PutUint64(page[metaDataSizeOffset:], uint64(info.Size))
+	binary.LittleEndian.PutUint64(page[metaDataModTimeOffset:], uint64(info.ModTime.UnixNano()))
+	binary.LittleEndian.PutUint32(page[metaDataChecksumOffset:], info.Checksum)
+	return t.writeMeta(page)
+}
+
+// IndexedOffset returns the offset in the data file up to which its rows were indexed by ImportCSV
+// or AppendIndex, or 0 if none is recorded.
+func (t *BPlusTree) IndexedOffset() (int64, error) {
+	if t.metaPageID == -1 {
+		return 0, nil
+	}
+	page, err := t.readPage(t.metaPageID)
+	if err != nil {
+		return 0, err
+	}
+	return int64(binary.LittleEndian.Uint64(page[metaIndexedOffset:])), nil
+}
+
+func (t *BPlusTree) setIndexedOffset(offset int64) error {
+	page, err := t.readMeta()
+	if err != nil {
+		return err
+	}
+	binary.LittleEndian.PutUint64(page[metaIndexedOffset:], uint64(offset))
+	return t.writeMeta(page)
+}
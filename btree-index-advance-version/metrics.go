@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// =================================================================================================
+// --- metrics.go --- (Metrics)
+// =================================================================================================
+
+// A Tracer reports every event with the page it is about, which suits a learning UI but not a
+// server that handles thousands of requests a second. Metrics reports the same kinds of events
+// as plain counts, plus the bytes written to the log, the fsyncs and how long each operation
+// took, so they can be aggregated and scraped:
+//
+//	metrics := NewPrometheusMetrics()
+//	db.SetMetrics(metrics)
+//	http.Handle("/metrics", metrics)
+//
+// The HTTP server does exactly that, so `curl localhost:8080/metrics` shows the counters of a
+// running server in the Prometheus text format. A tree without metrics, the default, skips all of
+// this at the cost of a nil check.
+
+// Metrics receives the counts and latencies of a tree, or of a DB and its files. Its methods are
+// called from whichever goroutine does the work, including the buffer pool's flusher, so
+// implementations must be safe for concurrent use.
+type Metrics interface {
+	// PageRead fires for every page the buffer pool hands to the tree; hit reports whether it was
+	// cached.
+	PageRead(hit bool)
+	// PageWrite fires for every page the buffer pool writes to its PageStore.
+	PageWrite()
+	Split(isLeaf bool)
+	Merge(isLeaf bool)
+	// WALAppend fires for every record appended to the log, with its size in bytes.
+	WALAppend(bytes int)
+	// Fsync fires after a file has been forced to disk: "index", "heap" or "wal".
+	Fsync(file string)
+	// Operation fires when an operation returns, with how long it took: "search", "range",
+	// "insert" and "delete" on the tree, and "commit" on a DB.
+	Operation(op string, d time.Duration)
+}
+
+// SetMetrics installs metrics on the tree and its buffer pool, and on its Pager if it has one.
+// Passing nil disables them. Like SetTracer, it must not be called while the tree is in use; use
+// DB.SetMetrics for a DB.
+func (t *BPlusTree) SetMetrics(metrics Metrics) {
+	t.metrics = metrics
+	t.pool.setMetrics(metrics)
+	if pager, ok := t.pager.(*Pager); ok {
+		pager.setMetrics(metrics)
+	}
+}
+
+// observe reports an operation of the tree that began at start.
+func (t *BPlusTree) observe(op string, start time.Time) {
+	t.metrics.Operation(op, time.Since(start))
+}
+
+// SetMetrics installs metrics on the DB, its tree, and its log and heap file. Passing nil disables
+// them. It waits for the running transaction, if any, to finish.
+func (db *DB) SetMetrics(metrics Metrics) {
+	db.txMu.Lock()
+	defer db.txMu.Unlock()
+	db.metrics = metrics
+	db.tree.SetMetrics(metrics)
+	db.wal.setMetrics(metrics)
+}
+
+// observe reports an operation of the DB that began at start.
+func (db *DB) observe(op string, start time.Time) {
+	db.metrics.Operation(op, time.Since(start))
+}
+
+// operationBuckets are the upper bounds, in seconds, of the buckets of the operation latency
+// histograms: from 10µs, a page found in the buffer pool, to a second.
+var operationBuckets = []float64{0.00001, 0.00005, 0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1}
+
+// PrometheusMetrics is a Metrics that keeps running totals and serves them over HTTP in the
+// Prometheus text exposition format.
+type PrometheusMetrics struct {
+	pageHits, pageMisses atomic.Int64
+	pageWrites           atomic.Int64
+	splits, merges       [2]atomic.Int64 // indexed by nodeIndex
+	walRecords, walBytes atomic.Int64
+
+	mu         sync.Mutex
+	fsyncs     map[string]int64
+	operations map[string]*latencyHistogram
+}
+
+// latencyHistogram counts the latencies of one operation. counts[i] is the number that fell in
+// bucket i alone; the exposition format wants them cumulative.
+type latencyHistogram struct {
+	counts []int64 // one per operationBuckets, plus +Inf
+	sum    float64
+	count  int64
+}
+
+// NewPrometheusMetrics returns a PrometheusMetrics with every count at zero.
+func NewPrometheusMetrics() *PrometheusMetrics {
+	return &PrometheusMetrics{fsyncs: make(map[string]int64), operations: make(map[string]*latencyHistogram)}
+}
+
+// nodeIndex is the index of a kind of page in PrometheusMetrics' split and merge counts.
+func nodeIndex(isLeaf bool) int {
+	if isLeaf {
+		return NodeTypeLeaf
+	}
+	return NodeTypeInternal
+}
+
+func (m *PrometheusMetrics) PageRead(hit bool) {
+	if hit {
+		m.pageHits.Add(1)
+	} else {
+		m.pageMisses.Add(1)
+	}
+}
+
+func (m *PrometheusMetrics) PageWrite()          { m.pageWrites.Add(1) }
+func (m *PrometheusMetrics) Split(isLeaf bool)   { m.splits[nodeIndex(isLeaf)].Add(1) }
+func (m *PrometheusMetrics) Merge(isLeaf bool)   { m.merges[nodeIndex(isLeaf)].Add(1) }
+func (m *PrometheusMetrics) WALAppend(bytes int) { m.walRecords.Add(1); m.walBytes.Add(int64(bytes)) }
+
+func (m *PrometheusMetrics) Fsync(file string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.fsyncs[file]++
+}
+
+func (m *PrometheusMetrics) Operation(op string, d time.Duration) {
+	seconds := d.Seconds()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h, ok := m.operations[op]
+	if !ok {
+		h = &latencyHistogram{counts: make([]int64, len(operationBuckets)+1)}
+		m.operations[op] = h
+	}
+	i, _ := slices.BinarySearch(operationBuckets, seconds)
+	h.counts[i]++
+	h.sum += seconds
+	h.count++
+}
+
+// HitRatio returns the fraction of page reads that the buffer pool answered from memory, or 0
+// before the first read.
+func (m *PrometheusMetrics) HitRatio() float64 {
+	hits, misses := m.pageHits.Load(), m.pageMisses.Load()
+	if hits+misses == 0 {
+		return 0
+	}
+	return float64(hits) / float64(hits+misses)
+}
+
+// WriteTo writes every metric to w in the Prometheus text exposition format.
+func (m *PrometheusMetrics) WriteTo(w io.Writer) (int64, error) {
+	var b bytes.Buffer
+	metric := func(name, kind, help string) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, helpEscaper.Replace(help), name, kind)
+	}
+	sample := func(name, labels string, value float64) {
+		if labels != "" {
+			labels = "{" + labels + "}"
+		}
+		fmt.Fprintf(&b, "%s%s %s\n", name, labels, formatFloat(value))
+	}
+
+	metric("btree_page_reads_total", "counter", "Pages read through the buffer pool, by whether they were cached.")
+	sample("btree_page_reads_total", `result="hit"`, float64(m.pageHits.Load()))
+	sample("btree_page_reads_total", `result="miss"`, float64(m.pageMisses.Load()))
+	metric("btree_buffer_pool_hit_ratio", "gauge", "Fraction of page reads answered from the buffer pool.")
+	sample("btree_buffer_pool_hit_ratio", "", m.HitRatio())
+	metric("btree_page_writes_total", "counter", "Pages written from the buffer pool to the page store.")
+	sample("btree_page_writes_total", "", float64(m.pageWrites.Load()))
+	metric("btree_splits_total", "counter", "Pages split by inserts.")
+	sample("btree_splits_total", `node="leaf"`, float64(m.splits[NodeTypeLeaf].Load()))
+	sample("btree_splits_total", `node="internal"`, float64(m.splits[NodeTypeInternal].Load()))
+	metric("btree_merges_total", "counter", "Pages merged by deletes.")
+	sample("btree_merges_total", `node="leaf"`, float64(m.merges[NodeTypeLeaf].Load()))
+	sample("btree_merges_total", `node="internal"`, float64(m.merges[NodeTypeInternal].Load()))
+	metric("btree_wal_records_total", "counter", "Records appended to the write-ahead log.")
+	sample("btree_wal_records_total", "", float64(m.walRecords.Load()))
+	metric("btree_wal_bytes_total", "counter", "Bytes appended to the write-ahead log.")
+	sample("btree_wal_bytes_total", "", float64(m.walBytes.Load()))
+
+	m.mu.Lock()
+	metric("btree_fsyncs_total", "counter", "Files forced to disk, by file.")
+	for _, file := range slices.Sorted(maps.Keys(m.fsyncs)) {
+		sample("btree_fsyncs_total", promLabel("file", file), float64(m.fsyncs[file]))
+	}
+	metric("btree_operation_duration_seconds", "histogram", "How long operations took, by operation.")
+	for _, op := range slices.Sorted(maps.Keys(m.operations)) {
+		h := m.operations[op]
+		var cumulative int64
+		for i, count := range h.counts {
+			cumulative += count
+			le := "+Inf"
+			if i < len(operationBuckets) {
+				le = formatFloat(operationBuckets[i])
+			}
+			sample("btree_operation_duration_seconds_bucket", promLabel("op", op)+","+promLabel("le", le), float64(cumulative))
+		}
+		sample("btree_operation_duration_seconds_sum", promLabel("op", op), h.sum)
+		sample("btree_operation_duration_seconds_count", promLabel("op", op), float64(h.count))
+	}
+	m.mu.Unlock()
+	return b.WriteTo(w)
+}
+
+// ServeHTTP serves the metrics to a Prometheus scrape.
+func (m *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+// The exposition format escapes a backslash and a line feed in help text, and a double quote too
+// in label values. Other characters are written as they are, unlike with Go's %q.
+var (
+	helpEscaper       = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+// promLabel returns the label name="value", with value escaped.
+func promLabel(name, value string) string {
+	return name + `="` + labelValueEscaper.Replace(value) + `"`
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// promSample is a sample line of the Prometheus text exposition format.
+type promSample struct {
+	name   string
+	labels map[string]string
+	value  float64
+}
+
+// parsePromText parses the text exposition format the way a Prometheus scrape does, and fails on
+// anything the format doesn't allow: a sample of a family without a TYPE line, samples of one
+// family split by another, bad escapes in label values, and values that aren't numbers. It returns
+// the samples and the type of every family.
+func parsePromText(r io.Reader) ([]promSample, map[string]string, error) {
+	var samples []promSample
+	types := make(map[string]string)
+	closed := make(map[string]bool)
+	family := ""
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if rest, ok := strings.CutPrefix(text, "# "); ok {
+			fields := strings.SplitN(rest, " ", 3)
+			if len(fields) < 3 {
+				return nil, nil, fmt.Errorf("line %d: bad comment %q", line, text)
+			}
+			switch fields[0] {
+			case "HELP":
+				if strings.Contains(strings.ReplaceAll(strings.ReplaceAll(fields[2], `\\`, ""), `\n`, ""), `\`) {
+					return nil, nil, fmt.Errorf("line %d: bad escape in help text %q", line, fields[2])
+				}
+			case "TYPE":
+				if _, ok := types[fields[1]]; ok {
+					return nil, nil, fmt.Errorf("line %d: second TYPE line for %s", line, fields[1])
+				}
+				types[fields[1]] = fields[2]
+			}
+			continue
+		}
+		s, err := parsePromSample(text)
+		if err != nil {
+			return nil, nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		name := s.name
+		if types[name] == "" {
+			for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+				if base, ok := strings.CutSuffix(s.name, suffix); ok && types[base] == "histogram" {
+					name = base
+				}
+			}
+		}
+		if types[name] == "" {
+			return nil, nil, fmt.Errorf("line %d: sample of %s comes before its TYPE line", line, s.name)
+		}
+		if name != family {
+			if closed[name] {
+				return nil, nil, fmt.Errorf("line %d: samples of %s are not together", line, name)
+			}
+			closed[family], family = true, name
+		}
+		samples = append(samples, s)
+	}
+	return samples, types, scanner.Err()
+}
+
+// parsePromSample parses a line such as name{a="x",b="y"} 1.5.
+func parsePromSample(text string) (promSample, error) {
+	s := promSample{labels: make(map[string]string)}
+	end := strings.IndexAny(text, "{ ")
+	if end <= 0 {
+		return s, fmt.Errorf("bad sample %q", text)
+	}
+	s.name, text = text[:end], text[end:]
+	if rest, ok := strings.CutPrefix(text, "{"); ok {
+		text = rest
+		for !strings.HasPrefix(text, "}") {
+			name, rest, ok := strings.Cut(text, `="`)
+			if !ok {
+				return s, fmt.Errorf("bad label in %q", text)
+			}
+			var value strings.Builder
+			i := 0
+			for ; i < len(rest) && rest[i] != '"'; i++ {
+				if rest[i] != '\\' {
+					value.WriteByte(rest[i])
+					continue
+				}
+				i++
+				switch {
+				case i == len(rest):
+					return s, fmt.Errorf("label %s ends in a backslash", name)
+				case rest[i] == '\\' || rest[i] == '"':
+					value.WriteByte(rest[i])
+				case rest[i] == 'n':
+					value.WriteByte('\n')
+				default:
+					return s, fmt.Errorf(`label %s has the escape \%c`, name, rest[i])
+				}
+			}
+			if i == len(rest) {
+				return s, fmt.Errorf("label %s isn't closed", name)
+			}
+			if _, ok := s.labels[name]; ok {
+				return s, fmt.Errorf("label %s appears twice", name)
+			}
+			s.labels[name] = value.String()
+			text = strings.TrimPrefix(rest[i+1:], ",")
+		}
+		text = text[1:]
+	}
+	value, ok := strings.CutPrefix(text, " ")
+	if !ok {
+		return s, fmt.Errorf("no value in sample of %s", s.name)
+	}
+	var err error
+	if s.value, err = strconv.ParseFloat(value, 64); err != nil {
+		return s, fmt.Errorf("value of %s: %w", s.name, err)
+	}
+	return s, nil
+}
+
+// TestPrometheusMetrics scrapes a PrometheusMetrics over HTTP and parses what it serves, with label
+// values that need escaping and latencies in every bucket, on both sides of each bound.
+func TestPrometheusMetrics(t *testing.T) {
+	m := NewPrometheusMetrics()
+	m.PageRead(true)
+	m.PageRead(false)
+	m.Split(true)
+	m.WALAppend(100)
+	m.Fsync("wal")
+	oddOp := "a \"quoted\"\nop\\\té"
+	var want []time.Duration
+	for _, bound := range operationBuckets {
+		d := time.Duration(bound * float64(time.Second))
+		want = append(want, d, d+time.Microsecond)
+	}
+	want = append(want, 2*time.Second)
+	for _, d := range want {
+		m.Operation("search", d)
+		m.Operation(oddOp, d)
+	}
+	m.Fsync(oddOp)
+
+	server := httptest.NewServer(m)
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if contentType := resp.Header.Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain; version=0.0.4") {
+		t.Fatalf("Content-Type %q", contentType)
+	}
+	samples, types, err := parsePromText(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if types["btree_operation_duration_seconds"] != "histogram" {
+		t.Fatalf("btree_operation_duration_seconds has type %q", types["btree_operation_duration_seconds"])
+	}
+
+	fsyncs := make(map[string]float64)
+	buckets := make(map[string][]promSample)
+	counts := make(map[string]float64)
+	for _, s := range samples {
+		switch s.name {
+		case "btree_fsyncs_total":
+			fsyncs[s.labels["file"]] = s.value
+		case "btree_operation_duration_seconds_bucket":
+			buckets[s.labels["op"]] = append(buckets[s.labels["op"]], s)
+		case "btree_operation_duration_seconds_count":
+			counts[s.labels["op"]] = s.value
+		}
+	}
+	if fsyncs["wal"] != 1 || fsyncs[oddOp] != 1 {
+		t.Fatalf("fsyncs %v, want 1 for %q and for %q", fsyncs, "wal", oddOp)
+	}
+	for _, op := range []string{"search", oddOp} {
+		if len(buckets[op]) != len(operationBuckets)+1 {
+			t.Fatalf("op %q has %d buckets, want %d", op, len(buckets[op]), len(operationBuckets)+1)
+		}
+		previousBound, previousCount := math.Inf(-1), 0.0
+		for i, s := range buckets[op] {
+			bound, err := strconv.ParseFloat(s.labels["le"], 64)
+			if err != nil {
+				t.Fatalf("op %q: le %q: %v", op, s.labels["le"], err)
+			}
+			if bound <= previousBound || s.value < previousCount {
+				t.Fatalf("op %q: bucket le=%s of %g follows le=%g of %g", op, s.labels["le"], s.value, previousBound, previousCount)
+			}
+			// A bucket counts the latency equal to its bound and both latencies of every lower bound;
+			// the +Inf bucket counts them all.
+			wantCount := float64(len(want))
+			if i < len(operationBuckets) {
+				wantCount = float64(2*i + 1)
+			}
+			if s.value != wantCount {
+				t.Fatalf("op %q: bucket le=%s holds %g latencies, want %g", op, s.labels["le"], s.value, wantCount)
+			}
+			previousBound, previousCount = bound, s.value
+		}
+		if last := buckets[op][len(buckets[op])-1]; last.labels["le"] != "+Inf" || last.value != counts[op] {
+			t.Fatalf("op %q: last bucket le=%s of %g, want le=+Inf of %g, the count", op, last.labels["le"], last.value, counts[op])
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+)
+
+// =================================================================================================
+// --- optimistic.go --- (Optimistic Reads over a B-link Tree)
+// =================================================================================================
+
+// The tree itself isn't safe for concurrent use: a lookup that runs while an insert splits a page
+// can read the parent before the split and the child after it, and miss a key that moved to the
+// new sibling. The simple way out is a latch around the whole tree, which readers share and a
+// writer takes alone, so every lookup waits for the insert in progress. OptimisticSearch takes no
+// latch instead, and doesn't wait for splits either: the tree is a B-link tree (see slotted.go).
+// Every page that has been split knows its high key and its right sibling, and a split writes the
+// new right page before the left one. A reader that comes to a page for a key at or past its high
+// key, because it read the parent before the split, follows the right link to the page that holds
+// the key now:
+//
+//	parent (read before the split)
+//	   |
+//	   v
+//	[ 10 20 | high 30 ] --right link--> [ 30 40 | high 50 ]   (lookup of 40)
+//
+// Each page is copied whole from the buffer pool, so a reader never sees half of a write. Borrows
+// and merges are different: they move keys to the left, and release pages a reader may be about
+// to read. Once EnableOptimisticReads has been called, the buffer pool keeps a version for every
+// page a rebalance changes:
+//
+//	lock      at the start of a borrow, merge or root shrink: the version goes up by 1, to an
+//	          odd number, for the page, its parent and its siblings
+//	unlock    at the end: the version goes up by 1 again, to an even number
+//
+// A reader copies each page with its version and goes on without holding anything. After it has
+// copied the next page, down to a child or right to a sibling, it checks that the page it came
+// from still has the version it read: then no rebalance has begun there since, and the link it
+// followed still leads where it did. An odd version, or a page that changed, sends the reader back
+// to the root, which it takes from sharedRoot; so does a root that has changed by the time it has
+// been read. The writer updates sharedRoot before a new root is used. A rebalance only sends back
+// the readers that pass through the pages it changes, and splits don't change versions at all.
+//
+//	tree.EnableOptimisticReads()
+//	go func() { value, found, err := tree.OptimisticSearch(42) }() // alongside tree.Insert
+//
+// There is still a single writer, the goroutine that calls the tree's other methods. They must
+// not be Compact, Purge, the bulk builds or anything else that rewrites the file, and the tree
+// must not be part of a DB or hold buckets: those change pages and roots outside of splits and
+// rebalances. `go run . bench` compares OptimisticLookup with RWMutexLookup, the same lookups
+// behind a tree-wide sync.RWMutex, while a writer inserts and deletes keys. There is no latch
+// coupling to compare with: the tree has no latches per page.
+
+var errOptimisticReadsOff = errors.New("optimistic reads are not enabled on the tree")
+
+// EnableOptimisticReads lets other goroutines call OptimisticSearch while the calling goroutine
+// goes on modifying the tree. It must be called before they start.
+func (t *BPlusTree) EnableOptimisticReads() {
+	t.pool.trackVersions()
+	t.sharedRoot.Store(int64(t.rootPageID))
+	t.optimistic.Store(true)
+}
+
+// OptimisticSearch is Search that may run concurrently with the tree's writer. It restarts from
+// the root whenever the writer rebalances a page on its way. It doesn't consult the Bloom filter
+// or report to the tracer or metrics.
+func (t *BPlusTree) OptimisticSearch(key int) (int64, bool, error) {
+	if !t.optimistic.Load() {
+		return 0, false, errOptimisticReadsOff
+	}
+	for {
+		value, found, restart, err := t.optimisticSearch(key)
+		if !restart {
+			return value, found, err
+		}
+		runtime.Gosched()
+	}
+}
+
+// optimisticSearch makes one attempt at OptimisticSearch. restart is set if a rebalance got in
+// the way, in which case the other results mean nothing.
+func (t *BPlusTree) optimisticSearch(key int) (value int64, found, restart bool, err error) {
+	pageID := PageID(t.sharedRoot.Load())
+	// from is the page the reader came from, with the version it had then, and -1 at the root.
+	from, fromVersion := PageID(-1), uint64(0)
+	// low is the high key of the last page the reader moved right from. Every page it moves to
+	// must have a higher one, or the right links go in a circle.
+	var low *int
+	depth := 0
+	buf := getPageBuffer()
+	defer putPageBuffer(buf)
+	for {
+		page, version, err := t.readOptimistic(pageID, buf)
+		if version%2 == 1 {
+			return 0, false, true, nil
+		}
+		if from < 0 && pageID != PageID(t.sharedRoot.Load()) || from >= 0 && t.pool.pageVersion(from) != fromVersion {
+			return 0, false, true, nil
+		}
+		if err != nil {
+			return 0, false, false, err
+		}
+		from, fromVersion = pageID, version
+		if high, ok := highKey(page); ok && key >= high {
+			if low != nil && high <= *low {
+				return 0, false, false, fmt.Errorf("%w: page %d has high key %d, not above the high key %d of its left sibling", ErrCorruptPage, pageID, high, *low)
+			}
+			pageID, low = rightLink(page), &high
+			continue
+		}
+		if isLeaf(page) {
+			return leafValue(page, key)
+		}
+		if depth++; depth >= maxTreeDepth {
+			return 0, false, false, errTooDeep(PageID(t.sharedRoot.Load()))
+		}
+		numKeys := int(getNumKeys(page))
+		i := 0
+		for i < numKeys && key >= keyAt(page, i) {
+			i++
+		}
+		pageID, low = childAt(page, i), nil
+	}
+}
+
+// leafValue looks key up in a leaf, for optimisticSearch.
+func leafValue(page *Page, key int) (value int64, found, restart bool, err error) {
+	for i := range int(getNumKeys(page)) {
+		if keyAt(page, i) != key {
+			continue
+		}
+		if inline, _, _ := leafValueAt(page, i); len(inline) != 8 {
+			return 0, false, false, errNotInt64Value
+		}
+		return valueAt(page, i), true, false, nil
+	}
+	return 0, false, false, nil
+}
+
+// readOptimistic copies a page from the buffer pool into buf, with its version, and checks it as
+// readPage does. A page that fails the check may be one a rebalance has since released, so the
+// caller validates the page it came from before it reports the error.
+func (t *BPlusTree) readOptimistic(pageID PageID, buf *Page) (*Page, uint64, error) {
+	page, version, err := t.pool.readVersioned(pageID, buf)
+	if err == nil {
+		err = t.checkPage(pageID, page)
+	}
+	if err == nil && page[nodeTypeOffset] > NodeTypeInternal {
+		err = errNotTreeNode(pageID, page)
+	}
+	return page, version, err
+}
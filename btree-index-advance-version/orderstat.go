@@ -0,0 +1,153 @@
+package main
+
+// =================================================================================================
+// --- orderstat.go --- (Order Statistics)
+// =================================================================================================
+
+// Every internal page records how many entries lie under each of its children (see slotted.go).
+// Descending the tree while adding up the counts of the children to the left of the path gives
+// the position of a key in O(log n) page reads, and following the counts the other way finds the
+// entry at a given position. The counts are kept up to date by every insert, delete, split,
+// borrow and merge.
+
+// Len returns the number of keys in the tree, from the root page alone.
+func (t *BPlusTree) Len() (int, error) {
+	page, err := t.readPage(t.rootPageID)
+	if err != nil {
+		return 0, err
+	}
+	return subtreeCount(page), nil
+}
+
+// Rank returns the number of keys smaller than key.
+func (t *BPlusTree) Rank(key int) (int, error) {
+	return t.rank(key, false)
+}
+
+// rank returns the number of keys smaller than key, or smaller than or equal to it if inclusive.
+func (t *BPlusTree) rank(key int, inclusive bool) (int, error) {
+	rank := 0
+	pageID := t.rootPageID
+	for {
+		page, err := t.readPage(pageID)
+		if err != nil {
+			return 0, err
+		}
+		numKeys := int(getNumKeys(page))
+		if isLeaf(page) {
+			for i := 0; i < numKeys && (keyAt(page, i) < key || inclusive && keyAt(page, i) == key); i++ {
+				rank++
+			}
+			return rank, nil
+		}
+		// Children left of the one the key belongs in hold only smaller keys.
+		i := 0
+		for i < numKeys && key >= keyAt(page, i) {
+			rank += childCountAt(page, i)
+			i++
+		}
+		pageID = childAt(page, i)
+	}
+}
+
+// SelectNth returns the n-th smallest key, counting from 0. It reports false if the tree holds
+// n or fewer keys.
+func (t *BPlusTree) SelectNth(n int) (int, bool, error) {
+	page, i, err := t.selectEntry(n)
+	if page == nil || err != nil {
+		return 0, false, err
+	}
+	return keyAt(page, i), true, nil
+}
+
+// selectEntry returns the leaf holding the n-th smallest key and the key's index in it, or a nil
+// page if the tree holds n or fewer keys.
+func (t *BPlusTree) selectEntry(n int) (*Page, int, error) {
+	if n < 0 {
+		return nil, 0, nil
+	}
+	pageID := t.rootPageID
+	for {
+		page, err := t.readPage(pageID)
+		if err != nil {
+			return nil, 0, err
+		}
+		numKeys := int(getNumKeys(page))
+		if isLeaf(page) {
+			if n >= numKeys {
+				return nil, 0, nil
+			}
+			return page, n, nil
+		}
+		i := 0
+		for i < numKeys && n >= childCountAt(page, i) {
+			n -= childCountAt(page, i)
+			i++
+		}
+		pageID = childAt(page, i)
+	}
+}
+
+// CountRange returns the number of keys in [startKey, endKey] from two descents of the tree,
+// without reading the leaves in between.
+func (t *BPlusTree) CountRange(startKey, endKey int) (int, error) {
+	if startKey > endKey {
+		return 0, nil
+	}
+	before, err := t.rank(startKey, false)
+	if err != nil {
+		return 0, err
+	}
+	through, err := t.rank(endKey, true)
+	if err != nil {
+		return 0, err
+	}
+	return through - before, nil
+}
+
+// Min returns the smallest key. It reports false if the tree is empty.
+func (t *BPlusTree) Min() (int, bool, error) {
+	return t.SelectNth(0)
+}
+
+// Max returns the largest key, following the rightmost child down to the last leaf. It reports
+// false if the tree is empty.
+func (t *BPlusTree) Max() (int, bool, error) {
+	pageID := t.rootPageID
+	for {
+		page, err := t.readPage(pageID)
+		if err != nil {
+			return 0, false, err
+		}
+		numKeys := int(getNumKeys(page))
+		if isLeaf(page) {
+			if numKeys == 0 {
+				return 0, false, nil
+			}
+			return keyAt(page, numKeys-1), true, nil
+		}
+		pageID = childAt(page, numKeys)
+	}
+}
+
+// Floor returns the largest key <= key. Leaves are only linked forwards, so when that key sits
+// in the leaf before the one key belongs in, a leaf walk can't reach it; the rank can.
+func (t *BPlusTree) Floor(key int) (int, bool, error) {
+	through, err := t.rank(key, true)
+	if err != nil || through == 0 {
+		return 0, false, err
+	}
+	return t.SelectNth(through - 1)
+}
+
+// Ceiling returns the smallest key >= key.
+func (t *BPlusTree) Ceiling(key int) (int, bool, error) {
+	c, err := t.Seek(key)
+	if err != nil {
+		return 0, false, err
+	}
+	if !c.Next() {
+		return 0, false, c.Err()
+	}
+	return c.Key(), true, nil
+}
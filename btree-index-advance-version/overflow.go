@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// =================================================================================================
+// --- overflow.go --- (Overflow Pages for Large Values)
+// =================================================================================================
+
+// A leaf cell holds its value inline only while the value is small enough for a full leaf to still
+// fit in a page (see maxInlineValueSize). A larger value is written to a chain of overflow pages
+// and the cell keeps just the value's size and the ID of the first page of the chain.
+//
+// Overflow page layout:
+//
+//	| header (32 bytes) | payload ... |
+//
+// The header reuses the node header fields: the node type is NodeTypeOverflow, numKeys holds the
+// number of payload bytes on the page and the next-leaf slot links to the next page of the chain
+// (-1 on the last one).
+
+const NodeTypeOverflow = 2
+
+// overflowPayloadSize is the number of value bytes an overflow page holds.
+const overflowPayloadSize = PageSize - headerSize
+
+var errNotInt64Value = errors.New("value was not stored as an int64; use SearchBytes")
+
+// maxInlineValueSize returns the largest value stored directly in a leaf cell. It is chosen so
+// that a leaf with degree-1 cells of that size still fits in a page, next to a fence.
+func (t *BPlusTree) maxInlineValueSize() int {
+	return (PageSize-headerSize-fenceSize)/(t.degree-1) - cellPointerSize - leafCellHeaderSize
+}
+
+// newLeafCell builds the cell for a key/value pair, moving the value to overflow pages if it is
+// too large to be stored inline.
+func (t *BPlusTree) newLeafCell(key int, value []byte) ([]byte, error) {
+	if len(value) <= t.maxInlineValueSize() {
+		return leafCell(key, value), nil
+	}
+	firstPageID, err := t.writeOverflowChain(value)
+	if err != nil {
+		return nil, err
+	}
+	return overflowLeafCell(key, len(value), firstPageID), nil
+}
+
+// writeOverflowChain stores value in newly allocated overflow pages and returns the first one.
+func (t *BPlusTree) writeOverflowChain(value []byte) (PageID, error) {
+	numPages := (len(value) + overflowPayloadSize - 1) / overflowPayloadSize
+	pageIDs := make([]PageID, numPages)
+	for i := range pageIDs {
+		pageIDs[i] = t.pager.AllocatePage()
+	}
+	for i, pageID := range pageIDs {
+		chunk := value[i*overflowPayloadSize : min((i+1)*overflowPayloadSize, len(value))]
+		page := new(Page)
+		page[nodeTypeOffset] = NodeTypeOverflow
+		setParentPageID(page, -1)
+		setNumKeys(page, uint16(len(chunk)))
+		next := PageID(-1)
+		if i+1 < len(pageIDs) {
+			next = pageIDs[i+1]
+		}
+		setNextLeafPageID(page, next)
+		copy(page[headerSize:], chunk)
+		if err := t.writePage(pageID, page); err != nil {
+			return -1, err
+		}
+	}
+	return pageIDs[0], nil
+}
+
+// readOverflowChain reads a value of the given size from the chain starting at firstPageID.
+func (t *BPlusTree) readOverflowChain(firstPageID PageID, size int) ([]byte, error) {
+	value := make([]byte, 0, size)
+	for pageID := firstPageID; len(value) < size; {
+		if pageID == -1 {
+			return nil, fmt.Errorf("%w: overflow chain ends after %d of %d bytes", ErrCorruptPage, len(value), size)
+		}
+		page, err := t.readPage(pageID)
+		if err != nil {
+			return nil, err
+		}
+		if page[nodeTypeOffset] != NodeTypeOverflow {
+			return nil, fmt.Errorf("%w: page %d in an overflow chain is not an overflow page", ErrCorruptPage, pageID)
+		}
+		value = append(value, page[headerSize:headerSize+int(getNumKeys(page))]...)
+		pageID = getNextLeafPageID(page)
+	}
+	return value, nil
+}
+
+// freeOverflowChain releases every page of the chain starting at firstPageID.
+func (t *BPlusTree) freeOverflowChain(firstPageID PageID) error {
+	for pageID := firstPageID; pageID != -1; {
+		page, err := t.readPage(pageID)
+		if err != nil {
+			return err
+		}
+		next := getNextLeafPageID(page)
+		if err := t.releasePage(pageID, page); err != nil {
+			return err
+		}
+		pageID = next
+	}
+	return nil
+}
+
+// leafValue returns the value of the i-th entry of a leaf page, reading its overflow pages if needed.
+func (t *BPlusTree) leafValue(page *Page, i int) ([]byte, error) {
+	inline, size, overflow := leafValueAt(page, i)
+	if inline != nil {
+		return append([]byte(nil), inline...), nil
+	}
+	return t.readOverflowChain(overflow, size)
+}
@@ -0,0 +1,34 @@
+package main
+
+import "sync"
+
+// =================================================================================================
+// --- pagepool.go --- (Reusable Page Buffers)
+// =================================================================================================
+
+// Reading a page copies it into a buffer the caller owns, so that the caller can change it and
+// write it back. Most reads only look: a lookup looks at each page on its way down, and a scan at
+// each leaf until it moves on to the next. A fresh 4KB page for every one of those reads leaves the
+// garbage collector a page per level of every lookup and a page per leaf of every scan. Reads that
+// only look borrow a buffer from pageBuffers instead, and read page after page into it:
+//
+//	buf := getPageBuffer()
+//	defer putPageBuffer(buf)
+//	page, err := t.readPageInto(pageID, buf)
+//
+// A buffer can't be used once it is put back, so only a caller that is done with the page, and
+// hasn't handed it on, puts it back. A Cursor reads each leaf into the same buffer, and so does a
+// Finger, and the buffer pool reuses the frame of the page it evicts for the page it loads.
+
+// pageBuffers holds page buffers for reuse. Their contents are whatever the last user left.
+var pageBuffers = sync.Pool{New: func() any { return new(Page) }}
+
+// getPageBuffer returns a page buffer for reading into, not zeroed.
+func getPageBuffer() *Page {
+	return pageBuffers.Get().(*Page)
+}
+
+// putPageBuffer returns a buffer from getPageBuffer for reuse.
+func putPageBuffer(buf *Page) {
+	pageBuffers.Put(buf)
+}
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"sync"
 )
 
 // =================================================================================================
@@ -14,66 +17,355 @@ const PageSize = 4096 // A typical page size
 type PageID int64
 type Page [PageSize]byte
 
+// Errors returned by page stores, and passed on by the tree. Compare with errors.Is.
+var (
+	// ErrPageOutOfRange means a page beyond the end of the store was read.
+	ErrPageOutOfRange = errors.New("page out of range")
+	// ErrCorruptPage means a page's contents don't make sense, e.g. an unknown node type or a
+	// broken overflow chain.
+	ErrCorruptPage = errors.New("corrupt page")
+	// ErrTreeClosed means the tree, or the page store under it, has been closed.
+	ErrTreeClosed = errors.New("tree is closed")
+	// ErrLocked means another process has the index file open in a conflicting mode: any other
+	// process for a writer, a writer for a reader (see pager_lock.go).
+	ErrLocked = errors.New("index file is locked by another process")
+	// ErrReadOnly means a page was written to a store opened read-only.
+	ErrReadOnly = errors.New("index file is open read-only")
+)
+
+// PageStore is where the tree's pages live. The tree only depends on this interface, so the
+// ReadAt-based Pager below can be swapped for another implementation such as MmapPager.
+type PageStore interface {
+	// ReadPage returns the page with the given ID. Implementations may fill pageData and return
+	// it, or return a page of their own that the caller must treat as read-only. pageData is the
+	// caller's buffer, which it may reuse for read after read (see pagepool.go).
+	ReadPage(pageID PageID, pageData *Page) (*Page, error)
+	WritePage(pageID PageID, pageData *Page) error
+	// AllocatePage reserves the next page ID at the end of the store.
+	AllocatePage() PageID
+	NumPages() int64
+	Close() error
+}
+
+// pageFile is the file a Pager keeps its pages in: an *os.File, or the segments of a segmented
+// index (see segment.go).
+type pageFile interface {
+	io.ReaderAt
+	io.WriterAt
+	Sync() error
+	Truncate(size int64) error
+	Close() error
+	Name() string
+}
+
 type Pager struct {
-	file     *os.File
+	mu       sync.Mutex
+	path     string
+	file     pageFile
 	fileSize int64
 	numPages int64
+	closed   bool
+	readOnly bool // opened by NewReadOnlyPager
+	temp     bool // created by NewTempPager
+	// cipher encrypts the pages in the file, if it is encrypted (see encrypt.go).
+	cipher *pageCipher
+
+	// dirty holds the pages written since the last checkpoint (see checkpoint.go).
+	dirty        map[PageID]struct{}
+	checkpointed bool
+	// snapshot is the copy-on-write snapshot of a checkpoint in progress, if any.
+	snapshot *pageSnapshot
+
+	// readAhead prefetches pages for sequential scans (see readahead.go).
+	readAhead readAheadState
+
+	// metrics counts the fsyncs, if set (see metrics.go).
+	metrics Metrics
 }
 
+// NewPager opens the index file at path for reading and writing, creating it if it doesn't exist.
+// It takes an exclusive lock on the file, so it fails with ErrLocked while any other process has
+// the file open through a Pager, and so does any other process that tries while this one has it.
 func NewPager(path string) (*Pager, error) {
-	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+	return openPager(path, nil, false, nil)
+}
+
+// NewReadOnlyPager opens an existing index file for reading only. It takes a shared lock, so any
+// number of readers can have the file open at once, but not while a writer does. WritePage fails
+// with ErrReadOnly.
+func NewReadOnlyPager(path string) (*Pager, error) {
+	return openPager(path, nil, true, nil)
+}
+
+// NewTempPager creates an anonymous index file in dir, or in os.TempDir() if dir is empty, for a
+// short-lived index such as the runs of a sort or the inputs of a merge. The file is unlinked as
+// soon as it is open, so nothing is left behind once the pager is closed, even by a crash. Its
+// writes aren't synced, since nothing reads them after a crash. Where an open file can't be
+// unlinked, as on Windows, Close removes it instead. A tree on it saves no Bloom filter.
+func NewTempPager(dir string) (*Pager, error) {
+	file, err := os.CreateTemp(dir, "btree-*.idx")
+	if err != nil {
+		return nil, err
+	}
+	path := file.Name()
+	file.Close()
+	p, err := openPager(path, nil, false, nil)
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	p.temp = true
+	os.Remove(path)
+	return p, nil
+}
+
+// openPager opens the index file at path, whose pages are encrypted with c unless c is nil. If
+// segments isn't nil, a missing or empty file becomes a segmented index with those options.
+func openPager(path string, c *pageCipher, readOnly bool, segments *SegmentOptions) (*Pager, error) {
+	flag := os.O_RDWR | os.O_CREATE
+	if readOnly {
+		flag = os.O_RDONLY
+	}
+	file, err := os.OpenFile(path, flag, 0666)
 	if err != nil {
 		return nil, err
 	}
+	if err := lockFile(file, !readOnly); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("opening %s: %w", path, err)
+	}
 
 	stat, err := file.Stat()
 	if err != nil {
+		file.Close()
 		return nil, err
 	}
+	if segments != nil && stat.Size() == 0 {
+		if err := writeSegmentManifest(file, 1, segments.SegmentPages, segments.Dirs); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
 
-	fileSize := stat.Size()
-	numPages := fileSize / PageSize
+	pf, fileSize := pageFile(file), stat.Size()
+	if segmented, err := isSegmentManifest(file); err != nil || segmented {
+		if err == nil && c != nil {
+			err = errSegmentedEncrypted
+		}
+		var sf *segmentedFile
+		if err == nil {
+			sf, err = openSegments(path, file, readOnly, c.frameSize())
+		}
+		if err == nil {
+			pf = sf
+			if fileSize, err = sf.size(); err != nil {
+				sf.Close()
+				return nil, err
+			}
+		}
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+	} else if segments != nil {
+		file.Close()
+		return nil, fmt.Errorf("opening %s: %w", path, errNotSegmented)
+	}
+	// The check comes before anything is cut off the file: a frame of an encrypted file opened
+	// without a key would look like a page followed by a partial one.
+	if err := checkEncryption(pf, fileSize, c); err != nil {
+		pf.Close()
+		return nil, err
+	}
+	if partial := fileSize % c.frameSize(); partial != 0 {
+		// A crash while a page past the end was being written leaves part of it behind. The write
+		// never returned, so the page is cut off, as a torn record at the end of the log is (see
+		// wal.go). A reader can't, and treats the file as corrupt.
+		if readOnly {
+			pf.Close()
+			return nil, fmt.Errorf("%w: %s ends in %d bytes of a partial page", ErrCorruptPage, path, partial)
+		}
+		fileSize -= partial
+		if err := pf.Truncate(fileSize); err != nil {
+			pf.Close()
+			return nil, err
+		}
+	}
+	numPages := fileSize / c.frameSize()
 
-	return &Pager{
-		file:     file,
+	p := &Pager{
+		path:     path,
+		file:     pf,
 		fileSize: fileSize,
 		numPages: numPages,
-	}, nil
+		readOnly: readOnly,
+		cipher:   c,
+		dirty:    make(map[PageID]struct{}),
+		readAhead: readAheadState{
+			pages:    defaultReadAheadPages,
+			lastRead: -2,
+			hinted:   -1,
+		},
+	}
+	if c != nil {
+		p.readAhead.pages = 0
+	}
+	return p, nil
 }
 
 func (p *Pager) ReadPage(pageID PageID, pageData *Page) (*Page, error) {
-	offset := int64(pageID) * PageSize
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return pageData, ErrTreeClosed
+	}
+	if ok, err := p.readWithReadAhead(pageID, pageData); ok || err != nil {
+		return pageData, err
+	}
+	return p.readPage(pageID, pageData)
+}
+
+// readPage reads a page from the file. The caller must hold p.mu.
+func (p *Pager) readPage(pageID PageID, pageData *Page) (*Page, error) {
+	offset := int64(pageID) * p.cipher.frameSize()
 	if offset >= p.fileSize {
-		return pageData, fmt.Errorf("read past end of file: pageID %d, offset %d, fileSize %d", pageID, offset, p.fileSize)
+		return pageData, fmt.Errorf("%w: read past end of file: pageID %d, offset %d, fileSize %d", ErrPageOutOfRange, pageID, offset, p.fileSize)
 	}
-	_, err := p.file.ReadAt(pageData[:], offset)
-	return pageData, err
+	return pageData, p.cipher.readFrame(p.file, pageID, pageData)
 }
 
 func (p *Pager) WritePage(pageID PageID, pageData *Page) error {
-	offset := int64(pageID) * PageSize
-	_, err := p.file.WriteAt(pageData[:], offset)
-	if err != nil {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return ErrTreeClosed
+	}
+	if p.readOnly {
+		return ErrReadOnly
+	}
+
+	// A running checkpoint must still see the page as it was when the checkpoint began.
+	if err := p.preserveForSnapshot(pageID); err != nil {
 		return err
 	}
 
+	if err := p.cipher.writeFrame(p.file, pageID, pageData); err != nil {
+		return err
+	}
+	p.dirty[pageID] = struct{}{}
+	p.readAhead.updateWindow(pageID, pageData)
+
 	// Update the file size and page count if we've written a new page
 	// past the previous end of the file.
-	if offset+PageSize > p.fileSize {
-		p.fileSize = offset + PageSize
-		p.numPages = p.fileSize / PageSize
+	frameSize := p.cipher.frameSize()
+	if end := (int64(pageID) + 1) * frameSize; end > p.fileSize {
+		p.fileSize = end
+		p.numPages = p.fileSize / frameSize
 	}
 
+	if p.temp {
+		return nil
+	}
+	if p.metrics != nil {
+		p.metrics.Fsync("index")
+	}
 	return p.file.Sync()
 }
 
+// setMetrics installs the metrics the pager reports its fsyncs to, or removes them if metrics is
+// nil.
+func (p *Pager) setMetrics(metrics Metrics) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.metrics = metrics
+}
+
+func (p *Pager) NumPages() int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.numPages
+}
+
+// AllocatePage reserves the next page ID and extends the file with it, holding a released page
+// (see BPlusTree.releasePage). Whatever points to the page is written after it was allocated, so
+// the fsync that makes that write durable makes the extension durable too: after a crash, the
+// file never ends before a page that a parent, the meta page or the log refers to. If the file
+// can't be extended, the page is reserved all the same, and the file only grows when it is
+// written.
 func (p *Pager) AllocatePage() PageID {
-	pageID := p.numPages
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pageID := PageID(p.numPages)
 	p.numPages++
-	p.fileSize += PageSize
-	return PageID(pageID)
+	p.fileSize += p.cipher.frameSize()
+	if !p.closed && !p.readOnly && p.cipher.writeFrame(p.file, pageID, newReleasedPage()) == nil {
+		p.dirty[pageID] = struct{}{}
+	}
+	return pageID
+}
+
+// releaseAllocations forgets pages allocated beyond the first numPages that were never written,
+// e.g. by a transaction that rolled back, and cuts them off the end of the file. While a
+// checkpoint copies the file, or if the file can't be truncated, they stay in it as released
+// pages.
+func (p *Pager) releaseAllocations(numPages int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if numPages < p.numPages {
+		p.numPages = numPages
+		p.fileSize = numPages * p.cipher.frameSize()
+		p.readAhead.window = p.readAhead.window[:0]
+		if !p.closed && !p.readOnly && p.snapshot == nil {
+			p.file.Truncate(p.fileSize)
+		}
+	}
+}
+
+// replaceFile atomically replaces the pager's file with the one at newPath (see Compact).
+// Every page may have changed, so the next checkpoint has to be a full one.
+func (p *Pager) replaceFile(newPath string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.snapshot != nil {
+		return errCheckpointRunning
+	}
+	if err := os.Rename(newPath, p.path); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(p.path, os.O_RDWR, 0666)
+	if err != nil {
+		return err
+	}
+	// The lock was on the old file; nobody else can know the new one yet.
+	if err := lockFile(file, true); err != nil {
+		file.Close()
+		return err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	p.file.Close()
+	p.file = file
+	if p.temp {
+		os.Remove(p.path)
+	}
+	p.fileSize = stat.Size()
+	p.numPages = stat.Size() / p.cipher.frameSize()
+	p.dirty = make(map[PageID]struct{})
+	p.checkpointed = false
+	p.readAhead.window = p.readAhead.window[:0]
+	return nil
 }
 
 func (p *Pager) Close() error {
-	return p.file.Close()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	err := p.file.Close()
+	if p.temp {
+		os.Remove(p.path)
+	}
+	return err
 }
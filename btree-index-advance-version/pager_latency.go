@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// =================================================================================================
+// --- pager_latency.go --- (Disk Latency Simulator)
+// =================================================================================================
+
+// On a laptop's SSD, and with the page cache of the OS in between, every PageStore is fast, so the
+// benchmarks can't show why databases care so much about sequential access and about the number
+// of pages an operation touches. LatencyPageStore wraps another store and makes each access cost
+// what it would on a given kind of device:
+//
+//	store := NewLatencyPageStore(NewMemPageStore(), DiskHDD)
+//	tree := NewBPlusTree(store, 128)
+//
+// An access costs the profile's fixed latency for a read or a write, plus the seek latency if it
+// isn't to the page right after the one accessed before, plus the time to transfer a page at the
+// profile's throughput. On DiskHDD a random access costs a seek and a sequential one almost
+// nothing, while on DiskSSD both cost about the same; DiskMemory costs nothing at all.
+//
+// The device serves one access at a time, like a disk with a single queue. Sleeping for a few
+// microseconds takes much longer than that, so the store adds up the cost of the accesses and
+// sleeps once it owes a millisecond: single accesses return early, but any run of them takes as
+// long as the device would. `go run . bench -disk memory,ssd,hdd` runs the benchmark suite on a
+// MemPageStore behind each profile.
+//
+// The wrapper hides the store under it, so the features that need a *Pager, such as checkpoints
+// and compaction, aren't available through it.
+
+// latencySleepThreshold is how much simulated time a LatencyPageStore owes before it sleeps.
+const latencySleepThreshold = time.Millisecond
+
+// DiskProfile describes the cost of page accesses on a kind of device.
+type DiskProfile struct {
+	Name         string
+	ReadLatency  time.Duration // fixed cost of every read
+	WriteLatency time.Duration // fixed cost of every write
+	// SeekLatency is the extra cost of an access that isn't to the page after the previous one:
+	// the head moving and the platter turning on a hard disk.
+	SeekLatency time.Duration
+	// Throughput is the transfer rate in bytes per second; 0 means transfers cost nothing.
+	Throughput int64
+}
+
+// Typical devices. The figures are round numbers in the range of real hardware, not measurements.
+var (
+	DiskMemory = DiskProfile{Name: "memory"}
+	DiskSSD    = DiskProfile{Name: "ssd", ReadLatency: 80 * time.Microsecond, WriteLatency: 30 * time.Microsecond, Throughput: 500 << 20}
+	DiskHDD    = DiskProfile{Name: "hdd", ReadLatency: 100 * time.Microsecond, WriteLatency: 100 * time.Microsecond, SeekLatency: 8 * time.Millisecond, Throughput: 150 << 20}
+)
+
+var diskProfiles = []DiskProfile{DiskMemory, DiskSSD, DiskHDD}
+
+// DiskProfileByName returns the profile with the given name, ignoring case.
+func DiskProfileByName(name string) (DiskProfile, error) {
+	for _, profile := range diskProfiles {
+		if strings.EqualFold(profile.Name, name) {
+			return profile, nil
+		}
+	}
+	return DiskProfile{}, fmt.Errorf("unknown disk profile %q (available: memory, ssd, hdd)", name)
+}
+
+// cost returns the cost of an access, and whether it needs a seek.
+func (p DiskProfile) cost(write, sequential bool) (time.Duration, bool) {
+	d := p.ReadLatency
+	if write {
+		d = p.WriteLatency
+	}
+	if !sequential {
+		d += p.SeekLatency
+	}
+	if p.Throughput > 0 {
+		d += time.Duration(int64(PageSize) * int64(time.Second) / p.Throughput)
+	}
+	return d, !sequential && p.SeekLatency > 0
+}
+
+// DiskStats counts the accesses of a LatencyPageStore and the time they were charged.
+type DiskStats struct {
+	Reads, Writes int64
+	Seeks         int64         // accesses that paid the seek latency
+	Busy          time.Duration // the sum of the costs of every access
+}
+
+// LatencyPageStore is a PageStore that delays every access to the store it wraps as a device of
+// its profile would.
+type LatencyPageStore struct {
+	store   PageStore
+	profile DiskProfile
+
+	mu       sync.Mutex // held while an access is being charged, so accesses queue up
+	lastPage PageID     // the page accessed last, -1 before the first access
+	owed     time.Duration
+	stats    DiskStats
+}
+
+// NewLatencyPageStore wraps store in a LatencyPageStore with the given profile.
+func NewLatencyPageStore(store PageStore, profile DiskProfile) *LatencyPageStore {
+	return &LatencyPageStore{store: store, profile: profile, lastPage: -1}
+}
+
+// charge accounts for an access to pageID and sleeps off the time owed once it passes
+// latencySleepThreshold.
+func (l *LatencyPageStore) charge(pageID PageID, write bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	d, seek := l.profile.cost(write, l.lastPage != -1 && pageID == l.lastPage+1)
+	l.lastPage = pageID
+	if write {
+		l.stats.Writes++
+	} else {
+		l.stats.Reads++
+	}
+	if seek {
+		l.stats.Seeks++
+	}
+	l.stats.Busy += d
+	l.owed += d
+	if l.owed >= latencySleepThreshold {
+		// Sleep overshoots; the excess is credited to the next accesses.
+		start := time.Now()
+		time.Sleep(l.owed)
+		l.owed -= time.Since(start)
+	}
+}
+
+func (l *LatencyPageStore) ReadPage(pageID PageID, pageData *Page) (*Page, error) {
+	l.charge(pageID, false)
+	return l.store.ReadPage(pageID, pageData)
+}
+
+func (l *LatencyPageStore) WritePage(pageID PageID, pageData *Page) error {
+	l.charge(pageID, true)
+	return l.store.WritePage(pageID, pageData)
+}
+
+// AllocatePage only reserves an ID, which costs no access.
+func (l *LatencyPageStore) AllocatePage() PageID {
+	return l.store.AllocatePage()
+}
+
+func (l *LatencyPageStore) NumPages() int64 {
+	return l.store.NumPages()
+}
+
+func (l *LatencyPageStore) Close() error {
+	return l.store.Close()
+}
+
+// Profile returns the store's profile.
+func (l *LatencyPageStore) Profile() DiskProfile {
+	return l.profile
+}
+
+// Stats returns the accesses counted so far.
+func (l *LatencyPageStore) Stats() DiskStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.stats
+}
@@ -0,0 +1,36 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// =================================================================================================
+// --- pager_lock.go --- (Advisory File Locking)
+// =================================================================================================
+
+// lockFile takes an advisory flock on file: an exclusive one for a writer, a shared one for a
+// reader. It doesn't wait, so a file locked in a conflicting mode fails with ErrLocked at once.
+// The lock belongs to the open file and goes away when it is closed, or when the process dies.
+func lockFile(file *os.File, exclusive bool) error {
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	for {
+		err := syscall.Flock(int(file.Fd()), how|syscall.LOCK_NB)
+		switch {
+		case err == nil:
+			return nil
+		case errors.Is(err, syscall.EINTR):
+			continue
+		case errors.Is(err, syscall.EWOULDBLOCK):
+			return ErrLocked
+		default:
+			return err
+		}
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !(linux || darwin)
+
+package main
+
+import "os"
+
+// lockFile does nothing on platforms without flock (see pager_lock.go): two writers aren't kept
+// apart there.
+func lockFile(file *os.File, exclusive bool) error {
+	return nil
+}
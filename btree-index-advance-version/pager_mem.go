@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// =================================================================================================
+// --- pager_mem.go --- (In-Memory PageStore)
+// =================================================================================================
+
+// MemPageStore is a PageStore that keeps every page in memory. It never touches the filesystem,
+// which makes it the store of choice for the property checker and for experiments: a tree on
+// a MemPageStore behaves exactly like one on disk, just thousands of times faster.
+type MemPageStore struct {
+	mu       sync.Mutex
+	pages    map[PageID]*Page // pages that have been written
+	numPages int64
+	closed   bool
+}
+
+func NewMemPageStore() *MemPageStore {
+	return &MemPageStore{pages: make(map[PageID]*Page)}
+}
+
+// ReadPage copies the page into pageData, like Pager does, so callers are free to modify it.
+func (m *MemPageStore) ReadPage(pageID PageID, pageData *Page) (*Page, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return pageData, ErrTreeClosed
+	}
+	page, ok := m.pages[pageID]
+	if !ok {
+		return pageData, fmt.Errorf("%w: read of unwritten page %d (%d pages)", ErrPageOutOfRange, pageID, m.numPages)
+	}
+	*pageData = *page
+	return pageData, nil
+}
+
+func (m *MemPageStore) WritePage(pageID PageID, pageData *Page) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return ErrTreeClosed
+	}
+	pageCopy := *pageData
+	m.pages[pageID] = &pageCopy
+	m.numPages = max(m.numPages, int64(pageID)+1)
+	return nil
+}
+
+func (m *MemPageStore) AllocatePage() PageID {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	pageID := m.numPages
+	m.numPages++
+	return PageID(pageID)
+}
+
+func (m *MemPageStore) NumPages() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.numPages
+}
+
+// Close discards the pages. The store can't be used afterwards.
+func (m *MemPageStore) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pages, m.closed = nil, true
+	return nil
+}
@@ -0,0 +1,166 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// =================================================================================================
+// --- pager_mmap.go --- (Memory-Mapped PageStore)
+// =================================================================================================
+
+// MmapPager is a PageStore that maps the index file into memory instead of going through
+// ReadAt/WriteAt. ReadPage doesn't copy anything: it returns a pointer straight into the mapping,
+// so a page that is already in the OS page cache costs no system call and no copy to read.
+//
+// The mapping reserves more address space than the file needs, so the file can grow without
+// remapping. When it outgrows the reservation a larger mapping is created. The old mappings stay
+// valid until Close (they are shared views of the same file), so pages returned earlier can still
+// be read safely.
+type MmapPager struct {
+	mu       sync.Mutex
+	file     *os.File
+	data     []byte   // current mapping, len(data) is the reserved size
+	old      [][]byte // outgrown mappings, unmapped on Close
+	fileSize int64
+	numPages int64
+}
+
+// mmapInitialReserve is the address space reserved for a new mapping, in pages (64MB).
+const mmapInitialReserve = 16384
+
+func NewMmapPager(path string) (*MmapPager, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(file, true); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("opening %s: %w", path, err)
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	// Cut off a partial page at the end, as openPager does.
+	fileSize := stat.Size() / PageSize * PageSize
+	if fileSize != stat.Size() {
+		if err := file.Truncate(fileSize); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+
+	p := &MmapPager{file: file, fileSize: fileSize, numPages: fileSize / PageSize}
+	if err := p.remap(max(p.numPages, mmapInitialReserve)); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+// remap maps the file with room for the given number of pages. The caller must hold p.mu
+// (or be the constructor).
+func (p *MmapPager) remap(pages int64) error {
+	data, err := syscall.Mmap(int(p.file.Fd()), 0, int(pages*PageSize), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return err
+	}
+	if p.data != nil {
+		p.old = append(p.old, p.data)
+	}
+	p.data = data
+	return nil
+}
+
+// ReadPage returns the page as it is in the mapping. The returned page must not be modified;
+// pageData is left untouched.
+func (p *MmapPager) ReadPage(pageID PageID, pageData *Page) (*Page, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.data == nil {
+		return pageData, ErrTreeClosed
+	}
+
+	offset := int64(pageID) * PageSize
+	if offset >= p.fileSize {
+		return pageData, fmt.Errorf("%w: read past end of file: pageID %d, offset %d, fileSize %d", ErrPageOutOfRange, pageID, offset, p.fileSize)
+	}
+	return (*Page)(unsafe.Pointer(&p.data[offset])), nil
+}
+
+func (p *MmapPager) WritePage(pageID PageID, pageData *Page) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.data == nil {
+		return ErrTreeClosed
+	}
+	if err := p.writePage(pageID, pageData); err != nil {
+		return err
+	}
+	// On Linux, fsync also writes back pages dirtied through a shared mapping.
+	return p.file.Sync()
+}
+
+// writePage copies a page into the mapping, growing the file to hold it. The caller must hold
+// p.mu.
+func (p *MmapPager) writePage(pageID PageID, pageData *Page) error {
+	offset := int64(pageID) * PageSize
+	// Grow the file (and the reservation, if needed) before touching the mapping: writing to a
+	// mapped page that lies beyond the end of the file is a bus error.
+	if end := offset + PageSize; end > p.fileSize {
+		if end > int64(len(p.data)) {
+			if err := p.remap(max(2*int64(len(p.data)), end) / PageSize); err != nil {
+				return err
+			}
+		}
+		if err := p.file.Truncate(end); err != nil {
+			return err
+		}
+		p.fileSize = end
+		p.numPages = end / PageSize
+	}
+	copy(p.data[offset:offset+PageSize], pageData[:])
+	return nil
+}
+
+func (p *MmapPager) NumPages() int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.numPages
+}
+
+// AllocatePage reserves the next page ID and extends the file with it, as Pager.AllocatePage does.
+func (p *MmapPager) AllocatePage() PageID {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pageID := PageID(p.numPages)
+	p.numPages++
+	if p.data != nil {
+		p.writePage(pageID, newReleasedPage())
+	}
+	return pageID
+}
+
+func (p *MmapPager) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var firstErr error
+	for _, data := range append(p.old, p.data) {
+		if err := syscall.Munmap(data); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	p.data, p.old = nil, nil
+	if err := p.file.Close(); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	return firstErr
+}
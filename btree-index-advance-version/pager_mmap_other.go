@@ -0,0 +1,14 @@
+//go:build !(linux || darwin)
+
+package main
+
+import "errors"
+
+// MmapPager is only available on Linux and macOS (see pager_mmap.go).
+type MmapPager struct {
+	PageStore
+}
+
+func NewMmapPager(path string) (*MmapPager, error) {
+	return nil, errors.New("memory-mapped pager is not supported on this platform")
+}
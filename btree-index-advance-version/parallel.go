@@ -0,0 +1,324 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"io"
+	"math"
+	"slices"
+	"sync"
+)
+
+// =================================================================================================
+// --- parallel.go --- (Parallel Index Build)
+// =================================================================================================
+
+// BuildIndex reads the data file, sorts the records and merges them into the tree leaf by leaf,
+// all on one goroutine. An empty tree doesn't need the insert path at all: once the records are
+// sorted, the leaves can be filled from left to right and the internal levels built on top of
+// them, the way Compact rewrites a tree. With BuildOptions.Workers, BuildIndexWith does that, and
+// spreads the work over several goroutines:
+//
+//	read ──chunks──▶ sort (workers) ──runs──▶ merge in pairs (workers) ──▶ encode leaves (workers) ──▶ write
+//
+// Reading a file is sequential, so one goroutine reads the source and hands the records to the
+// workers in chunks of parallelChunkSize, each of which a worker sorts into a run. The runs are
+// then merged two at a time, each round of merges in parallel, until one is left. Finally every
+// worker encodes its share of the leaf pages and sends them to the calling goroutine, the only
+// one that writes pages, since a PageStore takes one write at a time. The internal levels hold
+// a fraction of a percent of the entries, so the writer builds those itself.
+//
+// Pages are filled to defaultCompactFillFactor, so the tree comes out as if freshly compacted.
+
+// parallelChunkSize is the number of records each sorting worker gets at a time.
+const parallelChunkSize = 1 << 16
+
+var errParallelBuildNotEmpty = errors.New("a parallel build needs an empty tree")
+
+// buildParallel implements BuildIndexWith for opts.Workers > 0.
+func (t *BPlusTree) buildParallel(source DataSource, opts BuildOptions) (int, error) {
+	n, err := t.Len()
+	if err != nil {
+		return 0, err
+	}
+	if n > 0 {
+		return 0, errParallelBuildNotEmpty
+	}
+	runs, err := sortRecords(source, opts.Workers)
+	if err != nil {
+		return 0, err
+	}
+	sorted := mergeRuns(runs, opts.Workers)
+	if violations := t.batchDuplicates(sorted); len(violations) > 0 {
+		if opts.CollectViolations {
+			return 0, violations
+		}
+		return 0, violations[0]
+	}
+	if err := t.bulkLoad(sorted, opts.Workers); err != nil {
+		return 0, err
+	}
+	return len(sorted), nil
+}
+
+// compareKV orders pairs by key.
+func compareKV(a, b KV) int {
+	return cmp.Compare(a.Key, b.Key)
+}
+
+// sortRecords reads every record of source and returns them as sorted runs, in the order the
+// records were read. Pairs with the same key keep their order within a run.
+func sortRecords(source DataSource, workers int) ([][]KV, error) {
+	chunks := make(chan []KV, workers)
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for chunk := range chunks {
+				slices.SortStableFunc(chunk, compareKV)
+			}
+		}()
+	}
+
+	// The workers sort the chunks in place, so runs already holds them in reading order.
+	var runs [][]KV
+	var readErr error
+	chunk := make([]KV, 0, parallelChunkSize)
+	for {
+		key, offset, err := source.NextRecord()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			readErr = err
+			break
+		}
+		chunk = append(chunk, KV{Key: key, Value: offset})
+		if len(chunk) == parallelChunkSize {
+			runs = append(runs, chunk)
+			chunks <- chunk
+			chunk = make([]KV, 0, parallelChunkSize)
+		}
+	}
+	if len(chunk) > 0 && readErr == nil {
+		runs = append(runs, chunk)
+		chunks <- chunk
+	}
+	close(chunks)
+	wg.Wait()
+	return runs, readErr
+}
+
+// mergeRuns merges sorted runs into one, running up to workers merges at a time. Pairs with the
+// same key keep the order of the runs they came from.
+func mergeRuns(runs [][]KV, workers int) []KV {
+	if len(runs) == 0 {
+		return nil
+	}
+	for len(runs) > 1 {
+		merged := make([][]KV, (len(runs)+1)/2)
+		slots := make(chan struct{}, workers)
+		var wg sync.WaitGroup
+		for i := 0; i < len(runs); i += 2 {
+			if i+1 == len(runs) {
+				merged[i/2] = runs[i]
+				continue
+			}
+			wg.Add(1)
+			slots <- struct{}{}
+			go func() {
+				defer wg.Done()
+				merged[i/2] = mergeTwoRuns(runs[i], runs[i+1])
+				<-slots
+			}()
+		}
+		wg.Wait()
+		runs = merged
+	}
+	return runs[0]
+}
+
+// mergeTwoRuns merges two sorted runs, taking a's pair first when both have the same key.
+func mergeTwoRuns(a, b []KV) []KV {
+	merged := make([]KV, 0, len(a)+len(b))
+	for len(a) > 0 && len(b) > 0 {
+		if b[0].Key < a[0].Key {
+			merged, b = append(merged, b[0]), b[1:]
+		} else {
+			merged, a = append(merged, a[0]), a[1:]
+		}
+	}
+	merged = append(merged, a...)
+	return append(merged, b...)
+}
+
+// builtPage is a page encoded by a worker, on its way to the writer.
+type builtPage struct {
+	pageID PageID
+	page   *Page
+}
+
+// bulkLoad builds the tree bottom-up from sorted pairs with unique keys. The tree must be empty:
+// its root leaf becomes the first leaf, and the other pages are allocated after the last page of
+// the store.
+func (t *BPlusTree) bulkLoad(sorted []KV, workers int) error {
+	if len(sorted) == 0 {
+		return nil
+	}
+
+	plan := t.planBulkLoad(len(sorted))
+	levels, pageIDs := plan.levels, plan.pageIDs
+	parentIDs := plan.leafParents()
+	firstEntry := make([]int, len(levels[0])) // index in sorted of each leaf's first pair
+	for i := 1; i < len(firstEntry); i++ {
+		firstEntry[i] = firstEntry[i-1] + levels[0][i-1]
+	}
+
+	// Leaves: each worker encodes a contiguous share of them.
+	pages := make(chan builtPage, 2*workers)
+	var wg sync.WaitGroup
+	share := (len(levels[0]) + workers - 1) / workers
+	for from := 0; from < len(levels[0]); from += share {
+		to := min(from+share, len(levels[0]))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := from; i < to; i++ {
+				entries := sorted[firstEntry[i] : firstEntry[i]+levels[0][i]]
+				pages <- builtPage{pageIDs[0][i], plan.leaf(i, entries, parentIDs[i])}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(pages)
+	}()
+	var writeErr error
+	for p := range pages {
+		// After a failed write, the rest are drained so that the workers can finish.
+		if writeErr == nil {
+			writeErr = t.writePage(p.pageID, p.page)
+		}
+	}
+	if writeErr != nil {
+		return writeErr
+	}
+	if t.bloom != nil {
+		for _, kv := range sorted {
+			t.bloom.Add(kv.Key)
+		}
+	}
+
+	lowKeys := make([]int, len(levels[0]))
+	for i, first := range firstEntry {
+		lowKeys[i] = sorted[first].Key
+	}
+	return t.writeInternalLevels(plan, lowKeys)
+}
+
+// bulkPlan is the shape of a tree built bottom-up: the number of entries under each page of each
+// level, from the leaves up to the root, and the IDs of the pages.
+type bulkPlan struct {
+	levels  [][]int
+	pageIDs [][]PageID
+}
+
+// planBulkLoad plans every level of a tree of n entries up front, as writeCompacted does, so each
+// page knows its own ID and its parent's when it's encoded. The tree's root leaf becomes the first
+// leaf, and the other pages are allocated.
+func (t *BPlusTree) planBulkLoad(n int) bulkPlan {
+	maxKeys, maxInternalKeys := t.degree-1, t.InternalDegree()-1
+	target := int(math.Round(defaultCompactFillFactor * float64(maxKeys)))
+	internalTarget := int(math.Round(defaultCompactFillFactor * float64(maxInternalKeys)))
+	levels := [][]int{distribute(n, t.minKeys(), maxKeys, target)}
+	for len(levels[len(levels)-1]) > 1 {
+		levels = append(levels, distribute(len(levels[len(levels)-1]), t.minInternalKeys()+1, maxInternalKeys+1, internalTarget+1))
+	}
+	pageIDs := make([][]PageID, len(levels))
+	for level, sizes := range levels {
+		pageIDs[level] = make([]PageID, len(sizes))
+		for i := range sizes {
+			if level == 0 && i == 0 {
+				pageIDs[level][i] = t.rootPageID
+			} else {
+				pageIDs[level][i] = t.pager.AllocatePage()
+			}
+		}
+	}
+	return bulkPlan{levels, pageIDs}
+}
+
+// leaf encodes the i-th leaf of the plan, holding entries, whose parent is parentPageID.
+func (p bulkPlan) leaf(i int, entries []KV, parentPageID PageID) *Page {
+	cells := make([][]byte, len(entries))
+	for j, kv := range entries {
+		cells[j] = leafCell(kv.Key, encodeInt64Value(kv.Value))
+	}
+	page := new(Page)
+	page[nodeTypeOffset] = NodeTypeLeaf
+	writeLeafEntries(page, cells)
+	next := PageID(-1)
+	if i+1 < len(p.levels[0]) {
+		next = p.pageIDs[0][i+1]
+	}
+	setNextLeafPageID(page, next)
+	setParentPageID(page, parentPageID)
+	setIsRoot(page, len(p.levels) == 1)
+	return page
+}
+
+// parentOf returns the parent of the index-th page of a level, -1 for the root.
+func (p bulkPlan) parentOf(level, index int) PageID {
+	if level == len(p.levels)-1 {
+		return -1
+	}
+	return p.pageIDs[level+1][groupOf(p.levels[level+1], index)]
+}
+
+// leafParents returns the parent of every leaf. groupOf is linear, so they are worked out in one
+// pass instead.
+func (p bulkPlan) leafParents() []PageID {
+	parentIDs := make([]PageID, len(p.levels[0]))
+	for i := range parentIDs {
+		parentIDs[i] = -1
+	}
+	if len(p.levels) > 1 {
+		leaf := 0
+		for parent, size := range p.levels[1] {
+			for range size {
+				parentIDs[leaf] = p.pageIDs[1][parent]
+				leaf++
+			}
+		}
+	}
+	return parentIDs
+}
+
+// writeInternalLevels writes the internal pages of a plan whose leaves have been written, given the
+// smallest key of each leaf, and makes the top one the root. A separator is the smallest key under
+// the child to its right.
+func (t *BPlusTree) writeInternalLevels(plan bulkPlan, lowKeys []int) error {
+	levels, pageIDs := plan.levels, plan.pageIDs
+	counts := levels[0] // number of entries under each page of the current level
+	for level := 1; level < len(levels); level++ {
+		childLowKeys, childCounts := lowKeys, counts
+		lowKeys, counts = make([]int, 0, len(levels[level])), make([]int, 0, len(levels[level]))
+		child := 0
+		for i, size := range levels[level] {
+			page := new(Page)
+			page[nodeTypeOffset] = NodeTypeInternal
+			writeInternalEntries(page, childLowKeys[child+1:child+size], pageIDs[level-1][child:child+size], childCounts[child:child+size])
+			setParentPageID(page, plan.parentOf(level, i))
+			setIsRoot(page, level == len(levels)-1)
+			lowKeys = append(lowKeys, childLowKeys[child])
+			counts = append(counts, subtreeCount(page))
+			child += size
+			if err := t.writePage(pageIDs[level][i], page); err != nil {
+				return err
+			}
+		}
+	}
+	t.rootPageID = pageIDs[len(levels)-1][0]
+	return nil
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// =================================================================================================
+// --- pitr.go --- (Point-in-Time Recovery)
+// =================================================================================================
+
+// An archive directory holds base backups of a DB and copies of its log, from which the DB can be
+// restored as it was at any commit since the oldest base backup:
+//
+//	base-<lsn>.snap          a backup of the index and heap files, taken at LSN lsn (see
+//	                         DB.Backup), written by BaseBackup
+//	wal-<first>-<last>.seg   a segment: the log records from LSN first to last, in the WAL file's
+//	                         format, written by ArchiveWAL
+//
+// The LSNs in the names are zero-padded, so the names sort in LSN order. ArchiveWAL copies the
+// records logged since the last segment into a new one. The DB's own log is never truncated, so
+// the segments are copies, meant to be kept somewhere safer than the DB's files.
+//
+// RestoreToLSN copies the newest base backup taken at or before the target into a new DB and
+// replays the committed transactions of the segments on top of it, up to the target, as a replica
+// applies its leader's log (see replication.go). Commit records carry their commit time, so
+// RestoreToTime can pick the last commit before a point in time as the target.
+
+var (
+	errNoBaseBackup = errors.New("archive has no base backup old enough")
+	errArchiveGap   = errors.New("archive is missing log records")
+)
+
+const (
+	baseBackupPattern = "base-%020d.snap"
+	segmentPattern    = "wal-%020d-%020d.seg"
+)
+
+// BaseBackup writes a backup of the DB to the archive directory dir and returns its LSN.
+func (db *DB) BaseBackup(dir string) (uint64, error) {
+	file, err := os.CreateTemp(dir, "base-*.tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(file.Name())
+	w := bufio.NewWriter(file)
+	lsn, err := db.Backup(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if err := errors.Join(err, file.Close()); err != nil {
+		return 0, err
+	}
+	return lsn, os.Rename(file.Name(), filepath.Join(dir, fmt.Sprintf(baseBackupPattern, lsn)))
+}
+
+// ArchiveWAL copies the records logged since the last segment in the archive directory dir into a
+// new segment, and returns how many it copied.
+func (db *DB) ArchiveWAL(dir string) (int, error) {
+	_, segments, err := readArchive(dir)
+	if err != nil {
+		return 0, err
+	}
+	var archived uint64
+	if len(segments) > 0 {
+		archived = segments[len(segments)-1].last
+	}
+
+	// Only records that have been synced are read in full; readWALRecords stops at the first one
+	// that is still being written.
+	records, _, err := readWALRecords(bufio.NewReader(io.NewSectionReader(db.wal.file, 0, math.MaxInt64)))
+	if err != nil {
+		return 0, err
+	}
+	i := slices.IndexFunc(records, func(r walRecord) bool { return r.lsn > archived })
+	if i == -1 {
+		return 0, nil
+	}
+	records = records[i:]
+
+	file, err := os.CreateTemp(dir, "wal-*.tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(file.Name())
+	w := bufio.NewWriter(file)
+	for i := range records {
+		w.Write(encodeWALRecord(&records[i]))
+	}
+	err = w.Flush()
+	if err == nil {
+		err = file.Sync()
+	}
+	if err := errors.Join(err, file.Close()); err != nil {
+		return 0, err
+	}
+	name := fmt.Sprintf(segmentPattern, records[0].lsn, records[len(records)-1].lsn)
+	return len(records), os.Rename(file.Name(), filepath.Join(dir, name))
+}
+
+// archiveSegment is a segment of the log in an archive directory.
+type archiveSegment struct {
+	path        string
+	first, last uint64
+}
+
+// readArchive returns the LSNs of the base backups and the segments in the archive directory dir,
+// in LSN order.
+func readArchive(dir string) ([]uint64, []archiveSegment, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	var bases []uint64
+	var segments []archiveSegment
+	for _, entry := range entries {
+		var s archiveSegment
+		var lsn uint64
+		if _, err := fmt.Sscanf(entry.Name(), baseBackupPattern, &lsn); err == nil {
+			bases = append(bases, lsn)
+		} else if _, err := fmt.Sscanf(entry.Name(), segmentPattern, &s.first, &s.last); err == nil {
+			s.path = filepath.Join(dir, entry.Name())
+			segments = append(segments, s)
+		}
+	}
+	// os.ReadDir sorts by name, which is LSN order.
+	return bases, segments, nil
+}
+
+// readSegment returns the records of an archived segment.
+func readSegment(s archiveSegment) ([]walRecord, error) {
+	file, err := os.Open(s.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	records, _, err := readWALRecords(bufio.NewReader(file))
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 || records[len(records)-1].lsn != s.last {
+		return nil, fmt.Errorf("%w: segment %s is truncated", errArchiveGap, s.path)
+	}
+	return records, nil
+}
+
+// RestoreToLSN creates a DB in path.idx, path.dat and path.wal, replacing any files there, from
+// the archive directory dir, as it was after the last transaction that committed at or before
+// LSN lsn. It returns the LSN of that commit, which is the base backup's LSN if no transaction
+// was replayed.
+func RestoreToLSN(dir, path string, lsn uint64) (uint64, error) {
+	bases, segments, err := readArchive(dir)
+	if err != nil {
+		return 0, err
+	}
+	i := slices.IndexFunc(bases, func(base uint64) bool { return base > lsn })
+	if i == -1 {
+		i = len(bases)
+	}
+	if i == 0 {
+		return 0, fmt.Errorf("%w for LSN %d", errNoBaseBackup, lsn)
+	}
+	base := bases[i-1]
+
+	file, err := os.Open(filepath.Join(dir, fmt.Sprintf(baseBackupPattern, base)))
+	if err != nil {
+		return 0, err
+	}
+	_, err = RestoreBackup(bufio.NewReader(file), path)
+	file.Close()
+	if err != nil {
+		return 0, err
+	}
+	db, err := OpenDB(path+".idx", path+".dat", path+".wal", 0)
+	if err != nil {
+		return 0, err
+	}
+
+	restored := base
+	var assembler txAssembler
+	next := base + 1 // the next LSN the replay needs
+	err = func() error {
+		for _, s := range segments {
+			if next > lsn {
+				break
+			}
+			if s.last < next {
+				continue
+			}
+			if s.first > next {
+				return fmt.Errorf("%w: LSNs %d to %d", errArchiveGap, next, s.first-1)
+			}
+			records, err := readSegment(s)
+			if err != nil {
+				return err
+			}
+			for _, record := range records {
+				if record.lsn <= base || record.lsn > lsn {
+					continue
+				}
+				if txRecords := assembler.add(record); txRecords != nil {
+					if err := db.applyReplicated(txRecords, record.lsn); err != nil {
+						return err
+					}
+					restored = record.lsn
+				}
+			}
+			next = s.last + 1
+		}
+		return nil
+	}()
+	return restored, errors.Join(err, db.Close())
+}
+
+// RestoreToTime is RestoreToLSN for the last transaction that committed at or before t.
+func RestoreToTime(dir, path string, t time.Time) (uint64, error) {
+	_, segments, err := readArchive(dir)
+	if err != nil {
+		return 0, err
+	}
+	var lsn uint64
+	for _, s := range segments {
+		records, err := readSegment(s)
+		if err != nil {
+			return 0, err
+		}
+		for _, record := range records {
+			if record.kind == walCommit && len(record.data) == 8 {
+				if commitTime := int64(binary.LittleEndian.Uint64(record.data)); commitTime <= t.UnixNano() {
+					lsn = record.lsn
+				}
+			}
+		}
+	}
+	return RestoreToLSN(dir, path, lsn)
+}
+
+// restoreCommand implements `go run . restore -archive dir -db path (-lsn N | -time T)`.
+func restoreCommand(args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	dir := flags.String("archive", "archive", "archive directory")
+	path := flags.String("db", "restored", "path of the restored DB's files, without extension")
+	lsn := flags.String("lsn", "", "restore up to this LSN")
+	at := flags.String("time", "", "restore up to this time, in RFC 3339 format")
+	flags.Parse(args)
+
+	var restored uint64
+	var err error
+	switch {
+	case *lsn != "" && *at == "":
+		var target uint64
+		if target, err = strconv.ParseUint(*lsn, 10, 64); err == nil {
+			restored, err = RestoreToLSN(*dir, *path, target)
+		}
+	case *at != "" && *lsn == "":
+		var target time.Time
+		if target, err = time.Parse(time.RFC3339Nano, *at); err == nil {
+			restored, err = RestoreToTime(*dir, *path, target)
+		}
+	default:
+		return errors.New("usage: restore -archive dir -db path (-lsn N | -time T)")
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("restored %s.idx up to LSN %d\n", *path, restored)
+	return nil
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// =================================================================================================
+// --- query.go --- (Query Layer and Cost-Based Access Path Selection)
+// =================================================================================================
+
+// Table is a data file (in the users.csv format: a header line, then one row per line starting
+// with its integer id) together with the B+ Tree index on the id column. Select answers
+// `WHERE id BETWEEN start AND end` queries, and the planner decides for each query whether to
+// read the data file front to back or to go through the index. SelectIDs answers
+// `SELECT id ... WHERE id BETWEEN start AND end`, which the leaves of the index answer on their
+// own, without reading a single row.
+//
+// The decision is based on estimated page reads, weighted like PostgreSQL's default cost model:
+//
+//	full scan:       every page of the data file, read sequentially
+//	index scan:      one random read per internal level, the matching share of the leaves read
+//	                 sequentially, and one random read of the data file per matching row
+//	index only scan: the index scan without the reads of the data file
+//
+// The number of matching rows comes from an equi-depth histogram over the index (histogram.go)
+// and the shape of the index from its statistics (stats.go). Both are collected by Analyze.
+type Table struct {
+	name      string
+	dataPath  string
+	index     *BPlusTree
+	histogram *Histogram
+	stats     TreeStats
+	dataPages int
+}
+
+const (
+	seqPageCost    = 1.0
+	randomPageCost = 4.0
+
+	// tableHistogramBuckets is the histogram resolution used by Analyze.
+	tableHistogramBuckets = 64
+)
+
+// AccessPath is the way a query reads its rows.
+type AccessPath int
+
+const (
+	FullScan AccessPath = iota
+	IndexScan
+	IndexOnlyScan
+)
+
+func (p AccessPath) String() string {
+	switch p {
+	case IndexScan:
+		return "Index Scan"
+	case IndexOnlyScan:
+		return "Index Only Scan"
+	}
+	return "Full Scan"
+}
+
+// QueryPlan is the planner's decision for one query, with the estimates it was based on.
+type QueryPlan struct {
+	Path       AccessPath
+	Start, End int
+	// KeysOnly is set for a query that only needs the ids, which an index only scan can answer.
+	KeysOnly          bool
+	EstimatedRows     float64
+	FullScanCost      float64
+	IndexScanCost     float64
+	IndexOnlyScanCost float64
+	table             *Table
+}
+
+// NewTable creates a table over a data file and its index, and analyzes them.
+func NewTable(name, dataPath string, index *BPlusTree) (*Table, error) {
+	t := &Table{name: name, dataPath: dataPath, index: index}
+	if err := t.Analyze(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Analyze refreshes the statistics the planner works with. Call it again after the data has
+// changed significantly.
+func (t *Table) Analyze() error {
+	stat, err := os.Stat(t.dataPath)
+	if err != nil {
+		return err
+	}
+	stats, err := t.index.Stats()
+	if err != nil {
+		return err
+	}
+	histogram, err := t.index.BuildHistogram(tableHistogramBuckets)
+	if err != nil {
+		return err
+	}
+	t.dataPages = int((stat.Size() + PageSize - 1) / PageSize)
+	t.stats, t.histogram = stats, histogram
+	return nil
+}
+
+// Plan chooses the access path for `SELECT * ... WHERE id BETWEEN start AND end`.
+func (t *Table) Plan(start, end int) *QueryPlan {
+	return t.plan(start, end, false)
+}
+
+// PlanIDs chooses the access path for `SELECT id ... WHERE id BETWEEN start AND end`.
+func (t *Table) PlanIDs(start, end int) *QueryPlan {
+	return t.plan(start, end, true)
+}
+
+func (t *Table) plan(start, end int, keysOnly bool) *QueryPlan {
+	plan := &QueryPlan{Start: start, End: end, KeysOnly: keysOnly, table: t}
+	plan.EstimatedRows = t.histogram.EstimateRange(start, end)
+	plan.FullScanCost = float64(t.dataPages) * seqPageCost
+
+	leaves := t.stats.PagesPerLevel[len(t.stats.PagesPerLevel)-1]
+	leavesRead := math.Max(1, math.Ceil(t.histogram.Selectivity(start, end)*float64(leaves)))
+	plan.IndexOnlyScanCost = float64(t.stats.Height-1)*randomPageCost + leavesRead*seqPageCost
+	plan.IndexScanCost = plan.IndexOnlyScanCost + plan.EstimatedRows*randomPageCost
+
+	if indexPath, indexCost := plan.indexPath(); indexCost < plan.FullScanCost {
+		plan.Path = indexPath
+	}
+	return plan
+}
+
+// indexPath returns the way the plan's query would go through the index, and its cost: an index
+// only scan if the query needs only the ids, or else an index scan.
+func (p *QueryPlan) indexPath() (AccessPath, float64) {
+	if p.KeysOnly {
+		return IndexOnlyScan, p.IndexOnlyScanCost
+	}
+	return IndexScan, p.IndexScanCost
+}
+
+// Explain describes the plan in the style of a database's EXPLAIN output.
+func (p *QueryPlan) Explain() string {
+	indexPath, indexCost := p.indexPath()
+	scan, cond := fmt.Sprintf("Full Scan on %s", p.table.name), "Filter"
+	cost, rejected, rejectedCost := p.FullScanCost, indexPath, indexCost
+	if p.Path != FullScan {
+		scan, cond = fmt.Sprintf("%v using %s_pk on %s", p.Path, p.table.name, p.table.name), "Index Cond"
+		cost, rejected, rejectedCost = indexCost, FullScan, p.FullScanCost
+	}
+	return fmt.Sprintf("%s  (cost=%.1f rows=%.0f)\n  %s: id >= %d AND id <= %d\n  Rejected: %v (cost=%.1f)",
+		scan, cost, p.EstimatedRows, cond, p.Start, p.End, rejected, rejectedCost)
+}
+
+// Select returns the rows with start <= id <= end, in id order, and the plan used to find them.
+func (t *Table) Select(start, end int) ([]string, *QueryPlan, error) {
+	plan := t.Plan(start, end)
+	var rows []string
+	var err error
+	if plan.Path == IndexScan {
+		rows, err = t.indexScan(start, end)
+	} else {
+		rows, err = t.fullScan(start, end)
+	}
+	return rows, plan, err
+}
+
+// SelectIDs returns the ids with start <= id <= end, in order, and the plan used to find them. An
+// index only scan reads them from the leaves of the index and never opens the data file.
+func (t *Table) SelectIDs(start, end int) ([]int, *QueryPlan, error) {
+	plan := t.PlanIDs(start, end)
+	if plan.Path == IndexOnlyScan {
+		ids, err := t.indexOnlyScan(start, end)
+		return ids, plan, err
+	}
+	rows, err := t.fullScan(start, end)
+	if err != nil {
+		return nil, plan, err
+	}
+	ids := make([]int, len(rows))
+	for i, row := range rows {
+		idField, _, _ := strings.Cut(row, ",")
+		ids[i], _ = strconv.Atoi(idField)
+	}
+	return ids, plan, nil
+}
+
+// indexOnlyScan collects the matching keys from the leaves of the index.
+func (t *Table) indexOnlyScan(start, end int) ([]int, error) {
+	var ids []int
+	c, err := t.index.Seek(start)
+	if err != nil {
+		return nil, err
+	}
+	for c.Next() && c.Key() <= end {
+		ids = append(ids, c.Key())
+	}
+	return ids, c.Err()
+}
+
+// indexScan finds the matching rows through the index and reads each one from the data file.
+func (t *Table) indexScan(start, end int) ([]string, error) {
+	file, err := os.Open(t.dataPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	offsets, err := t.index.SearchRange(start, end)
+	if err != nil {
+		return nil, err
+	}
+	rows := make([]string, 0, len(offsets))
+	for _, offset := range offsets {
+		line, _, err := bufio.NewReader(io.NewSectionReader(file, offset, math.MaxInt64-offset)).ReadLine()
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, string(line))
+	}
+	return rows, nil
+}
+
+// fullScan reads the whole data file and keeps the matching rows, sorted by id like the rows
+// of an index scan.
+func (t *Table) fullScan(start, end int) ([]string, error) {
+	file, err := os.Open(t.dataPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	type match struct {
+		id  int
+		row string
+	}
+	var matches []match
+	scanner := bufio.NewScanner(file)
+	scanner.Scan() // header line
+	for scanner.Scan() {
+		line := scanner.Text()
+		idField, _, _ := strings.Cut(line, ",")
+		id, err := strconv.Atoi(idField)
+		if err != nil {
+			continue // skip rows with invalid ids, which ImportCSV rejects
+		}
+		if id >= start && id <= end {
+			matches = append(matches, match{id, line})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	slices.SortFunc(matches, func(a, b match) int { return cmp.Compare(a.id, b.id) })
+	rows := make([]string, len(matches))
+	for i, m := range matches {
+		rows[i] = m.row
+	}
+	return rows, nil
+}
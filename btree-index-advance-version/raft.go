@@ -0,0 +1,854 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// =================================================================================================
+// --- raft.go --- (Raft Consensus for the Key-Value Store)
+// =================================================================================================
+
+// Replication (see replication.go) has a fixed leader: if it fails, writes stop until a replica
+// is promoted by hand, and a replica may be missing writes the leader already acknowledged.
+// RaftCluster replicates a KVStore over several nodes with the Raft consensus algorithm instead.
+// The nodes elect a leader among themselves, and the leader acknowledges a write only once a
+// majority of the nodes have it in their logs, so any majority that elects the next leader still
+// holds every acknowledged write:
+//
+//	cluster, err := OpenRaftCluster("data/raft", 3) // data/raft/node0.idx, .dat, .wal, node1...
+//	err = cluster.Put([]byte("user:42"), []byte("zoe")) // through the leader, once there is one
+//	value, found, err := cluster.Node(2).Get([]byte("user:42"))
+//
+// Each node is a KVStore of its own, and its WAL doubles as its Raft log. The leader runs a Put or
+// Delete in a transaction that it rolls back instead of committing, and proposes the records the
+// commit would have logged, page images and rows, as a log entry. Once a majority has logged the
+// entry, every node applies it the way a replica applies a transaction of its leader's log, with
+// the entry's index logged as the leader LSN. The nodes' files stay identical, page for page.
+//
+// The Raft state is kept in the WAL too, in records that transaction recovery skips:
+//
+//	walRaftVote   the current term and the node voted for in it, logged before the vote is cast
+//	walRaftEntry  an entry and its term, at an index; it replaces the entries from that index on
+//
+// Reopening a cluster reads them back, and each node resumes after the last entry it applied. The
+// nodes run in one process and call each other directly. Disconnect cuts a node off from the
+// others, to watch them elect a new leader without it, and Reconnect lets it catch up:
+//
+//	$ go run . raft
+//
+// Writes go through the leader one at a time. Get reads a node's own copy, which lags behind the
+// leader's on a follower. Unlike full Raft, there is no log compaction and no membership change:
+// the log, like the WAL, only grows.
+
+const (
+	// raftTickInterval is how often a node wakes up. A leader then sends each follower the entries
+	// it lacks, or an empty heartbeat.
+	raftTickInterval = 20 * time.Millisecond
+	// raftElectionTimeout is the least time a follower waits to hear from a leader before it
+	// stands for election. Each wait is drawn between it and twice it, so that two candidates
+	// rarely split the vote.
+	raftElectionTimeout = 150 * time.Millisecond
+	// raftProposeTimeout is how long a write waits for a leader and for its entry to be applied.
+	raftProposeTimeout = 3 * time.Second
+	// raftMaxAppendEntries caps the number of entries sent to a follower at once.
+	raftMaxAppendEntries = 64
+)
+
+var (
+	ErrNotLeader           = errors.New("node is not the Raft leader")
+	errRaftTimeout         = errors.New("timed out waiting for the Raft log")
+	errRaftEntryTooLarge   = errors.New("write is too large for a Raft log entry")
+	errCorruptRaftRecord   = errors.New("corrupt Raft record in the log")
+	errRaftClusterTooSmall = errors.New("a Raft cluster needs at least one node")
+)
+
+// raftRole is what a node does in its current term.
+type raftRole int
+
+const (
+	raftFollower raftRole = iota
+	raftCandidate
+	raftLeader
+)
+
+func (r raftRole) String() string {
+	return [...]string{"follower", "candidate", "leader"}[r]
+}
+
+// raftEntry is an entry of a Raft log.
+type raftEntry struct {
+	term uint64
+	data []byte // a transaction's changes, framed as in the WAL file; empty for a leader's no-op
+}
+
+// RaftCluster is a group of Raft nodes running in one process.
+type RaftCluster struct {
+	nodes []*RaftNode
+
+	mu           sync.Mutex
+	disconnected []bool
+}
+
+// RaftNode is a member of a RaftCluster, with a KVStore of its own.
+type RaftNode struct {
+	id      int
+	cluster *RaftCluster
+	store   *KVStore
+
+	// proposeMu lets one write at a time through the leader.
+	proposeMu sync.Mutex
+
+	mu sync.Mutex
+	// changed is broadcast whenever an entry is applied or the node's role changes, and on every
+	// tick, for the writes waiting on the node.
+	changed     *sync.Cond
+	role        raftRole
+	term        uint64
+	votedFor    int         // -1 if the node hasn't voted in term
+	leader      int         // -1 if the node knows no leader in term
+	log         []raftEntry // log[i] is the entry at index i; log[0] is a placeholder of term 0
+	commitIndex int
+	applied     int       // the index of the last entry applied to the store
+	deadline    time.Time // when a follower or candidate stands for election
+	nextIndex   []int     // a leader's next entry to send to each node
+	matchIndex  []int     // the last entry a leader knows each node has logged
+	err         error     // the error that stopped the node from applying entries
+
+	kick          chan struct{} // wakes the node before its next tick
+	stop, stopped chan struct{}
+}
+
+// RaftStatus is a node's view of the cluster.
+type RaftStatus struct {
+	ID        int
+	Role      string // follower, candidate or leader
+	Term      uint64
+	Leader    int // the leader of Term, or -1 if the node knows none
+	LastIndex int // the index of the last entry in the node's log
+	Commit    int // the index of the last entry the node knows is committed
+	Applied   int // the index of the last entry applied to the node's store
+}
+
+// OpenRaftCluster opens a cluster of size nodes, keeping node i in dir/node<i>.idx, .dat and .wal,
+// and starts them. Files that don't exist are created.
+func OpenRaftCluster(dir string, size int) (*RaftCluster, error) {
+	if size < 1 {
+		return nil, errRaftClusterTooSmall
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+	c := &RaftCluster{disconnected: make([]bool, size)}
+	for id := range size {
+		node, err := openRaftNode(c, id, filepath.Join(dir, fmt.Sprintf("node%d", id)))
+		if err != nil {
+			for _, n := range c.nodes {
+				n.store.db.Close()
+			}
+			return nil, err
+		}
+		c.nodes = append(c.nodes, node)
+	}
+	for _, n := range c.nodes {
+		go n.run()
+	}
+	return c, nil
+}
+
+// openRaftNode opens a node's store and reads its term, vote and log back from the WAL.
+func openRaftNode(c *RaftCluster, id int, path string) (*RaftNode, error) {
+	db, records, err := openDB(path+".idx", path+".dat", path+".wal", 0, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	n := &RaftNode{
+		id:       id,
+		cluster:  c,
+		store:    &KVStore{db: db},
+		votedFor: -1,
+		leader:   -1,
+		log:      make([]raftEntry, 1),
+		kick:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	n.changed = sync.NewCond(&n.mu)
+	for _, record := range records {
+		switch record.kind {
+		case walRaftVote:
+			if len(record.data) != 8 {
+				db.Close()
+				return nil, errCorruptRaftRecord
+			}
+			n.term, n.votedFor = uint64(record.target), int(int64(binary.LittleEndian.Uint64(record.data)))
+		case walRaftEntry:
+			if len(record.data) < 8 || record.target < 1 || record.target > int64(len(n.log)) {
+				db.Close()
+				return nil, errCorruptRaftRecord
+			}
+			n.log = append(n.log[:record.target], raftEntry{binary.LittleEndian.Uint64(record.data), record.data[8:]})
+		}
+	}
+	// Entries are only applied once committed. The last one applied is logged with its
+	// transaction; the no-ops after it, if any, have nothing to apply again.
+	n.applied = int(db.replicatedLSN.Load())
+	n.commitIndex = n.applied
+	n.resetDeadline()
+	return n, nil
+}
+
+// Node returns the node with the given id, from 0.
+func (c *RaftCluster) Node(id int) *RaftNode {
+	return c.nodes[id]
+}
+
+// Leader returns the leader of the connected nodes, or nil while they have none.
+func (c *RaftCluster) Leader() *RaftNode {
+	var leader *RaftNode
+	var term uint64
+	for _, n := range c.nodes {
+		status := n.Status()
+		// A node cut off while it led still thinks it does, in an older term.
+		if c.connected(n.id) && status.Role == raftLeader.String() && status.Term >= term {
+			leader, term = n, status.Term
+		}
+	}
+	return leader
+}
+
+// Disconnect cuts the node off from the others: no message reaches it or leaves it.
+func (c *RaftCluster) Disconnect(id int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.disconnected[id] = true
+}
+
+// Reconnect undoes Disconnect.
+func (c *RaftCluster) Reconnect(id int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.disconnected[id] = false
+}
+
+func (c *RaftCluster) connected(id int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return !c.disconnected[id]
+}
+
+// Put stores value under key through the leader, waiting for one to be elected if there is none.
+func (c *RaftCluster) Put(key, value []byte) error {
+	return c.propose(func(leader *RaftNode) error { return leader.Put(key, value) })
+}
+
+// Delete removes key through the leader, waiting for one to be elected if there is none, and
+// reports whether it was there.
+func (c *RaftCluster) Delete(key []byte) (bool, error) {
+	var found bool
+	err := c.propose(func(leader *RaftNode) (err error) {
+		found, err = leader.Delete(key)
+		return err
+	})
+	return found, err
+}
+
+// propose calls fn with the leader until it is no longer told that the node isn't the leader, or
+// raftProposeTimeout has passed.
+func (c *RaftCluster) propose(fn func(leader *RaftNode) error) error {
+	deadline := time.Now().Add(raftProposeTimeout)
+	for {
+		err := ErrNotLeader
+		if leader := c.Leader(); leader != nil {
+			err = fn(leader)
+		}
+		if !errors.Is(err, ErrNotLeader) || time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(raftTickInterval)
+	}
+}
+
+// Close stops the nodes and closes their files.
+func (c *RaftCluster) Close() error {
+	for _, n := range c.nodes {
+		close(n.stop)
+	}
+	var errs []error
+	for _, n := range c.nodes {
+		<-n.stopped
+	}
+	for _, n := range c.nodes {
+		errs = append(errs, n.store.db.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// Status returns the node's view of the cluster.
+func (n *RaftNode) Status() RaftStatus {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return RaftStatus{
+		ID:        n.id,
+		Role:      n.role.String(),
+		Term:      n.term,
+		Leader:    n.leader,
+		LastIndex: len(n.log) - 1,
+		Commit:    n.commitIndex,
+		Applied:   n.applied,
+	}
+}
+
+// Put stores value under key, once a majority of the nodes have logged the write. Only the leader
+// takes writes; the other nodes return ErrNotLeader.
+func (n *RaftNode) Put(key, value []byte) error {
+	if len(key) == 0 {
+		return errEmptyKey
+	}
+	return n.propose(func(tx *Tx) error { return putEntry(tx, key, value, 0) })
+}
+
+// Delete removes key, once a majority of the nodes have logged the write, and reports whether it
+// was there. Only the leader takes writes; the other nodes return ErrNotLeader.
+func (n *RaftNode) Delete(key []byte) (bool, error) {
+	var found bool
+	err := n.propose(func(tx *Tx) (err error) {
+		found, err = deleteEntry(tx, key)
+		return err
+	})
+	return found, err
+}
+
+// Get returns the value stored under key in the node's own store.
+func (n *RaftNode) Get(key []byte) ([]byte, bool, error) {
+	return n.store.Get(key)
+}
+
+// Scan calls fn for every key in the node's own store that starts with prefix (see Bucket.Scan).
+func (n *RaftNode) Scan(prefix []byte, fn func(key, value []byte) error) error {
+	return n.store.Scan(prefix, fn)
+}
+
+// propose runs fn against the leader's store without committing, appends the changes it made to
+// the log as an entry, and waits for the entry to be applied.
+func (n *RaftNode) propose(fn func(tx *Tx) error) error {
+	n.proposeMu.Lock()
+	defer n.proposeMu.Unlock()
+	deadline := time.Now().Add(raftProposeTimeout)
+
+	// The leader must have applied its whole log, down to the no-op that started its term, for
+	// fn to see every committed write.
+	n.mu.Lock()
+	term := n.term
+	err := n.await(deadline, func() (bool, error) {
+		if n.role != raftLeader || n.term != term {
+			return false, ErrNotLeader
+		}
+		return n.applied == len(n.log)-1, nil
+	})
+	n.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	records, err := n.store.db.prepare(fn)
+	if err != nil || len(records) == 0 {
+		return err
+	}
+	var data []byte
+	for i := range records {
+		data = append(data, encodeWALRecord(&records[i])...)
+	}
+	if 8+len(data) > walMaxDataSize {
+		return errRaftEntryTooLarge
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.role != raftLeader || n.term != term {
+		return ErrNotLeader
+	}
+	index := len(n.log)
+	if err := n.appendLog(index, []raftEntry{{term, data}}); err != nil {
+		return err
+	}
+	n.wake()
+	return n.await(deadline, func() (bool, error) {
+		// A new leader may have replaced the entry before a majority logged it.
+		if index >= len(n.log) || n.log[index].term != term {
+			return false, ErrNotLeader
+		}
+		return n.applied >= index, nil
+	})
+}
+
+// await waits, with n.mu held, until done reports true or an error, the node fails to apply an
+// entry, or deadline passes.
+func (n *RaftNode) await(deadline time.Time, done func() (bool, error)) error {
+	for {
+		if n.err != nil {
+			return n.err
+		}
+		if ok, err := done(); ok || err != nil {
+			return err
+		}
+		if time.Now().After(deadline) {
+			return errRaftTimeout
+		}
+		n.changed.Wait()
+	}
+}
+
+// run is the node's main loop: on every tick a leader replicates its log, and a follower whose
+// leader has gone quiet stands for election. Then the newly committed entries are applied.
+func (n *RaftNode) run() {
+	defer close(n.stopped)
+	ticker := time.NewTicker(raftTickInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-ticker.C:
+		case <-n.kick:
+		}
+		n.mu.Lock()
+		role, deadline := n.role, n.deadline
+		n.mu.Unlock()
+		switch {
+		case role == raftLeader:
+			n.replicate()
+		case time.Now().After(deadline):
+			n.campaign()
+		}
+		n.applyCommitted()
+		n.mu.Lock()
+		n.changed.Broadcast()
+		n.mu.Unlock()
+	}
+}
+
+// wake makes the node run its next tick now.
+func (n *RaftNode) wake() {
+	select {
+	case n.kick <- struct{}{}:
+	default:
+	}
+}
+
+// peers returns the other nodes the node can reach.
+func (n *RaftNode) peers() []*RaftNode {
+	if !n.cluster.connected(n.id) {
+		return nil
+	}
+	var peers []*RaftNode
+	for _, peer := range n.cluster.nodes {
+		if peer != n && n.cluster.connected(peer.id) {
+			peers = append(peers, peer)
+		}
+	}
+	return peers
+}
+
+func (n *RaftNode) resetDeadline() {
+	n.deadline = time.Now().Add(raftElectionTimeout + time.Duration(rand.Int63n(int64(raftElectionTimeout))))
+}
+
+// setTerm logs the node's term and vote, then adopts them.
+func (n *RaftNode) setTerm(term uint64, votedFor int) error {
+	data := binary.LittleEndian.AppendUint64(nil, uint64(int64(votedFor)))
+	if _, err := n.store.db.wal.Append(&walRecord{kind: walRaftVote, target: int64(term), data: data}); err != nil {
+		return err
+	}
+	if err := n.store.db.wal.Sync(); err != nil {
+		return err
+	}
+	n.term, n.votedFor = term, votedFor
+	return nil
+}
+
+// stepDown makes the node a follower in term, which is at least its current term.
+func (n *RaftNode) stepDown(term uint64) error {
+	if term > n.term {
+		if err := n.setTerm(term, -1); err != nil {
+			return err
+		}
+		n.leader = -1
+	}
+	if n.role != raftFollower {
+		n.role = raftFollower
+		n.changed.Broadcast()
+	}
+	return nil
+}
+
+// appendLog logs entries from index on, replacing the entries the log has from there, then adds
+// them to the log.
+func (n *RaftNode) appendLog(index int, entries []raftEntry) error {
+	wal := n.store.db.wal
+	for i, e := range entries {
+		data := binary.LittleEndian.AppendUint64(nil, e.term)
+		if _, err := wal.Append(&walRecord{kind: walRaftEntry, target: int64(index + i), data: append(data, e.data...)}); err != nil {
+			return err
+		}
+	}
+	if err := wal.Sync(); err != nil {
+		return err
+	}
+	n.log = append(n.log[:index], entries...)
+	return nil
+}
+
+// campaign starts an election: the node moves to the next term, votes for itself and asks the
+// others for their votes. With a majority it becomes the leader.
+func (n *RaftNode) campaign() {
+	n.mu.Lock()
+	n.resetDeadline()
+	if err := n.setTerm(n.term+1, n.id); err != nil {
+		n.mu.Unlock()
+		return
+	}
+	n.role, n.leader = raftCandidate, -1
+	last := len(n.log) - 1
+	req := raftVoteRequest{term: n.term, candidate: n.id, lastIndex: last, lastTerm: n.log[last].term}
+	n.mu.Unlock()
+
+	votes := 1
+	for _, peer := range n.peers() {
+		reply := peer.requestVote(req)
+		if reply.granted {
+			votes++
+		}
+		if reply.term > req.term {
+			n.mu.Lock()
+			n.stepDown(reply.term)
+			n.mu.Unlock()
+			return
+		}
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.role != raftCandidate || n.term != req.term || 2*votes <= len(n.cluster.nodes) {
+		return
+	}
+	// A leader only counts replicas of entries from its own term, so it appends a no-op at once
+	// to commit the entries of earlier terms along with it.
+	if err := n.appendLog(len(n.log), []raftEntry{{term: n.term}}); err != nil {
+		return
+	}
+	n.role, n.leader = raftLeader, n.id
+	n.nextIndex = make([]int, len(n.cluster.nodes))
+	n.matchIndex = make([]int, len(n.cluster.nodes))
+	for id := range n.nextIndex {
+		n.nextIndex[id] = len(n.log) - 1
+	}
+	n.changed.Broadcast()
+	n.wake()
+}
+
+// raftVoteRequest asks a node to vote for a candidate.
+type raftVoteRequest struct {
+	term      uint64
+	candidate int
+	lastIndex int    // the index of the candidate's last entry
+	lastTerm  uint64 // its term
+}
+
+type raftVoteReply struct {
+	term    uint64
+	granted bool
+}
+
+// requestVote grants the vote if the node hasn't voted for another candidate in the term and the
+// candidate's log is at least as up to date as its own, so the node won't help elect a leader
+// that lacks entries it has.
+func (n *RaftNode) requestVote(req raftVoteRequest) raftVoteReply {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if req.term > n.term {
+		if err := n.stepDown(req.term); err != nil {
+			return raftVoteReply{term: n.term}
+		}
+	}
+	if req.term < n.term || n.votedFor != -1 && n.votedFor != req.candidate {
+		return raftVoteReply{term: n.term}
+	}
+	last := len(n.log) - 1
+	if req.lastTerm < n.log[last].term || req.lastTerm == n.log[last].term && req.lastIndex < last {
+		return raftVoteReply{term: n.term}
+	}
+	if n.votedFor != req.candidate {
+		if err := n.setTerm(n.term, req.candidate); err != nil {
+			return raftVoteReply{term: n.term}
+		}
+	}
+	n.resetDeadline()
+	return raftVoteReply{term: n.term, granted: true}
+}
+
+// raftAppendRequest carries a leader's entries, or none as a heartbeat.
+type raftAppendRequest struct {
+	term        uint64
+	leader      int
+	prevIndex   int    // the index of the entry before entries
+	prevTerm    uint64 // its term
+	entries     []raftEntry
+	commitIndex int // the leader's
+}
+
+type raftAppendReply struct {
+	term      uint64
+	success   bool
+	lastIndex int // on failure, the index below which the leader should look for a match
+}
+
+// replicate sends every reachable follower the entries it lacks, then commits the entries a
+// majority has logged.
+func (n *RaftNode) replicate() {
+	for _, peer := range n.peers() {
+		n.mu.Lock()
+		if n.role != raftLeader {
+			n.mu.Unlock()
+			return
+		}
+		next := n.nextIndex[peer.id]
+		req := raftAppendRequest{
+			term:        n.term,
+			leader:      n.id,
+			prevIndex:   next - 1,
+			prevTerm:    n.log[next-1].term,
+			entries:     slices.Clone(n.log[next:min(len(n.log), next+raftMaxAppendEntries)]),
+			commitIndex: n.commitIndex,
+		}
+		n.mu.Unlock()
+
+		reply := peer.appendEntries(req)
+
+		n.mu.Lock()
+		switch {
+		case reply.term > n.term:
+			n.stepDown(reply.term)
+		case n.role != raftLeader || n.term != req.term:
+		case reply.success:
+			n.matchIndex[peer.id] = max(n.matchIndex[peer.id], req.prevIndex+len(req.entries))
+			n.nextIndex[peer.id] = n.matchIndex[peer.id] + 1
+		default:
+			// The logs differ at prevIndex: back up, past the end of the follower's log if need be.
+			n.nextIndex[peer.id] = max(1, min(next-1, reply.lastIndex+1))
+		}
+		n.mu.Unlock()
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.role != raftLeader {
+		return
+	}
+	for index := len(n.log) - 1; index > n.commitIndex && n.log[index].term == n.term; index-- {
+		replicas := 1
+		for id, match := range n.matchIndex {
+			if id != n.id && match >= index {
+				replicas++
+			}
+		}
+		if 2*replicas > len(n.cluster.nodes) {
+			n.commitIndex = index
+			break
+		}
+	}
+}
+
+// appendEntries adds a leader's entries to the log, once the log holds the entry the leader sent
+// them after, replacing any of its own that conflict with them.
+func (n *RaftNode) appendEntries(req raftAppendRequest) raftAppendReply {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if req.term < n.term {
+		return raftAppendReply{term: n.term}
+	}
+	if err := n.stepDown(req.term); err != nil {
+		return raftAppendReply{term: n.term, lastIndex: req.prevIndex}
+	}
+	n.leader = req.leader
+	n.resetDeadline()
+
+	last := len(n.log) - 1
+	if req.prevIndex > last || n.log[req.prevIndex].term != req.prevTerm {
+		return raftAppendReply{term: n.term, lastIndex: min(last, req.prevIndex-1)}
+	}
+	for i, e := range req.entries {
+		index := req.prevIndex + 1 + i
+		if index < len(n.log) && n.log[index].term == e.term {
+			continue
+		}
+		if err := n.appendLog(index, req.entries[i:]); err != nil {
+			return raftAppendReply{term: n.term, lastIndex: req.prevIndex}
+		}
+		break
+	}
+	if req.commitIndex > n.commitIndex {
+		n.commitIndex = max(n.commitIndex, min(req.commitIndex, req.prevIndex+len(req.entries)))
+	}
+	return raftAppendReply{term: n.term, success: true}
+}
+
+// applyCommitted applies the committed entries that haven't been applied yet, in log order.
+func (n *RaftNode) applyCommitted() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for n.err == nil && n.applied < n.commitIndex {
+		index := n.applied + 1
+		entry := n.log[index]
+		n.mu.Unlock()
+		err := n.apply(index, entry)
+		n.mu.Lock()
+		if err != nil {
+			log.Printf("raft node %d: applying entry %d: %v", n.id, index, err)
+			n.err = err
+			return
+		}
+		n.applied = index
+		n.changed.Broadcast()
+	}
+}
+
+// apply applies an entry to the node's store, as a replica applies a transaction of its leader's
+// log, and logs the entry's index with it.
+func (n *RaftNode) apply(index int, entry raftEntry) error {
+	if len(entry.data) == 0 {
+		return nil
+	}
+	records, _, err := readWALRecords(bytes.NewReader(entry.data))
+	if err != nil {
+		return err
+	}
+	return n.store.db.applyReplicated(records, uint64(index))
+}
+
+// raftCommand implements `go run . raft [-dir path] [-keys N]`: it replicates writes over three
+// nodes, cuts the leader off, and shows the others carry on without it and it catch up once it
+// is back. Then it reopens the cluster from the nodes' files.
+func raftCommand(args []string) error {
+	flags := flag.NewFlagSet("raft", flag.ExitOnError)
+	dir := flags.String("dir", "", "directory of the nodes' files; a temporary one if empty")
+	numKeys := flags.Int("keys", 50, "number of keys written before and after the leader is cut off")
+	flags.Parse(args)
+	if *dir == "" {
+		tmp, err := os.MkdirTemp("", "raft")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		*dir = tmp
+	}
+
+	cluster, err := OpenRaftCluster(*dir, 3)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cluster != nil {
+			cluster.Close()
+		}
+	}()
+	put := func(from, to int) error {
+		for i := from; i < to; i++ {
+			if err := cluster.Put(fmt.Appendf(nil, "key:%06d", i), fmt.Appendf(nil, "value %d", i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	// converged waits for every node to apply the leader's whole log.
+	converged := func() (*RaftNode, error) {
+		deadline := time.Now().Add(raftProposeTimeout)
+		for time.Now().Before(deadline) {
+			if leader := cluster.Leader(); leader != nil {
+				last := leader.Status().LastIndex
+				if !slices.ContainsFunc(cluster.nodes, func(n *RaftNode) bool { return n.Status().Applied < last }) {
+					return leader, nil
+				}
+			}
+			time.Sleep(raftTickInterval)
+		}
+		return nil, errRaftTimeout
+	}
+	printNodes := func() error {
+		for _, n := range cluster.nodes {
+			keys := 0
+			if err := n.Scan(nil, func(key, value []byte) error { keys++; return nil }); err != nil {
+				return err
+			}
+			s := n.Status()
+			fmt.Printf("  node %d: %-9s term %d, %d entries, applied up to %d, %d keys\n",
+				s.ID, s.Role, s.Term, s.LastIndex, s.Applied, keys)
+		}
+		return nil
+	}
+
+	if err := put(0, *numKeys); err != nil {
+		return err
+	}
+	leader, err := converged()
+	if err != nil {
+		return err
+	}
+	first := leader.Status()
+	fmt.Printf("node %d was elected leader in term %d and replicated %d writes:\n", first.ID, first.Term, *numKeys)
+	if err := printNodes(); err != nil {
+		return err
+	}
+
+	cluster.Disconnect(first.ID)
+	if err := put(*numKeys, 2**numKeys); err != nil {
+		return err
+	}
+	second := cluster.Leader().Status()
+	fmt.Printf("with node %d cut off, node %d took over in term %d and replicated %d more:\n",
+		first.ID, second.ID, second.Term, *numKeys)
+	if err := printNodes(); err != nil {
+		return err
+	}
+
+	cluster.Reconnect(first.ID)
+	if _, err := converged(); err != nil {
+		return err
+	}
+	fmt.Printf("node %d rejoined as a follower and caught up:\n", first.ID)
+	if err := printNodes(); err != nil {
+		return err
+	}
+
+	err = cluster.Close()
+	cluster = nil
+	if err != nil {
+		return err
+	}
+	if cluster, err = OpenRaftCluster(*dir, 3); err != nil {
+		return err
+	}
+	fmt.Println("reopened, every node read its term and log back from its WAL:")
+	if err := printNodes(); err != nil {
+		return err
+	}
+	if _, err := converged(); err != nil {
+		return err
+	}
+	value, found, err := cluster.Node(first.ID).Get(fmt.Appendf(nil, "key:%06d", 2**numKeys-1))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("after a new election, node %d serves the last write: found=%v, %q\n", first.ID, found, value)
+	return nil
+}
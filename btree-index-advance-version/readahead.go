@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+// =================================================================================================
+// --- readahead.go --- (Sequential Read-Ahead for Range Scans)
+// =================================================================================================
+
+// A range scan reads one leaf page at a time. The Pager notices when pages are being read in
+// ascending order (or is told so by a scan hint) and then fetches the next readAhead pages with a
+// single ReadAt into a read-ahead window. The following reads of the scan are served from that
+// window, so a long scan issues one large read every few pages instead of one small read per page.
+//
+// Leaves are only physically sequential when they were allocated in key order (e.g. after a bulk
+// or sequential load), so detection falls back to single-page reads as soon as a scan jumps around.
+
+// defaultReadAheadPages is how many pages a read-ahead fetches at once (64KB).
+const defaultReadAheadPages = 16
+
+// ScanHinter is implemented by page stores that can prefetch for sequential scans. The tree's scan
+// cursor calls HintScan with the page it will read next, before it reads it.
+type ScanHinter interface {
+	HintScan(nextPageID PageID)
+}
+
+// readAheadState is the Pager's read-ahead bookkeeping. It is guarded by Pager.mu.
+type readAheadState struct {
+	pages    int    // pages fetched per read-ahead, 0 disables read-ahead
+	lastRead PageID // page read by the previous ReadPage
+	hinted   PageID // page the scan cursor said it reads next, -1 if none
+	start    PageID // first page held in window
+	window   []byte // pages [start, start+len(window)/PageSize)
+}
+
+// SetReadAhead sets how many pages are fetched at once when a sequential scan is detected.
+// Zero disables read-ahead. Read-ahead stays off for encrypted files.
+func (p *Pager) SetReadAhead(pages int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cipher != nil {
+		pages = 0
+	}
+	p.readAhead.pages = max(pages, 0)
+	p.readAhead.window = nil
+}
+
+// HintScan tells the Pager that a scan is about to read nextPageID, so the read-ahead can begin
+// at that page instead of waiting to detect the sequential pattern.
+func (p *Pager) HintScan(nextPageID PageID) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.readAhead.hinted = nextPageID
+}
+
+// readWithReadAhead serves a read from the read-ahead window, refilling the window first when the
+// read continues a sequential pattern. It reports false if the page has to be read on its own.
+// The caller must hold p.mu.
+func (p *Pager) readWithReadAhead(pageID PageID, pageData *Page) (bool, error) {
+	ra := &p.readAhead
+	sequential := pageID == ra.lastRead+1 || pageID == ra.hinted
+	ra.lastRead = pageID
+	if pageID == ra.hinted {
+		ra.hinted = -1
+	}
+
+	if ra.copyFromWindow(pageID, pageData) {
+		return true, nil
+	}
+	if ra.pages == 0 || !sequential {
+		return false, nil
+	}
+	if err := p.fillWindow(pageID); err != nil {
+		return false, err
+	}
+	return ra.copyFromWindow(pageID, pageData), nil
+}
+
+// fillWindow reads up to ra.pages pages starting at pageID into the window with a single read.
+func (p *Pager) fillWindow(pageID PageID) error {
+	ra := &p.readAhead
+	offset := int64(pageID) * PageSize
+	size := min(int64(ra.pages)*PageSize, p.fileSize-offset)
+	if size <= 0 {
+		return nil
+	}
+	if int64(cap(ra.window)) < size {
+		ra.window = make([]byte, size)
+	}
+	n, err := p.file.ReadAt(ra.window[:size], offset)
+	if err != nil && !errors.Is(err, io.EOF) {
+		ra.window = ra.window[:0]
+		return err
+	}
+	// A page the file couldn't be extended with when it was allocated lies beyond the end of the
+	// file until it is written; keep only whole pages.
+	ra.start = pageID
+	ra.window = ra.window[:n/PageSize*PageSize]
+	return nil
+}
+
+func (ra *readAheadState) copyFromWindow(pageID PageID, pageData *Page) bool {
+	i := int64(pageID-ra.start) * PageSize
+	if pageID < ra.start || i >= int64(len(ra.window)) {
+		return false
+	}
+	copy(pageData[:], ra.window[i:i+PageSize])
+	return true
+}
+
+// updateWindow keeps the window in step with a page that was just written.
+func (ra *readAheadState) updateWindow(pageID PageID, pageData *Page) {
+	i := int64(pageID-ra.start) * PageSize
+	if pageID >= ra.start && i < int64(len(ra.window)) {
+		copy(ra.window[i:i+PageSize], pageData[:])
+	}
+}
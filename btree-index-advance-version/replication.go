@@ -0,0 +1,423 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// =================================================================================================
+// --- replication.go --- (WAL Shipping to Read Replicas)
+// =================================================================================================
+
+// A leader DB ships its write-ahead log over TCP to replicas, which apply the committed
+// transactions to their own copy of the files and serve reads from it:
+//
+//	leader:   go run . serve -replication :7070
+//	replica:  go run . replica -leader localhost:7070 -addr :8081
+//
+// A replica connects and sends the leader LSN up to which it has applied the log. The leader
+// answers with one byte:
+//
+//	'S' snapshot: a backup of the leader (see DB.Backup), followed by the log after the backup's
+//	    LSN. Sent to a new replica, which asks for LSN 0.
+//	'L' log: the records after the requested LSN, framed as in the WAL file.
+//	'E' error: | length uint32 | message |.
+//
+// After that the leader tails its WAL file, sending every record once it has been synced, for as
+// long as the replica stays connected.
+//
+// The replica logs each transaction it applies in its own WAL, together with a walReplicated
+// record holding the leader LSN of the transaction's commit, so a restarted replica knows where
+// to resume. Compact replaces the index file without logging it, so replicas have
+// to be bootstrapped again afterwards.
+
+const (
+	replicationSnapshot = 'S'
+	replicationLog      = 'L'
+	replicationError    = 'E'
+)
+
+const (
+	// replicationPollInterval is how often the leader looks for new records at the end of its log.
+	replicationPollInterval = 20 * time.Millisecond
+	// replicaRetryInterval is how long a replica waits before reconnecting to its leader.
+	replicaRetryInterval = time.Second
+)
+
+var (
+	errReplicaAhead        = errors.New("replica is ahead of the leader's log")
+	errReplicationProtocol = errors.New("unexpected replication message")
+)
+
+// ServeReplication ships the log to the replicas that connect to listener, until ctx is done.
+func (db *DB) ServeReplication(ctx context.Context, listener net.Listener) error {
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			if err := db.shipLog(ctx, conn); err != nil && ctx.Err() == nil {
+				log.Printf("replication to %s: %v", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// shipLog serves one replica.
+func (db *DB) shipLog(ctx context.Context, conn net.Conn) error {
+	var request [8]byte
+	if _, err := io.ReadFull(conn, request[:]); err != nil {
+		return err
+	}
+	from := binary.LittleEndian.Uint64(request[:])
+	w := bufio.NewWriter(conn)
+
+	if from > db.wal.lastLSN() {
+		w.WriteByte(replicationError)
+		binary.Write(w, binary.LittleEndian, uint32(len(errReplicaAhead.Error())))
+		w.WriteString(errReplicaAhead.Error())
+		w.Flush()
+		return errReplicaAhead
+	}
+	if from == 0 {
+		w.WriteByte(replicationSnapshot)
+		lsn, err := db.Backup(w)
+		if err != nil {
+			return err
+		}
+		from = lsn
+	} else {
+		w.WriteByte(replicationLog)
+	}
+	return db.tailLog(ctx, from, w)
+}
+
+// tailLog sends the records of the log after LSN from to w, waiting at the end of the log for more
+// to be written, until ctx is done or w fails. Checkpoint records are left out, as they only
+// concern the leader's own index file.
+func (db *DB) tailLog(ctx context.Context, from uint64, w *bufio.Writer) error {
+	return db.followLog(ctx, func(record walRecord) error {
+		if record.lsn <= from || record.kind == walCheckpoint {
+			return nil
+		}
+		_, err := w.Write(encodeWALRecord(&record))
+		return err
+	}, w.Flush)
+}
+
+// followLog calls fn with every record of the log, from the first, waiting at the end of the log
+// for more to be written, until ctx is done or fn fails. idle, if not nil, is called each time
+// the end of the log is reached.
+func (db *DB) followLog(ctx context.Context, fn func(record walRecord) error, idle func() error) error {
+	var offset int64
+	r := bufio.NewReader(io.NewSectionReader(db.wal.file, 0, math.MaxInt64))
+	for {
+		record, size, err := readWALRecord(r)
+		if err == io.EOF || err == io.ErrUnexpectedEOF || err == errCorruptWALRecord {
+			// The end of the log, or a record that is still being written.
+			if idle != nil {
+				if err := idle(); err != nil {
+					return err
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(replicationPollInterval):
+			}
+			r.Reset(io.NewSectionReader(db.wal.file, offset, math.MaxInt64-offset))
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		offset += size
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+}
+
+// Replica is a read-only copy of a leader DB, kept up to date by applying the leader's log.
+type Replica struct {
+	db         *DB
+	path       string
+	leaderAddr string
+
+	mu      sync.Mutex
+	conn    net.Conn // the current connection to the leader
+	closed  bool
+	stopped chan struct{}
+}
+
+// OpenReplica opens the replica kept in path.idx, path.dat and path.wal and starts following the
+// leader at leaderAddr. A new replica first copies a snapshot of the leader's files, replacing
+// its own. If the connection to the leader is lost later, the replica keeps serving reads and
+// reconnects in the background.
+func OpenReplica(path, leaderAddr string) (*Replica, error) {
+	db, err := OpenDB(path+".idx", path+".dat", path+".wal", 0)
+	if err != nil {
+		return nil, err
+	}
+	r := &Replica{db: db, path: path, leaderAddr: leaderAddr, stopped: make(chan struct{})}
+	reader, err := r.connect(true)
+	if err != nil {
+		r.db.Close()
+		return nil, err
+	}
+	go r.run(reader)
+	return r, nil
+}
+
+// connect connects to the leader and asks for its log after the replica's LSN. If bootstrap is
+// true, the leader may send a snapshot, which is restored before connect returns.
+func (r *Replica) connect(bootstrap bool) (*bufio.Reader, error) {
+	conn, err := net.Dial("tcp", r.leaderAddr)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	closed := r.closed
+	r.conn = conn
+	r.mu.Unlock()
+	if closed {
+		conn.Close()
+		return nil, net.ErrClosed
+	}
+
+	if err := binary.Write(conn, binary.LittleEndian, r.LSN()); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	kind, err := reader.ReadByte()
+	switch {
+	case err != nil:
+	case kind == replicationLog:
+	case kind == replicationSnapshot && bootstrap:
+		err = r.restoreSnapshot(reader)
+	case kind == replicationError:
+		var length uint32
+		if err = binary.Read(reader, binary.LittleEndian, &length); err == nil {
+			message := make([]byte, min(length, 1024))
+			io.ReadFull(reader, message)
+			err = fmt.Errorf("leader: %s", message)
+		}
+	default:
+		err = errReplicationProtocol
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return reader, nil
+}
+
+// restoreSnapshot replaces the replica's files with a snapshot sent by the leader.
+func (r *Replica) restoreSnapshot(reader io.Reader) error {
+	if err := r.db.Close(); err != nil {
+		return err
+	}
+	lsn, err := RestoreBackup(reader, r.path)
+	if err != nil {
+		return err
+	}
+	db, err := OpenDB(r.path+".idx", r.path+".dat", r.path+".wal", 0)
+	if err != nil {
+		return err
+	}
+	r.db = db
+	tx := db.Begin()
+	tx.replicatedLSN = lsn
+	return tx.Commit()
+}
+
+// run applies the leader's log until the replica is closed, reconnecting whenever the connection
+// is lost.
+func (r *Replica) run(reader *bufio.Reader) {
+	defer close(r.stopped)
+	for {
+		err := r.follow(reader)
+		for {
+			r.mu.Lock()
+			closed := r.closed
+			r.conn.Close()
+			r.mu.Unlock()
+			if closed {
+				return
+			}
+			log.Printf("replica of %s: %v; reconnecting in %s", r.leaderAddr, err, replicaRetryInterval)
+			time.Sleep(replicaRetryInterval)
+			if reader, err = r.connect(false); err == nil {
+				break
+			}
+		}
+	}
+}
+
+// follow reads the leader's log and applies each committed transaction, until reading fails.
+func (r *Replica) follow(reader *bufio.Reader) error {
+	var assembler txAssembler
+	for {
+		record, _, err := readWALRecord(reader)
+		if err != nil {
+			return err
+		}
+		if records := assembler.add(record); records != nil {
+			if err := r.db.applyReplicated(records, record.lsn); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// txAssembler collects the records of another DB's log into transactions.
+type txAssembler struct {
+	pending []walRecord // the records of the transaction being collected
+}
+
+// add adds a record of the log. If the record commits a transaction, add returns the
+// transaction's records, without the commit record.
+func (a *txAssembler) add(record walRecord) []walRecord {
+	switch {
+	case record.kind == walBegin:
+		// A transaction that never committed, if any, was abandoned.
+		a.pending = []walRecord{record}
+	case len(a.pending) == 0 || record.txID != a.pending[0].txID:
+	case record.kind == walCommit:
+		records := a.pending
+		a.pending = nil
+		return records
+	default:
+		a.pending = append(a.pending, record)
+	}
+	return nil
+}
+
+// applyReplicated applies a transaction received from the leader, made of the given records, in a
+// transaction of the replica's own. lsn is the LSN of its commit record in the leader's log.
+func (db *DB) applyReplicated(records []walRecord, lsn uint64) error {
+	tx := db.Begin()
+	tx.replicatedLSN = lsn
+	for _, record := range records {
+		var page *Page
+		switch record.kind {
+		case walPageImage:
+			if len(record.data) != PageSize {
+				tx.Rollback()
+				return errCorruptWALRecord
+			}
+			page = (*Page)(record.data)
+		case walPageUpdate, walCompensation:
+			// A page the leader stole, or restored undoing that (see aries.go). The last
+			// record of a page holds it as the transaction left it.
+			var err error
+			if page, err = loggedPage(record); err != nil {
+				tx.Rollback()
+				return err
+			}
+		case walHeapAppend:
+			tx.rows = append(tx.rows, pendingRow{offset: record.target, data: record.data})
+		}
+		if page != nil {
+			pageID := PageID(record.target)
+			// Allocate the pages the leader allocated, so the Pager counts them.
+			for db.pager.NumPages() <= int64(pageID) {
+				db.pager.AllocatePage()
+			}
+			db.tree.txPages[pageID] = page
+		}
+	}
+	var roots []PageID
+	for _, pageID := range slices.Sorted(maps.Keys(db.tree.txPages)) {
+		switch page := db.tree.txPages[pageID]; {
+		case page[nodeTypeOffset] == NodeTypeMeta:
+			db.tree.metaPageID = pageID
+		case page[nodeTypeOffset] == NodeTypeCatalog:
+			db.tree.catalogPageID = pageID
+		case isRoot(page):
+			roots = append(roots, pageID)
+		}
+	}
+	// The leader doesn't log its root, but a new root is written with the root flag set. So is
+	// the root of every bucket.
+	if len(roots) > 0 {
+		buckets, err := db.tree.buckets()
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		for _, pageID := range roots {
+			if !slices.ContainsFunc(buckets, func(e catalogEntry) bool { return e.root == pageID }) {
+				db.tree.rootPageID = pageID
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// LSN returns the leader LSN up to which the replica has applied the log.
+func (r *Replica) LSN() uint64 {
+	return r.db.replicatedLSN.Load()
+}
+
+// Get looks up the row stored under key, as of the last transaction the replica has applied.
+func (r *Replica) Get(key int) (string, bool, error) {
+	return r.db.Get(key)
+}
+
+// Close stops following the leader and closes the replica's files.
+func (r *Replica) Close() error {
+	r.mu.Lock()
+	r.closed = true
+	r.conn.Close()
+	r.mu.Unlock()
+	<-r.stopped
+	return r.db.Close()
+}
+
+// replicaCommand implements `go run . replica -leader host:port [-addr :8081] [-db path]`: it
+// follows the leader and serves the read-only part of the HTTP API (see server.go).
+func replicaCommand(args []string) error {
+	flags := flag.NewFlagSet("replica", flag.ExitOnError)
+	leader := flags.String("leader", "localhost:7070", "replication address of the leader")
+	addr := flags.String("addr", ":8081", "address to listen on")
+	path := flags.String("db", "replica", "path of the replica's files, without extension")
+	flags.Parse(args)
+
+	replica, err := OpenReplica(*path, *leader)
+	if err != nil {
+		return err
+	}
+	log.Printf("replicating %s into %s.idx, at LSN %d", *leader, *path, replica.LSN())
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	servers := []*http.Server{{Addr: *addr, Handler: newIndexHandler(replica.db, true)}}
+	return errors.Join(serveUntilDone(ctx, servers), replica.Close())
+}
@@ -0,0 +1,54 @@
+package main
+
+// =================================================================================================
+// --- rightmost.go --- (Rightmost-Leaf Fast Path for Appends)
+// =================================================================================================
+
+// Keys that only ever grow, like the auto-increment ids of users.csv, all go to the rightmost
+// leaf, yet every Insert descends from the root to find it again, reading one page per level.
+// The tree remembers the rightmost leaf instead, and an Insert of a key larger than every key in
+// it goes straight there:
+//
+//	key > last key of the remembered leaf:  read only that leaf
+//	anything else:                          descend from the root, and remember the leaf found
+//	                                        if it has no next leaf
+//
+// The leaf isn't tracked through the changes that can take its place, such as splits, merges,
+// rollbacks, bucket switches and compactions. It is checked when it is read instead: it must
+// still be a leaf with keys and no next leaf, and the root must be the one it was found under.
+// Only the rightmost leaf of a tree has no next leaf, and released pages have no keys, so a page
+// that passes is the rightmost leaf, and a key past its last one belongs there. After a split,
+// the next Insert descends and finds the new rightmost leaf.
+
+// rightmostLeaf is the leaf a tree remembers for appends.
+type rightmostLeaf struct {
+	root PageID // the root it was found under
+	leaf PageID // 0, the meta page, for none
+}
+
+// appendLeaf returns the rightmost leaf if key belongs there past its last key. It reports false
+// if the remembered leaf no longer checks out, or key isn't larger than every key in it.
+func (t *BPlusTree) appendLeaf(key int) (PageID, *Page, bool) {
+	r := t.rightmost
+	if r.leaf == 0 || r.root != t.rootPageID {
+		return -1, nil, false
+	}
+	page, err := t.readPage(r.leaf)
+	if err != nil || !isLeaf(page) || getNextLeafPageID(page) != -1 {
+		// A failed read is left to the descent, which reports it if it matters.
+		return -1, nil, false
+	}
+	numKeys := int(getNumKeys(page))
+	if numKeys == 0 || key <= keyAt(page, numKeys-1) {
+		return -1, nil, false
+	}
+	t.compared(1)
+	return r.leaf, page, true
+}
+
+// noteRightmostLeaf remembers a leaf a descent found, if it is the rightmost one.
+func (t *BPlusTree) noteRightmostLeaf(pageID PageID, page *Page) {
+	if getNextLeafPageID(page) == -1 {
+		t.rightmost = rightmostLeaf{root: t.rootPageID, leaf: pageID}
+	}
+}
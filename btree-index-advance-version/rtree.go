@@ -0,0 +1,380 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+)
+
+// =================================================================================================
+// --- rtree.go --- (R-Tree)
+// =================================================================================================
+
+// The B+ tree orders keys along one dimension, so it can't answer "which rows lie in this part of
+// the map?": points that are close on a map can be far apart in any single order. An R-tree is a
+// B+ tree of rectangles instead of keys. Every entry of a leaf is the bounding rectangle of a row
+// and the row's TID; every entry of an internal page is the bounding rectangle of everything under
+// a child and the child's page ID. A window query descends into every child whose rectangle
+// intersects the window, so it reads the pages near the window and skips the rest of the tree.
+//
+// Unlike the keys of a B+ tree, the rectangles of siblings may overlap, and a query may have to
+// descend into several of them. Inserts keep the overlap down, as in Guttman's original R-tree:
+//
+//   - an entry goes down into the child whose rectangle grows the least to cover it, and
+//   - an overflowing page is split with the quadratic algorithm: the two entries that would waste
+//     the most area together seed the two halves, and every other entry joins the half whose
+//     rectangle it enlarges the least.
+//
+// The tree has no delete.
+//
+// The tree lives in pages of a PageStore of its own. Page 0 is always the root: when it splits,
+// its entries move to two new pages and it becomes their parent, so the tree grows from the root,
+// and all leaves stay at the same depth.
+//
+// Page layout:
+//
+//	| header (32 bytes) | minX | minY | maxX | maxY float64 | child page ID or TID int64 | ... |
+//
+// The node type is NodeTypeRTree, numKeys is the number of entries and the parent slot holds the
+// level of the page: 0 for a leaf, one more for each level above.
+
+const NodeTypeRTree = 9
+
+const (
+	rtreeEntrySize  = 5 * 8
+	rtreeMaxEntries = (PageSize - headerSize) / rtreeEntrySize
+	// rtreeMinEntries is the fewest entries a split leaves in either half.
+	rtreeMinEntries = rtreeMaxEntries * 2 / 5
+)
+
+var errInvalidRect = errors.New("rectangle must have MinX <= MaxX and MinY <= MaxY")
+
+// Rect is an axis-aligned rectangle, closed on all sides. A point is a rectangle with
+// MinX == MaxX and MinY == MaxY.
+type Rect struct {
+	MinX, MinY, MaxX, MaxY float64
+}
+
+func (r Rect) valid() bool {
+	return r.MinX <= r.MaxX && r.MinY <= r.MaxY // also false for NaNs
+}
+
+func (r Rect) area() float64 {
+	return (r.MaxX - r.MinX) * (r.MaxY - r.MinY)
+}
+
+// union returns the smallest rectangle covering r and s.
+func (r Rect) union(s Rect) Rect {
+	return Rect{min(r.MinX, s.MinX), min(r.MinY, s.MinY), max(r.MaxX, s.MaxX), max(r.MaxY, s.MaxY)}
+}
+
+// Intersects reports whether r and s have at least one point in common.
+func (r Rect) Intersects(s Rect) bool {
+	return r.MinX <= s.MaxX && s.MinX <= r.MaxX && r.MinY <= s.MaxY && s.MinY <= r.MaxY
+}
+
+// enlargement returns how much r's area grows to cover s.
+func (r Rect) enlargement(s Rect) float64 {
+	return r.union(s).area() - r.area()
+}
+
+// rtreeEntry is an entry of an R-tree page: a TID in a leaf, a child page ID in an internal page.
+type rtreeEntry struct {
+	rect Rect
+	ref  int64
+}
+
+// boundingRect returns the smallest rectangle covering every entry.
+func boundingRect(entries []rtreeEntry) Rect {
+	r := entries[0].rect
+	for _, e := range entries[1:] {
+		r = r.union(e.rect)
+	}
+	return r
+}
+
+// RTree is an R-tree index mapping rectangles to TIDs. Like the B+ tree, it is not safe for
+// concurrent use.
+type RTree struct {
+	pager  PageStore
+	pool   *BufferPool
+	tracer Tracer
+}
+
+// OpenRTree opens the R-tree stored in pager, or creates an empty one in an empty pager.
+func OpenRTree(pager PageStore) (*RTree, error) {
+	t := &RTree{pager: pager, pool: NewBufferPool(pager, defaultBufferPoolFrames)}
+	if pager.NumPages() == 0 {
+		pager.AllocatePage()
+		return t, t.writeNode(0, 0, nil)
+	}
+	if _, _, err := t.readNode(0); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// BufferPool returns the pool caching the tree's pages.
+func (t *RTree) BufferPool() *BufferPool {
+	return t.pool
+}
+
+// SetTracer installs a tracer on the tree. It reports page reads and writes, and OnSplit for page
+// splits. Passing nil disables tracing.
+func (t *RTree) SetTracer(tracer Tracer) {
+	t.tracer = tracer
+}
+
+// --- Pages ---
+
+// readNode returns the level and the entries of a page.
+func (t *RTree) readNode(pageID PageID) (int, []rtreeEntry, error) {
+	if t.tracer != nil {
+		t.tracer.OnPageRead(pageID)
+	}
+	page, err := t.pool.ReadPage(pageID, new(Page))
+	if err != nil {
+		return 0, nil, err
+	}
+	if page[nodeTypeOffset] != NodeTypeRTree || int(getNumKeys(page)) > rtreeMaxEntries {
+		return 0, nil, fmt.Errorf("%w: page %d is not an R-tree page", ErrCorruptPage, pageID)
+	}
+	entries := make([]rtreeEntry, getNumKeys(page))
+	for i := range entries {
+		field := func(j int) uint64 {
+			return binary.LittleEndian.Uint64(page[headerSize+i*rtreeEntrySize+j*8:])
+		}
+		entries[i] = rtreeEntry{
+			rect: Rect{math.Float64frombits(field(0)), math.Float64frombits(field(1)), math.Float64frombits(field(2)), math.Float64frombits(field(3))},
+			ref:  int64(field(4)),
+		}
+	}
+	return int(getParentPageID(page)), entries, nil
+}
+
+// writeNode writes a page holding entries at the given level.
+func (t *RTree) writeNode(pageID PageID, level int, entries []rtreeEntry) error {
+	page := new(Page)
+	page[nodeTypeOffset] = NodeTypeRTree
+	setIsRoot(page, pageID == 0)
+	setParentPageID(page, PageID(level))
+	setNextLeafPageID(page, -1)
+	setNumKeys(page, uint16(len(entries)))
+	for i, e := range entries {
+		offset := headerSize + i*rtreeEntrySize
+		for j, f := range []float64{e.rect.MinX, e.rect.MinY, e.rect.MaxX, e.rect.MaxY} {
+			binary.LittleEndian.PutUint64(page[offset+j*8:], math.Float64bits(f))
+		}
+		binary.LittleEndian.PutUint64(page[offset+32:], uint64(e.ref))
+	}
+	if t.tracer != nil {
+		t.tracer.OnPageWrite(pageID)
+	}
+	return t.pool.WritePage(pageID, page)
+}
+
+// --- Operations ---
+
+// Insert adds a rectangle and the TID of its row. The same TID may be inserted under several
+// rectangles, and the same rectangle under several TIDs.
+func (t *RTree) Insert(rect Rect, tid TID) error {
+	if !rect.valid() {
+		return fmt.Errorf("%w: %v", errInvalidRect, rect)
+	}
+
+	// Descend to a leaf, remembering the path and the entry followed on each page.
+	type step struct {
+		pageID  PageID
+		level   int
+		entries []rtreeEntry
+		index   int // the entry followed to the next page
+	}
+	var path []step
+	pageID := PageID(0)
+	for {
+		level, entries, err := t.readNode(pageID)
+		if err != nil {
+			return err
+		}
+		if level == 0 {
+			path = append(path, step{pageID, level, entries, -1})
+			break
+		}
+		if len(entries) == 0 {
+			return fmt.Errorf("%w: R-tree page %d has no children", ErrCorruptPage, pageID)
+		}
+		best := chooseSubtree(entries, rect)
+		path = append(path, step{pageID, level, entries, best})
+		pageID = PageID(entries[best].ref)
+	}
+
+	// Add the entry to the leaf, then walk back up: each parent's entry for the page below is
+	// widened to the page's new bounding rectangle, and gets a sibling entry if the page split.
+	entry := rtreeEntry{rect, tid}
+	var split *rtreeEntry
+	for i := len(path) - 1; i >= 0; i-- {
+		s := path[i]
+		entries := s.entries
+		if i == len(path)-1 {
+			entries = append(entries, entry)
+		} else {
+			entries[s.index].rect = boundingRect(path[i+1].entries)
+			if split != nil {
+				entries = append(entries, *split)
+			}
+		}
+		split = nil
+		if len(entries) <= rtreeMaxEntries {
+			if err := t.writeNode(s.pageID, s.level, entries); err != nil {
+				return err
+			}
+			path[i].entries = entries
+			continue
+		}
+
+		left, right := quadraticSplit(entries)
+		if s.pageID == 0 {
+			return t.splitRoot(s.level, left, right)
+		}
+		newPageID := t.pager.AllocatePage()
+		if t.tracer != nil {
+			t.tracer.OnSplit(s.pageID, newPageID, s.level == 0)
+		}
+		// The new page is written before its parent points to it.
+		if err := t.writeNode(newPageID, s.level, right); err != nil {
+			return err
+		}
+		if err := t.writeNode(s.pageID, s.level, left); err != nil {
+			return err
+		}
+		path[i].entries = left
+		split = &rtreeEntry{boundingRect(right), int64(newPageID)}
+	}
+	return nil
+}
+
+// splitRoot moves the two halves of the overflowing root to new pages and makes the root their
+// parent, one level up.
+func (t *RTree) splitRoot(level int, left, right []rtreeEntry) error {
+	leftPageID, rightPageID := t.pager.AllocatePage(), t.pager.AllocatePage()
+	if t.tracer != nil {
+		t.tracer.OnSplit(0, rightPageID, level == 0)
+	}
+	if err := t.writeNode(leftPageID, level, left); err != nil {
+		return err
+	}
+	if err := t.writeNode(rightPageID, level, right); err != nil {
+		return err
+	}
+	return t.writeNode(0, level+1, []rtreeEntry{
+		{boundingRect(left), int64(leftPageID)},
+		{boundingRect(right), int64(rightPageID)},
+	})
+}
+
+// chooseSubtree returns the index of the entry whose rectangle needs the least enlargement to
+// cover rect, preferring the smaller rectangle on a tie.
+func chooseSubtree(entries []rtreeEntry, rect Rect) int {
+	best := 0
+	for i := 1; i < len(entries); i++ {
+		d, bestD := entries[i].rect.enlargement(rect), entries[best].rect.enlargement(rect)
+		if d < bestD || d == bestD && entries[i].rect.area() < entries[best].rect.area() {
+			best = i
+		}
+	}
+	return best
+}
+
+// quadraticSplit divides the entries of an overflowing page into two groups of at least
+// rtreeMinEntries each.
+func quadraticSplit(entries []rtreeEntry) (left, right []rtreeEntry) {
+	// The seeds are the pair that would waste the most area in one rectangle.
+	seedA, seedB, worst := 0, 1, math.Inf(-1)
+	for i := range entries {
+		for j := i + 1; j < len(entries); j++ {
+			waste := entries[i].rect.union(entries[j].rect).area() - entries[i].rect.area() - entries[j].rect.area()
+			if waste > worst {
+				seedA, seedB, worst = i, j, waste
+			}
+		}
+	}
+	left, right = []rtreeEntry{entries[seedA]}, []rtreeEntry{entries[seedB]}
+	leftRect, rightRect := entries[seedA].rect, entries[seedB].rect
+	rest := make([]rtreeEntry, 0, len(entries)-2)
+	for i, e := range entries {
+		if i != seedA && i != seedB {
+			rest = append(rest, e)
+		}
+	}
+
+	for len(rest) > 0 {
+		// A group that needs every remaining entry to reach the minimum gets them all.
+		if len(left)+len(rest) == rtreeMinEntries {
+			return append(left, rest...), right
+		}
+		if len(right)+len(rest) == rtreeMinEntries {
+			return left, append(right, rest...)
+		}
+		// Next is the entry with the strongest preference for one group.
+		next, bestDiff := 0, -1.0
+		for i, e := range rest {
+			if diff := math.Abs(leftRect.enlargement(e.rect) - rightRect.enlargement(e.rect)); diff > bestDiff {
+				next, bestDiff = i, diff
+			}
+		}
+		e := rest[next]
+		rest = slices.Delete(rest, next, next+1)
+		dl, dr := leftRect.enlargement(e.rect), rightRect.enlargement(e.rect)
+		toLeft := dl < dr || dl == dr && (leftRect.area() < rightRect.area() ||
+			leftRect.area() == rightRect.area() && len(left) <= len(right))
+		if toLeft {
+			left, leftRect = append(left, e), leftRect.union(e.rect)
+		} else {
+			right, rightRect = append(right, e), rightRect.union(e.rect)
+		}
+	}
+	return left, right
+}
+
+// Search returns the TIDs of the rectangles that intersect window, in ascending order, once for
+// each rectangle.
+func (t *RTree) Search(window Rect) ([]TID, error) {
+	if !window.valid() {
+		return nil, fmt.Errorf("%w: %v", errInvalidRect, window)
+	}
+	var tids []TID
+	pending := []PageID{0}
+	for len(pending) > 0 {
+		pageID := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		level, entries, err := t.readNode(pageID)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			if !e.rect.Intersects(window) {
+				continue
+			}
+			if level == 0 {
+				tids = append(tids, e.ref)
+			} else {
+				pending = append(pending, PageID(e.ref))
+			}
+		}
+	}
+	slices.Sort(tids)
+	return tids, nil
+}
+
+// Height returns the number of levels of the tree, 1 for a tree that is a single leaf.
+func (t *RTree) Height() (int, error) {
+	level, _, err := t.readNode(0)
+	return level + 1, err
+}
+
+// Close writes out the pages cached by the tree's buffer pool. It doesn't close the PageStore.
+func (t *RTree) Close() error {
+	return t.pool.Close()
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"slices"
+)
+
+// =================================================================================================
+// --- sample.go --- (Random Sampling)
+// =================================================================================================
+
+// Analytics that only need an approximate answer, such as the shape of the key distribution, don't
+// need to read every leaf. Sample picks entries at random, each descent from the root choosing a
+// child with a probability proportional to the number of entries under it, which the order
+// statistics record on every internal page (see orderstat.go). That is the same as picking a rank
+// uniformly at random and following SelectNth to it, so every entry is equally likely, however
+// unevenly the leaves are filled. A sample of n entries costs n descents, about n * height page
+// reads, whatever the size of the tree.
+//
+//	sample, err := tree.Sample(1000, rand.New(rand.NewSource(1)))
+//	h, err := tree.SampleHistogram(16, 1000, nil) // approximate BuildHistogram(16)
+//
+// Entries are drawn with replacement, so a sample may hold an entry more than once. Seeding the
+// random source makes a sample reproducible, which suits tests.
+
+var (
+	errInvalidSampleSize = errors.New("sample size must be positive")
+	errSampleTreeChanged = errors.New("tree changed while sampling")
+)
+
+// Sample returns n entries of the tree chosen uniformly at random, with replacement, in the order
+// they were drawn. A nil rng uses the default source of math/rand. It returns nothing if the tree
+// is empty. Values are those stored by Insert, as Cursor.Value returns them.
+func (t *BPlusTree) Sample(n int, rng *rand.Rand) ([]KV, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+	intn := rand.Intn
+	if rng != nil {
+		intn = rng.Intn
+	}
+	total, err := t.Len()
+	if err != nil || total == 0 {
+		return nil, err
+	}
+	sample := make([]KV, 0, n)
+	for range n {
+		page, i, err := t.selectEntry(intn(total))
+		if err != nil {
+			return nil, err
+		}
+		if page == nil {
+			// Len and the counts along the path disagree only if the tree changed meanwhile.
+			return nil, errSampleTreeChanged
+		}
+		sample = append(sample, KV{Key: keyAt(page, i), Value: int64ValueAt(page, i)})
+	}
+	return sample, nil
+}
+
+// SampleHistogram builds an equi-depth histogram with at most numBuckets buckets from a random
+// sample of sampleSize entries, instead of scanning the tree as BuildHistogram does. The bucket
+// counts are the sample's scaled to the size of the tree, and the first and last buckets reach the
+// smallest and largest keys, so every key falls in a bucket. rng is as for Sample.
+func (t *BPlusTree) SampleHistogram(numBuckets, sampleSize int, rng *rand.Rand) (*Histogram, error) {
+	if numBuckets < 1 {
+		return nil, errInvalidBucketCount
+	}
+	if sampleSize < 1 {
+		return nil, errInvalidSampleSize
+	}
+	total, err := t.Len()
+	if err != nil {
+		return nil, err
+	}
+	h := &Histogram{Total: total}
+	if total == 0 {
+		return h, nil
+	}
+	sample, err := t.Sample(sampleSize, rng)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]int, len(sample))
+	for i, kv := range sample {
+		keys[i] = kv.Key
+	}
+	slices.Sort(keys)
+
+	drawn := 0
+	sizes := distribute(len(keys), 1, len(keys), (len(keys)+numBuckets-1)/numBuckets)
+	for _, size := range sizes {
+		// Scaling the running total rather than each size keeps the counts summing to total.
+		count := (drawn+size)*total/len(keys) - drawn*total/len(keys)
+		h.Buckets = append(h.Buckets, HistogramBucket{Low: keys[drawn], High: keys[drawn+size-1], Count: count})
+		drawn += size
+	}
+	if h.Buckets[0].Low, _, err = t.Min(); err != nil {
+		return nil, err
+	}
+	if h.Buckets[len(h.Buckets)-1].High, _, err = t.Max(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// =================================================================================================
+// --- savepoint.go --- (Savepoints)
+// =================================================================================================
+
+// A long transaction, such as a batch import, can fail halfway through one of its steps, after it
+// changed some pages for it. Rolling the whole transaction back throws away every step that
+// worked. A savepoint marks a point in the transaction that RollbackTo can go back to instead:
+//
+//	tx := db.Begin()
+//	for _, row := range rows {
+//		tx.Savepoint("row")
+//		if err := importRow(tx, row); err != nil {
+//			tx.RollbackTo("row") // undoes this row only
+//		}
+//	}
+//	err := tx.Commit()
+//
+// Most of an open transaction doesn't reach the WAL before it commits (see txn.go), so the undo
+// records that RollbackTo replays are kept with the transaction rather than in the log, which
+// only ever sees the changes that are left at commit. While a savepoint is set, every page write
+// records the buffered page it replaces, and every change to an already changed key records the
+// change it had; rows, new key changes and stolen pages are only appended, so the savepoint
+// remembers how many there were. RollbackTo first undoes the pages stolen since, logging a
+// compensation record for each (see aries.go), then puts the buffered pages back in reverse order,
+// drops the rows and changes that came after, and restores the roots and the number of allocated
+// pages the savepoint saw.
+//
+// Savepoints nest: a name can be set again, and RollbackTo and Release refer to the most recent
+// savepoint of that name, dropping the savepoints set after it. Release forgets a savepoint
+// without undoing anything, and once none is left, writes stop recording undo records.
+
+var errSavepointNotFound = errors.New("savepoint not found")
+
+// savepoint is a point in a transaction that RollbackTo can go back to.
+type savepoint struct {
+	name string
+	// The lengths of the undo records and of the transaction's rows, key changes and stolen pages
+	// when it was set.
+	pageUndo, keyUndo, rows, keyChanges, stolen int
+
+	rootPageID    PageID
+	metaPageID    PageID
+	catalogPageID PageID
+	numPages      int64
+}
+
+// pageUndo records that a transaction's write replaced its buffered page, nil if there was none,
+// or that stealing the page removed it.
+type pageUndo struct {
+	pageID PageID
+	page   *Page
+}
+
+// keyChangeUndo records the row a transaction's key change led to before the key changed again.
+type keyChangeUndo struct {
+	index int // in Tx.keyChanges
+	new   int64
+}
+
+// Savepoint sets a savepoint called name at the current point of the transaction.
+func (tx *Tx) Savepoint(name string) error {
+	if tx.done || tx.prepared {
+		return errTxDone
+	}
+	tree := tx.db.tree
+	if tree.txUndo == nil {
+		tree.txUndo = []pageUndo{}
+	}
+	tx.savepoints = append(tx.savepoints, savepoint{
+		name:          name,
+		pageUndo:      len(tree.txUndo),
+		keyUndo:       len(tx.keyUndo),
+		rows:          len(tx.rows),
+		keyChanges:    len(tx.keyChanges),
+		stolen:        len(tx.stolen),
+		rootPageID:    tree.rootPageID,
+		metaPageID:    tree.metaPageID,
+		catalogPageID: tree.catalogPageID,
+		numPages:      tx.db.pager.NumPages(),
+	})
+	return nil
+}
+
+// RollbackTo undoes every change the transaction made since the savepoint called name was set,
+// and drops the savepoints set after it. The savepoint itself stays.
+func (tx *Tx) RollbackTo(name string) error {
+	i, err := tx.findSavepoint(name)
+	if err != nil {
+		return err
+	}
+	sp := tx.savepoints[i]
+	if err := tx.undoStolen(sp.stolen); err != nil {
+		return err
+	}
+	tree := tx.db.tree
+	for j := len(tree.txUndo) - 1; j >= sp.pageUndo; j-- {
+		if u := tree.txUndo[j]; u.page == nil {
+			delete(tree.txPages, u.pageID)
+		} else {
+			tree.txPages[u.pageID] = u.page
+		}
+	}
+	tree.txUndo = tree.txUndo[:sp.pageUndo]
+	for j := len(tx.keyUndo) - 1; j >= sp.keyUndo; j-- {
+		tx.keyChanges[tx.keyUndo[j].index].new = tx.keyUndo[j].new
+	}
+	tx.keyUndo = tx.keyUndo[:sp.keyUndo]
+	for _, c := range tx.keyChanges[sp.keyChanges:] {
+		delete(tx.changedKeys, c.key)
+	}
+	tx.keyChanges = tx.keyChanges[:sp.keyChanges]
+	tx.rows = tx.rows[:sp.rows]
+	tree.rootPageID, tree.metaPageID, tree.catalogPageID = sp.rootPageID, sp.metaPageID, sp.catalogPageID
+	tx.db.pager.releaseAllocations(tx.keptPages(sp.numPages))
+	tx.savepoints = tx.savepoints[:i+1]
+	return nil
+}
+
+// Release forgets the savepoint called name, and the savepoints set after it, keeping the changes
+// made since.
+func (tx *Tx) Release(name string) error {
+	i, err := tx.findSavepoint(name)
+	if err != nil {
+		return err
+	}
+	tx.savepoints = tx.savepoints[:i]
+	if len(tx.savepoints) == 0 {
+		tx.db.tree.txUndo, tx.keyUndo = nil, nil
+	}
+	return nil
+}
+
+// findSavepoint returns the position of the most recent savepoint called name.
+func (tx *Tx) findSavepoint(name string) (int, error) {
+	if tx.done || tx.prepared {
+		return 0, errTxDone
+	}
+	for i := len(tx.savepoints) - 1; i >= 0; i-- {
+		if tx.savepoints[i].name == name {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: %q", errSavepointNotFound, name)
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+)
+
+// =================================================================================================
+// --- secondary.go --- (Secondary Indexes)
+// =================================================================================================
+
+// The main tree of a DB indexes its rows by primary key. A secondary index finds the same rows by
+// another column, say the email of a user. It is one more B+ tree in the index file, kept in the
+// catalog like a KVStore bucket, mapping the column's value to the offset of the row in the heap
+// file:
+//
+//	db.CreateIndex("users_email", func(row []byte) (int, bool) { ... })
+//	tx.Insert(42, []byte("42,zoe,zoe@example.com"))  // also indexed in users_email
+//	row, found, err := tx.GetBy("users_email", key)
+//
+// Once an index is registered, Tx.Insert and Tx.Delete maintain it along with the main tree, as
+// part of the same transaction: its pages are logged and committed with the row, or rolled back
+// with it. An update is a Delete followed by an Insert, as in the HTTP server's PUT, so it moves
+// the row's entry in every index too.
+//
+// The tree only maps a key to one value, so secondary indexes are unique: inserting a row whose
+// key is already in an index fails with a *ConstraintViolation naming the index. Every index is
+// checked before anything is written, so a rejected row leaves the main tree and the other indexes
+// as they were.
+//
+// The function that computes a row's key is code, so the file can't store it. The index's tree
+// stays in the file between runs, but a program must register it with CreateIndex after every
+// OpenDB, before it changes any row; rows changed while it isn't registered are missing from it.
+
+// IndexKeyFunc returns the key a secondary index stores a row under, or false to leave the row out
+// of the index, like a NULL column.
+type IndexKeyFunc func(row []byte) (int, bool)
+
+// secondaryIndex is an index registered with CreateIndex.
+type secondaryIndex struct {
+	name string
+	key  IndexKeyFunc
+}
+
+var (
+	ErrIndexNotFound   = errors.New("index not found")
+	errIndexRegistered = errors.New("index is already registered")
+)
+
+// CreateIndex registers a secondary index. The first time, it also creates the index's tree and
+// adds every row already in the main tree to it, in a transaction of its own.
+func (db *DB) CreateIndex(name string, key IndexKeyFunc) error {
+	tx := db.Begin()
+	if slices.ContainsFunc(db.indexes, func(idx secondaryIndex) bool { return idx.name == name }) {
+		tx.Rollback()
+		return fmt.Errorf("%w: %q", errIndexRegistered, name)
+	}
+	_, err := db.tree.bucketRoot(name)
+	if err == nil {
+		db.indexes = append(db.indexes, secondaryIndex{name, key})
+		return tx.Rollback()
+	}
+	if !errors.Is(err, ErrBucketNotFound) {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.buildIndex(name, key); err != nil {
+		tx.Rollback()
+		return err
+	}
+	// Registered while the transaction still holds the DB, so no other transaction misses it.
+	db.indexes = append(db.indexes, secondaryIndex{name, key})
+	return tx.Commit()
+}
+
+// Indexes returns the names of the registered secondary indexes, in the order they were
+// registered.
+func (db *DB) Indexes() []string {
+	db.txMu.Lock()
+	defer db.txMu.Unlock()
+	names := make([]string, len(db.indexes))
+	for i, idx := range db.indexes {
+		names[i] = idx.name
+	}
+	return names
+}
+
+// buildIndex creates the tree of a new index and adds the rows of the main tree to it.
+func (tx *Tx) buildIndex(name string, key IndexKeyFunc) error {
+	var pairs []KV
+	c, err := tx.db.tree.Seek(math.MinInt)
+	if err != nil {
+		return err
+	}
+	for c.Next() {
+		if isTombstone(c.Value()) {
+			continue
+		}
+		row, err := tx.row(c.Value())
+		if err != nil {
+			return err
+		}
+		if k, ok := key([]byte(row)); ok {
+			pairs = append(pairs, KV{k, c.Value()})
+		}
+	}
+	if err := c.Err(); err != nil {
+		return err
+	}
+	if err := tx.db.tree.createBucket(name); err != nil {
+		return err
+	}
+	return tx.inIndex(name, func(t *BPlusTree) error {
+		for _, kv := range pairs {
+			if err := t.Insert(kv.Key, kv.Value); err != nil {
+				return indexViolation(err, name)
+			}
+		}
+		return nil
+	})
+}
+
+// inIndex runs fn with the tree pointed at the root of the named index, like a Bucket does, and
+// records the index's new root in the catalog if fn moved it.
+func (tx *Tx) inIndex(name string, fn func(t *BPlusTree) error) error {
+	t := tx.db.tree
+	root, err := t.bucketRoot(name)
+	if err != nil {
+		return err
+	}
+	mainRoot := t.rootPageID
+	t.rootPageID = root
+	err = fn(t)
+	newRoot := t.rootPageID
+	t.rootPageID = mainRoot
+	if err == nil && newRoot != root {
+		err = t.setBucketRoot(name, newRoot)
+	}
+	return err
+}
+
+// indexViolation names the index in the constraint violation err, if it is one.
+func indexViolation(err error, name string) error {
+	var violation *ConstraintViolation
+	if errors.As(err, &violation) {
+		violation.Index = name
+	}
+	return err
+}
+
+// indexEntry is the key of a row in a secondary index.
+type indexEntry struct {
+	index string
+	key   int
+}
+
+// indexEntries returns the keys of a row in the registered indexes.
+func (db *DB) indexEntries(row []byte) []indexEntry {
+	var entries []indexEntry
+	for _, idx := range db.indexes {
+		if k, ok := idx.key(row); ok {
+			entries = append(entries, indexEntry{idx.name, k})
+		}
+	}
+	return entries
+}
+
+// checkIndexes returns a *ConstraintViolation if any of the entries is already in its index.
+// offset is the offset the row would be stored at.
+func (tx *Tx) checkIndexes(entries []indexEntry, offset int64) error {
+	for _, e := range entries {
+		err := tx.inIndex(e.index, func(t *BPlusTree) error {
+			existing, found, err := t.Search(e.key)
+			if err != nil || !found {
+				return err
+			}
+			return &ConstraintViolation{Index: e.index, Key: e.key, Existing: existing, Rejected: offset}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetBy looks up the row stored under key in the named secondary index, including the changes made
+// by the transaction itself.
+func (tx *Tx) GetBy(index string, key int) (string, bool, error) {
+	if tx.done {
+		return "", false, errTxDone
+	}
+	if !slices.ContainsFunc(tx.db.indexes, func(idx secondaryIndex) bool { return idx.name == index }) {
+		return "", false, fmt.Errorf("%w: %q", ErrIndexNotFound, index)
+	}
+	var offset int64
+	var found bool
+	err := tx.inIndex(index, func(t *BPlusTree) (err error) {
+		offset, found, err = t.Search(key)
+		return err
+	})
+	if err != nil || !found {
+		return "", false, err
+	}
+	row, err := tx.row(offset)
+	return row, err == nil, err
+}
+
+// GetBy looks up the row stored under key in the named secondary index.
+func (db *DB) GetBy(index string, key int) (string, bool, error) {
+	tx := db.Begin()
+	defer tx.Rollback()
+	return tx.GetBy(index, key)
+}
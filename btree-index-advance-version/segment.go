@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// =================================================================================================
+// --- segment.go --- (Segmented Index Files)
+// =================================================================================================
+
+// A Pager keeps every page in one file, which can't grow past the file size limit of the OS or of
+// its file system, nor past the free space of one mount. A segmented index splits its pages across
+// fixed-size segment files instead, the way PostgreSQL splits a table into 1GB files. Page p is in
+// segment p / SegmentPages, at offset p % SegmentPages of it:
+//
+//	users.idx           manifest: generation 1, 262144 pages per segment, directories
+//	users.idx.g1.0000   pages 0 .. 262143
+//	users.idx.g1.0001   pages 262144 .. 524287, in the next directory if there are several
+//
+// The file at the index's path becomes a small text manifest. It holds the segment size and the
+// directories the segments go to in turn, which may be on different mounts. The segments of the
+// current generation are found by their names, so a segment is just created when a write first
+// reaches it, and the manifest only changes when the index is compacted. Every segment but the
+// last is full, so the page count follows from the last one's size.
+//
+//	pager, err := NewSegmentedPager("users.idx", SegmentOptions{SegmentPages: 1024, Dirs: []string{"/mnt/a", "/mnt/b"}})
+//	tree := NewBPlusTree(pager, 0)
+//
+// NewPager, Open and NewReadOnlyPager recognize a manifest, so once created, a segmented index is
+// opened like any other. Compaction writes the new tree to the segments of the next generation,
+// then atomically renames a new manifest naming it over the old one, and deletes the old segments.
+// The compacted tree usually needs fewer pages, so the segments past its end are dropped whole
+// instead of being truncated. A crash leaves segments of a generation the manifest doesn't name,
+// which the next writer to open the index deletes. Segmented indexes can't be encrypted, and a
+// checkpoint of one is a single file.
+
+const (
+	segmentManifestMagic = "btree-segments 1"
+	// defaultSegmentPages makes segments of 1GB, as PostgreSQL does.
+	defaultSegmentPages = 1 << 18
+)
+
+var (
+	errNotSegmented       = errors.New("index file exists and is not a segmented index")
+	errSegmentedEncrypted = errors.New("segmented index files can't be encrypted")
+)
+
+// SegmentOptions configures a new segmented index (see NewSegmentedPager).
+type SegmentOptions struct {
+	// SegmentPages is the number of pages in each segment file; 0 means 262144, or 1GB.
+	SegmentPages int64
+	// Dirs are the directories segment i goes to, Dirs[i % len(Dirs)]. None means the directory of
+	// the manifest.
+	Dirs []string
+}
+
+// NewSegmentedPager opens the segmented index whose manifest is at path, creating an empty one with
+// opts if the file doesn't exist or is empty. An existing index keeps the options it was created
+// with. The manifest is locked as NewPager locks an index file.
+func NewSegmentedPager(path string, opts SegmentOptions) (*Pager, error) {
+	if opts.SegmentPages < 0 {
+		return nil, fmt.Errorf("segment size of %d pages is negative", opts.SegmentPages)
+	}
+	if opts.SegmentPages == 0 {
+		opts.SegmentPages = defaultSegmentPages
+	}
+	return openPager(path, nil, false, &opts)
+}
+
+// segmentedFile is the pageFile of a segmented index: it maps offsets of the index to segment
+// files. Pages don't straddle segments, but a read-ahead window may.
+type segmentedFile struct {
+	path       string
+	manifest   *os.File // the locked manifest at path; nil for a generation that isn't installed yet
+	readOnly   bool
+	generation int
+	segPages   int64
+	segBytes   int64
+	dirs       []string // as the manifest lists them
+	segments   []*os.File
+
+	mu     sync.Mutex // guards segments and synced
+	synced []bool     // false for a segment written since it was last synced
+}
+
+// writeSegmentManifest writes the manifest of a generation to file.
+func writeSegmentManifest(file *os.File, generation int, segPages int64, dirs []string) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\ngeneration %d\npages %d\n", segmentManifestMagic, generation, segPages)
+	for _, dir := range dirs {
+		fmt.Fprintf(&b, "dir %s\n", dir)
+	}
+	if _, err := file.WriteAt([]byte(b.String()), 0); err != nil {
+		return err
+	}
+	if err := file.Truncate(int64(b.Len())); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// isSegmentManifest reports whether file holds a segment manifest.
+func isSegmentManifest(file *os.File) (bool, error) {
+	magic := make([]byte, len(segmentManifestMagic)+1)
+	if _, err := file.ReadAt(magic, 0); errors.Is(err, io.EOF) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return string(magic) == segmentManifestMagic+"\n", nil
+}
+
+// openSegments opens the segments named by the manifest, which the caller has locked. A writer
+// also deletes the segments of other generations, left over by a compaction that crashed.
+func openSegments(path string, manifest *os.File, readOnly bool, frameSize int64) (*segmentedFile, error) {
+	f := &segmentedFile{path: path, manifest: manifest, readOnly: readOnly}
+	scanner := bufio.NewScanner(io.NewSectionReader(manifest, 0, PageSize))
+	scanner.Scan() // the magic, already checked
+	for scanner.Scan() {
+		field, value, _ := strings.Cut(scanner.Text(), " ")
+		var err error
+		switch field {
+		case "generation":
+			f.generation, err = strconv.Atoi(value)
+		case "pages":
+			f.segPages, err = strconv.ParseInt(value, 10, 64)
+		case "dir":
+			f.dirs = append(f.dirs, value)
+		default:
+			err = fmt.Errorf("unknown field %q", field)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: segment manifest %s: %v", ErrCorruptPage, path, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if f.generation < 1 || f.segPages < 1 {
+		return nil, fmt.Errorf("%w: segment manifest %s has generation %d and %d pages per segment", ErrCorruptPage, path, f.generation, f.segPages)
+	}
+	f.segBytes = f.segPages * frameSize
+
+	flag := os.O_RDWR
+	if readOnly {
+		flag = os.O_RDONLY
+	}
+	for i := 0; ; i++ {
+		file, err := os.OpenFile(f.segmentPath(f.generation, i), flag, 0666)
+		if errors.Is(err, os.ErrNotExist) {
+			break
+		} else if err != nil {
+			f.closeSegments()
+			return nil, err
+		}
+		f.segments = append(f.segments, file)
+		f.synced = append(f.synced, true)
+	}
+	// Every segment but the last is full, or the page IDs after it would shift.
+	for i, file := range f.segments[:max(len(f.segments)-1, 0)] {
+		if stat, err := file.Stat(); err != nil || stat.Size() != f.segBytes {
+			f.closeSegments()
+			if err != nil {
+				return nil, err
+			}
+			return nil, fmt.Errorf("%w: segment %d of %s has %d bytes, want %d", ErrCorruptPage, i, path, stat.Size(), f.segBytes)
+		}
+	}
+	if !readOnly {
+		f.removeOtherGenerations()
+	}
+	return f, nil
+}
+
+// segmentPath returns the path of segment i of a generation.
+func (f *segmentedFile) segmentPath(generation, i int) string {
+	dir := filepath.Dir(f.path)
+	if len(f.dirs) > 0 {
+		dir = f.dirs[i%len(f.dirs)]
+	}
+	return filepath.Join(dir, fmt.Sprintf("%s.g%d.%04d", filepath.Base(f.path), generation, i))
+}
+
+// removeOtherGenerations deletes the segments in the index's directories that don't belong to its
+// generation. Errors are ignored: the files are only garbage.
+func (f *segmentedFile) removeOtherGenerations() {
+	dirs := f.dirs
+	if len(dirs) == 0 {
+		dirs = []string{filepath.Dir(f.path)}
+	}
+	prefix := filepath.Base(f.path) + ".g"
+	current := fmt.Sprintf("%s%d.", prefix, f.generation)
+	for _, dir := range dirs {
+		matches, _ := filepath.Glob(filepath.Join(dir, prefix+"*.*"))
+		for _, match := range matches {
+			if !strings.HasPrefix(filepath.Base(match), current) {
+				os.Remove(match)
+			}
+		}
+	}
+}
+
+// size returns the size of the index: the full segments and the last one.
+func (f *segmentedFile) size() (int64, error) {
+	if len(f.segments) == 0 {
+		return 0, nil
+	}
+	stat, err := f.segments[len(f.segments)-1].Stat()
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(f.segments)-1)*f.segBytes + stat.Size(), nil
+}
+
+// segment returns segment i, creating it and the ones before it if write is set. The segments
+// before a new one are extended to their full size, as the page IDs in the new one rely on it.
+// It returns nil for a segment past the end when reading.
+func (f *segmentedFile) segment(i int, write bool) (*os.File, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for len(f.segments) <= i {
+		if !write {
+			return nil, nil
+		}
+		if f.readOnly {
+			return nil, ErrReadOnly
+		}
+		if n := len(f.segments); n > 0 {
+			if err := f.segments[n-1].Truncate(f.segBytes); err != nil {
+				return nil, err
+			}
+			f.synced[n-1] = false
+		}
+		file, err := os.OpenFile(f.segmentPath(f.generation, len(f.segments)), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+		if err != nil {
+			return nil, err
+		}
+		f.segments = append(f.segments, file)
+		f.synced = append(f.synced, false)
+	}
+	if write {
+		f.synced[i] = false
+	}
+	return f.segments[i], nil
+}
+
+// ReadAt reads len(b) bytes at offset off of the index, from as many segments as they span.
+func (f *segmentedFile) ReadAt(b []byte, off int64) (int, error) {
+	n := 0
+	for n < len(b) {
+		pos := off + int64(n)
+		segment, err := f.segment(int(pos/f.segBytes), false)
+		if err != nil {
+			return n, err
+		}
+		if segment == nil {
+			return n, io.EOF
+		}
+		chunk := b[n:min(len(b), n+int(f.segBytes-pos%f.segBytes))]
+		m, err := segment.ReadAt(chunk, pos%f.segBytes)
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Truncate cuts the index down to size bytes, which must end in its last segment.
+func (f *segmentedFile) Truncate(size int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	last := len(f.segments) - 1
+	if last < 0 || size < int64(last)*f.segBytes {
+		return fmt.Errorf("truncating %s to %d bytes: only its last segment can be cut", f.path, size)
+	}
+	f.synced[last] = false
+	return f.segments[last].Truncate(size - int64(last)*f.segBytes)
+}
+
+// WriteAt writes b at offset off of the index, creating the segments it reaches.
+func (f *segmentedFile) WriteAt(b []byte, off int64) (int, error) {
+	n := 0
+	for n < len(b) {
+		pos := off + int64(n)
+		segment, err := f.segment(int(pos/f.segBytes), true)
+		if err != nil {
+			return n, err
+		}
+		chunk := b[n:min(len(b), n+int(f.segBytes-pos%f.segBytes))]
+		m, err := segment.WriteAt(chunk, pos%f.segBytes)
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Sync syncs the segments written since they were last synced.
+func (f *segmentedFile) Sync() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, segment := range f.segments {
+		if !f.synced[i] {
+			if err := segment.Sync(); err != nil {
+				return err
+			}
+			f.synced[i] = true
+		}
+	}
+	return nil
+}
+
+// Name returns the path of the manifest.
+func (f *segmentedFile) Name() string {
+	return f.path
+}
+
+func (f *segmentedFile) closeSegments() error {
+	var errs []error
+	for _, segment := range f.segments {
+		errs = append(errs, segment.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// Close closes the segments and the manifest, which releases the lock.
+func (f *segmentedFile) Close() error {
+	err := f.closeSegments()
+	if f.manifest != nil {
+		err = errors.Join(err, f.manifest.Close())
+	}
+	return err
+}
+
+// nextGeneration returns an empty index of the next generation, with the same segment size and
+// directories, for Compact to write to. It doesn't replace f until installed by replaceSegments.
+func (f *segmentedFile) nextGeneration() *segmentedFile {
+	return &segmentedFile{path: f.path, generation: f.generation + 1, segPages: f.segPages, segBytes: f.segBytes, dirs: f.dirs}
+}
+
+// remove closes the segments of a generation that was never installed and deletes them.
+func (f *segmentedFile) remove() {
+	f.closeSegments()
+	for i := range f.segments {
+		os.Remove(f.segmentPath(f.generation, i))
+	}
+}
+
+// replaceSegments installs next, a later generation of the pager's segmented file, in its place:
+// it renames a manifest naming next over the old one, and deletes the old segments.
+func (p *Pager) replaceSegments(next *segmentedFile) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.snapshot != nil {
+		return errCheckpointRunning
+	}
+	old := p.file.(*segmentedFile)
+	size, err := next.size()
+	if err != nil {
+		return err
+	}
+	tmpPath := p.path + ".tmp"
+	manifest, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	// The lock was on the old manifest; nobody else can know the new one yet.
+	err = lockFile(manifest, true)
+	if err == nil {
+		err = writeSegmentManifest(manifest, next.generation, next.segPages, next.dirs)
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, p.path)
+	}
+	if err != nil {
+		manifest.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	next.manifest = manifest
+	old.Close()
+	p.file = next
+	next.removeOtherGenerations()
+	p.fileSize = size
+	p.numPages = size / p.cipher.frameSize()
+	p.dirty = make(map[PageID]struct{})
+	p.checkpointed = false
+	p.readAhead.window = p.readAhead.window[:0]
+	return nil
+}
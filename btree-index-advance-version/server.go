@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// =================================================================================================
+// --- server.go --- (HTTP Server)
+// =================================================================================================
+
+// `go run . serve` serves a DB over HTTP:
+//
+//	GET    /keys/{k}               the row stored under key k
+//	GET    /range?start=a&end=b    the rows of the keys in [a, b], in key order
+//	PUT    /keys/{k}               store the request body as the row of key k
+//	DELETE /keys/{k}               remove key k
+//	GET    /backup                 a backup of the DB (see backup.go), taken while writes go on
+//	GET    /changes?from=n         the changes committed after LSN n, as JSON Lines (see cdc.go)
+//	GET    /metrics                the DB's metrics in the Prometheus text format (see metrics.go)
+//
+// Rows are returned as JSON objects {"key": k, "row": "..."}. net/http runs every request in a
+// goroutine of its own, and each handler runs one transaction, so concurrent requests are
+// serialized by the DB's transaction lock and a reader never sees half of a write. On SIGINT or
+// SIGTERM the server stops accepting connections, ends the streams of changes, waits for the
+// requests in flight, and closes the DB, which flushes the buffer pool.
+
+// maxRowSize limits the request body of a PUT.
+const maxRowSize = 1 << 20
+
+// archiveInterval is how often the log is archived by `serve -archive`.
+const archiveInterval = 10 * time.Second
+
+// shutdownTimeout is how long the server waits for requests in flight when it is stopped.
+const shutdownTimeout = 10 * time.Second
+
+// keyRow is a row as the server returns it.
+type keyRow struct {
+	Key int    `json:"key"`
+	Row string `json:"row"`
+}
+
+// indexServer handles the HTTP requests for a DB.
+type indexServer struct {
+	db *DB
+}
+
+// newIndexHandler returns the handler of the HTTP API, and installs the metrics it serves on db. A
+// read-only handler, as served by a replica, answers PUT and DELETE requests with 405 Method Not
+// Allowed, and doesn't serve /changes: a replica's log has no change records.
+func newIndexHandler(db *DB, readOnly bool) http.Handler {
+	s := &indexServer{db: db}
+	metrics := NewPrometheusMetrics()
+	db.SetMetrics(metrics)
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /keys/{key}", s.get)
+	mux.HandleFunc("GET /range", s.scan)
+	mux.HandleFunc("GET /backup", s.backup)
+	mux.Handle("GET /metrics", metrics)
+	if !readOnly {
+		mux.HandleFunc("GET /changes", s.changes)
+		mux.HandleFunc("PUT /keys/{key}", s.put)
+		mux.HandleFunc("DELETE /keys/{key}", s.delete)
+	}
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// pathKey parses the {key} path parameter, writing a 400 response if it isn't an int.
+func pathKey(w http.ResponseWriter, r *http.Request) (int, bool) {
+	key, err := strconv.Atoi(r.PathValue("key"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("key %q is not an int", r.PathValue("key")))
+		return 0, false
+	}
+	return key, true
+}
+
+// putRow stores row under key in a transaction of its own and reports whether the key is new. The
+// old row is deleted in the same transaction, so readers never see the key missing.
+func putRow(db *DB, key int, row []byte) (bool, error) {
+	tx := db.Begin()
+	existed, err := tx.Delete(key)
+	if err == nil {
+		err = tx.Insert(key, row)
+	}
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	return !existed, tx.Commit()
+}
+
+// deleteRow deletes key in a transaction of its own and reports whether it was there.
+func deleteRow(db *DB, key int) (bool, error) {
+	tx := db.Begin()
+	deleted, err := tx.Delete(key)
+	if err != nil || !deleted {
+		tx.Rollback()
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+func (s *indexServer) get(w http.ResponseWriter, r *http.Request) {
+	key, ok := pathKey(w, r)
+	if !ok {
+		return
+	}
+	row, found, err := s.db.Get(key)
+	switch {
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, err)
+	case !found:
+		writeError(w, http.StatusNotFound, fmt.Errorf("%w: %d", ErrKeyNotFound, key))
+	default:
+		writeJSON(w, http.StatusOK, keyRow{key, row})
+	}
+}
+
+// put replaces the row of the key, or adds it. It responds 201 if the key is new and 200 if it
+// replaced a row.
+func (s *indexServer) put(w http.ResponseWriter, r *http.Request) {
+	key, ok := pathKey(w, r)
+	if !ok {
+		return
+	}
+	row, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRowSize))
+	if err != nil {
+		writeError(w, http.StatusRequestEntityTooLarge, err)
+		return
+	}
+	created, err := putRow(s.db, key, row)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, errRowHasNewline) || errors.Is(err, errRowTooLarge) {
+			status = http.StatusBadRequest
+		}
+		writeError(w, status, err)
+		return
+	}
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	writeJSON(w, status, keyRow{key, string(row)})
+}
+
+func (s *indexServer) delete(w http.ResponseWriter, r *http.Request) {
+	key, ok := pathKey(w, r)
+	if !ok {
+		return
+	}
+	deleted, err := deleteRow(s.db, key)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if !deleted {
+		writeError(w, http.StatusNotFound, fmt.Errorf("%w: %d", ErrKeyNotFound, key))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *indexServer) scan(w http.ResponseWriter, r *http.Request) {
+	var bounds [2]int
+	for i, name := range []string{"start", "end"} {
+		value, err := strconv.Atoi(r.URL.Query().Get(name))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("query parameter %q must be an int", name))
+			return
+		}
+		bounds[i] = value
+	}
+	tx := s.db.Begin()
+	defer tx.Rollback()
+	rows := []keyRow{}
+	err := tx.Scan(bounds[0], bounds[1], func(key int, row string) error {
+		rows = append(rows, keyRow{key, row})
+		return nil
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, rows)
+}
+
+// backup streams a backup of the DB. Once the backup has started, an error can only be reported
+// by cutting the response short.
+func (s *indexServer) backup(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if _, err := s.db.Backup(w); err != nil {
+		log.Printf("backup: %v", err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// changes streams the change events committed after the LSN in the from query parameter, or from
+// the start of the log, one JSON object per line, until the client goes away. Like a backup, it
+// can only report an error by cutting the response short.
+func (s *indexServer) changes(w http.ResponseWriter, r *http.Request) {
+	var from uint64
+	if value := r.URL.Query().Get("from"); value != "" {
+		var err error
+		if from, err = strconv.ParseUint(value, 10, 64); err != nil {
+			writeError(w, http.StatusBadRequest, errors.New(`query parameter "from" must be an LSN`))
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/jsonl")
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+	encoder := json.NewEncoder(w)
+	err := s.db.Subscribe(r.Context(), from, func(e ChangeEvent) error {
+		if err := encoder.Encode(e); err != nil {
+			return err
+		}
+		return rc.Flush()
+	})
+	if err != nil && r.Context().Err() == nil {
+		log.Printf("changes: %v", err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// serveCommand implements `go run . serve [-addr :8080] [-grpc :9090] [-replication :7070]
+// [-archive dir] [-db path]`. The DB is kept in path.idx, path.dat and path.wal. With -grpc, the
+// gRPC service (see grpc.go) is served too, and with -replication the log is shipped to replicas
+// (see replication.go). With -archive, a base backup is taken at startup and the log is archived
+// every archiveInterval and at shutdown (see pitr.go).
+func serveCommand(args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := flags.String("addr", ":8080", "address to listen on")
+	grpcAddr := flags.String("grpc", "", "address to serve the gRPC service on (none if empty)")
+	replicationAddr := flags.String("replication", "", "address to ship the log to replicas on (none if empty)")
+	archiveDir := flags.String("archive", "", "directory to archive base backups and the log in (none if empty)")
+	path := flags.String("db", "server", "path of the DB files, without extension")
+	degree := flags.Int("degree", 0, "degree of a new index (0 means MaxDegree)")
+	flags.Parse(args)
+
+	db, err := OpenDB(*path+".idx", *path+".dat", *path+".wal", *degree)
+	if err != nil {
+		return err
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	// Requests see ctx done at shutdown, which ends the streams of changes.
+	servers := []*http.Server{{Addr: *addr, Handler: newIndexHandler(db, false),
+		BaseContext: func(net.Listener) context.Context { return ctx }}}
+	if *grpcAddr != "" {
+		// gRPC needs HTTP/2, and its clients connect without TLS by default.
+		var protocols http.Protocols
+		protocols.SetUnencryptedHTTP2(true)
+		servers = append(servers, &http.Server{Addr: *grpcAddr, Handler: newGRPCHandler(db), Protocols: &protocols})
+	}
+
+	if *replicationAddr != "" {
+		listener, err := net.Listen("tcp", *replicationAddr)
+		if err != nil {
+			db.Close()
+			return err
+		}
+		log.Printf("shipping the log to replicas on %s", *replicationAddr)
+		go func() {
+			if err := db.ServeReplication(ctx, listener); err != nil {
+				log.Printf("replication: %v", err)
+			}
+		}()
+	}
+	if *archiveDir != "" {
+		if err := startArchiving(ctx, db, *archiveDir); err != nil {
+			db.Close()
+			return err
+		}
+	}
+	log.Printf("serving %s.idx", *path)
+	err = serveUntilDone(ctx, servers)
+	if *archiveDir != "" {
+		_, archiveErr := db.ArchiveWAL(*archiveDir)
+		err = errors.Join(err, archiveErr)
+	}
+	return errors.Join(err, db.Close())
+}
+
+// startArchiving takes a base backup of db in dir and archives its log every archiveInterval
+// until ctx is done.
+func startArchiving(ctx context.Context, db *DB, dir string) error {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+	lsn, err := db.BaseBackup(dir)
+	if err != nil {
+		return err
+	}
+	log.Printf("archiving to %s, base backup at LSN %d", dir, lsn)
+	go func() {
+		ticker := time.NewTicker(archiveInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if _, err := db.ArchiveWAL(dir); err != nil {
+					log.Printf("archiving the log: %v", err)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// serveUntilDone runs the servers until ctx is done or one of them fails, and then shuts them all
+// down, waiting up to shutdownTimeout for the requests in flight.
+func serveUntilDone(ctx context.Context, servers []*http.Server) error {
+	serveErr := make(chan error, len(servers))
+	for _, server := range servers {
+		go func() { serveErr <- server.ListenAndServe() }()
+		log.Printf("listening on %s", server.Addr)
+	}
+
+	var errs []error
+	select {
+	case err := <-serveErr:
+		errs = append(errs, err)
+	case <-ctx.Done():
+	}
+	log.Printf("shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	for _, server := range servers {
+		errs = append(errs, server.Shutdown(shutdownCtx))
+	}
+	return errors.Join(errs...)
+}
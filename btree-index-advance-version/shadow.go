@@ -0,0 +1,490 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"maps"
+	"os"
+	"slices"
+	"sync"
+)
+
+// =================================================================================================
+// --- shadow.go --- (Shadow Paging)
+// =================================================================================================
+
+// A DB makes its transactions durable with a write-ahead log: every changed page is written twice,
+// once to the log before the commit and once to the index file later, and recovery replays the
+// log. Shadow paging, the technique of System R, writes every page once and has nothing to replay.
+// The tree's page IDs become logical, and a page table maps each one to the physical page of the
+// file that holds it:
+//
+//	meta page ──▶ page table pages ──▶ physical pages
+//	              logical 0 ─▶ 7
+//	              logical 1 ─▶ 3
+//
+// A transaction never overwrites a page of the committed version. The first time it writes a
+// logical page, the page goes to a free physical page instead, and the transaction's own copy of
+// the table, the shadow, points there. Commit writes the page table pages that changed to free
+// pages too, syncs, and then writes the meta page naming them, like the copy-on-write tree does
+// with its root (cow.go): pages 0 and 1 are both meta pages, a commit overwrites the older one, and
+// opening the file picks the valid one with the highest transaction ID. Until the meta page is on
+// disk, the previous version is intact, so a crash loses the transaction and nothing else, and
+// rolling back just forgets the shadow.
+//
+// Unlike the copy-on-write tree, the B+ tree itself doesn't change: ShadowPager is a PageStore, and
+// the tree on top of it overwrites its pages in place as usual. The indirection is what turns those
+// writes into copies. The physical pages a commit replaces are reused by later transactions. The
+// price is the page table, which a commit rewrites a page of for every 508 logical pages it touches
+// there, and that logically consecutive pages end up scattered across the file.
+//
+//	st, err := OpenShadowTree("users_shadow.idx", 0)
+//	err = st.Update(func(tree *BPlusTree) error {
+//		return tree.Insert(42, 4200) // durable once Update returns nil
+//	})
+//
+// `go run . bench` compares the two techniques in its Durability lines.
+
+const (
+	NodeTypeShadowMeta = 13
+	NodeTypePageTable  = 14
+)
+
+const (
+	shadowMagic = 0x53484450 // "SHDP"
+	// shadowMetaPages is the number of meta pages at the start of the file.
+	shadowMetaPages = 2
+	// shadowMetaFixedSize is the size of the fields of a meta page before its list of page table
+	// pages: magic, checksum, transaction ID, logical page count and page table page count.
+	shadowMetaFixedSize = 32
+	// pageTableEntries is the number of logical pages whose physical page one page table page holds.
+	pageTableEntries = (PageSize - headerSize) / 8
+	// shadowMaxTablePages is the number of page table pages a meta page can list, which limits a
+	// shadow-paged file to 504 * 508 logical pages, about 1GB.
+	shadowMaxTablePages = (PageSize - headerSize - shadowMetaFixedSize) / 8
+)
+
+var errShadowFileFull = errors.New("shadow-paged file has more pages than its page table can map")
+
+// ShadowPager is a PageStore that makes the writes since the last Commit durable all at once, by
+// shadow paging. Page IDs passed to it are logical; the file stores the pages wherever its page
+// table says.
+type ShadowPager struct {
+	mu     sync.Mutex
+	file   *os.File
+	closed bool
+
+	// The committed version.
+	txid       uint64
+	table      []PageID // physical page of each logical page, -1 if it hasn't been written
+	tablePages []PageID // physical pages holding table
+
+	// The open transaction.
+	numPages int64             // logical pages, including those allocated since the last commit
+	shadow   map[PageID]PageID // logical pages written since the last commit, to their new physical page
+
+	free      []PageID // physical pages that neither the committed version nor the transaction uses
+	filePages PageID   // physical pages in the file
+}
+
+// OpenShadowPager opens the shadow-paged file at path, creating an empty one if it doesn't exist.
+func OpenShadowPager(path string) (*ShadowPager, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(file, true); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("opening %s: %w", path, err)
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	s := &ShadowPager{file: file, shadow: make(map[PageID]PageID), filePages: PageID(stat.Size() / PageSize)}
+	if stat.Size() == 0 {
+		err = s.create()
+	} else {
+		err = s.load()
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// create initializes an empty file: two meta pages of transaction 0 and an empty page table.
+func (s *ShadowPager) create() error {
+	for metaPageID := PageID(0); metaPageID < shadowMetaPages; metaPageID++ {
+		if err := s.writePhysical(metaPageID, s.encodeMeta(0, 0, nil)); err != nil {
+			return err
+		}
+	}
+	s.filePages = shadowMetaPages
+	return s.file.Sync()
+}
+
+// load reads the committed version from the newest valid meta page, and finds the free pages.
+func (s *ShadowPager) load() error {
+	var best *Page
+	var bestTxID uint64
+	for metaPageID := PageID(0); metaPageID < shadowMetaPages; metaPageID++ {
+		page, err := s.readPhysical(metaPageID, new(Page))
+		if err != nil {
+			return err
+		}
+		if txid, ok := decodeShadowMeta(page); ok && (best == nil || txid > bestTxID) {
+			best, bestTxID = page, txid
+		}
+	}
+	if best == nil {
+		return fmt.Errorf("%w: neither meta page of the shadow-paged file is valid", ErrCorruptPage)
+	}
+
+	body := best[headerSize:]
+	s.txid = bestTxID
+	s.numPages = int64(binary.LittleEndian.Uint64(body[16:]))
+	numTablePages := int(binary.LittleEndian.Uint64(body[24:]))
+	used := make([]bool, s.filePages)
+	used[0], used[1] = true, true
+	markUsed := func(pageID PageID) error {
+		if pageID < shadowMetaPages || pageID >= s.filePages {
+			return fmt.Errorf("%w: shadow page table refers to page %d of %d", ErrCorruptPage, pageID, s.filePages)
+		}
+		used[pageID] = true
+		return nil
+	}
+	s.table = make([]PageID, 0, s.numPages)
+	for i := range numTablePages {
+		tablePageID := PageID(binary.LittleEndian.Uint64(body[shadowMetaFixedSize+8*i:]))
+		if err := markUsed(tablePageID); err != nil {
+			return err
+		}
+		page, err := s.readPhysical(tablePageID, new(Page))
+		if err != nil {
+			return err
+		}
+		if page[nodeTypeOffset] != NodeTypePageTable {
+			return fmt.Errorf("%w: page %d is not a page table page", ErrCorruptPage, tablePageID)
+		}
+		s.tablePages = append(s.tablePages, tablePageID)
+		for j := range int(getNumKeys(page)) {
+			pageID := PageID(int64(binary.LittleEndian.Uint64(page[headerSize+8*j:])))
+			if pageID != -1 {
+				if err := markUsed(pageID); err != nil {
+					return err
+				}
+			}
+			s.table = append(s.table, pageID)
+		}
+	}
+	if int64(len(s.table)) != s.numPages {
+		return fmt.Errorf("%w: shadow page table maps %d pages, want %d", ErrCorruptPage, len(s.table), s.numPages)
+	}
+	// Pages of older versions, and of a transaction that never committed, are free.
+	for pageID := s.filePages - 1; pageID >= shadowMetaPages; pageID-- {
+		if !used[pageID] {
+			s.free = append(s.free, pageID)
+		}
+	}
+	return nil
+}
+
+// encodeMeta encodes the meta page of a version.
+func (s *ShadowPager) encodeMeta(txid uint64, numPages int64, tablePages []PageID) *Page {
+	page := new(Page)
+	page[nodeTypeOffset] = NodeTypeShadowMeta
+	setParentPageID(page, -1)
+	setNextLeafPageID(page, -1)
+	body := page[headerSize:]
+	binary.LittleEndian.PutUint32(body[0:], shadowMagic)
+	binary.LittleEndian.PutUint64(body[8:], txid)
+	binary.LittleEndian.PutUint64(body[16:], uint64(numPages))
+	binary.LittleEndian.PutUint64(body[24:], uint64(len(tablePages)))
+	for i, pageID := range tablePages {
+		binary.LittleEndian.PutUint64(body[shadowMetaFixedSize+8*i:], uint64(pageID))
+	}
+	end := shadowMetaFixedSize + 8*len(tablePages)
+	binary.LittleEndian.PutUint32(body[4:], crc32.ChecksumIEEE(body[8:end]))
+	return page
+}
+
+// decodeShadowMeta returns the transaction ID of a meta page, and false if it isn't a valid meta
+// page.
+func decodeShadowMeta(page *Page) (uint64, bool) {
+	body := page[headerSize:]
+	if page[nodeTypeOffset] != NodeTypeShadowMeta || binary.LittleEndian.Uint32(body[0:]) != shadowMagic {
+		return 0, false
+	}
+	numTablePages := binary.LittleEndian.Uint64(body[24:])
+	if numTablePages > shadowMaxTablePages {
+		return 0, false
+	}
+	end := shadowMetaFixedSize + 8*int(numTablePages)
+	if binary.LittleEndian.Uint32(body[4:]) != crc32.ChecksumIEEE(body[8:end]) {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint64(body[8:]), true
+}
+
+// encodePageTable encodes the entries of one page table page.
+func encodePageTable(entries []PageID) *Page {
+	page := new(Page)
+	page[nodeTypeOffset] = NodeTypePageTable
+	setParentPageID(page, -1)
+	setNextLeafPageID(page, -1)
+	setNumKeys(page, uint16(len(entries)))
+	for i, pageID := range entries {
+		binary.LittleEndian.PutUint64(page[headerSize+8*i:], uint64(pageID))
+	}
+	return page
+}
+
+func (s *ShadowPager) readPhysical(pageID PageID, pageData *Page) (*Page, error) {
+	_, err := s.file.ReadAt(pageData[:], int64(pageID)*PageSize)
+	return pageData, err
+}
+
+func (s *ShadowPager) writePhysical(pageID PageID, pageData *Page) error {
+	_, err := s.file.WriteAt(pageData[:], int64(pageID)*PageSize)
+	return err
+}
+
+// allocatePhysical returns a free physical page, growing the file if there is none. The caller
+// must hold s.mu.
+func (s *ShadowPager) allocatePhysical() PageID {
+	if n := len(s.free); n > 0 {
+		pageID := s.free[n-1]
+		s.free = s.free[:n-1]
+		return pageID
+	}
+	s.filePages++
+	return s.filePages - 1
+}
+
+// physical returns the physical page holding a logical page in the open transaction, and false if
+// the logical page hasn't been written. The caller must hold s.mu.
+func (s *ShadowPager) physical(pageID PageID) (PageID, bool) {
+	if physical, ok := s.shadow[pageID]; ok {
+		return physical, true
+	}
+	if pageID >= 0 && int(pageID) < len(s.table) && s.table[pageID] != -1 {
+		return s.table[pageID], true
+	}
+	return -1, false
+}
+
+// ReadPage reads a logical page, as the open transaction has left it.
+func (s *ShadowPager) ReadPage(pageID PageID, pageData *Page) (*Page, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return pageData, ErrTreeClosed
+	}
+	physical, ok := s.physical(pageID)
+	if !ok {
+		return pageData, fmt.Errorf("%w: read of unwritten page %d (%d pages)", ErrPageOutOfRange, pageID, s.numPages)
+	}
+	return s.readPhysical(physical, pageData)
+}
+
+// WritePage writes a logical page. The first write of a page since the last commit moves it to a
+// free physical page; the committed version of the page stays where it is. Nothing is synced
+// until Commit.
+func (s *ShadowPager) WritePage(pageID PageID, pageData *Page) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrTreeClosed
+	}
+	physical, ok := s.shadow[pageID]
+	if !ok {
+		physical = s.allocatePhysical()
+		s.shadow[pageID] = physical
+	}
+	s.numPages = max(s.numPages, int64(pageID)+1)
+	return s.writePhysical(physical, pageData)
+}
+
+func (s *ShadowPager) AllocatePage() PageID {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.numPages++
+	return PageID(s.numPages - 1)
+}
+
+func (s *ShadowPager) NumPages() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.numPages
+}
+
+// Commit makes every write since the last commit durable: it writes the page table pages that
+// changed, syncs the file, and then writes and syncs the meta page naming them. If it fails, the
+// committed version is unchanged and the writes are still pending.
+func (s *ShadowPager) Commit() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrTreeClosed
+	}
+	if len(s.shadow) == 0 && s.numPages == int64(len(s.table)) {
+		return nil
+	}
+	numTablePages := (int(s.numPages) + pageTableEntries - 1) / pageTableEntries
+	if numTablePages > shadowMaxTablePages {
+		return errShadowFileFull
+	}
+
+	table := slices.Clone(s.table)
+	for len(table) < int(s.numPages) {
+		table = append(table, -1)
+	}
+	changed := make(map[int]bool) // indexes of the page table pages to rewrite
+	for i := len(s.tablePages); i < numTablePages; i++ {
+		changed[i] = true
+	}
+	for pageID, physical := range s.shadow {
+		table[pageID] = physical
+		changed[int(pageID)/pageTableEntries] = true
+	}
+
+	tablePages := slices.Clone(s.tablePages)
+	tablePages = append(tablePages, make([]PageID, numTablePages-len(tablePages))...)
+	var written []PageID
+	err := func() error {
+		for _, i := range slices.Sorted(maps.Keys(changed)) {
+			physical := s.allocatePhysical()
+			written = append(written, physical)
+			tablePages[i] = physical
+			entries := table[i*pageTableEntries : min((i+1)*pageTableEntries, len(table))]
+			if err := s.writePhysical(physical, encodePageTable(entries)); err != nil {
+				return err
+			}
+		}
+		// The pages and the page table must be on disk before the meta page that points to them.
+		if err := s.file.Sync(); err != nil {
+			return err
+		}
+		txid := s.txid + 1
+		if err := s.writePhysical(PageID(txid%shadowMetaPages), s.encodeMeta(txid, s.numPages, tablePages)); err != nil {
+			return err
+		}
+		return s.file.Sync()
+	}()
+	if err != nil {
+		s.free = append(s.free, written...)
+		return err
+	}
+
+	// The pages of the previous version that were replaced can be reused: the meta page of the
+	// version before it is the next one to be overwritten, so nothing will ever read them again.
+	for pageID := range s.shadow {
+		if int(pageID) < len(s.table) && s.table[pageID] != -1 {
+			s.free = append(s.free, s.table[pageID])
+		}
+	}
+	for i := range changed {
+		if i < len(s.tablePages) {
+			s.free = append(s.free, s.tablePages[i])
+		}
+	}
+	s.txid++
+	s.table, s.tablePages = table, tablePages
+	clear(s.shadow)
+	return nil
+}
+
+// Rollback discards every write since the last commit.
+func (s *ShadowPager) Rollback() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, physical := range s.shadow {
+		s.free = append(s.free, physical)
+	}
+	clear(s.shadow)
+	s.numPages = int64(len(s.table))
+}
+
+// TxID returns the ID of the last committed transaction, 0 for a new file.
+func (s *ShadowPager) TxID() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.txid
+}
+
+// Close closes the file. Writes since the last commit are lost, as in a crash.
+func (s *ShadowPager) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	return s.file.Close()
+}
+
+// ShadowTree is a B+ tree stored in a shadow-paged file, whose writes are made durable by Update.
+type ShadowTree struct {
+	mu    sync.Mutex // held by the running Update
+	pager *ShadowPager
+	tree  *BPlusTree
+}
+
+// OpenShadowTree opens the shadow-paged tree at path, creating an empty one if the file doesn't
+// exist. A degree of 0 means MaxDegree.
+func OpenShadowTree(path string, degree int) (*ShadowTree, error) {
+	pager, err := OpenShadowPager(path)
+	if err != nil {
+		return nil, err
+	}
+	// A new tree writes its empty root, which is committed straight away.
+	tree := NewBPlusTree(pager, degree)
+	if err := pager.Commit(); err != nil {
+		pager.Close()
+		return nil, err
+	}
+	return &ShadowTree{pager: pager, tree: tree}, nil
+}
+
+// Update runs fn on the tree and commits its writes if it returns nil. Otherwise, or if the commit
+// fails, the writes are discarded and the tree is as it was before. Only one Update runs at a time.
+func (st *ShadowTree) Update(fn func(tree *BPlusTree) error) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	t := st.tree
+	rootPageID, metaPageID, catalogPageID := t.rootPageID, t.metaPageID, t.catalogPageID
+	err := fn(t)
+	if err == nil {
+		if err = t.pool.Flush(); err == nil {
+			err = st.pager.Commit()
+		}
+	}
+	if err != nil {
+		st.pager.Rollback()
+		t.pool.reset()
+		t.rootPageID, t.metaPageID, t.catalogPageID = rootPageID, metaPageID, catalogPageID
+	}
+	return err
+}
+
+// Tree returns the tree, for reading. Writes must go through Update.
+func (st *ShadowTree) Tree() *BPlusTree {
+	return st.tree
+}
+
+// Pager returns the shadow-paged file under the tree.
+func (st *ShadowTree) Pager() *ShadowPager {
+	return st.pager
+}
+
+// Close closes the file. It waits for the running Update, if any, to finish.
+func (st *ShadowTree) Close() error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.pager.Close()
+}
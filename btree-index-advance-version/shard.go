@@ -0,0 +1,251 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+)
+
+// =================================================================================================
+// --- shard.go --- (Sharding with Consistent Hashing or Key Ranges)
+// =================================================================================================
+
+// One index on one machine only grows so far. A distributed database spreads its keys over
+// shards, each an independent index, and routes every operation to the shard that owns the key.
+// ShardedIndex does the routing for a set of trees, with the same Insert, Search, SearchRange and
+// Delete as a single tree, and a Partitioner decides which shard owns which key. There are two:
+//
+// HashRing places every shard at many pseudo-random points of a ring of hash values, its virtual
+// nodes, and gives a key to the first point at or after the key's hash, going around:
+//
+//	      shard 0      shard 1
+//	    ───●────────────●──────●──────●──── ▶ wraps around
+//	         ▲ hash(42)        shard 2  shard 0
+//
+// Keys spread evenly, whatever their distribution, and adding a shard only moves the keys of the
+// ring segments its new points take over, about 1/n of them, where hash(key) % n would move almost
+// all. The price is that key order is lost: a range scan asks every shard.
+//
+// RangePartitioner gives each shard a contiguous range of keys, cut at boundaries. A range scan
+// asks only the shards whose ranges overlap it, but the keys must be spread evenly by hand;
+// SplitAt (see splitindex.go) cuts a shard that grew too large.
+//
+//	index, err := NewShardedIndex(trees, NewHashRing(len(trees), 0))
+//	err = index.Insert(42, 4200)
+//	offsets, err := index.SearchRange(1, 100) // scans the shards in parallel
+//
+// A range scan reads the shards it asks from one goroutine each and merges their results in key
+// order. Like a tree, a ShardedIndex must not be used by several goroutines at once.
+
+// defaultVirtualNodes is the number of points per shard on a HashRing. With 100 points per shard,
+// each shard's share of the keys is within about 15% of the average.
+const defaultVirtualNodes = 100
+
+var errPartitionMismatch = errors.New("partitioner and shards disagree on the number of shards")
+
+// Partitioner decides which shard owns a key.
+type Partitioner interface {
+	// NumShards returns the number of shards keys are spread over, numbered from 0.
+	NumShards() int
+	// Shard returns the shard that owns key.
+	Shard(key int) int
+	// ShardsFor returns the shards that may own keys in [start, end].
+	ShardsFor(start, end int) []int
+}
+
+// ringPoint is a virtual node of a HashRing.
+type ringPoint struct {
+	hash  uint64
+	shard int
+}
+
+// HashRing is a Partitioner that spreads keys over shards by consistent hashing.
+type HashRing struct {
+	numShards int
+	points    []ringPoint // sorted by hash
+}
+
+// NewHashRing returns a ring of numShards shards with virtualNodes points each; 0 means
+// defaultVirtualNodes. A ring of more shards keeps the points of the shards it has in common with a
+// smaller one, so a key only ever moves to a new shard.
+func NewHashRing(numShards, virtualNodes int) *HashRing {
+	if virtualNodes <= 0 {
+		virtualNodes = defaultVirtualNodes
+	}
+	r := &HashRing{numShards: numShards, points: make([]ringPoint, 0, numShards*virtualNodes)}
+	for shard := range numShards {
+		for v := range virtualNodes {
+			// Negative inputs keep the points apart from the hashes of small keys.
+			r.points = append(r.points, ringPoint{hashKey(-1 - (shard<<20 | v)), shard})
+		}
+	}
+	slices.SortFunc(r.points, func(a, b ringPoint) int { return cmp.Compare(a.hash, b.hash) })
+	return r
+}
+
+func (r *HashRing) NumShards() int {
+	return r.numShards
+}
+
+func (r *HashRing) Shard(key int) int {
+	h := hashKey(key)
+	i, _ := slices.BinarySearchFunc(r.points, h, func(p ringPoint, h uint64) int { return cmp.Compare(p.hash, h) })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].shard
+}
+
+// ShardsFor returns every shard: hashing scatters any range over all of them.
+func (r *HashRing) ShardsFor(start, end int) []int {
+	shards := make([]int, r.numShards)
+	for i := range shards {
+		shards[i] = i
+	}
+	return shards
+}
+
+// RangePartitioner is a Partitioner that gives each shard a contiguous range of keys.
+type RangePartitioner struct {
+	bounds []int
+}
+
+// NewRangePartitioner returns a partitioner of len(bounds)+1 shards. bounds must be strictly
+// increasing: shard 0 owns the keys below bounds[0], shard i the keys in [bounds[i-1], bounds[i]),
+// and the last shard the keys from the last bound on.
+func NewRangePartitioner(bounds ...int) (*RangePartitioner, error) {
+	for i := 1; i < len(bounds); i++ {
+		if bounds[i] <= bounds[i-1] {
+			return nil, fmt.Errorf("range partition bounds %v are not strictly increasing", bounds)
+		}
+	}
+	return &RangePartitioner{bounds: slices.Clone(bounds)}, nil
+}
+
+func (p *RangePartitioner) NumShards() int {
+	return len(p.bounds) + 1
+}
+
+func (p *RangePartitioner) Shard(key int) int {
+	i, found := slices.BinarySearch(p.bounds, key)
+	if found {
+		i++
+	}
+	return i
+}
+
+// ShardsFor returns the shards whose ranges overlap [start, end], in key order.
+func (p *RangePartitioner) ShardsFor(start, end int) []int {
+	var shards []int
+	for shard := p.Shard(start); shard <= p.Shard(end); shard++ {
+		shards = append(shards, shard)
+	}
+	return shards
+}
+
+// ShardedIndex spreads the keys of one logical index over several trees.
+type ShardedIndex struct {
+	shards      []*BPlusTree
+	partitioner Partitioner
+}
+
+// NewShardedIndex returns an index over shards, routed by partitioner. The shards must hold only
+// keys the partitioner gives them, as they do if they start out empty.
+func NewShardedIndex(shards []*BPlusTree, partitioner Partitioner) (*ShardedIndex, error) {
+	if len(shards) != partitioner.NumShards() {
+		return nil, fmt.Errorf("%w: %d trees, %d shards", errPartitionMismatch, len(shards), partitioner.NumShards())
+	}
+	return &ShardedIndex{shards: slices.Clone(shards), partitioner: partitioner}, nil
+}
+
+// Shard returns the tree that owns key.
+func (s *ShardedIndex) Shard(key int) *BPlusTree {
+	return s.shards[s.partitioner.Shard(key)]
+}
+
+// Shards returns the trees, in the partitioner's order.
+func (s *ShardedIndex) Shards() []*BPlusTree {
+	return slices.Clone(s.shards)
+}
+
+func (s *ShardedIndex) Insert(key int, value int64) error {
+	return s.Shard(key).Insert(key, value)
+}
+
+func (s *ShardedIndex) Search(key int) (int64, bool, error) {
+	return s.Shard(key).Search(key)
+}
+
+func (s *ShardedIndex) Delete(key int) (bool, error) {
+	return s.Shard(key).Delete(key)
+}
+
+// Len returns the number of keys in all shards.
+func (s *ShardedIndex) Len() (int, error) {
+	total := 0
+	for _, shard := range s.shards {
+		n, err := shard.Len()
+		if err != nil {
+			return 0, err
+		}
+		total += n
+	}
+	return total, nil
+}
+
+// SearchRange returns the values of the keys in [startKey, endKey] in key order, like
+// BPlusTree.SearchRange, from a Scan.
+func (s *ShardedIndex) SearchRange(startKey, endKey int) ([]int64, error) {
+	pairs, err := s.Scan(startKey, endKey)
+	if err != nil {
+		return nil, err
+	}
+	values := make([]int64, len(pairs))
+	for i, kv := range pairs {
+		values[i] = kv.Value
+	}
+	return values, nil
+}
+
+// Scan returns the keys in [startKey, endKey] with their values, in key order. It scans the shards
+// that may own such keys concurrently, one goroutine each, and merges what they found.
+func (s *ShardedIndex) Scan(startKey, endKey int) ([]KV, error) {
+	if startKey > endKey {
+		return nil, nil
+	}
+	shards := s.partitioner.ShardsFor(startKey, endKey)
+	found := make([][]KV, len(shards))
+	errs := make([]error, len(shards))
+	var wg sync.WaitGroup
+	for i, shard := range shards {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			found[i], errs[i] = scanTree(s.shards[shard], startKey, endKey)
+		}()
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	// Each shard's pairs are sorted already, and with range partitioning so is their
+	// concatenation, which the sort then only verifies.
+	pairs := slices.Concat(found...)
+	slices.SortFunc(pairs, func(a, b KV) int { return cmp.Compare(a.Key, b.Key) })
+	return pairs, nil
+}
+
+// scanTree returns the keys of a tree in [startKey, endKey] with their values, in key order.
+func scanTree(tree *BPlusTree, startKey, endKey int) ([]KV, error) {
+	c, err := tree.Seek(startKey)
+	if err != nil {
+		return nil, err
+	}
+	var pairs []KV
+	for c.Next() && c.Key() <= endKey {
+		pairs = append(pairs, KV{Key: c.Key(), Value: c.Value()})
+	}
+	return pairs, c.Err()
+}
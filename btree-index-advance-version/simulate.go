@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// =================================================================================================
+// --- simulate.go --- (Deterministic Simulation for Teaching)
+// =================================================================================================
+
+// `go run . simulate` runs a script of operations against a fresh in-memory tree and writes what
+// happened, event by event, as JSON Lines, for a visualizer or a slide generator to animate:
+//
+//	# script.txt
+//	insert 10 20 30 40
+//	search 30
+//	delete 20
+//	range 10 40
+//
+//	$ go run . simulate -degree 3 script.txt
+//	{"seq":1,"step":1,"op":"insert 10","event":"begin"}
+//	{"seq":2,"step":1,"op":"insert 10","event":"write","page":1}
+//	{"seq":3,"step":1,"op":"insert 10","event":"end","result":"inserted"}
+//	{"seq":4,"step":1,"op":"insert 10","event":"tree","root":1,"tree":[{"id":1,"leaf":true,"keys":[10]}]}
+//	...
+//
+// Every operation is a step, bracketed by begin and end events. In between come the events the
+// tree's Tracer reports: split, promote, merge, write, and read with -reads. After each step, a
+// tree event holds every page reachable from the root, level by level, so a frame can be drawn
+// without replaying the events. The tree lives in a MemPageStore, the value of each key is the
+// key itself, and nothing depends on time or chance, so the same script always produces the same
+// trace, byte for byte.
+
+// SimulationOptions configures Simulate.
+type SimulationOptions struct {
+	// Degree is the degree of the tree; 0 means MaxDegree. Small degrees split sooner, which
+	// suits teaching.
+	Degree int
+	// PageReads adds a read event for every page read. They outnumber the other events by far.
+	PageReads bool
+}
+
+// SimEvent is one line of a simulation trace. The fields after Event depend on it.
+type SimEvent struct {
+	Seq   int    `json:"seq"`  // position in the trace, from 1
+	Step  int    `json:"step"` // the operation of the script, from 1
+	Op    string `json:"op"`
+	Event string `json:"event"` // begin, read, write, split, promote, merge, end or tree
+
+	Page    *PageID   `json:"page,omitempty"`     // read, write, split, promote, merge
+	NewPage *PageID   `json:"new_page,omitempty"` // split: the new right page; merge: the page folded away
+	Leaf    *bool     `json:"leaf,omitempty"`     // split, merge
+	Key     *int      `json:"key,omitempty"`      // promote: the separator pushed up
+	Result  string    `json:"result,omitempty"`   // end
+	Root    *PageID   `json:"root,omitempty"`     // tree
+	Tree    []SimPage `json:"tree,omitempty"`     // tree
+}
+
+// SimPage is a page of the tree as a tree event shows it.
+type SimPage struct {
+	ID       PageID   `json:"id"`
+	Leaf     bool     `json:"leaf"`
+	Keys     []int    `json:"keys"`
+	Children []PageID `json:"children,omitempty"`
+	Next     *PageID  `json:"next,omitempty"` // the next leaf in the chain, if any
+}
+
+// simOp is a parsed operation of a script.
+type simOp struct {
+	name string // insert, delete, search or range
+	keys []int  // one key, or the bounds of a range
+}
+
+func (op simOp) String() string {
+	s := op.name
+	for _, k := range op.keys {
+		s += " " + strconv.Itoa(k)
+	}
+	return s
+}
+
+// parseScript reads a simulation script: one command per line, with # starting a comment.
+// insert, delete and search take one or more keys, each a step of its own; range takes two bounds.
+func parseScript(r io.Reader) ([]simOp, error) {
+	var ops []simOp
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		keys := make([]int, len(fields)-1)
+		for i, field := range fields[1:] {
+			k, err := strconv.Atoi(field)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: key %q is not an int", line, field)
+			}
+			keys[i] = k
+		}
+		switch name := fields[0]; name {
+		case "insert", "delete", "search":
+			if len(keys) == 0 {
+				return nil, fmt.Errorf("line %d: %s needs at least one key", line, name)
+			}
+			for _, k := range keys {
+				ops = append(ops, simOp{name, []int{k}})
+			}
+		case "range":
+			if len(keys) != 2 {
+				return nil, fmt.Errorf("line %d: range needs two bounds", line)
+			}
+			ops = append(ops, simOp{name, keys})
+		default:
+			return nil, fmt.Errorf("line %d: unknown command %q (available: insert, delete, search, range)", line, name)
+		}
+	}
+	return ops, scanner.Err()
+}
+
+// simTracer turns the tree's trace into events of the running step.
+type simTracer struct {
+	sim       *simulation
+	pageReads bool
+}
+
+func (s *simTracer) OnSplit(pageID, newPageID PageID, isLeaf bool) {
+	s.sim.emit(SimEvent{Event: "split", Page: &pageID, NewPage: &newPageID, Leaf: &isLeaf})
+}
+
+func (s *simTracer) OnPromote(key int, parentPageID PageID) {
+	s.sim.emit(SimEvent{Event: "promote", Page: &parentPageID, Key: &key})
+}
+
+func (s *simTracer) OnMerge(pageID, mergedPageID PageID, isLeaf bool) {
+	s.sim.emit(SimEvent{Event: "merge", Page: &pageID, NewPage: &mergedPageID, Leaf: &isLeaf})
+}
+
+func (s *simTracer) OnPageRead(pageID PageID) {
+	if s.pageReads {
+		s.sim.emit(SimEvent{Event: "read", Page: &pageID})
+	}
+}
+
+func (s *simTracer) OnPageWrite(pageID PageID) {
+	s.sim.emit(SimEvent{Event: "write", Page: &pageID})
+}
+
+// simulation is a running Simulate.
+type simulation struct {
+	enc  *json.Encoder
+	err  error // the first error writing the trace
+	seq  int
+	step int
+	op   string
+}
+
+// emit writes an event of the running step.
+func (s *simulation) emit(e SimEvent) {
+	if s.err != nil {
+		return
+	}
+	s.seq++
+	e.Seq, e.Step, e.Op = s.seq, s.step, s.op
+	s.err = s.enc.Encode(e)
+}
+
+// Simulate runs the operations of script against a fresh in-memory tree and writes their trace to
+// w as JSON Lines, one SimEvent per line. An operation that fails, such as inserting a key twice,
+// is reported in its end event and doesn't stop the simulation.
+func Simulate(script io.Reader, w io.Writer, opts SimulationOptions) error {
+	if opts.Degree != 0 && (opts.Degree < 3 || opts.Degree > MaxDegree) {
+		return fmt.Errorf("degree %d is not between 3 and %d", opts.Degree, MaxDegree)
+	}
+	ops, err := parseScript(script)
+	if err != nil {
+		return err
+	}
+	out := bufio.NewWriter(w)
+	sim := &simulation{enc: json.NewEncoder(out)}
+	tree := NewBPlusTree(NewMemPageStore(), opts.Degree)
+	tracer := &simTracer{sim: sim, pageReads: opts.PageReads}
+	for i, op := range ops {
+		sim.step, sim.op = i+1, op.String()
+		sim.emit(SimEvent{Event: "begin"})
+		tree.SetTracer(tracer)
+		result, err := runSimOp(tree, op)
+		tree.SetTracer(nil)
+		if err != nil {
+			result = "error: " + err.Error()
+		}
+		sim.emit(SimEvent{Event: "end", Result: result})
+		root := tree.rootPageID
+		pages, err := simPages(tree)
+		if err != nil {
+			return fmt.Errorf("step %d (%s): %w", sim.step, sim.op, err)
+		}
+		sim.emit(SimEvent{Event: "tree", Root: &root, Tree: pages})
+	}
+	return errors.Join(sim.err, out.Flush())
+}
+
+// runSimOp runs an operation and describes its outcome.
+func runSimOp(tree *BPlusTree, op simOp) (string, error) {
+	key := op.keys[0]
+	switch op.name {
+	case "insert":
+		if err := tree.Insert(key, int64(key)); err != nil {
+			return "", err
+		}
+		return "inserted", nil
+	case "delete":
+		deleted, err := tree.Delete(key)
+		if err != nil || !deleted {
+			return "not found", err
+		}
+		return "deleted", nil
+	case "search":
+		_, found, err := tree.Search(key)
+		if err != nil || !found {
+			return "not found", err
+		}
+		return "found", nil
+	default:
+		values, err := tree.SearchRange(op.keys[0], op.keys[1])
+		return fmt.Sprintf("%d keys", len(values)), err
+	}
+}
+
+// simPages returns every page reachable from the root, level by level.
+func simPages(tree *BPlusTree) ([]SimPage, error) {
+	var pages []SimPage
+	for level := []PageID{tree.rootPageID}; len(level) > 0; {
+		var next []PageID
+		for _, pageID := range level {
+			page, err := tree.readPage(pageID)
+			if err != nil {
+				return nil, err
+			}
+			p := SimPage{ID: pageID, Leaf: isLeaf(page)}
+			if p.Leaf {
+				p.Keys, _ = readLeafEntries(page)
+				if nextLeaf := getNextLeafPageID(page); nextLeaf != -1 {
+					p.Next = &nextLeaf
+				}
+			} else {
+				p.Keys, p.Children, _ = readInternalEntries(page)
+				next = append(next, p.Children...)
+			}
+			if p.Keys == nil {
+				p.Keys = []int{}
+			}
+			pages = append(pages, p)
+		}
+		level = next
+	}
+	return pages, nil
+}
+
+// simulateCommand implements `go run . simulate [-degree N] [-reads] [script]`. The script is read
+// from standard input if no file is given.
+func simulateCommand(args []string) error {
+	flags := flag.NewFlagSet("simulate", flag.ExitOnError)
+	degree := flags.Int("degree", 4, "degree of the simulated tree (0 means MaxDegree)")
+	reads := flags.Bool("reads", false, "include an event for every page read")
+	flags.Parse(args)
+
+	script := io.Reader(os.Stdin)
+	if flags.NArg() > 0 {
+		file, err := os.Open(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		script = file
+	}
+	return Simulate(script, os.Stdout, SimulationOptions{Degree: *degree, PageReads: *reads})
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"slices"
+)
+
+// =================================================================================================
+// --- slotted.go --- (Slotted Page Layout)
+// =================================================================================================
+
+// Both leaf and internal pages use a slotted layout:
+//
+//	| header (32 bytes) | cell pointers -> |      free space      | <- cells |
+//	0                 32                                 cellContentOffset  4096
+//
+// The cell pointer array starts right after the header and holds one uint16 page offset per
+// entry, in key order. Cells are written from the end of the page towards the front, and the
+// header's cellContentOffset marks where the cell content area begins. Inserting an entry only
+// appends a cell and shifts the (small) pointer array, and cells no longer have to be the same
+// size, which is what variable-length keys and values need.
+//
+// Deleting an entry leaves a hole in the cell content area. The holes are counted in the header's
+// fragmentedBytes and reclaimed by defragmentPage the next time a cell doesn't fit otherwise.
+//
+// Cells:
+//
+//	leaf:     | key int64 | size uint32 | value (size bytes) |
+//	          | key int64 | size uint32 | first overflow PageID |  (size has overflowFlag set)
+//	internal: | key int64 | child PageID | count uint32 |  (the child holding keys >= key)
+//
+// Values that are too large to be stored in the cell are moved to a chain of overflow pages
+// (see overflow.go).
+//
+// An internal page has one more child than keys: the leftmost child is kept in the header, in the
+// slot leaves use for their next-leaf pointer.
+//
+// Next to each child pointer, an internal page stores the number of entries in that child's
+// subtree (the leftmost child's count is in the header too). The counts make rank and position
+// queries O(log n) (see orderstat.go).
+//
+// A page that has been split, or is the result of a split, ends in a fence, and its cell content
+// area ends where the fence begins:
+//
+//	| header | cell pointers -> |  free space  | <- cells | high key int64 | right link PageID |
+//	0                                                   4080                                4096
+//
+// The high key is the first key that no longer belongs in the page, and the right link is the
+// page to its right on the same level, which holds the keys from the high key on. A leaf's right
+// link is its next-leaf pointer, so its fence only uses the high key. The rightmost page of a
+// level has no right link and no high key. The two make the tree a B-link tree (Lehman and Yao),
+// which a reader can descend while a split goes on (see optimistic.go): a split writes the new
+// right page first and then the left one with its new fence, so a reader that comes to the left
+// page for a key that has moved finds it by following the right link. Pages built by Compact and
+// the bulk loads, and pages written before fences existed, have no fence, which reads as no high
+// key: their range can only shrink by a split, which gives them one.
+
+const (
+	cellContentOffsetOffset = 2  // uint16, 0 on a zeroed page, which means PageSize
+	fragmentedBytesOffset   = 4  // uint16
+	leftmostCountOffset     = 20 // uint32
+	leftmostChildOffset     = nextLeafPtrOffset
+	hasFenceOffset          = 6 // byte, 1 if the page ends in a fence
+
+	cellPointerSize    = 2
+	leafCellHeaderSize = 12 // key + value size
+	internalCellSize   = 20
+	fenceSize          = 16
+
+	// overflowFlag is set in a leaf cell's size when the value lives in overflow pages.
+	overflowFlag = 1 << 31
+)
+
+// maxCellsPerPage is the number of entries that fit in a page when each leaf value is no larger
+// than an int64 (or a PageID pointing to its overflow pages), with room left for a fence. Internal
+// cells are smaller, so an internal page always has room for as many.
+const maxCellsPerPage = (PageSize - headerSize - fenceSize) / (cellPointerSize + leafCellHeaderSize + 8)
+
+// MaxDegree is the largest degree a tree can have: a full node of int64 values fills a page.
+// NewBPlusTree uses it for a degree of 0.
+const MaxDegree = maxCellsPerPage + 1
+
+// DegreeForValueSize returns the largest degree at which values of up to valueSize bytes are still
+// stored in their leaf cells instead of in overflow pages (see maxInlineValueSize). Values of
+// up to 8 bytes, like the offsets Insert stores, get MaxDegree. The result is at least 3, even if
+// values that large then go to overflow pages.
+func DegreeForValueSize(valueSize int) int {
+	perEntry := cellPointerSize + leafCellHeaderSize + max(valueSize, 8)
+	return max(3, min(MaxDegree, (PageSize-headerSize-fenceSize)/perEntry+1))
+}
+
+func getCellContentOffset(page *Page) int {
+	if offset := binary.LittleEndian.Uint16(page[cellContentOffsetOffset:]); offset != 0 {
+		return int(offset)
+	}
+	return PageSize
+}
+func setCellContentOffset(page *Page, offset int) {
+	binary.LittleEndian.PutUint16(page[cellContentOffsetOffset:], uint16(offset))
+}
+func getFragmentedBytes(page *Page) int {
+	return int(binary.LittleEndian.Uint16(page[fragmentedBytesOffset:]))
+}
+func setFragmentedBytes(page *Page, n int) {
+	binary.LittleEndian.PutUint16(page[fragmentedBytesOffset:], uint16(n))
+}
+func getLeftmostChild(page *Page) PageID {
+	return PageID(binary.LittleEndian.Uint64(page[leftmostChildOffset:]))
+}
+func setLeftmostChild(page *Page, pageID PageID) {
+	binary.LittleEndian.PutUint64(page[leftmostChildOffset:], uint64(pageID))
+}
+
+func hasFence(page *Page) bool { return page[hasFenceOffset] == 1 }
+
+// cellContentEnd returns where the cell content area ends: at the fence, if the page has one.
+func cellContentEnd(page *Page) int {
+	if hasFence(page) {
+		return PageSize - fenceSize
+	}
+	return PageSize
+}
+
+// highKey returns the page's high key. It reports false if the page has no fence, or is the
+// rightmost page of its level.
+func highKey(page *Page) (int, bool) {
+	if !hasFence(page) || rightLink(page) == -1 {
+		return 0, false
+	}
+	return int(binary.LittleEndian.Uint64(page[PageSize-fenceSize:])), true
+}
+
+// rightLink returns the page to the right of a page on its level, or -1 if there is none or the
+// page has no fence. A leaf's is its next-leaf pointer.
+func rightLink(page *Page) PageID {
+	if isLeaf(page) {
+		return getNextLeafPageID(page)
+	}
+	if !hasFence(page) {
+		return -1
+	}
+	return PageID(binary.LittleEndian.Uint64(page[PageSize-fenceSize+8:]))
+}
+
+// setFence gives a page a fence holding highKey and, for an internal page, rightPageID (a leaf's
+// right link is set with setNextLeafPageID). A page that had no fence is defragmented to clear the
+// end of the page for it; if its cells leave no room, it is left without one.
+func setFence(page *Page, highKey int, rightPageID PageID) {
+	if !hasFence(page) {
+		if usedCellBytes(page)+fenceSize > PageSize-headerSize-int(getNumKeys(page))*cellPointerSize {
+			return
+		}
+		page[hasFenceOffset] = 1
+		defragmentPage(page)
+	}
+	if isLeaf(page) {
+		rightPageID = -1
+	}
+	binary.LittleEndian.PutUint64(page[PageSize-fenceSize:], uint64(highKey))
+	binary.LittleEndian.PutUint64(page[PageSize-fenceSize+8:], uint64(rightPageID))
+}
+
+// setHighKey changes the high key of a page that has a fence, after its range changed.
+func setHighKey(page *Page, highKey int) {
+	if hasFence(page) {
+		binary.LittleEndian.PutUint64(page[PageSize-fenceSize:], uint64(highKey))
+	}
+}
+
+// copyFence gives page the fence of src, or removes its own if src has none.
+func copyFence(page, src *Page) {
+	if !hasFence(src) {
+		if hasFence(page) {
+			page[hasFenceOffset] = 0
+			defragmentPage(page)
+		}
+		return
+	}
+	setFence(page, int(binary.LittleEndian.Uint64(src[PageSize-fenceSize:])), rightLink(src))
+}
+
+// usedCellBytes returns the bytes taken by the page's cells.
+func usedCellBytes(page *Page) int {
+	return cellContentEnd(page) - getCellContentOffset(page) - getFragmentedBytes(page)
+}
+
+// cellOffset returns where the i-th cell starts.
+func cellOffset(page *Page, i int) int {
+	return int(binary.LittleEndian.Uint16(page[headerSize+i*cellPointerSize:]))
+}
+func setCellOffset(page *Page, i, offset int) {
+	binary.LittleEndian.PutUint16(page[headerSize+i*cellPointerSize:], uint16(offset))
+}
+
+// cellSizeAt returns the size of the cell stored at offset.
+func cellSizeAt(page *Page, offset int) int {
+	if !isLeaf(page) {
+		return internalCellSize
+	}
+	size := binary.LittleEndian.Uint32(page[offset+8:])
+	if size&overflowFlag != 0 {
+		return leafCellHeaderSize + 8
+	}
+	return leafCellHeaderSize + int(size)
+}
+
+// cellAt returns the bytes of the i-th cell, aliasing the page.
+func cellAt(page *Page, i int) []byte {
+	offset := cellOffset(page, i)
+	return page[offset : offset+cellSizeAt(page, offset)]
+}
+
+// checkCells returns an ErrCorruptPage error if the numKeys or a cell pointer of a leaf or
+// internal page doesn't fit in the page, or a cell overlaps the fence. The accessors here take
+// them on trust, and would index past the end of the page, or read a cell out of the header.
+// checkPageLayout in check.go checks the rest of the layout.
+func checkCells(pageID PageID, page *Page) error {
+	if page[hasFenceOffset] > 1 {
+		return fmt.Errorf("%w: page %d has fence flag %d", ErrCorruptPage, pageID, page[hasFenceOffset])
+	}
+	numKeys := int(getNumKeys(page))
+	contentOffset, contentEnd := getCellContentOffset(page), cellContentEnd(page)
+	if contentOffset > contentEnd || headerSize+numKeys*cellPointerSize > contentOffset {
+		return fmt.Errorf("%w: page %d has %d keys, more than fit before its cells at offset %d", ErrCorruptPage, pageID, numKeys, contentOffset)
+	}
+	for i := range numKeys {
+		offset := cellOffset(page, i)
+		if offset < contentOffset || offset+leafCellHeaderSize > contentEnd || offset+cellSizeAt(page, offset) > contentEnd {
+			return fmt.Errorf("%w: cell %d of page %d at offset %d lies outside the cell content area", ErrCorruptPage, i, pageID, offset)
+		}
+	}
+	return nil
+}
+
+// keyAt returns the key of the i-th entry of a leaf or internal page.
+func keyAt(page *Page, i int) int {
+	return int(binary.LittleEndian.Uint64(page[cellOffset(page, i):]))
+}
+
+// valueAt returns the value of the i-th entry of a leaf page, for values stored as an int64.
+func valueAt(page *Page, i int) int64 {
+	return int64(binary.LittleEndian.Uint64(page[cellOffset(page, i)+leafCellHeaderSize:]))
+}
+
+// leafValueAt describes the value of the i-th entry of a leaf page. An inline value is returned
+// as a slice of the page. Otherwise inline is nil and the value's size bytes start at the
+// overflow page.
+func leafValueAt(page *Page, i int) (inline []byte, size int, overflow PageID) {
+	offset := cellOffset(page, i)
+	rawSize := binary.LittleEndian.Uint32(page[offset+8:])
+	data := page[offset+leafCellHeaderSize:]
+	if rawSize&overflowFlag != 0 {
+		return nil, int(rawSize &^ overflowFlag), PageID(binary.LittleEndian.Uint64(data))
+	}
+	return data[:rawSize], int(rawSize), -1
+}
+
+// childAt returns the i-th child of an internal page, 0 <= i <= numKeys.
+func childAt(page *Page, i int) PageID {
+	if i == 0 {
+		return getLeftmostChild(page)
+	}
+	return PageID(binary.LittleEndian.Uint64(page[cellOffset(page, i-1)+8:]))
+}
+
+// childCountAt returns the number of entries under the i-th child of an internal page.
+func childCountAt(page *Page, i int) int {
+	if i == 0 {
+		return int(binary.LittleEndian.Uint32(page[leftmostCountOffset:]))
+	}
+	return int(binary.LittleEndian.Uint32(page[cellOffset(page, i-1)+16:]))
+}
+func setChildCountAt(page *Page, i, count int) {
+	if i == 0 {
+		binary.LittleEndian.PutUint32(page[leftmostCountOffset:], uint32(count))
+		return
+	}
+	binary.LittleEndian.PutUint32(page[cellOffset(page, i-1)+16:], uint32(count))
+}
+
+// subtreeCount returns the number of entries under a page.
+func subtreeCount(page *Page) int {
+	if isLeaf(page) {
+		return int(getNumKeys(page))
+	}
+	count := 0
+	for i := 0; i <= int(getNumKeys(page)); i++ {
+		count += childCountAt(page, i)
+	}
+	return count
+}
+
+func leafCell(key int, value []byte) []byte {
+	cell := make([]byte, leafCellHeaderSize+len(value))
+	binary.LittleEndian.PutUint64(cell, uint64(key))
+	binary.LittleEndian.PutUint32(cell[8:], uint32(len(value)))
+	copy(cell[leafCellHeaderSize:], value)
+	return cell
+}
+
+func overflowLeafCell(key int, size int, firstPageID PageID) []byte {
+	cell := make([]byte, leafCellHeaderSize+8)
+	binary.LittleEndian.PutUint64(cell, uint64(key))
+	binary.LittleEndian.PutUint32(cell[8:], uint32(size)|overflowFlag)
+	binary.LittleEndian.PutUint64(cell[leafCellHeaderSize:], uint64(firstPageID))
+	return cell
+}
+
+// encodeInt64Value encodes the int64 values stored by Insert.
+func encodeInt64Value(value int64) []byte {
+	return binary.LittleEndian.AppendUint64(nil, uint64(value))
+}
+
+func internalCell(key int, child PageID, count int) []byte {
+	cell := make([]byte, internalCellSize)
+	binary.LittleEndian.PutUint64(cell, uint64(key))
+	binary.LittleEndian.PutUint64(cell[8:], uint64(child))
+	binary.LittleEndian.PutUint32(cell[16:], uint32(count))
+	return cell
+}
+
+// freeSpace returns the contiguous free space between the cell pointers and the cells.
+func freeSpace(page *Page) int {
+	return getCellContentOffset(page) - (headerSize + int(getNumKeys(page))*cellPointerSize)
+}
+
+// insertCell inserts a cell as the i-th entry of the page. It reports false, leaving the page
+// unchanged, if there isn't room for it even after defragmenting the page.
+func insertCell(page *Page, i int, cell []byte) bool {
+	need := cellPointerSize + len(cell)
+	if freeSpace(page) < need {
+		if freeSpace(page)+getFragmentedBytes(page) < need {
+			return false
+		}
+		defragmentPage(page)
+	}
+
+	numKeys := int(getNumKeys(page))
+	offset := getCellContentOffset(page) - len(cell)
+	copy(page[offset:], cell)
+	setCellContentOffset(page, offset)
+
+	pointers := page[headerSize : headerSize+(numKeys+1)*cellPointerSize]
+	copy(pointers[(i+1)*cellPointerSize:], pointers[i*cellPointerSize:])
+	setCellOffset(page, i, offset)
+	setNumKeys(page, uint16(numKeys+1))
+	return true
+}
+
+// deleteCell removes the i-th entry of the page.
+func deleteCell(page *Page, i int) {
+	numKeys := int(getNumKeys(page))
+	offset := cellOffset(page, i)
+	size := cellSizeAt(page, offset)
+	clear(page[offset : offset+size])
+	if offset == getCellContentOffset(page) {
+		setCellContentOffset(page, offset+size)
+	} else {
+		setFragmentedBytes(page, getFragmentedBytes(page)+size)
+	}
+
+	pointers := page[headerSize : headerSize+numKeys*cellPointerSize]
+	copy(pointers[i*cellPointerSize:], pointers[(i+1)*cellPointerSize:])
+	clear(pointers[(numKeys-1)*cellPointerSize:])
+	setNumKeys(page, uint16(numKeys-1))
+}
+
+// defragmentPage rewrites the cells back to back at the end of the cell content area, turning
+// every hole left by deleted cells back into contiguous free space.
+func defragmentPage(page *Page) {
+	numKeys := int(getNumKeys(page))
+	cells := make([][]byte, numKeys)
+	for i := range cells {
+		cells[i] = slices.Clone(cellAt(page, i))
+	}
+	resetCells(page)
+	for i, cell := range cells {
+		insertCell(page, i, cell)
+	}
+}
+
+// resetCells removes every entry from the page, keeping the rest of its header and its fence.
+func resetCells(page *Page) {
+	clear(page[headerSize:cellContentEnd(page)])
+	setNumKeys(page, 0)
+	setCellContentOffset(page, cellContentEnd(page))
+	setFragmentedBytes(page, 0)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// =================================================================================================
+// --- spans.go --- (Tracing Spans)
+// =================================================================================================
+
+// Metrics tell how the index behaves in aggregate; a span tells what one request did. Every Search,
+// SearchRange, Insert and Commit can start a span, as a child of the span in its context, with the
+// number of pages it read and keys it compared as attributes.
+//
+// This is a tracing hook, not an OpenTelemetry integration: the module doesn't import
+// OpenTelemetry, and nothing here is tested against it. SpanTracer is an interface shaped like
+// OpenTelemetry's trace.Tracer, so a service that does use OpenTelemetry can plug its tracer in
+// with an adapter of its own, like the one in the README:
+//
+//	tree.SetSpanTracer(otelSpans{otel.Tracer("btree")})
+//	offset, found, err := tree.SearchContext(ctx, 42)  // a btree.Search span under ctx's span
+//
+// SpanRecorder is an implementation that just keeps the spans, for tests and the demo.
+//
+// The counts live in the tree while an operation runs, so like a Tracer, a SpanTracer assumes one
+// operation at a time.
+
+// SpanTracer starts spans. An OpenTelemetry trace.Tracer fits it with a small adapter.
+type SpanTracer interface {
+	// Start starts a span named name as a child of the span in ctx, if any, and returns a context
+	// holding the new span.
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a span started by a SpanTracer.
+type Span interface {
+	SetAttributes(attrs ...SpanAttribute)
+	// RecordError marks the span as failed with err.
+	RecordError(err error)
+	End()
+}
+
+// SpanAttribute is a key-value pair attached to a span, like OpenTelemetry's attribute.KeyValue.
+// Value is an int, an int64, a bool or a string.
+type SpanAttribute struct {
+	Key   string
+	Value any
+}
+
+func (a SpanAttribute) String() string {
+	return fmt.Sprintf("%s=%v", a.Key, a.Value)
+}
+
+// SetSpanTracer installs a span tracer on the tree. Passing nil disables spans.
+func (t *BPlusTree) SetSpanTracer(spans SpanTracer) {
+	t.spans = spans
+}
+
+// SetSpanTracer installs a span tracer on the DB and its tree. Passing nil disables spans. It waits
+// for the running transaction, if any, to finish.
+func (db *DB) SetSpanTracer(spans SpanTracer) {
+	db.txMu.Lock()
+	defer db.txMu.Unlock()
+	db.spans = spans
+	db.tree.SetSpanTracer(spans)
+}
+
+// opSpan is the span of the running operation of a tree, with what the operation has done so far.
+// A nil *opSpan, for a tree without a span tracer, ignores every call.
+type opSpan struct {
+	tree         *BPlusTree
+	span         Span
+	pagesRead    int
+	keysCompared int
+	outer        *opSpan // the span of the operation this one runs in, if any
+}
+
+// startSpan starts the span of an operation and counts its page reads and key comparisons until
+// end is called. It returns nil if the tree has no span tracer.
+func (t *BPlusTree) startSpan(ctx context.Context, name string, attrs ...SpanAttribute) *opSpan {
+	if t.spans == nil {
+		return nil
+	}
+	_, span := t.spans.Start(ctx, name)
+	span.SetAttributes(attrs...)
+	t.span = &opSpan{tree: t, span: span, outer: t.span}
+	return t.span
+}
+
+// end records the operation's counts, attrs and err, if not nil, on the span and ends it.
+func (s *opSpan) end(err error, attrs ...SpanAttribute) {
+	if s == nil {
+		return
+	}
+	s.tree.span = s.outer
+	if s.outer != nil {
+		s.outer.pagesRead += s.pagesRead
+		s.outer.keysCompared += s.keysCompared
+	}
+	s.span.SetAttributes(append(attrs,
+		SpanAttribute{"btree.pages_read", s.pagesRead},
+		SpanAttribute{"btree.keys_compared", s.keysCompared})...)
+	if err != nil {
+		s.span.RecordError(err)
+	}
+	s.span.End()
+}
+
+// compared counts n key comparisons towards the running operation's span.
+func (t *BPlusTree) compared(n int) {
+	if t.span != nil {
+		t.span.keysCompared += n
+	}
+}
+
+// RecordedSpan is a span kept by a SpanRecorder.
+type RecordedSpan struct {
+	Name       string
+	Parent     string // name of the parent span, if it was started by the same recorder
+	Attributes []SpanAttribute
+	Err        error
+	Duration   time.Duration
+}
+
+func (s RecordedSpan) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s", s.Name)
+	if s.Parent != "" {
+		fmt.Fprintf(&b, " (in %s)", s.Parent)
+	}
+	for _, a := range s.Attributes {
+		fmt.Fprintf(&b, " %v", a)
+	}
+	if s.Err != nil {
+		fmt.Fprintf(&b, " error=%q", s.Err)
+	}
+	return b.String()
+}
+
+// SpanRecorder is a SpanTracer that keeps every span once it has ended.
+type SpanRecorder struct {
+	mu    sync.Mutex
+	spans []RecordedSpan
+}
+
+// recorderSpanKey is the context key of the span a SpanRecorder started.
+type recorderSpanKey struct{}
+
+// recorderSpan is a span of a SpanRecorder while it is running.
+type recorderSpan struct {
+	recorder *SpanRecorder
+	span     RecordedSpan
+	start    time.Time
+}
+
+func (r *SpanRecorder) Start(ctx context.Context, name string) (context.Context, Span) {
+	s := &recorderSpan{recorder: r, span: RecordedSpan{Name: name}, start: time.Now()}
+	if parent, ok := ctx.Value(recorderSpanKey{}).(*recorderSpan); ok {
+		s.span.Parent = parent.span.Name
+	}
+	return context.WithValue(ctx, recorderSpanKey{}, s), s
+}
+
+func (s *recorderSpan) SetAttributes(attrs ...SpanAttribute) {
+	s.span.Attributes = append(s.span.Attributes, attrs...)
+}
+
+func (s *recorderSpan) RecordError(err error) {
+	s.span.Err = err
+}
+
+func (s *recorderSpan) End() {
+	s.span.Duration = time.Since(s.start)
+	s.recorder.mu.Lock()
+	defer s.recorder.mu.Unlock()
+	s.recorder.spans = append(s.recorder.spans, s.span)
+}
+
+// Spans returns the spans that have ended, in the order they ended.
+func (r *SpanRecorder) Spans() []RecordedSpan {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.spans)
+}
+
+// Reset forgets the spans recorded so far.
+func (r *SpanRecorder) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = nil
+}
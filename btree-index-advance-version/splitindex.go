@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"math"
+	"os"
+)
+
+// =================================================================================================
+// --- splitindex.go --- (Splitting an Index by Key Range)
+// =================================================================================================
+
+// Range partitioning keeps each shard's keys in a contiguous range, so rebalancing a shard that
+// grew too large means cutting its range in two. SplitAt does that to an index: it writes the
+// entries below the split key to one new index file and the rest to another, each bulk-loaded
+// bottom-up exactly as Compact writes its file (see compact.go):
+//
+//	          ┌─▶ low.idx:  (-∞, 5000)
+//	tree  ────┤
+//	          └─▶ high.idx: [5000, +∞)
+//
+//	err := tree.SplitAt(5000, "users_pk.low.idx", "users_pk.high.idx")
+//	low, err := Open("users_pk.low.idx")
+//
+// Both are complete index files with a header, opened with Open like any other, and encrypted
+// with the tree's key if its file is. The tree itself is unchanged, so it keeps serving until the
+// caller switches over; Merge (see merge.go) undoes a split. Only the main tree is copied, not
+// its buckets, and the bloom filter isn't either: EnableBloomFilter builds one for a half.
+// Each file is written under a temporary name and renamed into place once it is complete.
+
+// SplitAt writes the tree's entries with keys smaller than key to a new index file at lowPath,
+// and the others to one at highPath, with pages filled to defaultCompactFillFactor. Existing
+// files at those paths are replaced. Either half may be empty.
+func (t *BPlusTree) SplitAt(key int, lowPath, highPath string) error {
+	return t.SplitAtContext(context.Background(), key, lowPath, highPath)
+}
+
+// SplitAtContext is SplitAt that gives up once ctx is done and returns ctx.Err(). A file that was
+// already complete by then stays in place.
+func (t *BPlusTree) SplitAtContext(ctx context.Context, key int, lowPath, highPath string) error {
+	err := t.writeSplit(lowPath, func() (compactSource, error) {
+		c, err := t.SeekContext(ctx, math.MinInt)
+		return keysBelow{c, key}, err
+	})
+	if err != nil {
+		return err
+	}
+	return t.writeSplit(highPath, func() (compactSource, error) {
+		return t.SeekContext(ctx, key)
+	})
+}
+
+// writeSplit bulk-loads the entries of the source open returns into a new index file at path.
+func (t *BPlusTree) writeSplit(path string, open func() (compactSource, error)) error {
+	file, err := os.Create(path + ".split")
+	if err != nil {
+		return err
+	}
+	if _, _, err := t.writeCompacted(file, defaultCompactFillFactor, nil, open); err != nil {
+		discardCompacted(file)
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+// keysBelow is a cursor that ends before the first key that isn't smaller than end.
+type keysBelow struct {
+	*Cursor
+	end int
+}
+
+func (k keysBelow) Next() bool {
+	return k.Cursor.Next() && k.Key() < k.end
+}
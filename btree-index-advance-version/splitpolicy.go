@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"math"
+)
+
+// =================================================================================================
+// --- splitpolicy.go --- (Leaf Split Policies)
+// =================================================================================================
+
+// A full leaf normally splits down the middle, which suits keys that arrive in random order: both
+// halves have room for the keys that will land in them. Keys that arrive in ascending order only
+// ever land in the rightmost leaf, so the left half of every split stays half empty for good, and
+// a sequential load leaves the whole tree about 50% full. A SplitPolicy keeps more of the entries
+// in the left leaf when the rightmost leaf splits for a key past its last one:
+//
+//	SplitEven         50/50, the default
+//	SplitRightHeavy   90/10: the left leaf keeps 90% of the entries
+//	SplitRightmost    the left leaf keeps every entry, the new key starts the right one
+//
+//	tree.SetSplitPolicy(SplitRightHeavy)
+//
+// Every other split stays even, so random inserts are unaffected. The new rightmost leaf starts
+// out with fewer than the minimum number of keys, which the tree allows for the rightmost leaf:
+// the next appends fill it. The policy isn't stored in the index file.
+
+// SplitPolicy is the fraction of a full leaf's entries, counting the new one, that stays in the
+// leaf when the rightmost leaf splits for a key past its last one.
+type SplitPolicy float64
+
+const (
+	// SplitEven splits every leaf in half.
+	SplitEven SplitPolicy = 0.5
+	// SplitRightHeavy keeps 90% of the entries in the left leaf, for keys inserted in ascending order.
+	SplitRightHeavy SplitPolicy = 0.9
+	// SplitRightmost keeps all of them, 1.0 of the entries: the left leaf stays full, and the new
+	// key starts the right leaf on its own. A sequential load fills every leaf but the last.
+	SplitRightmost SplitPolicy = 1
+)
+
+var errInvalidSplitPolicy = errors.New("split policy must be between 0.5 and 1")
+
+// SetSplitPolicy sets the split policy of the tree. It defaults to SplitEven.
+func (t *BPlusTree) SetSplitPolicy(policy SplitPolicy) error {
+	if !(policy >= SplitEven && policy <= 1) {
+		return errInvalidSplitPolicy
+	}
+	t.splitPolicy = policy
+	return nil
+}
+
+// leafSplitPoint returns how many of the degree entries of a splitting leaf, the new one at
+// insertIndex included, stay in the leaf.
+func (t *BPlusTree) leafSplitPoint(page *Page, insertIndex int) int {
+	if t.splitPolicy <= SplitEven || insertIndex != t.degree-1 || getNextLeafPageID(page) != -1 {
+		return t.degree / 2
+	}
+	return min(int(math.Round(float64(t.splitPolicy)*float64(t.degree))), t.degree-1)
+}
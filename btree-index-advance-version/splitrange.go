@@ -0,0 +1,146 @@
+package main
+
+import (
+	"cmp"
+	"slices"
+)
+
+// =================================================================================================
+// --- splitrange.go --- (Range Partitioning for Parallel Scans)
+// =================================================================================================
+
+// A large analytical read, say summing a column over half the table, goes faster if several
+// goroutines each scan a part of the range. The parts should hold about the same number of keys,
+// which an even split of the key space doesn't give when keys are unevenly spread. The separators
+// in the internal pages do: they are keys that actually occur, and every internal page records how
+// many entries each of its children holds (see orderstat.go), so the number of keys on either side
+// of a separator is known without reading a leaf.
+//
+// SplitRange descends from the root, level by level, into the children that overlap the range,
+// collecting the separators that fall inside it, until it has splitRangeOversample times as many
+// as it needs or the next level would be the leaves. It then cuts the range at the separators
+// closest to the n-1 evenly spaced key counts:
+//
+//	ranges, err := tree.SplitRange(0, 1_000_000, 4)
+//	for _, r := range ranges {
+//		go func() { offsets, err := tree.SearchRange(r.Start, r.End); ... }()
+//	}
+//
+// Reading the tree from several goroutines is safe as long as nothing writes to it meanwhile and
+// it has no tracer or span tracer.
+
+// splitRangeOversample is how many candidate separators per requested part SplitRange collects
+// before it stops descending, so that it can pick boundaries close to the ideal ones.
+const splitRangeOversample = 4
+
+// KeyRange is the range of keys [Start, End].
+type KeyRange struct {
+	Start, End int
+}
+
+// splitCandidate is a separator inside the range, with the number of keys in the tree smaller than
+// it.
+type splitCandidate struct {
+	key    int
+	before int
+}
+
+// splitFrontier is a page on the current level of SplitRange's descent, with the bounds of the
+// keys that belong under it and the number of keys in the tree smaller than those.
+type splitFrontier struct {
+	pageID PageID
+	bounds keyRange
+	before int
+}
+
+// SplitRange divides [start, end] into at most n consecutive sub-ranges that hold roughly the same
+// number of keys, in key order. It returns fewer when the internal pages don't have enough
+// separators inside the range, down to the whole range when the tree is a single leaf or the
+// range falls within one leaf. Apart from one leaf, it reads only internal pages.
+func (t *BPlusTree) SplitRange(start, end, n int) ([]KeyRange, error) {
+	if start > end {
+		return nil, nil
+	}
+	whole := []KeyRange{{start, end}}
+	if n <= 1 {
+		return whole, nil
+	}
+	first, err := t.rank(start, false)
+	if err != nil {
+		return nil, err
+	}
+	through, err := t.rank(end, true)
+	if err != nil {
+		return nil, err
+	}
+	if through-first < n {
+		return whole, nil
+	}
+
+	var candidates []splitCandidate
+	frontier := []splitFrontier{{pageID: t.rootPageID}}
+	for len(candidates) < splitRangeOversample*n {
+		// Every leaf is on the same level, so the first page of a level tells whether it's the
+		// leaf level.
+		if page, err := t.readPage(frontier[0].pageID); err != nil || isLeaf(page) {
+			if err != nil {
+				return nil, err
+			}
+			break
+		}
+		var next []splitFrontier
+		for _, f := range frontier {
+			page, err := t.readPage(f.pageID)
+			if err != nil {
+				return nil, err
+			}
+			keys, children, counts := readInternalEntries(page)
+			before := f.before
+			for i, child := range children {
+				bounds := f.bounds
+				if i > 0 {
+					bounds.low, bounds.hasLow = keys[i-1], true
+				}
+				if i < len(keys) {
+					bounds.high, bounds.hasHigh = keys[i], true
+				}
+				// Only the children that may hold keys of the range are descended into.
+				if (!bounds.hasLow || bounds.low <= end) && (!bounds.hasHigh || bounds.high > start) {
+					next = append(next, splitFrontier{child, bounds, before})
+				}
+				before += counts[i]
+				if i < len(keys) && keys[i] > start && keys[i] <= end {
+					candidates = append(candidates, splitCandidate{keys[i], before})
+				}
+			}
+		}
+		frontier = next
+	}
+	slices.SortFunc(candidates, func(a, b splitCandidate) int { return cmp.Compare(a.key, b.key) })
+	candidates = slices.CompactFunc(candidates, func(a, b splitCandidate) bool { return a.key == b.key })
+
+	// For each ideal boundary, take the candidate whose key count is closest to it, after the
+	// candidate taken for the previous one.
+	ranges := make([]KeyRange, 0, n)
+	rangeStart, c := start, 0
+	for i := 1; i < n; i++ {
+		target := first + i*(through-first)/n
+		for c+1 < len(candidates) && abs(candidates[c+1].before-target) <= abs(candidates[c].before-target) {
+			c++
+		}
+		if c == len(candidates) {
+			break
+		}
+		ranges = append(ranges, KeyRange{rangeStart, candidates[c].key - 1})
+		rangeStart = candidates[c].key
+		c++
+	}
+	return append(ranges, KeyRange{rangeStart, end}), nil
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
@@ -0,0 +1,73 @@
+package main
+
+import "fmt"
+
+// =================================================================================================
+// --- stats.go --- (Tree Statistics)
+// =================================================================================================
+
+// TreeStats summarizes the shape of the tree and how well its pages are used. The numbers are what
+// choosing a degree needs, and what the query layer's cost estimates are based on.
+type TreeStats struct {
+	Height int
+	// PagesPerLevel holds the number of tree pages on each level, starting with the root.
+	PagesPerLevel []int
+	Keys          int
+	// FillFactor is the fraction of the tree pages' capacity (degree-1 entries per leaf, internal
+	// degree-1 keys per internal page) in use.
+	FillFactor    float64
+	OverflowPages int
+	// FreePages counts pages in the file that are no longer part of the tree, such as pages
+	// released by merges. Compact drops them. The pages of buckets are counted too.
+	FreePages   int
+	BytesOnDisk int64
+}
+
+func (s TreeStats) String() string {
+	return fmt.Sprintf("height %d, pages per level %v, %d keys, %.0f%% full, %d overflow pages, %d free pages, %d bytes on disk",
+		s.Height, s.PagesPerLevel, s.Keys, s.FillFactor*100, s.OverflowPages, s.FreePages, s.BytesOnDisk)
+}
+
+// Stats walks the tree level by level and collects its statistics.
+func (t *BPlusTree) Stats() (TreeStats, error) {
+	var stats TreeStats
+	usedKeys, capacity, treePages := 0, 0, 0
+	for level := []PageID{t.rootPageID}; len(level) > 0; {
+		var next []PageID
+		for _, pageID := range level {
+			page, err := t.readPage(pageID)
+			if err != nil {
+				return stats, err
+			}
+			numKeys := int(getNumKeys(page))
+			usedKeys += numKeys
+			capacity += t.maxKeysOf(page)
+			if !isLeaf(page) {
+				_, children, _ := readInternalEntries(page)
+				next = append(next, children...)
+				continue
+			}
+			stats.Keys += numKeys
+			for i := 0; i < numKeys; i++ {
+				if _, size, overflow := leafValueAt(page, i); overflow != -1 {
+					stats.OverflowPages += (size + overflowPayloadSize - 1) / overflowPayloadSize
+				}
+			}
+		}
+		stats.Height++
+		stats.PagesPerLevel = append(stats.PagesPerLevel, len(level))
+		treePages += len(level)
+		level = next
+	}
+	stats.FillFactor = float64(usedKeys) / float64(capacity)
+	numPages := t.pager.NumPages()
+	stats.FreePages = int(numPages) - treePages - stats.OverflowPages
+	if t.metaPageID != -1 {
+		stats.FreePages--
+	}
+	if t.catalogPageID != -1 {
+		stats.FreePages--
+	}
+	stats.BytesOnDisk = numPages * PageSize
+	return stats, nil
+}
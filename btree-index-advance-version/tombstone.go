@@ -0,0 +1,114 @@
+package main
+
+import "math"
+
+// =================================================================================================
+// --- tombstone.go --- (Soft Deletes and Purging)
+// =================================================================================================
+
+// Delete takes a key out of the tree, and with it any trace that the key was ever there. A replica
+// that missed the delete, or a reader that still looks at an older version, can't tell a key that
+// was deleted from one that never existed. SoftDelete leaves a tombstone under the key instead: an
+// entry whose value is negative, which can't be a heap offset, and records the log's LSN at the
+// time of the delete:
+//
+//	tx := db.Begin()
+//	deleted, err := tx.SoftDelete(42) // the key now reads as not found
+//	err = tx.Commit()
+//	purged, err := db.Purge(lsn)      // drop the tombstones written before lsn
+//
+// Reads skip tombstones, Delete treats the key as not there, and Insert replaces the tombstone
+// with the new row. The row's keys leave the secondary indexes at once, as with Delete.
+//
+// A tombstone's LSN is the last one logged before the delete, so the deleting transaction's commit
+// record comes after it. Transactions run one at a time, so for the LSN of a commit record, such as
+// a replica's LSN or a change event's (see cdc.go), the tombstones recorded before it are exactly
+// those of the transactions that committed up to and including it. Purge physically removes them
+// by rewriting the index file bottom-up, as Compact does (see compact.go), and like Compact it
+// refuses to run on a file that holds buckets or secondary indexes.
+
+// tombstoneValue returns the tree value of a tombstone recording lsn.
+func tombstoneValue(lsn uint64) int64 {
+	return -1 - int64(lsn)
+}
+
+// isTombstone reports whether a tree value is a tombstone rather than a heap offset.
+func isTombstone(value int64) bool {
+	return value < 0
+}
+
+// tombstoneLSN returns the LSN a tombstone value records.
+func tombstoneLSN(value int64) uint64 {
+	return uint64(-1 - value)
+}
+
+// SoftDelete replaces the row of key with a tombstone, and removes the row's keys from the
+// secondary indexes, as part of the transaction, and reports whether the key was there. The row
+// stays in the heap file.
+func (tx *Tx) SoftDelete(key int) (bool, error) {
+	if tx.done {
+		return false, errTxDone
+	}
+	offset, found, err := tx.db.tree.Search(key)
+	if err != nil || !found || isTombstone(offset) {
+		return false, err
+	}
+	if err := tx.unindexRow(offset); err != nil {
+		return false, err
+	}
+	if _, err := tx.db.tree.Delete(key); err != nil {
+		return false, err
+	}
+	if err := tx.db.tree.Insert(key, tombstoneValue(tx.db.wal.lastLSN())); err != nil {
+		return false, err
+	}
+	tx.noteChange(key, offset, -1)
+	return true, tx.maybeSteal()
+}
+
+// Purge removes the tombstones recorded before LSN beforeLSN from the index file, rewriting it
+// with pages filled to defaultCompactFillFactor, and returns how many it removed. It waits for the
+// running transaction, if any, to finish. If there is nothing to remove, the file is left as it is.
+func (db *DB) Purge(beforeLSN uint64) (int, error) {
+	db.txMu.Lock()
+	defer db.txMu.Unlock()
+	numKeys, purged := 0, 0
+	c, err := db.tree.Seek(math.MinInt)
+	if err != nil {
+		return 0, err
+	}
+	for c.Next() {
+		numKeys++
+		if isTombstone(c.Value()) && tombstoneLSN(c.Value()) < beforeLSN {
+			purged++
+		}
+	}
+	if err := c.Err(); err != nil || purged == 0 {
+		return 0, err
+	}
+	// The rewrite flushes the buffer pool first, which logs a checkpoint past every page image in
+	// the log, so recovery never replays an image of the old file over the new one.
+	err = db.tree.rewrite(defaultCompactFillFactor, numKeys-purged, func() (compactSource, error) {
+		c, err := db.tree.Seek(math.MinInt)
+		return liveEntries{c, beforeLSN}, err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return purged, nil
+}
+
+// liveEntries is a cursor that skips the tombstones recorded before beforeLSN.
+type liveEntries struct {
+	*Cursor
+	beforeLSN uint64
+}
+
+func (l liveEntries) Next() bool {
+	for l.Cursor.Next() {
+		if !isTombstone(l.Value()) || tombstoneLSN(l.Value()) >= l.beforeLSN {
+			return true
+		}
+	}
+	return false
+}
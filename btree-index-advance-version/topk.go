@@ -0,0 +1,55 @@
+package main
+
+import (
+	"math"
+	"slices"
+)
+
+// =================================================================================================
+// --- topk.go --- (Top-K Queries)
+// =================================================================================================
+
+// A leaderboard asks for the k largest keys, and a queue for the k smallest. Scanning the whole
+// range and sorting it reads every leaf. The leaf chain already holds the keys in order, so the k
+// smallest are the first k entries of a cursor from the first leaf, about k / (keys per leaf)
+// leaves. Leaves are only linked forwards, so the k largest can't be read walking back from the
+// last leaf. The order statistics find where they start instead: the key of rank Len()-k, one
+// descent away. A cursor from there to the end reads as few leaves, and the result is reversed.
+//
+//	top, err := tree.TopK(10, true) // the 10 largest keys, largest first
+
+// TopK returns the k smallest keys with their values in ascending order, or the k largest in
+// descending order if desc. It returns every key if the tree holds k or fewer. Values are those
+// stored by Insert, as Cursor.Value returns them.
+func (t *BPlusTree) TopK(k int, desc bool) ([]KV, error) {
+	if k <= 0 {
+		return nil, nil
+	}
+	start := math.MinInt
+	if desc {
+		n, err := t.Len()
+		if err != nil {
+			return nil, err
+		}
+		if n > k {
+			if start, _, err = t.SelectNth(n - k); err != nil {
+				return nil, err
+			}
+		}
+	}
+	c, err := t.Seek(start)
+	if err != nil {
+		return nil, err
+	}
+	var top []KV
+	for len(top) < k && c.Next() {
+		top = append(top, KV{Key: c.Key(), Value: c.Value()})
+	}
+	if err := c.Err(); err != nil {
+		return nil, err
+	}
+	if desc {
+		slices.Reverse(top)
+	}
+	return top, nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// =================================================================================================
+// --- tracer.go --- (Mutation Trace / Event Hooks)
+// =================================================================================================
+
+// Tracer observes the structural changes the tree makes and every page it touches,
+// so a learning UI or a test harness can follow exactly what each Insert/Delete does.
+type Tracer interface {
+	// OnSplit fires after a full page has been split, moving its upper half to newPageID.
+	OnSplit(pageID, newPageID PageID, isLeaf bool)
+	// OnPromote fires when a separator key is pushed up into parentPageID
+	// (which is a freshly allocated root when the split page was the root).
+	OnPromote(key int, parentPageID PageID)
+	// OnMerge fires after an underfull page has been merged, folding mergedPageID into pageID.
+	OnMerge(pageID, mergedPageID PageID, isLeaf bool)
+	OnPageRead(pageID PageID)
+	OnPageWrite(pageID PageID)
+}
+
+// SetTracer installs a tracer on the tree. Passing nil disables tracing.
+func (t *BPlusTree) SetTracer(tracer Tracer) {
+	t.tracer = tracer
+}
+
+// LogTracer is a Tracer that prints every event as a line of text.
+type LogTracer struct {
+	w io.Writer
+}
+
+// NewLogTracer creates a tracer that writes its events to w.
+func NewLogTracer(w io.Writer) *LogTracer {
+	return &LogTracer{w: w}
+}
+
+func (l *LogTracer) OnSplit(pageID, newPageID PageID, isLeaf bool) {
+	fmt.Fprintf(l.w, "  [trace] split %s page %d -> new page %d\n", pageKind(isLeaf), pageID, newPageID)
+}
+
+func (l *LogTracer) OnPromote(key int, parentPageID PageID) {
+	fmt.Fprintf(l.w, "  [trace] promote key %d into page %d\n", key, parentPageID)
+}
+
+func (l *LogTracer) OnMerge(pageID, mergedPageID PageID, isLeaf bool) {
+	fmt.Fprintf(l.w, "  [trace] merge %s page %d into page %d\n", pageKind(isLeaf), mergedPageID, pageID)
+}
+
+func (l *LogTracer) OnPageRead(pageID PageID) {
+	fmt.Fprintf(l.w, "  [trace] read page %d\n", pageID)
+}
+
+func (l *LogTracer) OnPageWrite(pageID PageID) {
+	fmt.Fprintf(l.w, "  [trace] write page %d\n", pageID)
+}
+
+// pageCounter is a Tracer that only counts page accesses. The benchmarks, the checks and the
+// demo use it to count how many pages an operation touches.
+type pageCounter struct {
+	reads, writes int64
+}
+
+func (c *pageCounter) OnSplit(pageID, newPageID PageID, isLeaf bool)    {}
+func (c *pageCounter) OnPromote(key int, parentPageID PageID)           {}
+func (c *pageCounter) OnMerge(pageID, mergedPageID PageID, isLeaf bool) {}
+func (c *pageCounter) OnPageRead(pageID PageID)                         { c.reads++ }
+func (c *pageCounter) OnPageWrite(pageID PageID)                        { c.writes++ }
+
+func (c *pageCounter) touched() int64 { return c.reads + c.writes }
+
+func pageKind(isLeaf bool) string {
+	if isLeaf {
+		return "leaf"
+	}
+	return "internal"
+}
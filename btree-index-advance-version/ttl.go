@@ -0,0 +1,190 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"math"
+	"slices"
+	"time"
+)
+
+// =================================================================================================
+// --- ttl.go --- (Expiring Keys)
+// =================================================================================================
+
+// A cache or a session store wants its keys to go away by themselves. PutWithTTL stores a value
+// that expires after a while; its expiration time is kept next to the value in the key's group
+// row (see kv.go), in Unix nanoseconds:
+//
+//	store.PutWithTTL([]byte("session:8f3a"), []byte("user:42"), 30*time.Minute)
+//	err := store.StartSweeper(time.Minute)
+//
+// Expiry is lazy: an expired key stays in its row, but Get, Scan and Delete act as if it were
+// gone. A Put replaces it, without an expiration time unless it is a PutWithTTL. So rows don't
+// fill up with dead keys, SweepExpired deletes the expired keys of the main tree and of every
+// bucket, and StartSweeper calls it in the background every interval until StopSweeper or Close.
+//
+// SweepExpired first looks for groups holding expired keys in a read-only pass, and then rewrites
+// each of them in a transaction of its own, so that the store isn't locked for a whole sweep. The
+// clock is the machine's: a key expires when time.Now() reaches its expiration time.
+
+var errSweeperRunning = errors.New("expiry sweeper is already running")
+
+// expired reports whether the entry has an expiration time and it has passed at now.
+func (e kvEntry) expired(now time.Time) bool {
+	return e.expires != 0 && e.expires <= now.UnixNano()
+}
+
+// PutWithTTL stores value under key in the main tree, to expire after ttl (see
+// Bucket.PutWithTTL).
+func (s *KVStore) PutWithTTL(key, value []byte, ttl time.Duration) error {
+	return (&Bucket{store: s}).PutWithTTL(key, value, ttl)
+}
+
+// PutWithTTL stores value under key, replacing the value stored before, if any, to expire after
+// ttl. A ttl that isn't positive stores a key that has already expired.
+func (b *Bucket) PutWithTTL(key, value []byte, ttl time.Duration) error {
+	if len(key) == 0 {
+		return errEmptyKey
+	}
+	// An expiration time of 0 means never, so the earliest one is 1.
+	expires := max(time.Now().Add(ttl).UnixNano(), 1)
+	tx, err := b.begin()
+	if err != nil {
+		return err
+	}
+	if err := putEntry(tx, key, value, expires); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return b.commit(tx)
+}
+
+// SweepExpired deletes the keys that have expired from the main tree and from every bucket, and
+// returns how many it deleted.
+func (s *KVStore) SweepExpired() (int, error) {
+	names, err := s.Buckets()
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	total := 0
+	for _, name := range slices.Insert(names, 0, "") {
+		n, err := (&Bucket{store: s, name: name}).sweepExpired(now)
+		total += n
+		if errors.Is(err, ErrBucketNotFound) {
+			continue // deleted meanwhile
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// sweepExpired deletes the bucket's keys that have expired at now and returns how many it
+// deleted.
+func (b *Bucket) sweepExpired(now time.Time) (int, error) {
+	groups, err := b.expiredGroups(now)
+	if err != nil {
+		return 0, err
+	}
+	swept := 0
+	for _, g := range groups {
+		tx, err := b.begin()
+		if err != nil {
+			return swept, err
+		}
+		// The group may have changed since it was read.
+		entries, err := readGroup(tx, g)
+		if err != nil {
+			tx.Rollback()
+			return swept, err
+		}
+		live := slices.DeleteFunc(slices.Clone(entries), func(e kvEntry) bool { return e.expired(now) })
+		if len(live) == len(entries) {
+			tx.Rollback()
+			continue
+		}
+		if err := writeGroup(tx, g, live); err != nil {
+			tx.Rollback()
+			return swept, err
+		}
+		if err := b.commit(tx); err != nil {
+			return swept, err
+		}
+		swept += len(entries) - len(live)
+	}
+	return swept, nil
+}
+
+// expiredGroups returns the tree keys of the bucket's groups that hold a key that has expired at
+// now, in order.
+func (b *Bucket) expiredGroups(now time.Time) ([]int, error) {
+	tx, err := b.begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	db := b.store.db
+	c, err := db.tree.Seek(math.MinInt)
+	if err != nil {
+		return nil, err
+	}
+	var groups []int
+	for c.Next() {
+		row, err := db.heap.ReadRow(c.Value())
+		if err != nil {
+			return nil, err
+		}
+		entries, err := decodeGroup(row)
+		if err != nil {
+			return nil, err
+		}
+		if slices.ContainsFunc(entries, func(e kvEntry) bool { return e.expired(now) }) {
+			groups = append(groups, c.Key())
+		}
+	}
+	return groups, c.Err()
+}
+
+// StartSweeper starts a goroutine that calls SweepExpired every interval, and logs its errors,
+// until StopSweeper or Close is called.
+func (s *KVStore) StartSweeper(interval time.Duration) error {
+	s.sweeperMu.Lock()
+	defer s.sweeperMu.Unlock()
+	if s.stopSweeper != nil {
+		return errSweeperRunning
+	}
+	s.stopSweeper = make(chan struct{})
+	s.sweeperStopped = make(chan struct{})
+
+	go func(stop, stopped chan struct{}) {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if _, err := s.SweepExpired(); err != nil {
+					log.Printf("expiry sweeper: %v", err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}(s.stopSweeper, s.sweeperStopped)
+	return nil
+}
+
+// StopSweeper stops the background sweeper, if it is running, and waits for it to finish.
+func (s *KVStore) StopSweeper() {
+	s.sweeperMu.Lock()
+	stop, stopped := s.stopSweeper, s.sweeperStopped
+	s.stopSweeper, s.sweeperStopped = nil, nil
+	s.sweeperMu.Unlock()
+	if stop != nil {
+		close(stop)
+		<-stopped
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// =================================================================================================
+// --- twophase.go --- (Two-Phase Commit across Shards)
+// =================================================================================================
+
+// ShardedDB spreads the rows of one table over several DBs, routed by a Partitioner as in
+// ShardedIndex (see shard.go). A transaction that writes to one shard commits there as usual. One
+// that writes to several must commit on all of them or on none, even if the process crashes
+// halfway, which each shard's WAL can't promise on its own. A coordinator with a log of its own
+// runs two-phase commit over the shards' transactions instead:
+//
+//	phase 1  every shard logs the transaction's changes, followed by a prepare record, and forces
+//	         its WAL to disk. A prepared shard can still commit or roll back.
+//	decision the coordinator logs a commit record for the distributed transaction and forces its
+//	         log to disk: the transaction is committed.
+//	phase 2  every shard logs its commit record and applies the changes.
+//
+// If a shard fails to prepare, every shard rolls back and nothing is decided. A crash before the
+// decision leaves prepared transactions in the shards' WALs that never committed, and one after
+// leaves some that committed on other shards; recovery can't tell them apart from the shard's log
+// alone. So OpenShardedDB reads the coordinator's log first, and each shard's recovery commits
+// those of its in-doubt transactions that the coordinator decided to commit and aborts the rest,
+// logging the outcome either way:
+//
+//	db, err := OpenShardedDB("data/users", NewHashRing(4, 0), 0) // data/users.coord.wal, .shard0.idx...
+//	tx := db.Begin()
+//	tx.Insert(1, []byte("1,zoe,zoe@example.com"))    // shard 2, say
+//	tx.Insert(2, []byte("2,yann,yann@example.com"))  // shard 0
+//	err = tx.Commit()                                // both rows or neither
+//
+// The coordinator never hands out the ID of a distributed transaction twice, not even one that
+// never reached a decision: a shard that logged a prepare record under the ID could otherwise take
+// a later transaction's decision for its own. IDs are reserved in blocks of shardedTxIDBlock by a
+// record in the coordinator's log, forced to disk before the first ID of the block is used, and
+// OpenShardedDB starts after the last block reserved.
+//
+// A ShardedTx buffers its writes until Commit, which begins the shards' transactions in shard
+// order, so that two sharded transactions never wait for each other's shards in a cycle. Reads go
+// to the shards directly and see only committed rows.
+
+var errNoShards = errors.New("sharded DB needs at least one shard")
+
+// shardedTxIDBlock is the number of distributed transaction IDs a record in the coordinator's log
+// reserves at a time.
+const shardedTxIDBlock = 1024
+
+// ShardedDB is a table whose rows are spread over several DBs.
+type ShardedDB struct {
+	shards      []*DB
+	partitioner Partitioner
+	coordinator *WAL // holds a commit record for every distributed transaction that committed
+
+	mu       sync.Mutex
+	nextTxID uint64 // the ID of the next distributed transaction
+	reserved uint64 // the highest ID the coordinator's log has reserved
+}
+
+// OpenShardedDB opens the coordinator's log, path.coord.wal, and then shard i of the partitioner
+// in path.shard<i>.idx, .dat and .wal, creating any file that doesn't exist. The in-doubt
+// transactions of each shard are resolved as the coordinator decided.
+func OpenShardedDB(path string, partitioner Partitioner, degree int) (*ShardedDB, error) {
+	if partitioner.NumShards() < 1 {
+		return nil, errNoShards
+	}
+	coordinator, records, err := OpenWAL(path + ".coord.wal")
+	if err != nil {
+		return nil, err
+	}
+	s := &ShardedDB{partitioner: partitioner, coordinator: coordinator, nextTxID: 1}
+	committed := make(map[uint64]bool)
+	for _, record := range records {
+		switch record.kind {
+		case walCommit:
+			committed[record.txID] = true
+			s.nextTxID = max(s.nextTxID, record.txID+1)
+		case walTxIDs:
+			s.nextTxID = max(s.nextTxID, uint64(record.target)+1)
+		}
+	}
+	// Every ID up to here may have been handed out; new ones need a block of their own.
+	s.reserved = s.nextTxID - 1
+	decided := func(globalID uint64) bool { return committed[globalID] }
+	for i := range partitioner.NumShards() {
+		shardPath := fmt.Sprintf("%s.shard%d", path, i)
+		db, _, err := openDB(shardPath+".idx", shardPath+".dat", shardPath+".wal", degree, nil, decided)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.shards = append(s.shards, db)
+	}
+	return s, nil
+}
+
+// Shard returns the DB that owns key.
+func (s *ShardedDB) Shard(key int) *DB {
+	return s.shards[s.partitioner.Shard(key)]
+}
+
+// Get looks up the row stored under key in the shard that owns it.
+func (s *ShardedDB) Get(key int) (string, bool, error) {
+	return s.Shard(key).Get(key)
+}
+
+// Close closes the shards and the coordinator's log.
+func (s *ShardedDB) Close() error {
+	errs := []error{s.coordinator.Close()}
+	for _, db := range s.shards {
+		errs = append(errs, db.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// ShardedTx is a transaction over a ShardedDB, started with Begin. It must be finished with
+// Commit or Rollback.
+type ShardedTx struct {
+	db   *ShardedDB
+	ops  [][]shardOp // the writes to each shard, in order
+	done bool
+}
+
+// shardOp is a write buffered by a ShardedTx.
+type shardOp struct {
+	key    int
+	row    []byte
+	delete bool
+}
+
+// Begin starts a transaction. Nothing is locked until Commit.
+func (s *ShardedDB) Begin() *ShardedTx {
+	return &ShardedTx{db: s, ops: make([][]shardOp, len(s.shards))}
+}
+
+// Insert adds a row under key as part of the transaction. Errors such as a duplicate key are
+// reported by Commit.
+func (tx *ShardedTx) Insert(key int, row []byte) error {
+	if tx.done {
+		return errTxDone
+	}
+	shard := tx.db.partitioner.Shard(key)
+	tx.ops[shard] = append(tx.ops[shard], shardOp{key: key, row: row})
+	return nil
+}
+
+// Delete removes key as part of the transaction. A key that isn't there is ignored.
+func (tx *ShardedTx) Delete(key int) error {
+	if tx.done {
+		return errTxDone
+	}
+	shard := tx.db.partitioner.Shard(key)
+	tx.ops[shard] = append(tx.ops[shard], shardOp{key: key, delete: true})
+	return nil
+}
+
+// Rollback discards the transaction's writes.
+func (tx *ShardedTx) Rollback() error {
+	if tx.done {
+		return errTxDone
+	}
+	tx.done = true
+	return nil
+}
+
+// Commit applies the transaction's writes to every shard they go to, or to none. With more than
+// one shard it runs two-phase commit. An error after the decision means a shard failed to log or
+// apply its part. The transaction is committed anyway; reopening the DB lets the shard's recovery
+// finish it.
+func (tx *ShardedTx) Commit() error {
+	if tx.done {
+		return errTxDone
+	}
+	tx.done = true
+
+	var parts []*Tx
+	rollback := func() {
+		for _, part := range parts {
+			part.Rollback()
+		}
+	}
+	for shard, ops := range tx.ops {
+		if len(ops) == 0 {
+			continue
+		}
+		part := tx.db.shards[shard].Begin()
+		parts = append(parts, part)
+		for _, op := range ops {
+			var err error
+			if op.delete {
+				_, err = part.Delete(op.key)
+			} else {
+				err = part.Insert(op.key, op.row)
+			}
+			if err != nil {
+				rollback()
+				return err
+			}
+		}
+	}
+	switch len(parts) {
+	case 0:
+		return nil
+	case 1:
+		return parts[0].Commit()
+	}
+
+	// Phase 1.
+	globalID, err := tx.db.newTxID()
+	if err != nil {
+		rollback()
+		return err
+	}
+	for _, part := range parts {
+		if err := part.prepare(globalID); err != nil {
+			rollback()
+			return err
+		}
+	}
+	// The decision.
+	if err := tx.db.logDecision(globalID); err != nil {
+		rollback()
+		return err
+	}
+	// Phase 2.
+	var errs []error
+	for _, part := range parts {
+		errs = append(errs, part.Commit())
+	}
+	return errors.Join(errs...)
+}
+
+// newTxID returns the ID of a new distributed transaction, first reserving a block of IDs in the
+// coordinator's log if the last one is used up.
+func (s *ShardedDB) newTxID() (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.nextTxID > s.reserved {
+		reserved := s.nextTxID + shardedTxIDBlock - 1
+		if _, err := s.coordinator.Append(&walRecord{kind: walTxIDs, target: int64(reserved)}); err != nil {
+			return 0, err
+		}
+		if err := s.coordinator.Sync(); err != nil {
+			return 0, err
+		}
+		s.reserved = reserved
+	}
+	id := s.nextTxID
+	s.nextTxID++
+	return id, nil
+}
+
+// logDecision logs that the distributed transaction globalID committed and forces the
+// coordinator's log to disk.
+func (s *ShardedDB) logDecision(globalID uint64) error {
+	commitTime := binary.LittleEndian.AppendUint64(nil, uint64(time.Now().UnixNano()))
+	if _, err := s.coordinator.Append(&walRecord{txID: globalID, kind: walCommit, data: commitTime}); err != nil {
+		return err
+	}
+	return s.coordinator.Sync()
+}
@@ -0,0 +1,544 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"maps"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// =================================================================================================
+// --- txn.go --- (Transaction Manager)
+// =================================================================================================
+
+// DB ties the paged B+ Tree index, the heap file holding the rows it points to, and the
+// write-ahead log together, and runs transactions over them:
+//
+//	tx := db.Begin()
+//	tx.Insert(42, []byte("42,zoe,zoe@example.com"))
+//	tx.Commit() // or tx.Rollback()
+//
+// A transaction never touches the heap file until it commits. Its page writes are buffered in
+// memory and its rows are kept aside, so rolling back mostly throws them away. Committing logs
+// every changed page and row to the WAL, forces the log to disk, and only then applies the
+// changes. A transaction that buffers more than maxTxPages pages logs them and hands them to the
+// index early, and rolling it back undoes them. When the database is reopened, recovery redoes
+// what the log holds and undoes the transactions that never finished (see aries.go), which
+// repairs a crash at any point.
+//
+// Committed pages are applied to the tree's buffer pool, which a background flusher writes to the
+// index file every dbFlushInterval. After each flush the flusher logs a checkpoint record, so
+// recovery only has to replay the log from the oldest change that may not have reached the file.
+type DB struct {
+	pager *Pager
+	tree  *BPlusTree
+	heap  *HeapFile
+	wal   *WAL
+
+	// txMu is held for the whole lifetime of a transaction: one transaction runs at a time.
+	txMu     sync.Mutex
+	nextTxID uint64
+
+	// replicatedLSN is the LSN of the leader's log up to which a replica has applied it, or 0.
+	replicatedLSN atomic.Uint64
+
+	// indexes are the secondary indexes that Insert and Delete maintain (see secondary.go).
+	indexes []secondaryIndex
+
+	// metrics, if set, also counts the heap file's fsyncs and times commits (see metrics.go).
+	metrics Metrics
+	// spans, if set, starts a span for every commit (see spans.go).
+	spans SpanTracer
+
+	// maxTxPages is the number of pages a transaction buffers before it steals them (see aries.go).
+	maxTxPages int
+}
+
+// Tx is a transaction started with DB.Begin. It must be finished with Commit or Rollback.
+type Tx struct {
+	db   *DB
+	id   uint64
+	rows []pendingRow
+	done bool
+
+	// replicatedLSN, if not 0, is logged with the transaction as the leader LSN it brings a
+	// replica up to.
+	replicatedLSN uint64
+	// beginLSN is the LSN of the transaction's begin record once it has been logged, with the
+	// transaction's changes or before the first page it steals, or 0.
+	beginLSN uint64
+	// prepared is set once prepare has logged the transaction's changes ahead of the commit.
+	prepared bool
+
+	// stolen are the pages the transaction stole and hasn't undone, in log order, and newStolen
+	// the pages it allocated among those it ever stole (see aries.go). noSteal keeps every page
+	// the transaction writes buffered, however many there are.
+	stolen    []stolenPage
+	newStolen map[PageID]bool
+	noSteal   bool
+
+	// keyChanges are the keys the transaction inserted or deleted, in the order it first changed
+	// them, and changedKeys their positions in it. They are logged for change data capture (see
+	// cdc.go), under the name of the bucket the transaction works on, if any.
+	keyChanges  []keyChange
+	changedKeys map[int]int
+	bucket      string
+
+	// savepoints are the transaction's savepoints, oldest first, and keyUndo the earlier values
+	// of the key changes that changed again since the first of them (see savepoint.go).
+	savepoints []savepoint
+	keyUndo    []keyChangeUndo
+
+	// State at Begin, restored on rollback.
+	rootPageID    PageID
+	metaPageID    PageID
+	catalogPageID PageID
+	numPages      int64
+}
+
+// pendingRow is a row inserted by a transaction that has not been written to the heap file yet.
+type pendingRow struct {
+	offset int64
+	data   []byte
+}
+
+// dbFlushInterval is how often the buffer pool of an open DB writes its dirty pages to disk.
+const dbFlushInterval = 100 * time.Millisecond
+
+var (
+	errTxDone      = errors.New("transaction has already been committed or rolled back")
+	errRowTooLarge = errors.New("row is too large to be logged")
+)
+
+// OpenDB opens the index, heap and log files, creating any that don't exist, and replays the
+// transactions that committed in the log before the index is used.
+func OpenDB(indexPath, heapPath, walPath string, degree int) (*DB, error) {
+	db, _, err := openDB(indexPath, heapPath, walPath, degree, nil, nil)
+	return db, err
+}
+
+// OpenEncryptedDB is OpenDB for an index file whose pages are encrypted with key (see encrypt.go).
+func OpenEncryptedDB(indexPath, heapPath, walPath string, degree int, key []byte) (*DB, error) {
+	c, err := newPageCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	db, _, err := openDB(indexPath, heapPath, walPath, degree, c, nil)
+	return db, err
+}
+
+// openDB implements OpenDB and OpenEncryptedDB. It also returns the records found in the log.
+// decided, if not nil, tells recovery whether the distributed transactions that are in doubt in
+// the log committed (see twophase.go).
+func openDB(indexPath, heapPath, walPath string, degree int, c *pageCipher, decided func(globalID uint64) bool) (*DB, []walRecord, error) {
+	pager, err := openPager(indexPath, c, false, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	heap, err := OpenHeapFile(heapPath)
+	if err != nil {
+		pager.Close()
+		return nil, nil, err
+	}
+	wal, records, err := OpenWAL(walPath)
+	if err != nil {
+		pager.Close()
+		heap.Close()
+		return nil, nil, err
+	}
+
+	db := &DB{pager: pager, heap: heap, wal: wal, nextTxID: 1, maxTxPages: defaultMaxTxPages}
+	if err := db.recover(pager, records, decided); err != nil {
+		db.closeFiles(pager)
+		return nil, nil, err
+	}
+	// The tree is opened after recovery so that it finds the root as of the last commit.
+	db.tree = NewBPlusTree(pager, degree)
+	db.tree.pool.forceLog = db.wal.SyncTo
+	// Recovery wrote everything in the log to the index file.
+	if len(records) > 0 {
+		db.tree.pool.advanceAppliedLSN(records[len(records)-1].lsn)
+	}
+	if err := db.tree.pool.StartFlusher(dbFlushInterval, db.logCheckpoint); err != nil {
+		db.closeFiles(pager)
+		return nil, nil, err
+	}
+	return db, records, nil
+}
+
+// logCheckpoint records that every change logged before lsn has been written to the index file.
+func (db *DB) logCheckpoint(lsn uint64) error {
+	if _, err := db.wal.Append(&walRecord{kind: walCheckpoint, target: int64(lsn)}); err != nil {
+		return err
+	}
+	return db.wal.Sync()
+}
+
+// Begin starts a new transaction, waiting for the running one, if any, to finish.
+func (db *DB) Begin() *Tx {
+	db.txMu.Lock()
+	tx := &Tx{
+		db:            db,
+		id:            db.nextTxID,
+		rootPageID:    db.tree.rootPageID,
+		metaPageID:    db.tree.metaPageID,
+		catalogPageID: db.tree.catalogPageID,
+		numPages:      db.pager.NumPages(),
+	}
+	db.nextTxID++
+	db.tree.txPages = make(map[PageID]*Page)
+	return tx
+}
+
+// Insert adds a row to the heap file and indexes it under key, and in every secondary index, as
+// part of the transaction.
+func (tx *Tx) Insert(key int, row []byte) error {
+	if tx.done {
+		return errTxDone
+	}
+	if len(row) > walMaxDataSize {
+		return errRowTooLarge
+	}
+	// Checked here rather than when the row is written at commit, after it has been logged.
+	if bytes.IndexByte(row, '\n') != -1 {
+		return errRowHasNewline
+	}
+	offset := tx.db.heap.Size()
+	if len(tx.rows) > 0 {
+		last := tx.rows[len(tx.rows)-1]
+		offset = last.offset + int64(len(last.data)) + 1
+	}
+	entries := tx.db.indexEntries(row)
+	if err := tx.checkIndexes(entries, offset); err != nil {
+		return err
+	}
+	// A tombstone gives way to the new row (see tombstone.go).
+	if old, found, err := tx.db.tree.Search(key); err != nil {
+		return err
+	} else if found && isTombstone(old) {
+		if _, err := tx.db.tree.Delete(key); err != nil {
+			return err
+		}
+	}
+	if err := tx.db.tree.Insert(key, offset); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := tx.inIndex(e.index, func(t *BPlusTree) error { return t.Insert(e.key, offset) }); err != nil {
+			return err
+		}
+	}
+	tx.rows = append(tx.rows, pendingRow{offset: offset, data: slices.Clone(row)})
+	tx.noteChange(key, -1, offset)
+	return tx.maybeSteal()
+}
+
+// Delete removes key from the index, and the row's keys from the secondary indexes, as part of the
+// transaction. The row stays in the heap file. A key that has a tombstone isn't there.
+func (tx *Tx) Delete(key int) (bool, error) {
+	if tx.done {
+		return false, errTxDone
+	}
+	offset, found, err := tx.db.tree.Search(key)
+	if err != nil || !found || isTombstone(offset) {
+		return false, err
+	}
+	if err := tx.unindexRow(offset); err != nil {
+		return false, err
+	}
+	if _, err := tx.db.tree.Delete(key); err != nil {
+		return false, err
+	}
+	tx.noteChange(key, offset, -1)
+	return true, tx.maybeSteal()
+}
+
+// unindexRow removes the keys of the row at offset from the secondary indexes.
+func (tx *Tx) unindexRow(offset int64) error {
+	if len(tx.db.indexes) == 0 {
+		return nil
+	}
+	row, err := tx.row(offset)
+	if err != nil {
+		return err
+	}
+	for _, e := range tx.db.indexEntries([]byte(row)) {
+		if err := tx.inIndex(e.index, func(t *BPlusTree) error {
+			_, err := t.Delete(e.key)
+			return err
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// noteChange records that the transaction moved key from the row at offset old to the one at
+// offset new, where -1 stands for no row. Changes to the same key add up to one.
+func (tx *Tx) noteChange(key int, old, new int64) {
+	if i, ok := tx.changedKeys[key]; ok {
+		if len(tx.savepoints) > 0 {
+			tx.keyUndo = append(tx.keyUndo, keyChangeUndo{i, tx.keyChanges[i].new})
+		}
+		tx.keyChanges[i].new = new
+		return
+	}
+	if tx.changedKeys == nil {
+		tx.changedKeys = make(map[int]int)
+	}
+	tx.changedKeys[key] = len(tx.keyChanges)
+	tx.keyChanges = append(tx.keyChanges, keyChange{key, old, new})
+}
+
+// Get looks up the row stored under key, including the changes made by the transaction itself.
+func (tx *Tx) Get(key int) (string, bool, error) {
+	if tx.done {
+		return "", false, errTxDone
+	}
+	offset, found, err := tx.db.tree.Search(key)
+	if err != nil || !found || isTombstone(offset) {
+		return "", false, err
+	}
+	row, err := tx.row(offset)
+	return row, err == nil, err
+}
+
+// Scan calls fn with the key and row of every key in [start, end], in key order, including the
+// changes made by the transaction itself. It stops at the first error fn returns.
+func (tx *Tx) Scan(start, end int, fn func(key int, row string) error) error {
+	if tx.done {
+		return errTxDone
+	}
+	c, err := tx.db.tree.Seek(start)
+	if err != nil {
+		return err
+	}
+	for c.Next() && c.Key() <= end {
+		if isTombstone(c.Value()) {
+			continue
+		}
+		row, err := tx.row(c.Value())
+		if err != nil {
+			return err
+		}
+		if err := fn(c.Key(), row); err != nil {
+			return err
+		}
+	}
+	return c.Err()
+}
+
+// row returns the row at offset, which may still be pending in the transaction.
+func (tx *Tx) row(offset int64) (string, error) {
+	for _, row := range tx.rows {
+		if row.offset == offset {
+			return string(row.data), nil
+		}
+	}
+	return tx.db.heap.ReadRow(offset)
+}
+
+// Commit makes the transaction's changes durable and applies them to the index and heap file.
+func (tx *Tx) Commit() error {
+	return tx.CommitContext(context.Background())
+}
+
+// CommitContext is Commit that rolls the transaction back and returns ctx.Err() instead if ctx is
+// already done. Its span, if the DB has a span tracer, is started in ctx.
+func (tx *Tx) CommitContext(ctx context.Context) error {
+	if tx.done {
+		return errTxDone
+	}
+	if err := ctx.Err(); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if tx.db.spans == nil {
+		return tx.commit()
+	}
+	_, span := tx.db.spans.Start(ctx, "btree.Commit")
+	span.SetAttributes(SpanAttribute{"btree.tx.id", int64(tx.id)},
+		SpanAttribute{"btree.tx.pages", len(tx.db.tree.txPages)}, SpanAttribute{"btree.tx.rows", len(tx.rows)})
+	err := tx.commit()
+	if err != nil {
+		span.RecordError(err)
+	}
+	span.End()
+	return err
+}
+
+// commit implements CommitContext.
+func (tx *Tx) commit() error {
+	db := tx.db
+	pages := db.tree.txPages
+	defer tx.finish()
+	if db.metrics != nil {
+		defer db.observe("commit", time.Now())
+	}
+
+	// 1. Log the whole transaction, ending with its commit record, and force the log to disk.
+	//    Once Sync returns the transaction is committed, even if we crash right after. A prepared
+	//    transaction only has its commit record left to log.
+	if !tx.prepared {
+		if err := tx.logChanges(); err != nil {
+			return err
+		}
+	}
+	commitTime := binary.LittleEndian.AppendUint64(nil, uint64(time.Now().UnixNano()))
+	commitLSN, err := db.wal.Append(&walRecord{txID: tx.id, kind: walCommit, data: commitTime})
+	if err != nil {
+		return err
+	}
+	if err := db.wal.Sync(); err != nil {
+		return err
+	}
+	beginLSN := tx.beginLSN
+
+	// 2. Apply the changes. If this fails halfway, replaying the log on the next open finishes it.
+	//    The pages only go to the buffer pool; its flusher writes them to the index file later.
+	db.tree.txPages = nil
+	for _, row := range tx.rows {
+		if err := db.heap.WriteRow(row.offset, row.data); err != nil {
+			return err
+		}
+	}
+	if db.metrics != nil {
+		db.metrics.Fsync("heap")
+	}
+	if err := db.heap.Sync(); err != nil {
+		return err
+	}
+	for _, pageID := range slices.Sorted(maps.Keys(pages)) {
+		if err := db.tree.pool.writeLoggedPage(pageID, pages[pageID], beginLSN); err != nil {
+			return err
+		}
+	}
+	db.tree.pool.advanceAppliedLSN(commitLSN)
+	if tx.replicatedLSN != 0 {
+		db.replicatedLSN.Store(tx.replicatedLSN)
+	}
+	return nil
+}
+
+// logChanges appends the transaction's begin record, unless it is already logged, its changes and
+// then the records in extra to the log, without forcing it to disk.
+func (tx *Tx) logChanges(extra ...walRecord) error {
+	var records []walRecord
+	if tx.beginLSN == 0 {
+		records = append(records, walRecord{txID: tx.id, kind: walBegin})
+	}
+	records = append(records, tx.changes()...)
+	for _, c := range tx.keyChanges {
+		// A key inserted and deleted again is left out.
+		if c.old != c.new {
+			records = append(records, c.record(tx.id, tx.bucket))
+		}
+	}
+	if tx.replicatedLSN != 0 {
+		records = append(records, walRecord{txID: tx.id, kind: walReplicated, target: int64(tx.replicatedLSN)})
+	}
+	records = append(records, extra...)
+	for i := range records {
+		if _, err := tx.db.wal.Append(&records[i]); err != nil {
+			return err
+		}
+	}
+	if tx.beginLSN == 0 {
+		tx.beginLSN = records[0].lsn
+	}
+	return nil
+}
+
+// prepare logs the transaction's changes, followed by a prepare record naming the distributed
+// transaction it is part of, and forces the log to disk (see twophase.go). The transaction stays
+// open: once prepared it can still commit, whatever happens to the process, or roll back.
+func (tx *Tx) prepare(globalID uint64) error {
+	if tx.done || tx.prepared {
+		return errTxDone
+	}
+	if err := tx.logChanges(walRecord{txID: tx.id, kind: walPrepare, target: int64(globalID)}); err != nil {
+		return err
+	}
+	tx.prepared = true
+	return tx.db.wal.Sync()
+}
+
+// changes returns the records that log the transaction's changes: the image of every page it
+// wrote, in page order, followed by its rows.
+func (tx *Tx) changes() []walRecord {
+	pages := tx.db.tree.txPages
+	pageIDs := slices.Sorted(maps.Keys(pages))
+	records := make([]walRecord, 0, len(pageIDs)+len(tx.rows))
+	for _, pageID := range pageIDs {
+		records = append(records, walRecord{txID: tx.id, kind: walPageImage, target: int64(pageID), data: pages[pageID][:]})
+	}
+	for _, row := range tx.rows {
+		records = append(records, walRecord{txID: tx.id, kind: walHeapAppend, target: row.offset, data: row.data})
+	}
+	return records
+}
+
+// prepare runs fn in a transaction and returns the records that committing it would log for its
+// changes, then rolls it back, leaving the files as they were (see raft.go). The transaction never
+// steals pages.
+func (db *DB) prepare(fn func(tx *Tx) error) ([]walRecord, error) {
+	tx := db.Begin()
+	tx.noSteal = true
+	defer tx.Rollback()
+	if err := fn(tx); err != nil {
+		return nil, err
+	}
+	return tx.changes(), nil
+}
+
+// Rollback discards every change made by the transaction. Its rows and buffered pages were never
+// written, so they are simply dropped. The pages it stole are undone, and if anything of it was
+// logged, an abort record ends it.
+func (tx *Tx) Rollback() error {
+	if tx.done {
+		return errTxDone
+	}
+	defer tx.finish()
+	db := tx.db
+	err := tx.undoStolen(0)
+	if err == nil && tx.beginLSN != 0 {
+		var lsn uint64
+		if lsn, err = db.wal.Append(&walRecord{txID: tx.id, kind: walAbort}); err == nil {
+			db.tree.pool.advanceAppliedLSN(lsn)
+		}
+	}
+	db.tree.rootPageID, db.tree.metaPageID, db.tree.catalogPageID = tx.rootPageID, tx.metaPageID, tx.catalogPageID
+	db.pager.releaseAllocations(tx.keptPages(tx.numPages))
+	return err
+}
+
+// finish ends the transaction and lets the next one begin.
+func (tx *Tx) finish() {
+	tx.done = true
+	tx.db.tree.txPages, tx.db.tree.txUndo = nil, nil
+	tx.db.txMu.Unlock()
+}
+
+// Get looks up the row stored under key.
+func (db *DB) Get(key int) (string, bool, error) {
+	tx := db.Begin()
+	defer tx.Rollback()
+	return tx.Get(key)
+}
+
+// Close flushes the buffer pool and closes the underlying files. It waits for the running
+// transaction, if any, to finish.
+func (db *DB) Close() error {
+	db.txMu.Lock()
+	defer db.txMu.Unlock()
+	return errors.Join(db.tree.Close(), db.wal.Close(), db.heap.Close())
+}
+
+func (db *DB) closeFiles(pager *Pager) error {
+	return errors.Join(db.wal.Close(), db.heap.Close(), pager.Close())
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+)
+
+// =================================================================================================
+// --- validate.go --- (Validating Offsets against the Data File)
+// =================================================================================================
+
+// The index stores byte offsets into the data file, so editing the data file after the index was
+// built silently leaves the index pointing at the wrong rows, or at the middle of one.
+// ValidateAgainstData catches that in two ways:
+//
+//   - It compares the data file with the version recorded in the meta page by RecordDataFile
+//     (size, modification time and checksum). This is cheap to check and tells whether the file
+//     changed at all.
+//   - It follows every offset in the index, re-parses the row found there and checks that the row
+//     carries the key the index has for it. This finds the entries that actually went stale.
+
+// OffsetMismatch is an index entry whose offset doesn't lead to a row with its key.
+type OffsetMismatch struct {
+	Key     int
+	Offset  int64
+	Problem string
+}
+
+func (m OffsetMismatch) String() string {
+	return fmt.Sprintf("key %d at offset %d: %s", m.Key, m.Offset, m.Problem)
+}
+
+// DataValidation is the result of ValidateAgainstData.
+type DataValidation struct {
+	// Recorded is the data file version in the meta page. HasRecorded is false if there is none.
+	Recorded    DataFileInfo
+	HasRecorded bool
+	Current     DataFileInfo
+	Entries     int
+	Mismatches  []OffsetMismatch
+}
+
+// Changed reports whether the data file differs from the recorded version.
+func (v *DataValidation) Changed() bool {
+	return v.HasRecorded && (v.Recorded.Size != v.Current.Size || !v.Recorded.ModTime.Equal(v.Current.ModTime) ||
+		v.Recorded.Checksum != v.Current.Checksum)
+}
+
+// ValidateAgainstData checks every entry of the index against the data file at dataPath, whose
+// rows are described by schema, and compares the file with the version recorded in the meta page.
+// Mismatches are reported in the result; the error is only for failures to read the index or the
+// data file.
+func (t *BPlusTree) ValidateAgainstData(dataPath string, schema CSVSchema) (*DataValidation, error) {
+	keyColumn, err := schema.keyColumn()
+	if err != nil {
+		return nil, err
+	}
+	v := &DataValidation{}
+	if v.Recorded, v.HasRecorded, err = t.DataFileInfo(); err != nil {
+		return nil, err
+	}
+	if v.Current, err = statDataFile(dataPath); err != nil {
+		return nil, err
+	}
+	file, err := os.Open(dataPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	c, err := t.Seek(math.MinInt)
+	if err != nil {
+		return nil, err
+	}
+	for c.Next() {
+		v.Entries++
+		key, offset := c.Key(), c.Value()
+		if problem := checkRowAt(file, v.Current.Size, offset, key, schema, keyColumn); problem != "" {
+			v.Mismatches = append(v.Mismatches, OffsetMismatch{Key: key, Offset: offset, Problem: problem})
+		}
+	}
+	if err := c.Err(); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// checkRowAt parses the row at offset in the data file and returns what is wrong with it as the
+// row of key, or "" if nothing is.
+func checkRowAt(file *os.File, size, offset int64, key int, schema CSVSchema, keyColumn int) string {
+	if offset < 0 || offset >= size {
+		return fmt.Sprintf("offset is outside the data file of %d bytes", size)
+	}
+	if offset > 0 {
+		var before [1]byte
+		if _, err := file.ReadAt(before[:], offset-1); err != nil {
+			return err.Error()
+		}
+		if before[0] != '\n' {
+			return "offset is not at the start of a line"
+		}
+	}
+	reader := csv.NewReader(io.NewSectionReader(file, offset, size-offset))
+	if schema.Delimiter != 0 {
+		reader.Comma = schema.Delimiter
+	}
+	reader.FieldsPerRecord = len(schema.Columns)
+	fields, err := reader.Read()
+	if err != nil {
+		return fmt.Sprintf("row does not parse: %v", err)
+	}
+	if err := schema.checkRow(fields); err != nil {
+		return err.Error()
+	}
+	if rowKey, _ := strconv.Atoi(fields[keyColumn]); rowKey != key {
+		return fmt.Sprintf("row has key %d", rowKey)
+	}
+	return ""
+}
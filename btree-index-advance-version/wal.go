@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+)
+
+// =================================================================================================
+// --- wal.go --- (Write-Ahead Log)
+// =================================================================================================
+
+// The write-ahead log is an append-only file of records. Every change a transaction makes is
+// logged, and the log is forced to disk, before the change is applied to the index or heap file.
+// If the process crashes in between, replaying the log on the next open finishes the job.
+//
+// On-disk record format:
+//
+//	| length uint32 | crc32 uint32 | lsn uint64 | txID uint64 | type uint8 | target int64 | data ... |
+//
+// length and crc32 cover everything after them. A torn or corrupt record marks the end of the log.
+
+type walRecordType uint8
+
+const (
+	walBegin        walRecordType = iota + 1
+	walPageImage                  // data is the full page after the change, target is its PageID
+	walHeapAppend                 // data is a row appended to the heap file, target is its offset
+	walCommit                     // data is the commit time in Unix nanoseconds, as a uint64
+	walCheckpoint                 // every change logged before LSN target is in the index file
+	walReplicated                 // the transaction applied the leader's log up to LSN target (see replication.go)
+	walRaftVote                   // the node's Raft term is target; data is the node it voted for (see raft.go)
+	walRaftEntry                  // data is the Raft log entry at index target, replacing those from there on
+	walPrepare                    // the transaction is prepared as part of distributed transaction target (see twophase.go)
+	walAbort                      // the transaction rolled back, or the prepared transaction was aborted
+	walChange                     // key target of the transaction's tree changed rows (see cdc.go)
+	walPageUpdate                 // data is page target after the change, then before it; the page was stolen (see aries.go)
+	walCompensation               // data is the undoNext LSN, as a uint64, then page target as undoing an update restored it
+	walTxIDs                      // the distributed transaction IDs up to target may be handed out (see twophase.go)
+)
+
+const (
+	walFrameHeaderSize  = 8  // length + crc32
+	walRecordHeaderSize = 25 // lsn + txID + type + target
+	walMaxDataSize      = 1 << 20
+)
+
+var errCorruptWALRecord = errors.New("corrupt WAL record")
+
+// walRecord is a single entry in the write-ahead log. LSNs (log sequence numbers) increase
+// monotonically and identify a record's position in the history of the database.
+type walRecord struct {
+	lsn    uint64
+	txID   uint64
+	kind   walRecordType
+	target int64
+	data   []byte
+}
+
+// WAL is safe for concurrent use: the buffer pool's flusher logs checkpoints while transactions
+// commit.
+type WAL struct {
+	mu      sync.Mutex
+	file    *os.File
+	writer  *bufio.Writer
+	nextLSN uint64
+	// syncedLSN is the LSN of the last record known to be on disk.
+	syncedLSN uint64
+	// metrics counts the appended bytes and the fsyncs, if set (see metrics.go).
+	metrics Metrics
+}
+
+// OpenWAL opens (or creates) the log at path and returns the records that are already in it.
+// A partially written record at the end of the log, left behind by a crash, is truncated away.
+func OpenWAL(path string) (*WAL, []walRecord, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	records, validSize, err := readWALRecords(bufio.NewReader(file))
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	if err := file.Truncate(validSize); err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	if _, err := file.Seek(validSize, io.SeekStart); err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+
+	w := &WAL{file: file, writer: bufio.NewWriter(file), nextLSN: 1}
+	if len(records) > 0 {
+		w.nextLSN = records[len(records)-1].lsn + 1
+		w.syncedLSN = records[len(records)-1].lsn
+	}
+	return w, records, nil
+}
+
+// Append assigns the next LSN to a record and adds it to the log buffer.
+// The record is not durable until Sync returns.
+func (w *WAL) Append(record *walRecord) (uint64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	record.lsn = w.nextLSN
+	w.nextLSN++
+	encoded := encodeWALRecord(record)
+	if _, err := w.writer.Write(encoded); err != nil {
+		return 0, err
+	}
+	if w.metrics != nil {
+		w.metrics.WALAppend(len(encoded))
+	}
+	return record.lsn, nil
+}
+
+// lastLSN returns the LSN of the last record appended to the log, or 0 if it is empty.
+func (w *WAL) lastLSN() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.nextLSN - 1
+}
+
+// Sync forces every appended record to disk.
+func (w *WAL) Sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	lsn := w.nextLSN - 1
+	if err := w.writer.Flush(); err != nil {
+		return err
+	}
+	if w.metrics != nil {
+		w.metrics.Fsync("wal")
+	}
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	w.syncedLSN = lsn
+	return nil
+}
+
+// SyncTo forces the log to disk if the record at lsn isn't there yet.
+func (w *WAL) SyncTo(lsn uint64) error {
+	w.mu.Lock()
+	synced := w.syncedLSN >= lsn
+	w.mu.Unlock()
+	if synced {
+		return nil
+	}
+	return w.Sync()
+}
+
+// setMetrics installs the metrics the log reports to, or removes them if metrics is nil.
+func (w *WAL) setMetrics(metrics Metrics) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.metrics = metrics
+}
+
+func (w *WAL) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.writer.Flush(); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
+
+func encodeWALRecord(record *walRecord) []byte {
+	bodySize := walRecordHeaderSize + len(record.data)
+	buf := make([]byte, walFrameHeaderSize+bodySize)
+	body := buf[walFrameHeaderSize:]
+	binary.LittleEndian.PutUint64(body[0:], record.lsn)
+	binary.LittleEndian.PutUint64(body[8:], record.txID)
+	body[16] = byte(record.kind)
+	binary.LittleEndian.PutUint64(body[17:], uint64(record.target))
+	copy(body[walRecordHeaderSize:], record.data)
+
+	binary.LittleEndian.PutUint32(buf[0:], uint32(bodySize))
+	binary.LittleEndian.PutUint32(buf[4:], crc32.ChecksumIEEE(body))
+	return buf
+}
+
+// readWALRecords decodes records until the end of the log, or until the first torn or corrupt
+// record. It returns the decoded records and the size of the valid prefix of the log.
+func readWALRecords(r io.Reader) ([]walRecord, int64, error) {
+	var records []walRecord
+	var validSize int64
+	for {
+		record, size, err := readWALRecord(r)
+		if err == io.EOF || err == io.ErrUnexpectedEOF || err == errCorruptWALRecord {
+			return records, validSize, nil
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		records = append(records, record)
+		validSize += size
+	}
+}
+
+func readWALRecord(r io.Reader) (walRecord, int64, error) {
+	var header [walFrameHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return walRecord{}, 0, err
+	}
+	bodySize := binary.LittleEndian.Uint32(header[0:])
+	if bodySize < walRecordHeaderSize || bodySize > walRecordHeaderSize+walMaxDataSize {
+		return walRecord{}, 0, errCorruptWALRecord
+	}
+	body := make([]byte, bodySize)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return walRecord{}, 0, err
+	}
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(header[4:]) {
+		return walRecord{}, 0, errCorruptWALRecord
+	}
+
+	record := walRecord{
+		lsn:    binary.LittleEndian.Uint64(body[0:]),
+		txID:   binary.LittleEndian.Uint64(body[8:]),
+		kind:   walRecordType(body[16]),
+		target: int64(binary.LittleEndian.Uint64(body[17:])),
+		data:   body[walRecordHeaderSize:],
+	}
+	return record, int64(walFrameHeaderSize + bodySize), nil
+}
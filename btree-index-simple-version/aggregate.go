@@ -0,0 +1,47 @@
+package main
+
+import "golang.org/x/exp/constraints"
+
+// =================================================================================================
+// Counts and Aggregates over Key Ranges
+// =================================================================================================
+
+// Aggregates over the index key only need the leaves: COUNT, MIN, MAX and SUM over the id column
+// never dereference a RecordOffset into the data file. CountRange doesn't even need the leaves,
+// thanks to the subtree sizes (see orderstat.go).
+
+// RangeAggregate holds the aggregates of the keys in a range. Min and Max are only meaningful
+// when Count > 0.
+type RangeAggregate[K any] struct {
+	Count    int
+	Min, Max K
+}
+
+// AggregateRange returns the count, minimum and maximum of the keys in [startKey, endKey].
+func (t *BPlusTree[K, V]) AggregateRange(startKey, endKey K) RangeAggregate[K] {
+	var agg RangeAggregate[K]
+	if t.less(endKey, startKey) {
+		return agg
+	}
+	for c := t.Seek(startKey); c.Next() && !t.less(endKey, c.Key()); {
+		if agg.Count == 0 {
+			agg.Min = c.Key()
+		}
+		agg.Count++
+		agg.Max = c.Key()
+	}
+	return agg
+}
+
+// SumRange returns the sum of the keys in [startKey, endKey]. It is a function rather than a
+// method because only numeric keys can be summed.
+func SumRange[K constraints.Integer | constraints.Float, V any](t *BPlusTree[K, V], startKey, endKey K) K {
+	var sum K
+	if t.less(endKey, startKey) {
+		return sum
+	}
+	for c := t.Seek(startKey); c.Next() && !t.less(endKey, c.Key()); {
+		sum += c.Key()
+	}
+	return sum
+}
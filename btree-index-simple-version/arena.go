@@ -0,0 +1,135 @@
+package main
+
+// =================================================================================================
+// Node Arena
+// =================================================================================================
+
+// Every node is a separate allocation, and so are its arrays of keys and of values or children: a
+// tree of a million keys at degree 128 is some 30,000 objects for the garbage collector to track,
+// and a tree at degree 4 over a million. With an arena, a tree takes its nodes and their arrays
+// from slabs that each hold arenaSlabNodes of them instead:
+//
+//	tree := NewBPlusTree[int, RecordOffset](128)
+//	tree.SetArena(true)
+//	... build, query ...
+//	tree.Reset() // drop every node at once
+//	... build again, in the same slabs ...
+//
+// A node that a merge removes, or a root that goes away, goes on a free list, and the next split
+// takes it from there before it takes a new one from the slabs. Reset drops the whole tree in O(1)
+// and hands the slabs out again from the start, so a rebuild allocates nothing until it outgrows
+// the previous tree. Nothing may hold on to a node across a Reset, or across a Delete, such as a
+// Cursor, since its memory is about to hold another node. Without an arena, Reset leaves the old
+// nodes to the garbage collector.
+
+// arenaSlabNodes is the number of nodes a slab has room for.
+const arenaSlabNodes = 256
+
+// slabs hands out pieces of slabs of T, allocating a new slab when the ones it has are used up.
+type slabs[T any] struct {
+	slabs [][]T
+	slab  int // the slab pieces are handed out of
+	used  int // how much of it is handed out
+}
+
+// alloc returns a piece of n elements, holding whatever the last user of the memory left. Its
+// capacity is n, so appending past it moves the piece out of the slab.
+func (s *slabs[T]) alloc(n int) []T {
+	for s.slab < len(s.slabs) {
+		if slab := s.slabs[s.slab]; s.used+n <= len(slab) {
+			piece := slab[s.used : s.used+n : s.used+n]
+			s.used += n
+			return piece
+		}
+		s.slab, s.used = s.slab+1, 0
+	}
+	s.slabs = append(s.slabs, make([]T, arenaSlabNodes*n))
+	return s.alloc(n)
+}
+
+// reset hands the slabs out again from the start.
+func (s *slabs[T]) reset() {
+	s.slab, s.used = 0, 0
+}
+
+// nodeArena is where a tree with an arena allocates its nodes.
+type nodeArena[K, V any] struct {
+	nodes    slabs[Node[K, V]]
+	keys     slabs[K]
+	values   slabs[V]
+	children slabs[*Node[K, V]]
+	// Released nodes for reuse, with their arrays: leaves, and internal nodes.
+	freeLeaves, freeInternal []*Node[K, V]
+}
+
+// SetArena sets whether the tree allocates its nodes from an arena. It can be changed at any time:
+// nodes allocated before keep their memory either way.
+func (t *BPlusTree[K, V]) SetArena(enabled bool) {
+	switch {
+	case enabled && t.arena == nil:
+		t.arena = &nodeArena[K, V]{}
+	case !enabled:
+		t.arena = nil
+	}
+}
+
+// Reset removes every entry from the tree, and the NULL bucket. The degree, key order, tracer, null
+// key policy, arena and index information stay as they are.
+func (t *BPlusTree[K, V]) Reset() {
+	t.root = nil
+	t.nulls = nil
+	if a := t.arena; a != nil {
+		a.nodes.reset()
+		a.keys.reset()
+		a.values.reset()
+		a.children.reset()
+		a.freeLeaves = a.freeLeaves[:0]
+		a.freeInternal = a.freeInternal[:0]
+	}
+}
+
+// newNode returns an empty node from the arena, a released one if there is one.
+func (a *nodeArena[K, V]) newNode(isLeaf bool, degree int) *Node[K, V] {
+	free := &a.freeInternal
+	if isLeaf {
+		free = &a.freeLeaves
+	}
+	if n := len(*free); n > 0 {
+		node := (*free)[n-1]
+		*free = (*free)[:n-1]
+		*node = Node[K, V]{isLeaf: isLeaf, keys: node.keys[:0], children: node.children[:0], values: node.values[:0]}
+		return node
+	}
+
+	node := &a.nodes.alloc(1)[0]
+	*node = Node[K, V]{isLeaf: isLeaf, keys: a.keys.alloc(degree)[:0]}
+	if isLeaf {
+		node.values = a.values.alloc(degree)[:0]
+	} else {
+		node.children = a.children.alloc(degree + 1)[:0]
+	}
+	return node
+}
+
+// releaseNode hands a node that is no longer in the tree back to the arena, if the tree has one.
+func (t *BPlusTree[K, V]) releaseNode(node *Node[K, V]) {
+	if t.arena == nil {
+		return
+	}
+	if node.isLeaf {
+		t.arena.freeLeaves = append(t.arena.freeLeaves, node)
+	} else {
+		t.arena.freeInternal = append(t.arena.freeInternal, node)
+	}
+}
+
+// releaseSubtree hands node and every node under it back to the arena, if the tree has one.
+func (t *BPlusTree[K, V]) releaseSubtree(node *Node[K, V]) {
+	if t.arena == nil || node == nil {
+		return
+	}
+	for _, child := range node.children {
+		t.releaseSubtree(child)
+	}
+	t.releaseNode(node)
+}
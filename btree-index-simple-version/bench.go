@@ -0,0 +1,27 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"os/exec"
+)
+
+// =================================================================================================
+// Benchmark Suite
+// =================================================================================================
+
+// The benchmarks are Benchmark functions in bench_test.go. `go run . bench` is a shortcut that runs
+// them with `go test`, from this module's directory.
+
+// benchCommand implements `go run . bench [-bench regexp] [-sizes 10000,100000]`. It runs the
+// benchmarks that match -bench with `go test -bench` and passes -sizes on to them.
+func benchCommand(args []string) error {
+	flags := flag.NewFlagSet("bench", flag.ExitOnError)
+	pattern := flags.String("bench", ".", "regular expression selecting the benchmarks to run")
+	sizes := flags.String("sizes", "", "comma-separated dataset sizes (default 10000,100000,1000000)")
+	flags.Parse(args)
+
+	cmd := exec.Command("go", "test", "-run", "^$", "-bench", *pattern, "-timeout", "0", ".", "-args", "-sizes="+*sizes)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	return cmd.Run()
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// The benchmark suite runs with `go test -bench .`, or `go run . bench` (see bench.go). Each
+// benchmark has a sub-benchmark for every index, dataset size and insert order, named
+// <index>/<order>/<size>, and -sizes picks the sizes:
+//
+//	go test -run '^$' -bench Lookup -args -sizes 10000
+//
+// The datasets and metrics here mirror the benchmark suite of the on-disk version
+// (btree-index-advance-version/bench_test.go) so the two sets of numbers can be compared side by
+// side. Since this tree has no pages, "pages touched" counts the nodes visited or modified instead.
+//
+// The benchmarks take an OrderedIndex, so every index in benchIndexes runs the same matrix of
+// sizes, orders and operations. Only the B+ Tree has a Tracer, so only its lines count pages.
+// Insert and Lookup also report the heap allocations of one insert or lookup, measured in a
+// separate run without the tracer, which copies the keys of every node it is told about.
+
+var sizesFlag = flag.String("sizes", "", "comma-separated dataset sizes (default 10000,100000,1000000)")
+
+// benchDegree gives nodes a realistic fan-out instead of the tiny degree used by the demo.
+const benchDegree = 128
+
+// benchRangeWidth is the number of consecutive keys read by each range scan.
+const benchRangeWidth = 1000
+
+var defaultBenchSizes = []int{10_000, 100_000, 1_000_000}
+
+// benchIndex is an index implementation the suite runs against.
+type benchIndex struct {
+	name string
+	new  func() OrderedIndex[int]
+}
+
+var benchIndexes = []benchIndex{
+	{"InMemory", func() OrderedIndex[int] { return NewBPlusTree[int, RecordOffset](benchDegree) }},
+	{"InMemoryArena", func() OrderedIndex[int] {
+		tree := NewBPlusTree[int, RecordOffset](benchDegree)
+		tree.SetArena(true)
+		return tree
+	}},
+	{"SkipList", func() OrderedIndex[int] { return NewSkipList[int]() }},
+}
+
+// pageCounter is a Tracer that only counts node accesses. The benchmarks use it to report
+// how many nodes each operation touches.
+type pageCounter struct {
+	reads, writes int64
+}
+
+func (c *pageCounter) OnSplit(isLeaf bool, left, right []int) {}
+func (c *pageCounter) OnPromote(key int, newRoot bool)        {}
+func (c *pageCounter) OnMerge(isLeaf bool, merged []int)      {}
+func (c *pageCounter) OnPageRead(keys []int)                  { c.reads++ }
+func (c *pageCounter) OnPageWrite(keys []int)                 { c.writes++ }
+
+func (c *pageCounter) touched() int64 { return c.reads + c.writes }
+
+// countPages installs a new pageCounter on index if it is a B+ Tree, and returns it with a function
+// that removes it again. For any other index it returns nil.
+func countPages(index OrderedIndex[int]) (*pageCounter, func()) {
+	tree, ok := index.(*Index[int])
+	if !ok {
+		return nil, func() {}
+	}
+	counter := &pageCounter{}
+	tree.SetTracer(counter)
+	return counter, func() { tree.SetTracer(nil) }
+}
+
+// generateKeys returns the keys 0..n-1, either in ascending order or shuffled with a fixed seed
+// so that every run inserts them in the same order.
+func generateKeys(n int, random bool) []int {
+	if !random {
+		keys := make([]int, n)
+		for i := range keys {
+			keys[i] = i
+		}
+		return keys
+	}
+	return rand.New(rand.NewSource(42)).Perm(n)
+}
+
+// buildBenchIndex creates an index holding the given keys, which must be unique. Each key's offset
+// is derived from the key.
+func buildBenchIndex(impl benchIndex, keys []int) OrderedIndex[int] {
+	index := impl.new()
+	for _, k := range keys {
+		index.Insert(k, RecordOffset(k)*10)
+	}
+	return index
+}
+
+func benchmarkInsert(impl benchIndex, keys []int) func(b *testing.B) {
+	return func(b *testing.B) {
+		var touched int64
+		counted := false
+		for i := 0; i < b.N; i++ {
+			index := impl.new()
+			counter, stop := countPages(index)
+			for _, k := range keys {
+				if err := index.Insert(k, RecordOffset(k)*10); err != nil {
+					b.Fatal(err)
+				}
+			}
+			stop()
+			if counter != nil {
+				touched += counter.touched()
+				counted = true
+			}
+		}
+		inserts := float64(b.N * len(keys))
+		b.ReportMetric(inserts/b.Elapsed().Seconds(), "inserts/s")
+		if counted {
+			b.ReportMetric(float64(touched)/inserts, "pages/insert")
+		}
+		b.StopTimer()
+		allocs := testing.AllocsPerRun(1, func() { buildBenchIndex(impl, keys) })
+		b.ReportMetric(allocs/float64(len(keys)), "allocs/insert")
+	}
+}
+
+func benchmarkLookup(index OrderedIndex[int], keys []int) func(b *testing.B) {
+	return func(b *testing.B) {
+		counter, stop := countPages(index)
+		r := rand.New(rand.NewSource(7))
+
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			key := keys[r.Intn(len(keys))]
+			if _, found := index.Search(key); !found {
+				b.Fatalf("lookup of key %d failed", key)
+			}
+		}
+		b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "lookups/s")
+		if counter != nil {
+			b.ReportMetric(float64(counter.touched())/float64(b.N), "pages/lookup")
+		}
+		stop()
+		b.StopTimer()
+		allocs := testing.AllocsPerRun(1000, func() { index.Search(keys[r.Intn(len(keys))]) })
+		b.ReportMetric(allocs, "allocs/lookup")
+	}
+}
+
+func benchmarkRangeScan(index OrderedIndex[int], n int) func(b *testing.B) {
+	return func(b *testing.B) {
+		counter, stop := countPages(index)
+		defer stop()
+		r := rand.New(rand.NewSource(7))
+		width := min(benchRangeWidth, n)
+
+		b.ResetTimer()
+		scanned := 0
+		for i := 0; i < b.N; i++ {
+			start := r.Intn(n - width + 1)
+			scanned += len(index.SearchRange(start, start+width-1))
+		}
+		b.ReportMetric(float64(scanned)/b.Elapsed().Seconds(), "keys/s")
+		if counter != nil {
+			b.ReportMetric(float64(counter.touched())/float64(b.N), "pages/scan")
+		}
+	}
+}
+
+// runDatasets runs a sub-benchmark for every index in benchIndexes and every dataset size -sizes
+// asks for, in both sequential and random insert order. setup runs, untimed, the first time the
+// sub-benchmark runs, so datasets that -bench filters out are never built.
+func runDatasets(b *testing.B, setup func(impl benchIndex, keys []int) func(b *testing.B)) {
+	sizes := defaultBenchSizes
+	if *sizesFlag != "" {
+		var err error
+		if sizes, err = parseSizes(*sizesFlag); err != nil {
+			b.Fatal(err)
+		}
+	}
+	for _, impl := range benchIndexes {
+		for _, n := range sizes {
+			for _, random := range []bool{false, true} {
+				order := "sequential"
+				if random {
+					order = "random"
+				}
+				var run func(b *testing.B)
+				b.Run(fmt.Sprintf("%s/%s/%d", impl.name, order, n), func(b *testing.B) {
+					if run == nil {
+						b.StopTimer()
+						run = setup(impl, generateKeys(n, random))
+						b.StartTimer()
+					}
+					run(b)
+				})
+			}
+		}
+	}
+}
+
+func BenchmarkInsert(b *testing.B) {
+	runDatasets(b, benchmarkInsert)
+}
+
+func BenchmarkLookup(b *testing.B) {
+	runDatasets(b, func(impl benchIndex, keys []int) func(b *testing.B) {
+		return benchmarkLookup(buildBenchIndex(impl, keys), keys)
+	})
+}
+
+func BenchmarkRangeScan(b *testing.B) {
+	runDatasets(b, func(impl benchIndex, keys []int) func(b *testing.B) {
+		return benchmarkRangeScan(buildBenchIndex(impl, keys), len(keys))
+	})
+}
+
+func parseSizes(s string) ([]int, error) {
+	var sizes []int
+	for _, part := range strings.Split(s, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid dataset size %q", part)
+		}
+		sizes = append(sizes, n)
+	}
+	return sizes, nil
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"slices"
+)
+
+// =================================================================================================
+// Property-Based / Fuzz Checking
+// =================================================================================================
+
+// checkDegrees are the degrees exercised by the checker. Small degrees split and merge constantly.
+var checkDegrees = []int{3, 4, 5, 8}
+
+// referenceModel is the trivially correct model the tree is compared against.
+type referenceModel struct {
+	entries map[int]RecordOffset
+}
+
+// sortedKeys returns the model's keys in ascending order.
+func (m *referenceModel) sortedKeys() []int {
+	keys := make([]int, 0, len(m.entries))
+	for k := range m.entries {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// OrderedIndex is the interface shared by the B+ Tree and the skip list (skiplist.go). Both are
+// held to it by the same conformance checks.
+type OrderedIndex[K any] interface {
+	Insert(key K, offset RecordOffset) error
+	Upsert(key K, offset RecordOffset) bool
+	Search(key K) (RecordOffset, bool)
+	SearchRange(startKey, endKey K) []RecordOffset
+	Delete(key K) bool
+	Len() int
+}
+
+var (
+	_ OrderedIndex[int] = (*Index[int])(nil)
+	_ OrderedIndex[int] = (*SkipList[int])(nil)
+)
+
+// fuzzOps is the fuzz target for the B+ Tree: it runs checkConformance on a fresh tree of the given
+// degree, and also verifies the tree invariants after every operation. A tree with an arena runs
+// the operations a second time after a Reset, in the nodes of the first run.
+func fuzzOps(degree int, arena bool, data []byte) error {
+	tree := NewBPlusTree[int, RecordOffset](degree)
+	tree.SetArena(arena)
+	invariants := func() error {
+		if tree.Len() == 0 && tree.root != nil {
+			return fmt.Errorf("tree is empty but still has a root")
+		}
+		if err := checkRangeBounds(tree); err != nil {
+			return err
+		}
+		return checkInvariants(tree)
+	}
+	if err := checkConformance(tree, data, invariants); err != nil || !arena {
+		return err
+	}
+	tree.Reset()
+	if err := checkConformance(tree, data, invariants); err != nil {
+		return fmt.Errorf("after Reset: %w", err)
+	}
+	return nil
+}
+
+// fuzzSkipListOps is the fuzz target for the skip list, like fuzzOps.
+func fuzzSkipListOps(data []byte) error {
+	list := NewSkipList[int]()
+	return checkConformance(list, data, func() error { return checkSkipListInvariants(list) })
+}
+
+// checkConformance decodes data as a sequence of operations, applies each one to index and to the
+// reference model, and verifies after every operation that they agree and that invariants, the
+// checks specific to the implementation, hold. Each operation takes three bytes: an opcode and
+// two key bytes.
+func checkConformance(index OrderedIndex[int], data []byte, invariants func() error) error {
+	model := &referenceModel{entries: make(map[int]RecordOffset)}
+
+	for i := 0; i+2 < len(data); i += 3 {
+		key := int(data[i+1])<<8 | int(data[i+2])
+		// Keep keys in a small range so operations collide with existing keys often.
+		key %= 512
+		offset := RecordOffset(key) * 10
+
+		var desc string
+		switch data[i] % 4 {
+		case 0:
+			desc = fmt.Sprintf("Insert(%d)", key)
+			_, exists := model.entries[key]
+			err := index.Insert(key, offset)
+			if exists != errors.Is(err, ErrDuplicateKey) || (!exists && err != nil) {
+				return fmt.Errorf("op %d %s: returned error %v with key present=%v", i/3, desc, err, exists)
+			}
+			if !exists {
+				model.entries[key] = offset
+			}
+		case 1:
+			// Replace with a different offset, so a missed replacement shows up in the model check.
+			desc = fmt.Sprintf("Upsert(%d)", key)
+			_, exists := model.entries[key]
+			if replaced := index.Upsert(key, offset+1); replaced != exists {
+				return fmt.Errorf("op %d %s: returned %v, want %v", i/3, desc, replaced, exists)
+			}
+			model.entries[key] = offset + 1
+		case 2:
+			desc = fmt.Sprintf("Delete(%d)", key)
+			_, exists := model.entries[key]
+			if deleted := index.Delete(key); deleted != exists {
+				return fmt.Errorf("op %d %s: returned %v, want %v", i/3, desc, deleted, exists)
+			}
+			delete(model.entries, key)
+		case 3:
+			desc = fmt.Sprintf("Search(%d)", key)
+			want, exists := model.entries[key]
+			got, found := index.Search(key)
+			if found != exists || got != want {
+				return fmt.Errorf("op %d %s: got (%d, %v), want (%d, %v)", i/3, desc, got, found, want, exists)
+			}
+		}
+
+		if err := checkAgainstModel(index, model); err != nil {
+			return fmt.Errorf("op %d %s: %w", i/3, desc, err)
+		}
+		if err := invariants(); err != nil {
+			return fmt.Errorf("op %d %s: %w", i/3, desc, err)
+		}
+	}
+	return nil
+}
+
+// checkAgainstModel verifies that the size, a full range scan and a point lookup of every key agree
+// with the model.
+func checkAgainstModel(index OrderedIndex[int], model *referenceModel) error {
+	keys := model.sortedKeys()
+	if index.Len() != len(keys) {
+		return fmt.Errorf("Len() = %d, want %d", index.Len(), len(keys))
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+
+	offsets := index.SearchRange(keys[0], keys[len(keys)-1])
+	if len(offsets) != len(keys) {
+		return fmt.Errorf("range scan returned %d records, want %d", len(offsets), len(keys))
+	}
+	for i, k := range keys {
+		if offsets[i] != model.entries[k] {
+			return fmt.Errorf("range scan returned offset %d at position %d, want %d", offsets[i], i, model.entries[k])
+		}
+		if got, found := index.Search(k); !found || got != model.entries[k] {
+			return fmt.Errorf("Search(%d) = (%d, %v), want (%d, true)", k, got, found, model.entries[k])
+		}
+	}
+	return nil
+}
+
+// checkRangeBounds verifies Range under every combination of open and closed bounds, on bounds that
+// are keys of the tree, and ScanFrom, ScanTo and ScanAll, against the keys of the leaf chain.
+func checkRangeBounds(tree *Index[int]) error {
+	var keys []int
+	var values []RecordOffset
+	for leaf := tree.firstLeaf(); leaf != nil; leaf = leaf.next {
+		keys = append(keys, leaf.keys...)
+		values = append(values, leaf.values...)
+	}
+	if all := tree.ScanAll(); !slices.Equal(all, values) {
+		return fmt.Errorf("ScanAll() = %v, want %v", all, values)
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	// A range over a third of the keys, and a range of a single key.
+	bounds := [][2]int{{keys[len(keys)/3], keys[len(keys)*2/3]}, {keys[len(keys)/2], keys[len(keys)/2]}}
+	for _, b := range bounds {
+		for _, opts := range []RangeOptions{{}, {ExcludeStart: true}, {ExcludeEnd: true}, {true, true}} {
+			var want []RecordOffset
+			for i, k := range keys {
+				if (k > b[0] || k == b[0] && !opts.ExcludeStart) && (k < b[1] || k == b[1] && !opts.ExcludeEnd) {
+					want = append(want, values[i])
+				}
+			}
+			if got := tree.Range(b[0], b[1], opts); !slices.Equal(got, want) {
+				return fmt.Errorf("Range(%d, %d, %+v) = %v, want %v", b[0], b[1], opts, got, want)
+			}
+		}
+	}
+	// The bounds of the first range, and a key between them that may be missing.
+	for _, key := range []int{bounds[0][0], bounds[0][1], (bounds[0][0] + bounds[0][1]) / 2} {
+		from, _ := slices.BinarySearch(keys, key)
+		if got := tree.ScanFrom(key); !slices.Equal(got, values[from:]) {
+			return fmt.Errorf("ScanFrom(%d) = %v, want %v", key, got, values[from:])
+		}
+		to, _ := slices.BinarySearch(keys, key+1)
+		if got := tree.ScanTo(key); !slices.Equal(got, values[:to]) {
+			return fmt.Errorf("ScanTo(%d) = %v, want %v", key, got, values[:to])
+		}
+	}
+	return nil
+}
+
+// checkInvariants verifies the structural B+ tree invariants: node occupancy, sorted keys that
+// respect the separators above them, consistent parent pointers, subtree sizes, all leaves at the
+// same depth, and a leaf chain that visits the leaves in key order.
+func checkInvariants(tree *Index[int]) error {
+	if tree.root == nil {
+		return nil
+	}
+	if tree.root.parent != nil {
+		return fmt.Errorf("root has a parent")
+	}
+
+	var leaves []*Node[int, RecordOffset]
+	leafDepth := -1
+	var walk func(node *Node[int, RecordOffset], depth int, low, high *int) error
+	walk = func(node *Node[int, RecordOffset], depth int, low, high *int) error {
+		if len(node.keys) >= tree.degree {
+			return fmt.Errorf("node %v holds %d keys, max is %d", node.keys, len(node.keys), tree.degree-1)
+		}
+		if node != tree.root && len(node.keys) < tree.minKeys() {
+			return fmt.Errorf("node %v holds %d keys, min is %d", node.keys, len(node.keys), tree.minKeys())
+		}
+		if !slices.IsSorted(node.keys) {
+			return fmt.Errorf("node keys %v are not sorted", node.keys)
+		}
+		for _, k := range node.keys {
+			if (low != nil && k < *low) || (high != nil && k >= *high) {
+				return fmt.Errorf("key %d in node %v is outside the range set by its ancestors", k, node.keys)
+			}
+		}
+
+		if node.isLeaf {
+			if len(node.values) != len(node.keys) || len(node.children) != 0 {
+				return fmt.Errorf("leaf %v has %d values and %d children", node.keys, len(node.values), len(node.children))
+			}
+			if node.size != len(node.keys) {
+				return fmt.Errorf("leaf %v records size %d", node.keys, node.size)
+			}
+			if leafDepth == -1 {
+				leafDepth = depth
+			} else if depth != leafDepth {
+				return fmt.Errorf("leaf %v is at depth %d, other leaves are at depth %d", node.keys, depth, leafDepth)
+			}
+			leaves = append(leaves, node)
+			return nil
+		}
+
+		if len(node.children) != len(node.keys)+1 || len(node.values) != 0 {
+			return fmt.Errorf("internal node %v has %d children and %d values", node.keys, len(node.children), len(node.values))
+		}
+		size := 0
+		for _, child := range node.children {
+			size += child.size
+		}
+		if node.size != size {
+			return fmt.Errorf("internal node %v records size %d, its children hold %d entries", node.keys, node.size, size)
+		}
+		for i, child := range node.children {
+			if child.parent != node {
+				return fmt.Errorf("child %v of node %v has a stale parent pointer", child.keys, node.keys)
+			}
+			childLow, childHigh := low, high
+			if i > 0 {
+				childLow = &node.keys[i-1]
+			}
+			if i < len(node.keys) {
+				childHigh = &node.keys[i]
+			}
+			if err := walk(child, depth+1, childLow, childHigh); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk(tree.root, 0, nil, nil); err != nil {
+		return err
+	}
+
+	for i, leaf := range leaves {
+		var want *Node[int, RecordOffset]
+		if i+1 < len(leaves) {
+			want = leaves[i+1]
+		}
+		if leaf.next != want {
+			return fmt.Errorf("leaf %v does not link to the next leaf in key order", leaf.keys)
+		}
+	}
+	return nil
+}
+
+// checkCommand implements `go run . check [-runs N] [-ops N] [-seed N]`. It feeds randomly
+// generated operation sequences to fuzzOps for every degree in checkDegrees, every other one with
+// an arena, and to fuzzSkipListOps.
+func checkCommand(args []string) error {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	runs := flags.Int("runs", 200, "number of random operation sequences per degree")
+	ops := flags.Int("ops", 500, "number of operations per sequence")
+	seed := flags.Int64("seed", 1, "random seed")
+	flags.Parse(args)
+
+	r := rand.New(rand.NewSource(*seed))
+	for _, degree := range checkDegrees {
+		for run := 0; run < *runs; run++ {
+			data := make([]byte, *ops*3)
+			r.Read(data)
+			if err := fuzzOps(degree, run%2 == 1, data); err != nil {
+				return fmt.Errorf("degree %d, run %d (seed %d): %w", degree, run, *seed, err)
+			}
+		}
+		fmt.Printf("degree %d: %d runs of %d operations passed\n", degree, *runs, *ops)
+	}
+	for run := 0; run < *runs; run++ {
+		data := make([]byte, *ops*3)
+		r.Read(data)
+		if err := fuzzSkipListOps(data); err != nil {
+			return fmt.Errorf("skip list, run %d (seed %d): %w", run, *seed, err)
+		}
+	}
+	fmt.Printf("skip list: %d runs of %d operations passed\n", *runs, *ops)
+	return nil
+}
+
+// checkSkipListInvariants verifies that every level of the list is sorted, that each level is a
+// subsequence of the one below it, that no level above the ones in use has nodes, and that the
+// bottom level holds Len() nodes.
+func checkSkipListInvariants(list *SkipList[int]) error {
+	onLevel := make(map[*skipListNode[int]]bool) // the nodes on the level below the one being checked
+	for level := 0; level < skipListMaxLevel; level++ {
+		if level >= list.level && list.head.next[level] != nil {
+			return fmt.Errorf("level %d has nodes, but only %d levels are in use", level, list.level)
+		}
+		count := 0
+		onThisLevel := make(map[*skipListNode[int]]bool)
+		for node := list.head.next[level]; node != nil; node = node.next[level] {
+			if len(node.next) <= level {
+				return fmt.Errorf("node %d is linked on level %d but is only %d levels high", node.key, level, len(node.next))
+			}
+			if level > 0 && !onLevel[node] {
+				return fmt.Errorf("node %d is on level %d but not on level %d", node.key, level, level-1)
+			}
+			if next := node.next[level]; next != nil && next.key <= node.key {
+				return fmt.Errorf("level %d is out of order: %d is followed by %d", level, node.key, next.key)
+			}
+			onThisLevel[node] = true
+			count++
+		}
+		if level == 0 && count != list.Len() {
+			return fmt.Errorf("bottom level holds %d nodes, Len() is %d", count, list.Len())
+		}
+		onLevel = onThisLevel
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// testRuns and testOps are the number of random operation sequences each test runs, per degree,
+// and their length; `go run . check` runs more of them.
+const (
+	testRuns = 20
+	testOps  = 500
+)
+
+// testSequences returns n random operation sequences of testOps operations each.
+func testSequences(r *rand.Rand, n int) [][]byte {
+	sequences := make([][]byte, n)
+	for i := range sequences {
+		sequences[i] = make([]byte, testOps*3)
+		r.Read(sequences[i])
+	}
+	return sequences
+}
+
+// TestOps runs fuzzOps on random operation sequences for each degree, with an arena on every other
+// run.
+func TestOps(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for _, degree := range checkDegrees {
+		t.Run(fmt.Sprintf("degree=%d", degree), func(t *testing.T) {
+			for run, data := range testSequences(r, testRuns) {
+				if err := fuzzOps(degree, run%2 == 1, data); err != nil {
+					t.Fatalf("run %d: %v", run, err)
+				}
+			}
+		})
+	}
+}
+
+// TestSkipListOps runs fuzzSkipListOps on random operation sequences.
+func TestSkipListOps(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for run, data := range testSequences(r, testRuns) {
+		if err := fuzzSkipListOps(data); err != nil {
+			t.Fatalf("run %d: %v", run, err)
+		}
+	}
+}
+
+// TestRangeBounds runs checkRangeBounds on a tree of each degree as it grows to 200 keys, one key
+// at a time in random order, and as it shrinks back to empty.
+func TestRangeBounds(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for _, degree := range checkDegrees {
+		tree := NewBPlusTree[int, RecordOffset](degree)
+		keys := r.Perm(200)
+		for _, key := range keys {
+			tree.Insert(key*2, RecordOffset(key))
+			if err := checkRangeBounds(tree); err != nil {
+				t.Fatalf("degree %d, %d keys: %v", degree, tree.Len(), err)
+			}
+		}
+		for _, key := range r.Perm(len(keys)) {
+			tree.Delete(key * 2)
+			if err := checkRangeBounds(tree); err != nil {
+				t.Fatalf("degree %d, %d keys: %v", degree, tree.Len(), err)
+			}
+		}
+	}
+}
+
+// FuzzOps runs fuzzOps under `go test -fuzz FuzzOps`: data is the operation sequence, checked
+// against the reference map after every operation, degree picks one of checkDegrees, and arena
+// says whether the tree allocates from an arena. The corpus starts with a random sequence for each
+// degree.
+func FuzzOps(f *testing.F) {
+	r := rand.New(rand.NewSource(1))
+	for i := range checkDegrees {
+		data := make([]byte, 500*3)
+		r.Read(data)
+		f.Add(uint8(i), i%2 == 1, data)
+	}
+	f.Fuzz(func(t *testing.T, degree uint8, arena bool, data []byte) {
+		d := checkDegrees[int(degree)%len(checkDegrees)]
+		if err := fuzzOps(d, arena, data); err != nil {
+			t.Fatalf("degree %d, arena %v: %v", d, arena, err)
+		}
+	})
+}
+
+// FuzzSkipListOps runs fuzzSkipListOps under `go test -fuzz FuzzSkipListOps`. The corpus starts
+// with a random sequence.
+func FuzzSkipListOps(f *testing.F) {
+	f.Add(testSequences(rand.New(rand.NewSource(1)), 1)[0])
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if err := fuzzSkipListOps(data); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
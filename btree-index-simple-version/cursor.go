@@ -0,0 +1,74 @@
+package main
+
+// =================================================================================================
+// Leaf Cursor
+// =================================================================================================
+
+// Cursor walks the leaf chain in key order, one entry at a time. It has the same API as the
+// cursor of the on-disk version (btree-index-advance-version/cursor.go):
+//
+//	c := tree.Seek(5)
+//	for c.Next() {
+//		fmt.Println(c.Key(), c.Value())
+//	}
+//
+// The tree must not be modified while a cursor is in use.
+type Cursor[K, V any] struct {
+	tree  *BPlusTree[K, V]
+	node  *Node[K, V] // current leaf, nil once the cursor is exhausted
+	index int         // entry of node returned by the next call to Next
+}
+
+// Seek returns a cursor positioned before the first entry whose key is >= key.
+func (t *BPlusTree[K, V]) Seek(key K) *Cursor[K, V] {
+	c := &Cursor[K, V]{tree: t}
+	if t.root == nil {
+		return c
+	}
+	c.node = t.findLeaf(key)
+	for c.index < len(c.node.keys) && t.less(c.node.keys[c.index], key) {
+		c.index++
+	}
+	return c
+}
+
+// Next advances the cursor to the next entry. It returns false when there are no more entries.
+func (c *Cursor[K, V]) Next() bool {
+	for c.node != nil {
+		if c.index < len(c.node.keys) {
+			c.index++
+			return true
+		}
+		c.advance()
+	}
+	return false
+}
+
+// Skip moves the cursor past the next n entries without returning them, so a following Next
+// returns the entry after those. It follows the leaf chain, so it still reads every leaf it
+// passes, but only to count its keys: the cost is one step per leaf rather than per entry.
+func (c *Cursor[K, V]) Skip(n int) {
+	for n > 0 && c.node != nil {
+		remaining := len(c.node.keys) - c.index
+		if n <= remaining {
+			c.index += n
+			return
+		}
+		n -= remaining
+		c.advance()
+	}
+}
+
+// advance moves the cursor to the start of the next leaf.
+func (c *Cursor[K, V]) advance() {
+	c.node, c.index = c.node.next, 0
+	if c.node != nil {
+		c.tree.traceRead(c.node)
+	}
+}
+
+// Key returns the key of the entry the cursor is on.
+func (c *Cursor[K, V]) Key() K { return c.node.keys[c.index-1] }
+
+// Value returns the value of the entry the cursor is on.
+func (c *Cursor[K, V]) Value() V { return c.node.values[c.index-1] }
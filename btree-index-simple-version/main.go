@@ -2,12 +2,23 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
+	"hash/crc32"
 	"io"
 	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 
 	"golang.org/x/exp/constraints"
 )
@@ -17,86 +28,122 @@ import (
 // by storing the byte offset of the row in our data file.
 type RecordOffset int64
 
-// Node represents a node in the B+ Tree.
-type Node[K constraints.Ordered] struct {
+// Node represents a node in the B+ Tree. A leaf has one value per key, and an internal node one
+// child more than it has keys; the other slice is empty.
+type Node[K, V any] struct {
 	isLeaf   bool
 	keys     []K
-	pointers []interface{} // Can point to *Node[K] or RecordOffset
-	parent   *Node[K]
-	next     *Node[K] // Pointer to the next leaf node
+	children []*Node[K, V] // of an internal node
+	values   []V           // of a leaf
+	parent   *Node[K, V]
+	next     *Node[K, V] // Pointer to the next leaf node
+	size     int         // Number of entries in the node's subtree (see orderstat.go)
 }
 
-// BPlusTree represents the entire B+ Tree structure.
-type BPlusTree[K constraints.Ordered] struct {
-	root   *Node[K]
-	degree int // Also known as 'order'. The max number of pointers from a node.
+// BPlusTree represents the entire B+ Tree structure: an ordered map from keys of type K to values
+// of type V. An index stores record offsets (see Index), but any type of value will do.
+type BPlusTree[K, V any] struct {
+	root   *Node[K, V]
+	degree int               // Also known as 'order'. The max number of pointers from a node.
+	less   func(a, b K) bool // Key order. Keys a and b are equal if neither is less than the other.
+	tracer Tracer[K]
+	// Rows without a usable key (see nullkey.go).
+	nullPolicy NullKeyPolicy
+	nulls      []V
+	info       IndexInfo        // What the index file records about the index.
+	arena      *nodeArena[K, V] // Where nodes are allocated, if not on the heap (see arena.go).
 }
 
-// NewBPlusTree creates and initializes a new B+ Tree.
-func NewBPlusTree[K constraints.Ordered](degree int) *BPlusTree[K] {
+// Index is a B+ Tree used as an index: the value of a key is the offset of its row in the data
+// file. Building from a data file (buildTreeFromFile) and the benchmarks and checks work on it.
+type Index[K any] = BPlusTree[K, RecordOffset]
+
+// ErrDuplicateKey is returned by Insert for a key that is already in the tree. It is wrapped with
+// the key, so compare with errors.Is.
+var ErrDuplicateKey = errors.New("key already exists")
+
+// NewBPlusTree creates and initializes a new B+ Tree. The value type has to be given, as in
+// NewBPlusTree[int, RecordOffset](4) for an Index[int].
+func NewBPlusTree[K constraints.Ordered, V any](degree int) *BPlusTree[K, V] {
+	return NewBPlusTreeFunc[K, V](degree, cmp.Less[K])
+}
+
+// NewBPlusTreeFunc creates a B+ Tree that orders its keys with less instead of the < operator.
+// This allows keys that aren't constraints.Ordered, such as structs, and custom orders, such as
+// case-insensitive strings or a reverse order. less must be a strict weak ordering, like the
+// comparison functions of sort.Slice; keys for which neither is less than the other count as
+// the same key.
+func NewBPlusTreeFunc[K, V any](degree int, less func(a, b K) bool) *BPlusTree[K, V] {
 	if degree < 3 {
 		panic("B+ Tree degree must be at least 3")
 	}
-	return &BPlusTree[K]{
+	return &BPlusTree[K, V]{
 		root:   nil,
 		degree: degree,
+		less:   less,
+		info:   IndexInfo{KeyType: keyTypeName[K](), CreatedAt: time.Now().UTC()},
 	}
 }
 
+// equal reports whether two keys are the same key under the tree's order.
+func (t *BPlusTree[K, V]) equal(a, b K) bool {
+	return !t.less(a, b) && !t.less(b, a)
+}
+
 // =================================================================================================
 // Search Operations
 // =================================================================================================
 
-// Search finds the offset associated with a given key.
-func (t *BPlusTree[K]) Search(key K) (RecordOffset, bool) {
+// Search finds the value stored under a given key.
+func (t *BPlusTree[K, V]) Search(key K) (V, bool) {
+	var zero V
 	if t.root == nil {
-		return 0, false
+		return zero, false
 	}
 
 	leafNode := t.findLeaf(key)
 	for i, k := range leafNode.keys {
-		if k == key {
+		if t.equal(k, key) {
 			// In a B+ Tree, leaf node pointers are the actual records (or pointers to them).
-			return leafNode.pointers[i].(RecordOffset), true
+			return leafNode.values[i], true
 		}
 	}
-	return 0, false
+	return zero, false
 }
 
-// SearchRange finds all records for keys within the given range [startKey, endKey].
-func (t *BPlusTree[K]) SearchRange(startKey, endKey K) []RecordOffset {
-	if startKey > endKey {
+// SearchRange finds the values of all keys within the given range [startKey, endKey]. It is Range
+// with both bounds included (see scan.go).
+func (t *BPlusTree[K, V]) SearchRange(startKey, endKey K) []V {
+	return t.Range(startKey, endKey, RangeOptions{})
+}
+
+// SearchRangeLimit returns at most limit values of the keys within [startKey, endKey], after
+// skipping the first offset of them, like LIMIT/OFFSET in SQL. A negative limit means no limit.
+// The scan stops visiting leaves as soon as the page of results is complete.
+func (t *BPlusTree[K, V]) SearchRangeLimit(startKey, endKey K, limit, offset int) []V {
+	if t.less(endKey, startKey) || limit == 0 {
 		return nil
 	}
-
-	leafNode := t.findLeaf(startKey)
-	var results []RecordOffset
-
-	for leafNode != nil {
-		for i, k := range leafNode.keys {
-			if k >= startKey && k <= endKey {
-				results = append(results, leafNode.pointers[i].(RecordOffset))
-			}
-			// If we've passed the endKey in a sorted list, we can stop.
-			if k > endKey {
-				return results
-			}
-		}
-		// Move to the next leaf node using the linked list pointer.
-		leafNode = leafNode.next
+	c := t.Seek(startKey)
+	c.Skip(offset)
+	var results []V
+	for (limit < 0 || len(results) < limit) && c.Next() && !t.less(endKey, c.Key()) {
+		results = append(results, c.Value())
 	}
 	return results
 }
 
 // findLeaf traverses the tree to find the appropriate leaf node for a given key.
-func (t *BPlusTree[K]) findLeaf(key K) *Node[K] {
+func (t *BPlusTree[K, V]) findLeaf(key K) *Node[K, V] {
 	currentNode := t.root
+	t.traceRead(currentNode)
 	for !currentNode.isLeaf {
 		i := 0
-		for i < len(currentNode.keys) && key >= currentNode.keys[i] {
+		for i < len(currentNode.keys) && !t.less(key, currentNode.keys[i]) {
 			i++
 		}
-		currentNode = currentNode.pointers[i].(*Node[K])
+		currentNode = currentNode.children[i]
+		t.traceRead(currentNode)
 	}
 	return currentNode
 }
@@ -105,62 +152,94 @@ func (t *BPlusTree[K]) findLeaf(key K) *Node[K] {
 // Insertion Operations
 // =================================================================================================
 
-// Insert adds a new key and its record offset into the tree.
-func (t *BPlusTree[K]) Insert(key K, offset RecordOffset) {
+// Insert adds a new key and its value into the tree. Keys are unique, like a primary key:
+// inserting a key that is already present returns ErrDuplicateKey and leaves the tree unchanged.
+// Use Upsert to replace the value instead.
+func (t *BPlusTree[K, V]) Insert(key K, value V) error {
 	// Case 1: The tree is empty.
 	if t.root == nil {
-		t.root = &Node[K]{
-			isLeaf:   true,
-			keys:     []K{key},
-			pointers: []interface{}{offset},
-			parent:   nil,
-		}
-		return
+		t.root = t.newNode(true)
+		t.root.keys = append(t.root.keys, key)
+		t.root.values = append(t.root.values, value)
+		t.root.size = 1
+		t.traceWrite(t.root)
+		return nil
 	}
 
 	leafNode := t.findLeaf(key)
 
-	// Check for duplicates before inserting.
+	// Check for duplicates before inserting, like a unique constraint.
 	for _, k := range leafNode.keys {
-		if k == key {
-			// In a real DB, this might throw a unique constraint violation error.
-			fmt.Printf("Key %v already exists. Ignoring insertion.\n", key)
-			return
+		if t.equal(k, key) {
+			return fmt.Errorf("%w: %v", ErrDuplicateKey, key)
 		}
 	}
 
 	// Insert into the leaf node.
-	t.insertIntoLeaf(leafNode, key, offset)
+	t.insertIntoLeaf(leafNode, key, value)
+	for node := leafNode; node != nil; node = node.parent {
+		node.size++
+	}
 
 	// A node splits when the number of keys equals the degree.
 	// (Max keys = degree - 1)
 	if len(leafNode.keys) == t.degree {
 		t.splitAndPromote(leafNode)
 	}
+	return nil
+}
+
+// Upsert inserts a key with its value, or replaces the value if the key is already in the tree.
+// It reports whether an existing value was replaced.
+func (t *BPlusTree[K, V]) Upsert(key K, value V) bool {
+	if t.root != nil {
+		leafNode := t.findLeaf(key)
+		for i, k := range leafNode.keys {
+			if t.equal(k, key) {
+				leafNode.values[i] = value
+				t.traceWrite(leafNode)
+				return true
+			}
+		}
+	}
+	t.Insert(key, value) // can't fail, the key isn't present
+	return false
 }
 
-// insertIntoLeaf inserts a key-offset pair into a leaf node, maintaining sorted order.
-func (t *BPlusTree[K]) insertIntoLeaf(node *Node[K], key K, offset RecordOffset) {
+// newNode returns an empty node whose arrays have room for a full node plus the entry that makes it
+// split, so inserts shift entries within them instead of growing them.
+func (t *BPlusTree[K, V]) newNode(isLeaf bool) *Node[K, V] {
+	if t.arena != nil {
+		return t.arena.newNode(isLeaf, t.degree)
+	}
+	node := &Node[K, V]{isLeaf: isLeaf, keys: make([]K, 0, t.degree)}
+	if isLeaf {
+		node.values = make([]V, 0, t.degree)
+	} else {
+		node.children = make([]*Node[K, V], 0, t.degree+1)
+	}
+	return node
+}
+
+// insertIntoLeaf inserts a key-value pair into a leaf node, maintaining sorted order. The entries
+// after it are shifted in place.
+func (t *BPlusTree[K, V]) insertIntoLeaf(node *Node[K, V], key K, value V) {
 	insertPos := 0
-	for insertPos < len(node.keys) && key > node.keys[insertPos] {
+	for insertPos < len(node.keys) && t.less(node.keys[insertPos], key) {
 		insertPos++
 	}
 
-	node.keys = append(node.keys[:insertPos], append([]K{key}, node.keys[insertPos:]...)...)
-	node.pointers = append(node.pointers[:insertPos], append([]interface{}{offset}, node.pointers[insertPos:]...)...)
+	node.keys = slices.Insert(node.keys, insertPos, key)
+	node.values = slices.Insert(node.values, insertPos, value)
+	t.traceWrite(node)
 }
 
 // splitAndPromote handles the splitting of a node (leaf or internal) and promotes a key to the parent.
-func (t *BPlusTree[K]) splitAndPromote(node *Node[K]) {
+func (t *BPlusTree[K, V]) splitAndPromote(node *Node[K, V]) {
 	splitPoint := t.degree / 2
 
-	newRightNode := &Node[K]{
-		isLeaf: node.isLeaf,
-		parent: node.parent,
-		// Pre-allocate slices with capacity to avoid multiple re-allocations
-		keys:     make([]K, 0, t.degree),
-		pointers: make([]interface{}, 0, t.degree+1),
-	}
+	newRightNode := t.newNode(node.isLeaf)
+	newRightNode.parent = node.parent
 
 	var keyToPromote K
 
@@ -168,18 +247,21 @@ func (t *BPlusTree[K]) splitAndPromote(node *Node[K]) {
 		// --- Leaf Node Split Logic ---
 		// Copy second half to the new node
 		newRightNode.keys = append(newRightNode.keys, node.keys[splitPoint:]...)
-		newRightNode.pointers = append(newRightNode.pointers, node.pointers[splitPoint:]...)
+		newRightNode.values = append(newRightNode.values, node.values[splitPoint:]...)
 
 		// The key to promote is the first key of the new right node (it's a copy)
 		keyToPromote = newRightNode.keys[0]
 
 		// Truncate original node
 		node.keys = node.keys[:splitPoint]
-		node.pointers = node.pointers[:splitPoint]
+		node.values = node.values[:splitPoint]
 
 		// Link the leaf nodes' sibling pointers
 		newRightNode.next = node.next
 		node.next = newRightNode
+
+		node.size = len(node.keys)
+		newRightNode.size = len(newRightNode.keys)
 	} else {
 		// --- Internal Node Split Logic ---
 		// The middle key is *moved up*, not copied
@@ -187,38 +269,51 @@ func (t *BPlusTree[K]) splitAndPromote(node *Node[K]) {
 
 		// Copy keys *after* the promoted key to the new right node
 		newRightNode.keys = append(newRightNode.keys, node.keys[splitPoint+1:]...)
-		// Copy pointers *after* the promoted key's original position
-		newRightNode.pointers = append(newRightNode.pointers, node.pointers[splitPoint+1:]...)
+		// Copy children *after* the promoted key's original position
+		newRightNode.children = append(newRightNode.children, node.children[splitPoint+1:]...)
 
-		// Truncate original node to hold keys/pointers *before* the promoted key
+		// Truncate original node to hold keys/children *before* the promoted key
 		node.keys = node.keys[:splitPoint]
-		node.pointers = node.pointers[:splitPoint+1] // One more pointer than keys
+		node.children = node.children[:splitPoint+1] // One more child than keys
+
+		for _, child := range newRightNode.children {
+			newRightNode.size += child.size
+		}
+		node.size -= newRightNode.size
+	}
+
+	if t.tracer != nil {
+		t.tracer.OnSplit(node.isLeaf, slices.Clone(node.keys), slices.Clone(newRightNode.keys))
+	}
+	t.traceWrite(node)
+	t.traceWrite(newRightNode)
+
+	// Update parent pointer for children moved to the new right node
+	for _, childNode := range newRightNode.children {
+		childNode.parent = newRightNode
 	}
 
 	// --- Parent Insertion Logic (for both leaf and internal splits) ---
 	if node.parent == nil {
 		// If the split node was the root, create a new root
-		newRoot := &Node[K]{
-			isLeaf:   false,
-			keys:     []K{keyToPromote},
-			pointers: []interface{}{node, newRightNode},
-		}
+		newRoot := t.newNode(false)
+		newRoot.keys = append(newRoot.keys, keyToPromote)
+		newRoot.children = append(newRoot.children, node, newRightNode)
+		newRoot.size = node.size + newRightNode.size
 		node.parent = newRoot
 		newRightNode.parent = newRoot
 		t.root = newRoot
+		if t.tracer != nil {
+			t.tracer.OnPromote(keyToPromote, true)
+		}
+		t.traceWrite(newRoot)
 	} else {
 		// Insert into existing parent
 		parent := node.parent
-
-		// *** CRITICAL FIX ***: Update parent pointer for children moved to the new right node
-		if !newRightNode.isLeaf {
-			for _, p := range newRightNode.pointers {
-				childNode := p.(*Node[K])
-				childNode.parent = newRightNode
-			}
-		}
-
 		t.insertIntoParent(parent, keyToPromote, newRightNode)
+		if t.tracer != nil {
+			t.tracer.OnPromote(keyToPromote, false)
+		}
 
 		// Recursively split the parent if it is now full
 		if len(parent.keys) == t.degree {
@@ -228,149 +323,848 @@ func (t *BPlusTree[K]) splitAndPromote(node *Node[K]) {
 }
 
 // insertIntoParent inserts a key and a new child node pointer into an internal node.
-func (t *BPlusTree[K]) insertIntoParent(parent *Node[K], key K, newChild *Node[K]) {
+func (t *BPlusTree[K, V]) insertIntoParent(parent *Node[K, V], key K, newChild *Node[K, V]) {
 	insertPos := 0
-	for insertPos < len(parent.keys) && key > parent.keys[insertPos] {
+	for insertPos < len(parent.keys) && t.less(parent.keys[insertPos], key) {
 		insertPos++
 	}
 
-	parent.keys = append(parent.keys[:insertPos], append([]K{key}, parent.keys[insertPos:]...)...)
-	parent.pointers = append(parent.pointers[:insertPos+1], append([]interface{}{newChild}, parent.pointers[insertPos+1:]...)...)
+	parent.keys = slices.Insert(parent.keys, insertPos, key)
+	parent.children = slices.Insert(parent.children, insertPos+1, newChild)
+	t.traceWrite(parent)
+}
+
+// =================================================================================================
+// Deletion Operations
+// =================================================================================================
+
+// Delete removes a key and its value from the tree. It reports whether the key was present.
+func (t *BPlusTree[K, V]) Delete(key K) bool {
+	if t.root == nil {
+		return false
+	}
+
+	leafNode := t.findLeaf(key)
+	index := slices.IndexFunc(leafNode.keys, func(k K) bool { return t.equal(k, key) })
+	if index == -1 {
+		return false
+	}
+
+	leafNode.keys = slices.Delete(leafNode.keys, index, index+1)
+	leafNode.values = slices.Delete(leafNode.values, index, index+1)
+	for node := leafNode; node != nil; node = node.parent {
+		node.size--
+	}
+	t.traceWrite(leafNode)
+
+	t.rebalance(leafNode)
+	return true
+}
+
+// minKeys is the minimum number of keys a non-root node must hold to stay at least half-full.
+func (t *BPlusTree[K, V]) minKeys() int {
+	return (t.degree - 1) / 2
+}
+
+// rebalance restores the minimum occupancy of a node after a deletion, first by borrowing
+// a key from a sibling and otherwise by merging with one, which may cascade up to the root.
+func (t *BPlusTree[K, V]) rebalance(node *Node[K, V]) {
+	if node.parent == nil {
+		// The root is allowed to underflow. It only goes away once it is completely empty.
+		if len(node.keys) == 0 {
+			if node.isLeaf {
+				t.root = nil
+			} else {
+				// The root's only child becomes the new root, shrinking the tree by one level.
+				t.root = node.children[0]
+				t.root.parent = nil
+			}
+			t.releaseNode(node)
+		}
+		return
+	}
+	if len(node.keys) >= t.minKeys() {
+		return
+	}
+
+	parent := node.parent
+	childIndex := slices.Index(parent.children, node)
+
+	var left, right *Node[K, V]
+	if childIndex > 0 {
+		left = parent.children[childIndex-1]
+		if len(left.keys) > t.minKeys() {
+			t.borrowFromLeft(node, left, childIndex)
+			return
+		}
+	}
+	if childIndex < len(parent.children)-1 {
+		right = parent.children[childIndex+1]
+		if len(right.keys) > t.minKeys() {
+			t.borrowFromRight(node, right, childIndex)
+			return
+		}
+	}
+
+	// Neither sibling can spare a key, so merge with one of them.
+	if left != nil {
+		t.mergeNodes(left, node, childIndex-1)
+	} else {
+		t.mergeNodes(node, right, childIndex)
+	}
+	t.rebalance(parent)
+}
+
+// borrowFromLeft moves the last key of the left sibling into node and fixes the separator in the parent.
+func (t *BPlusTree[K, V]) borrowFromLeft(node, left *Node[K, V], childIndex int) {
+	parent := node.parent
+	last := len(left.keys) - 1
+
+	if node.isLeaf {
+		node.keys = slices.Insert(node.keys, 0, left.keys[last])
+		node.values = slices.Insert(node.values, 0, left.values[last])
+		left.keys = left.keys[:last]
+		left.values = left.values[:last]
+		parent.keys[childIndex-1] = node.keys[0]
+		node.size++
+		left.size--
+	} else {
+		// The separator comes down into node and the left sibling's last key goes up to replace it.
+		movedChild := left.children[last+1]
+		node.keys = slices.Insert(node.keys, 0, parent.keys[childIndex-1])
+		node.children = slices.Insert(node.children, 0, movedChild)
+		movedChild.parent = node
+		parent.keys[childIndex-1] = left.keys[last]
+		left.keys = left.keys[:last]
+		left.children = left.children[:last+1]
+		node.size += movedChild.size
+		left.size -= movedChild.size
+	}
+
+	t.traceWrite(left)
+	t.traceWrite(node)
+	t.traceWrite(parent)
+}
+
+// borrowFromRight moves the first key of the right sibling into node and fixes the separator in the parent.
+func (t *BPlusTree[K, V]) borrowFromRight(node, right *Node[K, V], childIndex int) {
+	parent := node.parent
+
+	if node.isLeaf {
+		node.keys = append(node.keys, right.keys[0])
+		node.values = append(node.values, right.values[0])
+		right.keys = slices.Delete(right.keys, 0, 1)
+		right.values = slices.Delete(right.values, 0, 1)
+		parent.keys[childIndex] = right.keys[0]
+		node.size++
+		right.size--
+	} else {
+		// The separator comes down into node and the right sibling's first key goes up to replace it.
+		movedChild := right.children[0]
+		node.keys = append(node.keys, parent.keys[childIndex])
+		node.children = append(node.children, movedChild)
+		movedChild.parent = node
+		parent.keys[childIndex] = right.keys[0]
+		right.keys = slices.Delete(right.keys, 0, 1)
+		right.children = slices.Delete(right.children, 0, 1)
+		node.size += movedChild.size
+		right.size -= movedChild.size
+	}
+
+	t.traceWrite(right)
+	t.traceWrite(node)
+	t.traceWrite(parent)
+}
+
+// mergeNodes folds right into left and removes the separator between them from their parent.
+func (t *BPlusTree[K, V]) mergeNodes(left, right *Node[K, V], separatorIndex int) {
+	parent := left.parent
+
+	if left.isLeaf {
+		left.keys = append(left.keys, right.keys...)
+		left.values = append(left.values, right.values...)
+		left.next = right.next
+	} else {
+		// The separator is pulled down between the two halves.
+		left.keys = append(left.keys, parent.keys[separatorIndex])
+		left.keys = append(left.keys, right.keys...)
+		for _, childNode := range right.children {
+			childNode.parent = left
+			left.children = append(left.children, childNode)
+		}
+	}
+
+	left.size += right.size
+	parent.keys = slices.Delete(parent.keys, separatorIndex, separatorIndex+1)
+	parent.children = slices.Delete(parent.children, separatorIndex+1, separatorIndex+2)
+
+	t.releaseNode(right)
+
+	if t.tracer != nil {
+		t.tracer.OnMerge(left.isLeaf, slices.Clone(left.keys))
+	}
+	t.traceWrite(left)
+	t.traceWrite(parent)
 }
 
 // =================================================================================================
 // Persistence Operations
 // =================================================================================================
 
-// Serializable structs for JSON marshalling. We can't directly serialize pointers.
-type SerializableNode[K constraints.Ordered] struct {
-	IsLeaf   bool    `json:"isLeaf"`
-	Keys     []K     `json:"keys"`
-	Pointers []int64 `json:"pointers"` // Will hold NodeIDs or RecordOffsets
-	ParentID int     `json:"parentID"`
-	NextID   int     `json:"nextID"`
-	NodeID   int     `json:"nodeID"`
+// Serializable structs for JSON marshalling. We can't directly serialize pointers. Pointers
+// holds the child node IDs of an internal node or the values of a leaf, as a JSON array either
+// way. Values are encoded as JSON, so V must be a type encoding/json can encode and decode; the
+// record offsets of an Index are plain numbers.
+type SerializableNode[K any] struct {
+	IsLeaf   bool            `json:"isLeaf"`
+	Keys     []K             `json:"keys"`
+	Pointers json.RawMessage `json:"pointers"` // Will hold NodeIDs or values
+	ParentID int             `json:"parentID"`
+	NextID   int             `json:"nextID"`
+	NodeID   int             `json:"nodeID"`
+}
+
+type SerializableTree[K, V any] struct {
+	FormatVersion int                   `json:"formatVersion"`
+	KeyType       string                `json:"keyType"`
+	CreatedAt     time.Time             `json:"createdAt"`
+	DataFile      *DataFileInfo         `json:"dataFile,omitempty"`
+	Degree        int                   `json:"degree"`
+	RootID        int                   `json:"rootID"`
+	Nodes         []SerializableNode[K] `json:"nodes"`
+	Nulls         []V                   `json:"nulls,omitempty"`
+	// Checksum is the CRC-32 of the nodes and nulls in compact JSON, so reindenting the file
+	// doesn't change it but changing a value does.
+	Checksum uint32 `json:"checksum"`
+}
+
+// FormatVersion is the version of the index file format SaveTo writes. It goes up whenever the
+// layout changes in a way an older LoadFrom would misread, and a binary format would carry it
+// too, after its magic number. LoadFrom reads every version from 0, the files written before the
+// field existed, up to FormatVersion; Migrate rewrites an older file in the current one.
+//
+// Version 2 added the key type, the creation time, the data file and the checksum.
+const FormatVersion = 2
+
+// ErrUnsupportedFormat is returned by LoadFrom for an index file written in a format version it
+// doesn't know, typically by a newer build. It is wrapped with the version, so compare with
+// errors.Is.
+var ErrUnsupportedFormat = errors.New("unsupported index file format")
+
+// Errors of loading an index file that doesn't match what it claims to be, or what it is loaded
+// for. They are wrapped with the details, so compare with errors.Is.
+var (
+	ErrMalformedIndex   = errors.New("malformed index file")
+	ErrChecksumMismatch = errors.New("index file checksum mismatch")
+	ErrKeyTypeMismatch  = errors.New("index file has a different key type")
+	ErrDataFileMismatch = errors.New("index was built over a different data file")
+)
+
+// IndexInfo is what an index file records about its index besides the tree itself.
+type IndexInfo struct {
+	// KeyType is the Go type of the keys, such as "int". It is empty for an index migrated
+	// from a file older than version 2.
+	KeyType string
+	// CreatedAt is when the tree was created. Saving and loading keep it, so it is the time the
+	// index was first built, not the time it was last saved. It is zero if unknown.
+	CreatedAt time.Time
+	// DataFile is the data file the index was built over, if SetDataFile recorded one.
+	DataFile *DataFileInfo
+}
+
+// DataFileInfo identifies a data file by its contents.
+type DataFileInfo struct {
+	Path   string `json:"path"` // as given to SetDataFile; a relative path is resolved when loading
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"` // hex-encoded
+}
+
+// Info returns what the index file records about the tree.
+func (t *BPlusTree[K, V]) Info() IndexInfo {
+	return t.info
+}
+
+// SetDataFile records the data file at path, with its size and hash, as the one the tree
+// indexes. It is saved with the tree, and LoadFromFile refuses to load the index once the file
+// has changed. Call it after the last change to the data file.
+func (t *BPlusTree[K, V]) SetDataFile(path string) error {
+	info, err := hashDataFile(path)
+	if err != nil {
+		return err
+	}
+	t.info.DataFile = info
+	return nil
+}
+
+// hashDataFile reads the file at path and describes it.
+func hashDataFile(path string) (*DataFileInfo, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, file)
+	if err != nil {
+		return nil, err
+	}
+	return &DataFileInfo{Path: path, Size: size, SHA256: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+// checkDataFile returns an error unless the file at recorded.Path still has the recorded contents.
+func checkDataFile(recorded *DataFileInfo) error {
+	current, err := hashDataFile(recorded.Path)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrDataFileMismatch, err)
+	}
+	if *current != *recorded {
+		return fmt.Errorf("%w: %s had %d bytes and SHA-256 %s, and now has %d bytes and SHA-256 %s",
+			ErrDataFileMismatch, recorded.Path, recorded.Size, recorded.SHA256, current.Size, current.SHA256)
+	}
+	return nil
+}
+
+// keyTypeName returns the name of the key type an index file records, such as "int".
+func keyTypeName[K any]() string {
+	return reflect.TypeFor[K]().String()
+}
+
+// checkFormatVersion returns an error for a format version LoadFrom can't read.
+func checkFormatVersion(version int) error {
+	if version < 0 || version > FormatVersion {
+		return fmt.Errorf("%w: version %d, this build reads versions 0 to %d", ErrUnsupportedFormat, version, FormatVersion)
+	}
+	return nil
 }
 
-type SerializableTree[K constraints.Ordered] struct {
-	Degree int                   `json:"degree"`
-	RootID int                   `json:"rootID"`
-	Nodes  []SerializableNode[K] `json:"nodes"`
+// SaveOptions configures SaveToFileWith.
+type SaveOptions struct {
+	// Backups is the number of previous versions of the file to keep, from path.1, the most
+	// recent, to path.N. 0 keeps none.
+	Backups int
 }
 
 // SaveToFile serializes the B+ Tree index to a JSON file.
-func (t *BPlusTree[K]) SaveToFile(path string) error {
+func (t *BPlusTree[K, V]) SaveToFile(path string) error {
+	return t.SaveToFileWith(path, SaveOptions{})
+}
+
+// SaveToFileWith is SaveToFile with options. The index is written to a temporary file in the same
+// directory, synced, and renamed over path, so a crash leaves either the old file or the new one,
+// never half of one.
+func (t *BPlusTree[K, V]) SaveToFileWith(path string, opts SaveOptions) error {
+	dir := filepath.Dir(path)
+	file, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := file.Name()
+	err = t.SaveTo(file)
+	if err == nil {
+		// CreateTemp makes the file private; give it the mode of the file it replaces instead.
+		mode := os.FileMode(0644)
+		if info, statErr := os.Stat(path); statErr == nil {
+			mode = info.Mode().Perm()
+		}
+		err = file.Chmod(mode)
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && opts.Backups > 0 {
+		err = rotateBackups(path, opts.Backups)
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return syncDir(dir)
+}
+
+// rotateBackups shifts path.1 ... path.N-1 up by one, dropping path.N, and makes path.1 a hard
+// link to the current file at path, if there is one. path itself stays in place until the new
+// file is renamed over it.
+func rotateBackups(path string, backups int) error {
+	backup := func(i int) string { return path + "." + strconv.Itoa(i) }
+	if err := os.Remove(backup(backups)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	for i := backups - 1; i >= 1; i-- {
+		if err := os.Rename(backup(i), backup(i+1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if err := os.Link(path, backup(1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// syncDir syncs a directory, so that renames within it survive a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// SaveTo serializes the B+ Tree index as JSON to w. Nodes are encoded and written one at a time,
+// so the serialized form of the whole tree is never held in memory.
+func (t *BPlusTree[K, V]) SaveTo(w io.Writer) error {
 	if t.root == nil {
 		return fmt.Errorf("cannot save an empty tree")
 	}
 
-	nodeMap := make(map[*Node[K]]int)
-	serializableNodes := []SerializableNode[K]{}
-	nodeIDCounter := 0
+	// Level-order traversal to assign IDs to each node. The root always gets ID 0.
+	nodeMap := make(map[*Node[K, V]]int)
+	queue := []*Node[K, V]{t.root}
+	for i := 0; i < len(queue); i++ {
+		node := queue[i]
+		nodeMap[node] = i
+		queue = append(queue, node.children...)
+	}
 
-	// Level-order traversal to assign IDs to each node
-	queue := []*Node[K]{t.root}
-	for len(queue) > 0 {
-		node := queue[0]
-		queue = queue[1:]
-		if _, exists := nodeMap[node]; !exists {
-			nodeMap[node] = nodeIDCounter
-			nodeIDCounter++
-			if !node.isLeaf {
-				for _, p := range node.pointers {
-					queue = append(queue, p.(*Node[K]))
-				}
-			}
+	keyType, err := json.Marshal(t.info.KeyType)
+	if err != nil {
+		return err
+	}
+	createdAt, err := json.Marshal(t.info.CreatedAt)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "{\n  \"formatVersion\": %d,\n  \"keyType\": %s,\n  \"createdAt\": %s,",
+		FormatVersion, keyType, createdAt)
+	if t.info.DataFile != nil {
+		data, err := json.Marshal(t.info.DataFile)
+		if err != nil {
+			return err
 		}
+		fmt.Fprintf(bw, "\n  \"dataFile\": %s,", data)
 	}
+	fmt.Fprintf(bw, "\n  \"degree\": %d,\n  \"rootID\": %d,\n  \"nodes\": [", t.degree, nodeMap[t.root])
 
-	// Create serializable representation of each node
-	for node, id := range nodeMap {
-		sNode := SerializableNode[K]{
-			IsLeaf:   node.isLeaf,
-			Keys:     node.keys,
-			NodeID:   id,
-			ParentID: -1, // Default to -1 (no parent, e.g., root)
-			NextID:   -1, // Default to -1 (no next)
+	checksum := crc32.NewIEEE()
+	for i, node := range queue {
+		sNode, err := t.serializeNode(node, nodeMap)
+		if err != nil {
+			return err
 		}
-		if node.parent != nil {
-			sNode.ParentID = nodeMap[node.parent]
+		data, err := json.MarshalIndent(sNode, "    ", "  ")
+		if err != nil {
+			return err
 		}
-		if node.next != nil {
-			sNode.NextID = nodeMap[node.next]
+		if i > 0 {
+			bw.WriteString(",")
 		}
-
-		for _, p := range node.pointers {
-			if node.isLeaf {
-				sNode.Pointers = append(sNode.Pointers, int64(p.(RecordOffset)))
-			} else {
-				sNode.Pointers = append(sNode.Pointers, int64(nodeMap[p.(*Node[K])]))
-			}
+		bw.WriteString("\n    ")
+		bw.Write(data)
+		if err := hashJSON(checksum, data); err != nil {
+			return err
+		}
+	}
+	bw.WriteString("\n  ]")
+	if len(t.nulls) > 0 {
+		data, err := json.Marshal(t.nulls)
+		if err != nil {
+			return err
 		}
-		serializableNodes = append(serializableNodes, sNode)
+		fmt.Fprintf(bw, ",\n  \"nulls\": %s", data)
+		if err := hashJSON(checksum, data); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(bw, ",\n  \"checksum\": %d\n}\n", checksum.Sum32())
+	return bw.Flush()
+}
+
+// hashJSON adds the compact form of a JSON value to the checksum of an index file.
+func hashJSON(h hash.Hash32, data []byte) error {
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, data); err != nil {
+		return err
 	}
+	h.Write(compact.Bytes())
+	return nil
+}
 
-	serializableTree := SerializableTree[K]{
-		Degree: t.degree,
-		RootID: nodeMap[t.root],
-		Nodes:  serializableNodes,
+// serializeNode creates the serializable representation of a node, replacing pointers with node IDs.
+// It fails if the values of a leaf can't be encoded as JSON.
+func (t *BPlusTree[K, V]) serializeNode(node *Node[K, V], nodeMap map[*Node[K, V]]int) (SerializableNode[K], error) {
+	sNode := SerializableNode[K]{
+		IsLeaf:   node.isLeaf,
+		Keys:     node.keys,
+		NodeID:   nodeMap[node],
+		ParentID: -1, // Default to -1 (no parent, e.g., root)
+		NextID:   -1, // Default to -1 (no next)
+	}
+	if node.parent != nil {
+		sNode.ParentID = nodeMap[node.parent]
+	}
+	if node.next != nil {
+		sNode.NextID = nodeMap[node.next]
 	}
 
-	file, err := json.MarshalIndent(serializableTree, "", "  ")
+	var err error
+	if node.isLeaf {
+		sNode.Pointers, err = json.Marshal(node.values)
+	} else {
+		childIDs := make([]int64, len(node.children))
+		for i, child := range node.children {
+			childIDs[i] = int64(nodeMap[child])
+		}
+		sNode.Pointers, err = json.Marshal(childIDs)
+	}
+	return sNode, err
+}
+
+// LoadFromFile deserializes a B+ Tree index from a JSON file. On top of what LoadFrom checks, it
+// fails with ErrDataFileMismatch if the index records a data file (see SetDataFile) that is
+// missing or has changed since, so that an index is never used over rows it doesn't describe.
+func LoadFromFile[K constraints.Ordered, V any](path string) (*BPlusTree[K, V], error) {
+	return LoadFromFileFunc[K, V](path, cmp.Less[K])
+}
+
+// LoadFromFileFunc deserializes a B+ Tree index that was saved by a tree created with
+// NewBPlusTreeFunc. less must be the order the tree was built with; the file doesn't record it.
+func LoadFromFileFunc[K, V any](path string, less func(a, b K) bool) (*BPlusTree[K, V], error) {
+	tree, err := loadFromFile[K, V](path, less, keyTypeName[K]())
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return os.WriteFile(path, file, 0644)
+	if tree.info.DataFile != nil {
+		if err := checkDataFile(tree.info.DataFile); err != nil {
+			return nil, fmt.Errorf("loading %s: %w", path, err)
+		}
+	}
+	return tree, nil
 }
 
-// LoadFromFile deserializes a B+ Tree index from a JSON file.
-func LoadFromFile[K constraints.Ordered](path string) (*BPlusTree[K], error) {
-	file, err := os.ReadFile(path)
+// loadFromFile decodes the index file at path, checking only what decodeTree checks.
+func loadFromFile[K, V any](path string, less func(a, b K) bool, keyType string) (*BPlusTree[K, V], error) {
+	file, err := os.Open(path)
 	if err != nil {
 		return nil, err
 	}
+	defer file.Close()
+	return decodeTree[K, V](bufio.NewReader(file), less, keyType)
+}
+
+// LoadFrom deserializes a B+ Tree index from JSON read from r. The input is decoded one node
+// at a time instead of being read into memory as a whole first. It fails with ErrMalformedIndex
+// if the nodes don't form a valid tree (see validateNodes), with ErrChecksumMismatch if they don't
+// match the file's checksum, and with ErrKeyTypeMismatch if the file was saved by a tree with keys
+// of another type. The file doesn't record the value type: values are decoded from JSON into V,
+// which fails only if they don't fit.
+func LoadFrom[K constraints.Ordered, V any](r io.Reader) (*BPlusTree[K, V], error) {
+	return LoadFromFunc[K, V](r, cmp.Less[K])
+}
+
+// LoadFromFunc is LoadFrom for a tree ordered by less (see LoadFromFileFunc).
+func LoadFromFunc[K, V any](r io.Reader, less func(a, b K) bool) (*BPlusTree[K, V], error) {
+	return decodeTree[K, V](r, less, keyTypeName[K]())
+}
 
-	var sTree SerializableTree[K]
-	if err := json.Unmarshal(file, &sTree); err != nil {
+// decodeTree decodes an index file and verifies its checksum. Unless keyType is empty, a file that
+// records another key type fails before its keys are decoded; files that don't record one pass.
+// The data file is left to the caller; the tree's info holds what the file recorded.
+func decodeTree[K, V any](r io.Reader, less func(a, b K) bool, keyType string) (*BPlusTree[K, V], error) {
+	var version, degree, rootID int
+	var nulls []V
+	var info IndexInfo
+	var storedChecksum *uint32
+	checksum := crc32.NewIEEE()
+	nodeMapByID := make(map[int]*Node[K, V])
+	var pending []pendingLinks[K, V]
+
+	dec := json.NewDecoder(r)
+	if err := expectDelim(dec, '{'); err != nil {
 		return nil, err
 	}
+	for dec.More() {
+		token, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		var decodeErr error
+		switch token {
+		case "formatVersion":
+			if decodeErr = dec.Decode(&version); decodeErr == nil {
+				decodeErr = checkFormatVersion(version)
+			}
+		case "keyType":
+			decodeErr = dec.Decode(&info.KeyType)
+			if decodeErr == nil && keyType != "" && info.KeyType != "" && info.KeyType != keyType {
+				decodeErr = fmt.Errorf("%w: the file has %s keys, not %s", ErrKeyTypeMismatch, info.KeyType, keyType)
+			}
+		case "createdAt":
+			decodeErr = dec.Decode(&info.CreatedAt)
+		case "dataFile":
+			decodeErr = dec.Decode(&info.DataFile)
+		case "checksum":
+			decodeErr = dec.Decode(&storedChecksum)
+		case "degree":
+			decodeErr = dec.Decode(&degree)
+		case "rootID":
+			decodeErr = dec.Decode(&rootID)
+		case "nodes":
+			if err := expectDelim(dec, '['); err != nil {
+				return nil, err
+			}
+			for dec.More() {
+				var raw json.RawMessage
+				if err := dec.Decode(&raw); err != nil {
+					return nil, err
+				}
+				if err := hashJSON(checksum, raw); err != nil {
+					return nil, err
+				}
+				var sNode SerializableNode[K]
+				if err := json.Unmarshal(raw, &sNode); err != nil {
+					return nil, err
+				}
+				node := &Node[K, V]{
+					isLeaf: sNode.IsLeaf,
+					keys:   sNode.Keys,
+				}
+				if _, ok := nodeMapByID[sNode.NodeID]; ok {
+					return nil, fmt.Errorf("%w: node ID %d is used twice", ErrMalformedIndex, sNode.NodeID)
+				}
+				nodeMapByID[sNode.NodeID] = node
+				links := pendingLinks[K, V]{node: node, nodeID: sNode.NodeID, parentID: sNode.ParentID, nextID: sNode.NextID}
+				var pointers any = &node.values
+				if !node.isLeaf {
+					pointers = &links.childIDs
+				}
+				if err := json.Unmarshal(sNode.Pointers, pointers); err != nil {
+					return nil, err
+				}
+				pending = append(pending, links)
+			}
+			decodeErr = expectDelim(dec, ']')
+		case "nulls":
+			var raw json.RawMessage
+			if decodeErr = dec.Decode(&raw); decodeErr == nil {
+				if decodeErr = hashJSON(checksum, raw); decodeErr == nil {
+					decodeErr = json.Unmarshal(raw, &nulls)
+				}
+			}
+		default:
+			// Skip fields this version doesn't know about.
+			var skipped json.RawMessage
+			decodeErr = dec.Decode(&skipped)
+		}
+		if decodeErr != nil {
+			return nil, decodeErr
+		}
+	}
+	if err := expectDelim(dec, '}'); err != nil {
+		return nil, err
+	}
+	// Files older than version 2 have no checksum.
+	if version >= 2 {
+		switch {
+		case storedChecksum == nil:
+			return nil, fmt.Errorf("%w: the file has no checksum", ErrChecksumMismatch)
+		case *storedChecksum != checksum.Sum32():
+			return nil, fmt.Errorf("%w: the file says %08x, the nodes hash to %08x",
+				ErrChecksumMismatch, *storedChecksum, checksum.Sum32())
+		}
+	}
 
-	tree := NewBPlusTree[K](sTree.Degree)
-	if len(sTree.Nodes) == 0 {
+	if degree < 3 {
+		return nil, fmt.Errorf("%w: degree %d is below 3", ErrMalformedIndex, degree)
+	}
+	tree := NewBPlusTreeFunc[K, V](degree, less)
+	tree.nulls = nulls
+	tree.info = info
+	if len(pending) == 0 {
 		return tree, nil
 	}
+	if err := validateNodes(pending, rootID, degree, less); err != nil {
+		return nil, err
+	}
 
-	// First pass: create all nodes and store them in a map by their ID
-	nodeMapByID := make(map[int]*Node[K])
-	for _, sNode := range sTree.Nodes {
-		node := &Node[K]{
-			isLeaf: sNode.IsLeaf,
-			keys:   sNode.Keys,
+	// Second pass: link all the nodes together using the map
+	for _, links := range pending {
+		node := links.node
+		if links.parentID != -1 {
+			node.parent = nodeMapByID[links.parentID]
+		}
+		if links.nextID != -1 {
+			node.next = nodeMapByID[links.nextID]
+		}
+		for _, childID := range links.childIDs {
+			node.children = append(node.children, nodeMapByID[int(childID)])
 		}
-		nodeMapByID[sNode.NodeID] = node
 	}
 
-	// Second pass: link all the nodes together using the map
-	for _, sNode := range sTree.Nodes {
-		node := nodeMapByID[sNode.NodeID]
-		if sNode.ParentID != -1 {
-			node.parent = nodeMapByID[sNode.ParentID]
+	tree.root = nodeMapByID[rootID]
+	computeSizes(tree.root)
+	return tree, nil
+}
+
+// pendingLinks is a decoded node whose links to other nodes are still node IDs. Links can only be
+// resolved once every node exists, so they are kept aside while the nodes are being decoded.
+type pendingLinks[K, V any] struct {
+	node     *Node[K, V]
+	nodeID   int
+	parentID int
+	nextID   int
+	childIDs []int64
+}
+
+// validateNodes checks the decoded nodes of an index file before they are linked, so that a
+// damaged or hand-edited file is rejected with an error instead of building a tree that panics or
+// loops later. The nodes must form one tree under rootID, with every node reached exactly once and
+// parent IDs that agree with it; every node holds fewer than degree keys, a leaf one value per
+// key and an internal node one child more than its keys; keys are sorted and within the
+// separators above them; all leaves are at the same depth; and the next IDs chain the leaves in
+// key order. A nil less skips the checks of key order.
+func validateNodes[K, V any](pending []pendingLinks[K, V], rootID, degree int, less func(a, b K) bool) error {
+	byID := make(map[int]*pendingLinks[K, V], len(pending))
+	for i := range pending {
+		byID[pending[i].nodeID] = &pending[i]
+	}
+	malformed := func(format string, args ...any) error {
+		return fmt.Errorf("%w: "+format, append([]any{ErrMalformedIndex}, args...)...)
+	}
+
+	visited := make(map[int]bool, len(pending))
+	var leaves []*pendingLinks[K, V]
+	leafDepth := -1
+	var walk func(id, parentID, depth int, low, high *K) error
+	walk = func(id, parentID, depth int, low, high *K) error {
+		links, ok := byID[id]
+		if !ok {
+			return malformed("node %d links to node %d, which doesn't exist", parentID, id)
+		}
+		if visited[id] {
+			return malformed("node %d is reached twice, the second time from node %d", id, parentID)
+		}
+		visited[id] = true
+		if links.parentID != parentID {
+			return malformed("node %d records parent %d, but is a child of %d", id, links.parentID, parentID)
 		}
-		if sNode.NextID != -1 {
-			node.next = nodeMapByID[sNode.NextID]
+		node := links.node
+		if len(node.keys) >= degree {
+			return malformed("node %d holds %d keys, the degree allows %d", id, len(node.keys), degree-1)
+		}
+		for i, k := range node.keys {
+			if less == nil {
+				break
+			}
+			if i > 0 && !less(node.keys[i-1], k) {
+				return malformed("the keys of node %d are not in ascending order", id)
+			}
+			if (low != nil && less(k, *low)) || (high != nil && !less(k, *high)) {
+				return malformed("a key of node %d is outside the range its parent gives it", id)
+			}
 		}
 
-		for _, pID := range sNode.Pointers {
-			if node.isLeaf {
-				node.pointers = append(node.pointers, RecordOffset(pID))
-			} else {
-				node.pointers = append(node.pointers, nodeMapByID[int(pID)])
+		if node.isLeaf {
+			if len(node.values) != len(node.keys) {
+				return malformed("leaf %d has %d keys but %d values", id, len(node.keys), len(node.values))
+			}
+			if leafDepth == -1 {
+				leafDepth = depth
+			} else if depth != leafDepth {
+				return malformed("leaf %d is at depth %d, other leaves are at depth %d", id, depth, leafDepth)
+			}
+			leaves = append(leaves, links)
+			return nil
+		}
+		if len(links.childIDs) != len(node.keys)+1 {
+			return malformed("internal node %d has %d keys but %d children", id, len(node.keys), len(links.childIDs))
+		}
+		if links.nextID != -1 {
+			return malformed("internal node %d has a next node", id)
+		}
+		for i, childID := range links.childIDs {
+			childLow, childHigh := low, high
+			if i > 0 {
+				childLow = &node.keys[i-1]
+			}
+			if i < len(node.keys) {
+				childHigh = &node.keys[i]
+			}
+			if err := walk(int(childID), id, depth+1, childLow, childHigh); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if _, ok := byID[rootID]; !ok {
+		return malformed("root node %d doesn't exist", rootID)
+	}
+	if err := walk(rootID, -1, 0, nil, nil); err != nil {
+		return err
+	}
+	if len(visited) != len(pending) {
+		for _, links := range pending {
+			if !visited[links.nodeID] {
+				return malformed("node %d is not reachable from the root", links.nodeID)
 			}
 		}
 	}
 
-	tree.root = nodeMapByID[sTree.RootID]
-	return tree, nil
+	for i, leaf := range leaves {
+		want := -1
+		if i+1 < len(leaves) {
+			want = leaves[i+1].nodeID
+		}
+		if leaf.nextID != want {
+			return malformed("leaf %d links to %d, but the next leaf in key order is %d", leaf.nodeID, leaf.nextID, want)
+		}
+	}
+	return nil
+}
+
+// Migrate rewrites the index file at oldPath in the current format version at newPath, which may be
+// the same path. The keys and values are carried over as raw JSON, so it works whatever their
+// types, and so are the key type, creation time and data file the old file records. The data file isn't checked.
+func Migrate(oldPath, newPath string) error {
+	// Loading and saving don't compare keys, so the tree needs no order, and raw keys can't be
+	// checked against one.
+	tree, err := loadFromFile[json.RawMessage, json.RawMessage](oldPath, nil, "")
+	if err != nil {
+		return err
+	}
+	return tree.SaveToFile(newPath)
+}
+
+// computeSizes fills in the subtree sizes of a node and its descendants, which the index file
+// doesn't store.
+func computeSizes[K, V any](node *Node[K, V]) int {
+	if node.isLeaf {
+		node.size = len(node.keys)
+		return node.size
+	}
+	node.size = 0
+	for _, child := range node.children {
+		node.size += computeSizes(child)
+	}
+	return node.size
+}
+
+// expectDelim reads the next JSON token and checks that it is the given delimiter.
+func expectDelim(dec *json.Decoder, want json.Delim) error {
+	token, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != want {
+		return fmt.Errorf("%w: expected %q, got %v", ErrMalformedIndex, want, token)
+	}
+	return nil
 }
 
 // =================================================================================================
@@ -378,12 +1172,12 @@ func LoadFromFile[K constraints.Ordered](path string) (*BPlusTree[K], error) {
 // =================================================================================================
 
 // PrintTree provides a simple visualization of the tree structure.
-func (t *BPlusTree[K]) PrintTree() {
+func (t *BPlusTree[K, V]) PrintTree() {
 	if t.root == nil {
 		fmt.Println("Tree is empty.")
 		return
 	}
-	queue := []*Node[K]{t.root}
+	queue := []*Node[K, V]{t.root}
 	level := 0
 	for len(queue) > 0 {
 		levelSize := len(queue)
@@ -393,11 +1187,7 @@ func (t *BPlusTree[K]) PrintTree() {
 			queue = queue[1:]
 
 			fmt.Printf("%v ", node.keys)
-			if !node.isLeaf {
-				for _, p := range node.pointers {
-					queue = append(queue, p.(*Node[K]))
-				}
-			}
+			queue = append(queue, node.children...)
 		}
 		fmt.Println()
 		level++
@@ -408,10 +1198,14 @@ func (t *BPlusTree[K]) PrintTree() {
 // Main Function to Demonstrate Usage
 // =================================================================================================
 
-func buildTreeFromFile(tree *BPlusTree[int], dataFilePath string) error {
+// buildTreeFromFile indexes every row of a CSV file, after its header, by the integer id in its
+// first column. Rows whose id is missing or invalid are handled by the tree's NullKeyPolicy, and
+// the report says what became of them. The file is recorded as the tree's data file.
+func buildTreeFromFile(tree *Index[int], dataFilePath string) (BuildReport, error) {
+	var report BuildReport
 	file, err := os.Open(dataFilePath)
 	if err != nil {
-		return err
+		return report, err
 	}
 	defer file.Close()
 
@@ -421,35 +1215,39 @@ func buildTreeFromFile(tree *BPlusTree[int], dataFilePath string) error {
 	// Skip header line
 	line, _, err := reader.ReadLine()
 	if err != nil {
-		return err
+		return report, err
 	}
 	offset += int64(len(line)) + 1 // +1 for the newline character
 
 	// Read data lines
-	for {
+	for lineNo := 2; ; lineNo++ {
 		line, _, err := reader.ReadLine()
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			return err
+			return report, err
 		}
+		report.Rows++
 
-		parts := strings.Split(string(line), ",")
-		if len(parts) < 1 {
-			continue
-		}
-		id, err := strconv.Atoi(parts[0])
+		idField, _, _ := strings.Cut(string(line), ",")
+		id, err := strconv.Atoi(strings.TrimSpace(idField))
 		if err != nil {
-			continue // Skip lines with invalid IDs
+			row := SkippedRow{Line: lineNo, Offset: RecordOffset(offset), Key: strings.TrimSpace(idField)}
+			if err := addNullKey(tree, &report, row); err != nil {
+				return report, err
+			}
+		} else {
+			// Insert the ID as the key and the line's starting offset as the value
+			if err := tree.Insert(id, RecordOffset(offset)); err != nil {
+				return report, err
+			}
+			report.Indexed++
 		}
 
-		// Insert the ID as the key and the line's starting offset as the value
-		tree.Insert(id, RecordOffset(offset))
-
 		offset += int64(len(line)) + 1
 	}
-	return nil
+	return report, tree.SetDataFile(dataFilePath)
 }
 
 func readDataAtOffset(dataFilePath string, offset RecordOffset) (string, error) {
@@ -472,20 +1270,65 @@ func readDataAtOffset(dataFilePath string, offset RecordOffset) (string, error)
 	return string(line), nil
 }
 
+// runSubcommand dispatches the tool modes that run instead of the demo.
+func runSubcommand(name string, args []string) error {
+	switch name {
+	case "bench":
+		return benchCommand(args)
+	case "check":
+		return checkCommand(args)
+	default:
+		return fmt.Errorf("unknown command %q (available: bench, check)", name)
+	}
+}
+
 func main() {
+	// `go run . <command>` runs one of the tools instead of the demo below.
+	if len(os.Args) > 1 {
+		if err := runSubcommand(os.Args[1], os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	const dataFile = "users.csv"
 	const indexFile = "users_pk.idx"
 	degree := 4
-	tree := NewBPlusTree[int](degree)
+	tree := NewBPlusTree[int, RecordOffset](degree)
 
 	fmt.Println("--- Building B+ Tree index from users.csv ---")
-	if err := buildTreeFromFile(tree, dataFile); err != nil {
+	report, err := buildTreeFromFile(tree, dataFile)
+	if err != nil {
 		panic(err)
 	}
-	fmt.Println("Index built successfully in memory.")
+	fmt.Printf("Index built successfully in memory (%v).\n", report)
 
 	fmt.Println("\n--- Let's see the final tree structure ---")
 	tree.PrintTree()
+	fmt.Printf("Index statistics: %v\n", tree.Stats())
+
+	fmt.Println("\n--- Rows without a usable id, under each NULL key policy ---")
+	messyFile, err := os.CreateTemp("", "users-*.csv")
+	if err != nil {
+		panic(err)
+	}
+	defer os.Remove(messyFile.Name())
+	messyFile.WriteString("id,username,email\n17,quinn,quinn@example.com\n,rita,rita@example.com\nabc,sam,sam@example.com\n")
+	messyFile.Close()
+	for _, policy := range []NullKeyPolicy{NullKeySkip, NullKeyError, NullKeyIndex} {
+		messyTree := NewBPlusTree[int, RecordOffset](degree)
+		messyTree.SetNullKeyPolicy(policy)
+		report, err := buildTreeFromFile(messyTree, messyFile.Name())
+		switch {
+		case err != nil:
+			fmt.Printf("%-5v: the build fails: %v\n", policy, err)
+		case policy == NullKeyIndex:
+			fmt.Printf("%-5v: %v, NULL bucket offsets %v\n", policy, report, messyTree.Nulls())
+		default:
+			fmt.Printf("%-5v: %v %v\n", policy, report, report.Skipped)
+		}
+	}
 
 	fmt.Println("\n--- Use Case 1: Point Search (Find user with id=12) ---")
 	offset, found := tree.Search(12)
@@ -498,6 +1341,12 @@ func main() {
 	} else {
 		fmt.Println("Key 12 not found.")
 	}
+	if err := tree.Insert(12, offset); errors.Is(err, ErrDuplicateKey) {
+		fmt.Printf("Inserting id 12 again is rejected: %v\n", err)
+	}
+	if tree.Upsert(12, offset) {
+		fmt.Println("Upsert replaced the offset stored for id 12 instead.")
+	}
 
 	fmt.Println("\n--- Use Case 2: Range Search (Find users with id between 5 and 8) ---")
 	offsets := tree.SearchRange(5, 8)
@@ -507,6 +1356,34 @@ func main() {
 		fmt.Printf("  - Data at offset %d: %s\n", off, rowData)
 	}
 
+	fmt.Println("Second page of the same range, two records per page (LIMIT 2 OFFSET 2):")
+	for _, off := range tree.SearchRangeLimit(5, 8, 2, 2) {
+		rowData, _ := readDataAtOffset(dataFile, off)
+		fmt.Printf("  - Data at offset %d: %s\n", off, rowData)
+	}
+
+	agg := tree.AggregateRange(5, 8)
+	fmt.Printf("Aggregates over the same range, from the leaves alone: count=%d min=%d max=%d sum=%d\n",
+		agg.Count, agg.Min, agg.Max, SumRange(tree, 5, 8))
+
+	median, _ := tree.SelectNth(tree.Len() / 2)
+	fmt.Printf("Order statistics: %d ids are below 12, the median id is %d\n", tree.Rank(12), median)
+	minID, _ := tree.Min()
+	maxID, _ := tree.Max()
+	ceiling, _ := tree.Ceiling(0)
+	fmt.Printf("Smallest id %d, largest id %d, smallest id >= 0 is %d\n", minID, maxID, ceiling)
+
+	// A custom comparator gives a descending index on the same ids.
+	descending := NewBPlusTreeFunc[int, RecordOffset](tree.degree, func(a, b int) bool { return a > b })
+	for c := tree.Seek(minID); c.Next(); {
+		descending.Insert(c.Key(), c.Value())
+	}
+	var newest []int
+	for c := descending.Seek(maxID); len(newest) < 3 && c.Next(); {
+		newest = append(newest, c.Key())
+	}
+	fmt.Printf("A descending index returns the highest ids first: %v\n", newest)
+
 	fmt.Println("\n--- Use Case 3: Saving the index to a file ---")
 	if err := tree.SaveToFile(indexFile); err != nil {
 		panic(err)
@@ -514,7 +1391,7 @@ func main() {
 	fmt.Printf("Index saved to %s\n", indexFile)
 
 	fmt.Println("\n--- Use Case 4: Loading the index from file into a new tree ---")
-	loadedTree, err := LoadFromFile[int](indexFile)
+	loadedTree, err := LoadFromFile[int, RecordOffset](indexFile)
 	if err != nil {
 		panic(err)
 	}
@@ -535,4 +1412,13 @@ func main() {
 		rowData, _ := readDataAtOffset(dataFile, off)
 		fmt.Printf("  - Data: %s\n", rowData)
 	}
+
+	fmt.Println("\n--- Use Case 5: Tracing what a Delete does to the loaded tree ---")
+	loadedTree.SetTracer(NewLogTracer[int](os.Stdout))
+	for _, key := range []int{5, 6, 7} {
+		fmt.Printf("Delete(%d):\n", key)
+		loadedTree.Delete(key)
+	}
+	loadedTree.SetTracer(nil)
+	loadedTree.PrintTree()
 }
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// =================================================================================================
+// Merging Two Indexes
+// =================================================================================================
+
+// Merge combines two trees, such as ones built over two shards of a data file, the way the
+// on-disk version does (btree-index-advance-version/merge.go): it walks both leaf chains side by
+// side, like the merge step of a merge sort, and rebuilds the tree bottom-up from the combined
+// sequence, instead of inserting the other tree's keys one by one. Leaves are filled evenly, as
+// full as the degree allows, and every node gets its parent, next-leaf link and subtree size.
+
+// MergePolicy decides which value Merge keeps for a key both trees hold.
+type MergePolicy int
+
+const (
+	// MergeReject fails the merge with ErrDuplicateKey and leaves the tree unchanged.
+	MergeReject MergePolicy = iota
+	// MergeKeepExisting keeps the value of the tree being merged into.
+	MergeKeepExisting
+	// MergeKeepOther keeps the value of the tree merged in.
+	MergeKeepOther
+)
+
+var errMergeSelf = errors.New("cannot merge a tree with itself")
+
+// Merge adds every entry of other to the tree, resolving keys both hold by policy, and rebuilds
+// the tree bottom-up. other, which must use the same key order, is left unchanged, except that
+// the NULL buckets of both trees are combined.
+func (t *BPlusTree[K, V]) Merge(other *BPlusTree[K, V], policy MergePolicy) error {
+	if other == t {
+		return errMergeSelf
+	}
+	a, b := t.firstLeaf(), other.firstLeaf()
+	i, j := 0, 0
+	merged := make([]Entry[K, V], 0, t.Len()+other.Len())
+	for {
+		// Step over exhausted leaves.
+		for a != nil && i == len(a.keys) {
+			a, i = a.next, 0
+		}
+		for b != nil && j == len(b.keys) {
+			b, j = b.next, 0
+		}
+		switch {
+		case a == nil && b == nil:
+			// The entries are copied out, so the old nodes can be reused for the new ones.
+			t.releaseSubtree(t.root)
+			t.root = t.buildFromSorted(merged)
+			t.nulls = append(t.nulls, other.nulls...)
+			return nil
+		case b == nil || a != nil && t.less(a.keys[i], b.keys[j]):
+			merged = append(merged, Entry[K, V]{a.keys[i], a.values[i]})
+			i++
+		case a == nil || t.less(b.keys[j], a.keys[i]):
+			merged = append(merged, Entry[K, V]{b.keys[j], b.values[j]})
+			j++
+		default:
+			switch policy {
+			case MergeKeepExisting:
+				merged = append(merged, Entry[K, V]{a.keys[i], a.values[i]})
+			case MergeKeepOther:
+				merged = append(merged, Entry[K, V]{b.keys[j], b.values[j]})
+			default:
+				return fmt.Errorf("%w: %v", ErrDuplicateKey, a.keys[i])
+			}
+			i++
+			j++
+		}
+	}
+}
+
+// firstLeaf returns the leftmost leaf, or nil if the tree is empty.
+func (t *BPlusTree[K, V]) firstLeaf() *Node[K, V] {
+	node := t.root
+	for node != nil && !node.isLeaf {
+		node = node.children[0]
+	}
+	return node
+}
+
+// buildFromSorted builds the nodes of a tree holding entries, which are in key order without
+// duplicates, and returns its root, or nil if there are no entries.
+func (t *BPlusTree[K, V]) buildFromSorted(entries []Entry[K, V]) *Node[K, V] {
+	if len(entries) == 0 {
+		return nil
+	}
+	// Leaves, chained together. lowKeys holds the smallest key under each node of the level.
+	var level []*Node[K, V]
+	var lowKeys []K
+	start := 0
+	for _, size := range evenGroups(len(entries), t.degree-1) {
+		leaf := t.newNode(true)
+		leaf.size = size
+		for _, e := range entries[start : start+size] {
+			leaf.keys = append(leaf.keys, e.Key)
+			leaf.values = append(leaf.values, e.Value)
+		}
+		if len(level) > 0 {
+			level[len(level)-1].next = leaf
+		}
+		level = append(level, leaf)
+		lowKeys = append(lowKeys, leaf.keys[0])
+		t.traceWrite(leaf)
+		start += size
+	}
+
+	// Internal levels, until a single node is left. A separator is the smallest key under the
+	// child to its right.
+	for len(level) > 1 {
+		var parents []*Node[K, V]
+		var parentLowKeys []K
+		start := 0
+		for _, size := range evenGroups(len(level), t.degree) {
+			parent := t.newNode(false)
+			for k, child := range level[start : start+size] {
+				if k > 0 {
+					parent.keys = append(parent.keys, lowKeys[start+k])
+				}
+				parent.children = append(parent.children, child)
+				parent.size += child.size
+				child.parent = parent
+			}
+			parents = append(parents, parent)
+			parentLowKeys = append(parentLowKeys, lowKeys[start])
+			t.traceWrite(parent)
+			start += size
+		}
+		level, lowKeys = parents, parentLowKeys
+	}
+	return level[0]
+}
+
+// evenGroups splits n items into as few groups of at most maxPer items as possible, with sizes
+// differing by at most one. Every group but a single one is then at least half full.
+func evenGroups(n, maxPer int) []int {
+	groups := (n + maxPer - 1) / maxPer
+	sizes := make([]int, groups)
+	for i := range sizes {
+		sizes[i] = n / groups
+		if i < n%groups {
+			sizes[i]++
+		}
+	}
+	return sizes
+}
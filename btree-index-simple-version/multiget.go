@@ -0,0 +1,71 @@
+package main
+
+import "slices"
+
+// =================================================================================================
+// Batch Lookup
+// =================================================================================================
+
+// MultiGet resolves many keys in one left-to-right pass over the tree instead of one descent per
+// key, like the on-disk version (btree-index-advance-version/multiget.go): the keys are sorted,
+// each internal node splits them among its children by its separators, and only the children
+// that received keys are visited, so every node is visited at most once per batch.
+
+// MultiGet looks up every key, in any order, and returns their values and whether each was
+// found, at the same positions as the keys. A key may be requested more than once.
+func (t *BPlusTree[K, V]) MultiGet(keys []K) ([]V, []bool) {
+	values := make([]V, len(keys))
+	found := make([]bool, len(keys))
+	if t.root == nil || len(keys) == 0 {
+		return values, found
+	}
+	// order holds the positions of the keys, sorted by key.
+	order := make([]int, len(keys))
+	for i := range order {
+		order[i] = i
+	}
+	slices.SortFunc(order, func(a, b int) int {
+		switch {
+		case t.less(keys[a], keys[b]):
+			return -1
+		case t.less(keys[b], keys[a]):
+			return 1
+		}
+		return 0
+	})
+	t.multiGet(t.root, keys, order, values, found)
+	return values, found
+}
+
+// multiGet resolves the keys at the positions in order, sorted by key, all of which belong under
+// node.
+func (t *BPlusTree[K, V]) multiGet(node *Node[K, V], keys []K, order []int, values []V, found []bool) {
+	t.traceRead(node)
+	if node.isLeaf {
+		i := 0
+		for _, pos := range order {
+			for i < len(node.keys) && t.less(node.keys[i], keys[pos]) {
+				i++
+			}
+			if i == len(node.keys) {
+				return
+			}
+			if t.equal(node.keys[i], keys[pos]) {
+				values[pos], found[pos] = node.values[i], true
+			}
+		}
+		return
+	}
+	// Child i receives the keys below separator i, the last child the rest.
+	start := 0
+	for i := 0; i <= len(node.keys) && start < len(order); i++ {
+		end := start
+		for end < len(order) && (i == len(node.keys) || t.less(keys[order[end]], node.keys[i])) {
+			end++
+		}
+		if end > start {
+			t.multiGet(node.children[i], keys, order[start:end], values, found)
+		}
+		start = end
+	}
+}
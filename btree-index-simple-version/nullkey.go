@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// =================================================================================================
+// Rows without a Usable Key
+// =================================================================================================
+
+// A data file may have rows whose key column is empty (a NULL id) or doesn't parse as a key. SQL
+// databases keep such rows out of a unique index's key space but can still find them with
+// IS NULL, and a bulk load must decide what to do with them. NullKeyPolicy makes the decision
+// explicit, per index, instead of buildTreeFromFile dropping the rows without a word.
+
+// NullKeyPolicy says what building an index does with a row that has no usable key.
+type NullKeyPolicy int
+
+const (
+	// NullKeySkip leaves the row out of the index and reports it in the BuildReport.
+	NullKeySkip NullKeyPolicy = iota
+	// NullKeyError stops the build with ErrNullKey.
+	NullKeyError
+	// NullKeyIndex keeps the row's offset in the tree's NULL bucket (see Nulls).
+	NullKeyIndex
+)
+
+func (p NullKeyPolicy) String() string {
+	switch p {
+	case NullKeySkip:
+		return "skip"
+	case NullKeyError:
+		return "error"
+	case NullKeyIndex:
+		return "index"
+	}
+	return fmt.Sprintf("NullKeyPolicy(%d)", int(p))
+}
+
+// ErrNullKey is returned by a build under NullKeyError for a row without a usable key. It is
+// wrapped with the line, so compare with errors.Is.
+var ErrNullKey = errors.New("row has no usable key")
+
+// SetNullKeyPolicy sets what building the tree from a file does with rows without a usable key.
+// The default is NullKeySkip.
+func (t *BPlusTree[K, V]) SetNullKeyPolicy(policy NullKeyPolicy) {
+	t.nullPolicy = policy
+}
+
+// NullKeyPolicy returns the tree's policy for rows without a usable key.
+func (t *BPlusTree[K, V]) NullKeyPolicy() NullKeyPolicy {
+	return t.nullPolicy
+}
+
+// InsertNull adds a value without a key, such as the offset of a row without one, to the NULL
+// bucket. Unlike keys, any number of rows may be NULL.
+func (t *BPlusTree[K, V]) InsertNull(value V) {
+	t.nulls = append(t.nulls, value)
+}
+
+// Nulls returns the values in the NULL bucket, in the order they were inserted: for an Index, the
+// rows a WHERE id IS NULL query returns. Search, SearchRange and Len never see them.
+func (t *BPlusTree[K, V]) Nulls() []V {
+	return slices.Clone(t.nulls)
+}
+
+// SkippedRow is a row of a data file that a build left out of the index.
+type SkippedRow struct {
+	Line   int
+	Offset RecordOffset
+	Key    string // the key field as it appears in the file, empty if it is missing
+}
+
+func (r SkippedRow) String() string {
+	if r.Key == "" {
+		return fmt.Sprintf("line %d: missing key", r.Line)
+	}
+	return fmt.Sprintf("line %d: invalid key %q", r.Line, r.Key)
+}
+
+// BuildReport counts what building an index from a data file did with its rows.
+type BuildReport struct {
+	Rows    int // data rows read, not counting the header
+	Indexed int // rows inserted under their key
+	Nulls   int // rows added to the NULL bucket
+	Skipped []SkippedRow
+}
+
+func (r BuildReport) String() string {
+	return fmt.Sprintf("%d rows: %d indexed, %d NULL, %d skipped", r.Rows, r.Indexed, r.Nulls, len(r.Skipped))
+}
+
+// addNullKey applies the tree's policy to a row without a usable key. It is a function rather than
+// a method because only an Index stores the offsets of rows.
+func addNullKey[K any](t *Index[K], report *BuildReport, row SkippedRow) error {
+	switch t.nullPolicy {
+	case NullKeyError:
+		return fmt.Errorf("%w: %v", ErrNullKey, row)
+	case NullKeyIndex:
+		t.InsertNull(row.Offset)
+		report.Nulls++
+	default:
+		report.Skipped = append(report.Skipped, row)
+	}
+	return nil
+}
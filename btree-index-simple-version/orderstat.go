@@ -0,0 +1,112 @@
+package main
+
+// =================================================================================================
+// Order Statistics
+// =================================================================================================
+
+// Every node records the number of entries in its subtree, so an internal node knows how many
+// entries lie under each of its children. Descending the tree while adding up the sizes of the
+// children to the left of the path gives the position of a key in O(log n), and following the
+// sizes the other way finds the entry at a given position. This mirrors the per-child counts the
+// on-disk version stores in its internal pages (btree-index-advance-version/orderstat.go).
+
+// Len returns the number of keys in the tree.
+func (t *BPlusTree[K, V]) Len() int {
+	if t.root == nil {
+		return 0
+	}
+	return t.root.size
+}
+
+// Rank returns the number of keys smaller than key.
+func (t *BPlusTree[K, V]) Rank(key K) int {
+	return t.rank(key, false)
+}
+
+// rank returns the number of keys smaller than key, or smaller than or equal to it if inclusive.
+func (t *BPlusTree[K, V]) rank(key K, inclusive bool) int {
+	rank := 0
+	for node := t.root; node != nil; {
+		t.traceRead(node)
+		if node.isLeaf {
+			for _, k := range node.keys {
+				if t.less(key, k) || !inclusive && !t.less(k, key) {
+					break
+				}
+				rank++
+			}
+			break
+		}
+		// Children left of the one the key belongs in hold only smaller keys.
+		i := 0
+		for i < len(node.keys) && !t.less(key, node.keys[i]) {
+			rank += node.children[i].size
+			i++
+		}
+		node = node.children[i]
+	}
+	return rank
+}
+
+// SelectNth returns the n-th smallest key, counting from 0. It reports false if the tree holds
+// n or fewer keys.
+func (t *BPlusTree[K, V]) SelectNth(n int) (K, bool) {
+	var zero K
+	if t.root == nil || n < 0 || n >= t.root.size {
+		return zero, false
+	}
+	node, i := t.selectEntry(n)
+	return node.keys[i], true
+}
+
+// selectEntry returns the leaf holding the n-th smallest key and the key's index in it. n must be
+// a valid position.
+func (t *BPlusTree[K, V]) selectEntry(n int) (*Node[K, V], int) {
+	node := t.root
+	for !node.isLeaf {
+		t.traceRead(node)
+		i := 0
+		for n >= node.children[i].size {
+			n -= node.children[i].size
+			i++
+		}
+		node = node.children[i]
+	}
+	t.traceRead(node)
+	return node, n
+}
+
+// CountRange returns the number of keys in [startKey, endKey] from two descents of the tree,
+// without visiting the leaves in between.
+func (t *BPlusTree[K, V]) CountRange(startKey, endKey K) int {
+	if t.less(endKey, startKey) {
+		return 0
+	}
+	return t.rank(endKey, true) - t.rank(startKey, false)
+}
+
+// Min returns the smallest key. It reports false if the tree is empty.
+func (t *BPlusTree[K, V]) Min() (K, bool) {
+	return t.SelectNth(0)
+}
+
+// Max returns the largest key. It reports false if the tree is empty.
+func (t *BPlusTree[K, V]) Max() (K, bool) {
+	return t.SelectNth(t.Len() - 1)
+}
+
+// Floor returns the largest key <= key. Leaves are only linked forwards, so when that key sits
+// in the leaf before the one key belongs in, a leaf walk can't reach it; the rank can.
+func (t *BPlusTree[K, V]) Floor(key K) (K, bool) {
+	return t.SelectNth(t.rank(key, true) - 1)
+}
+
+// Ceiling returns the smallest key >= key.
+func (t *BPlusTree[K, V]) Ceiling(key K) (K, bool) {
+	c := t.Seek(key)
+	if !c.Next() {
+		var zero K
+		return zero, false
+	}
+	return c.Key(), true
+}
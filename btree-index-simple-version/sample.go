@@ -0,0 +1,30 @@
+package main
+
+import "math/rand"
+
+// =================================================================================================
+// Random Sampling
+// =================================================================================================
+
+// Sample draws entries uniformly at random without scanning the tree, like the on-disk version
+// (btree-index-advance-version/sample.go): each draw descends from the root choosing a child with
+// a probability proportional to its subtree size, which is the same as following SelectNth to a
+// random rank. Entries are drawn with replacement, and a seeded rng makes a sample reproducible.
+
+// Sample returns n entries chosen uniformly at random, with replacement, in the order they were
+// drawn. A nil rng uses the default source of math/rand. It returns nothing if the tree is empty.
+func (t *BPlusTree[K, V]) Sample(n int, rng *rand.Rand) []Entry[K, V] {
+	if n <= 0 || t.Len() == 0 {
+		return nil
+	}
+	intn := rand.Intn
+	if rng != nil {
+		intn = rng.Intn
+	}
+	sample := make([]Entry[K, V], 0, n)
+	for range n {
+		node, i := t.selectEntry(intn(t.Len()))
+		sample = append(sample, Entry[K, V]{node.keys[i], node.values[i]})
+	}
+	return sample
+}
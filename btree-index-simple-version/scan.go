@@ -0,0 +1,91 @@
+package main
+
+// =================================================================================================
+// Range Scans with Open, Closed and Missing Bounds
+// =================================================================================================
+
+// SearchRange includes both of its bounds, as BETWEEN does in SQL. Range takes RangeOptions to
+// leave either bound out, for the half-open ranges that pagination and time buckets use, or the
+// open ranges of a strict comparison:
+//
+//	tree.Range(5, 8, RangeOptions{})                                    // 5 <= key <= 8
+//	tree.Range(5, 8, RangeOptions{ExcludeEnd: true})                    // 5 <= key < 8
+//	tree.Range(5, 8, RangeOptions{ExcludeStart: true, ExcludeEnd: true}) // 5 < key < 8
+//
+// The scan starts at the first key at or after the start bound, found by the descent, rather than
+// at the start of its leaf, and stops at the first key past the end bound, without looking at the
+// rest of that leaf or the leaves after it.
+//
+// A range with only one bound, such as every id from 100 up, would need a made-up bound on the
+// other side, the largest or smallest key there could be, which K may not even have. ScanFrom and
+// ScanTo leave that side open instead, and ScanAll both:
+//
+//	tree.ScanFrom(100) // 100 <= key
+//	tree.ScanTo(100)   // key <= 100
+//	tree.ScanAll()     // every key
+
+// RangeOptions says which bounds of a Range are left out. The zero value includes both.
+type RangeOptions struct {
+	ExcludeStart bool // leave out startKey itself
+	ExcludeEnd   bool // leave out endKey itself
+}
+
+// Range returns the values of the keys between startKey and endKey, in key order, with the bounds
+// included or not as opts says. It returns nothing if endKey comes before startKey.
+func (t *BPlusTree[K, V]) Range(startKey, endKey K, opts RangeOptions) []V {
+	if t.less(endKey, startKey) {
+		return nil
+	}
+	var results []V
+	for c := t.Seek(startKey); c.Next(); {
+		k := c.Key()
+		if t.less(endKey, k) || opts.ExcludeEnd && !t.less(k, endKey) {
+			break
+		}
+		if opts.ExcludeStart && !t.less(startKey, k) {
+			continue
+		}
+		results = append(results, c.Value())
+	}
+	return results
+}
+
+// ScanFrom returns the values of key and every key after it, in key order.
+func (t *BPlusTree[K, V]) ScanFrom(key K) []V {
+	var results []V
+	for c := t.Seek(key); c.Next(); {
+		results = append(results, c.Value())
+	}
+	return results
+}
+
+// ScanTo returns the values of every key up to key, and of key itself, in key order.
+func (t *BPlusTree[K, V]) ScanTo(key K) []V {
+	var results []V
+	for c := t.first(); c.Next() && !t.less(key, c.Key()); {
+		results = append(results, c.Value())
+	}
+	return results
+}
+
+// ScanAll returns the values of every key, in key order.
+func (t *BPlusTree[K, V]) ScanAll() []V {
+	results := make([]V, 0, t.Len())
+	for c := t.first(); c.Next(); {
+		results = append(results, c.Value())
+	}
+	return results
+}
+
+// first returns a cursor positioned before the first entry of the tree.
+func (t *BPlusTree[K, V]) first() *Cursor[K, V] {
+	node := t.root
+	for node != nil {
+		t.traceRead(node)
+		if node.isLeaf {
+			break
+		}
+		node = node.children[0]
+	}
+	return &Cursor[K, V]{tree: t, node: node}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"math/rand"
+
+	"golang.org/x/exp/constraints"
+)
+
+// =================================================================================================
+// Skip List
+// =================================================================================================
+
+// A SkipList is an ordered index with the same Insert/Upsert/Search/SearchRange/Delete methods as
+// the B+ Tree, built on a different idea. It is a sorted linked list in which every node also
+// links forward on a random number of higher levels:
+//
+//	level 2:  head ----------------------> 7 ----------------------> nil
+//	level 1:  head --------> 3 ----------> 7 --------> 12 ---------> nil
+//	level 0:  head --> 1 --> 3 --> 5 --> 7 --> 9 --> 12 --> 15 --> nil
+//
+// A node reaches level i+1 with probability 1/2, so each level skips about half the nodes of the
+// one below it. A search starts at the top level of the head and moves right while the next key is
+// smaller than the one it looks for, then drops down a level, and ends on level 0 just before the
+// key. That visits O(log n) nodes on average, like a balanced tree, but the balance comes from the
+// coin flips: an insert or delete only relinks the neighbours of one node, with no splits, merges
+// or rotations. This is why LSM trees use skip lists as their memtable (see
+// lsm-index-version/memtable.go, which specializes the same structure to int keys).
+//
+// The price is that the O(log n) bound is an expectation rather than a guarantee, and that the
+// nodes are scattered in memory, while a B+ Tree keeps many keys per node.
+
+// skipListMaxLevel bounds the height of a node, which is plenty for 2^32 keys.
+const skipListMaxLevel = 32
+
+type skipListNode[K any] struct {
+	key    K
+	offset RecordOffset
+	next   []*skipListNode[K] // next[i] is the following node on level i
+}
+
+// SkipList maps unique keys to record offsets, in key order.
+type SkipList[K any] struct {
+	head  *skipListNode[K] // a sentinel before the first node, with a link on every level
+	level int              // the number of levels in use
+	len   int
+	less  func(a, b K) bool
+	rng   *rand.Rand
+}
+
+// NewSkipList creates an empty skip list.
+func NewSkipList[K constraints.Ordered]() *SkipList[K] {
+	return NewSkipListFunc(cmp.Less[K])
+}
+
+// NewSkipListFunc creates a skip list that orders its keys with less instead of the < operator,
+// with the same requirements as NewBPlusTreeFunc. Its node heights come from a fixed seed, so the
+// same sequence of operations always builds the same list.
+func NewSkipListFunc[K any](less func(a, b K) bool) *SkipList[K] {
+	return &SkipList[K]{
+		head:  &skipListNode[K]{next: make([]*skipListNode[K], skipListMaxLevel)},
+		level: 1,
+		less:  less,
+		rng:   rand.New(rand.NewSource(1)),
+	}
+}
+
+// Len returns the number of keys in the list.
+func (s *SkipList[K]) Len() int {
+	return s.len
+}
+
+// findPredecessors returns the first node with a key not less than key, or nil. If update isn't
+// nil, it is filled with the last node before that one on each level.
+func (s *SkipList[K]) findPredecessors(key K, update []*skipListNode[K]) *skipListNode[K] {
+	node := s.head
+	for level := s.level - 1; level >= 0; level-- {
+		for node.next[level] != nil && s.less(node.next[level].key, key) {
+			node = node.next[level]
+		}
+		if update != nil {
+			update[level] = node
+		}
+	}
+	return node.next[0]
+}
+
+// find returns the node holding key, or nil.
+func (s *SkipList[K]) find(key K) *skipListNode[K] {
+	if node := s.findPredecessors(key, nil); node != nil && !s.less(key, node.key) {
+		return node
+	}
+	return nil
+}
+
+// Search finds the offset associated with a given key.
+func (s *SkipList[K]) Search(key K) (RecordOffset, bool) {
+	if node := s.find(key); node != nil {
+		return node.offset, true
+	}
+	return 0, false
+}
+
+// SearchRange finds all records for keys within the given range [startKey, endKey].
+func (s *SkipList[K]) SearchRange(startKey, endKey K) []RecordOffset {
+	if s.less(endKey, startKey) {
+		return nil
+	}
+	var results []RecordOffset
+	for node := s.findPredecessors(startKey, nil); node != nil && !s.less(endKey, node.key); node = node.next[0] {
+		results = append(results, node.offset)
+	}
+	return results
+}
+
+// randomLevel returns the height of a new node: 1, then one more level with probability 1/2 each.
+func (s *SkipList[K]) randomLevel() int {
+	level := 1
+	for level < skipListMaxLevel && s.rng.Intn(2) == 0 {
+		level++
+	}
+	return level
+}
+
+// Insert adds a new key and its record offset. Like the B+ Tree's Insert, it returns
+// ErrDuplicateKey for a key that is already present and leaves the list unchanged.
+func (s *SkipList[K]) Insert(key K, offset RecordOffset) error {
+	var update [skipListMaxLevel]*skipListNode[K]
+	if node := s.findPredecessors(key, update[:]); node != nil && !s.less(key, node.key) {
+		return fmt.Errorf("%w: %v", ErrDuplicateKey, key)
+	}
+
+	level := s.randomLevel()
+	for ; s.level < level; s.level++ {
+		update[s.level] = s.head
+	}
+	node := &skipListNode[K]{key: key, offset: offset, next: make([]*skipListNode[K], level)}
+	for i := 0; i < level; i++ {
+		node.next[i] = update[i].next[i]
+		update[i].next[i] = node
+	}
+	s.len++
+	return nil
+}
+
+// Upsert inserts a key with its record offset, or replaces the offset if the key is already in
+// the list. It reports whether an existing offset was replaced.
+func (s *SkipList[K]) Upsert(key K, offset RecordOffset) bool {
+	if node := s.find(key); node != nil {
+		node.offset = offset
+		return true
+	}
+	s.Insert(key, offset) // can't fail, the key isn't present
+	return false
+}
+
+// Delete removes a key and its record offset from the list. It reports whether the key was present.
+func (s *SkipList[K]) Delete(key K) bool {
+	var update [skipListMaxLevel]*skipListNode[K]
+	node := s.findPredecessors(key, update[:])
+	if node == nil || s.less(key, node.key) {
+		return false
+	}
+	for i := range node.next {
+		update[i].next[i] = node.next[i]
+	}
+	for s.level > 1 && s.head.next[s.level-1] == nil {
+		s.level--
+	}
+	s.len--
+	return true
+}
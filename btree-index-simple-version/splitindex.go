@@ -0,0 +1,34 @@
+package main
+
+import "time"
+
+// =================================================================================================
+// Splitting an Index by Key Range
+// =================================================================================================
+
+// SplitAt cuts a tree in two at a key, for range-partitioning experiments, like the on-disk
+// version (btree-index-advance-version/splitindex.go), which writes each half to an index file.
+// Here the halves are new trees, built bottom-up from the leaf chain as Merge builds its result,
+// and SaveToFile writes them out. The tree itself is unchanged.
+
+// SplitAt returns a tree holding the entries with keys smaller than key and one holding the
+// others. Both have the tree's degree, key order and index information, with a new creation time.
+// The NULL bucket belongs to neither range and is left out.
+func (t *BPlusTree[K, V]) SplitAt(key K) (low, high *BPlusTree[K, V]) {
+	var entries []Entry[K, V]
+	for leaf := t.firstLeaf(); leaf != nil; leaf = leaf.next {
+		for i, k := range leaf.keys {
+			entries = append(entries, Entry[K, V]{k, leaf.values[i]})
+		}
+	}
+	cut := t.Rank(key)
+	return t.newSplit(entries[:cut]), t.newSplit(entries[cut:])
+}
+
+// newSplit returns a tree like t holding entries, which are in key order.
+func (t *BPlusTree[K, V]) newSplit(entries []Entry[K, V]) *BPlusTree[K, V] {
+	split := &BPlusTree[K, V]{degree: t.degree, less: t.less, nullPolicy: t.nullPolicy, info: t.info}
+	split.info.CreatedAt = time.Now().UTC()
+	split.root = split.buildFromSorted(entries)
+	return split
+}
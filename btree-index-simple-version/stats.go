@@ -0,0 +1,68 @@
+package main
+
+import "fmt"
+
+// =================================================================================================
+// Tree Statistics
+// =================================================================================================
+
+// TreeStats summarizes the shape of the tree and how well its nodes are used. The fields mirror
+// the statistics of the on-disk version (btree-index-advance-version/stats.go), with nodes in
+// place of pages.
+type TreeStats struct {
+	Height int
+	// NodesPerLevel holds the number of nodes on each level, starting with the root.
+	NodesPerLevel []int
+	Keys          int
+	// FillFactor is the average fraction of a node's capacity (degree-1 keys) in use.
+	FillFactor float64
+	// BytesOnDisk is the size of the index file SaveToFile writes for the tree.
+	BytesOnDisk int64
+}
+
+func (s TreeStats) String() string {
+	return fmt.Sprintf("height %d, nodes per level %v, %d keys, %.0f%% full, %d bytes on disk",
+		s.Height, s.NodesPerLevel, s.Keys, s.FillFactor*100, s.BytesOnDisk)
+}
+
+// Stats walks the tree level by level and collects its statistics. Computing BytesOnDisk
+// serializes the tree, so Stats takes time proportional to the size of the tree.
+func (t *BPlusTree[K, V]) Stats() TreeStats {
+	var stats TreeStats
+	if t.root == nil {
+		return stats
+	}
+	usedKeys, numNodes := 0, 0
+	for level := []*Node[K, V]{t.root}; len(level) > 0; {
+		var next []*Node[K, V]
+		for _, node := range level {
+			usedKeys += len(node.keys)
+			if node.isLeaf {
+				stats.Keys += len(node.keys)
+				continue
+			}
+			next = append(next, node.children...)
+		}
+		stats.Height++
+		stats.NodesPerLevel = append(stats.NodesPerLevel, len(level))
+		numNodes += len(level)
+		level = next
+	}
+	stats.FillFactor = float64(usedKeys) / float64(numNodes*(t.degree-1))
+
+	counter := &byteCounter{}
+	if err := t.SaveTo(counter); err == nil {
+		stats.BytesOnDisk = counter.n
+	}
+	return stats
+}
+
+// byteCounter is an io.Writer that only counts the bytes written to it.
+type byteCounter struct {
+	n int64
+}
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
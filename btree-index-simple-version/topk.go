@@ -0,0 +1,42 @@
+package main
+
+import "slices"
+
+// =================================================================================================
+// Top-K Queries
+// =================================================================================================
+
+// TopK answers leaderboard-style queries without scanning and sorting the whole tree, like the
+// on-disk version (btree-index-advance-version/topk.go): the k smallest keys are the first k
+// entries of the leaf chain, and the k largest the last k, which start at the key of rank
+// Len()-k, since leaves are only linked forwards.
+
+// Entry is a key and the value stored under it.
+type Entry[K, V any] struct {
+	Key   K
+	Value V
+}
+
+// TopK returns the k smallest keys with their values in ascending order, or the k largest in
+// descending order if desc. It returns every key if the tree holds k or fewer.
+func (t *BPlusTree[K, V]) TopK(k int, desc bool) []Entry[K, V] {
+	if k <= 0 {
+		return nil
+	}
+	rank := 0
+	if desc {
+		rank = max(t.Len()-k, 0)
+	}
+	start, ok := t.SelectNth(rank)
+	if !ok {
+		return nil
+	}
+	var top []Entry[K, V]
+	for c := t.Seek(start); len(top) < k && c.Next(); {
+		top = append(top, Entry[K, V]{c.Key(), c.Value()})
+	}
+	if desc {
+		slices.Reverse(top)
+	}
+	return top
+}
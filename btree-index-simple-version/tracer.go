@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"slices"
+)
+
+// =================================================================================================
+// Tracing Hooks
+// =================================================================================================
+
+// Tracer observes the structural changes the tree makes while it runs. It lets a
+// learning UI or a test harness follow exactly what each Insert/Delete does.
+//
+// This version keeps every node in memory, so a node stands in for a disk page:
+// OnPageRead fires whenever a node is visited and OnPageWrite whenever its
+// contents change. Every hook receives a copy of the keys involved.
+type Tracer[K any] interface {
+	// OnSplit fires after an overfull node has been split into left and right.
+	OnSplit(isLeaf bool, left, right []K)
+	// OnPromote fires when a key is pushed up into a parent. newRoot is true
+	// when the split node was the root and a new root had to be created.
+	OnPromote(key K, newRoot bool)
+	// OnMerge fires after an underfull node has been merged into its sibling.
+	OnMerge(isLeaf bool, merged []K)
+	OnPageRead(keys []K)
+	OnPageWrite(keys []K)
+}
+
+// SetTracer installs a tracer on the tree. Passing nil disables tracing.
+func (t *BPlusTree[K, V]) SetTracer(tracer Tracer[K]) {
+	t.tracer = tracer
+}
+
+func (t *BPlusTree[K, V]) traceRead(node *Node[K, V]) {
+	if t.tracer != nil {
+		t.tracer.OnPageRead(slices.Clone(node.keys))
+	}
+}
+
+func (t *BPlusTree[K, V]) traceWrite(node *Node[K, V]) {
+	if t.tracer != nil {
+		t.tracer.OnPageWrite(slices.Clone(node.keys))
+	}
+}
+
+// LogTracer is a Tracer that prints every event as a line of text.
+type LogTracer[K any] struct {
+	w io.Writer
+}
+
+// NewLogTracer creates a tracer that writes its events to w.
+func NewLogTracer[K any](w io.Writer) *LogTracer[K] {
+	return &LogTracer[K]{w: w}
+}
+
+func (l *LogTracer[K]) OnSplit(isLeaf bool, left, right []K) {
+	fmt.Fprintf(l.w, "  [trace] split %s: %v | %v\n", nodeKind(isLeaf), left, right)
+}
+
+func (l *LogTracer[K]) OnPromote(key K, newRoot bool) {
+	if newRoot {
+		fmt.Fprintf(l.w, "  [trace] promote %v into a new root\n", key)
+		return
+	}
+	fmt.Fprintf(l.w, "  [trace] promote %v into parent\n", key)
+}
+
+func (l *LogTracer[K]) OnMerge(isLeaf bool, merged []K) {
+	fmt.Fprintf(l.w, "  [trace] merge %s: %v\n", nodeKind(isLeaf), merged)
+}
+
+func (l *LogTracer[K]) OnPageRead(keys []K) {
+	fmt.Fprintf(l.w, "  [trace] read node %v\n", keys)
+}
+
+func (l *LogTracer[K]) OnPageWrite(keys []K) {
+	fmt.Fprintf(l.w, "  [trace] write node %v\n", keys)
+}
+
+func nodeKind(isLeaf bool) string {
+	if isLeaf {
+		return "leaf"
+	}
+	return "internal"
+}
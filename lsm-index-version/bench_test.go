@@ -0,0 +1,239 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// The benchmark suite runs with `go test -bench .`, or `go run . bench` (see bench.go). Each
+// benchmark has a sub-benchmark for every dataset size and insert order, named
+// LSM/<order>/<size>, and -sizes picks the sizes:
+//
+//	go test -run '^$' -bench Lookup -args -sizes 10000
+//
+// The datasets and metrics here mirror the benchmark suite of the on-disk B+ tree
+// (btree-index-advance-version/bench.go), so that the two sets of numbers can be compared side by
+// side. The B+ tree counts the pages each operation touches; the LSM tree reports the bytes each
+// insert writes to disk, log and compactions included, and the table blocks each read has to
+// load. A B+ tree insert writes back at least one whole page, so bytes/insert is best compared
+// with the B+ tree's pages/insert times 4096.
+
+var sizesFlag = flag.String("sizes", "", "comma-separated dataset sizes (default 10000,100000,1000000)")
+
+// benchRangeWidth is the number of consecutive keys read by each range scan.
+const benchRangeWidth = 1000
+
+var defaultBenchSizes = []int{10_000, 100_000, 1_000_000}
+
+// generateKeys returns the keys 0..n-1, either in ascending order or shuffled with a fixed seed
+// so that every run inserts them in the same order.
+func generateKeys(n int, random bool) []int {
+	if !random {
+		keys := make([]int, n)
+		for i := range keys {
+			keys[i] = i
+		}
+		return keys
+	}
+	return rand.New(rand.NewSource(42)).Perm(n)
+}
+
+// newBenchTree creates an empty tree in a fresh temporary directory. The returned cleanup
+// function closes the tree and removes the directory.
+func newBenchTree() (*LSMTree, func(), error) {
+	dir, err := os.MkdirTemp("", "bench-*.lsm")
+	if err != nil {
+		return nil, nil, err
+	}
+	tree, err := Open(dir, DefaultOptions)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, nil, err
+	}
+	cleanup := func() {
+		tree.Close()
+		os.RemoveAll(dir)
+	}
+	return tree, cleanup, nil
+}
+
+// buildBenchTree creates a tree holding the given keys. Each key's value is derived from the key.
+func buildBenchTree(keys []int) (*LSMTree, func(), error) {
+	tree, cleanup, err := newBenchTree()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, k := range keys {
+		if err := tree.Insert(k, int64(k)*10); err != nil {
+			cleanup()
+			return nil, nil, err
+		}
+	}
+	return tree, cleanup, nil
+}
+
+// benchmarkInsert measures inserting keys into an empty tree, including the flushes and
+// compactions they set off.
+func benchmarkInsert(keys []int) func(b *testing.B) {
+	return func(b *testing.B) {
+		var written int64
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			tree, cleanup, err := newBenchTree()
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.StartTimer()
+
+			for _, k := range keys {
+				if err := tree.Insert(k, int64(k)*10); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			b.StopTimer()
+			written += tree.Stats().BytesWritten
+			cleanup()
+			b.StartTimer()
+		}
+		inserts := float64(b.N * len(keys))
+		b.ReportMetric(inserts/b.Elapsed().Seconds(), "inserts/s")
+		b.ReportMetric(float64(written)/inserts, "bytes/insert")
+	}
+}
+
+func benchmarkLookup(tree *LSMTree, keys []int) func(b *testing.B) {
+	return func(b *testing.B) {
+		r := rand.New(rand.NewSource(7))
+		reads := tree.Stats().BlockReads
+
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			key := keys[r.Intn(len(keys))]
+			if _, found, err := tree.Search(key); err != nil || !found {
+				b.Fatalf("lookup of key %d failed: found=%v err=%v", key, found, err)
+			}
+		}
+		b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "lookups/s")
+		b.ReportMetric(float64(tree.Stats().BlockReads-reads)/float64(b.N), "blocks/lookup")
+	}
+}
+
+func benchmarkRangeScan(tree *LSMTree, n int) func(b *testing.B) {
+	return func(b *testing.B) {
+		r := rand.New(rand.NewSource(7))
+		width := min(benchRangeWidth, n)
+		reads := tree.Stats().BlockReads
+
+		b.ResetTimer()
+		scanned := 0
+		for i := 0; i < b.N; i++ {
+			start := r.Intn(n - width + 1)
+			results, err := tree.SearchRange(start, start+width-1)
+			if err != nil {
+				b.Fatal(err)
+			}
+			scanned += len(results)
+		}
+		b.ReportMetric(float64(scanned)/b.Elapsed().Seconds(), "keys/s")
+		b.ReportMetric(float64(tree.Stats().BlockReads-reads)/float64(b.N), "blocks/scan")
+	}
+}
+
+// runDatasets runs a sub-benchmark for every dataset size -sizes asks for, in both sequential and
+// random insert order. setup runs, untimed, the first time the sub-benchmark runs, so datasets
+// that -bench filters out are never built, and the cleanup it returns runs once the sub-benchmark
+// is done.
+func runDatasets(b *testing.B, setup func(keys []int) (func(b *testing.B), func(), error)) {
+	sizes := defaultBenchSizes
+	if *sizesFlag != "" {
+		var err error
+		if sizes, err = parseSizes(*sizesFlag); err != nil {
+			b.Fatal(err)
+		}
+	}
+	for _, n := range sizes {
+		for _, random := range []bool{false, true} {
+			order := "sequential"
+			if random {
+				order = "random"
+			}
+			var run func(b *testing.B)
+			cleanup := func() {}
+			b.Run(fmt.Sprintf("LSM/%s/%d", order, n), func(b *testing.B) {
+				if run == nil {
+					b.StopTimer()
+					bench, done, err := setup(generateKeys(n, random))
+					if err != nil {
+						b.Fatal(err)
+					}
+					run, cleanup = bench, done
+					b.StartTimer()
+				}
+				run(b)
+			})
+			cleanup()
+		}
+	}
+}
+
+// onTrees is the setup of benchmarks that read a tree holding the dataset, as the inserts left it
+// or, with compacted, after a full compaction.
+func onTrees(compacted bool, bench func(tree *LSMTree, keys []int) func(b *testing.B)) func(keys []int) (func(b *testing.B), func(), error) {
+	return func(keys []int) (func(b *testing.B), func(), error) {
+		tree, cleanup, err := buildBenchTree(keys)
+		if err != nil {
+			return nil, nil, err
+		}
+		if compacted {
+			if err := tree.Compact(); err != nil {
+				cleanup()
+				return nil, nil, err
+			}
+		}
+		return bench(tree, keys), cleanup, nil
+	}
+}
+
+func BenchmarkInsert(b *testing.B) {
+	runDatasets(b, func(keys []int) (func(b *testing.B), func(), error) {
+		return benchmarkInsert(keys), func() {}, nil
+	})
+}
+
+func BenchmarkLookup(b *testing.B) {
+	runDatasets(b, onTrees(false, benchmarkLookup))
+}
+
+func BenchmarkRangeScan(b *testing.B) {
+	runDatasets(b, onTrees(false, func(tree *LSMTree, keys []int) func(b *testing.B) {
+		return benchmarkRangeScan(tree, len(keys))
+	}))
+}
+
+func BenchmarkCompactedLookup(b *testing.B) {
+	runDatasets(b, onTrees(true, benchmarkLookup))
+}
+
+func BenchmarkCompactedRangeScan(b *testing.B) {
+	runDatasets(b, onTrees(true, func(tree *LSMTree, keys []int) func(b *testing.B) {
+		return benchmarkRangeScan(tree, len(keys))
+	}))
+}
+
+func parseSizes(s string) ([]int, error) {
+	var sizes []int
+	for _, part := range strings.Split(s, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid dataset size %q", part)
+		}
+		sizes = append(sizes, n)
+	}
+	return sizes, nil
+}
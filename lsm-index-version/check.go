@@ -0,0 +1,314 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"slices"
+)
+
+// =================================================================================================
+// --- check.go --- (Property Checks)
+// =================================================================================================
+
+// checkMemtableSize is tiny, so that a few hundred operations flush and compact many times.
+const checkMemtableSize = 16 * entryMemSize
+
+// referenceModel is the trivially correct model the tree is compared against.
+type referenceModel struct {
+	entries map[int]int64
+}
+
+// sortedKeys returns the model's keys in ascending order.
+func (m *referenceModel) sortedKeys() []int {
+	keys := make([]int, 0, len(m.entries))
+	for k := range m.entries {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// OrderedIndex is the interface the conformance checks are written against. It has the method set
+// of OrderedIndex in btree-index-advance-version, and checkConformance decodes operations as the
+// one there does, so the same byte input runs the same sequence against the LSM tree as against
+// the B+ tree and the other indexes of that module.
+type OrderedIndex interface {
+	Insert(key int, value int64) error
+	Search(key int) (int64, bool, error)
+	SearchRange(startKey, endKey int) ([]int64, error)
+	Delete(key int) (bool, error)
+	Len() (int, error)
+}
+
+var _ OrderedIndex = (*LSMTree)(nil)
+
+// fuzzOps decodes data as a sequence of operations, applies each one to a fresh tree in a
+// temporary directory and to the reference model, and compares the two after every operation.
+// Each operation takes three bytes: an opcode and two key bytes. One opcode reopens the tree,
+// after closing it or after a simulated crash, which leaves it to replay its log.
+func fuzzOps(data []byte) error {
+	dir, err := os.MkdirTemp("", "check-*.lsm")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	opts := Options{MemtableSize: checkMemtableSize}
+	tree, err := Open(dir, opts)
+	if err != nil {
+		return err
+	}
+	defer func() { tree.Close() }()
+	model := &referenceModel{entries: make(map[int]int64)}
+
+	for i := 0; i+2 < len(data); i += 3 {
+		// Keep keys in a small range so operations collide with existing keys often.
+		key := (int(data[i+1])<<8 | int(data[i+2])) % 512
+		value := int64(i)
+
+		var desc string
+		switch data[i] % 8 {
+		case 0, 1, 2:
+			desc = fmt.Sprintf("Insert(%d)", key)
+			if err := tree.Insert(key, value); err != nil {
+				return fmt.Errorf("op %d %s: %w", i/3, desc, err)
+			}
+			model.entries[key] = value
+		case 3, 4:
+			desc = fmt.Sprintf("Delete(%d)", key)
+			_, exists := model.entries[key]
+			deleted, err := tree.Delete(key)
+			if err != nil || deleted != exists {
+				return fmt.Errorf("op %d %s: returned (%v, %v), want %v", i/3, desc, deleted, err, exists)
+			}
+			delete(model.entries, key)
+		case 5:
+			desc = fmt.Sprintf("Search(%d)", key)
+			want, exists := model.entries[key]
+			got, found, err := tree.Search(key)
+			if err != nil || found != exists || got != want {
+				return fmt.Errorf("op %d %s: got (%d, %v, %v), want (%d, %v)", i/3, desc, got, found, err, want, exists)
+			}
+		case 6:
+			desc = "Compact"
+			if key%8 == 0 {
+				if err := tree.Compact(); err != nil {
+					return fmt.Errorf("op %d %s: %w", i/3, desc, err)
+				}
+			}
+		case 7:
+			desc = "reopen"
+			if key%4 == 0 {
+				// Every other reopen follows a simulated crash, which leaves the memtable to be
+				// rebuilt from the log.
+				closeTree := tree.Close
+				if key%8 == 4 {
+					desc, closeTree = "crash and reopen", tree.crash
+				}
+				if err := closeTree(); err != nil {
+					return fmt.Errorf("op %d %s: %w", i/3, desc, err)
+				}
+				if tree, err = Open(dir, opts); err != nil {
+					return fmt.Errorf("op %d %s: %w", i/3, desc, err)
+				}
+			}
+		}
+
+		if err := checkAgainstModel(tree, model); err != nil {
+			return fmt.Errorf("op %d %s: %w", i/3, desc, err)
+		}
+	}
+	return checkTiers(tree)
+}
+
+// fuzzConformance runs checkConformance on a fresh tree in a temporary directory. Its memtable is
+// tiny, so the sequence flushes and compacts it too, and its tiers are checked after every
+// operation.
+func fuzzConformance(data []byte) error {
+	dir, err := os.MkdirTemp("", "check-*.lsm")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	tree, err := Open(dir, Options{MemtableSize: checkMemtableSize})
+	if err != nil {
+		return err
+	}
+	defer tree.Close()
+	return checkConformance(tree, data, func() error { return checkTiers(tree) })
+}
+
+// checkConformance decodes data as a sequence of operations, applies each one to index and to the
+// reference model, and verifies after every operation that they agree and that invariants, the
+// checks specific to the implementation, hold. Each operation takes three bytes: an opcode and
+// two key bytes. Inserting a key that is already there must replace its value, as LSMTree.Insert
+// does, where the B+ tree fails with ErrDuplicateKey; the value is the same either way.
+func checkConformance(index OrderedIndex, data []byte, invariants func() error) error {
+	model := &referenceModel{entries: make(map[int]int64)}
+
+	for i := 0; i+2 < len(data); i += 3 {
+		key := int(data[i+1])<<8 | int(data[i+2])
+		// Keep keys in a small range so operations collide with existing keys often.
+		key %= 512
+		value := int64(key) * 10
+
+		var desc string
+		switch data[i] % 4 {
+		case 0, 1:
+			desc = fmt.Sprintf("Insert(%d)", key)
+			if err := index.Insert(key, value); err != nil {
+				return fmt.Errorf("op %d %s: %w", i/3, desc, err)
+			}
+			model.entries[key] = value
+		case 2:
+			desc = fmt.Sprintf("Delete(%d)", key)
+			_, exists := model.entries[key]
+			deleted, err := index.Delete(key)
+			if err != nil {
+				return fmt.Errorf("op %d %s: %w", i/3, desc, err)
+			}
+			if deleted != exists {
+				return fmt.Errorf("op %d %s: returned %v, want %v", i/3, desc, deleted, exists)
+			}
+			delete(model.entries, key)
+		case 3:
+			desc = fmt.Sprintf("Search(%d)", key)
+			want, exists := model.entries[key]
+			got, found, err := index.Search(key)
+			if err != nil {
+				return fmt.Errorf("op %d %s: %w", i/3, desc, err)
+			}
+			if found != exists || got != want {
+				return fmt.Errorf("op %d %s: got (%d, %v), want (%d, %v)", i/3, desc, got, found, want, exists)
+			}
+		}
+
+		if err := checkIndexAgainstModel(index, model); err != nil {
+			return fmt.Errorf("op %d %s: %w", i/3, desc, err)
+		}
+		if err := invariants(); err != nil {
+			return fmt.Errorf("op %d %s: %w", i/3, desc, err)
+		}
+	}
+	return nil
+}
+
+// checkIndexAgainstModel is checkAgainstModel through OrderedIndex: it verifies that the size, a
+// range scan over the model's keys and a point lookup of every key agree with the model.
+func checkIndexAgainstModel(index OrderedIndex, model *referenceModel) error {
+	keys := model.sortedKeys()
+	n, err := index.Len()
+	if err != nil {
+		return err
+	}
+	if n != len(keys) {
+		return fmt.Errorf("Len() = %d, want %d", n, len(keys))
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+
+	values, err := index.SearchRange(keys[0], keys[len(keys)-1])
+	if err != nil {
+		return err
+	}
+	if len(values) != len(keys) {
+		return fmt.Errorf("range scan returned %d records, want %d", len(values), len(keys))
+	}
+	for i, k := range keys {
+		if values[i] != model.entries[k] {
+			return fmt.Errorf("range scan returned value %d at position %d, want %d", values[i], i, model.entries[k])
+		}
+		got, found, err := index.Search(k)
+		if err != nil {
+			return err
+		}
+		if !found || got != model.entries[k] {
+			return fmt.Errorf("Search(%d) = (%d, %v), want (%d, true)", k, got, found, model.entries[k])
+		}
+	}
+	return nil
+}
+
+// crash closes the tree's files without flushing the memtable, as if the process had died.
+func (t *LSMTree) crash() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closed = true
+	return errors.Join(t.wal.file.Close(), t.closeTables())
+}
+
+// checkAgainstModel verifies that a full range scan and a point lookup of every key agree with the
+// model.
+func checkAgainstModel(tree *LSMTree, model *referenceModel) error {
+	keys := model.sortedKeys()
+	var got []int
+	var values []int64
+	if err := tree.Scan(-1<<20, 1<<20, func(key int, value int64) bool {
+		got = append(got, key)
+		values = append(values, value)
+		return true
+	}); err != nil {
+		return err
+	}
+	if !slices.Equal(got, keys) {
+		return fmt.Errorf("range scan returned keys %v, want %v", got, keys)
+	}
+	for i, k := range keys {
+		if values[i] != model.entries[k] {
+			return fmt.Errorf("range scan returned value %d for key %d, want %d", values[i], k, model.entries[k])
+		}
+		if value, found, err := tree.Search(k); err != nil || !found || value != model.entries[k] {
+			return fmt.Errorf("Search(%d) = (%d, %v, %v), want (%d, true)", k, value, found, err, model.entries[k])
+		}
+	}
+	return nil
+}
+
+// checkTiers verifies that the tables are ordered by tier and that no tier has been left with
+// enough tables to be compacted.
+func checkTiers(tree *LSMTree) error {
+	counts := make(map[int]int)
+	for i, table := range tree.tables {
+		if i > 0 && table.tier < tree.tables[i-1].tier {
+			return fmt.Errorf("table %s of tier %d comes after a table of tier %d", table.name, table.tier, tree.tables[i-1].tier)
+		}
+		counts[table.tier]++
+	}
+	if len(tree.tables) > 0 && counts[tree.tables[0].tier] >= compactionFanIn {
+		return fmt.Errorf("tier %d holds %d tables", tree.tables[0].tier, counts[tree.tables[0].tier])
+	}
+	return nil
+}
+
+// checkCommand implements `go run . check [-runs N] [-ops N] [-seed N]`. It feeds randomly
+// generated operation sequences to fuzzOps, and then to the conformance checks.
+func checkCommand(args []string) error {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	runs := flags.Int("runs", 50, "number of random operation sequences")
+	ops := flags.Int("ops", 500, "number of operations per sequence")
+	seed := flags.Int64("seed", 1, "random seed")
+	flags.Parse(args)
+
+	r := rand.New(rand.NewSource(*seed))
+	for run := 0; run < *runs; run++ {
+		data := make([]byte, *ops*3)
+		r.Read(data)
+		if err := fuzzOps(data); err != nil {
+			return fmt.Errorf("run %d (seed %d): %w", run, *seed, err)
+		}
+	}
+	fmt.Printf("%d runs of %d operations passed\n", *runs, *ops)
+
+	for run := 0; run < *runs; run++ {
+		data := make([]byte, *ops*3)
+		r.Read(data)
+		if err := fuzzConformance(data); err != nil {
+			return fmt.Errorf("conformance, run %d (seed %d): %w", run, *seed, err)
+		}
+	}
+	fmt.Printf("conformance: %d runs of %d operations passed\n", *runs, *ops)
+	return nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// testRuns and testOps are the number of random operation sequences each test runs and their
+// length; `go run . check` runs more of them.
+const (
+	testRuns = 10
+	testOps  = 500
+)
+
+// testSequences returns n random operation sequences of testOps operations each.
+func testSequences(r *rand.Rand, n int) [][]byte {
+	sequences := make([][]byte, n)
+	for i := range sequences {
+		sequences[i] = make([]byte, testOps*3)
+		r.Read(sequences[i])
+	}
+	return sequences
+}
+
+// TestOps runs fuzzOps on random operation sequences, with compactions, reopens and crashes.
+func TestOps(t *testing.T) {
+	for run, data := range testSequences(rand.New(rand.NewSource(1)), testRuns) {
+		if err := fuzzOps(data); err != nil {
+			t.Fatalf("run %d: %v", run, err)
+		}
+	}
+}
+
+// TestConformance runs the conformance suite of the B+ tree against a fresh tree.
+func TestConformance(t *testing.T) {
+	for run, data := range testSequences(rand.New(rand.NewSource(2)), testRuns) {
+		if err := fuzzConformance(data); err != nil {
+			t.Fatalf("run %d: %v", run, err)
+		}
+	}
+}
+
+// FuzzOps runs fuzzOps under `go test -fuzz FuzzOps`: data is the operation sequence, checked
+// against the reference model after every operation. The corpus starts with a random sequence.
+func FuzzOps(f *testing.F) {
+	f.Add(testSequences(rand.New(rand.NewSource(1)), 1)[0])
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if err := fuzzOps(data); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+// FuzzConformance runs fuzzConformance under `go test -fuzz FuzzConformance`, like FuzzOps.
+func FuzzConformance(f *testing.F) {
+	f.Add(testSequences(rand.New(rand.NewSource(2)), 1)[0])
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if err := fuzzConformance(data); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+)
+
+// =================================================================================================
+// --- compaction.go --- (Size-Tiered Compaction)
+// =================================================================================================
+
+// Every flush adds a table, and every table is one more place a lookup has to look, so tables are
+// merged into larger ones. This is size-tiered compaction: a flushed table is in tier 0, and once
+// compactionFanIn tables of one tier have built up, they are merged into a single table of the
+// next tier, about compactionFanIn times larger. That can fill the next tier in turn.
+//
+// Flushes add tables at the front of the list, and a merged table takes the place of the tables
+// it replaces, so the list stays ordered by tier, lowest and newest first. A tier can only fill
+// up when it is at the front, which is the only place maybeCompact has to look.
+//
+// Merging keeps the newest entry of each key. Tombstones are kept too, to go on shadowing the key
+// in older tables, except when the merged tables are the oldest ones, where there is nothing left
+// to shadow. Each entry is rewritten about once per tier, so with n entries a write costs
+// O(log n / log compactionFanIn) rewrites: the write amplification Stats reports.
+
+const compactionFanIn = 4
+
+// maybeCompact merges the tables of the front tier while it holds compactionFanIn tables. The
+// caller must hold t.mu.
+func (t *LSMTree) maybeCompact() error {
+	for {
+		n := 0
+		for n < len(t.tables) && t.tables[n].tier == t.tables[0].tier {
+			n++
+		}
+		if n < compactionFanIn {
+			return nil
+		}
+		if err := t.compact(n, t.tables[0].tier+1); err != nil {
+			return err
+		}
+	}
+}
+
+// Compact merges all the tables into one, which drops every tombstone and every overwritten
+// value, and makes every lookup that misses the memtable a single read.
+func (t *LSMTree) Compact() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return ErrClosed
+	}
+	if len(t.tables) < 2 {
+		return nil
+	}
+	return t.compact(len(t.tables), t.tables[len(t.tables)-1].tier)
+}
+
+// compact merges the n newest tables into one table of the given tier. The caller must hold t.mu.
+func (t *LSMTree) compact(n, tier int) error {
+	inputs := t.tables[:n]
+	sources := make([]iterator, n)
+	for i, table := range inputs {
+		sources[i] = table.iterator(math.MinInt)
+	}
+	table, err := t.writeTable(sources, tier, n == len(t.tables))
+	if err != nil {
+		return err
+	}
+
+	tables := make([]*sstable, 0, len(t.tables)-n+1)
+	if table != nil {
+		tables = append(tables, table)
+	}
+	t.tables = append(tables, t.tables[n:]...)
+	if err := t.writeManifest(); err != nil {
+		return err
+	}
+	var errs []error
+	for _, old := range inputs {
+		errs = append(errs, old.close(), os.Remove(filepath.Join(t.dir, old.name)))
+	}
+	return errors.Join(errs...)
+}
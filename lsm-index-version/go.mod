@@ -0,0 +1,3 @@
+module lsm-index-version
+
+go 1.24.2
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// =================================================================================================
+// --- lsm.go --- (Log-Structured Merge Tree)
+// =================================================================================================
+
+// An LSMTree indexes int keys to int64 values, like the B+ tree of btree-index-advance-version,
+// but never updates anything on disk in place:
+//
+//  1. A write is appended to the write-ahead log (wal.go) and put in the memtable (memtable.go).
+//  2. When the memtable reaches Options.MemtableSize, it is written out, in key order, as a new
+//     SSTable (sstable.go), and the log starts over.
+//  3. SSTables pile up, so they are merged from time to time into larger ones (compaction.go).
+//
+// Every write is therefore a sequential append, where a B+ tree insert reads the leaf holding the
+// key and writes the whole page back. The price is paid on reads: a key may be in the memtable or
+// in any table, newest first, and a range scan has to merge all of them (merge.go).
+//
+// The tree is a directory:
+//
+//	MANIFEST      the live tables, newest first, one "<tier> <file>" line each
+//	000001.sst    the tables
+//	wal.log       the log of the memtable
+//
+// The manifest is replaced with a rename, which is atomic, so a flush or a compaction takes effect
+// all at once. Tables that the manifest doesn't list are left over from one that crashed halfway,
+// and are removed when the tree is opened.
+
+const (
+	manifestFile = "MANIFEST"
+	walFile      = "wal.log"
+	tableSuffix  = ".sst"
+)
+
+var ErrClosed = errors.New("LSM tree is closed")
+
+// Options configures an LSMTree.
+type Options struct {
+	// MemtableSize is roughly how much memory the memtable takes up before it is flushed.
+	MemtableSize int64
+	// SyncWrites makes every write wait for its log record to reach the disk. Without it, the
+	// last writes before a machine crash can be lost, though not those before a process crash.
+	SyncWrites bool
+}
+
+var DefaultOptions = Options{MemtableSize: 4 << 20}
+
+// LSMTree is safe for concurrent use. Writes are serialized, and a write that fills the memtable
+// flushes it, and compacts if needed, before it returns.
+type LSMTree struct {
+	mu       sync.RWMutex
+	dir      string
+	opts     Options
+	mem      *memtable
+	wal      *wal
+	tables   []*sstable // newest first
+	nextFile int
+	closed   bool
+
+	// bytesWritten counts the bytes written to the log and to tables, to measure write
+	// amplification, and blockReads the table blocks read (see Stats).
+	bytesWritten int64
+	blockReads   atomic.Int64
+}
+
+// Open opens the tree in dir, creating it if needed, and replays its log.
+func Open(dir string, opts Options) (*LSMTree, error) {
+	if opts.MemtableSize <= 0 {
+		opts.MemtableSize = DefaultOptions.MemtableSize
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	t := &LSMTree{dir: dir, opts: opts, mem: newMemtable(), nextFile: 1}
+	if err := t.loadManifest(); err != nil {
+		t.closeTables()
+		return nil, err
+	}
+	if err := t.removeOrphans(); err != nil {
+		t.closeTables()
+		return nil, err
+	}
+	w, err := openWAL(filepath.Join(dir, walFile), opts.SyncWrites, t.mem.put)
+	if err != nil {
+		t.closeTables()
+		return nil, err
+	}
+	t.wal = w
+	return t, nil
+}
+
+// loadManifest opens the tables listed in the manifest.
+func (t *LSMTree) loadManifest() error {
+	file, err := os.Open(filepath.Join(t.dir, manifestFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var tier, number int
+		if _, err := fmt.Sscanf(scanner.Text(), "%d %06d"+tableSuffix, &tier, &number); err != nil {
+			return fmt.Errorf("manifest line %q: %w", scanner.Text(), err)
+		}
+		name := tableName(number)
+		table, err := openSSTable(filepath.Join(t.dir, name), name, tier, &t.blockReads)
+		if err != nil {
+			return err
+		}
+		t.tables = append(t.tables, table)
+		t.nextFile = max(t.nextFile, number+1)
+	}
+	return scanner.Err()
+}
+
+// removeOrphans removes the table files the manifest doesn't list.
+func (t *LSMTree) removeOrphans() error {
+	entries, err := os.ReadDir(t.dir)
+	if err != nil {
+		return err
+	}
+	live := make(map[string]bool, len(t.tables))
+	for _, table := range t.tables {
+		live[table.name] = true
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if (strings.HasSuffix(name, tableSuffix) && !live[name]) || strings.HasSuffix(name, ".tmp") {
+			if err := os.Remove(filepath.Join(t.dir, name)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func tableName(number int) string {
+	return fmt.Sprintf("%06d"+tableSuffix, number)
+}
+
+// writeManifest replaces the manifest with the current list of tables.
+func (t *LSMTree) writeManifest() error {
+	var b strings.Builder
+	for _, table := range t.tables {
+		fmt.Fprintf(&b, "%d %s\n", table.tier, table.name)
+	}
+	path := filepath.Join(t.dir, manifestFile)
+	if err := writeFileSync(path+".tmp", []byte(b.String())); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	return syncDir(t.dir)
+}
+
+func writeFileSync(path string, data []byte) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	return errors.Join(err, file.Close())
+}
+
+// syncDir makes the renames and removals in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	return errors.Join(d.Sync(), d.Close())
+}
+
+// Insert stores value under key. Unlike the B+ tree's Insert, it doesn't fail for a key that is
+// already there but replaces its value: finding out would take a read, and the point of the LSM
+// tree is that writes don't read.
+func (t *LSMTree) Insert(key int, value int64) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.write(entry{key: key, value: value})
+}
+
+// Delete removes key and reports whether it was present. The answer costs a lookup; the delete
+// itself is a tombstone written like any other entry.
+func (t *LSMTree) Delete(key int) (bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return false, ErrClosed
+	}
+	if _, found, err := t.get(key); err != nil || !found {
+		return false, err
+	}
+	return true, t.write(entry{key: key, deleted: true})
+}
+
+// write logs e and puts it in the memtable, flushing the memtable if it is full. The caller must
+// hold t.mu.
+func (t *LSMTree) write(e entry) error {
+	if t.closed {
+		return ErrClosed
+	}
+	if err := t.wal.append(e); err != nil {
+		return err
+	}
+	t.bytesWritten += walRecordSize
+	t.mem.put(e)
+	if t.mem.memSize() >= t.opts.MemtableSize {
+		return t.flush()
+	}
+	return nil
+}
+
+// Search returns the value stored under key.
+func (t *LSMTree) Search(key int) (int64, bool, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.closed {
+		return 0, false, ErrClosed
+	}
+	return t.get(key)
+}
+
+// get looks key up in the memtable, then in each table from newest to oldest, and stops at the
+// first entry it finds. The caller must hold t.mu.
+func (t *LSMTree) get(key int) (int64, bool, error) {
+	e, found := t.mem.get(key)
+	for i := 0; !found && i < len(t.tables); i++ {
+		var err error
+		if e, found, err = t.tables[i].get(key); err != nil {
+			return 0, false, err
+		}
+	}
+	if !found || e.deleted {
+		return 0, false, nil
+	}
+	return e.value, true, nil
+}
+
+// SearchRange returns the values stored under the keys from startKey to endKey, inclusive, in key
+// order.
+func (t *LSMTree) SearchRange(startKey, endKey int) ([]int64, error) {
+	var results []int64
+	err := t.Scan(startKey, endKey, func(key int, value int64) bool {
+		results = append(results, value)
+		return true
+	})
+	return results, err
+}
+
+// Len returns the number of keys in the tree. A table can't tell how many of its entries newer ones
+// replace or delete, so Len counts the keys with a full scan.
+func (t *LSMTree) Len() (int, error) {
+	n := 0
+	err := t.Scan(math.MinInt, math.MaxInt, func(int, int64) bool {
+		n++
+		return true
+	})
+	return n, err
+}
+
+// Scan calls fn for each key from startKey to endKey, inclusive, in key order, until fn returns
+// false.
+func (t *LSMTree) Scan(startKey, endKey int, fn func(key int, value int64) bool) error {
+	if startKey > endKey {
+		return nil
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.closed {
+		return ErrClosed
+	}
+	sources := []iterator{t.mem.iterator(startKey)}
+	for _, table := range t.tables {
+		if table.entries > 0 && table.lastKey >= startKey && table.index[0].firstKey <= endKey {
+			sources = append(sources, table.iterator(startKey))
+		}
+	}
+	it := newMergingIterator(sources)
+	for it.Next() && it.Entry().key <= endKey {
+		if e := it.Entry(); !e.deleted && !fn(e.key, e.value) {
+			return nil
+		}
+	}
+	return it.Err()
+}
+
+// Flush writes the memtable out to a new table, even if it isn't full.
+func (t *LSMTree) Flush() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return ErrClosed
+	}
+	return t.flush()
+}
+
+// flush writes the memtable to a tier-0 table, installs it and empties the log, then compacts
+// if that makes too many tables. The caller must hold t.mu.
+func (t *LSMTree) flush() error {
+	if t.mem.len == 0 {
+		return nil
+	}
+	// With no older table, there is nothing for a tombstone to shadow.
+	dropTombstones := len(t.tables) == 0
+	table, err := t.writeTable([]iterator{t.mem.iterator(math.MinInt)}, 0, dropTombstones)
+	if err != nil {
+		return err
+	}
+	if table != nil {
+		t.tables = append([]*sstable{table}, t.tables...)
+		if err := t.writeManifest(); err != nil {
+			return err
+		}
+	}
+	// The table is durable, so the log can go. Had the process crashed before this, the log would
+	// be replayed on top of the table, which only writes the same entries again.
+	if err := t.wal.reset(); err != nil {
+		return err
+	}
+	t.mem = newMemtable()
+	return t.maybeCompact()
+}
+
+// writeTable writes the merged entries of sources to a new table of the given tier and opens it.
+// It returns nil if there is nothing to write. The caller must hold t.mu.
+func (t *LSMTree) writeTable(sources []iterator, tier int, dropTombstones bool) (*sstable, error) {
+	name := tableName(t.nextFile)
+	t.nextFile++
+	path := filepath.Join(t.dir, name)
+	sw, err := newSSTableWriter(path + ".tmp")
+	if err != nil {
+		return nil, err
+	}
+	it := newMergingIterator(sources)
+	for it.Next() {
+		if e := it.Entry(); !e.deleted || !dropTombstones {
+			if err := sw.add(e); err != nil {
+				sw.abort()
+				return nil, err
+			}
+		}
+	}
+	if err := it.Err(); err != nil {
+		sw.abort()
+		return nil, err
+	}
+	if sw.entries == 0 {
+		sw.abort()
+		return nil, nil
+	}
+	size, err := sw.finish()
+	if err != nil {
+		os.Remove(path + ".tmp")
+		return nil, err
+	}
+	t.bytesWritten += size
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return nil, err
+	}
+	return openSSTable(path, name, tier, &t.blockReads)
+}
+
+// Close flushes the memtable and closes the tree's files.
+func (t *LSMTree) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return nil
+	}
+	err := t.flush()
+	t.closed = true
+	return errors.Join(err, t.wal.close(), t.closeTables())
+}
+
+func (t *LSMTree) closeTables() error {
+	var errs []error
+	for _, table := range t.tables {
+		errs = append(errs, table.close())
+	}
+	return errors.Join(errs...)
+}
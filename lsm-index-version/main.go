@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// =================================================================================================
+// --- main.go --- (Demonstration)
+// =================================================================================================
+
+func readDataAtOffset(dataFilePath string, offset int64) (string, error) {
+	file, err := os.Open(dataFilePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	_, err = file.Seek(offset, io.SeekStart)
+	if err != nil {
+		return "", err
+	}
+	line, _, err := bufio.NewReader(file).ReadLine()
+	if err != nil {
+		return "", err
+	}
+	return string(line), nil
+}
+
+// buildTreeFromFile indexes every row of a CSV file, after its header, by the integer id in its
+// first column.
+func buildTreeFromFile(tree *LSMTree, dataFilePath string) error {
+	file, err := os.Open(dataFilePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+	var offset int64
+	for lineNo := 1; ; lineNo++ {
+		line, err := r.ReadString('\n')
+		if line == "" && err == io.EOF {
+			return nil
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if lineNo > 1 {
+			idField, _, _ := strings.Cut(strings.TrimRight(line, "\r\n"), ",")
+			id, err := strconv.Atoi(idField)
+			if err != nil {
+				return fmt.Errorf("line %d: invalid id %q", lineNo, idField)
+			}
+			if err := tree.Insert(id, offset); err != nil {
+				return err
+			}
+		}
+		offset += int64(len(line))
+	}
+}
+
+// runSubcommand dispatches the tool modes that run instead of the demo.
+func runSubcommand(name string, args []string) error {
+	switch name {
+	case "bench":
+		return benchCommand(args)
+	case "check":
+		return checkCommand(args)
+	default:
+		return fmt.Errorf("unknown command %q (available: bench, check)", name)
+	}
+}
+
+func main() {
+	// `go run . <command>` runs one of the tools instead of the demo below.
+	if len(os.Args) > 1 {
+		if err := runSubcommand(os.Args[1], os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	const dataFile = "users.csv"
+	const indexDir = "users_pk.lsm"
+	// A memtable of 4 entries flushes after every few rows, so the demo ends up with several
+	// tables, and compactions, out of a small file.
+	opts := Options{MemtableSize: 4 * entryMemSize}
+
+	os.RemoveAll(indexDir)
+	tree, err := Open(indexDir, opts)
+	if err != nil {
+		panic(err)
+	}
+
+	fmt.Println("--- Building the LSM tree index from users.csv ---")
+	if err := buildTreeFromFile(tree, dataFile); err != nil {
+		panic(err)
+	}
+	fmt.Printf("Index statistics: %v\n", tree.Stats())
+
+	fmt.Println("\n--- Use Case 1: Point Search (Find user with id=12) ---")
+	offset, found, err := tree.Search(12)
+	if err != nil {
+		panic(err)
+	}
+	if found {
+		fmt.Printf("Found key 12. Stored offset is: %d\n", offset)
+		rowData, _ := readDataAtOffset(dataFile, offset)
+		fmt.Printf("Data at offset: %s\n", rowData)
+	} else {
+		fmt.Println("Key 12 not found.")
+	}
+
+	fmt.Println("\n--- Use Case 2: Range Search (Find users with id between 5 and 8) ---")
+	offsets, err := tree.SearchRange(5, 8)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Printf("Found %d records in range [5, 8]. Offsets: %v\n", len(offsets), offsets)
+	for _, off := range offsets {
+		rowData, _ := readDataAtOffset(dataFile, off)
+		fmt.Printf("  - Data at offset %d: %s\n", off, rowData)
+	}
+
+	fmt.Println("\n--- Use Case 3: Deletes are tombstones ---")
+	for _, key := range []int{6, 7} {
+		if _, err := tree.Delete(key); err != nil {
+			panic(err)
+		}
+	}
+	offsets, err = tree.SearchRange(5, 8)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Printf("After deleting ids 6 and 7, range [5, 8] holds %d records: %v\n", len(offsets), offsets)
+	fmt.Printf("The tombstones sit in the memtable: %v\n", tree.Stats())
+
+	fmt.Println("\n--- Use Case 4: Reopening replays the write-ahead log ---")
+	if err := tree.crash(); err != nil {
+		panic(err)
+	}
+	if tree, err = Open(indexDir, opts); err != nil {
+		panic(err)
+	}
+	_, found, err = tree.Search(6)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Printf("After a simulated crash, the replayed log still has id 6 deleted: found=%v\n", found)
+
+	fmt.Println("\n--- Use Case 5: A full compaction merges every table into one ---")
+	if err := tree.Flush(); err != nil {
+		panic(err)
+	}
+	if err := tree.Compact(); err != nil {
+		panic(err)
+	}
+	fmt.Printf("Index statistics: %v\n", tree.Stats())
+	if err := tree.Close(); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"math/rand"
+)
+
+// =================================================================================================
+// --- memtable.go --- (Memtable)
+// =================================================================================================
+
+// The memtable holds the most recent writes in memory, sorted by key, until it is large enough to
+// be flushed to an SSTable (see sstable.go). It is a skip list: a sorted linked list in which each
+// node also links forward on a random number of higher levels, every level skipping about half the
+// nodes of the one below. A search starts on the highest level and drops down a level whenever the
+// next node would overshoot, so it visits O(log n) nodes, like a balanced tree, without ever having
+// to rebalance. Inserting only relinks the neighbours of the new node.
+//
+// A delete is stored as an entry of its own, a tombstone, which shadows the key in older tables
+// until compaction drops both.
+
+const (
+	// skipListMaxLevel bounds the height of a node. Each level holds about half the nodes of the
+	// one below, so 16 levels keep searches fast up to 2^16 entries, a full memtable at the default
+	// size.
+	skipListMaxLevel = 16
+	// entryMemSize is roughly what an entry costs in memory, used to decide when to flush.
+	entryMemSize = 64
+)
+
+// entry is a key with its value, or with a tombstone if deleted is set.
+type entry struct {
+	key     int
+	value   int64
+	deleted bool
+}
+
+type skipNode struct {
+	entry
+	next []*skipNode
+}
+
+// memtable is a skip list of entries, one per key.
+type memtable struct {
+	head  *skipNode // a sentinel before the first node, as tall as the highest level
+	level int       // the number of levels in use
+	len   int
+	rng   *rand.Rand
+}
+
+func newMemtable() *memtable {
+	return &memtable{
+		head:  &skipNode{next: make([]*skipNode, skipListMaxLevel)},
+		level: 1,
+		rng:   rand.New(rand.NewSource(1)),
+	}
+}
+
+// randomLevel returns the height of a new node: 1, then one more level with probability 1/2 each.
+func (m *memtable) randomLevel() int {
+	level := 1
+	for level < skipListMaxLevel && m.rng.Intn(2) == 0 {
+		level++
+	}
+	return level
+}
+
+// findPredecessors fills update with the last node before key on each level and returns the first
+// node at or after key on the bottom level, or nil.
+func (m *memtable) findPredecessors(key int, update []*skipNode) *skipNode {
+	node := m.head
+	for level := m.level - 1; level >= 0; level-- {
+		for node.next[level] != nil && node.next[level].key < key {
+			node = node.next[level]
+		}
+		if update != nil {
+			update[level] = node
+		}
+	}
+	return node.next[0]
+}
+
+// put stores e, replacing the entry for the same key if there is one.
+func (m *memtable) put(e entry) {
+	var update [skipListMaxLevel]*skipNode
+	if node := m.findPredecessors(e.key, update[:]); node != nil && node.key == e.key {
+		node.entry = e
+		return
+	}
+
+	level := m.randomLevel()
+	for ; m.level < level; m.level++ {
+		update[m.level] = m.head
+	}
+	node := &skipNode{entry: e, next: make([]*skipNode, level)}
+	for i := 0; i < level; i++ {
+		node.next[i] = update[i].next[i]
+		update[i].next[i] = node
+	}
+	m.len++
+}
+
+// get returns the entry for key, which may be a tombstone.
+func (m *memtable) get(key int) (entry, bool) {
+	if node := m.findPredecessors(key, nil); node != nil && node.key == key {
+		return node.entry, true
+	}
+	return entry{}, false
+}
+
+// memSize estimates the memory the memtable's entries take up.
+func (m *memtable) memSize() int64 {
+	return int64(m.len) * entryMemSize
+}
+
+// iterator returns an iterator over the entries from the first key at or after start.
+func (m *memtable) iterator(start int) *memtableIterator {
+	return &memtableIterator{node: m.findPredecessors(start, nil)}
+}
+
+// memtableIterator walks the bottom level of the skip list.
+type memtableIterator struct {
+	node    *skipNode
+	current entry
+}
+
+func (it *memtableIterator) Next() bool {
+	if it.node == nil {
+		return false
+	}
+	it.current = it.node.entry
+	it.node = it.node.next[0]
+	return true
+}
+
+func (it *memtableIterator) Entry() entry { return it.current }
+func (it *memtableIterator) Err() error   { return nil }
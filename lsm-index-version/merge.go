@@ -0,0 +1,78 @@
+package main
+
+// =================================================================================================
+// --- merge.go --- (Merging Iterator)
+// =================================================================================================
+
+// A key may have entries in the memtable and in any number of SSTables, and the newest one wins.
+// Range scans and compactions both read through a mergingIterator, which merges sorted sources
+// into one sorted stream with a single entry per key: the one from the newest source that has the
+// key. Sources are given newest first, so on equal keys the one with the lowest index wins.
+
+// iterator is a sorted stream of entries. Next advances to the next entry and reports whether
+// there is one; Err returns the error that stopped it early, if any.
+type iterator interface {
+	Next() bool
+	Entry() entry
+	Err() error
+}
+
+type mergingIterator struct {
+	sources []iterator
+	heads   []entry // the current entry of each source
+	live    []bool  // whether the source still has a current entry
+	current entry
+	started bool
+	err     error
+}
+
+// newMergingIterator merges sources, newest first.
+func newMergingIterator(sources []iterator) *mergingIterator {
+	return &mergingIterator{
+		sources: sources,
+		heads:   make([]entry, len(sources)),
+		live:    make([]bool, len(sources)),
+	}
+}
+
+func (it *mergingIterator) advance(i int) {
+	if it.live[i] = it.sources[i].Next(); it.live[i] {
+		it.heads[i] = it.sources[i].Entry()
+	} else if err := it.sources[i].Err(); err != nil && it.err == nil {
+		it.err = err
+	}
+}
+
+func (it *mergingIterator) Next() bool {
+	if !it.started {
+		it.started = true
+		for i := range it.sources {
+			it.advance(i)
+		}
+	}
+	if it.err != nil {
+		return false
+	}
+	// There are only a handful of sources, so a linear scan for the smallest key is cheaper than
+	// keeping them in a heap.
+	smallest := -1
+	for i, live := range it.live {
+		if live && (smallest == -1 || it.heads[i].key < it.heads[smallest].key) {
+			smallest = i
+		}
+	}
+	if smallest == -1 {
+		return false
+	}
+	it.current = it.heads[smallest]
+	// Older entries for the same key are shadowed.
+	for i, live := range it.live {
+		if live && it.heads[i].key == it.current.key {
+			it.advance(i)
+		}
+	}
+	return it.err == nil
+}
+
+func (it *mergingIterator) Entry() entry { return it.current }
+func (it *mergingIterator) Err() error   { return it.err }
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"sort"
+	"sync/atomic"
+)
+
+// =================================================================================================
+// --- sstable.go --- (Sorted String Tables)
+// =================================================================================================
+
+// An SSTable is an immutable file of entries sorted by key, written once from a flushed memtable
+// or a compaction and never modified:
+//
+//	| data block | data block | ... | index | footer |
+//
+//	data block:  | entry | entry | ... | checksum uint32 |, at most sstableBlockSize bytes
+//	entry:       | key int64 | value int64 | flags uint8 |
+//	index:       | first key int64 | offset int64 | entry count uint32 | for each block
+//	footer:      | index offset int64 | block count uint32 | entry count uint64 | last key int64 | magic uint32 |
+//
+// The block checksum is the CRC-32 of the block's entries. The index is sparse: it holds only the
+// first key of each block, and is loaded into memory when the table is opened. A lookup binary
+// searches it for the one block that can hold the key, reads that block and binary searches its
+// entries, so it costs one read however large the table is. The last key in the footer lets a
+// lookup skip a table whose keys are all smaller without reading anything.
+
+const (
+	sstableBlockSize  = 4096
+	entrySize         = 8 + 8 + 1
+	entriesPerBlock   = (sstableBlockSize - 4) / entrySize
+	indexEntrySize    = 8 + 8 + 4
+	sstableFooterSize = 8 + 4 + 8 + 8 + 4
+	sstableMagic      = 0x4C534D54 // "LSMT"
+)
+
+var ErrCorruptTable = errors.New("corrupt SSTable")
+
+func encodeEntry(buf []byte, e entry) {
+	binary.LittleEndian.PutUint64(buf[0:], uint64(e.key))
+	binary.LittleEndian.PutUint64(buf[8:], uint64(e.value))
+	buf[16] = 0
+	if e.deleted {
+		buf[16] = flagTombstone
+	}
+}
+
+func decodeEntry(buf []byte) entry {
+	return entry{
+		key:     int(int64(binary.LittleEndian.Uint64(buf[0:]))),
+		value:   int64(binary.LittleEndian.Uint64(buf[8:])),
+		deleted: buf[16]&flagTombstone != 0,
+	}
+}
+
+// blockHandle is an index entry: where a data block is and the first key in it.
+type blockHandle struct {
+	firstKey int
+	offset   int64
+	entries  int
+}
+
+func (h blockHandle) size() int64 { return int64(h.entries)*entrySize + 4 }
+
+// --- Writing ---
+
+// sstableWriter writes the entries it is given, in ascending key order, to a new SSTable.
+type sstableWriter struct {
+	file    *os.File
+	w       *bufio.Writer
+	block   []byte
+	index   []blockHandle
+	offset  int64 // where the current block starts
+	entries int
+	lastKey int
+}
+
+func newSSTableWriter(path string) (*sstableWriter, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &sstableWriter{
+		file:  file,
+		w:     bufio.NewWriterSize(file, 64*1024),
+		block: make([]byte, 0, sstableBlockSize),
+	}, nil
+}
+
+// add appends e, whose key must be greater than that of the entry added before it.
+func (sw *sstableWriter) add(e entry) error {
+	if sw.entries > 0 && e.key <= sw.lastKey {
+		return fmt.Errorf("sstable: key %d added after key %d", e.key, sw.lastKey)
+	}
+	if len(sw.block) == 0 {
+		sw.index = append(sw.index, blockHandle{firstKey: e.key, offset: sw.offset})
+	}
+	sw.block = sw.block[:len(sw.block)+entrySize]
+	encodeEntry(sw.block[len(sw.block)-entrySize:], e)
+	sw.index[len(sw.index)-1].entries++
+	sw.entries++
+	sw.lastKey = e.key
+	if len(sw.block)+entrySize > sstableBlockSize-4 {
+		return sw.finishBlock()
+	}
+	return nil
+}
+
+func (sw *sstableWriter) finishBlock() error {
+	if len(sw.block) == 0 {
+		return nil
+	}
+	sw.block = binary.LittleEndian.AppendUint32(sw.block, crc32.ChecksumIEEE(sw.block))
+	if _, err := sw.w.Write(sw.block); err != nil {
+		return err
+	}
+	sw.offset += int64(len(sw.block))
+	sw.block = sw.block[:0]
+	return nil
+}
+
+// finish writes the index and the footer, syncs the file and closes it. It returns the size of
+// the table.
+func (sw *sstableWriter) finish() (int64, error) {
+	err := sw.finishBlock()
+	if err == nil {
+		buf := make([]byte, 0, len(sw.index)*indexEntrySize+sstableFooterSize)
+		for _, h := range sw.index {
+			buf = binary.LittleEndian.AppendUint64(buf, uint64(h.firstKey))
+			buf = binary.LittleEndian.AppendUint64(buf, uint64(h.offset))
+			buf = binary.LittleEndian.AppendUint32(buf, uint32(h.entries))
+		}
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(sw.offset))
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(sw.index)))
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(sw.entries))
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(sw.lastKey))
+		buf = binary.LittleEndian.AppendUint32(buf, sstableMagic)
+		_, err = sw.w.Write(buf)
+		sw.offset += int64(len(buf))
+	}
+	if err == nil {
+		err = sw.w.Flush()
+	}
+	if err == nil {
+		err = sw.file.Sync()
+	}
+	return sw.offset, errors.Join(err, sw.file.Close())
+}
+
+// abort closes and removes a table that won't be finished.
+func (sw *sstableWriter) abort() {
+	sw.file.Close()
+	os.Remove(sw.file.Name())
+}
+
+// --- Reading ---
+
+// sstable is an open SSTable.
+type sstable struct {
+	file    *os.File
+	name    string // the file name, relative to the tree's directory
+	tier    int    // see compaction.go
+	size    int64
+	index   []blockHandle
+	entries int
+	lastKey int
+	reads   *atomic.Int64 // counts the blocks read, for Stats
+}
+
+// openSSTable opens the table at path and loads its index. Block reads are counted in reads.
+func openSSTable(path, name string, tier int, reads *atomic.Int64) (*sstable, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	t, err := loadSSTable(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	t.name, t.tier, t.reads = name, tier, reads
+	return t, nil
+}
+
+func loadSSTable(file *os.File) (*sstable, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+	if size < sstableFooterSize {
+		return nil, fmt.Errorf("%w: file of %d bytes is too small", ErrCorruptTable, size)
+	}
+	footer := make([]byte, sstableFooterSize)
+	if _, err := file.ReadAt(footer, size-sstableFooterSize); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(footer[28:]) != sstableMagic {
+		return nil, fmt.Errorf("%w: bad magic number", ErrCorruptTable)
+	}
+	indexOffset := int64(binary.LittleEndian.Uint64(footer[0:]))
+	blocks := int(binary.LittleEndian.Uint32(footer[8:]))
+	if indexOffset < 0 || indexOffset+int64(blocks)*indexEntrySize != size-sstableFooterSize {
+		return nil, fmt.Errorf("%w: index doesn't fit the file", ErrCorruptTable)
+	}
+
+	buf := make([]byte, blocks*indexEntrySize)
+	if _, err := file.ReadAt(buf, indexOffset); err != nil {
+		return nil, err
+	}
+	t := &sstable{
+		file:    file,
+		size:    size,
+		index:   make([]blockHandle, blocks),
+		entries: int(binary.LittleEndian.Uint64(footer[12:])),
+		lastKey: int(int64(binary.LittleEndian.Uint64(footer[20:]))),
+	}
+	for i := range t.index {
+		b := buf[i*indexEntrySize:]
+		t.index[i] = blockHandle{
+			firstKey: int(int64(binary.LittleEndian.Uint64(b[0:]))),
+			offset:   int64(binary.LittleEndian.Uint64(b[8:])),
+			entries:  int(binary.LittleEndian.Uint32(b[16:])),
+		}
+		if h := t.index[i]; h.entries == 0 || h.entries > entriesPerBlock || h.offset < 0 || h.offset+h.size() > indexOffset {
+			return nil, fmt.Errorf("%w: index entry %d is out of bounds", ErrCorruptTable, i)
+		}
+	}
+	return t, nil
+}
+
+// readBlock reads and verifies block i, returning its entries.
+func (t *sstable) readBlock(i int) ([]byte, error) {
+	h := t.index[i]
+	t.reads.Add(1)
+	block := make([]byte, h.size())
+	if _, err := t.file.ReadAt(block, h.offset); err != nil {
+		return nil, err
+	}
+	entries := block[:len(block)-4]
+	if binary.LittleEndian.Uint32(block[len(entries):]) != crc32.ChecksumIEEE(entries) {
+		return nil, fmt.Errorf("%w: block %d of %s fails its checksum", ErrCorruptTable, i, t.name)
+	}
+	return entries, nil
+}
+
+// findBlock returns the block that would hold key, or -1 if key comes before the first block.
+func (t *sstable) findBlock(key int) int {
+	return sort.Search(len(t.index), func(i int) bool { return t.index[i].firstKey > key }) - 1
+}
+
+// get returns the entry for key, which may be a tombstone.
+func (t *sstable) get(key int) (entry, bool, error) {
+	if len(t.index) == 0 || key > t.lastKey {
+		return entry{}, false, nil
+	}
+	i := t.findBlock(key)
+	if i < 0 {
+		return entry{}, false, nil
+	}
+	block, err := t.readBlock(i)
+	if err != nil {
+		return entry{}, false, err
+	}
+	n := len(block) / entrySize
+	j := sort.Search(n, func(j int) bool { return decodeEntry(block[j*entrySize:]).key >= key })
+	if j < n {
+		if e := decodeEntry(block[j*entrySize:]); e.key == key {
+			return e, true, nil
+		}
+	}
+	return entry{}, false, nil
+}
+
+// iterator returns an iterator over the entries from the first key at or after start.
+func (t *sstable) iterator(start int) *sstableIterator {
+	return &sstableIterator{table: t, block: max(t.findBlock(start), 0) - 1, start: start}
+}
+
+func (t *sstable) close() error {
+	return t.file.Close()
+}
+
+// sstableIterator reads a table's blocks in order, one at a time.
+type sstableIterator struct {
+	table   *sstable
+	block   int    // the block being read
+	entries []byte // the entries of that block not returned yet
+	start   int
+	current entry
+	err     error
+}
+
+func (it *sstableIterator) Next() bool {
+	for it.err == nil {
+		for len(it.entries) > 0 {
+			it.current = decodeEntry(it.entries)
+			it.entries = it.entries[entrySize:]
+			if it.current.key >= it.start {
+				return true
+			}
+		}
+		if it.block+1 >= len(it.table.index) {
+			return false
+		}
+		it.block++
+		it.entries, it.err = it.table.readBlock(it.block)
+	}
+	return false
+}
+
+func (it *sstableIterator) Entry() entry { return it.current }
+func (it *sstableIterator) Err() error   { return it.err }
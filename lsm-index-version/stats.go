@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// =================================================================================================
+// --- stats.go --- (Statistics)
+// =================================================================================================
+
+// Stats describes the shape of an LSMTree and the I/O it has done since it was opened.
+type Stats struct {
+	MemtableEntries int
+	Tables          []TableStats // newest first
+	BytesWritten    int64        // written to the log and to tables, flushes and compactions alike
+	BlockReads      int64        // table blocks read by lookups, scans and compactions
+}
+
+// TableStats describes one SSTable.
+type TableStats struct {
+	Name    string
+	Tier    int
+	Entries int // tombstones included
+	Size    int64
+}
+
+// Stats returns the tree's current statistics.
+func (t *LSMTree) Stats() Stats {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	s := Stats{
+		MemtableEntries: t.mem.len,
+		BytesWritten:    t.bytesWritten,
+		BlockReads:      t.blockReads.Load(),
+	}
+	for _, table := range t.tables {
+		s.Tables = append(s.Tables, TableStats{Name: table.name, Tier: table.tier, Entries: table.entries, Size: table.size})
+	}
+	return s
+}
+
+func (s Stats) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "memtable: %d entries, %d tables:", s.MemtableEntries, len(s.Tables))
+	for _, t := range s.Tables {
+		fmt.Fprintf(&b, " %s (tier %d, %d entries, %d bytes)", t.Name, t.Tier, t.Entries, t.Size)
+	}
+	fmt.Fprintf(&b, "; %d bytes written, %d blocks read", s.BytesWritten, s.BlockReads)
+	return b.String()
+}
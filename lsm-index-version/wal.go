@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// =================================================================================================
+// --- wal.go --- (Write-Ahead Log)
+// =================================================================================================
+
+// The memtable lives in memory, so every write is first appended to the write-ahead log, and a
+// tree that is reopened after a crash replays the log into a new memtable. Each record is
+//
+//	| checksum uint32 | key int64 | value int64 | flags uint8 |
+//
+// where the checksum is the CRC-32 of the rest of the record and flag 1 marks a tombstone. A
+// record whose checksum doesn't match, or that is cut short, is the tail of a write interrupted
+// by a crash: replay stops there and the log is truncated to the records before it.
+//
+// Once the memtable has been flushed to an SSTable, its records are no longer needed and the log
+// starts over empty.
+
+const (
+	walRecordSize = 4 + entrySize
+	flagTombstone = 1
+)
+
+var errCorruptWALRecord = errors.New("corrupt WAL record")
+
+// wal is the write-ahead log of the current memtable.
+type wal struct {
+	file *os.File
+	sync bool // fsync after every record
+	size int64
+}
+
+// openWAL opens the log at path, creating it if needed, and calls replay for each of its records.
+func openWAL(path string, sync bool, replay func(e entry)) (*wal, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	var size int64
+	r := bufio.NewReader(file)
+	for {
+		e, err := readWALRecord(r)
+		if err == io.EOF || err == io.ErrUnexpectedEOF || err == errCorruptWALRecord {
+			break
+		}
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		replay(e)
+		size += walRecordSize
+	}
+	// Drop a torn tail, so that new records follow the last complete one.
+	if err := file.Truncate(size); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, err := file.Seek(size, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &wal{file: file, sync: sync, size: size}, nil
+}
+
+func readWALRecord(r io.Reader) (entry, error) {
+	var record [walRecordSize]byte
+	if _, err := io.ReadFull(r, record[:]); err != nil {
+		return entry{}, err
+	}
+	if binary.LittleEndian.Uint32(record[:4]) != crc32.ChecksumIEEE(record[4:]) {
+		return entry{}, errCorruptWALRecord
+	}
+	return decodeEntry(record[4:]), nil
+}
+
+// append logs e.
+func (w *wal) append(e entry) error {
+	var record [walRecordSize]byte
+	encodeEntry(record[4:], e)
+	binary.LittleEndian.PutUint32(record[:4], crc32.ChecksumIEEE(record[4:]))
+	if _, err := w.file.Write(record[:]); err != nil {
+		return err
+	}
+	w.size += walRecordSize
+	if w.sync {
+		return w.file.Sync()
+	}
+	return nil
+}
+
+// reset empties the log, once its records are safely in an SSTable.
+func (w *wal) reset() error {
+	if err := w.file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := w.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	w.size = 0
+	return w.file.Sync()
+}
+
+func (w *wal) close() error {
+	return errors.Join(w.file.Sync(), w.file.Close())
+}